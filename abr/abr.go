@@ -0,0 +1,182 @@
+//Package abr groups several encodes of one event into an adaptive bitrate presentation,
+//hls and dash serve the group by its own stream name
+package abr
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/use-go/websocket-streamserver/mediatype/aac"
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/mediatype/h264"
+)
+
+const defaultSegmentMs = 6000
+
+//Group renditions of one event,e.g. live/event -> live/event_1080,live/event_720,
+//encoders must output the same timestamps and keyframes at the same time for every rendition
+type Group struct {
+	Name       string   `json:"Name"`
+	Renditions []string `json:"Renditions"`
+	//segments start at the first keyframe after every SegmentMs of timestamp
+	SegmentMs int `json:"SegmentMs,omitempty"`
+}
+
+//Check trim the names and set defaults,a stream belongs to one group at most
+func Check(groups []Group) (err error) {
+	names := make(map[string]bool)
+	for i := range groups {
+		group := &groups[i]
+		group.Name = strings.Trim(group.Name, "/")
+		if len(group.Name) == 0 || len(group.Renditions) == 0 {
+			return errors.New("invalid abr group:" + group.Name)
+		}
+		if group.SegmentMs <= 0 {
+			group.SegmentMs = defaultSegmentMs
+		}
+		if names[group.Name] {
+			return errors.New("abr stream repeated:" + group.Name)
+		}
+		names[group.Name] = true
+		for j, rendition := range group.Renditions {
+			rendition = strings.Trim(rendition, "/")
+			if names[rendition] {
+				return errors.New("abr stream repeated:" + rendition)
+			}
+			names[rendition] = true
+			group.Renditions[j] = rendition
+		}
+	}
+	return
+}
+
+//Find the group named name,nil if not a group
+func Find(groups []Group, name string) *Group {
+	for i := range groups {
+		if groups[i].Name == name {
+			return &groups[i]
+		}
+	}
+	return nil
+}
+
+//Of the group streamName is a rendition of,nil if none
+func Of(groups []Group, streamName string) *Group {
+	for i := range groups {
+		for _, rendition := range groups[i].Renditions {
+			if rendition == streamName {
+				return &groups[i]
+			}
+		}
+	}
+	return nil
+}
+
+//Aligner 每个SegmentMs 时间窗口的第一个关键帧切分,序号为窗口序号,
+//同一组的码率关键帧时间相同,切分点和序号就相同
+type Aligner struct {
+	segmentMs int64
+	idx       int64
+	started   bool
+}
+
+//NewAligner for segmentMs
+func NewAligner(segmentMs int) *Aligner {
+	if segmentMs <= 0 {
+		segmentMs = defaultSegmentMs
+	}
+	return &Aligner{segmentMs: int64(segmentMs)}
+}
+
+//Boundary whether a segment starts at the keyframe of timestamp,
+//the window of the first keyframe is skipped,joining in the middle of it would give a shorter segment
+func (aligner *Aligner) Boundary(timestamp uint32) bool {
+	idx := int64(timestamp) / aligner.segmentMs
+	if false == aligner.started {
+		aligner.started = true
+		aligner.idx = idx
+		return false
+	}
+	if idx == aligner.idx {
+		return false
+	}
+	//时间戳回退也切分
+	aligner.idx = idx
+	return true
+}
+
+//Index of the segment started by the last boundary
+func (aligner *Aligner) Index() int64 {
+	return aligner.idx
+}
+
+//Variant description of a rendition in master playlist and mpd
+type Variant struct {
+	Width      int
+	Height     int
+	FrameRate  int
+	VideoCodec string
+	AudioCodec string
+	SampleRate int
+	Channels   int
+	//bits per second,peak of segments
+	Bandwidth int
+	totalBits int64
+	totalMs   float64
+}
+
+//NewVariant resolution and codecs from the avc and aac sequence headers,nil header ignored
+func NewVariant(videoHeader, audioHeader *flv.FlvTag) (variant *Variant) {
+	variant = &Variant{}
+	if videoHeader != nil && len(videoHeader.Data) > 13 &&
+		videoHeader.Data[0] == 0x17 && videoHeader.Data[1] == 0 {
+		sps, _ := h264.GetSpsPpsFromAVC(videoHeader.Data[5:])
+		if len(sps) > 4 {
+			variant.Width, variant.Height, variant.FrameRate = h264.ParseSPS(sps)
+			variant.VideoCodec = fmt.Sprintf("avc1.%02x%02x%02x", sps[1], sps[2], sps[3])
+		}
+	}
+	if audioHeader != nil && len(audioHeader.Data) > 3 &&
+		audioHeader.Data[0]>>4 == flv.SoundFormatAAC {
+		asc := aac.MP4AudioGetConfig(audioHeader.Data[2:])
+		variant.AudioCodec = fmt.Sprintf("mp4a.40.%d", asc.Object_type)
+		variant.SampleRate = asc.Sample_rate
+		variant.Channels = asc.Channels
+	}
+	return
+}
+
+//AddSegment bandwidth measured from the segment size
+func (variant *Variant) AddSegment(size int, durationMs float64) {
+	if durationMs <= 0 {
+		return
+	}
+	bits := int64(size) * 8
+	bandwidth := int(float64(bits) * 1000 / durationMs)
+	if bandwidth > variant.Bandwidth {
+		variant.Bandwidth = bandwidth
+	}
+	variant.totalBits += bits
+	variant.totalMs += durationMs
+}
+
+//AverageBandwidth of all segments added
+func (variant *Variant) AverageBandwidth() int {
+	if variant.totalMs <= 0 {
+		return 0
+	}
+	return int(float64(variant.totalBits) * 1000 / variant.totalMs)
+}
+
+//Codecs for hls CODECS attribute
+func (variant *Variant) Codecs() string {
+	codecs := make([]string, 0, 2)
+	if len(variant.VideoCodec) > 0 {
+		codecs = append(codecs, variant.VideoCodec)
+	}
+	if len(variant.AudioCodec) > 0 {
+		codecs = append(codecs, variant.AudioCodec)
+	}
+	return strings.Join(codecs, ",")
+}
@@ -0,0 +1,62 @@
+package abr
+
+import (
+	"testing"
+
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/mediatype/h264"
+)
+
+func TestAligner(t *testing.T) {
+	//两个码率关键帧间隔2秒,第二个从中间加入,切分点和序号要相同
+	boundaries := func(keyframes []uint32) (cuts map[uint32]int64) {
+		cuts = make(map[uint32]int64)
+		aligner := NewAligner(6000)
+		for _, ts := range keyframes {
+			if aligner.Boundary(ts) {
+				cuts[ts] = aligner.Index()
+			}
+		}
+		return
+	}
+	first := boundaries([]uint32{1000, 3000, 5000, 7000, 9000, 11000, 13000})
+	second := boundaries([]uint32{9000, 11000, 13000})
+	if len(first) != 2 || first[7000] != 1 || first[13000] != 2 {
+		t.Fatalf("cuts %v", first)
+	}
+	if len(second) != 1 || second[13000] != 2 {
+		t.Fatalf("cuts %v", second)
+	}
+}
+
+func TestVariant(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xec, 0x04, 0x40, 0x00, 0x00, 0x03, 0x00, 0x40, 0x00, 0x00, 0x0c, 0x23, 0xc6, 0x0c, 0x92}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	videoHeader := &flv.FlvTag{TagType: flv.FlvTagVideo, Data: append([]byte{0x17, 0, 0, 0, 0}, h264.AVCDecoderConfigurationRecord(sps, pps)...)}
+	audioHeader := &flv.FlvTag{TagType: flv.FlvTagAudio, Data: []byte{0xaf, 0, 0x12, 0x10}}
+	variant := NewVariant(videoHeader, audioHeader)
+	if variant.Width != 1280 || variant.Height != 720 {
+		t.Fatalf("resolution %dx%d", variant.Width, variant.Height)
+	}
+	if variant.Codecs() != "avc1.42c01f,mp4a.40.2" {
+		t.Fatalf("codecs %s", variant.Codecs())
+	}
+	variant.AddSegment(125000, 2000)
+	variant.AddSegment(125000, 1000)
+	if variant.Bandwidth != 1000000 || variant.AverageBandwidth() != 666666 {
+		t.Fatalf("bandwidth %d %d", variant.Bandwidth, variant.AverageBandwidth())
+	}
+}
+
+func TestCheck(t *testing.T) {
+	groups := []Group{{Name: "/live/event/", Renditions: []string{"live/event_1080/", "live/event_720"}}}
+	if err := Check(groups); err != nil {
+		t.Fatal(err)
+	}
+	if groups[0].SegmentMs != defaultSegmentMs || Of(groups, "live/event_1080") != &groups[0] || Find(groups, "live/event") != &groups[0] {
+		t.Fatalf("group %v", groups[0])
+	}
+	if Check([]Group{{Name: "live/a", Renditions: []string{"live/a"}}}) == nil {
+		t.Fatal("group named as its rendition accepted")
+	}
+}
@@ -0,0 +1,192 @@
+//Package authorizer decide if a client can publish or play a stream,
+//consulted by every protocol handler before the streamer is touched
+package authorizer
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/utils"
+)
+
+//actions
+const (
+	ActionPublish = "publish"
+	ActionPlay    = "play"
+)
+
+//protocols
+const (
+	ProtocolRTMP      = "rtmp"
+	ProtocolRTSP      = "rtsp"
+	ProtocolWebSocket = "websocket"
+	ProtocolHLS       = "hls"
+	ProtocolDASH      = "dash"
+	ProtocolHTTPFLV   = "httpflv"
+	ProtocolWebRTC    = "webrtc"
+	ProtocolSRT       = "srt"
+)
+
+//authorizer types in config
+const (
+	TypeNone = ""
+	TypeHMAC = "hmac"
+	TypeHTTP = "http"
+)
+
+//TokenParam query param carry the token
+const TokenParam = "token"
+
+//errors returned by Check,handlers map them to protocol errors
+var (
+	ErrTokenMissing = errors.New("auth token missing")
+	ErrTokenInvalid = errors.New("auth token invalid")
+	ErrTokenExpired = errors.New("auth token expired")
+	ErrDenied       = errors.New("auth denied")
+)
+
+//Request one publish or play request
+type Request struct {
+	Action     string `json:"action"`
+	Protocol   string `json:"protocol"`
+	StreamName string `json:"stream"`
+	Token      string `json:"token"`
+	RemoteAddr string `json:"addr"`
+}
+
+//Authorizer return nil if the request allowed
+type Authorizer interface {
+	Authorize(req *Request) error
+}
+
+//Config of authorizer
+type Config struct {
+	Type        string `json:"Type"`
+	Publish     bool   `json:"Publish"`
+	Play        bool   `json:"Play"`
+	Secret      string `json:"Secret"`
+	CallbackURL string `json:"CallbackURL"`
+	TimeoutSec  int    `json:"TimeoutSec"`
+}
+
+var (
+	mutexAuth  sync.RWMutex
+	authConfig Config
+	current    Authorizer
+)
+
+//Init load config file and create the authorizer,empty file name disable auth
+func Init(fileName string) (err error) {
+	cfg := Config{}
+	if len(fileName) > 0 {
+		var buf []byte
+		buf, err = utils.ReadFileAll(fileName)
+		if err != nil {
+			return
+		}
+		err = json.Unmarshal(buf, &cfg)
+		if err != nil {
+			return
+		}
+	}
+	var auth Authorizer
+	switch cfg.Type {
+	case TypeNone:
+	case TypeHMAC:
+		if len(cfg.Secret) == 0 {
+			return errors.New("hmac authorizer need a secret")
+		}
+		auth = &HMACAuthorizer{Secret: []byte(cfg.Secret)}
+	case TypeHTTP:
+		if len(cfg.CallbackURL) == 0 {
+			return errors.New("http authorizer need a callback url")
+		}
+		auth = NewHTTPAuthorizer(cfg.CallbackURL, cfg.TimeoutSec)
+	default:
+		return errors.New("unknown authorizer type:" + cfg.Type)
+	}
+	SetAuthorizer(auth, cfg.Publish, cfg.Play)
+	return
+}
+
+//SetAuthorizer replace the authorizer,nil disable auth
+func SetAuthorizer(auth Authorizer, publish, play bool) {
+	mutexAuth.Lock()
+	defer mutexAuth.Unlock()
+	current = auth
+	authConfig.Publish = publish
+	authConfig.Play = play
+}
+
+//Check the request with current authorizer
+func Check(req *Request) (err error) {
+	mutexAuth.RLock()
+	auth := current
+	need := (req.Action == ActionPublish && authConfig.Publish) ||
+		(req.Action == ActionPlay && authConfig.Play)
+	mutexAuth.RUnlock()
+	if nil == auth || false == need {
+		return
+	}
+	err = auth.Authorize(req)
+	if err != nil {
+		logger.LOGW(req.Protocol + " " + req.Action + " " + req.StreamName + " from " + req.RemoteAddr + " rejected:" + err.Error())
+	}
+	return
+}
+
+//SplitToken name?token=xxx -> name,xxx
+func SplitToken(name string) (streamName, token string) {
+	idx := strings.Index(name, "?")
+	if idx < 0 {
+		return name, ""
+	}
+	streamName = name[:idx]
+	token = TokenFromQuery(name[idx+1:])
+	return
+}
+
+//TokenFromQuery get token from raw query
+func TokenFromQuery(rawQuery string) string {
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return ""
+	}
+	return values.Get(TokenParam)
+}
+
+//StatusCode http and rtsp share the status code,401 ask for a token,403 reject the token
+func StatusCode(err error) int {
+	if err == ErrTokenMissing {
+		return 401
+	}
+	return 403
+}
+
+//CheckHTTP play request of http based protocols,token in url query
+//or bearer authorization header as whep players send
+func CheckHTTP(protocol, streamName string, req *http.Request) error {
+	return checkHTTP(ActionPlay, protocol, streamName, req)
+}
+
+//CheckHTTPPublish publish request of http based protocols as whip
+func CheckHTTPPublish(protocol, streamName string, req *http.Request) error {
+	return checkHTTP(ActionPublish, protocol, streamName, req)
+}
+
+func checkHTTP(action, protocol, streamName string, req *http.Request) error {
+	token := req.URL.Query().Get(TokenParam)
+	if len(token) == 0 && strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ") {
+		token = strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	}
+	return Check(&Request{Action: action,
+		Protocol:   protocol,
+		StreamName: streamName,
+		Token:      token,
+		RemoteAddr: req.RemoteAddr})
+}
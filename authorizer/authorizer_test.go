@@ -0,0 +1,128 @@
+package authorizer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHMACAuthorizer(t *testing.T) {
+	auth := &HMACAuthorizer{Secret: []byte("secret")}
+	valid := time.Now().Add(time.Minute)
+	token := auth.Token(ActionPlay, "live/hmac", valid)
+	//expires is signed,it can not be extended
+	extended := strconv.FormatInt(valid.Add(time.Hour).Unix(), 10) + token[strings.Index(token, "-"):]
+	for _, test := range []struct {
+		name   string
+		auth   *HMACAuthorizer
+		action string
+		stream string
+		token  string
+		err    error
+	}{
+		{"valid", auth, ActionPlay, "live/hmac", token, nil},
+		{"missing", auth, ActionPlay, "live/hmac", "", ErrTokenMissing},
+		{"no separator", auth, ActionPlay, "live/hmac", "123456", ErrTokenInvalid},
+		{"bad expires", auth, ActionPlay, "live/hmac", "x" + token, ErrTokenInvalid},
+		{"bad hex", auth, ActionPlay, "live/hmac", token + "zz", ErrTokenInvalid},
+		{"extended", auth, ActionPlay, "live/hmac", extended, ErrTokenInvalid},
+		{"other stream", auth, ActionPlay, "live/other", token, ErrTokenInvalid},
+		{"other action", auth, ActionPublish, "live/hmac", token, ErrTokenInvalid},
+		{"other secret", &HMACAuthorizer{Secret: []byte("other")}, ActionPlay, "live/hmac", token, ErrTokenInvalid},
+		{"expired", auth, ActionPlay, "live/hmac", auth.Token(ActionPlay, "live/hmac", time.Now().Add(-time.Minute)), ErrTokenExpired},
+	} {
+		err := test.auth.Authorize(&Request{Action: test.action, StreamName: test.stream, Token: test.token})
+		if err != test.err {
+			t.Errorf("%s:got %v,want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	auth := &HMACAuthorizer{Secret: []byte("secret")}
+	token := auth.Token(ActionPublish, "live/check", time.Now().Add(time.Minute))
+	defer SetAuthorizer(nil, false, false)
+	for _, test := range []struct {
+		name    string
+		auth    Authorizer
+		publish bool
+		play    bool
+		req     Request
+		err     error
+	}{
+		{"disabled", nil, true, true, Request{Action: ActionPublish, StreamName: "live/check"}, nil},
+		{"publish only", auth, true, false, Request{Action: ActionPlay, StreamName: "live/check"}, nil},
+		{"publish no token", auth, true, false, Request{Action: ActionPublish, StreamName: "live/check"}, ErrTokenMissing},
+		{"publish token", auth, true, false, Request{Action: ActionPublish, StreamName: "live/check", Token: token}, nil},
+		{"play token of publish", auth, true, true, Request{Action: ActionPlay, StreamName: "live/check", Token: token}, ErrTokenInvalid},
+	} {
+		SetAuthorizer(test.auth, test.publish, test.play)
+		if err := Check(&test.req); err != test.err {
+			t.Errorf("%s:got %v,want %v", test.name, err, test.err)
+		}
+	}
+
+	//token from query or bearer header
+	SetAuthorizer(auth, true, false)
+	for _, test := range []struct {
+		url    string
+		header string
+		err    error
+	}{
+		{"/whip/live/check?token=" + token, "", nil},
+		{"/whip/live/check", "Bearer " + token, nil},
+		{"/whip/live/check", "Basic " + token, ErrTokenMissing},
+	} {
+		req := httptest.NewRequest("POST", test.url, nil)
+		req.Header.Set("Authorization", test.header)
+		if err := CheckHTTPPublish(ProtocolWebRTC, "live/check", req); err != test.err {
+			t.Errorf("%s %s:got %v,want %v", test.url, test.header, err, test.err)
+		}
+	}
+	if StatusCode(ErrTokenMissing) != 401 || StatusCode(ErrTokenExpired) != 403 {
+		t.Error("status code")
+	}
+}
+
+func TestSplitToken(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		stream string
+		token  string
+	}{
+		{"live/foo", "live/foo", ""},
+		{"live/foo?token=abc", "live/foo", "abc"},
+		{"live/foo?a=1&token=abc", "live/foo", "abc"},
+		{"live/foo?a=1", "live/foo", ""},
+	} {
+		stream, token := SplitToken(test.name)
+		if stream != test.stream || token != test.token {
+			t.Errorf("%s:got %s %s", test.name, stream, token)
+		}
+	}
+}
+
+func TestHTTPAuthorizer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		authReq := &Request{}
+		if err := json.NewDecoder(req.Body).Decode(authReq); err != nil || authReq.Token != "good" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+	auth := NewHTTPAuthorizer(server.URL, 1)
+	if err := auth.Authorize(&Request{Action: ActionPlay, Token: "good"}); err != nil {
+		t.Error(err)
+	}
+	if err := auth.Authorize(&Request{Action: ActionPlay, Token: "bad"}); err != ErrDenied {
+		t.Errorf("bad token:%v", err)
+	}
+	server.Close()
+	if err := auth.Authorize(&Request{Action: ActionPlay, Token: "good"}); err != ErrDenied {
+		t.Errorf("callback down:%v", err)
+	}
+}
@@ -0,0 +1,54 @@
+package authorizer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//HMACAuthorizer token is expires-hex(hmac-sha256(secret,action:stream:expires)),
+//expires is unix seconds
+type HMACAuthorizer struct {
+	Secret []byte
+}
+
+//Authorize check signature and expire time
+func (auth *HMACAuthorizer) Authorize(req *Request) error {
+	if len(req.Token) == 0 {
+		return ErrTokenMissing
+	}
+	subs := strings.SplitN(req.Token, "-", 2)
+	if len(subs) != 2 {
+		return ErrTokenInvalid
+	}
+	expires, err := strconv.ParseInt(subs[0], 10, 64)
+	if err != nil {
+		return ErrTokenInvalid
+	}
+	sig, err := hex.DecodeString(subs[1])
+	if err != nil {
+		return ErrTokenInvalid
+	}
+	if false == hmac.Equal(sig, auth.sign(req.Action, req.StreamName, expires)) {
+		return ErrTokenInvalid
+	}
+	if time.Now().Unix() > expires {
+		return ErrTokenExpired
+	}
+	return nil
+}
+
+//Token create a token for action on stream valid until expires
+func (auth *HMACAuthorizer) Token(action, streamName string, expires time.Time) string {
+	unix := expires.Unix()
+	return strconv.FormatInt(unix, 10) + "-" + hex.EncodeToString(auth.sign(action, streamName, unix))
+}
+
+func (auth *HMACAuthorizer) sign(action, streamName string, expires int64) []byte {
+	mac := hmac.New(sha256.New, auth.Secret)
+	mac.Write([]byte(action + ":" + streamName + ":" + strconv.FormatInt(expires, 10)))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,48 @@
+package authorizer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const defaultCallbackTimeout = 3 * time.Second
+
+//HTTPAuthorizer post the request as json to our own service,
+//2xx means allowed,anything else denied
+type HTTPAuthorizer struct {
+	CallbackURL string
+	client      *http.Client
+}
+
+//NewHTTPAuthorizer timeoutSec <= 0 use default
+func NewHTTPAuthorizer(callbackURL string, timeoutSec int) *HTTPAuthorizer {
+	timeout := defaultCallbackTimeout
+	if timeoutSec > 0 {
+		timeout = time.Duration(timeoutSec) * time.Second
+	}
+	return &HTTPAuthorizer{CallbackURL: callbackURL,
+		client: &http.Client{Timeout: timeout}}
+}
+
+//Authorize ask the callback
+func (auth *HTTPAuthorizer) Authorize(req *Request) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := auth.client.Post(auth.CallbackURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		//回调不可用时拒绝
+		return ErrDenied
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return ErrDenied
+	}
+	return nil
+}
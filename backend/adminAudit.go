@@ -0,0 +1,96 @@
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/logger"
+)
+
+//auditRecentLength entries kept in memory for /admin/audit
+const auditRecentLength = 1000
+
+//auditEntry one admin request
+type auditEntry struct {
+	Time       string `json:"time"`
+	User       string `json:"usr,omitempty"`
+	Role       string `json:"role,omitempty"`
+	RemoteAddr string `json:"addr"`
+	Method     string `json:"method"`
+	Route      string `json:"route"`
+	Action     string `json:"action,omitempty"`
+	Result     string `json:"result"`
+}
+
+//auditLog entries are appended to the file as json lines,the recent ones are kept in memory
+type auditLog struct {
+	mux    sync.Mutex
+	fp     *os.File
+	recent []auditEntry
+}
+
+var audit = &auditLog{}
+
+//open the file to append,memory only if fileName is empty
+func (log *auditLog) open(fileName string) (err error) {
+	log.mux.Lock()
+	defer log.mux.Unlock()
+	if log.fp != nil {
+		log.fp.Close()
+		log.fp = nil
+	}
+	if len(fileName) == 0 {
+		return
+	}
+	log.fp, err = os.OpenFile(fileName, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	return
+}
+
+func (log *auditLog) close() {
+	log.open("")
+}
+
+//add an entry of req,session nil for anonymous requests
+func (log *auditLog) add(req *http.Request, session *adminSession, result string) {
+	entry := auditEntry{
+		Time:       time.Now().Format(time.RFC3339),
+		RemoteAddr: req.RemoteAddr,
+		Method:     req.Method,
+		Route:      req.URL.Path,
+		Action:     req.FormValue("action_code"),
+		Result:     result}
+	if session != nil {
+		entry.User = session.User
+		entry.Role = session.Role
+	}
+	log.write(entry)
+}
+
+func (log *auditLog) write(entry auditEntry) {
+	data, _ := json.Marshal(&entry)
+	log.mux.Lock()
+	defer log.mux.Unlock()
+	if len(log.recent) >= auditRecentLength {
+		log.recent = append(log.recent[:0], log.recent[1:]...)
+	}
+	log.recent = append(log.recent, entry)
+	if log.fp != nil {
+		if _, err := log.fp.Write(append(data, '\n')); err != nil {
+			logger.LOGE("write audit log failed:" + err.Error())
+		}
+	}
+}
+
+//entries the recent entries,oldest first
+func (log *auditLog) entries() (list []object) {
+	log.mux.Lock()
+	defer log.mux.Unlock()
+	list = make([]object, 0, len(log.recent))
+	for _, entry := range log.recent {
+		list = append(list, entry)
+	}
+	return
+}
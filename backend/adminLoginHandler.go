@@ -1,38 +1,18 @@
 package backend
 
 import (
-	"crypto/md5"
-	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"net/http"
 
 	"github.com/use-go/websocket-streamserver/wssapi"
 )
 
 type adminLoginHandler struct {
-	route     string
-	AuthToken string
-	isLogin   bool
+	route string
 }
 
-type adminLoginData struct {
-	username string
-	password string
-}
-
-//LoginHandler for user
-var LoginHandler *adminLoginHandler
-var loginData *adminLoginData
-
 func (alh *adminLoginHandler) init(data *wssapi.Msg) (err error) {
-	lgdata := data.Param1.(adminLoginData)
-	if len(lgdata.username) == 0 || len(lgdata.password) == 0 {
-		return errors.New("invalid param")
-	}
-	loginData = &lgdata
 	alh.route = "/admin/login"
-	LoginHandler = alh
 	return
 }
 
@@ -53,47 +33,91 @@ func (alh *adminLoginHandler) handleLoginRequest(w http.ResponseWriter, req *htt
 	if req.Method != "POST" {
 		result, err := BadRequest(WSSRequestMethodError, "bad request in login ")
 		SendResponse(result, err, w)
-	} else {
-		username := req.PostFormValue("username")
-		password := req.PostFormValue("password")
-		if len(username) > 0 && len(password) > 0 {
-			ispass, authToken := compAuth(username, password)
-			if ispass {
-				alh.isLogin = true
-				alh.AuthToken = authToken
-				responseData, err := passAuthResponseData(authToken)
-				SendResponse(responseData, err, w)
-			} else {
-				responseData, err := BadRequest(WSSUserAuthError, "login auth error")
-				SendResponse(responseData, err, w)
-			}
-		} else {
-			responseData, err := BadRequest(WSSParamError, "login auth error")
-			SendResponse(responseData, err, w)
-		}
+		return
+	}
+	username := req.PostFormValue("username")
+	password := req.PostFormValue("password")
+	if len(username) == 0 || len(password) == 0 {
+		responseData, err := BadRequest(WSSParamError, "login auth error")
+		SendResponse(responseData, err, w)
+		return
+	}
+	user := checkPassword(username, password)
+	if nil == user {
+		audit.add(req, &adminSession{User: username}, "login failed")
+		responseData, err := BadRequest(WSSUserAuthError, "login auth error")
+		SendResponse(responseData, err, w)
+		return
 	}
+	token, session, err := sessions.create(user)
+	if err != nil {
+		sendBadResponse(w, "create session failed", WSSSeverError)
+		return
+	}
+	audit.add(req, session, "login")
+	responseData, err := passAuthResponseData(token, session)
+	SendResponse(responseData, err, w)
 }
 
 //login sucess response
-func passAuthResponseData(authToken string) ([]byte, error) {
+func passAuthResponseData(authToken string, session *adminSession) ([]byte, error) {
 	result := &LoginResponseData{}
 	result.Code = WSSRequestOK
 	result.Msg = "ok"
 	result.Data.UserData.Token = authToken
-	result.Data.UserData.Usrname = loginData.username
+	result.Data.UserData.Usrname = session.User
+	result.Data.UserData.Role = session.Role
+	result.Data.UserData.Expires = session.Expires
 
 	resultData, err := json.Marshal(result)
 	return resultData, err
 }
 
-func compAuth(username, password string) (ispass bool, authToken string) {
-	if loginData.username == username && loginData.password == password {
-		hash := md5.New()
-		hash.Write([]byte(username + password))
-		md5data := hash.Sum(nil)
-		md5str := hex.EncodeToString(md5data)
-		return true, md5str
+//adminLogoutHandler revoke the session of the token
+type adminLogoutHandler struct {
+	route string
+}
+
+func (aloh *adminLogoutHandler) init(data *wssapi.Msg) (err error) {
+	aloh.route = "/admin/logout"
+	return
+}
+
+func (aloh *adminLogoutHandler) getRoute() (route string) {
+	return aloh.route
+}
+
+func (aloh *adminLogoutHandler) requiredRole(req *http.Request) string {
+	return RoleViewer
+}
+
+func (aloh *adminLogoutHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		sendBadResponse(w, "bad request in logout", WSSRequestMethodError)
+		return
 	}
-	return false, ""
+	sessions.revoke(sessionOf(req))
+	sendSuccessResponse("op success", nil, w)
+}
+
+//adminAuditHandler recent audit entries for admins
+type adminAuditHandler struct {
+	route string
+}
+
+func (aah *adminAuditHandler) init(data *wssapi.Msg) (err error) {
+	aah.route = "/admin/audit"
+	return
+}
+
+func (aah *adminAuditHandler) getRoute() (route string) {
+	return aah.route
+}
+
+func (aah *adminAuditHandler) requiredRole(req *http.Request) string {
+	return RoleAdmin
+}
 
+func (aah *adminAuditHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	sendSuccessResponse(nil, audit.entries(), w)
 }
@@ -0,0 +1,256 @@
+package backend
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//roles of admin users,a role can do everything the lower ones can
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+var roleLevels = map[string]int{RoleViewer: 1, RoleOperator: 2, RoleAdmin: 3}
+
+//errors of session check
+var (
+	errSessionMissing = errors.New("session token missing")
+	errSessionInvalid = errors.New("session token invalid")
+	errSessionExpired = errors.New("session token expired")
+	errSessionRevoked = errors.New("session revoked")
+)
+
+//adminSession claims signed in the token
+type adminSession struct {
+	ID      string `json:"id"`
+	User    string `json:"usr"`
+	Role    string `json:"role"`
+	Expires int64  `json:"exp"`
+}
+
+//sessionManager token is base64(claims).hex(hmac-sha256(secret,base64(claims))),
+//revoked sessions are kept until they expire
+type sessionManager struct {
+	secret  []byte
+	ttl     time.Duration
+	mux     sync.Mutex
+	revoked map[string]int64
+}
+
+var sessions *sessionManager
+
+type sessionKey struct{}
+
+//newSessionManager random secret if not configured,tokens are invalid after restart then
+func newSessionManager(secret string, ttl time.Duration) (manager *sessionManager, err error) {
+	manager = &sessionManager{
+		secret:  []byte(secret),
+		ttl:     ttl,
+		revoked: make(map[string]int64)}
+	if len(manager.secret) == 0 {
+		manager.secret = make([]byte, 32)
+		_, err = rand.Read(manager.secret)
+	}
+	return
+}
+
+//create a session of user valid for ttl
+func (manager *sessionManager) create(user *adminUser) (token string, session *adminSession, err error) {
+	id := make([]byte, 16)
+	if _, err = rand.Read(id); err != nil {
+		return
+	}
+	session = &adminSession{
+		ID:      hex.EncodeToString(id),
+		User:    user.Name,
+		Role:    user.Role,
+		Expires: time.Now().Add(manager.ttl).Unix()}
+	claims, err := json.Marshal(session)
+	if err != nil {
+		return
+	}
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	token = payload + "." + hex.EncodeToString(manager.sign(payload))
+	return
+}
+
+//verify signature,expire time and revocation,the role is taken from the current users
+func (manager *sessionManager) verify(token string) (session *adminSession, err error) {
+	if len(token) == 0 {
+		return nil, errSessionMissing
+	}
+	subs := strings.SplitN(token, ".", 2)
+	if len(subs) != 2 {
+		return nil, errSessionInvalid
+	}
+	sig, err := hex.DecodeString(subs[1])
+	if err != nil || false == hmac.Equal(sig, manager.sign(subs[0])) {
+		return nil, errSessionInvalid
+	}
+	claims, err := base64.RawURLEncoding.DecodeString(subs[0])
+	if err != nil {
+		return nil, errSessionInvalid
+	}
+	session = &adminSession{}
+	if err = json.Unmarshal(claims, session); err != nil {
+		return nil, errSessionInvalid
+	}
+	if time.Now().Unix() > session.Expires {
+		return nil, errSessionExpired
+	}
+	manager.mux.Lock()
+	_, revoked := manager.revoked[session.ID]
+	manager.mux.Unlock()
+	if revoked {
+		return nil, errSessionRevoked
+	}
+	user := findUser(session.User)
+	if nil == user {
+		return nil, errSessionRevoked
+	}
+	session.Role = user.Role
+	return
+}
+
+//revoke the session until it expires
+func (manager *sessionManager) revoke(session *adminSession) {
+	now := time.Now().Unix()
+	manager.mux.Lock()
+	defer manager.mux.Unlock()
+	for id, expires := range manager.revoked {
+		if expires < now {
+			delete(manager.revoked, id)
+		}
+	}
+	manager.revoked[session.ID] = session.Expires
+}
+
+func (manager *sessionManager) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, manager.secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+//requestToken only from the Authorization: Bearer header,
+//tokens in the url end up in access logs and browser history
+func requestToken(req *http.Request) string {
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return ""
+}
+
+//hasRole whether role can do what required needs
+func hasRole(role, required string) bool {
+	return roleLevels[role] > 0 && roleLevels[role] >= roleLevels[required]
+}
+
+//sessionOf the session checked by the middleware
+func sessionOf(req *http.Request) *adminSession {
+	session, _ := req.Context().Value(sessionKey{}).(*adminSession)
+	return session
+}
+
+//roleHandler handlers need a session,requiredRole empty means public
+type roleHandler interface {
+	requiredRole(req *http.Request) string
+}
+
+//errorSender handlers answer errors in their own format
+type errorSender interface {
+	sendError(w http.ResponseWriter, status int, msg string, code int)
+}
+
+func sendDenied(handler backendServiceHander, w http.ResponseWriter, status int, msg string, code int) {
+	if sender, ok := handler.(errorSender); ok {
+		sender.sendError(w, status, msg, code)
+		return
+	}
+	w.WriteHeader(status)
+	sendBadResponse(w, msg, code)
+}
+
+//withSession verify the token and role before next,every request needs a session is audited
+func withSession(handler backendServiceHander, next http.Handler) http.Handler {
+	roled, ok := handler.(roleHandler)
+	if false == ok {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		required := roled.requiredRole(req)
+		if len(required) == 0 {
+			next.ServeHTTP(w, req)
+			return
+		}
+		session, err := sessions.verify(requestToken(req))
+		if err != nil {
+			audit.add(req, nil, "denied:"+err.Error())
+			code := WSSUserAuthError
+			if err == errSessionMissing {
+				code = WSSNotLogin
+			}
+			sendDenied(handler, w, http.StatusUnauthorized, err.Error(), code)
+			return
+		}
+		if false == hasRole(session.Role, required) {
+			audit.add(req, session, "denied:need "+required)
+			sendDenied(handler, w, http.StatusForbidden, "permission denied,need "+required, WSSPermissionDenied)
+			return
+		}
+		recorder := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(recorder, req.WithContext(context.WithValue(req.Context(), sessionKey{}, session)))
+		audit.add(req, session, recorder.result())
+	})
+}
+
+//statusWriter keep what the handler answered for the audit entry,
+//the legacy admin handlers answer errors with status 200 and a code in the body
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	code   int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+		body := &BadRequestData{}
+		if json.Unmarshal(data, body) == nil {
+			w.code = body.Code
+		}
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+//result status of the response,and the code of the body when it is not ok
+func (w *statusWriter) result() string {
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	result := "status " + strconv.Itoa(status)
+	if w.code != 0 && w.code != WSSRequestOK {
+		result += ",code " + strconv.Itoa(w.code)
+	}
+	return result
+}
@@ -0,0 +1,138 @@
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSessionMiddleware(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	config := &BackendConfig{Users: []AdminUserConfig{
+		{Name: "ops", Password: string(hash), Role: RoleOperator},
+		{Name: "guest", Password: string(hash), Role: RoleViewer}}}
+	if err := loadUsers(config); err != nil {
+		t.Fatal(err)
+	}
+	sessions, _ = newSessionManager("", time.Hour)
+
+	login := func(name string) string {
+		req := httptest.NewRequest("POST", "/admin/login", strings.NewReader(url.Values{"username": {name}, "password": {"secret"}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		(&adminLoginHandler{route: "/admin/login"}).ServeHTTP(w, req)
+		if false == strings.Contains(w.Body.String(), `"code":200`) {
+			t.Fatalf("login %s:%s", name, w.Body.String())
+		}
+		token := w.Body.String()[strings.Index(w.Body.String(), `"token":"`)+9:]
+		return token[:strings.Index(token, `"`)]
+	}
+	served := false
+	handler := &adminStreamManageHandler{Route: "/admin/stream/manage"}
+	protected := withSession(handler, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		served = sessionOf(req) != nil
+	}))
+	call := func(token, action string) int {
+		served = false
+		req := httptest.NewRequest("POST", "/admin/stream/manage", strings.NewReader(url.Values{"action_code": {action}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		protected.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := call("", "0"); code != http.StatusUnauthorized || served {
+		t.Fatalf("without token %d", code)
+	}
+	guest := login("guest")
+	if code := call(guest, "0"); code != http.StatusOK || false == served {
+		t.Fatalf("viewer show streams %d", code)
+	}
+	//查询以外的操作需要 operator
+	if code := call(guest, "13"); code != http.StatusForbidden || served {
+		t.Fatalf("viewer start record %d", code)
+	}
+	ops := login("ops")
+	if code := call(ops, "13"); code != http.StatusOK {
+		t.Fatalf("operator start record %d", code)
+	}
+	//token only from the header
+	served = false
+	req := httptest.NewRequest("POST", "/admin/stream/manage", strings.NewReader(url.Values{"action_code": {"0"}, "action_token": {ops}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	protected.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized || served {
+		t.Fatalf("form token %d", w.Code)
+	}
+	if code := call(ops[:len(ops)-2]+"00", "0"); code != http.StatusUnauthorized {
+		t.Fatalf("tampered token %d", code)
+	}
+
+	session, err := sessions.verify(ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions.revoke(session)
+	if code := call(ops, "0"); code != http.StatusUnauthorized {
+		t.Fatalf("revoked token %d", code)
+	}
+
+	sessions.ttl = -time.Minute
+	if _, err := sessions.verify(login("guest")); err != errSessionExpired {
+		t.Fatalf("expired token %v", err)
+	}
+	if entries := audit.entries(); len(entries) < 8 {
+		t.Fatalf("audit entries %d", len(entries))
+	}
+}
+
+func TestAuditOutcome(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err := loadUsers(&BackendConfig{Users: []AdminUserConfig{{Name: "ops", Password: string(hash), Role: RoleOperator}}}); err != nil {
+		t.Fatal(err)
+	}
+	sessions, _ = newSessionManager("", time.Hour)
+	token, _, err := sessions.create(findUser("ops"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &adminStreamManageHandler{Route: "/admin/stream/manage"}
+	tests := []struct {
+		serve  func(w http.ResponseWriter)
+		result string
+	}{
+		{func(w http.ResponseWriter) { sendSuccessResponse(nil, nil, w) }, "status 200"},
+		{func(w http.ResponseWriter) { sendBadResponse(w, "no stream", WSSParamError) }, "status 200,code 102"},
+		{func(w http.ResponseWriter) { w.WriteHeader(http.StatusNotFound) }, "status 404"},
+		{func(w http.ResponseWriter) {}, "status 200"},
+	}
+	for _, test := range tests {
+		serve := test.serve
+		protected := withSession(handler, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			//the entry is written after the handler
+			if entries := audit.entries(); len(entries) > 0 && entries[len(entries)-1].(auditEntry).Route == "/outcome" {
+				t.Fatal("audited before the handler returned")
+			}
+			serve(w)
+		}))
+		req := httptest.NewRequest("POST", "/outcome", strings.NewReader(url.Values{"action_code": {"13"}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+token)
+		protected.ServeHTTP(httptest.NewRecorder(), req)
+		entries := audit.entries()
+		entry := entries[len(entries)-1].(auditEntry)
+		if entry.Route != "/outcome" || entry.Action != "13" || entry.Result != test.result {
+			t.Fatalf("audit %+v,want %s", entry, test.result)
+		}
+		audit.write(auditEntry{Route: "/other"})
+	}
+}
@@ -10,7 +10,9 @@ import (
 
 	"github.com/use-go/websocket-streamserver/events/eLiveListCtrl"
 	"github.com/use-go/websocket-streamserver/events/eRTMPEvent"
+	"github.com/use-go/websocket-streamserver/events/eRecordEvent"
 	"github.com/use-go/websocket-streamserver/events/eStreamerEvent"
+	"github.com/use-go/websocket-streamserver/events/eVODEvent"
 	"github.com/use-go/websocket-streamserver/logger"
 	"github.com/use-go/websocket-streamserver/wssapi"
 )
@@ -19,11 +21,6 @@ type adminStreamManageHandler struct {
 	Route string
 }
 
-type streamManageRequestData struct {
-	Action Action
-	LoginResponseData
-}
-
 func (asmh *adminStreamManageHandler) init(data *wssapi.Msg) (err error) {
 	asmh.Route = "/admin/stream/manage"
 	return
@@ -43,33 +40,20 @@ func (asmh *adminStreamManageHandler) ServeHTTP(w http.ResponseWriter, req *http
 }
 
 func (asmh *adminStreamManageHandler) handleStreamManageRequest(w http.ResponseWriter, req *http.Request) {
-	if !LoginHandler.isLogin {
-		doManage(w, req)
-		//response, err := BadRequest(WSSNotLogin, "please login")
-		//SendResponse(response, err, w)
-		return
-	}
-	requestData := getRequestData(req)
-	if requestData.Action.ActionToken != LoginHandler.AuthToken {
-		response, err := BadRequest(WSSUserAuthError, "Auth error")
-		SendResponse(response, err, w)
-		return
-	}
 	doManage(w, req)
-
 }
 
-func getRequestData(req *http.Request) streamManageRequestData {
-	data := streamManageRequestData{}
-	code := req.PostFormValue("action_code")
-	codeInt, err := strconv.Atoi(code)
+//requiredRole viewers can only query,other actions change the server
+func (asmh *adminStreamManageHandler) requiredRole(req *http.Request) string {
+	code, err := strconv.Atoi(req.PostFormValue("action_code"))
 	if err != nil {
-		data.Action.ActionCode = codeInt
-	} else {
-		data.Action.ActionCode = -1
+		return RoleViewer
+	}
+	switch code {
+	case WSShowAllSream, WSGetLivePlayerCount, WSGetRecordList, WSGetVODList:
+		return RoleViewer
 	}
-	data.Action.ActionToken = req.PostFormValue("action_token")
-	return data
+	return RoleOperator
 }
 
 func doManage(w http.ResponseWriter, req *http.Request) {
@@ -117,6 +101,14 @@ func parseActionEvent(w http.ResponseWriter, req *http.Request) error {
 		task = &eStreamerEvent.EveDelSource{}
 	case WSGetSource:
 		task = &eStreamerEvent.EveGetSource{}
+	case WSStartRecord:
+		doStartRecord(w, req)
+	case WSStopRecord:
+		doStopRecord(w, req)
+	case WSGetRecordList:
+		doGetRecordList(w)
+	case WSGetVODList:
+		doGetVODList(w)
 	default:
 		return errors.New("no function")
 	}
@@ -191,6 +183,70 @@ func doDelSource(w http.ResponseWriter, r *http.Request) {
 func doGetSource(w http.ResponseWriter, r *http.Request) {
 }
 
+//start record
+//need form data " live_name=app/stream&format=flv
+//				" format flv or fmp4,optional
+func doStartRecord(w http.ResponseWriter, req *http.Request) {
+	liveName := req.FormValue("live_name")
+	if len(liveName) <= 0 {
+		sendBadResponse(w, "need live_name", WSSParamError)
+		return
+	}
+	eve := &eRecordEvent.EveStartRecord{}
+	eve.StreamName = liveName
+	eve.Format = req.FormValue("format")
+	err := wssapi.HandleTask(eve)
+	if err != nil {
+		sendBadResponse(w, "start record failed:"+err.Error(), WSSSeverHandleError)
+		return
+	}
+	sendSuccessResponse("op success", nil, w)
+}
+
+func doStopRecord(w http.ResponseWriter, req *http.Request) {
+	liveName := req.FormValue("live_name")
+	if len(liveName) <= 0 {
+		sendBadResponse(w, "need live_name", WSSParamError)
+		return
+	}
+	eve := &eRecordEvent.EveStopRecord{}
+	eve.StreamName = liveName
+	err := wssapi.HandleTask(eve)
+	if err != nil {
+		sendBadResponse(w, "stop record failed:"+err.Error(), WSSSeverHandleError)
+		return
+	}
+	sendSuccessResponse("op success", nil, w)
+}
+
+func doGetRecordList(w http.ResponseWriter) {
+	eve := &eRecordEvent.EveGetRecordList{}
+	err := wssapi.HandleTask(eve)
+	if err != nil {
+		sendBadResponse(w, "recorder not available", WSSSeverHandleError)
+		return
+	}
+	list := make([]object, 0)
+	for item := eve.Records.Front(); item != nil; item = item.Next() {
+		list = append(list, *item.Value.(*eRecordEvent.RecordInfo))
+	}
+	sendSuccessResponse(nil, list, w)
+}
+
+func doGetVODList(w http.ResponseWriter) {
+	eve := &eVODEvent.EveGetVODList{}
+	err := wssapi.HandleTask(eve)
+	if err != nil {
+		sendBadResponse(w, "vod not available", WSSSeverHandleError)
+		return
+	}
+	list := make([]object, 0)
+	for item := eve.Files.Front(); item != nil; item = item.Next() {
+		list = append(list, *item.Value.(*eVODEvent.VODInfo))
+	}
+	sendSuccessResponse(nil, list, w)
+}
+
 //Enable BlackList
 // need form data " opcode = 1
 // 					opcode 1 for enable blacklist
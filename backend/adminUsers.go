@@ -0,0 +1,83 @@
+package backend
+
+import (
+	"errors"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/use-go/websocket-streamserver/logger"
+)
+
+//AdminUserConfig Password is a bcrypt hash,e.g. htpasswd -nbBC 10 "" password
+type AdminUserConfig struct {
+	Name     string `json:"Name"`
+	Password string `json:"Password"`
+	Role     string `json:"Role"`
+}
+
+type adminUser struct {
+	Name string
+	Role string
+	hash []byte
+}
+
+var (
+	muxUsers sync.RWMutex
+	users    map[string]*adminUser
+)
+
+//loadUsers from config,the legacy Usr/Pwd root is an admin with the plain password hashed here
+func loadUsers(config *BackendConfig) (err error) {
+	loaded := make(map[string]*adminUser)
+	for _, item := range config.Users {
+		if len(item.Name) == 0 || len(item.Password) == 0 {
+			return errors.New("admin user without name or password")
+		}
+		if roleLevels[item.Role] == 0 {
+			return errors.New("invalid role of admin user " + item.Name + ":" + item.Role)
+		}
+		if _, err = bcrypt.Cost([]byte(item.Password)); err != nil {
+			return errors.New("password of admin user " + item.Name + " is not a bcrypt hash")
+		}
+		if _, exist := loaded[item.Name]; exist {
+			return errors.New("admin user repeated:" + item.Name)
+		}
+		loaded[item.Name] = &adminUser{Name: item.Name, Role: item.Role, hash: []byte(item.Password)}
+	}
+	if len(config.RootName) > 0 && len(config.RootPwd) > 0 {
+		if _, exist := loaded[config.RootName]; false == exist {
+			logger.LOGW("plain backend Usr/Pwd is deprecated,use Users with bcrypt passwords")
+			hash, err := bcrypt.GenerateFromPassword([]byte(config.RootPwd), bcrypt.DefaultCost)
+			if err != nil {
+				return err
+			}
+			loaded[config.RootName] = &adminUser{Name: config.RootName, Role: RoleAdmin, hash: hash}
+		}
+	}
+	if len(loaded) == 0 {
+		return errors.New("no admin user")
+	}
+	muxUsers.Lock()
+	users = loaded
+	muxUsers.Unlock()
+	return nil
+}
+
+func findUser(name string) *adminUser {
+	muxUsers.RLock()
+	defer muxUsers.RUnlock()
+	return users[name]
+}
+
+//checkPassword nil if the user exists and the password matches
+func checkPassword(name, password string) *adminUser {
+	user := findUser(name)
+	if nil == user {
+		return nil
+	}
+	if bcrypt.CompareHashAndPassword(user.hash, []byte(password)) != nil {
+		return nil
+	}
+	return user
+}
@@ -0,0 +1,313 @@
+package backend
+
+//apiDocument OpenAPI description of /api/v1/,served at /api/v1/openapi.json
+const apiDocument = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "websocket-streamserver admin api",
+    "version": "1.0.0"
+  },
+  "servers": [{"url": "/api/v1"}],
+  "security": [{"bearer": []}],
+  "paths": {
+    "/streams": {
+      "get": {
+        "summary": "live streams",
+        "responses": {
+          "200": {"description": "streams", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Stream"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/streams/{name}": {
+      "parameters": [{"$ref": "#/components/parameters/StreamName"}],
+      "get": {
+        "summary": "one live stream",
+        "responses": {
+          "200": {"description": "stream", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Stream"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "kick the publisher,operator only",
+        "responses": {
+          "204": {"description": "publisher disconnected"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/streams/{name}/sessions": {
+      "parameters": [{"$ref": "#/components/parameters/StreamName"}],
+      "get": {
+        "summary": "sessions playing or publishing the stream",
+        "responses": {
+          "200": {"description": "sessions", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Session"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/streams/{name}/pushes": {
+      "parameters": [{"$ref": "#/components/parameters/StreamName"}],
+      "get": {
+        "summary": "servers the stream is pushed to,stream keys hidden",
+        "responses": {
+          "200": {"description": "push targets", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/PushStatus"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "push the stream to another rtmp server whenever it is live,operator only",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PushTarget"}}}},
+        "responses": {
+          "201": {"description": "push target added", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PushTarget"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/streams/{name}/pushes/{id}": {
+      "parameters": [
+        {"$ref": "#/components/parameters/StreamName"},
+        {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}
+      ],
+      "delete": {
+        "summary": "stop pushing to the target,operator only",
+        "responses": {
+          "204": {"description": "push target removed"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/pushes": {
+      "get": {
+        "summary": "push targets of all streams,stream keys hidden",
+        "responses": {
+          "200": {"description": "push targets", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/PushStatus"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/sessions": {
+      "get": {
+        "summary": "rtmp,rtsp,websocket,hls and dash sessions",
+        "parameters": [{"name": "stream", "in": "query", "required": false, "description": "only sessions of this stream", "schema": {"type": "string"}}],
+        "responses": {
+          "200": {"description": "sessions", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Session"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/sessions/{id}": {
+      "delete": {
+        "summary": "disconnect a session,operator only",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "ban", "in": "query", "required": false, "description": "also ban the ip for seconds", "schema": {"type": "integer"}}
+        ],
+        "responses": {
+          "204": {"description": "session disconnected"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/bans": {
+      "get": {
+        "summary": "banned ips",
+        "responses": {
+          "200": {"description": "bans", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/BanInfo"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "refuse new sessions from an ip,operator only",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Ban"}}}},
+        "responses": {
+          "201": {"description": "ip banned", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Ban"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/bans/{ip}": {
+      "delete": {
+        "summary": "lift a ban,operator only",
+        "parameters": [{"name": "ip", "in": "path", "required": true, "schema": {"type": "string"}}],
+        "responses": {
+          "204": {"description": "ban lifted"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/relays": {
+      "post": {
+        "summary": "pull a rtmp,rtsp or hls stream into a local source,operator only",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Relay"}}}},
+        "responses": {
+          "201": {"description": "relay started", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Relay"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/upstreams": {
+      "post": {
+        "summary": "add an upstream pulled on demand,operator only",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Upstream"}}}},
+        "responses": {
+          "201": {"description": "upstream added", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Upstream"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "remove an upstream equal to the body,operator only",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Upstream"}}}},
+        "responses": {
+          "204": {"description": "upstream removed"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/acl": {
+      "put": {
+        "summary": "enable and edit black and white lists of stream names,operator only",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ACL"}}}},
+        "responses": {
+          "204": {"description": "lists changed"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/openapi.json": {
+      "get": {
+        "summary": "this document",
+        "security": [],
+        "responses": {"200": {"description": "OpenAPI document"}}
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "bearer": {"type": "http", "scheme": "bearer", "description": "token from POST /admin/login"}
+    },
+    "parameters": {
+      "StreamName": {"name": "name", "in": "path", "required": true, "description": "app/stream,the slash is kept", "schema": {"type": "string"}}
+    },
+    "responses": {
+      "Error": {"description": "error", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+    },
+    "schemas": {
+      "Error": {
+        "type": "object",
+        "properties": {
+          "error": {
+            "type": "object",
+            "properties": {
+              "code": {"type": "integer"},
+              "message": {"type": "string"}
+            }
+          }
+        }
+      },
+      "Stream": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "players": {"type": "integer"},
+          "addr": {"type": "string"}
+        }
+      },
+      "Session": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "protocol": {"type": "string", "enum": ["rtmp", "rtsp", "websocket", "hls", "dash"]},
+          "remoteAddr": {"type": "string"},
+          "stream": {"type": "string"},
+          "publisher": {"type": "boolean"},
+          "agent": {"type": "string", "description": "user agent,or flash version of rtmp clients"},
+          "start": {"type": "string", "format": "date-time"},
+          "bytesIn": {"type": "integer"},
+          "bytesOut": {"type": "integer"}
+        }
+      },
+      "Ban": {
+        "type": "object",
+        "required": ["ip", "seconds"],
+        "properties": {
+          "ip": {"type": "string"},
+          "seconds": {"type": "integer"}
+        }
+      },
+      "BanInfo": {
+        "type": "object",
+        "properties": {
+          "ip": {"type": "string"},
+          "until": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Relay": {
+        "type": "object",
+        "required": ["url"],
+        "properties": {
+          "source": {"type": "string", "description": "local stream name,app/stream of the url if empty"},
+          "url": {"type": "string", "description": "rtmp[s]://,rtsp:// or http[s]://.../stream.m3u8", "example": "rtmp://example.com:1935/live/hks"},
+          "skipVerify": {"type": "boolean"}
+        }
+      },
+      "PushTarget": {
+        "type": "object",
+        "required": ["url"],
+        "properties": {
+          "id": {"type": "string", "description": "generated if empty"},
+          "stream": {"type": "string", "description": "local stream,taken from the path"},
+          "url": {"type": "string", "example": "rtmp://a.rtmp.youtube.com/live2/streamkey"},
+          "skipVerify": {"type": "boolean"}
+        }
+      },
+      "PushStatus": {
+        "allOf": [
+          {"$ref": "#/components/schemas/PushTarget"},
+          {
+            "type": "object",
+            "properties": {
+              "state": {"type": "string", "enum": ["waiting", "connecting", "publishing", "retrying", "stopped"]},
+              "since": {"type": "string", "format": "date-time"},
+              "retries": {"type": "integer", "description": "failed connections,retried with backoff up to a minute"},
+              "lastError": {"type": "string"},
+              "bytesOut": {"type": "integer"}
+            }
+          }
+        ]
+      },
+      "Upstream": {
+        "type": "object",
+        "required": ["app", "protocol", "addr"],
+        "properties": {
+          "ID": {"type": "string"},
+          "app": {"type": "string"},
+          "instance": {"type": "string"},
+          "protocol": {"type": "string", "enum": ["rtmp", "rtmps", "rtsp", "hls"]},
+          "port": {"type": "integer"},
+          "addr": {"type": "string"},
+          "weight": {"type": "integer"},
+          "tlsSkipVerify": {"type": "boolean"},
+          "https": {"type": "boolean"},
+          "playlist": {"type": "string"}
+        }
+      },
+      "ACLList": {
+        "type": "object",
+        "properties": {
+          "enabled": {"type": "boolean"},
+          "add": {"type": "array", "items": {"type": "string"}},
+          "remove": {"type": "array", "items": {"type": "string"}}
+        }
+      },
+      "ACL": {
+        "type": "object",
+        "properties": {
+          "black": {"$ref": "#/components/schemas/ACLList"},
+          "white": {"$ref": "#/components/schemas/ACLList"}
+        }
+      }
+    }
+  }
+}
+`
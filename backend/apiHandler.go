@@ -0,0 +1,585 @@
+package backend
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/events/eHLSEvent"
+	"github.com/use-go/websocket-streamserver/events/eLiveListCtrl"
+	"github.com/use-go/websocket-streamserver/events/eRTMPEvent"
+	"github.com/use-go/websocket-streamserver/events/eRTSPEvent"
+	"github.com/use-go/websocket-streamserver/events/eStreamerEvent"
+	"github.com/use-go/websocket-streamserver/session"
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+const (
+	apiRoute        = "/api/v1/"
+	apiMaxBodySize  = 1 << 20
+	apiRelayTimeout = 10 * time.Second
+)
+
+//apiHandler resource oriented json api,stream names keep their slash:
+//GET /api/v1/streams/live/hks/sessions
+type apiHandler struct {
+	route string
+}
+
+//apiError every failed api request answers this with a http status
+type apiError struct {
+	Error apiErrorBody `json:"error"`
+}
+
+type apiErrorBody struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type apiStream struct {
+	Name    string `json:"name"`
+	Players int    `json:"players"`
+	Addr    string `json:"addr"`
+}
+
+//apiRelay pull url into the local source,rtmp[s],rtsp and http[s] hls urls
+type apiRelay struct {
+	Source     string `json:"source,omitempty"`
+	URL        string `json:"url"`
+	SkipVerify bool   `json:"skipVerify,omitempty"`
+}
+
+//apiBan refuse new sessions from IP for Seconds
+type apiBan struct {
+	IP      string `json:"ip"`
+	Seconds int    `json:"seconds"`
+}
+
+//apiACLList nil Enabled keeps the list enabled or not
+type apiACLList struct {
+	Enabled *bool    `json:"enabled,omitempty"`
+	Add     []string `json:"add,omitempty"`
+	Remove  []string `json:"remove,omitempty"`
+}
+
+type apiACL struct {
+	Black *apiACLList `json:"black,omitempty"`
+	White *apiACLList `json:"white,omitempty"`
+}
+
+func (ah *apiHandler) init(data *wssapi.Msg) (err error) {
+	ah.route = apiRoute
+	return
+}
+
+func (ah *apiHandler) getRoute() (route string) {
+	return ah.route
+}
+
+//requiredRole the document is public,viewers can only get
+func (ah *apiHandler) requiredRole(req *http.Request) string {
+	if req.URL.Path == ah.route+"openapi.json" {
+		return ""
+	}
+	if req.Method == "GET" || req.Method == "HEAD" {
+		return RoleViewer
+	}
+	return RoleOperator
+}
+
+func (ah *apiHandler) sendError(w http.ResponseWriter, status int, msg string, code int) {
+	sendAPIError(w, status, code, msg)
+}
+
+func (ah *apiHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(req.URL.Path, "/")
+	switch {
+	case path == "openapi.json":
+		if allowMethods(w, req, "GET") {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, apiDocument)
+		}
+	case path == "streams":
+		if allowMethods(w, req, "GET") {
+			sendAPIJSON(w, http.StatusOK, liveStreams())
+		}
+	case strings.HasPrefix(path, "streams/") && strings.HasSuffix(path, "/sessions"):
+		if allowMethods(w, req, "GET") {
+			ah.getSessions(w, strings.TrimSuffix(strings.TrimPrefix(path, "streams/"), "/sessions"))
+		}
+	case strings.HasPrefix(path, "streams/") && strings.HasSuffix(path, "/pushes"):
+		if allowMethods(w, req, "GET", "POST") {
+			name := strings.TrimSuffix(strings.TrimPrefix(path, "streams/"), "/pushes")
+			if req.Method == "GET" {
+				ah.getPushes(w, name)
+			} else {
+				ah.addPush(w, req, name)
+			}
+		}
+	case strings.HasPrefix(path, "streams/") && strings.Contains(path, "/pushes/"):
+		if allowMethods(w, req, "DELETE") {
+			idx := strings.LastIndex(path, "/pushes/")
+			ah.delPush(w, strings.TrimPrefix(path[:idx], "streams/"), path[idx+len("/pushes/"):])
+		}
+	case path == "pushes":
+		if allowMethods(w, req, "GET") {
+			ah.getPushes(w, "")
+		}
+	case strings.HasPrefix(path, "streams/"):
+		name := strings.TrimPrefix(path, "streams/")
+		if allowMethods(w, req, "GET", "DELETE") {
+			if req.Method == "GET" {
+				ah.getStream(w, name)
+			} else {
+				ah.kickStream(w, name)
+			}
+		}
+	case path == "sessions":
+		if allowMethods(w, req, "GET") {
+			sendAPIJSON(w, http.StatusOK, session.List(req.URL.Query().Get("stream")))
+		}
+	case strings.HasPrefix(path, "sessions/"):
+		if allowMethods(w, req, "DELETE") {
+			ah.kickSession(w, req, strings.TrimPrefix(path, "sessions/"))
+		}
+	case path == "bans":
+		if allowMethods(w, req, "GET", "POST") {
+			if req.Method == "GET" {
+				sendAPIJSON(w, http.StatusOK, session.Bans())
+			} else {
+				ah.addBan(w, req)
+			}
+		}
+	case strings.HasPrefix(path, "bans/"):
+		if allowMethods(w, req, "DELETE") {
+			if false == session.Unban(strings.TrimPrefix(path, "bans/")) {
+				sendAPIError(w, http.StatusNotFound, WSSNotFound, "ip not banned")
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case path == "relays":
+		if allowMethods(w, req, "POST") {
+			ah.addRelay(w, req)
+		}
+	case path == "upstreams":
+		if allowMethods(w, req, "POST", "DELETE") {
+			ah.setUpstream(w, req)
+		}
+	case path == "acl":
+		if allowMethods(w, req, "PUT") {
+			ah.setACL(w, req)
+		}
+	default:
+		sendAPIError(w, http.StatusNotFound, WSSNotFound, "no resource "+req.URL.Path)
+	}
+}
+
+func (ah *apiHandler) getStream(w http.ResponseWriter, name string) {
+	for _, stream := range liveStreams() {
+		if stream.Name == name {
+			sendAPIJSON(w, http.StatusOK, stream)
+			return
+		}
+	}
+	sendAPIError(w, http.StatusNotFound, WSSNotFound, "stream not found:"+name)
+}
+
+func (ah *apiHandler) getSessions(w http.ResponseWriter, name string) {
+	if len(name) == 0 {
+		sendAPIError(w, http.StatusBadRequest, WSSParamError, "need stream name")
+		return
+	}
+	sendAPIJSON(w, http.StatusOK, session.List(name))
+}
+
+//kickSession disconnect one client,?ban=seconds bans its ip too
+func (ah *apiHandler) kickSession(w http.ResponseWriter, req *http.Request, id string) {
+	banSec := 0
+	if ban := req.URL.Query().Get("ban"); len(ban) > 0 {
+		var err error
+		if banSec, err = strconv.Atoi(ban); err != nil || banSec < 0 {
+			sendAPIError(w, http.StatusBadRequest, WSSParamError, "ban should be seconds")
+			return
+		}
+	}
+	if _, err := session.Kick(id, time.Duration(banSec)*time.Second); err != nil {
+		sendAPIError(w, http.StatusNotFound, WSSNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ah *apiHandler) addBan(w http.ResponseWriter, req *http.Request) {
+	ban := &apiBan{}
+	if err := decodeJSON(req, ban); err != nil {
+		sendAPIError(w, http.StatusBadRequest, WSSParamError, err.Error())
+		return
+	}
+	if nil == net.ParseIP(ban.IP) || ban.Seconds <= 0 {
+		sendAPIError(w, http.StatusBadRequest, WSSParamError, "need ip and seconds")
+		return
+	}
+	session.Ban(ban.IP, time.Duration(ban.Seconds)*time.Second)
+	sendAPIJSON(w, http.StatusCreated, ban)
+}
+
+//kickStream disconnect the publisher,players wait for a new one
+func (ah *apiHandler) kickStream(w http.ResponseWriter, name string) {
+	eve := &eStreamerEvent.EveDelSource{StreamName: name, ID: eStreamerEvent.DelSourceForce}
+	if err := wssapi.HandleTask(eve); err != nil {
+		sendAPIError(w, http.StatusNotFound, WSSNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//addRelay pull a rtmp,rtsp or hls stream now,the puller stops when the source has no player
+func (ah *apiHandler) addRelay(w http.ResponseWriter, req *http.Request) {
+	relay := &apiRelay{}
+	if err := decodeJSON(req, relay); err != nil {
+		sendAPIError(w, http.StatusBadRequest, WSSParamError, err.Error())
+		return
+	}
+	task, chSrc, err := relayTask(relay)
+	if err != nil {
+		sendAPIError(w, http.StatusBadRequest, WSSParamError, err.Error())
+		return
+	}
+	if err = wssapi.HandleTask(task); err != nil {
+		sendAPIError(w, http.StatusBadGateway, WSSSeverHandleError, "relay failed:"+err.Error())
+		return
+	}
+	select {
+	case src, ok := <-chSrc:
+		if false == ok || nil == src {
+			sendAPIError(w, http.StatusBadGateway, WSSSeverHandleError, "relay failed:"+relay.URL)
+			return
+		}
+	case <-time.After(apiRelayTimeout):
+		sendAPIError(w, http.StatusGatewayTimeout, WSSSeverHandleError, "relay timeout:"+relay.URL)
+		return
+	}
+	sendAPIJSON(w, http.StatusCreated, relay)
+}
+
+//relayTask pull task of the puller the url scheme belongs to,relay.Source is filled if empty,
+//the puller may answer on chSrc after we gave up,so it is buffered
+func relayTask(relay *apiRelay) (task wssapi.Task, chSrc chan wssapi.MsgHandler, err error) {
+	u, err := url.Parse(relay.URL)
+	if err != nil || len(u.Hostname()) == 0 {
+		return nil, nil, errors.New("invalid url:" + relay.URL)
+	}
+	subs := strings.Split(strings.Trim(u.Path, "/"), "/")
+	chSrc = make(chan wssapi.MsgHandler, 1)
+	switch strings.ToLower(u.Scheme) {
+	case "rtmp", "rtmps":
+		task, err = rtmpRelayTask(relay, u, subs, chSrc)
+	case "rtsp":
+		task, err = rtspRelayTask(relay, u, subs, chSrc)
+	case "http", "https":
+		task, err = hlsRelayTask(relay, u, subs, chSrc)
+	default:
+		err = errors.New("only rtmp,rtmps,rtsp and http[s] hls urls can be relayed")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return
+}
+
+//relayPort the port of u,def if it has none
+func relayPort(u *url.URL, def int) (port int, err error) {
+	if len(u.Port()) == 0 {
+		return def, nil
+	}
+	if port, err = strconv.Atoi(u.Port()); err != nil {
+		return 0, errors.New("invalid port:" + u.Port())
+	}
+	return
+}
+
+//relaySource app/stream of the url,a url without app needs the source given
+func relaySource(relay *apiRelay, app, streamName string) error {
+	if len(relay.Source) > 0 {
+		return nil
+	}
+	if len(app) == 0 || len(streamName) == 0 {
+		return errors.New("source is needed for " + relay.URL)
+	}
+	relay.Source = app + "/" + streamName
+	return nil
+}
+
+//rtmpRelayTask rtmp[s]://host[:port]/app[/instance]/stream
+func rtmpRelayTask(relay *apiRelay, u *url.URL, subs []string, chSrc chan wssapi.MsgHandler) (task *eRTMPEvent.EvePullRTMPStream, err error) {
+	protocol := strings.ToLower(u.Scheme)
+	port := 1935
+	if protocol == "rtmps" {
+		port = 443
+	}
+	if port, err = relayPort(u, port); err != nil {
+		return
+	}
+	if len(subs) < 2 {
+		return nil, errors.New("url should be rtmp://host:port/app/stream")
+	}
+	app := strings.Join(subs[:len(subs)-1], "/")
+	streamName := subs[len(subs)-1]
+	if err = relaySource(relay, app, streamName); err != nil {
+		return
+	}
+	task = &eRTMPEvent.EvePullRTMPStream{}
+	task.Init(protocol, app, strings.Join(subs[1:len(subs)-1], "/"), u.Hostname(), streamName, relay.Source, port)
+	task.SkipVerify = relay.SkipVerify
+	task.Src = chSrc
+	return
+}
+
+//rtspRelayTask rtsp://[user:password@]host[:port]/path/stream,cameras often have no app,
+//the source should be given for them
+func rtspRelayTask(relay *apiRelay, u *url.URL, subs []string, chSrc chan wssapi.MsgHandler) (task *eRTSPEvent.EvePullRTSPStream, err error) {
+	port, err := relayPort(u, 554)
+	if err != nil {
+		return
+	}
+	if len(subs[len(subs)-1]) == 0 {
+		return nil, errors.New("url should be rtsp://host:port/app/stream")
+	}
+	task = &eRTSPEvent.EvePullRTSPStream{
+		Protocol:   "rtsp",
+		App:        strings.Join(subs[:len(subs)-1], "/"),
+		Address:    u.Hostname(),
+		Port:       port,
+		StreamName: subs[len(subs)-1],
+		Src:        chSrc}
+	if u.User != nil {
+		task.Address = u.User.String() + "@" + task.Address
+	}
+	if err = relaySource(relay, task.App, task.StreamName); err != nil {
+		return nil, err
+	}
+	task.SourceName = relay.Source
+	return
+}
+
+//hlsRelayTask http[s]://host[:port]/app/stream.m3u8
+func hlsRelayTask(relay *apiRelay, u *url.URL, subs []string, chSrc chan wssapi.MsgHandler) (task *eHLSEvent.EvePullHLSStream, err error) {
+	port, err := relayPort(u, 0)
+	if err != nil {
+		return
+	}
+	playlist := subs[len(subs)-1]
+	if false == strings.HasSuffix(playlist, ".m3u8") || len(playlist) == len(".m3u8") {
+		return nil, errors.New("hls url should be http[s]://host:port/app/stream.m3u8")
+	}
+	task = &eHLSEvent.EvePullHLSStream{
+		HTTPS:      strings.ToLower(u.Scheme) == "https",
+		App:        strings.Join(subs[:len(subs)-1], "/"),
+		Address:    u.Hostname(),
+		Port:       port,
+		StreamName: strings.TrimSuffix(playlist, ".m3u8"),
+		SkipVerify: relay.SkipVerify,
+		Src:        chSrc}
+	if err = relaySource(relay, task.App, task.StreamName); err != nil {
+		return nil, err
+	}
+	task.SourceName = relay.Source
+	return
+}
+
+//getPushes push targets of name with their state,all targets if name is empty
+func (ah *apiHandler) getPushes(w http.ResponseWriter, name string) {
+	eve := &eRTMPEvent.EveGetPushTargets{StreamName: name}
+	if err := wssapi.HandleTask(eve); err != nil {
+		sendAPIError(w, http.StatusInternalServerError, WSSSeverHandleError, err.Error())
+		return
+	}
+	pushes := make([]eRTMPEvent.PushStatus, 0, len(eve.Targets))
+	for _, v := range eve.Targets {
+		v.URL = hideStreamKey(v.URL)
+		pushes = append(pushes, v)
+	}
+	sendAPIJSON(w, http.StatusOK, pushes)
+}
+
+//addPush start pushing the stream now,it is pushed whenever it is live
+func (ah *apiHandler) addPush(w http.ResponseWriter, req *http.Request, name string) {
+	eve := &eRTMPEvent.EveAddPushTarget{}
+	if err := decodeJSON(req, &eve.Target); err != nil {
+		sendAPIError(w, http.StatusBadRequest, WSSParamError, err.Error())
+		return
+	}
+	if len(eve.Target.URL) == 0 {
+		sendAPIError(w, http.StatusBadRequest, WSSParamError, "need url")
+		return
+	}
+	eve.Target.StreamName = name
+	if err := wssapi.HandleTask(eve); err != nil {
+		sendAPIError(w, http.StatusBadRequest, WSSParamError, err.Error())
+		return
+	}
+	eve.Target.URL = hideStreamKey(eve.Target.URL)
+	sendAPIJSON(w, http.StatusCreated, eve.Target)
+}
+
+func (ah *apiHandler) delPush(w http.ResponseWriter, name, id string) {
+	eve := &eRTMPEvent.EveDelPushTarget{StreamName: name, ID: id}
+	if err := wssapi.HandleTask(eve); err != nil {
+		sendAPIError(w, http.StatusNotFound, WSSNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//hideStreamKey the last path element of push urls is the key of the account
+func hideStreamKey(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || strings.LastIndex(u.Path, "/") <= 0 {
+		return rawURL
+	}
+	u.Path = u.Path[:strings.LastIndex(u.Path, "/")+1] + "xxxx"
+	u.RawPath = ""
+	u.RawQuery = ""
+	return u.String()
+}
+
+//setUpstream POST to add,DELETE to remove the same one
+func (ah *apiHandler) setUpstream(w http.ResponseWriter, req *http.Request) {
+	eve := &eLiveListCtrl.EveSetUpStreamApp{}
+	if err := decodeJSON(req, eve); err != nil {
+		sendAPIError(w, http.StatusBadRequest, WSSParamError, err.Error())
+		return
+	}
+	if len(eve.App) == 0 || len(eve.Addr) == 0 || len(eve.Protocol) == 0 {
+		sendAPIError(w, http.StatusBadRequest, WSSParamError, "need app,addr and protocol")
+		return
+	}
+	eve.Add = req.Method == "POST"
+	if err := wssapi.HandleTask(eve); err != nil {
+		sendAPIError(w, http.StatusConflict, WSSSeverHandleError, err.Error())
+		return
+	}
+	if eve.Add {
+		sendAPIJSON(w, http.StatusCreated, eve)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (ah *apiHandler) setACL(w http.ResponseWriter, req *http.Request) {
+	acl := &apiACL{}
+	if err := decodeJSON(req, acl); err != nil {
+		sendAPIError(w, http.StatusBadRequest, WSSParamError, err.Error())
+		return
+	}
+	if nil == acl.Black && nil == acl.White {
+		sendAPIError(w, http.StatusBadRequest, WSSParamError, "need black or white")
+		return
+	}
+	if err := applyACL(acl.Black, true); err != nil {
+		sendAPIError(w, http.StatusInternalServerError, WSSSeverHandleError, "black list:"+err.Error())
+		return
+	}
+	if err := applyACL(acl.White, false); err != nil {
+		sendAPIError(w, http.StatusInternalServerError, WSSSeverHandleError, "white list:"+err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func applyACL(acl *apiACLList, black bool) (err error) {
+	if nil == acl {
+		return
+	}
+	if acl.Enabled != nil {
+		if black {
+			err = wssapi.HandleTask(&eLiveListCtrl.EveEnableBlackList{Enable: *acl.Enabled})
+		} else {
+			err = wssapi.HandleTask(&eLiveListCtrl.EveEnableWhiteList{Enable: *acl.Enabled})
+		}
+		if err != nil {
+			return
+		}
+	}
+	for _, op := range []struct {
+		add   bool
+		names []string
+	}{{true, acl.Add}, {false, acl.Remove}} {
+		if len(op.names) == 0 {
+			continue
+		}
+		names := list.New()
+		for _, name := range op.names {
+			names.PushBack(name)
+		}
+		if black {
+			err = wssapi.HandleTask(&eLiveListCtrl.EveSetBlackList{Add: op.add, Names: names})
+		} else {
+			err = wssapi.HandleTask(&eLiveListCtrl.EveSetWhiteList{Add: op.add, Names: names})
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func liveStreams() (streams []apiStream) {
+	streams = make([]apiStream, 0)
+	eve := &eLiveListCtrl.EveGetLiveList{}
+	if wssapi.HandleTask(eve) != nil || nil == eve.Lives {
+		return
+	}
+	for item := eve.Lives.Front(); item != nil; item = item.Next() {
+		info := item.Value.(*eLiveListCtrl.LiveInfo)
+		streams = append(streams, apiStream{Name: info.StreamName, Players: info.PlayerCount, Addr: info.IP})
+	}
+	return
+}
+
+//allowMethods answer 405 if the method is not one of methods
+func allowMethods(w http.ResponseWriter, req *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if req.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	sendAPIError(w, http.StatusMethodNotAllowed, WSSRequestMethodError, "method not allowed:"+req.Method)
+	return false
+}
+
+func decodeJSON(req *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(io.LimitReader(req.Body, apiMaxBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return errors.New("invalid json body:" + err.Error())
+	}
+	return nil
+}
+
+func sendAPIJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		sendAPIError(w, http.StatusInternalServerError, WSSSeverError, "encode response failed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func sendAPIError(w http.ResponseWriter, status, code int, msg string) {
+	data, _ := json.Marshal(&apiError{Error: apiErrorBody{Code: code, Message: msg}})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
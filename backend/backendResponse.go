@@ -11,7 +11,9 @@ const (
 	WSSUserAuthError      = 101
 	WSSParamError         = 102
 	WSSNotLogin           = 103
+	WSSPermissionDenied   = 104
 	WSSRequestOK          = 200
+	WSSNotFound           = 404
 	WSSSeverHandleError   = 501
 	WSSSeverError         = 500
 )
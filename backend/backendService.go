@@ -1,12 +1,15 @@
 package backend
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/tlsconf"
 	"github.com/use-go/websocket-streamserver/wssapi"
 	"github.com/use-go/websocket-streamserver/utils"
 )
@@ -19,15 +22,33 @@ type backendServiceHander interface {
 
 //BackendService for web
 type BackendService struct {
+	server    *http.Server
+	tlsServer *http.Server
 }
 
 //BackendConfig for web
+//Users log in to get a session token valid for SessionTTLSec,signed by SessionSecret,
+//a random secret is used if empty and sessions are lost on restart,
+//every admin request is appended to AuditLog
 type BackendConfig struct {
 	Port     int    `json:"Port"`
 	RootName string `json:"Usr"`
 	RootPwd  string `json:"Pwd"`
+	//TLS https for the admin api,beside the plain port
+	TLS           *tlsconf.Config   `json:"TLS"`
+	Users         []AdminUserConfig `json:"Users,omitempty"`
+	SessionSecret string            `json:"SessionSecret,omitempty"`
+	SessionTTLSec int               `json:"SessionTTLSec,omitempty"`
+	AuditLog      string            `json:"AuditLog,omitempty"`
+	//MetricsToken bearer token for prometheus scrapers,without it /metrics needs a viewer session
+	MetricsToken string `json:"MetricsToken,omitempty"`
 }
 
+const (
+	shutdownTimeout   = 5 * time.Second
+	defaultSessionTTL = 3600
+)
+
 var serviceConfig BackendConfig
 
 func serveDefaultHome(w http.ResponseWriter, r *http.Request) {
@@ -50,24 +71,40 @@ func (backend *BackendService) Init(msg *wssapi.Msg) (err error) {
 	}
 
 	fileName := msg.Param1.(string)
-	err = backend.loadConfigFile(fileName)
+	cfg, err := backend.loadConfigFile(fileName)
 	if err != nil {
 		logger.LOGE(err.Error())
 		return errors.New("load backend config failed")
 	}
-
+	sessions, err = newSessionManager(cfg.SessionSecret, time.Duration(cfg.SessionTTLSec)*time.Second)
+	if err != nil {
+		logger.LOGE(err.Error())
+		return errors.New("load backend config failed")
+	}
+	serviceConfig = *cfg
 	return
 }
 
-func (backend *BackendService) loadConfigFile(fileName string) (err error) {
+//loadConfigFile read a new config,users and the audit log are switched to it
+func (backend *BackendService) loadConfigFile(fileName string) (cfg *BackendConfig, err error) {
 	data, err := utils.ReadFileAll(fileName)
 	if err != nil {
 		return
 	}
 
-	err = json.Unmarshal(data, &serviceConfig)
+	cfg = &BackendConfig{}
+	err = json.Unmarshal(data, cfg)
 	if err != nil {
-		return
+		return nil, err
+	}
+	if cfg.SessionTTLSec <= 0 {
+		cfg.SessionTTLSec = defaultSessionTTL
+	}
+	if err = loadUsers(cfg); err != nil {
+		return nil, err
+	}
+	if err = audit.open(cfg.AuditLog); err != nil {
+		return nil, err
 	}
 	return
 }
@@ -75,31 +112,46 @@ func (backend *BackendService) loadConfigFile(fileName string) (err error) {
 //Start Service in Goroutine
 func (backend *BackendService) Start(msg *wssapi.Msg) (err error) {
 
-	go func() {
-		strPort := ":" + strconv.Itoa(serviceConfig.Port)
-		handlers := backendHandlerInit()
-		mux := http.NewServeMux()
-		for _, item := range handlers {
-			backHandler := item.(backendServiceHander)
-			logger.LOGD(backHandler.getRoute())
-			//http.Handle(backHandler.GetRoute(), http.StripPrefix(backHandler.GetRoute(), backHandler.(http.Handler)))
-			mux.Handle(backHandler.getRoute(), http.StripPrefix(backHandler.getRoute(), backHandler.(http.Handler)))
-		}
-		//handle static assert
-		mux.Handle("/web/", http.StripPrefix("/web/", http.FileServer(http.Dir("../test-websocket"))))
-		mux.HandleFunc("/", serveDefaultHome)
+	strPort := ":" + strconv.Itoa(serviceConfig.Port)
+	mux := newBackendMux()
+	backend.server = &http.Server{Addr: strPort, Handler: mux}
 
-		err = http.ListenAndServe(strPort, mux)
-		if err != nil {
+	go func(server *http.Server) {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
 			logger.LOGE("start backend serve failed")
 		}
-	}()
+	}(backend.server)
 
+	if serviceConfig.TLS.Enabled() {
+		store, err := tlsconf.NewStore(serviceConfig.TLS)
+		if err != nil {
+			logger.LOGE("backend tls disabled:" + err.Error())
+			return nil
+		}
+		backend.tlsServer = &http.Server{Addr: serviceConfig.TLS.Addr(), Handler: mux, TLSConfig: store.TLSConfig()}
+		go func(server *http.Server) {
+			err := server.ListenAndServeTLS("", "")
+			if err != nil && err != http.ErrServerClosed {
+				logger.LOGE("start backend https serve failed:" + err.Error())
+			}
+		}(backend.tlsServer)
+	}
 	return
 }
 
-//Stop Service
+//Stop Service,wait running requests at most a few seconds
 func (backend *BackendService) Stop(msg *wssapi.Msg) (err error) {
+	if nil == backend.server {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if nil != backend.tlsServer {
+		backend.tlsServer.Shutdown(ctx)
+	}
+	err = backend.server.Shutdown(ctx)
+	audit.close()
 	return
 }
 
@@ -113,8 +165,22 @@ func (backend *BackendService) HandleTask(task wssapi.Task) (err error) {
 	return
 }
 
-//ProcessMessage of Service
+//ProcessMessage reload users and the audit log,sessions of removed users are rejected by verify,
+//the listeners and the session signing are kept
 func (backend *BackendService) ProcessMessage(msg *wssapi.Msg) (err error) {
+	switch msg.Type {
+	case wssapi.MsgReloadConfig:
+		var cfg *BackendConfig
+		cfg, err = backend.loadConfigFile(msg.Param1.(string))
+		if err != nil {
+			return
+		}
+		if cfg.Port != serviceConfig.Port || false == cfg.TLS.Equal(serviceConfig.TLS) ||
+			cfg.SessionSecret != serviceConfig.SessionSecret || cfg.SessionTTLSec != serviceConfig.SessionTTLSec ||
+			cfg.MetricsToken != serviceConfig.MetricsToken {
+			logger.LOGW("backend port,tls,session and metrics token change need restart")
+		}
+	}
 	return
 }
 
@@ -123,24 +189,31 @@ func (backend *BackendService) SetParent(parent wssapi.MsgHandler) {
 	return
 }
 
+//newBackendMux routes of all handlers behind the session check
+func newBackendMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	for _, item := range backendHandlerInit() {
+		backHandler := item.(backendServiceHander)
+		logger.LOGD(backHandler.getRoute())
+		//http.Handle(backHandler.GetRoute(), http.StripPrefix(backHandler.GetRoute(), backHandler.(http.Handler)))
+		mux.Handle(backHandler.getRoute(), withSession(backHandler, http.StripPrefix(backHandler.getRoute(), backHandler.(http.Handler))))
+	}
+	//handle static assert
+	mux.Handle("/web/", http.StripPrefix("/web/", http.FileServer(http.Dir("../test-websocket"))))
+	mux.HandleFunc("/", serveDefaultHome)
+	return mux
+}
+
 func backendHandlerInit() []backendServiceHander {
-	handers := make([]backendServiceHander, 0)
-	adminLoginHandle := &adminLoginHandler{}
-	lgData := &wssapi.Msg{}
-	loginData := adminLoginData{}
-	loginData.password = serviceConfig.RootPwd
-	loginData.username = serviceConfig.RootName
-	lgData.Param1 = loginData
-	err := adminLoginHandle.init(lgData)
-	if err == nil {
-		handers = append(handers, adminLoginHandle)
-	} else {
-		if err != nil {
-			logger.LOGE("add adminLoginHandle error!")
-		}
+	handers := []backendServiceHander{
+		&adminLoginHandler{},
+		&adminLogoutHandler{},
+		&adminAuditHandler{},
+		&adminStreamManageHandler{},
+		&apiHandler{},
+		&metricsHandler{}}
+	for _, hander := range handers {
+		hander.init(nil)
 	}
-	streamManagerHandle := &adminStreamManageHandler{}
-	streamManagerHandle.init(nil)
-	handers = append(handers, streamManagerHandle)
 	return handers
 }
@@ -17,6 +17,8 @@ type Data struct {
 type Usr struct {
 	Usrname string `json:"usrname"`
 	Token   string `json:"token"`
+	Role    string `json:"role,omitempty"`
+	Expires int64  `json:"expires,omitempty"`
 }
 
 // Action struct
@@ -49,4 +51,8 @@ const (
 	WSAddSource
 	WSDelSource
 	WSGetSource
+	WSStartRecord
+	WSStopRecord
+	WSGetRecordList
+	WSGetVODList
 )
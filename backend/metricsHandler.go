@@ -0,0 +1,44 @@
+package backend
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/use-go/websocket-streamserver/metrics"
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+//metricsHandler prometheus scrape,needs a viewer session or the MetricsToken of the config,
+//scrapers send the token as "Authorization: Bearer <token>"
+type metricsHandler struct {
+	route string
+}
+
+func (mh *metricsHandler) init(data *wssapi.Msg) (err error) {
+	mh.route = "/metrics"
+	return
+}
+
+func (mh *metricsHandler) getRoute() (route string) {
+	return mh.route
+}
+
+func (mh *metricsHandler) requiredRole(req *http.Request) string {
+	if isScrapeToken(requestToken(req)) {
+		return ""
+	}
+	return RoleViewer
+}
+
+func (mh *metricsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	metrics.ServeHTTP(w, req)
+}
+
+//isScrapeToken a token matches the configured one,no token configured matches nothing
+func isScrapeToken(token string) bool {
+	expected := serviceConfig.MetricsToken
+	if len(expected) == 0 || len(token) == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
@@ -0,0 +1,387 @@
+//Package cmaf cuts a stream into fmp4 segments once,hls and dash serve the same segments
+package cmaf
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/abr"
+	"github.com/use-go/websocket-streamserver/events/eStreamerEvent"
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/mediatype/mp4"
+	"github.com/use-go/websocket-streamserver/utils"
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+//MinSegments kept at least,more for the window
+const MinSegments = 5
+
+//Segment start and duration in ms,Idx is the aligned window,Seq increases by one for every segment
+type Segment struct {
+	Idx      int64
+	Seq      int64
+	Start    uint32
+	Duration uint32
+	Data     []byte
+}
+
+//Snapshot segments and media info of a stream at a time
+type Snapshot struct {
+	StartTime      time.Time
+	Variant        abr.Variant
+	AudioBandwidth int
+	Videos         []*Segment
+	Audios         []*Segment
+}
+
+//Stream sink of one stream,fmp4 segments are cut by the aligner and shared by hls and dash
+type Stream struct {
+	name      string
+	segmentMs int
+	clientID  string
+	sinkAdded bool
+	refs      int
+
+	//only touched by the streamer goroutine
+	aligner     *abr.Aligner
+	creater     *mp4.FMP4Creater
+	audioHeader *flv.FlvTag
+	videoHeader *flv.FlvTag
+	started     bool
+	videoBuf    []byte
+	videoBegin  uint32
+	segIdx      int64
+	segSeq      int64
+	audioBuf    []byte
+	audioBegin  uint32
+
+	mux       sync.RWMutex
+	closed    bool
+	windowMs  int
+	startTime time.Time
+	variant   *abr.Variant
+	audioRate *abr.Variant
+	videoInit []byte
+	audioInit []byte
+	initData  []byte
+	videos    []*Segment
+	audios    []*Segment
+	waits     []chan bool
+}
+
+var streams = make(map[string]*Stream)
+var muxStreams sync.Mutex
+
+//Acquire the stream of name cut by segmentMs,created and added to the source if not existed,
+//segments in windowMs are kept,Release when not used
+func Acquire(name string, segmentMs, windowMs int) (stream *Stream) {
+	key := name + "@" + strconv.Itoa(segmentMs)
+	muxStreams.Lock()
+	stream, ok := streams[key]
+	if false == ok || stream.Closed() {
+		stream = &Stream{
+			name:      name,
+			segmentMs: segmentMs,
+			clientID:  utils.GenerateGUID(),
+			aligner:   abr.NewAligner(segmentMs)}
+		streams[key] = stream
+		defer func() {
+			taskAddSink := &eStreamerEvent.EveAddSink{
+				StreamName: name,
+				SinkId:     stream.clientID,
+				Sinker:     stream}
+			wssapi.HandleTask(taskAddSink)
+		}()
+	}
+	stream.refs++
+	muxStreams.Unlock()
+
+	stream.mux.Lock()
+	if windowMs > stream.windowMs {
+		stream.windowMs = windowMs
+	}
+	stream.mux.Unlock()
+	return
+}
+
+//Release removed from the source when all users released
+func (stream *Stream) Release() {
+	key := stream.name + "@" + strconv.Itoa(stream.segmentMs)
+	muxStreams.Lock()
+	stream.refs--
+	if stream.refs > 0 {
+		muxStreams.Unlock()
+		return
+	}
+	if streams[key] == stream {
+		delete(streams, key)
+	}
+	muxStreams.Unlock()
+	stream.Stop(nil)
+}
+
+//Name of the stream
+func (stream *Stream) Name() string {
+	return stream.name
+}
+
+//Init nothing to do
+func (stream *Stream) Init(msg *wssapi.Msg) (err error) {
+	return
+}
+
+//Start nothing to do
+func (stream *Stream) Start(msg *wssapi.Msg) (err error) {
+	return
+}
+
+//Stop remove from streamer,waiting requests are released,Acquire creates a new one
+func (stream *Stream) Stop(msg *wssapi.Msg) (err error) {
+	stream.mux.Lock()
+	if stream.closed {
+		stream.mux.Unlock()
+		return
+	}
+	stream.closed = true
+	sinkAdded := stream.sinkAdded
+	waits := stream.waits
+	stream.waits = nil
+	stream.mux.Unlock()
+	for _, ch := range waits {
+		close(ch)
+	}
+	if sinkAdded {
+		taskDelSink := &eStreamerEvent.EveDelSink{}
+		taskDelSink.StreamName = stream.name
+		taskDelSink.SinkId = stream.clientID
+		go wssapi.HandleTask(taskDelSink)
+		logger.LOGT("del cmaf sinker:" + stream.clientID)
+	}
+	return
+}
+
+//GetType of stream
+func (stream *Stream) GetType() string {
+	return ""
+}
+
+//HandleTask not implemention
+func (stream *Stream) HandleTask(task wssapi.Task) (err error) {
+	return
+}
+
+//ProcessMessage from source
+func (stream *Stream) ProcessMessage(msg *wssapi.Msg) (err error) {
+	switch msg.Type {
+	case wssapi.MsgGetSourceNotify, wssapi.MsgPlayStart:
+		stream.mux.Lock()
+		stream.sinkAdded = true
+		stream.mux.Unlock()
+	case wssapi.MsgGetSourceFailed, wssapi.MsgPlayStop:
+		stream.Stop(nil)
+	case wssapi.MsgFlvTag:
+		stream.AddFlvTag(msg.Param1.(*flv.FlvTag))
+	}
+	return
+}
+
+//Closed source stopped or released
+func (stream *Stream) Closed() bool {
+	stream.mux.RLock()
+	defer stream.mux.RUnlock()
+	return stream.closed
+}
+
+//AddFlvTag segments are cut at the aligned keyframes
+func (stream *Stream) AddFlvTag(tag *flv.FlvTag) {
+	if tag.TagType != flv.FlvTagAudio && tag.TagType != flv.FlvTagVideo {
+		return
+	}
+	if len(tag.Data) < 2 {
+		return
+	}
+	if flv.IsVideoSequenceHeader(tag) || flv.IsAudioSequenceHeader(tag) {
+		//codec change is not supported after start
+		if stream.started {
+			return
+		}
+		if tag.TagType == flv.FlvTagAudio {
+			stream.audioHeader = tag.Copy()
+		} else {
+			stream.videoHeader = tag.Copy()
+		}
+		return
+	}
+	boundary := tag.TagType == flv.FlvTagVideo && flv.IsKeyFrame(tag) && stream.aligner.Boundary(tag.Timestamp)
+	if false == stream.started {
+		if false == boundary || false == stream.start(tag.Timestamp) {
+			return
+		}
+	} else if boundary {
+		stream.flush(tag.Timestamp)
+	}
+	slice := stream.creater.AddFlvTag(tag)
+	if nil == slice || slice.Idx < 0 {
+		return
+	}
+	if slice.Type == flv.FlvTagVideo {
+		stream.videoBuf = append(stream.videoBuf, slice.Data...)
+	} else {
+		if len(stream.audioBuf) == 0 {
+			stream.audioBegin = tag.Timestamp
+		}
+		stream.audioBuf = append(stream.audioBuf, slice.Data...)
+	}
+}
+
+//start at the first aligned keyframe,timestamps are kept for the shared timeline
+func (stream *Stream) start(timestamp uint32) bool {
+	if nil == stream.videoHeader {
+		return false
+	}
+	stream.creater = &mp4.FMP4Creater{KeepTimestamp: true}
+	var videoInit, audioInit []byte
+	if slice := stream.creater.AddFlvTag(stream.videoHeader); slice != nil {
+		videoInit = slice.Data
+	}
+	if stream.audioHeader != nil {
+		if slice := stream.creater.AddFlvTag(stream.audioHeader); slice != nil {
+			audioInit = slice.Data
+		}
+	}
+	initData, err := mp4.MergeInitSegments(videoInit, audioInit)
+	if len(videoInit) == 0 || err != nil {
+		logger.LOGE("create cmaf init segment failed:" + stream.name)
+		stream.creater = nil
+		return false
+	}
+	stream.mux.Lock()
+	stream.videoInit = videoInit
+	stream.audioInit = audioInit
+	stream.initData = initData
+	stream.startTime = time.Now().Add(-time.Duration(timestamp) * time.Millisecond)
+	stream.variant = abr.NewVariant(stream.videoHeader, stream.audioHeader)
+	stream.audioRate = &abr.Variant{}
+	stream.mux.Unlock()
+	stream.started = true
+	stream.videoBegin = timestamp
+	stream.segIdx = stream.aligner.Index()
+	return true
+}
+
+//flush the segment before the keyframe at timestamp
+func (stream *Stream) flush(timestamp uint32) {
+	idx := stream.segIdx
+	stream.segIdx = stream.aligner.Index()
+	if timestamp <= stream.videoBegin || len(stream.videoBuf) == 0 {
+		stream.videoBegin = timestamp
+		stream.videoBuf = nil
+		return
+	}
+	video := &Segment{Idx: idx, Seq: stream.segSeq, Start: stream.videoBegin, Duration: timestamp - stream.videoBegin, Data: stream.videoBuf}
+	var audio *Segment
+	if len(stream.audioBuf) > 0 && timestamp > stream.audioBegin {
+		//音频段和视频段同一序号
+		audio = &Segment{Idx: idx, Seq: stream.segSeq, Start: stream.audioBegin, Duration: timestamp - stream.audioBegin, Data: stream.audioBuf}
+	}
+	stream.segSeq++
+	stream.videoBuf = nil
+	stream.audioBuf = nil
+	stream.videoBegin = timestamp
+
+	stream.mux.Lock()
+	stream.variant.AddSegment(len(video.Data), float64(video.Duration))
+	stream.videos = pushSegment(stream.videos, video, stream.windowMs)
+	if audio != nil {
+		stream.audioRate.AddSegment(len(audio.Data), float64(audio.Duration))
+		stream.audios = pushSegment(stream.audios, audio, stream.windowMs)
+	}
+	waits := stream.waits
+	stream.waits = nil
+	stream.mux.Unlock()
+	for _, ch := range waits {
+		close(ch)
+	}
+}
+
+//pushSegment the oldest is removed when the others still cover windowMs
+func pushSegment(segments []*Segment, seg *Segment, windowMs int) []*Segment {
+	segments = append(segments, seg)
+	if window := Window(segments, windowMs); len(window) < len(segments) {
+		segments = append([]*Segment(nil), window...)
+	}
+	return segments
+}
+
+//Window the last segments covering windowMs,MinSegments at least
+func Window(segments []*Segment, windowMs int) []*Segment {
+	if len(segments) == 0 {
+		return segments
+	}
+	last := segments[len(segments)-1]
+	end := int64(last.Start) + int64(last.Duration)
+	remove := 0
+	for len(segments)-remove > MinSegments && end-int64(segments[remove+1].Start) >= int64(windowMs) {
+		remove++
+	}
+	return segments[remove:]
+}
+
+//Wait until the next segment created,false if timeout or closed
+func (stream *Stream) Wait(timeout time.Duration) bool {
+	ch := make(chan bool)
+	stream.mux.Lock()
+	if stream.closed {
+		stream.mux.Unlock()
+		return false
+	}
+	stream.waits = append(stream.waits, ch)
+	stream.mux.Unlock()
+	select {
+	case <-ch:
+		return false == stream.Closed()
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+//Snapshot false before the first segment
+func (stream *Stream) Snapshot() (snapshot Snapshot, ok bool) {
+	stream.mux.RLock()
+	defer stream.mux.RUnlock()
+	if len(stream.videos) == 0 {
+		return
+	}
+	snapshot.StartTime = stream.startTime
+	snapshot.Variant = *stream.variant
+	snapshot.AudioBandwidth = stream.audioRate.Bandwidth
+	snapshot.Videos = stream.videos
+	snapshot.Audios = stream.audios
+	return snapshot, true
+}
+
+//InitSegments video and audio init segments and the merged one of both tracks
+func (stream *Stream) InitSegments() (video, audio, merged []byte) {
+	stream.mux.RLock()
+	defer stream.mux.RUnlock()
+	return stream.videoInit, stream.audioInit, stream.initData
+}
+
+//key of Find
+const (
+	ByIdx = iota
+	BySeq
+	ByStart
+)
+
+//Find segment of the track by Idx,Seq or Start
+func Find(segments []*Segment, key int64, by int) *Segment {
+	for _, seg := range segments {
+		if (by == ByIdx && seg.Idx == key) || (by == BySeq && seg.Seq == key) || (by == ByStart && int64(seg.Start) == key) {
+			return seg
+		}
+	}
+	return nil
+}
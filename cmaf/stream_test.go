@@ -0,0 +1,69 @@
+package cmaf
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/use-go/websocket-streamserver/abr"
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/mediatype/h264"
+	"github.com/use-go/websocket-streamserver/mediatype/mp4"
+)
+
+func TestStreamSegments(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xec, 0x04, 0x40, 0x00, 0x00, 0x03, 0x00, 0x40, 0x00, 0x00, 0x0c, 0x23, 0xc6, 0x0c, 0x92}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	frame := func(ts uint32) *flv.FlvTag {
+		frameType, nal := byte(0x27), byte(0x41)
+		if ts%200 == 0 {
+			frameType, nal = 0x17, 0x65
+		}
+		data := []byte{frameType, 1, 0, 0, 0, 0, 0, 0x03, 0xe8, nal}
+		return &flv.FlvTag{TagType: flv.FlvTagVideo, Timestamp: ts, Data: append(data, bytes.Repeat([]byte{0x11}, 999)...)}
+	}
+
+	stream := &Stream{name: "live/test", segmentMs: 1000, aligner: abr.NewAligner(1000)}
+	stream.AddFlvTag(&flv.FlvTag{TagType: flv.FlvTagVideo, Data: append([]byte{0x17, 0, 0, 0, 0}, h264.AVCDecoderConfigurationRecord(sps, pps)...)})
+	stream.AddFlvTag(&flv.FlvTag{TagType: flv.FlvTagAudio, Data: []byte{0xaf, 0, 0x12, 0x10}})
+	if _, ok := stream.Snapshot(); ok {
+		t.Fatal("snapshot before the first segment")
+	}
+	for ts := uint32(0); ts <= 8000; ts += 40 {
+		stream.AddFlvTag(frame(ts))
+		stream.AddFlvTag(&flv.FlvTag{TagType: flv.FlvTagAudio, Timestamp: ts, Data: []byte{0xaf, 1, 0x21, 0x22}})
+	}
+
+	snapshot, ok := stream.Snapshot()
+	if false == ok {
+		t.Fatal("no segment")
+	}
+	//0 开始的段不完整被丢弃,窗口为0时保留最少的段数
+	if len(snapshot.Videos) != MinSegments || len(snapshot.Audios) != MinSegments {
+		t.Fatalf("segments video %d audio %d", len(snapshot.Videos), len(snapshot.Audios))
+	}
+	last := snapshot.Videos[len(snapshot.Videos)-1]
+	if last.Start != 7000 || last.Duration != 1000 || last.Idx != 7 || last.Seq != snapshot.Videos[0].Seq+MinSegments-1 {
+		t.Fatalf("last segment %d %d %d %d", last.Start, last.Duration, last.Idx, last.Seq)
+	}
+	if Find(snapshot.Audios, last.Seq, BySeq) == nil || Find(snapshot.Videos, 7000, ByStart) != last || Find(snapshot.Videos, 1, ByIdx) != nil {
+		t.Fatal("find segment")
+	}
+
+	_, _, merged := stream.InitSegments()
+	parser := &mp4.FMP4Parser{}
+	if err := parser.ParseInit(merged); err != nil {
+		t.Fatal(err)
+	}
+	tags, err := parser.Parse(append(append([]byte(nil), last.Data...), Find(snapshot.Audios, last.Seq, BySeq).Data...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//两个sequence header,25帧视频和音频
+	if len(tags) != 52 {
+		t.Fatalf("tags %d", len(tags))
+	}
+
+	if window := Window(snapshot.Videos, 0); len(window) != MinSegments {
+		t.Fatalf("window %d", len(window))
+	}
+}
@@ -4,13 +4,20 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/use-go/websocket-streamserver/abr"
+	"github.com/use-go/websocket-streamserver/authorizer"
 	"github.com/use-go/websocket-streamserver/httpmux"
+	"github.com/use-go/websocket-streamserver/tlsconf"
 	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/metrics"
+	"github.com/use-go/websocket-streamserver/session"
 	"github.com/use-go/websocket-streamserver/wssapi"
 	"github.com/use-go/websocket-streamserver/utils"
 )
@@ -22,20 +29,54 @@ const (
 	AudioPREFIX = "audio"
 )
 
+//Profile of mpd,timeline lists every segment,number uses SegmentTemplate $Number$ with fixed duration
+const (
+	ProfileTimeline = "timeline"
+	ProfileNumber   = "number"
+)
+
+const (
+	//utcTimingPath http://addr/DASH/utc returns the server time for UTCTiming
+	utcTimingPath    = "utc"
+	defaultSegmentMs = 2000
+)
+
 //DASHService struct
 type DASHService struct {
 	sources   map[string]*DASHSource
 	muxSource sync.RWMutex
+	groups    map[string]*abrGroup
+	muxGroups sync.Mutex
 }
 
 //DASHConfig struc
+//ABR groups are served as one mpd with a representation for every rendition
+//Profile number serves every stream with $Number$ segments of SegmentMs,the publisher gop should be SegmentMs,
+//DVRWindowSec segments are kept for time shift,UTCTiming adds the server clock to the mpd
 type DASHConfig struct {
-	Port  int    `json:"Port"`
-	Route string `json:"Route"`
+	Port         int             `json:"Port"`
+	Route        string          `json:"Route"`
+	TLS          *tlsconf.Config `json:"TLS"`
+	ABR          []abr.Group     `json:"ABR,omitempty"`
+	Profile      string          `json:"Profile,omitempty"`
+	SegmentMs    int             `json:"SegmentMs,omitempty"`
+	DVRWindowSec int             `json:"DVRWindowSec,omitempty"`
+	UTCTiming    bool            `json:"UTCTiming,omitempty"`
 }
 
 var service *DASHService
-var serviceConfig DASHConfig
+
+//serviceConfig *DASHConfig,mpd and segment requests read it,a reload swaps it
+var serviceConfig atomic.Value
+
+//config current config,do not modify it
+func config() *DASHConfig {
+	cfg, _ := serviceConfig.Load().(*DASHConfig)
+	if nil == cfg {
+		return &DASHConfig{}
+	}
+	return cfg
+}
 
 func (dashService *DASHService) Init(msg *wssapi.Msg) (err error) {
 	defer func() {
@@ -48,23 +89,58 @@ func (dashService *DASHService) Init(msg *wssapi.Msg) (err error) {
 		return
 	}
 	fileName := msg.Param1.(string)
-	err = dashService.loadConfigFile(fileName)
+	cfg, err := dashService.loadConfigFile(fileName)
 	if nil != err {
 		return
 	}
-	strPort := ":" + strconv.Itoa(serviceConfig.Port)
-	httpmux.AddRoute(strPort, serviceConfig.Route, dashService.ServeHTTP)
+	serviceConfig.Store(cfg)
+	strPort := ":" + strconv.Itoa(cfg.Port)
+	httpmux.AddRoute(strPort, cfg.Route, dashService.ServeHTTP)
+	err = httpmux.AddTLSRoute(cfg.TLS, cfg.Route, dashService.ServeHTTP)
+	if err != nil {
+		logger.LOGE("dash tls disabled:" + err.Error())
+		err = nil
+	}
 	dashService.sources = make(map[string]*DASHSource)
+	dashService.groups = make(map[string]*abrGroup)
+	for _, group := range cfg.ABR {
+		dashService.groups[group.Name] = newABRGroup(group)
+	}
 	service = dashService
 	return
 }
 
 func (dashService *DASHService) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	streamName, reqType, param, err := dashService.parseURL(req.URL.String())
+	if strings.Trim(strings.TrimPrefix(req.URL.Path, config().Route), "/") == utcTimingPath {
+		serveUTCTiming(w)
+		return
+	}
+	streamName, reqType, param, err := dashService.parseURL(req.URL.Path)
 	if err != nil {
 		logger.LOGE(err.Error())
 		return
 	}
+	errAuth := authorizer.CheckHTTP(authorizer.ProtocolDASH, streamName, req)
+	if errAuth != nil {
+		w.WriteHeader(authorizer.StatusCode(errAuth))
+		return
+	}
+	sess, errSession := session.Touch(metrics.ProtocolDASH, streamName, req)
+	if errSession != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	w = sess.ResponseWriter(w)
+	if group := dashService.getGroup(streamName, reqType); group != nil {
+		if false == group.serveHTTP(reqType, param, w, req) && nil == abr.Find(config().ABR, streamName) {
+			dashService.delGroup(streamName, group)
+		}
+		return
+	}
+	if config().Profile == ProfileNumber {
+		w.WriteHeader(404)
+		return
+	}
 
 	dashService.muxSource.RLock()
 	source, exist := dashService.sources[streamName]
@@ -114,13 +190,34 @@ func (dashService *DASHService) createSource(streamName string) {
 	}
 }
 
-func (dashService *DASHService) loadConfigFile(fileName string) (err error) {
+//loadConfigFile read a new config,it is not used until stored
+func (dashService *DASHService) loadConfigFile(fileName string) (cfg *DASHConfig, err error) {
 	buf, err := utils.ReadFileAll(fileName)
 	if err != nil {
 		return
 	}
-	err = json.Unmarshal(buf, &serviceConfig)
-	return err
+	cfg = &DASHConfig{}
+	err = json.Unmarshal(buf, cfg)
+	if err != nil {
+		return nil, err
+	}
+	switch cfg.Profile {
+	case "":
+		cfg.Profile = ProfileTimeline
+	case ProfileTimeline, ProfileNumber:
+	default:
+		return nil, errors.New("invalid dash profile:" + cfg.Profile)
+	}
+	if cfg.SegmentMs <= 0 {
+		cfg.SegmentMs = defaultSegmentMs
+	}
+	if cfg.DVRWindowSec < 0 {
+		cfg.DVRWindowSec = 0
+	}
+	if err = abr.Check(cfg.ABR); err != nil {
+		return nil, err
+	}
+	return
 }
 
 //Start action
@@ -128,7 +225,25 @@ func (dashService *DASHService) Start(msg *wssapi.Msg) (err error) {
 	return
 }
 
+//Stop remove all dash sources from streamer
 func (dashService *DASHService) Stop(msg *wssapi.Msg) (err error) {
+	dashService.muxSource.Lock()
+	sources := dashService.sources
+	dashService.sources = make(map[string]*DASHSource)
+	dashService.muxSource.Unlock()
+	for _, v := range sources {
+		v.Stop(nil)
+	}
+	dashService.muxGroups.Lock()
+	groups := dashService.groups
+	dashService.groups = make(map[string]*abrGroup)
+	for _, group := range config().ABR {
+		dashService.groups[group.Name] = newABRGroup(group)
+	}
+	dashService.muxGroups.Unlock()
+	for _, group := range groups {
+		group.stop()
+	}
 	return
 }
 
@@ -140,12 +255,66 @@ func (dashService *DASHService) HandleTask(task wssapi.Task) (err error) {
 	return
 }
 
+//ProcessMessage reload config,abr groups and the profile are built at init so they are kept
 func (dashService *DASHService) ProcessMessage(msg *wssapi.Msg) (err error) {
+	switch msg.Type {
+	case wssapi.MsgReloadConfig:
+		var cfg *DASHConfig
+		cfg, err = dashService.loadConfigFile(msg.Param1.(string))
+		if err != nil {
+			return
+		}
+		old := config()
+		if cfg.Port != old.Port || cfg.Route != old.Route || false == cfg.TLS.Equal(old.TLS) {
+			logger.LOGW("dash port,route and tls change need restart")
+			cfg.Port, cfg.Route, cfg.TLS = old.Port, old.Route, old.TLS
+		}
+		if cfg.Profile != old.Profile || false == reflect.DeepEqual(cfg.ABR, old.ABR) {
+			logger.LOGW("dash profile and abr change need restart")
+			cfg.Profile, cfg.ABR = old.Profile, old.ABR
+		}
+		serviceConfig.Store(cfg)
+	}
 	return
 }
 
+//getGroup abr group of the name,with profile number every stream is a group of itself,
+//created by the mpd request
+func (dashService *DASHService) getGroup(name, reqType string) *abrGroup {
+	dashService.muxGroups.Lock()
+	defer dashService.muxGroups.Unlock()
+	group, ok := dashService.groups[name]
+	if ok {
+		return group
+	}
+	if config().Profile != ProfileNumber || reqType != MpdPREFIX {
+		return nil
+	}
+	group = newABRGroup(abr.Group{Name: name, Renditions: []string{name}, SegmentMs: config().SegmentMs})
+	dashService.groups[name] = group
+	return group
+}
+
+//delGroup the stream has no data,removed until requested again
+func (dashService *DASHService) delGroup(name string, group *abrGroup) {
+	dashService.muxGroups.Lock()
+	if dashService.groups[name] == group {
+		delete(dashService.groups, name)
+	}
+	dashService.muxGroups.Unlock()
+	group.stop()
+}
+
+//serveUTCTiming urn:mpeg:dash:utc:http-iso:2014
+func serveUTCTiming(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(time.Now().UTC().Format(utcTimeFormat)))
+}
+
 func (dashService *DASHService) parseURL(url string) (streamName, reqType, param string, err error) {
-	url = strings.TrimPrefix(url, serviceConfig.Route)
+	url = strings.TrimPrefix(url, config().Route)
 	url = strings.TrimSuffix(url, "/")
 	subs := strings.Split(url, "/")
 	if len(subs) < 2 {
@@ -1,18 +1,23 @@
 package dash
 
 import (
+	"bytes"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 
 	"github.com/panda-media/muxer-fmp4/codec/H264"
 	"github.com/panda-media/muxer-fmp4/dashSlicer"
 
+	"github.com/use-go/websocket-streamserver/authorizer"
 	"github.com/use-go/websocket-streamserver/events/eStreamerEvent"
 	"github.com/use-go/websocket-streamserver/logger"
 	"github.com/use-go/websocket-streamserver/mediatype/flv"
 	"github.com/use-go/websocket-streamserver/mediatype/h264"
+	"github.com/use-go/websocket-streamserver/metrics"
 	"github.com/use-go/websocket-streamserver/utils"
 	"github.com/use-go/websocket-streamserver/wssapi"
 )
@@ -32,6 +37,7 @@ type DASHSource struct {
 	appendedKeyFrame  bool
 	audioHeader       *flv.FlvTag
 	videoHeader       *flv.FlvTag
+	stats             *metrics.SinkStats
 }
 
 func (dashSource *DASHSource) serveHTTP(reqType, param string, w http.ResponseWriter, req *http.Request) {
@@ -63,9 +69,19 @@ func (dashSource *DASHSource) serveMPD(param string, w http.ResponseWriter, req
 	//	logger.LOGE(err.Error())
 	//	return
 	//}
+	//segment requests need the token too
+	if token := req.URL.Query().Get(authorizer.TokenParam); len(token) > 0 {
+		mpd = bytes.Replace(mpd, []byte(`_mp4.m4s"`),
+			[]byte(`_mp4.m4s?`+authorizer.TokenParam+"="+url.QueryEscape(token)+`"`), -1)
+	}
+	if config().UTCTiming {
+		timing, _ := xml.Marshal(&UTCTimingXML{SchemeIdUri: UTCTimingHTTPISO, Value: utcTimingURL(req)})
+		mpd = bytes.Replace(mpd, []byte(`</MPD>`), append(timing, []byte(`</MPD>`)...), 1)
+	}
 	w.Header().Set("Content-Type", "application/dash+xml")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Write(mpd)
+	n, _ := w.Write(mpd)
+	dashSource.stats.AddBytes(n)
 
 }
 
@@ -84,7 +100,8 @@ func (dashSource *DASHSource) serveVideo(param string, w http.ResponseWriter, re
 		return
 	}
 
-	w.Write(data)
+	n, _ := w.Write(data)
+	dashSource.stats.AddBytes(n)
 }
 
 func (dashSource *DASHSource) serveAudio(param string, w http.ResponseWriter, req *http.Request) {
@@ -101,7 +118,8 @@ func (dashSource *DASHSource) serveAudio(param string, w http.ResponseWriter, re
 		w.WriteHeader(404)
 		return
 	}
-	w.Write(data)
+	n, _ := w.Write(data)
+	dashSource.stats.AddBytes(n)
 }
 
 func (dashSource *DASHSource) Init(msg *wssapi.Msg) (err error) {
@@ -125,6 +143,7 @@ func (dashSource *DASHSource) Init(msg *wssapi.Msg) (err error) {
 		SinkId:     dashSource.clientID,
 		Sinker:     dashSource}
 
+	dashSource.stats = metrics.AddSink(metrics.ProtocolDASH, dashSource.streamName, dashSource.clientID)
 	wssapi.HandleTask(taskAddSink)
 
 	return
@@ -145,6 +164,7 @@ func (dashSource *DASHSource) Stop(msg *wssapi.Msg) (err error) {
 		dashSource.sinkAdded = false
 		logger.LOGT("del sinker:" + dashSource.clientID)
 	}
+	metrics.DelSink(dashSource.stats)
 	if dashSource.inSvr {
 		service.Del(dashSource.streamName, dashSource.clientID)
 	}
@@ -199,8 +219,13 @@ func (dashSource *DASHSource) createSlicer() (err error) {
 				break
 			}
 		}
-		dashSource.mediaReceiver = NewFMP4Cache(5)
-		dashSource.slicer, err = dashSlicer.NEWSlicer(fps, 1000, 1000, 1000, 9000, 5, dashSource.mediaReceiver)
+		//段最短1秒,dvr 窗口内的段都保留
+		segCount := 5
+		if dvrWindowSec := config().DVRWindowSec; dvrWindowSec > segCount {
+			segCount = dvrWindowSec
+		}
+		dashSource.mediaReceiver = NewFMP4Cache(segCount)
+		dashSource.slicer, err = dashSlicer.NEWSlicer(fps, 1000, 1000, 1000, 9000, segCount, dashSource.mediaReceiver)
 		if err != nil {
 			logger.LOGE(err.Error())
 			return err
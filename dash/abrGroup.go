@@ -0,0 +1,266 @@
+package dash
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/abr"
+	"github.com/use-go/websocket-streamserver/authorizer"
+	"github.com/use-go/websocket-streamserver/cmaf"
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/metrics"
+	"github.com/use-go/websocket-streamserver/utils"
+)
+
+//abrRendition one rendition of the group,segments are cut by the cmaf stream shared with hls
+type abrRendition struct {
+	id     string
+	stream *cmaf.Stream
+	stats  *metrics.SinkStats
+}
+
+func newABRRendition(group *abrGroup, idx int) (rendition *abrRendition) {
+	streamName := group.config.Renditions[idx]
+	rendition = &abrRendition{
+		id:     strconv.Itoa(idx),
+		stream: cmaf.Acquire(streamName, group.config.SegmentMs, config().DVRWindowSec*1000)}
+	rendition.stats = metrics.AddSink(metrics.ProtocolDASH, streamName, utils.GenerateGUID())
+	return
+}
+
+//release the cmaf stream is stopped when hls does not use it
+func (rendition *abrRendition) release() {
+	metrics.DelSink(rendition.stats)
+	rendition.stream.Release()
+}
+
+//abrGroup renditions of one abr group,served with one mpd
+type abrGroup struct {
+	config     abr.Group
+	mux        sync.Mutex
+	renditions []*abrRendition
+	//availabilityStartTime 不随mpd 更新变化,码率重新加入时重置
+	startTime time.Time
+}
+
+func newABRGroup(config abr.Group) *abrGroup {
+	return &abrGroup{
+		config:     config,
+		renditions: make([]*abrRendition, len(config.Renditions))}
+}
+
+//get the renditions,stopped ones are added again
+func (group *abrGroup) get() (renditions []*abrRendition) {
+	group.mux.Lock()
+	defer group.mux.Unlock()
+	for i, rendition := range group.renditions {
+		if nil == rendition || rendition.stream.Closed() {
+			if rendition != nil {
+				rendition.release()
+			}
+			group.renditions[i] = newABRRendition(group, i)
+			group.startTime = time.Time{}
+		}
+	}
+	renditions = make([]*abrRendition, len(group.renditions))
+	copy(renditions, group.renditions)
+	return
+}
+
+func (group *abrGroup) stop() {
+	group.mux.Lock()
+	renditions := group.renditions
+	group.renditions = make([]*abrRendition, len(group.config.Renditions))
+	group.mux.Unlock()
+	for _, rendition := range renditions {
+		if rendition != nil {
+			rendition.release()
+		}
+	}
+}
+
+//wait until any rendition creates a segment
+func (group *abrGroup) wait(renditions []*abrRendition, timeout time.Duration) {
+	ch := make(chan bool, len(renditions))
+	for _, rendition := range renditions {
+		go func(stream *cmaf.Stream) {
+			ch <- stream.Wait(timeout)
+		}(rendition.stream)
+	}
+	for range renditions {
+		if <-ch {
+			return
+		}
+	}
+}
+
+//serveHTTP false if no mpd generated
+func (group *abrGroup) serveHTTP(reqType, param string, w http.ResponseWriter, req *http.Request) bool {
+	switch reqType {
+	case MpdPREFIX:
+		return group.serveMPD(w, req)
+	case VideoPREFIX, AudioPREFIX:
+		group.serveSegment(reqType, param, w)
+	}
+	return true
+}
+
+func (group *abrGroup) serveMPD(w http.ResponseWriter, req *http.Request) bool {
+	creater := &mpdCreater{}
+	if token := req.URL.Query().Get(authorizer.TokenParam); len(token) > 0 {
+		creater.query = "?" + authorizer.TokenParam + "=" + url.QueryEscape(token)
+	}
+	if config().UTCTiming {
+		creater.utcTiming = utcTimingURL(req)
+	}
+	renditions := group.get()
+	mpd := group.createMPD(renditions, creater)
+	if nil == mpd {
+		//第一个对齐的段最长需要两个SegmentMs
+		group.wait(renditions, time.Minute)
+		mpd = group.createMPD(renditions, creater)
+	}
+	if nil == mpd {
+		logger.LOGE("no rendition ready for " + group.config.Name)
+		w.WriteHeader(404)
+		return false
+	}
+	w.Header().Set("Content-Type", "application/dash+xml")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(mpd)
+	return true
+}
+
+//utcTimingURL the time path on the host and scheme of the request
+func utcTimingURL(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	route := strings.Trim(config().Route, "/")
+	if len(route) > 0 {
+		route = "/" + route
+	}
+	return scheme + "://" + req.Host + route + "/" + utcTimingPath
+}
+
+//createMPD video timeline is the segments all ready renditions have,nil if none ready
+func (group *abrGroup) createMPD(renditions []*abrRendition, creater *mpdCreater) []byte {
+	videos := make([]mpdRepresentation, 0, len(renditions))
+	var audio *mpdRepresentation
+	var timeline, audioTimeline []mpdSegment
+	var startTime time.Time
+	counts := make(map[uint32]int)
+	//hls may keep a longer window of the shared stream
+	windowMs := config().DVRWindowSec * 1000
+	for _, rendition := range renditions {
+		snapshot, ok := rendition.stream.Snapshot()
+		if false == ok {
+			continue
+		}
+		videos = append(videos, mpdRepresentation{
+			id:        rendition.id,
+			variant:   snapshot.Variant,
+			bandwidth: snapshot.Variant.Bandwidth})
+		for _, seg := range cmaf.Window(snapshot.Videos, windowMs) {
+			counts[seg.Start]++
+			if len(videos) == 1 {
+				timeline = append(timeline, mpdSegment{idx: seg.Idx, t: seg.Start, d: seg.Duration})
+			}
+		}
+		if len(videos) == 1 {
+			startTime = snapshot.StartTime
+		}
+		if nil == audio && len(snapshot.Audios) > 0 {
+			audio = &mpdRepresentation{
+				id:        rendition.id,
+				variant:   snapshot.Variant,
+				bandwidth: snapshot.AudioBandwidth}
+			for _, seg := range cmaf.Window(snapshot.Audios, windowMs) {
+				audioTimeline = append(audioTimeline, mpdSegment{idx: seg.Idx, t: seg.Start, d: seg.Duration})
+			}
+		}
+	}
+	shared := make([]mpdSegment, 0, len(timeline))
+	for _, seg := range timeline {
+		if counts[seg.t] == len(videos) {
+			shared = append(shared, seg)
+		}
+	}
+	if len(shared) == 0 {
+		return nil
+	}
+	group.mux.Lock()
+	if group.startTime.IsZero() {
+		group.startTime = startTime
+	}
+	startTime = group.startTime
+	group.mux.Unlock()
+	query := creater.query
+	creater.init(startTime, query)
+	if config().Profile == ProfileNumber {
+		creater.profile = ProfileNumber
+	}
+	creater.segmentMs = group.config.SegmentMs
+	creater.dvrMs = windowMs
+	return creater.GetXML(group.config.Name, videos, shared, audio, audioTimeline)
+}
+
+//serveSegment param: video_<id>_init.m4s or video_<id>_<time or number>.m4s
+func (group *abrGroup) serveSegment(reqType, param string, w http.ResponseWriter) {
+	var id int
+	var key int64
+	isInit := strings.HasSuffix(param, "_init.m4s")
+	if isInit {
+		_, err := fmt.Sscanf(param, reqType+"_%d_init.m4s", &id)
+		if err != nil {
+			w.WriteHeader(404)
+			return
+		}
+	} else if _, err := fmt.Sscanf(param, reqType+"_%d_%d.m4s", &id, &key); err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	group.mux.Lock()
+	var rendition *abrRendition
+	if id >= 0 && id < len(group.renditions) {
+		rendition = group.renditions[id]
+	}
+	group.mux.Unlock()
+	if nil == rendition {
+		w.WriteHeader(404)
+		return
+	}
+	var data []byte
+	by := cmaf.ByStart
+	if config().Profile == ProfileNumber {
+		by = cmaf.ByIdx
+	}
+	video, audio, _ := rendition.stream.InitSegments()
+	snapshot, _ := rendition.stream.Snapshot()
+	if reqType == VideoPREFIX {
+		if isInit {
+			data = video
+		} else if seg := cmaf.Find(snapshot.Videos, key, by); seg != nil {
+			data = seg.Data
+		}
+	} else {
+		if isInit {
+			data = audio
+		} else if seg := cmaf.Find(snapshot.Audios, key, by); seg != nil {
+			data = seg.Data
+		}
+	}
+	if len(data) == 0 {
+		w.WriteHeader(404)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	n, _ := w.Write(data)
+	rendition.stats.AddBytes(n)
+}
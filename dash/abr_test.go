@@ -0,0 +1,107 @@
+package dash
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/use-go/websocket-streamserver/abr"
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/mediatype/h264"
+	"github.com/use-go/websocket-streamserver/mediatype/mp4"
+)
+
+func TestABRGroupMPD(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xec, 0x04, 0x40, 0x00, 0x00, 0x03, 0x00, 0x40, 0x00, 0x00, 0x0c, 0x23, 0xc6, 0x0c, 0x92}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	videoHeader := &flv.FlvTag{TagType: flv.FlvTagVideo, Timestamp: 20, Data: append([]byte{0x17, 0, 0, 0, 0}, h264.AVCDecoderConfigurationRecord(sps, pps)...)}
+	audioHeader := &flv.FlvTag{TagType: flv.FlvTagAudio, Timestamp: 20, Data: []byte{0xaf, 0, 0x12, 0x10}}
+	frame := func(ts uint32, size int) *flv.FlvTag {
+		frameType, nal := byte(0x27), byte(0x41)
+		if (ts-20)%200 == 0 {
+			frameType, nal = 0x17, 0x65
+		}
+		data := []byte{frameType, 1, 0, 0, 0, byte(size >> 24), byte(size >> 16), byte(size >> 8), byte(size), nal}
+		return &flv.FlvTag{TagType: flv.FlvTagVideo, Timestamp: ts, Data: append(data, bytes.Repeat([]byte{0x11}, size-1)...)}
+	}
+
+	config := abr.Group{Name: "live/event", Renditions: []string{"live/event_720", "live/event_360"}, SegmentMs: 1000}
+	group := newABRGroup(config)
+	renditions := group.get()
+	for i, rendition := range renditions {
+		rendition.stream.AddFlvTag(videoHeader)
+		rendition.stream.AddFlvTag(audioHeader)
+		//第二个码率从中间加入
+		begin := uint32(20)
+		if i == 1 {
+			begin = 1220
+		}
+		for ts := begin; ts <= 4020; ts += 40 {
+			rendition.stream.AddFlvTag(frame(ts, 2000/(i+1)))
+			rendition.stream.AddFlvTag(&flv.FlvTag{TagType: flv.FlvTagAudio, Timestamp: ts, Data: []byte{0xaf, 1, 0x21, 0x22}})
+		}
+	}
+
+	data := group.createMPD(renditions, &mpdCreater{})
+	if nil == data {
+		t.Fatal("no mpd")
+	}
+	mpd := &MPD{}
+	if err := xml.Unmarshal(data, mpd); err != nil {
+		t.Fatal(err)
+	}
+	if len(mpd.Period) != 1 || len(mpd.Period[0].AdaptationSet) != 2 {
+		t.Fatalf("period %v", mpd.Period)
+	}
+	video := mpd.Period[0].AdaptationSet[0]
+	if len(video.Representation) != 2 || video.Representation[0].Width != "1280" || video.Representation[0].Codecs != "avc1.42c01f" {
+		t.Fatalf("representation %v", video.Representation)
+	}
+	//第一个码率 1020,2020,3020 开始的三个段,第二个码率从 2020 开始,只列出共同的段
+	timeline := video.SegmentTemplate.SegmentTimeline.S
+	if len(timeline) != 2 || timeline[0].T != "2020" || timeline[0].D != "1000" || timeline[1].T != "3020" {
+		t.Fatalf("timeline %v", timeline)
+	}
+
+	for _, id := range []string{"0", "1"} {
+		init := httptest.NewRecorder()
+		group.serveSegment(VideoPREFIX, "video_"+id+"_init.m4s", init)
+		segment := httptest.NewRecorder()
+		group.serveSegment(VideoPREFIX, "video_"+id+"_3020.m4s", segment)
+		parser := &mp4.FMP4Parser{}
+		if err := parser.ParseInit(init.Body.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		tags, err := parser.Parse(segment.Body.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		//sequence header 和25帧
+		if len(tags) != 26 || false == flv.IsKeyFrame(tags[1]) {
+			t.Fatalf("rendition %s tags %d", id, len(tags))
+		}
+	}
+
+	//number 模式下序号是对齐窗口序号,3020 开始的段是 3
+	serviceConfig.Store(&DASHConfig{Profile: ProfileNumber})
+	defer serviceConfig.Store(&DASHConfig{})
+	mpd = &MPD{}
+	if err := xml.Unmarshal(group.createMPD(renditions, &mpdCreater{utcTiming: "http://localhost/dash/utc"}), mpd); err != nil {
+		t.Fatal(err)
+	}
+	template := mpd.Period[0].AdaptationSet[0].SegmentTemplate
+	if template.StartNumber != "2" || nil == template.Duration || *template.Duration != 1000 || nil != template.SegmentTimeline {
+		t.Fatalf("template %v", template)
+	}
+	if len(mpd.UTCTiming) != 1 || mpd.UTCTiming[0].SchemeIdUri != UTCTimingHTTPISO {
+		t.Fatalf("utc timing %v", mpd.UTCTiming)
+	}
+	byNumber := httptest.NewRecorder()
+	group.serveSegment(VideoPREFIX, "video_0_3.m4s", byNumber)
+	byTime := httptest.NewRecorder()
+	group.serveSegment(VideoPREFIX, "video_0_3020.m4s", byTime)
+	if byNumber.Body.Len() == 0 || byTime.Code != 404 {
+		t.Fatalf("segment by number %d,by time %d", byNumber.Body.Len(), byTime.Code)
+	}
+}
@@ -3,13 +3,11 @@ package dash
 import (
 	"encoding/xml"
 	"fmt"
+	"strconv"
 	"time"
-    "strconv"
+
+	"github.com/use-go/websocket-streamserver/abr"
 	"github.com/use-go/websocket-streamserver/logger"
-	"github.com/use-go/websocket-streamserver/mediatype/flv"	
-	"github.com/use-go/websocket-streamserver/utils"
-	"github.com/use-go/websocket-streamserver/mediatype/aac"
-	"github.com/use-go/websocket-streamserver/mediatype/h264"
 )
 
 // const string for media description
@@ -26,24 +24,38 @@ const (
 	MPDXMLNS   = "urn:mpeg:dash:schema:mpd:2011"
 
 	SchemeIdUri = "urn:mpeg:dash:23003:3:audio_channel_configuration:2011"
+
+	UTCTimingHTTPISO = "urn:mpeg:dash:utc:http-iso:2014"
+	utcTimeFormat    = "2006-01-02T15:04:05.000Z"
 )
 
 // MPD Struct
 type MPD struct {
-	ID                        string      `xml:"id,attr"`
-	Profiles                  string      `xml:"profiles,attr"`
-	Type                      string      `xml:"type,attr"`
-	AvailabilityStartTime     string      `xml:"availabilityStartTime,attr"`
-	PublishTime               string      `xml:"publishTime,attr"`
-	MediaPresentationDuration string      `xml:"mediaPresentationDuration,attr,omitempty"`
-	MinimumUpdatePeriod       string      `xml:"minimumUpdatePeriod,attr,omitempty"`
-	MinBufferTime             string      `xml:"minBufferTime,attr"`
-	Xmlns                     string      `xml:"xmlns,attr"`
-	Period                    []PeriodXML `xml:"Period"`
+	ID                         string         `xml:"id,attr"`
+	Profiles                   string         `xml:"profiles,attr"`
+	Type                       string         `xml:"type,attr"`
+	AvailabilityStartTime      string         `xml:"availabilityStartTime,attr"`
+	PublishTime                string         `xml:"publishTime,attr"`
+	MediaPresentationDuration  string         `xml:"mediaPresentationDuration,attr,omitempty"`
+	MinimumUpdatePeriod        string         `xml:"minimumUpdatePeriod,attr,omitempty"`
+	MinBufferTime              string         `xml:"minBufferTime,attr"`
+	TimeShiftBufferDepth       string         `xml:"timeShiftBufferDepth,attr,omitempty"`
+	SuggestedPresentationDelay string         `xml:"suggestedPresentationDelay,attr,omitempty"`
+	Xmlns                      string         `xml:"xmlns,attr"`
+	Period                     []PeriodXML    `xml:"Period"`
+	UTCTiming                  []UTCTimingXML `xml:"UTCTiming,omitempty"`
+}
+
+//UTCTimingXML clock of the server for players to sync
+type UTCTimingXML struct {
+	XMLName     xml.Name `xml:"UTCTiming"`
+	SchemeIdUri string   `xml:"schemeIdUri,attr"`
+	Value       string   `xml:"value,attr"`
 }
 
 type PeriodXML struct {
 	ID            string             `xml:"id,attr"`
+	Start         string             `xml:"start,attr,omitempty"`
 	AdaptationSet []AdaptationSetXML `xml:"AdaptationSet"`
 }
 
@@ -51,6 +63,8 @@ type AdaptationSetXML struct {
 	Lang                      string                        `xml:"lang,attr,omitempty"`
 	MimeType                  string                        `xml:"mimeType,attr"`
 	Codecs                    string                        `xml:"codecs,attr,omitempty"`
+	SegmentAlignment          bool                          `xml:"segmentAlignment,attr,omitempty"`
+	StartWithSAP              int                           `xml:"startWithSAP,attr,omitempty"`
 	AudioChannelConfiguration *AudioChannelConfigurationXML `xml:"AudioChannelConfiguration,omitempty"`
 	SegmentTemplate           SegmentTemplateXML            `xml:"SegmentTemplate"`
 	Representation            []RepresentationXML           `xml:"Representation,omitempty"`
@@ -60,7 +74,7 @@ type SegmentTemplateXML struct {
 	Media           string              `xml:"media,attr"`
 	Initialization  string              `xml:"initialization,attr"`
 	Duration        *int                `xml:"duration,attr,omitempty"`
-	StartNumber     string              `xml:"startNumber,attr"`
+	StartNumber     string              `xml:"startNumber,attr,omitempty"`
 	TimeScale       string              `xml:"timescale,attr"`
 	SegmentTimeline *SegmentTimelineXML `xml:"SegmentTimeline,omitempty"`
 }
@@ -81,6 +95,7 @@ type SegmentTimelineDesc struct {
 type RepresentationXML struct {
 	ID                string `xml:"id,attr"`
 	Bandwidth         string `xml:"bandwidth,attr"`
+	Codecs            string `xml:"codecs,attr,omitempty"`
 	Width             string `xml:"width,attr,omitempty"`
 	Height            string `xml:"height,attr,omitempty"`
 	FrameRate         string `xml:"frameRate,attr,omitempty"`
@@ -93,17 +108,42 @@ type AudioChannelConfigurationXML struct {
 	Value       int    `xml:"value,attr"`
 }
 
+//mpdRepresentation one rendition,id is used in the segment urls
+type mpdRepresentation struct {
+	id        string
+	variant   abr.Variant
+	bandwidth int
+}
+
+//mpdSegment start and duration in ms,idx is the $Number$
+type mpdSegment struct {
+	idx int64
+	t   uint32
+	d   uint32
+}
+
+//mpdCreater dynamic mpd of an abr group,all video representations share one timeline,
+//segments of the renditions are aligned so the switching happens at the same time
 type mpdCreater struct {
-	audioHeader  *flv.FlvTag
-	videoHeader  *flv.FlvTag
 	avaStartTime string
+	query        string
+	//ProfileNumber:$Number$ with fixed duration,segment idx is timestamp/segmentMs
+	profile   string
+	segmentMs int
+	dvrMs     int
+	utcTiming string
 }
 
-func (dashMpdCreater *mpdCreater) init(videoHeader, audioHeader *flv.FlvTag) {
-	dashMpdCreater.audioHeader = audioHeader
-	dashMpdCreater.videoHeader = videoHeader
-	t := time.Now()
-	dashMpdCreater.avaStartTime = t.Format("2006-01-02T15:04:05.000Z")
+//init startTime is the wall clock of timestamp 0,query is appended to segment urls
+func (dashMpdCreater *mpdCreater) init(startTime time.Time, query string) {
+	dashMpdCreater.avaStartTime = startTime.UTC().Format(utcTimeFormat)
+	dashMpdCreater.query = query
+	dashMpdCreater.profile = ProfileTimeline
+}
+
+//generatePTimeMs duration in ms
+func generatePTimeMs(ms int) string {
+	return fmt.Sprintf("PT%.3fS", float64(ms)/1000.0)
 }
 
 func generatePTime(year, month, day, hour, minute, sec, mill int) string {
@@ -112,18 +152,33 @@ func generatePTime(year, month, day, hour, minute, sec, mill int) string {
 	return str
 }
 
-func (dashMpdCreater *mpdCreater) GetXML(id string, startNumber int) (buf []byte) {
+//GetXML audio nil for no audio
+func (dashMpdCreater *mpdCreater) GetXML(id string, videos []mpdRepresentation, videoTimeline []mpdSegment,
+	audio *mpdRepresentation, audioTimeline []mpdSegment) (buf []byte) {
 	mpd := &MPD{ID: id,
 		Profiles: ProfileISOLive,
 		Type:     dynamicMPD,
 		AvailabilityStartTime: dashMpdCreater.avaStartTime}
 	t := time.Now()
-	mpd.PublishTime = t.Format("2006-01-02T15:04:05.000Z")
+	mpd.PublishTime = t.UTC().Format(utcTimeFormat)
 	//MediaPresentationDuration ignore
-	mpd.MinimumUpdatePeriod = generatePTime(0, 0, 0, 0, 0, 3, 0)
-	mpd.MinBufferTime = generatePTime(0, 0, 0, 0, 0, 1, 0)
+	if dashMpdCreater.profile == ProfileNumber {
+		//播放器按availabilityStartTime 计算最新的段,mpd 只在码率变化时需要更新
+		mpd.MinimumUpdatePeriod = generatePTimeMs(dashMpdCreater.segmentMs)
+		mpd.MinBufferTime = generatePTimeMs(dashMpdCreater.segmentMs)
+		mpd.SuggestedPresentationDelay = generatePTimeMs(3 * dashMpdCreater.segmentMs)
+	} else {
+		mpd.MinimumUpdatePeriod = generatePTime(0, 0, 0, 0, 0, 3, 0)
+		mpd.MinBufferTime = generatePTime(0, 0, 0, 0, 0, 1, 0)
+	}
+	if dashMpdCreater.dvrMs > 0 {
+		mpd.TimeShiftBufferDepth = generatePTimeMs(dashMpdCreater.dvrMs)
+	}
+	if len(dashMpdCreater.utcTiming) > 0 {
+		mpd.UTCTiming = []UTCTimingXML{{SchemeIdUri: UTCTimingHTTPISO, Value: dashMpdCreater.utcTiming}}
+	}
 	mpd.Xmlns = MPDXMLNS
-	mpd.Period = dashMpdCreater.createPeriod(startNumber)
+	mpd.Period = dashMpdCreater.createPeriod(videos, videoTimeline, audio, audioTimeline)
 
 	buf, err := xml.Marshal(mpd)
 
@@ -138,109 +193,85 @@ func (dashMpdCreater *mpdCreater) GetXML(id string, startNumber int) (buf []byte
 	return data
 }
 
-func (dashMpdCreater *mpdCreater) createPeriod(startNumber int) (period []PeriodXML) {
-
-	period = make([]PeriodXML, 0, 2)
-
-	if dashMpdCreater.videoHeader != nil {
-		videPeroid := PeriodXML{ID: utils.GenerateGUID()}
-		dashMpdCreater.createVidePeroid(startNumber, &videPeroid)
-		period = append(period, videPeroid)
-	}
-
-	if dashMpdCreater.audioHeader != nil {
-		audioPeriod := PeriodXML{ID: utils.GenerateGUID()}
-		dashMpdCreater.createAudioPeroid(startNumber, &audioPeriod)
-		period = append(period, audioPeriod)
+//createPeriod one period,video and audio are adaptation sets of it
+func (dashMpdCreater *mpdCreater) createPeriod(videos []mpdRepresentation, videoTimeline []mpdSegment,
+	audio *mpdRepresentation, audioTimeline []mpdSegment) (period []PeriodXML) {
+	period = make([]PeriodXML, 1)
+	period[0].ID = "0"
+	period[0].Start = "PT0S"
+	period[0].AdaptationSet = make([]AdaptationSetXML, 0, 2)
+	if len(videos) > 0 {
+		period[0].AdaptationSet = append(period[0].AdaptationSet, dashMpdCreater.createVideoAdaptationSet(videos, videoTimeline))
 	}
-
-	if len(period) == 0 {
-		return nil
+	if audio != nil {
+		period[0].AdaptationSet = append(period[0].AdaptationSet, dashMpdCreater.createAudioAdaptationSet(audio, audioTimeline))
 	}
-	return period
-}
-
-func (dashMpdCreater *mpdCreater) createVidePeroid(startNumber int, period *PeriodXML) {
-	ada := make([]AdaptationSetXML, 1)
-	ada[0].MimeType = "video/mp4"
-	var width, height, fps int
-	if dashMpdCreater.videoHeader.Data[0] == 0x17 && dashMpdCreater.videoHeader.Data[1] == 0 {
-		ada[0].Codecs = "avc1."
-		sps, _ := h264.GetSpsPpsFromAVC(dashMpdCreater.videoHeader.Data[5:])
-		str := fmt.Sprintf("%x", sps[1])
-		if len(str) == 1 {
-			ada[0].Codecs += "0"
-		}
-		ada[0].Codecs += str
-
-		str = fmt.Sprintf("%x", sps[2])
-		if len(str) == 1 {
-			ada[0].Codecs += "0"
-		}
-		ada[0].Codecs += str
+	return
+}
 
-		str = fmt.Sprintf("%x", sps[3])
-		if len(str) == 1 {
-			ada[0].Codecs += "0"
+func (dashMpdCreater *mpdCreater) createVideoAdaptationSet(videos []mpdRepresentation, timeline []mpdSegment) (ada AdaptationSetXML) {
+	ada.MimeType = "video/mp4"
+	ada.SegmentAlignment = true
+	ada.StartWithSAP = 1
+	dashMpdCreater.segmentTemplate(&ada.SegmentTemplate, VideoPREFIX, timeline)
+
+	ada.Representation = make([]RepresentationXML, len(videos))
+	for i, video := range videos {
+		ada.Representation[i].ID = video.id
+		ada.Representation[i].Bandwidth = strconv.Itoa(video.bandwidth)
+		ada.Representation[i].Codecs = video.variant.VideoCodec
+		ada.Representation[i].Width = strconv.Itoa(video.variant.Width)
+		ada.Representation[i].Height = strconv.Itoa(video.variant.Height)
+		if video.variant.FrameRate > 0 {
+			ada.Representation[i].FrameRate = strconv.Itoa(video.variant.FrameRate)
 		}
-		ada[0].Codecs += str
-		width, height, fps = h264.ParseSPS(sps)
 	}
+	return
+}
 
-	ada[0].SegmentTemplate.Media = "../video/$RepresentationID$/$Number$.m4s"
-	ada[0].SegmentTemplate.Initialization = "../video/$RepresentationID$/init.mp4"
-	ada[0].SegmentTemplate.TimeScale = "1000"
-	ada[0].SegmentTemplate.StartNumber = strconv.Itoa(startNumber)
-	ada[0].SegmentTemplate.SegmentTimeline = dashMpdCreater.createSegmentTimeLine()
-
-	ada[0].Representation = make([]RepresentationXML, 1)
-	ada[0].Representation[0].ID = strconv.Itoa(width) + "_" + strconv.Itoa(height)
-	ada[0].Representation[0].Bandwidth = strconv.Itoa(width * 1000)
-	ada[0].Representation[0].Width = strconv.Itoa(width)
-	ada[0].Representation[0].Height = strconv.Itoa(height)
-	ada[0].Representation[0].FrameRate = strconv.Itoa(fps)
-
-	period.AdaptationSet = ada
-}
-
-func (dashMpdCreater *mpdCreater) createAudioPeroid(startNumber int, period *PeriodXML) {
-	ada := make([]AdaptationSetXML, 1)
-
-	ada[0].MimeType = "audio/mp4"
-	ada[0].Lang = "en"
-	sampleFreq := 0
-	channel := 0
-	if dashMpdCreater.audioHeader.Data[0]>>4 == flv.SoundFormatAAC {
-		asc := aac.MP4AudioGetConfig(dashMpdCreater.audioHeader.Data[2:])
-		ada[0].Codecs = "mp4a.40."
-		ada[0].Codecs += strconv.Itoa(asc.Object_type)
-		sampleFreq = asc.Sample_rate
-		channel = asc.Channels
-	}
+func (dashMpdCreater *mpdCreater) createAudioAdaptationSet(audio *mpdRepresentation, timeline []mpdSegment) (ada AdaptationSetXML) {
+	ada.MimeType = "audio/mp4"
+	ada.Lang = "en"
+	ada.Codecs = audio.variant.AudioCodec
+	ada.SegmentAlignment = true
+	ada.StartWithSAP = 1
 
-	ada[0].AudioChannelConfiguration = &AudioChannelConfigurationXML{}
-	ada[0].AudioChannelConfiguration.SchemeIdUri = SchemeIdUri
-	ada[0].AudioChannelConfiguration.Value = channel
+	ada.AudioChannelConfiguration = &AudioChannelConfigurationXML{}
+	ada.AudioChannelConfiguration.SchemeIdUri = SchemeIdUri
+	ada.AudioChannelConfiguration.Value = audio.variant.Channels
 
-	ada[0].SegmentTemplate.Media = "../video/$RepresentationID$/$Number$.m4s"
-	ada[0].SegmentTemplate.Initialization = "../video/$RepresentationID$/init.mp4"
-	ada[0].SegmentTemplate.TimeScale = strconv.Itoa(sampleFreq)
-	ada[0].SegmentTemplate.StartNumber = strconv.Itoa(startNumber)
-	ada[0].SegmentTemplate.SegmentTimeline = dashMpdCreater.createSegmentTimeLine()
+	dashMpdCreater.segmentTemplate(&ada.SegmentTemplate, AudioPREFIX, timeline)
 
-	ada[0].Representation = make([]RepresentationXML, 1)
-	ada[0].Representation[0].ID = "1_stereo"
-	ada[0].Representation[0].Bandwidth = "12800"
-	ada[0].Representation[0].AudioSamplingRate = strconv.Itoa(sampleFreq)
+	ada.Representation = make([]RepresentationXML, 1)
+	ada.Representation[0].ID = audio.id
+	ada.Representation[0].Bandwidth = strconv.Itoa(audio.bandwidth)
+	ada.Representation[0].AudioSamplingRate = strconv.Itoa(audio.variant.SampleRate)
+	return
+}
 
-	period.AdaptationSet = ada
+//segmentTemplate $Time$ with timeline or $Number$ with duration,timescale is ms
+func (dashMpdCreater *mpdCreater) segmentTemplate(template *SegmentTemplateXML, prefix string, timeline []mpdSegment) {
+	template.Initialization = prefix + "_$RepresentationID$_init.m4s" + dashMpdCreater.query
+	template.TimeScale = "1000"
+	if dashMpdCreater.profile == ProfileNumber {
+		template.Media = prefix + "_$RepresentationID$_$Number$.m4s" + dashMpdCreater.query
+		duration := dashMpdCreater.segmentMs
+		template.Duration = &duration
+		if len(timeline) > 0 {
+			template.StartNumber = strconv.FormatInt(timeline[0].idx, 10)
+		}
+		return
+	}
+	template.Media = prefix + "_$RepresentationID$_$Time$.m4s" + dashMpdCreater.query
+	template.SegmentTimeline = createSegmentTimeLine(timeline)
 }
 
-func (dashMpdCreater *mpdCreater) createSegmentTimeLine() (segTm *SegmentTimelineXML) {
-	//bad time line
+func createSegmentTimeLine(timeline []mpdSegment) (segTm *SegmentTimelineXML) {
 	segTm = &SegmentTimelineXML{}
-	segTm.S = make([]SegmentTimelineDesc, 1)
-	segTm.S[0].D = "1000"
-
+	segTm.S = make([]SegmentTimelineDesc, len(timeline))
+	for i, seg := range timeline {
+		segTm.S[i].T = strconv.FormatUint(uint64(seg.t), 10)
+		segTm.S[i].D = strconv.FormatUint(uint64(seg.d), 10)
+	}
 	return
 }
@@ -0,0 +1,61 @@
+package eHLSEvent
+
+import (
+	"strconv"
+
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+const (
+	PullHLSStream = "PullHLSStream"
+)
+
+//EvePullHLSStream relay an upstream hls stream as a source
+type EvePullHLSStream struct {
+	SourceName string //用来创建和删除源，源名称和app+streamName 并不一样
+	HTTPS      bool
+	App        string
+	Instance   string
+	Address    string
+	Port       int
+	StreamName string
+	Playlist   string //流名下的播放列表文件,空为 StreamName.m3u8
+	SkipVerify bool   //https upstream with self signed certificate
+	Src        chan wssapi.MsgHandler
+}
+
+func (evePullHLSStream *EvePullHLSStream) Receiver() string {
+	return wssapi.OBJHLSServer
+}
+
+func (evePullHLSStream *EvePullHLSStream) Type() string {
+	return PullHLSStream
+}
+
+//URL http://Address:Port/App/Instance/StreamName.m3u8 or .../StreamName/Playlist
+func (evePullHLSStream *EvePullHLSStream) URL() string {
+	url := "http://"
+	if evePullHLSStream.HTTPS {
+		url = "https://"
+	}
+	url += evePullHLSStream.Address
+	if evePullHLSStream.Port > 0 {
+		url += ":" + strconv.Itoa(evePullHLSStream.Port)
+	}
+	if len(evePullHLSStream.App) > 0 {
+		url += "/" + evePullHLSStream.App
+	}
+	if len(evePullHLSStream.Instance) > 0 {
+		url += "/" + evePullHLSStream.Instance
+	}
+	if len(evePullHLSStream.Playlist) > 0 {
+		return url + "/" + evePullHLSStream.StreamName + "/" + evePullHLSStream.Playlist
+	}
+	return url + "/" + evePullHLSStream.StreamName + ".m3u8"
+}
+
+func (evePullHLSStream *EvePullHLSStream) Copy() (out *EvePullHLSStream) {
+	out = &EvePullHLSStream{}
+	*out = *evePullHLSStream
+	return
+}
@@ -14,6 +14,11 @@ type EveSetUpStreamApp struct {
 	Port     int    `json:"port"`
 	Addr     string `json:"addr"`
 	Weight   int    `json:"weight"`
+	//TLSSkipVerify do not verify the certificate of rtmps upstream
+	TLSSkipVerify bool `json:"tlsSkipVerify,omitempty"`
+	//hls upstream:https or http,playlist file under the stream name,empty for streamName.m3u8
+	HTTPS    bool   `json:"https,omitempty"`
+	Playlist string `json:"playlist,omitempty"`
 }
 
 func (eveSetUpStreamApp *EveSetUpStreamApp) Receiver() string {
@@ -47,6 +52,9 @@ func (eveSetUpStreamApp *EveSetUpStreamApp) Copy() (out *EveSetUpStreamApp) {
 	out.Addr = eveSetUpStreamApp.Addr
 	out.Port = eveSetUpStreamApp.Port
 	out.Weight = eveSetUpStreamApp.Weight
+	out.TLSSkipVerify = eveSetUpStreamApp.TLSSkipVerify
+	out.HTTPS = eveSetUpStreamApp.HTTPS
+	out.Playlist = eveSetUpStreamApp.Playlist
 	return
 }
 
@@ -56,5 +64,8 @@ func (eveSetUpStreamApp *EveSetUpStreamApp) Equal(rh *EveSetUpStreamApp) bool {
 		eveSetUpStreamApp.Protocol == rh.Protocol &&
 		eveSetUpStreamApp.Addr == rh.Addr &&
 		eveSetUpStreamApp.Port == rh.Port &&
-		eveSetUpStreamApp.Weight == rh.Weight
+		eveSetUpStreamApp.Weight == rh.Weight &&
+		eveSetUpStreamApp.TLSSkipVerify == rh.TLSSkipVerify &&
+		eveSetUpStreamApp.HTTPS == rh.HTTPS &&
+		eveSetUpStreamApp.Playlist == rh.Playlist
 }
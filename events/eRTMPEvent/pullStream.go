@@ -16,6 +16,7 @@ type EvePullRTMPStream struct {
 	Address    string
 	Port       int
 	StreamName string
+	SkipVerify bool //rtmps upstream with self signed certificate
 	Src        chan wssapi.MsgHandler
 }
 
@@ -47,6 +48,7 @@ func (evePullRTMPStream *EvePullRTMPStream) Copy() (out *EvePullRTMPStream) {
 	out.Port = evePullRTMPStream.Port
 	out.StreamName = evePullRTMPStream.StreamName
 	out.SourceName = evePullRTMPStream.SourceName
+	out.SkipVerify = evePullRTMPStream.SkipVerify
 	out.Src = evePullRTMPStream.Src
 	return
 }
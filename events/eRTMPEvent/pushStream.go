@@ -0,0 +1,81 @@
+package eRTMPEvent
+
+import (
+	"time"
+
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+const (
+	AddPushTarget  = "AddPushTarget"
+	DelPushTarget  = "DelPushTarget"
+	GetPushTargets = "GetPushTargets"
+)
+
+//states of a push target
+const (
+	PushWaiting    = "waiting" //local stream not live
+	PushConnecting = "connecting"
+	PushPublishing = "publishing"
+	PushRetrying   = "retrying"
+	PushStopped    = "stopped"
+)
+
+//PushTarget a local stream published to URL,rtmp[s]://host[:port]/app[/instance]/stream
+type PushTarget struct {
+	ID         string `json:"id"`
+	StreamName string `json:"stream"`
+	URL        string `json:"url"`
+	SkipVerify bool   `json:"skipVerify,omitempty"`
+}
+
+//PushStatus of one target,every target reconnects by itself
+type PushStatus struct {
+	PushTarget
+	State     string    `json:"state"`
+	Since     time.Time `json:"since"`
+	Retries   int       `json:"retries"`
+	LastError string    `json:"lastError,omitempty"`
+	BytesOut  uint64    `json:"bytesOut"`
+}
+
+//EveAddPushTarget start pushing,ID is generated if empty
+type EveAddPushTarget struct {
+	Target PushTarget //in out
+}
+
+func (eveAddPushTarget *EveAddPushTarget) Receiver() string {
+	return wssapi.OBJRTMPServer
+}
+
+func (eveAddPushTarget *EveAddPushTarget) Type() string {
+	return AddPushTarget
+}
+
+//EveDelPushTarget stop pushing
+type EveDelPushTarget struct {
+	StreamName string //in
+	ID         string //in
+}
+
+func (eveDelPushTarget *EveDelPushTarget) Receiver() string {
+	return wssapi.OBJRTMPServer
+}
+
+func (eveDelPushTarget *EveDelPushTarget) Type() string {
+	return DelPushTarget
+}
+
+//EveGetPushTargets targets of StreamName,all targets if empty
+type EveGetPushTargets struct {
+	StreamName string       //in
+	Targets    []PushStatus //out
+}
+
+func (eveGetPushTargets *EveGetPushTargets) Receiver() string {
+	return wssapi.OBJRTMPServer
+}
+
+func (eveGetPushTargets *EveGetPushTargets) Type() string {
+	return GetPushTargets
+}
@@ -0,0 +1,59 @@
+package eRTSPEvent
+
+import (
+	"strconv"
+
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+const (
+	PullRTSPStream = "PullRTSPStream"
+)
+
+//EvePullRTSPStream pull a stream from an upstream rtsp server or camera
+type EvePullRTSPStream struct {
+	SourceName string //用来创建和删除源，源名称和app+streamName 并不一样
+	Protocol   string //rtsp
+	App        string
+	Instance   string
+	Address    string //可以带上 user:password@
+	Port       int
+	StreamName string
+	Src        chan wssapi.MsgHandler
+}
+
+func (evePullRTSPStream *EvePullRTSPStream) Receiver() string {
+	return wssapi.OBJRTSPServer
+}
+
+func (evePullRTSPStream *EvePullRTSPStream) Type() string {
+	return PullRTSPStream
+}
+
+//URL rtsp://Address:Port/App/StreamName
+func (evePullRTSPStream *EvePullRTSPStream) URL() string {
+	url := evePullRTSPStream.Protocol + "://" + evePullRTSPStream.Address
+	if evePullRTSPStream.Port > 0 {
+		url += ":" + strconv.Itoa(evePullRTSPStream.Port)
+	}
+	if len(evePullRTSPStream.App) > 0 {
+		url += "/" + evePullRTSPStream.App
+	}
+	if len(evePullRTSPStream.StreamName) > 0 {
+		url += "/" + evePullRTSPStream.StreamName
+	}
+	return url
+}
+
+func (evePullRTSPStream *EvePullRTSPStream) Copy() (out *EvePullRTSPStream) {
+	out = &EvePullRTSPStream{}
+	out.Protocol = evePullRTSPStream.Protocol
+	out.App = evePullRTSPStream.App
+	out.Instance = evePullRTSPStream.Instance
+	out.Address = evePullRTSPStream.Address
+	out.Port = evePullRTSPStream.Port
+	out.StreamName = evePullRTSPStream.StreamName
+	out.SourceName = evePullRTSPStream.SourceName
+	out.Src = evePullRTSPStream.Src
+	return
+}
@@ -0,0 +1,68 @@
+package eRecordEvent
+
+import (
+	"container/list"
+
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+// const string to describe the action
+const (
+	StartRecord   = "StartRecord"
+	StopRecord    = "StopRecord"
+	GetRecordList = "GetRecordList"
+)
+
+//EveStartRecord start record a live stream,format is optional
+type EveStartRecord struct {
+	StreamName string //in app/streamName
+	Format     string //in flv or fmp4
+}
+
+//Receiver of EveStartRecord
+func (eveStartRecord *EveStartRecord) Receiver() string {
+	return wssapi.OBJRecorderServer
+}
+
+//Type of EveStartRecord
+func (eveStartRecord *EveStartRecord) Type() string {
+	return StartRecord
+}
+
+//EveStopRecord stop record a live stream
+type EveStopRecord struct {
+	StreamName string //in
+}
+
+//Receiver of EveStopRecord
+func (eveStopRecord *EveStopRecord) Receiver() string {
+	return wssapi.OBJRecorderServer
+}
+
+//Type of EveStopRecord
+func (eveStopRecord *EveStopRecord) Type() string {
+	return StopRecord
+}
+
+//RecordInfo of one recording stream
+type RecordInfo struct {
+	StreamName string
+	Format     string
+	FileName   string
+	Size       int64
+}
+
+//EveGetRecordList streams being recorded
+type EveGetRecordList struct {
+	Records *list.List //out value =*RecordInfo
+}
+
+//Receiver of EveGetRecordList
+func (eveGetRecordList *EveGetRecordList) Receiver() string {
+	return wssapi.OBJRecorderServer
+}
+
+//Type of EveGetRecordList
+func (eveGetRecordList *EveGetRecordList) Type() string {
+	return GetRecordList
+}
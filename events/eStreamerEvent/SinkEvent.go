@@ -13,6 +13,7 @@ type EveAddSink struct {
 	StreamName string     //in
 	SinkId     string     //in
 	Sinker     wssapi.MsgHandler //in
+	StartMs    int64      //in 点播起始位置,直播忽略
 	Added      bool       //out
 }
 
@@ -12,6 +12,9 @@ const (
 	GetSource = "GetSource"
 )
 
+//DelSourceForce ID of EveDelSource to kick the producer whoever created the source
+const DelSourceForce int64 = 0xffffffff
+
 type EveAddSource struct {
 	StreamName string
 	RemoteIp   net.Addr
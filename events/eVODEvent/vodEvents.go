@@ -0,0 +1,95 @@
+package eVODEvent
+
+import (
+	"container/list"
+
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+// const string to describe the action
+const (
+	AddVODSink = "AddVODSink"
+	DelVODSink = "DelVODSink"
+	VODControl = "VODControl"
+	GetVODList = "GetVODList"
+)
+
+//vod control action
+const (
+	VODPause  = "pause"
+	VODResume = "resume"
+	VODSeek   = "seek"
+)
+
+//EveAddVODSink each sink has its own vod session
+type EveAddVODSink struct {
+	StreamName string            //in
+	SinkId     string            //in
+	Sinker     wssapi.MsgHandler //in
+	StartMs    int64             //in
+}
+
+//Receiver of EveAddVODSink
+func (eveAddVODSink *EveAddVODSink) Receiver() string {
+	return wssapi.OBJVODServer
+}
+
+//Type of EveAddVODSink
+func (eveAddVODSink *EveAddVODSink) Type() string {
+	return AddVODSink
+}
+
+//EveDelVODSink stop vod session
+type EveDelVODSink struct {
+	StreamName string //in
+	SinkId     string //in
+}
+
+//Receiver of EveDelVODSink
+func (eveDelVODSink *EveDelVODSink) Receiver() string {
+	return wssapi.OBJVODServer
+}
+
+//Type of EveDelVODSink
+func (eveDelVODSink *EveDelVODSink) Type() string {
+	return DelVODSink
+}
+
+//EveVODControl pause,resume or seek one sink,PositionMs for seek only
+type EveVODControl struct {
+	StreamName string //in
+	SinkId     string //in
+	Action     string //in
+	PositionMs int64  //in:seek position;out:real position of keyframe
+}
+
+//Receiver of EveVODControl
+func (eveVODControl *EveVODControl) Receiver() string {
+	return wssapi.OBJVODServer
+}
+
+//Type of EveVODControl
+func (eveVODControl *EveVODControl) Type() string {
+	return VODControl
+}
+
+//VODInfo of one flv file
+type VODInfo struct {
+	StreamName string
+	Size       int64
+}
+
+//EveGetVODList flv files can be played
+type EveGetVODList struct {
+	Files *list.List //out value =*VODInfo
+}
+
+//Receiver of EveGetVODList
+func (eveGetVODList *EveGetVODList) Receiver() string {
+	return wssapi.OBJVODServer
+}
+
+//Type of EveGetVODList
+func (eveGetVODList *EveGetVODList) Type() string {
+	return GetVODList
+}
@@ -1,9 +1,14 @@
 module github.com/use-go/websocket-streamserver
 
-go 1.13
+go 1.20
 
 require (
+	github.com/datarhei/gosrt v0.9.0
 	github.com/gorilla/websocket v1.2.1-0.20171210035353-cdedf21e585d
 	github.com/nareix/joy4 v0.0.0-20171103042016-bd41a3b90ff2
 	github.com/panda-media/muxer-fmp4 v0.0.0-20170927075719-c3ea7b6b8bea
+	github.com/pion/dtls/v2 v2.2.12
+	github.com/pion/srtp/v2 v2.0.20
+	github.com/pion/transport/v2 v2.2.4
+	golang.org/x/crypto v0.33.0
 )
@@ -0,0 +1,428 @@
+package hls
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/events/eHLSEvent"
+	"github.com/use-go/websocket-streamserver/events/eLiveListCtrl"
+	"github.com/use-go/websocket-streamserver/events/eStreamerEvent"
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/mediatype/mp4"
+	"github.com/use-go/websocket-streamserver/mediatype/ts"
+	"github.com/use-go/websocket-streamserver/utils"
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+const (
+	pullTimeout = 10 * time.Second
+	//直播从倒数第三个分片开始,和播放器一致
+	pullLiveStartSegments = 3
+	pullMaxFailures       = 3
+	pullPlaylistMaxSize   = 1 << 20
+	pullSegmentMaxSize    = 64 << 20
+	//不连续时新时间戳接在上一个时间戳后面
+	pullDiscontinuityGapMs = 40
+)
+
+//HLSPuller relay an upstream hls stream as a source,ts or fmp4 segments are demuxed to flv tags
+//and sent in real time
+type HLSPuller struct {
+	pullParams  *eHLSEvent.EvePullHLSStream
+	client      *http.Client
+	mutexSource sync.Mutex
+	src         wssapi.MsgHandler
+	srcID       int64
+	chQuit      chan bool
+	quitOnce    sync.Once
+	chValid     bool
+	tsParser    *ts.TsParser
+	fmp4Parser  *mp4.FMP4Parser
+	initURI     string
+	timeOffset  uint32
+	lastTime    uint32
+	paceSet     bool
+	paceWall    time.Time
+	paceTime    uint32
+}
+
+//PullHLSLive relay a hls stream
+func PullHLSLive(task *eHLSEvent.EvePullHLSStream) {
+	puller := &HLSPuller{}
+	msg := &wssapi.Msg{}
+	msg.Param1 = task
+	puller.Init(msg)
+	puller.Start(nil)
+}
+
+//Init Action
+func (puller *HLSPuller) Init(msg *wssapi.Msg) (err error) {
+	puller.pullParams = msg.Param1.(*eHLSEvent.EvePullHLSStream).Copy()
+	puller.chValid = true
+	puller.chQuit = make(chan bool)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if puller.pullParams.SkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	puller.client = &http.Client{Transport: transport, Timeout: pullTimeout}
+	return
+}
+
+//Start Action
+func (puller *HLSPuller) Start(msg *wssapi.Msg) (err error) {
+	go puller.threadRead()
+	return
+}
+
+//Stop Action
+func (puller *HLSPuller) Stop(msg *wssapi.Msg) (err error) {
+	puller.stop()
+	return
+}
+
+func (puller *HLSPuller) GetType() string {
+	return "HLSPuller"
+}
+
+func (puller *HLSPuller) HandleTask(task wssapi.Task) (err error) {
+	return
+}
+
+func (puller *HLSPuller) ProcessMessage(msg *wssapi.Msg) (err error) {
+	switch msg.Type {
+	case wssapi.MsgSourceClosedForce:
+		logger.LOGT("hls puller data sink closed")
+		puller.mutexSource.Lock()
+		puller.src = nil
+		puller.mutexSource.Unlock()
+		puller.stop()
+	default:
+		logger.LOGE(msg.Type + " not processed")
+	}
+	return
+}
+
+func (puller *HLSPuller) stop() {
+	puller.quitOnce.Do(func() {
+		close(puller.chQuit)
+	})
+}
+
+func (puller *HLSPuller) stopped() bool {
+	select {
+	case <-puller.chQuit:
+		return true
+	default:
+		return false
+	}
+}
+
+//wait false if stopped
+func (puller *HLSPuller) wait(duration time.Duration) bool {
+	if duration <= 0 {
+		return false == puller.stopped()
+	}
+	select {
+	case <-puller.chQuit:
+		return false
+	case <-time.After(duration):
+		return true
+	}
+}
+
+func (puller *HLSPuller) closeCh() {
+	if puller.chValid {
+		puller.chValid = false
+		close(puller.pullParams.Src)
+	}
+}
+
+func (puller *HLSPuller) threadRead() {
+	defer func() {
+		puller.stop()
+		puller.delSource()
+		puller.closeCh()
+		logger.LOGT("stop hls pull:" + puller.pullParams.SourceName)
+	}()
+	playlistURL := puller.pullParams.URL()
+	logger.LOGT("hls pull:" + playlistURL)
+	media, playlistURL, err := puller.loadMediaPlaylist(playlistURL)
+	if err != nil {
+		logger.LOGE("hls pull " + playlistURL + " failed:" + err.Error())
+		return
+	}
+	if false == puller.createSource(playlistURL) {
+		return
+	}
+	go puller.checkPlayerCounts()
+	start := 0
+	if false == media.endList && len(media.segments) > pullLiveStartSegments {
+		start = len(media.segments) - pullLiveStartSegments
+	}
+	lastSeq := int64(-1)
+	if len(media.segments) > 0 {
+		lastSeq = media.segments[start].seq - 1
+	}
+	failures := 0
+	for {
+		var segments []*mediaSegment
+		for _, segment := range media.segments {
+			if segment.seq > lastSeq {
+				segments = append(segments, segment)
+			}
+		}
+		if len(segments) > 0 && lastSeq >= 0 && segments[0].seq > lastSeq+1 {
+			//下载太慢,分片已经从列表中移除
+			logger.LOGW("hls pull skip " + strconv.FormatInt(segments[0].seq-lastSeq-1, 10) + " segments:" + puller.pullParams.SourceName)
+			segments[0].discontinuity = true
+		}
+		for _, segment := range segments {
+			err = puller.pullSegment(segment)
+			if err != nil {
+				logger.LOGE("hls pull segment " + segment.uri + " failed:" + err.Error())
+				failures++
+				if failures >= pullMaxFailures {
+					return
+				}
+			} else {
+				failures = 0
+			}
+			lastSeq = segment.seq
+			if puller.stopped() {
+				return
+			}
+		}
+		if media.endList {
+			logger.LOGT("hls pull end of list:" + puller.pullParams.SourceName)
+			return
+		}
+		if len(segments) == 0 && false == puller.wait(time.Duration(media.targetDuration*float64(time.Second)/2)) {
+			return
+		}
+		var mediaNew *mediaPlaylist
+		mediaNew, _, err = puller.loadMediaPlaylist(playlistURL)
+		if err != nil {
+			logger.LOGE("hls pull reload " + playlistURL + " failed:" + err.Error())
+			failures++
+			if failures >= pullMaxFailures || false == puller.wait(time.Duration(media.targetDuration*float64(time.Second)/2)) {
+				return
+			}
+			continue
+		}
+		media = mediaNew
+	}
+}
+
+//loadMediaPlaylist 主列表时选一个码流
+func (puller *HLSPuller) loadMediaPlaylist(playlistURL string) (media *mediaPlaylist, mediaURL string, err error) {
+	mediaURL = playlistURL
+	for i := 0; i < 2; i++ {
+		var data []byte
+		data, err = puller.get(mediaURL, pullPlaylistMaxSize)
+		if err != nil {
+			return
+		}
+		var base *url.URL
+		base, err = url.Parse(mediaURL)
+		if err != nil {
+			return
+		}
+		var variants []*variantStream
+		media, variants, err = parsePlaylist(data, base)
+		if err != nil || nil != media {
+			return
+		}
+		variant := selectVariant(variants)
+		if nil == variant {
+			return nil, mediaURL, errors.New("no h264/aac variant")
+		}
+		logger.LOGT("hls pull variant " + strconv.Itoa(variant.bandwidth) + " " + variant.uri)
+		mediaURL = variant.uri
+	}
+	return nil, mediaURL, errors.New("nested master playlist")
+}
+
+func (puller *HLSPuller) get(uri string, maxSize int64) (data []byte, err error) {
+	resp, err := puller.client.Get(uri)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	data, err = ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err == nil && int64(len(data)) > maxSize {
+		return nil, errors.New("response too large")
+	}
+	return
+}
+
+//pullSegment download and demux one segment
+func (puller *HLSPuller) pullSegment(segment *mediaSegment) (err error) {
+	if segment.discontinuity || nil == puller.tsParser && nil == puller.fmp4Parser {
+		puller.resetParsers()
+	}
+	data, err := puller.get(segment.uri, pullSegmentMaxSize)
+	if err != nil {
+		return
+	}
+	var tags []*flv.FlvTag
+	if len(segment.mapURI) > 0 {
+		if segment.mapURI != puller.initURI {
+			var init []byte
+			init, err = puller.get(segment.mapURI, pullSegmentMaxSize)
+			if err != nil {
+				return
+			}
+			err = puller.fmp4Parser.ParseInit(init)
+			if err != nil {
+				return
+			}
+			puller.initURI = segment.mapURI
+		}
+		tags, err = puller.fmp4Parser.Parse(data)
+		if err != nil {
+			return
+		}
+	} else {
+		tags = puller.tsParser.Parse(data)
+	}
+	return puller.sendTags(tags)
+}
+
+//resetParsers 新的解析器时间戳从0开始,加上偏移保持递增
+func (puller *HLSPuller) resetParsers() {
+	if nil != puller.tsParser || nil != puller.fmp4Parser {
+		puller.timeOffset = puller.lastTime + pullDiscontinuityGapMs
+	}
+	puller.tsParser = &ts.TsParser{}
+	puller.fmp4Parser = &mp4.FMP4Parser{}
+	puller.initURI = ""
+}
+
+//sendTags 按时间戳实时发送,落后时立即发送
+func (puller *HLSPuller) sendTags(tags []*flv.FlvTag) (err error) {
+	for _, tag := range tags {
+		tag.Timestamp += puller.timeOffset
+		if tag.Timestamp > puller.lastTime {
+			puller.lastTime = tag.Timestamp
+		}
+		if false == puller.paceSet {
+			puller.paceSet = true
+			puller.paceWall = time.Now()
+			puller.paceTime = tag.Timestamp
+		}
+		due := puller.paceWall.Add(time.Duration(int64(tag.Timestamp)-int64(puller.paceTime)) * time.Millisecond)
+		if false == puller.wait(time.Until(due)) {
+			return
+		}
+		puller.mutexSource.Lock()
+		if nil == puller.src {
+			puller.mutexSource.Unlock()
+			puller.stop()
+			return
+		}
+		err = puller.src.ProcessMessage(&wssapi.Msg{Type: wssapi.MsgFlvTag, Param1: tag})
+		puller.mutexSource.Unlock()
+		if err != nil {
+			puller.stop()
+			return
+		}
+	}
+	return
+}
+
+func (puller *HLSPuller) createSource(playlistURL string) bool {
+	taskGet := &eStreamerEvent.EveGetSource{}
+	taskGet.StreamName = puller.pullParams.SourceName
+	wssapi.HandleTask(taskGet)
+	if utils.InterfaceValid(taskGet.SrcObj) && taskGet.HasProducer {
+		//已经被其他人抢先了
+		logger.LOGD("some other pulled hls stream:" + taskGet.StreamName)
+		puller.notifySrc(taskGet.SrcObj)
+		return false
+	}
+	taskAdd := &eStreamerEvent.EveAddSource{}
+	taskAdd.Producer = puller
+	taskAdd.StreamName = puller.pullParams.SourceName
+	if u, err := url.Parse(playlistURL); err == nil {
+		port := u.Port()
+		if len(port) == 0 {
+			port = "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+		}
+		if addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(u.Hostname(), port)); err == nil {
+			taskAdd.RemoteIp = addr
+		}
+	}
+	err := wssapi.HandleTask(taskAdd)
+	if err != nil || utils.InterfaceIsNil(taskAdd.SrcObj) {
+		logger.LOGE("hls pull add source failed:" + puller.pullParams.SourceName)
+		return false
+	}
+	puller.mutexSource.Lock()
+	puller.src = taskAdd.SrcObj
+	puller.srcID = taskAdd.ID
+	puller.mutexSource.Unlock()
+	puller.notifySrc(taskAdd.SrcObj)
+	logger.LOGT("add hls src ok..")
+	return true
+}
+
+//notifySrc 等待方可能已经超时，不能一直阻塞
+func (puller *HLSPuller) notifySrc(src wssapi.MsgHandler) {
+	if false == puller.chValid {
+		return
+	}
+	select {
+	case puller.pullParams.Src <- src:
+	case <-time.After(pullTimeout):
+		logger.LOGW("nobody wait for hls pull result:" + puller.pullParams.SourceName)
+	}
+	puller.closeCh()
+}
+
+//delSource 删除源时streamer会回调ProcessMessage,不能持有锁
+func (puller *HLSPuller) delSource() {
+	puller.mutexSource.Lock()
+	src := puller.src
+	puller.src = nil
+	puller.mutexSource.Unlock()
+	if utils.InterfaceValid(src) {
+		taskDelSrc := &eStreamerEvent.EveDelSource{}
+		taskDelSrc.StreamName = puller.pullParams.SourceName
+		taskDelSrc.ID = puller.srcID
+		err := wssapi.HandleTask(taskDelSrc)
+		if err != nil {
+			logger.LOGE(err.Error())
+		}
+	}
+}
+
+func (puller *HLSPuller) checkPlayerCounts() {
+	for puller.wait(time.Duration(2) * time.Minute) {
+		eve := &eLiveListCtrl.EveGetLivePlayerCount{LiveName: puller.pullParams.SourceName}
+		err := wssapi.HandleTask(eve)
+		if err != nil {
+			logger.LOGD(err.Error())
+			continue
+		}
+		if 1 > eve.Count {
+			logger.LOGI("no player for hls puller ,close itself")
+			puller.stop()
+			return
+		}
+	}
+}
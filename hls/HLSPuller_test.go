@@ -0,0 +1,129 @@
+package hls
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/events/eHLSEvent"
+	"github.com/use-go/websocket-streamserver/events/eStreamerEvent"
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/mediatype/h264"
+	"github.com/use-go/websocket-streamserver/mediatype/ts"
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+//testStreamer 收集推到源的tag,删除源时和streamer一样回调生产者
+type testStreamer struct {
+	mutex    sync.Mutex
+	producer wssapi.MsgHandler
+	tags     []*flv.FlvTag
+	chDel    chan bool
+}
+
+func (streamer *testStreamer) Init(msg *wssapi.Msg) error  { return nil }
+func (streamer *testStreamer) Start(msg *wssapi.Msg) error { return nil }
+func (streamer *testStreamer) Stop(msg *wssapi.Msg) error  { return nil }
+func (streamer *testStreamer) GetType() string             { return "testStreamer" }
+
+func (streamer *testStreamer) HandleTask(task wssapi.Task) error {
+	switch task := task.(type) {
+	case *eStreamerEvent.EveAddSource:
+		streamer.producer = task.Producer
+		task.SrcObj = streamer
+	case *eStreamerEvent.EveDelSource:
+		streamer.producer.ProcessMessage(&wssapi.Msg{Type: wssapi.MsgSourceClosedForce})
+		close(streamer.chDel)
+	}
+	return nil
+}
+
+func (streamer *testStreamer) ProcessMessage(msg *wssapi.Msg) error {
+	streamer.mutex.Lock()
+	defer streamer.mutex.Unlock()
+	streamer.tags = append(streamer.tags, msg.Param1.(*flv.FlvTag))
+	return nil
+}
+
+func TestHLSPullTS(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xec, 0x04, 0x40, 0x00, 0x00, 0x03, 0x00, 0x40, 0x00, 0x00, 0x0c, 0x23, 0xc6, 0x0c, 0x92}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	creater := &ts.TsCreater{}
+	creater.AddTag(&flv.FlvTag{TagType: flv.FlvTagVideo, Data: append([]byte{0x17, 0, 0, 0, 0}, h264.AVCDecoderConfigurationRecord(sps, pps)...)})
+	//3个分片,每个10帧,关键帧开始
+	segments := make([][]byte, 3)
+	for i := range segments {
+		for frame := 0; frame < 10; frame++ {
+			data := []byte{0x27, 1, 0, 0, 0, 0, 0, 0, 3, 0x41, 0x9a, byte(frame)}
+			if frame == 0 {
+				data = []byte{0x17, 1, 0, 0, 0, 0, 0, 0, 3, 0x65, 0x88, byte(i)}
+			}
+			creater.AddTag(&flv.FlvTag{TagType: flv.FlvTagVideo, Timestamp: uint32((i*10 + frame) * 40), Data: data})
+		}
+		for e := creater.FlushTsList().Front(); e != nil; e = e.Next() {
+			segments[i] = append(segments[i], e.Value.([]byte)...)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/live/foo/master.m3u8", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=100000,CODECS=\"hvc1.1.6.L93.B0\"\nhevc/index.m3u8\n"+
+			"#EXT-X-STREAM-INF:BANDWIDTH=50000,CODECS=\"avc1.42c01f,mp4a.40.2\"\navc/index.m3u8\n")
+	})
+	mux.HandleFunc("/live/foo/avc/index.m3u8", func(w http.ResponseWriter, req *http.Request) {
+		playlist := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:7\n"
+		for i := range segments {
+			playlist += "#EXTINF:0.400,\nseg" + strconv.Itoa(i) + ".ts\n"
+		}
+		fmt.Fprint(w, playlist+"#EXT-X-ENDLIST\n")
+	})
+	mux.HandleFunc("/live/foo/avc/", func(w http.ResponseWriter, req *http.Request) {
+		var i int
+		if _, err := fmt.Sscanf(req.URL.Path, "/live/foo/avc/seg%d.ts", &i); err != nil || i >= len(segments) {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write(segments[i])
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	streamer := &testStreamer{chDel: make(chan bool)}
+	wssapi.SetHandler(streamer)
+	defer wssapi.SetHandler(nil)
+	task := &eHLSEvent.EvePullHLSStream{Address: host, App: "live", StreamName: "foo", Playlist: "master.m3u8",
+		SourceName: "live/foo", Src: make(chan wssapi.MsgHandler)}
+	task.Port, _ = strconv.Atoi(port)
+	PullHLSLive(task)
+	if src, ok := <-task.Src; false == ok || src != streamer {
+		t.Fatal("source not created")
+	}
+	select {
+	case <-streamer.chDel:
+	case <-time.After(5 * time.Second):
+		t.Fatal("puller not finished")
+	}
+	streamer.mutex.Lock()
+	defer streamer.mutex.Unlock()
+	//最后一帧要等下一个PES才能输出
+	if len(streamer.tags) != 30 || false == flv.IsVideoSequenceHeader(streamer.tags[0]) {
+		t.Fatal("tags", len(streamer.tags))
+	}
+	keyFrames := 0
+	for i, tag := range streamer.tags[1:] {
+		if flv.IsKeyFrame(tag) {
+			keyFrames++
+		}
+		if tag.Timestamp != uint32(i*40) {
+			t.Fatal("timestamp", i, tag.Timestamp)
+		}
+	}
+	if keyFrames != 3 {
+		t.Fatal("key frames", keyFrames)
+	}
+}
@@ -7,11 +7,18 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/use-go/websocket-streamserver/events/eHLSEvent"
 	"github.com/use-go/websocket-streamserver/logger"
 
+	"github.com/use-go/websocket-streamserver/abr"
+	"github.com/use-go/websocket-streamserver/authorizer"
 	"github.com/use-go/websocket-streamserver/httpmux"
+	"github.com/use-go/websocket-streamserver/metrics"
+	"github.com/use-go/websocket-streamserver/session"
+	"github.com/use-go/websocket-streamserver/tlsconf"
 	"github.com/use-go/websocket-streamserver/wssapi"
 	"github.com/use-go/websocket-streamserver/utils"
 )
@@ -20,18 +27,57 @@ import (
 type HLSService struct {
 	sources   map[string]*HLSSource
 	muxSource sync.RWMutex
+	cmafs     map[string]*cmafSource
+	muxCMAF   sync.Mutex
 	icoData   []byte
 }
 
+//HLSAppConfig segments of an app
+//CacheLength segments are kept in memory,older ones are moved to DVRDir while in DVRWindowSec
+//PlaylistType live is a sliding window,event keeps every segment since the stream started
+//Container fmp4 serves cmaf segments shared with dash when the SegmentMs is the same,
+//the dvr window and event playlists are kept in DVRDir as for ts
+type HLSAppConfig struct {
+	SegmentMs    int    `json:"SegmentMs,omitempty"`
+	CacheLength  int    `json:"CacheLength,omitempty"`
+	DVRWindowSec int    `json:"DVRWindowSec,omitempty"`
+	DVRDir       string `json:"DVRDir,omitempty"`
+	PlaylistType string `json:"PlaylistType,omitempty"`
+	Container    string `json:"Container,omitempty"`
+}
+
 //HLSService config
+//LowLatency also serves ll.m3u8 with fmp4 parts,keep the publisher gop not longer than LLSegmentMs for low latency
+//ABR groups are served as master playlists at /route/group/master.m3u8
+//the app config fields are the default,Apps overrides them by app name
 type HLSConfig struct {
-	Port  int    `json:"Port"`
-	Route string `json:"Route"`
-	ICO   string `json:"ico"`
+	Port           int             `json:"Port"`
+	Route          string          `json:"Route"`
+	ICO            string          `json:"ico"`
+	LowLatency     bool            `json:"LowLatency"`
+	PartTargetMs   int             `json:"PartTargetMs"`
+	LLSegmentMs    int             `json:"LLSegmentMs"`
+	LLSegmentCount int             `json:"LLSegmentCount"`
+	TLS            *tlsconf.Config `json:"TLS"`
+	ABR            []abr.Group     `json:"ABR,omitempty"`
+
+	HLSAppConfig
+	Apps map[string]HLSAppConfig `json:"Apps,omitempty"`
 }
 
 var service *HLSService
-var serviceConfig HLSConfig
+
+//serviceConfig *HLSConfig,new sources and segmenters read it,a reload swaps it
+var serviceConfig atomic.Value
+
+//config current config,do not modify it
+func config() *HLSConfig {
+	cfg, _ := serviceConfig.Load().(*HLSConfig)
+	if nil == cfg {
+		return &HLSConfig{}
+	}
+	return cfg
+}
 
 func (hlsService *HLSService) Init(msg *wssapi.Msg) (err error) {
 	defer func() {
@@ -44,46 +90,120 @@ func (hlsService *HLSService) Init(msg *wssapi.Msg) (err error) {
 		return
 	}
 	hlsService.sources = make(map[string]*HLSSource)
+	hlsService.cmafs = make(map[string]*cmafSource)
 	fileName := msg.Param1.(string)
-	err = hlsService.loadConfigFile(fileName)
+	cfg, err := hlsService.loadConfigFile(fileName)
 	if err != nil {
 		return
 	}
 	service = hlsService
 
-	strPort := ":" + strconv.Itoa(serviceConfig.Port)
-	httpmux.AddRoute(strPort, serviceConfig.Route, hlsService.ServeHTTP)
+	strPort := ":" + strconv.Itoa(cfg.Port)
+	httpmux.AddRoute(strPort, cfg.Route, hlsService.ServeHTTP)
+	err = httpmux.AddTLSRoute(cfg.TLS, cfg.Route, hlsService.ServeHTTP)
+	if err != nil {
+		logger.LOGE("hls tls disabled:" + err.Error())
+		err = nil
+	}
 
-	if len(serviceConfig.ICO) > 0 {
-		hlsService.icoData, err = utils.ReadFileAll(serviceConfig.ICO)
+	if len(cfg.ICO) > 0 {
+		hlsService.icoData, err = utils.ReadFileAll(cfg.ICO)
 		if err != nil {
 			logger.LOGW(err.Error())
 			err = nil
-			return
 		}
 	}
 
-	if strings.HasPrefix(serviceConfig.Route, "/") {
-		serviceConfig.Route = strings.TrimPrefix(serviceConfig.Route, "/")
-	}
-	if strings.HasSuffix(serviceConfig.Route, "/") {
-		serviceConfig.Route = strings.TrimSuffix(serviceConfig.Route, "/")
-	}
+	cfg.Route = trimRoute(cfg.Route)
+	serviceConfig.Store(cfg)
 	return
 }
 
-func (hlsService *HLSService) loadConfigFile(fileName string) (err error) {
+//trimRoute route without the leading and trailing slash,as urls are matched
+func trimRoute(route string) string {
+	route = strings.TrimPrefix(route, "/")
+	return strings.TrimSuffix(route, "/")
+}
+
+//loadConfigFile read a new config,it is not used until stored
+func (hlsService *HLSService) loadConfigFile(fileName string) (cfg *HLSConfig, err error) {
 	buf, err := utils.ReadFileAll(fileName)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = json.Unmarshal(buf, &serviceConfig)
+	cfg = &HLSConfig{}
+	err = json.Unmarshal(buf, cfg)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if cfg.PartTargetMs <= 0 {
+		cfg.PartTargetMs = defaultPartTargetMs
+	}
+	if cfg.LLSegmentMs < cfg.PartTargetMs {
+		cfg.LLSegmentMs = defaultLLSegmentMs
+	}
+	if cfg.LLSegmentCount <= 0 {
+		cfg.LLSegmentCount = defaultLLSegmentCount
+	}
+	if err = checkAppConfig(&cfg.HLSAppConfig, defaultAppConfig); err != nil {
+		return nil, err
+	}
+	for name, app := range cfg.Apps {
+		if err = checkAppConfig(&app, cfg.HLSAppConfig); err != nil {
+			return nil, err
+		}
+		cfg.Apps[name] = app
+	}
+	if err = abr.Check(cfg.ABR); err != nil {
+		return nil, err
 	}
 	return
 }
 
+//checkAppConfig unset fields from def
+func checkAppConfig(app *HLSAppConfig, def HLSAppConfig) error {
+	if app.SegmentMs <= 0 {
+		app.SegmentMs = def.SegmentMs
+	}
+	if app.CacheLength <= 0 {
+		app.CacheLength = def.CacheLength
+	}
+	if app.DVRWindowSec <= 0 {
+		app.DVRWindowSec = def.DVRWindowSec
+	}
+	if len(app.DVRDir) == 0 {
+		app.DVRDir = def.DVRDir
+	}
+	switch app.PlaylistType {
+	case "":
+		app.PlaylistType = def.PlaylistType
+	case PlaylistLive, PlaylistEvent:
+	default:
+		return errors.New("invalid hls playlist type:" + app.PlaylistType)
+	}
+	switch app.Container {
+	case "":
+		app.Container = def.Container
+	case ContainerTS, ContainerFMP4:
+	default:
+		return errors.New("invalid hls container:" + app.Container)
+	}
+	if app.Container == ContainerFMP4 && app.PlaylistType == PlaylistEvent {
+		return errors.New("hls event playlist not supported with fmp4")
+	}
+	return nil
+}
+
+//appConfig config of the app of the stream
+func appConfig(streamName string) HLSAppConfig {
+	app := strings.Split(streamName, "/")[0]
+	cfg := config()
+	if appCfg, ok := cfg.Apps[app]; ok {
+		return appCfg
+	}
+	return cfg.HLSAppConfig
+}
+
 func (hlsService *HLSService) Start(msg *wssapi.Msg) (err error) {
 
 	//	go func() {
@@ -99,7 +219,22 @@ func (hlsService *HLSService) Start(msg *wssapi.Msg) (err error) {
 	return
 }
 
+//Stop remove all hls sources from streamer,waiting requests are released
 func (hlsService *HLSService) Stop(msg *wssapi.Msg) (err error) {
+	hlsService.muxSource.Lock()
+	sources := hlsService.sources
+	hlsService.sources = make(map[string]*HLSSource)
+	hlsService.muxSource.Unlock()
+	for _, v := range sources {
+		v.Stop(nil)
+	}
+	hlsService.muxCMAF.Lock()
+	cmafs := hlsService.cmafs
+	hlsService.cmafs = make(map[string]*cmafSource)
+	hlsService.muxCMAF.Unlock()
+	for _, v := range cmafs {
+		v.release()
+	}
 	return
 }
 
@@ -107,11 +242,41 @@ func (hlsService *HLSService) GetType() string {
 	return wssapi.OBJHLSServer
 }
 
+//HandleTask pull hls stream from upstream
 func (hlsService *HLSService) HandleTask(task wssapi.Task) (err error) {
-	return
+	if task.Receiver() != hlsService.GetType() {
+		return errors.New("not my task")
+	}
+	switch task.Type() {
+	case eHLSEvent.PullHLSStream:
+		taskPull, ok := task.(*eHLSEvent.EvePullHLSStream)
+		if false == ok {
+			return errors.New("invalid param to pull hls stream")
+		}
+		PullHLSLive(taskPull)
+		return
+	default:
+		return errors.New("task " + task.Type() + " not prossed")
+	}
 }
 
+//ProcessMessage reload config,running sources keep their segmenters,new ones use the new config
 func (hlsService *HLSService) ProcessMessage(msg *wssapi.Msg) (err error) {
+	switch msg.Type {
+	case wssapi.MsgReloadConfig:
+		var cfg *HLSConfig
+		cfg, err = hlsService.loadConfigFile(msg.Param1.(string))
+		if err != nil {
+			return
+		}
+		cfg.Route = trimRoute(cfg.Route)
+		old := config()
+		if cfg.Port != old.Port || cfg.Route != old.Route || cfg.ICO != old.ICO || false == cfg.TLS.Equal(old.TLS) {
+			logger.LOGW("hls port,route,ico and tls change need restart")
+			cfg.Port, cfg.Route, cfg.ICO, cfg.TLS = old.Port, old.Route, old.ICO, old.TLS
+		}
+		serviceConfig.Store(cfg)
+	}
 	return
 }
 
@@ -135,9 +300,9 @@ func (hlsService *HLSService) ServeHTTP(w http.ResponseWriter, req *http.Request
 	url := req.URL.Path
 	url = strings.TrimPrefix(url, "/")
 	url = strings.TrimSuffix(url, "/")
-	if strings.HasPrefix(url, serviceConfig.Route) {
+	if strings.HasPrefix(url, config().Route) {
 		//logger.LOGD(url)
-		url = strings.TrimPrefix(url, serviceConfig.Route)
+		url = strings.TrimPrefix(url, config().Route)
 		if strings.HasPrefix(url, "/") {
 			//streamName := strings.TrimPrefix(url, "/")
 			//
@@ -159,20 +324,33 @@ func (hlsService *HLSService) ServeHTTP(w http.ResponseWriter, req *http.Request
 			streamName := strings.TrimSuffix(url, param)
 			streamName = strings.TrimSuffix(streamName, "/")
 			//
-			//logger.LOGD(streamName)
-			hlsService.muxSource.RLock()
-			source, exist := hlsService.sources[streamName]
-			hlsService.muxSource.RUnlock()
-			if exist == false {
-				source = hlsService.createSource(streamName)
-				if utils.InterfaceIsNil(source) {
-					logger.LOGE("add hls source " + streamName + " failed")
-					w.WriteHeader(404)
-					return
-				} else {
-					source.ServeHTTP(w, req, param)
-					return
+			errAuth := authorizer.CheckHTTP(authorizer.ProtocolHLS, streamName, req)
+			if errAuth != nil {
+				w.WriteHeader(authorizer.StatusCode(errAuth))
+				return
+			}
+			sess, errSession := session.Touch(metrics.ProtocolHLS, streamName, req)
+			if errSession != nil {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w = sess.ResponseWriter(w)
+			if group := abr.Find(config().ABR, streamName); group != nil && MasterM3U8 == param {
+				hlsService.serveGroup(w, req, group)
+				return
+			}
+			if appConfig(streamName).Container == ContainerFMP4 {
+				source := hlsService.getCMAF(streamName)
+				if false == source.serveHTTP(w, req, param) {
+					hlsService.delCMAF(source)
 				}
+				return
+			}
+			//logger.LOGD(streamName)
+			source := hlsService.getSource(streamName)
+			if nil == source {
+				w.WriteHeader(404)
+				return
 			}
 			source.ServeHTTP(w, req, param)
 		} else {
@@ -214,6 +392,22 @@ func (hlsService *HLSService) DelSource(key, id string) {
 	}
 }
 
+//getSource existed one or create a new sink
+func (hlsService *HLSService) getSource(streamName string) (source *HLSSource) {
+	hlsService.muxSource.RLock()
+	source, exist := hlsService.sources[streamName]
+	hlsService.muxSource.RUnlock()
+	if exist {
+		return
+	}
+	source = hlsService.createSource(streamName)
+	if utils.InterfaceIsNil(source) {
+		logger.LOGE("add hls source " + streamName + " failed")
+		return nil
+	}
+	return
+}
+
 func (hlsService *HLSService) createSource(streamName string) (source *HLSSource) {
 	chSvr := make(chan bool, 1)
 	msg := &wssapi.Msg{
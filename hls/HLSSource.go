@@ -5,16 +5,20 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/use-go/websocket-streamserver/abr"
+	"github.com/use-go/websocket-streamserver/authorizer"
 	"github.com/use-go/websocket-streamserver/events/eStreamerEvent"
 	"github.com/use-go/websocket-streamserver/logger"
 	"github.com/use-go/websocket-streamserver/mediatype/flv"
 	"github.com/use-go/websocket-streamserver/mediatype/ts"
+	"github.com/use-go/websocket-streamserver/metrics"
 	"github.com/use-go/websocket-streamserver/wssapi"
 	"github.com/use-go/websocket-streamserver/utils"
 )
@@ -25,6 +29,7 @@ type hlsTsData struct {
 	idx        int
 }
 
+//TsCacheLength default segments in memory
 const TsCacheLength = 4
 const (
 	MasterM3U8 = "master.m3u8"
@@ -32,6 +37,26 @@ const (
 	audioPref  = "a"
 )
 
+//PlaylistType of HLSAppConfig
+const (
+	PlaylistLive  = "live"
+	PlaylistEvent = "event"
+)
+
+//Container of HLSAppConfig
+const (
+	ContainerTS   = "ts"
+	ContainerFMP4 = "fmp4"
+)
+
+var defaultAppConfig = HLSAppConfig{
+	SegmentMs:    10000,
+	CacheLength:  TsCacheLength,
+	DVRDir:       "hls_dvr",
+	PlaylistType: PlaylistLive,
+	Container:    ContainerTS,
+}
+
 type HLSSource struct {
 	sinkAdded    bool
 	inSvrMap     bool
@@ -50,6 +75,13 @@ type HLSSource struct {
 	beginTime    uint32
 	waitsChannel *list.List
 	muxWaits     sync.RWMutex
+	stats        *metrics.SinkStats
+	ll           *llStream
+	app          HLSAppConfig
+	dvr          *dvrCache
+	//abr 码率的切分点和序号按时间戳对齐
+	aligner *abr.Aligner
+	variant *abr.Variant
 }
 
 func (hlsSource *HLSSource) Init(msg *wssapi.Msg) (err error) {
@@ -60,6 +92,9 @@ func (hlsSource *HLSSource) Init(msg *wssapi.Msg) (err error) {
 	hlsSource.waitsChannel = list.New()
 	hlsSource.segIdx = 0
 	hlsSource.beginTime = 0
+	if config().LowLatency {
+		hlsSource.ll = newLLStream()
+	}
 	var ok bool
 	hlsSource.streamName, ok = msg.Param1.(string)
 	if false == ok {
@@ -70,20 +105,26 @@ func (hlsSource *HLSSource) Init(msg *wssapi.Msg) (err error) {
 		return errors.New("invalid param init hls source")
 	}
 	hlsSource.chValid = true
+	hlsSource.app = appConfig(hlsSource.streamName)
+	if group := abr.Of(config().ABR, hlsSource.streamName); group != nil {
+		hlsSource.aligner = abr.NewAligner(group.SegmentMs)
+	}
 
 	//create source
 	hlsSource.clientID = utils.GenerateGUID()
+	hlsSource.dvr = newAppDVR(hlsSource.app, hlsSource.streamName, hlsSource.clientID, ".ts")
 	taskAddSink := &eStreamerEvent.EveAddSink{
 		StreamName: hlsSource.streamName,
 		SinkId:     hlsSource.clientID,
 		Sinker:     hlsSource}
 
+	hlsSource.stats = metrics.AddSink(metrics.ProtocolHLS, hlsSource.streamName, hlsSource.clientID)
 	wssapi.HandleTask(taskAddSink)
 
 	logger.LOGD("init end")
 	if strings.Contains(hlsSource.streamName, "/") {
 		//hlsSource.urlPref="/"+serviceConfig.Route+"/"+hlsSource.streamName
-		hlsSource.urlPref = "/" + serviceConfig.Route + "/" + hlsSource.streamName
+		hlsSource.urlPref = "/" + config().Route + "/" + hlsSource.streamName
 	}
 	return
 }
@@ -108,6 +149,7 @@ func (hlsSource *HLSSource) Stop(msg *wssapi.Msg) (err error) {
 		hlsSource.sinkAdded = false
 		logger.LOGT("del sinker:" + hlsSource.clientID)
 	}
+	metrics.DelSink(hlsSource.stats)
 	//从service移除
 	if hlsSource.inSvrMap {
 		hlsSource.inSvrMap = false
@@ -119,6 +161,13 @@ func (hlsSource *HLSSource) Stop(msg *wssapi.Msg) (err error) {
 		hlsSource.chValid = false
 	}
 
+	if hlsSource.ll != nil {
+		hlsSource.ll.close()
+	}
+	if hlsSource.dvr != nil {
+		hlsSource.dvr.close()
+	}
+
 	hlsSource.muxWaits.Lock()
 	defer hlsSource.muxWaits.Unlock()
 	if hlsSource.waitsChannel != nil {
@@ -167,6 +216,12 @@ func (hlsSource *HLSSource) ProcessMessage(msg *wssapi.Msg) (err error) {
 }
 
 func (hlsSource *HLSSource) ServeHTTP(w http.ResponseWriter, req *http.Request, param string) {
+	if hlsSource.ll != nil {
+		if handled, n := hlsSource.ll.serveHTTP(w, req, param, tokenQuery(req)); handled {
+			hlsSource.stats.AddBytes(n)
+			return
+		}
+	}
 	if strings.HasSuffix(param, ".ts") {
 		//get ts file
 		hlsSource.serveTs(w, req, param)
@@ -192,11 +247,12 @@ func (hlsSource *HLSSource) serveM3u8(w http.ResponseWriter, req *http.Request,
 	}
 }
 
-func (hlsSource *HLSSource) createVideoM3U8(tsCacheCopy *list.List) (strOut string) {
+//createVideoM3U8 query is appended to segment uri,keep the token for segment requests
+func (hlsSource *HLSSource) createVideoM3U8(tsCacheCopy *list.List, query string) (strOut string) {
 	//max duration
 	maxDuration := 0
 
-	if tsCacheCopy.Len() == TsCacheLength {
+	if nil == hlsSource.dvr && tsCacheCopy.Len() == hlsSource.app.CacheLength {
 		tsCacheCopy.Remove(tsCacheCopy.Front())
 	}
 	for e := tsCacheCopy.Front(); e != nil; e = e.Next() {
@@ -216,6 +272,9 @@ func (hlsSource *HLSSource) createVideoM3U8(tsCacheCopy *list.List) (strOut stri
 	strOut += "#EXT-X-VERSION:3\n"
 	strOut += "#EXT-X-MEDIA-SEQUENCE:" + strconv.Itoa(sequence) + "\n"
 	//strOut += "#EXT-X-PLAYLIST-TYPE:VOD\n"
+	if hlsSource.app.PlaylistType == PlaylistEvent {
+		strOut += "#EXT-X-PLAYLIST-TYPE:EVENT\n"
+	}
 	strOut += "#EXT-X-INDEPENDENT-SEGMENTS\n"
 	//last two ts？？
 	//if tsCacheCopy.Len()<=TsCacheLength{
@@ -224,7 +283,7 @@ func (hlsSource *HLSSource) createVideoM3U8(tsCacheCopy *list.List) (strOut stri
 			tmp := e.Value.(*hlsTsData)
 			strOut += fmt.Sprintf("#EXTINF:%f,\n", tmp.durationMs/1000.0)
 			//strOut += hlsSource.urlPref+"/"+strconv.Itoa(tmp.idx) + ".ts" + "\n"
-			strOut += "v" + strconv.Itoa(tmp.idx) + ".ts" + "\n"
+			strOut += "v" + strconv.Itoa(tmp.idx) + ".ts" + query + "\n"
 		}
 	} else {
 		e := tsCacheCopy.Front()
@@ -235,25 +294,30 @@ func (hlsSource *HLSSource) createVideoM3U8(tsCacheCopy *list.List) (strOut stri
 			tmp := e.Value.(*hlsTsData)
 			strOut += fmt.Sprintf("#EXTINF:%f,\n", tmp.durationMs/1000.0)
 			//strOut += hlsSource.urlPref+"/"+strconv.Itoa(tmp.idx) + ".ts" + "\n"
-			strOut += "v" + strconv.Itoa(tmp.idx) + ".ts" + "\n"
+			strOut += "v" + strconv.Itoa(tmp.idx) + ".ts" + query + "\n"
 		}
 	}
 	//strOut += "#EXT-X-ENDLIST\n"
 	return strOut
 }
 
+//tokenQuery query is appended to segment uri,keep the token for segment requests
+func tokenQuery(req *http.Request) string {
+	if token := req.URL.Query().Get(authorizer.TokenParam); len(token) > 0 {
+		return "?" + authorizer.TokenParam + "=" + url.QueryEscape(token)
+	}
+	return ""
+}
+
 func (hlsSource *HLSSource) serveMaster(w http.ResponseWriter, req *http.Request, param string) {
+	query := tokenQuery(req)
 
-	hlsSource.muxCache.RLock()
-	tsCacheCopy := list.New()
-	for e := hlsSource.tsCache.Front(); e != nil; e = e.Next() {
-		tsCacheCopy.PushBack(e.Value)
-	}
-	hlsSource.muxCache.RUnlock()
+	tsCacheCopy := hlsSource.copySegments()
 	if tsCacheCopy.Len() > 0 {
 		w.Header().Set("Content-Type", "Application/vnd.apple.mpegurl")
-		strOut := hlsSource.createVideoM3U8(tsCacheCopy)
-		w.Write([]byte(strOut))
+		strOut := hlsSource.createVideoM3U8(tsCacheCopy, query)
+		n, _ := w.Write([]byte(strOut))
+		hlsSource.stats.AddBytes(n)
 	} else {
 		//wait for new
 		chWait := make(chan bool, 1)
@@ -267,15 +331,11 @@ func (hlsSource *HLSSource) serveMaster(w http.ResponseWriter, req *http.Request
 				logger.LOGE("no data now")
 				return
 			} else {
-				hlsSource.muxCache.RLock()
-				tsCacheCopy := list.New()
-				for e := hlsSource.tsCache.Front(); e != nil; e = e.Next() {
-					tsCacheCopy.PushBack(e.Value)
-				}
-				hlsSource.muxCache.RUnlock()
-				strOut := hlsSource.createVideoM3U8(tsCacheCopy)
+				tsCacheCopy := hlsSource.copySegments()
+				strOut := hlsSource.createVideoM3U8(tsCacheCopy, query)
 				w.Header().Set("Content-Type", "Application/vnd.apple.mpegurl")
-				w.Write([]byte(strOut))
+				n, _ := w.Write([]byte(strOut))
+				hlsSource.stats.AddBytes(n)
 			}
 		case <-time.After(time.Minute):
 			w.WriteHeader(404)
@@ -285,22 +345,55 @@ func (hlsSource *HLSSource) serveMaster(w http.ResponseWriter, req *http.Request
 	}
 }
 
+//copySegments segments in dvr window and in memory
+func (hlsSource *HLSSource) copySegments() *list.List {
+	tsCacheCopy := list.New()
+	hlsSource.muxCache.RLock()
+	defer hlsSource.muxCache.RUnlock()
+	if hlsSource.tsCache.Len() == 0 {
+		return tsCacheCopy
+	}
+	if hlsSource.dvr != nil {
+		//刚写入磁盘还没有从内存移除的段只列一次
+		hlsSource.dvr.copyTo(tsCacheCopy, hlsSource.tsCache.Front().Value.(*hlsTsData).idx)
+	}
+	for e := hlsSource.tsCache.Front(); e != nil; e = e.Next() {
+		tsCacheCopy.PushBack(e.Value)
+	}
+	return tsCacheCopy
+}
+
 func (hlsSource *HLSSource) serveVideo(w http.ResponseWriter, req *http.Request, param string) {
 	strIdx := strings.TrimPrefix(param, "v")
 	strIdx = strings.TrimSuffix(strIdx, ".ts")
 	idx, _ := strconv.Atoi(strIdx)
 	hlsSource.muxCache.RLock()
-	defer hlsSource.muxCache.RUnlock()
 	for e := hlsSource.tsCache.Front(); e != nil; e = e.Next() {
 		tsData := e.Value.(*hlsTsData)
 		if tsData.idx == idx {
-			w.Write(tsData.buf)
+			hlsSource.muxCache.RUnlock()
+			n, _ := w.Write(tsData.buf)
+			hlsSource.stats.AddBytes(n)
 			return
 		}
 	}
+	hlsSource.muxCache.RUnlock()
+	if hlsSource.dvr != nil {
+		data, err := hlsSource.dvr.read(idx)
+		if err == nil {
+			n, _ := w.Write(data)
+			hlsSource.stats.AddBytes(n)
+			return
+		}
+		logger.LOGT(err.Error())
+	}
+	w.WriteHeader(404)
 }
 
 func (hlsSource *HLSSource) AddFlvTag(tag *flv.FlvTag) {
+	if hlsSource.ll != nil {
+		hlsSource.ll.addTag(tag)
+	}
 	if hlsSource.audioHeader == nil && tag.TagType == flv.FlvTagAudio {
 		hlsSource.audioHeader = tag.Copy()
 		return
@@ -311,7 +404,7 @@ func (hlsSource *HLSSource) AddFlvTag(tag *flv.FlvTag) {
 	}
 
 	//if idr,new slice
-	if tag.TagType == flv.FlvTagVideo && tag.Data[0] == 0x17 && tag.Data[1] == 1 {
+	if flv.IsKeyFrame(tag) && (nil == hlsSource.aligner || hlsSource.aligner.Boundary(tag.Timestamp)) {
 		hlsSource.createNewTSSegment(tag)
 	} else {
 		hlsSource.appendTag(tag)
@@ -332,17 +425,24 @@ func (hlsSource *HLSSource) createNewTSSegment(keyframe *flv.FlvTag) {
 			hlsSource.tsCur.AddTag(hlsSource.videoHeader)
 		}
 		hlsSource.tsCur.AddTag(keyframe)
+		if hlsSource.aligner != nil {
+			hlsSource.segIdx = hlsSource.aligner.Index()
+		}
 
 	} else {
 		//flush data
-		if hlsSource.tsCur.GetDuration() < 10000 {
+		if nil == hlsSource.aligner && hlsSource.tsCur.GetDuration() < hlsSource.app.SegmentMs {
 			hlsSource.appendTag(keyframe)
 			return
 		}
 		data := hlsSource.tsCur.FlushTsList()
+		if hlsSource.dvr != nil && hlsSource.tsCache.Len() > hlsSource.app.CacheLength {
+			//先交给dvr再从内存移除,写入磁盘前由dvr从内存提供
+			hlsSource.dvr.spill(hlsSource.tsCache.Front().Value.(*hlsTsData))
+		}
 		hlsSource.muxCache.Lock()
 		defer hlsSource.muxCache.Unlock()
-		if hlsSource.tsCache.Len() > TsCacheLength {
+		if hlsSource.tsCache.Len() > hlsSource.app.CacheLength {
 			hlsSource.tsCache.Remove(hlsSource.tsCache.Front())
 		}
 		tsdata := &hlsTsData{}
@@ -354,8 +454,17 @@ func (hlsSource *HLSSource) createNewTSSegment(keyframe *flv.FlvTag) {
 			ptr += ts.TS_length
 		}
 		tsdata.idx = int(hlsSource.segIdx & 0xffffffff)
-		hlsSource.segIdx++
+		if hlsSource.aligner != nil {
+			//序号由时间戳计算,各码率同一序号是同一段时间
+			hlsSource.segIdx = hlsSource.aligner.Index()
+		} else {
+			hlsSource.segIdx++
+		}
 		hlsSource.tsCache.PushBack(tsdata)
+		if nil == hlsSource.variant {
+			hlsSource.variant = abr.NewVariant(hlsSource.videoHeader, hlsSource.audioHeader)
+		}
+		hlsSource.variant.AddSegment(len(tsdata.buf), tsdata.durationMs)
 		hlsSource.muxWaits.Lock()
 		if hlsSource.waitsChannel.Len() > 0 {
 			for e := hlsSource.waitsChannel.Front(); e != nil; e = e.Next() {
@@ -411,3 +520,33 @@ func (hlsSource *HLSSource) appendTag(tag *flv.FlvTag) {
 		hlsSource.audioCur.AddTag(tag)
 	}
 }
+
+//waitSegment wait until the first ts segment created
+func (hlsSource *HLSSource) waitSegment(timeout time.Duration) bool {
+	hlsSource.muxCache.RLock()
+	ready := hlsSource.tsCache.Len() > 0
+	hlsSource.muxCache.RUnlock()
+	if ready {
+		return true
+	}
+	chWait := make(chan bool, 1)
+	hlsSource.muxWaits.Lock()
+	hlsSource.waitsChannel.PushBack(chWait)
+	hlsSource.muxWaits.Unlock()
+	select {
+	case ret, ok := <-chWait:
+		return ok && ret
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+//variantInfo resolution,codecs and bandwidth of the segments created,false before the first segment
+func (hlsSource *HLSSource) variantInfo() (variant abr.Variant, ok bool) {
+	hlsSource.muxCache.RLock()
+	defer hlsSource.muxCache.RUnlock()
+	if nil == hlsSource.variant {
+		return
+	}
+	return *hlsSource.variant, true
+}
@@ -0,0 +1,74 @@
+package hls
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/abr"
+	"github.com/use-go/websocket-streamserver/logger"
+)
+
+//serveGroup master playlist of an abr group,renditions without segments are left out
+func (hlsService *HLSService) serveGroup(w http.ResponseWriter, req *http.Request, group *abr.Group) {
+	variants := make([]*abr.Variant, len(group.Renditions))
+	wg := sync.WaitGroup{}
+	for i, rendition := range group.Renditions {
+		wg.Add(1)
+		go func(i int, rendition string) {
+			defer wg.Done()
+			if appConfig(rendition).Container == ContainerFMP4 {
+				if snapshot, ok := hlsService.getCMAF(rendition).waitSnapshot(time.Minute); ok {
+					//分片里视频和音频在一起
+					snapshot.Variant.Bandwidth += snapshot.AudioBandwidth
+					variants[i] = &snapshot.Variant
+				}
+				return
+			}
+			source := hlsService.getSource(rendition)
+			if nil == source || false == source.waitSegment(time.Minute) {
+				return
+			}
+			if variant, ok := source.variantInfo(); ok {
+				variants[i] = &variant
+			}
+		}(i, rendition)
+	}
+	wg.Wait()
+	strOut := createMasterM3U8(group.Renditions, variants, tokenQuery(req))
+	if len(strOut) == 0 {
+		logger.LOGE("no rendition ready for " + group.Name)
+		w.WriteHeader(404)
+		return
+	}
+	w.Header().Set("Content-Type", "Application/vnd.apple.mpegurl")
+	w.Write([]byte(strOut))
+}
+
+//createMasterM3U8 one EXT-X-STREAM-INF for every rendition ready,empty if none
+func createMasterM3U8(renditions []string, variants []*abr.Variant, query string) (strOut string) {
+	for i, variant := range variants {
+		if nil == variant || variant.Bandwidth == 0 {
+			continue
+		}
+		strOut += "#EXT-X-STREAM-INF:BANDWIDTH=" + strconv.Itoa(variant.Bandwidth)
+		strOut += ",AVERAGE-BANDWIDTH=" + strconv.Itoa(variant.AverageBandwidth())
+		if variant.Width > 0 && variant.Height > 0 {
+			strOut += fmt.Sprintf(",RESOLUTION=%dx%d", variant.Width, variant.Height)
+		}
+		if variant.FrameRate > 0 {
+			strOut += ",FRAME-RATE=" + strconv.Itoa(variant.FrameRate)
+		}
+		if codecs := variant.Codecs(); len(codecs) > 0 {
+			strOut += ",CODECS=\"" + codecs + "\""
+		}
+		strOut += "\n"
+		strOut += "/" + config().Route + "/" + renditions[i] + "/" + MasterM3U8 + query + "\n"
+	}
+	if len(strOut) == 0 {
+		return
+	}
+	return "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-INDEPENDENT-SEGMENTS\n" + strOut
+}
@@ -0,0 +1,234 @@
+package hls
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/abr"
+	"github.com/use-go/websocket-streamserver/cmaf"
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/metrics"
+	"github.com/use-go/websocket-streamserver/utils"
+)
+
+//fmp4 apps are served from the cmaf stream shared with dash,master.m3u8 is the media playlist as for ts
+const (
+	cmafInitName = "init.mp4"
+	cmafSegPref  = "c"
+	cmafExt      = ".m4s"
+)
+
+//cmafSource hls view of a cmaf stream,a segment is the video and audio fragments of the same sequence,
+//the cmaf stream keeps the last segments in memory,the dvr window and event playlists are kept by dvr
+type cmafSource struct {
+	streamName string
+	stream     *cmaf.Stream
+	stats      *metrics.SinkStats
+	app        HLSAppConfig
+	dvr        *dvrCache
+	chStop     chan bool
+}
+
+//getCMAF existed one,stopped streams are acquired again,
+//segments are aligned by the abr group when the stream is a rendition
+func (hlsService *HLSService) getCMAF(streamName string) (source *cmafSource) {
+	hlsService.muxCMAF.Lock()
+	defer hlsService.muxCMAF.Unlock()
+	source, exist := hlsService.cmafs[streamName]
+	if exist && false == source.stream.Closed() {
+		return
+	}
+	if exist {
+		source.release()
+	}
+	app := appConfig(streamName)
+	segmentMs := app.SegmentMs
+	if group := abr.Of(config().ABR, streamName); group != nil {
+		segmentMs = group.SegmentMs
+	}
+	clientID := utils.GenerateGUID()
+	source = &cmafSource{
+		streamName: streamName,
+		stream:     cmaf.Acquire(streamName, segmentMs, 0),
+		stats:      metrics.AddSink(metrics.ProtocolHLS, streamName, clientID),
+		app:        app,
+		dvr:        newAppDVR(app, streamName, clientID, cmafExt),
+		chStop:     make(chan bool)}
+	if source.dvr != nil {
+		go source.threadSpill()
+	}
+	hlsService.cmafs[streamName] = source
+	return
+}
+
+//delCMAF the stream has no data,acquired again by the next request
+func (hlsService *HLSService) delCMAF(source *cmafSource) {
+	hlsService.muxCMAF.Lock()
+	if hlsService.cmafs[source.streamName] != source {
+		hlsService.muxCMAF.Unlock()
+		return
+	}
+	delete(hlsService.cmafs, source.streamName)
+	hlsService.muxCMAF.Unlock()
+	source.release()
+}
+
+func (source *cmafSource) release() {
+	metrics.DelSink(source.stats)
+	source.stream.Release()
+	close(source.chStop)
+	if source.dvr != nil {
+		source.dvr.close()
+	}
+}
+
+//threadSpill every new segment is handed to the dvr until the stream stops
+func (source *cmafSource) threadSpill() {
+	next := int64(0)
+	for {
+		select {
+		case <-source.chStop:
+			return
+		default:
+		}
+		if snapshot, ok := source.stream.Snapshot(); ok {
+			for _, video := range snapshot.Videos {
+				if video.Seq < next {
+					continue
+				}
+				source.dvr.spill(&hlsTsData{buf: segmentData(snapshot, video),
+					durationMs: float64(video.Duration),
+					idx:        int(video.Seq)})
+				next = video.Seq + 1
+			}
+		}
+		if source.stream.Closed() {
+			return
+		}
+		source.stream.Wait(time.Second)
+	}
+}
+
+//waitSnapshot wait for the first segment,false if the stream stopped or timeout
+func (source *cmafSource) waitSnapshot(timeout time.Duration) (snapshot cmaf.Snapshot, ok bool) {
+	snapshot, ok = source.stream.Snapshot()
+	if false == ok && source.stream.Wait(timeout) {
+		snapshot, ok = source.stream.Snapshot()
+	}
+	return
+}
+
+//serveHTTP false if no playlist created
+func (source *cmafSource) serveHTTP(w http.ResponseWriter, req *http.Request, param string) bool {
+	switch {
+	case param == MasterM3U8:
+		return source.servePlaylist(w, req)
+	case param == cmafInitName:
+		_, _, initData := source.stream.InitSegments()
+		source.write(w, initData)
+	case strings.HasPrefix(param, cmafSegPref) && strings.HasSuffix(param, cmafExt):
+		source.serveSegment(w, param)
+	default:
+		w.WriteHeader(404)
+	}
+	return true
+}
+
+func (source *cmafSource) servePlaylist(w http.ResponseWriter, req *http.Request) bool {
+	snapshot, ok := source.waitSnapshot(time.Minute)
+	if false == ok {
+		logger.LOGE("no cmaf segment for " + source.streamName)
+		w.WriteHeader(404)
+		return false
+	}
+	w.Header().Set("Content-Type", "Application/vnd.apple.mpegurl")
+	n, _ := w.Write([]byte(createCMAFM3U8(source.playlistSegments(snapshot.Videos), source.app, tokenQuery(req))))
+	source.stats.AddBytes(n)
+	return true
+}
+
+//playlistSegments segments in the dvr window,the last CacheLength ones without dvr
+func (source *cmafSource) playlistSegments(videos []*cmaf.Segment) *list.List {
+	segments := list.New()
+	if source.dvr != nil {
+		//内存中的段也已交给dvr,只列一次
+		source.dvr.copyTo(segments, int(videos[0].Seq))
+	} else if len(videos) > source.app.CacheLength {
+		videos = videos[len(videos)-source.app.CacheLength:]
+	}
+	for _, seg := range videos {
+		segments.PushBack(&hlsTsData{durationMs: float64(seg.Duration), idx: int(seg.Seq)})
+	}
+	return segments
+}
+
+func createCMAFM3U8(segments *list.List, app HLSAppConfig, query string) (strOut string) {
+	maxMs := 0.0
+	for e := segments.Front(); e != nil; e = e.Next() {
+		if dura := e.Value.(*hlsTsData).durationMs; dura > maxMs {
+			maxMs = dura
+		}
+	}
+	strOut = "#EXTM3U\n"
+	strOut += "#EXT-X-TARGETDURATION:" + strconv.Itoa(int(math.Ceil(maxMs/1000))) + "\n"
+	strOut += "#EXT-X-VERSION:7\n"
+	strOut += "#EXT-X-MEDIA-SEQUENCE:" + strconv.Itoa(segments.Front().Value.(*hlsTsData).idx) + "\n"
+	if app.PlaylistType == PlaylistEvent {
+		strOut += "#EXT-X-PLAYLIST-TYPE:EVENT\n"
+	}
+	strOut += "#EXT-X-INDEPENDENT-SEGMENTS\n"
+	strOut += "#EXT-X-MAP:URI=\"" + cmafInitName + query + "\"\n"
+	for e := segments.Front(); e != nil; e = e.Next() {
+		seg := e.Value.(*hlsTsData)
+		strOut += fmt.Sprintf("#EXTINF:%.3f,\n", seg.durationMs/1000.0)
+		strOut += cmafSegPref + strconv.Itoa(seg.idx) + cmafExt + query + "\n"
+	}
+	return
+}
+
+//serveSegment param: c<seq>.m4s
+func (source *cmafSource) serveSegment(w http.ResponseWriter, param string) {
+	seq, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(param, cmafSegPref), cmafExt), 10, 64)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	snapshot, _ := source.stream.Snapshot()
+	if video := cmaf.Find(snapshot.Videos, seq, cmaf.BySeq); video != nil {
+		source.write(w, segmentData(snapshot, video))
+		return
+	}
+	if source.dvr != nil {
+		data, err := source.dvr.read(int(seq))
+		if err == nil {
+			source.write(w, data)
+			return
+		}
+		logger.LOGT(err.Error())
+	}
+	w.WriteHeader(404)
+}
+
+//segmentData video fragment followed by the audio fragment of the same sequence
+func segmentData(snapshot cmaf.Snapshot, video *cmaf.Segment) []byte {
+	audio := cmaf.Find(snapshot.Audios, video.Seq, cmaf.BySeq)
+	if nil == audio {
+		return video.Data
+	}
+	return append(append(make([]byte, 0, len(video.Data)+len(audio.Data)), video.Data...), audio.Data...)
+}
+
+func (source *cmafSource) write(w http.ResponseWriter, data []byte) {
+	if len(data) == 0 {
+		w.WriteHeader(404)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp4")
+	n, _ := w.Write(data)
+	source.stats.AddBytes(n)
+}
@@ -0,0 +1,42 @@
+package hls
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/use-go/websocket-streamserver/cmaf"
+)
+
+func TestCMAFPlaylist(t *testing.T) {
+	var videos []*cmaf.Segment
+	for seq := int64(0); seq < 8; seq++ {
+		videos = append(videos, &cmaf.Segment{Seq: seq + 3, Start: uint32(seq * 2000), Duration: 2000})
+	}
+	videos[7].Duration = 2100
+	source := &cmafSource{app: HLSAppConfig{CacheLength: 4}}
+	strOut := createCMAFM3U8(source.playlistSegments(videos), source.app, "?token=a")
+	for _, line := range []string{"#EXT-X-TARGETDURATION:3", "#EXT-X-MEDIA-SEQUENCE:7", "#EXT-X-MAP:URI=\"init.mp4?token=a\"", "#EXTINF:2.100,\nc10.m4s?token=a"} {
+		if false == strings.Contains(strOut, line) {
+			t.Fatalf("%s not in %s", line, strOut)
+		}
+	}
+	if strings.Contains(strOut, "#EXT-X-PLAYLIST-TYPE") {
+		t.Fatal(strOut)
+	}
+
+	//event 的段在dvr中,内存中的段只列一次
+	source.app = HLSAppConfig{CacheLength: 4, PlaylistType: PlaylistEvent, DVRDir: t.TempDir()}
+	source.dvr = newAppDVR(source.app, "live/event", "1", cmafExt)
+	defer source.dvr.close()
+	for seq := 0; seq < 6; seq++ {
+		source.dvr.spill(&hlsTsData{buf: []byte{byte(seq)}, durationMs: 2000, idx: seq})
+	}
+	strOut = createCMAFM3U8(source.playlistSegments(videos[3:]), source.app, "")
+	if false == strings.Contains(strOut, "#EXT-X-PLAYLIST-TYPE:EVENT\n") || false == strings.Contains(strOut, "#EXT-X-MEDIA-SEQUENCE:0\n") ||
+		strings.Count(strOut, "#EXTINF") != 11 || strings.Count(strOut, "c5.m4s") != 1 {
+		t.Fatal(strOut)
+	}
+	if data, err := source.dvr.read(0); err != nil || len(data) != 1 {
+		t.Fatal("segment 0 not in dvr", err)
+	}
+}
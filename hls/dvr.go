@@ -0,0 +1,165 @@
+package hls
+
+import (
+	"container/list"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/utils"
+)
+
+//dvrCache segments moved out of the memory cache are kept on disk,
+//windowMs 0 keeps all of them for event playlists.
+//files are written and removed by one goroutine,the publisher never waits for the disk
+type dvrCache struct {
+	dir        string
+	ext        string
+	windowMs   float64
+	durationMs float64
+	segments   *list.List
+	closed     bool
+	mux        sync.RWMutex
+	//jobs for the writer,appended under mux
+	writes  []*hlsTsData
+	removes []int
+	chWake  chan bool
+	chDone  chan bool
+}
+
+func newDVRCache(dir, ext string, windowMs float64) *dvrCache {
+	dvr := &dvrCache{dir: dir, ext: ext, windowMs: windowMs, segments: list.New(),
+		chWake: make(chan bool, 1),
+		chDone: make(chan bool)}
+	go dvr.threadWrite()
+	return dvr
+}
+
+//newAppDVR nil if the app has no dvr window and is not an event playlist
+func newAppDVR(app HLSAppConfig, streamName, clientID, ext string) *dvrCache {
+	if app.DVRWindowSec <= 0 && app.PlaylistType != PlaylistEvent {
+		return nil
+	}
+	//event 的段一直保留,不受窗口限制
+	windowMs := float64(app.DVRWindowSec * 1000)
+	if app.PlaylistType == PlaylistEvent {
+		windowMs = 0
+	}
+	return newDVRCache(filepath.Join(app.DVRDir, filepath.FromSlash(streamName), clientID), ext, windowMs)
+}
+
+func (dvr *dvrCache) fileName(idx int) string {
+	return filepath.Join(dvr.dir, strconv.Itoa(idx)+dvr.ext)
+}
+
+//spill hand the segment to the writer and remove the ones out of window,
+//the segment is served from memory until it is on disk
+func (dvr *dvrCache) spill(tsData *hlsTsData) {
+	dvr.mux.Lock()
+	if dvr.closed {
+		dvr.mux.Unlock()
+		return
+	}
+	segment := &hlsTsData{buf: tsData.buf, durationMs: tsData.durationMs, idx: tsData.idx}
+	dvr.segments.PushBack(segment)
+	dvr.durationMs += segment.durationMs
+	dvr.writes = append(dvr.writes, segment)
+	for dvr.windowMs > 0 && dvr.segments.Len() > 1 && dvr.durationMs > dvr.windowMs {
+		front := dvr.segments.Remove(dvr.segments.Front()).(*hlsTsData)
+		dvr.durationMs -= front.durationMs
+		dvr.removes = append(dvr.removes, front.idx)
+	}
+	select {
+	case dvr.chWake <- true:
+	default:
+	}
+	dvr.mux.Unlock()
+}
+
+func (dvr *dvrCache) threadWrite() {
+	defer close(dvr.chDone)
+	for range dvr.chWake {
+		dvr.mux.Lock()
+		writes, removes := dvr.writes, dvr.removes
+		dvr.writes, dvr.removes = nil, nil
+		dvr.mux.Unlock()
+		for _, segment := range writes {
+			dvr.write(segment)
+		}
+		//写入在前,窗口外的段一定已经写入
+		for _, idx := range removes {
+			os.Remove(dvr.fileName(idx))
+		}
+	}
+	os.RemoveAll(dvr.dir)
+}
+
+//write segment data is dropped from memory once written,kept if writing failed
+func (dvr *dvrCache) write(segment *hlsTsData) {
+	utils.CreateDirectory(dvr.dir)
+	fp, err := os.Create(dvr.fileName(segment.idx))
+	if err == nil {
+		_, err = fp.Write(segment.buf)
+		fp.Close()
+	}
+	if err != nil {
+		logger.LOGE(err.Error())
+		os.Remove(dvr.fileName(segment.idx))
+		return
+	}
+	dvr.mux.Lock()
+	segment.buf = nil
+	dvr.mux.Unlock()
+}
+
+//copyTo segments before idx are pushed to segments
+func (dvr *dvrCache) copyTo(segments *list.List, idx int) {
+	dvr.mux.RLock()
+	defer dvr.mux.RUnlock()
+	for e := dvr.segments.Front(); e != nil; e = e.Next() {
+		if e.Value.(*hlsTsData).idx < idx {
+			segments.PushBack(e.Value)
+		}
+	}
+}
+
+//read file is read without lock,spill does not wait for readers
+func (dvr *dvrCache) read(idx int) (data []byte, err error) {
+	found := false
+	dvr.mux.RLock()
+	for e := dvr.segments.Front(); e != nil; e = e.Next() {
+		segment := e.Value.(*hlsTsData)
+		if segment.idx == idx {
+			found = true
+			data = segment.buf
+			break
+		}
+	}
+	dvr.mux.RUnlock()
+	if false == found {
+		return nil, errors.New("segment " + strconv.Itoa(idx) + " not in dvr window")
+	}
+	if data != nil {
+		return
+	}
+	return utils.ReadFileAll(dvr.fileName(idx))
+}
+
+//close stop the writer and remove all the files
+func (dvr *dvrCache) close() {
+	dvr.mux.Lock()
+	if dvr.closed {
+		dvr.mux.Unlock()
+		return
+	}
+	dvr.closed = true
+	dvr.segments = list.New()
+	dvr.durationMs = 0
+	dvr.writes, dvr.removes = nil, nil
+	close(dvr.chWake)
+	dvr.mux.Unlock()
+	<-dvr.chDone
+}
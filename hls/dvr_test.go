@@ -0,0 +1,56 @@
+package hls
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDVRPlaylist(t *testing.T) {
+	dir := t.TempDir() + "/live/foo"
+	dvr := newDVRCache(dir, ".ts", 25000)
+	for idx := 0; idx < 4; idx++ {
+		dvr.spill(&hlsTsData{buf: []byte{byte(idx)}, durationMs: 10000, idx: idx})
+	}
+	//窗口25秒,只留下最后两段
+	if _, err := dvr.read(1); err == nil {
+		t.Fatal("segment out of window served")
+	}
+	if data, err := dvr.read(3); err != nil || len(data) != 1 || data[0] != 3 {
+		t.Fatalf("segment 3 %v %v", data, err)
+	}
+	//文件由写线程异步写入和删除
+	for i := 0; ; i++ {
+		_, errRemoved := os.Stat(dvr.fileName(1))
+		data, errWritten := ioutil.ReadFile(dvr.fileName(3))
+		if os.IsNotExist(errRemoved) && errWritten == nil && len(data) == 1 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("dvr files not written or removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if data, err := dvr.read(3); err != nil || len(data) != 1 || data[0] != 3 {
+		t.Fatalf("segment 3 from disk %v %v", data, err)
+	}
+
+	source := &HLSSource{app: HLSAppConfig{CacheLength: 2, PlaylistType: PlaylistEvent}, dvr: dvr, tsCache: list.New()}
+	//3 已经写入磁盘但还在内存中
+	for idx := 3; idx < 6; idx++ {
+		source.tsCache.PushBack(&hlsTsData{durationMs: 10000, idx: idx})
+	}
+	strOut := source.createVideoM3U8(source.copySegments(), "")
+	if false == strings.Contains(strOut, "#EXT-X-PLAYLIST-TYPE:EVENT\n") || false == strings.Contains(strOut, "#EXT-X-MEDIA-SEQUENCE:2\n") ||
+		strings.Count(strOut, "#EXTINF") != 4 {
+		t.Fatal(strOut)
+	}
+
+	dvr.close()
+	if _, err := os.Stat(dir); false == os.IsNotExist(err) {
+		t.Fatal("dvr dir not removed")
+	}
+}
@@ -0,0 +1,461 @@
+package hls
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/mediatype/mp4"
+)
+
+//low latency hls,fmp4 parts are served by ll.m3u8 beside the ts playlist
+const (
+	LLPlaylist = "ll.m3u8"
+	llInitName = "init.mp4"
+	llPartPref = "p"
+	llSegPref  = "s"
+	llExt      = ".m4s"
+)
+
+const (
+	defaultPartTargetMs   = 333
+	defaultLLSegmentMs    = 2000
+	defaultLLSegmentCount = 6
+	llPartListSegments    = 2 //parts are listed for the last complete segments only
+)
+
+type llPart struct {
+	data        []byte
+	durationMs  uint32
+	independent bool
+}
+
+type llSegment struct {
+	msn        int
+	parts      []*llPart
+	durationMs uint32
+}
+
+func (seg *llSegment) data() (buf []byte) {
+	for _, part := range seg.parts {
+		buf = append(buf, part.data...)
+	}
+	return
+}
+
+//llStream 把flv tag 切成fmp4 part,段在关键帧处切分,part 按PartTargetMs 切分
+type llStream struct {
+	partTargetMs uint32
+	segmentMs    uint32
+	segmentCount int
+
+	//only touched by the streamer goroutine
+	creater         *mp4.FMP4Creater
+	audioHeader     *flv.FlvTag
+	videoHeader     *flv.FlvTag
+	started         bool
+	partBuf         []byte
+	partBegin       uint32
+	partIndependent bool
+	segBegin        uint32
+	lastMaster      uint32
+	overTarget      bool
+
+	mux      sync.RWMutex
+	initData []byte
+	segments *list.List
+	cur      *llSegment
+
+	waitsChannel *list.List
+	muxWaits     sync.Mutex
+	closed       bool
+}
+
+func newLLStream() *llStream {
+	cfg := config()
+	return &llStream{
+		partTargetMs: uint32(cfg.PartTargetMs),
+		segmentMs:    uint32(cfg.LLSegmentMs),
+		segmentCount: cfg.LLSegmentCount,
+		segments:     list.New(),
+		waitsChannel: list.New(),
+	}
+}
+
+//elapsed time from begin to ts,zero if timestamp goes back
+func elapsed(ts, begin uint32) uint32 {
+	if ts < begin {
+		return 0
+	}
+	return ts - begin
+}
+
+func (ll *llStream) addTag(tag *flv.FlvTag) {
+	if tag.TagType != flv.FlvTagAudio && tag.TagType != flv.FlvTagVideo {
+		return
+	}
+	if len(tag.Data) < 2 {
+		return
+	}
+	if flv.IsVideoSequenceHeader(tag) || flv.IsAudioSequenceHeader(tag) {
+		//codec change is not supported after start
+		if ll.started {
+			return
+		}
+		if tag.TagType == flv.FlvTagAudio {
+			ll.audioHeader = tag.Copy()
+		} else {
+			ll.videoHeader = tag.Copy()
+		}
+		return
+	}
+	isKey := flv.IsKeyFrame(tag)
+	master := tag.TagType == flv.FlvTagVideo || ll.videoHeader == nil
+	if false == ll.started {
+		if false == master || (ll.videoHeader != nil && false == isKey) {
+			return
+		}
+		if false == ll.start(tag.Timestamp) {
+			return
+		}
+	} else if master {
+		ll.cut(tag.Timestamp, isKey)
+	}
+	slice := ll.creater.AddFlvTag(tag)
+	if slice != nil && slice.Idx >= 0 {
+		ll.partBuf = append(ll.partBuf, slice.Data...)
+	}
+}
+
+func (ll *llStream) start(ts uint32) bool {
+	ll.creater = &mp4.FMP4Creater{}
+	var videoInit, audioInit []byte
+	if ll.videoHeader != nil {
+		if slice := ll.creater.AddFlvTag(ll.videoHeader); slice != nil {
+			videoInit = slice.Data
+		}
+	}
+	if ll.audioHeader != nil {
+		if slice := ll.creater.AddFlvTag(ll.audioHeader); slice != nil {
+			audioInit = slice.Data
+		}
+	}
+	initData, err := mp4.MergeInitSegments(videoInit, audioInit)
+	if err != nil || len(initData) == 0 {
+		logger.LOGE("create ll-hls init segment failed")
+		ll.creater = nil
+		return false
+	}
+	ll.mux.Lock()
+	ll.initData = initData
+	ll.cur = &llSegment{msn: 0}
+	ll.mux.Unlock()
+	ll.started = true
+	ll.partBegin = ts
+	ll.segBegin = ts
+	ll.lastMaster = ts
+	ll.partIndependent = true
+	ll.notify()
+	return true
+}
+
+//cut close the current part before the master track tag at ts when it would pass the part target
+func (ll *llStream) cut(ts uint32, isKey bool) {
+	partDuration := elapsed(ts, ll.partBegin)
+	frameDuration := elapsed(ts, ll.lastMaster)
+	ll.lastMaster = ts
+	if partDuration == 0 {
+		return
+	}
+	newSegment := elapsed(ts, ll.segBegin) >= ll.segmentMs && (isKey || ll.videoHeader == nil)
+	if newSegment || partDuration+frameDuration > ll.partTargetMs {
+		ll.finishPart(ts, newSegment)
+		ll.partIndependent = isKey || ll.videoHeader == nil
+	}
+}
+
+func (ll *llStream) finishPart(ts uint32, endSegment bool) {
+	part := &llPart{
+		data:        ll.partBuf,
+		durationMs:  elapsed(ts, ll.partBegin),
+		independent: ll.partIndependent}
+	ll.partBuf = nil
+	ll.partBegin = ts
+
+	ll.mux.Lock()
+	ll.cur.parts = append(ll.cur.parts, part)
+	ll.cur.durationMs += part.durationMs
+	if endSegment {
+		if int(ll.cur.durationMs+500)/1000 > ll.targetDuration() && false == ll.overTarget {
+			ll.overTarget = true
+			logger.LOGW("ll-hls segment longer than target duration,keep the gop within LLSegmentMs")
+		}
+		ll.segments.PushBack(ll.cur)
+		for ll.segments.Len() > ll.segmentCount {
+			ll.segments.Remove(ll.segments.Front())
+		}
+		ll.cur = &llSegment{msn: ll.cur.msn + 1}
+		ll.segBegin = ts
+	}
+	ll.mux.Unlock()
+	ll.notify()
+}
+
+//notify wake up all blocking requests
+func (ll *llStream) notify() {
+	ll.muxWaits.Lock()
+	defer ll.muxWaits.Unlock()
+	if ll.waitsChannel.Len() > 0 {
+		for e := ll.waitsChannel.Front(); e != nil; e = e.Next() {
+			e.Value.(chan bool) <- true
+		}
+		ll.waitsChannel = list.New()
+	}
+}
+
+func (ll *llStream) close() {
+	ll.muxWaits.Lock()
+	defer ll.muxWaits.Unlock()
+	ll.closed = true
+	for e := ll.waitsChannel.Front(); e != nil; e = e.Next() {
+		close(e.Value.(chan bool))
+	}
+	ll.waitsChannel = list.New()
+}
+
+//wait block until check reports ready,returns the http status for the request
+func (ll *llStream) wait(check func() (ready, tooFar bool)) int {
+	timer := time.NewTimer(time.Duration(3*ll.targetDuration()) * time.Second)
+	defer timer.Stop()
+	for {
+		chWait := make(chan bool, 1)
+		ll.muxWaits.Lock()
+		if ll.closed {
+			ll.muxWaits.Unlock()
+			return http.StatusNotFound
+		}
+		ll.waitsChannel.PushBack(chWait)
+		ll.muxWaits.Unlock()
+
+		ready, tooFar := check()
+		if ready {
+			return http.StatusOK
+		}
+		if tooFar {
+			return http.StatusBadRequest
+		}
+		select {
+		case ret, ok := <-chWait:
+			if false == ok || false == ret {
+				return http.StatusNotFound
+			}
+		case <-timer.C:
+			return http.StatusServiceUnavailable
+		}
+	}
+}
+
+//ready whether the playlist contains part of segment msn,part<0 means the whole segment
+func (ll *llStream) ready(msn, part int) (ready, tooFar bool) {
+	ll.mux.RLock()
+	defer ll.mux.RUnlock()
+	if ll.cur == nil {
+		return false, false
+	}
+	if msn < 0 || msn < ll.cur.msn {
+		return true, false
+	}
+	if msn == ll.cur.msn {
+		return part >= 0 && part < len(ll.cur.parts), false
+	}
+	return false, msn > ll.cur.msn+2
+}
+
+//targetDuration in seconds,fixed by the configured segment duration as it must not change while playing
+func (ll *llStream) targetDuration() int {
+	return int((ll.segmentMs + 999) / 1000)
+}
+
+//serveHTTP handles ll-hls resources,handled is false for other params
+func (ll *llStream) serveHTTP(w http.ResponseWriter, req *http.Request, param, query string) (handled bool, n int) {
+	switch {
+	case param == LLPlaylist:
+		n = ll.servePlaylist(w, req, query)
+	case param == llInitName:
+		ll.mux.RLock()
+		initData := ll.initData
+		ll.mux.RUnlock()
+		if len(initData) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return true, 0
+		}
+		w.Header().Set("Content-Type", "video/mp4")
+		n, _ = w.Write(initData)
+	case strings.HasSuffix(param, llExt) && strings.HasPrefix(param, llPartPref):
+		n = ll.servePart(w, param)
+	case strings.HasSuffix(param, llExt) && strings.HasPrefix(param, llSegPref):
+		n = ll.serveSegment(w, param)
+	default:
+		return false, 0
+	}
+	return true, n
+}
+
+func (ll *llStream) servePlaylist(w http.ResponseWriter, req *http.Request, query string) (n int) {
+	values := req.URL.Query()
+	msn, part := -1, -1
+	var err error
+	if strMsn := values.Get("_HLS_msn"); len(strMsn) > 0 {
+		msn, err = strconv.Atoi(strMsn)
+		if err == nil && len(values.Get("_HLS_part")) > 0 {
+			part, err = strconv.Atoi(values.Get("_HLS_part"))
+		}
+		if err != nil || msn < 0 || part < -1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	} else if len(values.Get("_HLS_part")) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	//without _HLS_msn only wait for the stream start
+	status := ll.wait(func() (bool, bool) { return ll.ready(msn, part) })
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	n, _ = w.Write([]byte(ll.createPlaylist(query)))
+	return
+}
+
+func (ll *llStream) createPlaylist(query string) (strOut string) {
+	ll.mux.RLock()
+	defer ll.mux.RUnlock()
+	sequence := ll.cur.msn
+	if ll.segments.Len() > 0 {
+		sequence = ll.segments.Front().Value.(*llSegment).msn
+	}
+	partTarget := float64(ll.partTargetMs) / 1000.0
+
+	strOut = "#EXTM3U\n"
+	strOut += "#EXT-X-VERSION:9\n"
+	strOut += "#EXT-X-TARGETDURATION:" + strconv.Itoa(ll.targetDuration()) + "\n"
+	strOut += fmt.Sprintf("#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*partTarget)
+	strOut += fmt.Sprintf("#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget)
+	strOut += "#EXT-X-MEDIA-SEQUENCE:" + strconv.Itoa(sequence) + "\n"
+	strOut += "#EXT-X-INDEPENDENT-SEGMENTS\n"
+	strOut += "#EXT-X-MAP:URI=\"" + llInitName + query + "\"\n"
+	idx := 0
+	for e := ll.segments.Front(); e != nil; e = e.Next() {
+		seg := e.Value.(*llSegment)
+		if ll.segments.Len()-idx <= llPartListSegments {
+			strOut += createPartTags(seg, query)
+		}
+		strOut += fmt.Sprintf("#EXTINF:%.3f,\n", float64(seg.durationMs)/1000.0)
+		strOut += llSegPref + strconv.Itoa(seg.msn) + llExt + query + "\n"
+		idx++
+	}
+	strOut += createPartTags(ll.cur, query)
+	strOut += "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"" + partName(ll.cur.msn, len(ll.cur.parts)) + query + "\"\n"
+	return
+}
+
+func createPartTags(seg *llSegment, query string) (strOut string) {
+	for i, part := range seg.parts {
+		strOut += fmt.Sprintf("#EXT-X-PART:DURATION=%.3f,URI=\"%s%s\"", float64(part.durationMs)/1000.0, partName(seg.msn, i), query)
+		if part.independent {
+			strOut += ",INDEPENDENT=YES"
+		}
+		strOut += "\n"
+	}
+	return
+}
+
+func partName(msn, idx int) string {
+	return llPartPref + strconv.Itoa(msn) + "." + strconv.Itoa(idx) + llExt
+}
+
+//findPart returns the part,or hinted when it is the next part to be produced
+func (ll *llStream) findPart(msn, idx int) (part *llPart, hinted bool) {
+	ll.mux.RLock()
+	defer ll.mux.RUnlock()
+	if ll.cur == nil {
+		return nil, false
+	}
+	if msn == ll.cur.msn {
+		if idx < len(ll.cur.parts) {
+			return ll.cur.parts[idx], false
+		}
+		return nil, idx == len(ll.cur.parts)
+	}
+	for e := ll.segments.Front(); e != nil; e = e.Next() {
+		seg := e.Value.(*llSegment)
+		if seg.msn == msn && idx < len(seg.parts) {
+			return seg.parts[idx], false
+		}
+	}
+	return nil, false
+}
+
+func (ll *llStream) servePart(w http.ResponseWriter, param string) (n int) {
+	strIdx := strings.TrimSuffix(strings.TrimPrefix(param, llPartPref), llExt)
+	subs := strings.Split(strIdx, ".")
+	if len(subs) != 2 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	msn, errMsn := strconv.Atoi(subs[0])
+	idx, errIdx := strconv.Atoi(subs[1])
+	if errMsn != nil || errIdx != nil || idx < 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	part, hinted := ll.findPart(msn, idx)
+	if part == nil && hinted {
+		//preload hint,hold the request until the part is complete
+		if status := ll.wait(func() (bool, bool) { return ll.ready(msn, idx) }); status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		part, _ = ll.findPart(msn, idx)
+	}
+	if part == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp4")
+	n, _ = w.Write(part.data)
+	return
+}
+
+func (ll *llStream) serveSegment(w http.ResponseWriter, param string) (n int) {
+	msn, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(param, llSegPref), llExt))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var data []byte
+	ll.mux.RLock()
+	for e := ll.segments.Front(); e != nil; e = e.Next() {
+		if seg := e.Value.(*llSegment); seg.msn == msn {
+			data = seg.data()
+			break
+		}
+	}
+	ll.mux.RUnlock()
+	if data == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp4")
+	n, _ = w.Write(data)
+	return
+}
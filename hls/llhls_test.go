@@ -0,0 +1,151 @@
+package hls
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/mediatype/h264"
+)
+
+//llFeeder video of 25 fps,keyframe every keyMs
+type llFeeder struct {
+	ll    *llStream
+	ts    uint32
+	keyMs uint32
+}
+
+func (feeder *llFeeder) feed(to uint32) {
+	for ; feeder.ts <= to; feeder.ts += 40 {
+		frameType, nal := byte(0x27), byte(0x41)
+		if feeder.ts%feeder.keyMs == 0 {
+			frameType, nal = 0x17, 0x65
+		}
+		data := []byte{frameType, 1, 0, 0, 0, 0, 0, 0, 100, nal}
+		feeder.ll.addTag(&flv.FlvTag{TagType: flv.FlvTagVideo, Timestamp: feeder.ts, Data: append(data, bytes.Repeat([]byte{0x11}, 99)...)})
+	}
+}
+
+func llGet(t *testing.T, url string) (status int, body string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+//llGetAsync the response is sent to the channel
+func llGetAsync(t *testing.T, url string) chan string {
+	ch := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			ch <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		ch <- resp.Status + "\n" + string(data)
+	}()
+	return ch
+}
+
+func TestLLHLS(t *testing.T) {
+	serviceConfig.Store(&HLSConfig{PartTargetMs: 200, LLSegmentMs: 1000, LLSegmentCount: 4})
+	ll := newLLStream()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if handled, _ := ll.serveHTTP(w, req, path.Base(req.URL.Path), ""); false == handled {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	sps := []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xec, 0x04, 0x40, 0x00, 0x00, 0x03, 0x00, 0x40, 0x00, 0x00, 0x0c, 0x23, 0xc6, 0x0c, 0x92}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+
+	//playlist waits for the stream start
+	chStart := llGetAsync(t, server.URL+"/ll.m3u8")
+	ll.addTag(&flv.FlvTag{TagType: flv.FlvTagVideo, Data: append([]byte{0x17, 0, 0, 0, 0}, h264.AVCDecoderConfigurationRecord(sps, pps)...)})
+	feeder := &llFeeder{ll: ll, keyMs: 1000}
+	feeder.feed(2000)
+	if resp := <-chStart; false == strings.HasPrefix(resp, "200") {
+		t.Fatal(resp)
+	}
+
+	//parts are cut by the part target,segments at keyframes after LLSegmentMs
+	_, playlist := llGet(t, server.URL+"/ll.m3u8")
+	for _, line := range []string{"#EXT-X-TARGETDURATION:1\n", "#EXT-X-MEDIA-SEQUENCE:0\n", "#EXT-X-PART-INF:PART-TARGET=0.200\n",
+		"#EXT-X-PART:DURATION=0.200,URI=\"p0.0.m4s\",INDEPENDENT=YES\n#EXT-X-PART:DURATION=0.200,URI=\"p0.1.m4s\"\n",
+		"#EXTINF:1.000,\ns0.m4s\n", "#EXT-X-PART:DURATION=0.200,URI=\"p1.4.m4s\"\n#EXTINF:1.000,\ns1.m4s\n",
+		"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"p2.0.m4s\"\n"} {
+		if false == strings.Contains(playlist, line) {
+			t.Fatalf("%q not in %s", line, playlist)
+		}
+	}
+	if strings.Count(playlist, "#EXT-X-PART:") != 10 {
+		t.Fatal(playlist)
+	}
+	_, segment := llGet(t, server.URL+"/s0.m4s")
+	var parts string
+	for i := 0; i < 5; i++ {
+		_, part := llGet(t, server.URL+"/p0."+string(rune('0'+i))+".m4s")
+		parts += part
+	}
+	if len(segment) == 0 || segment != parts {
+		t.Fatal("segment is not the parts")
+	}
+
+	//blocking reload,msn more than two segments ahead is refused
+	for _, query := range []string{"_HLS_msn=5", "_HLS_part=1", "_HLS_msn=2&_HLS_part=x"} {
+		if status, _ := llGet(t, server.URL+"/ll.m3u8?"+query); status != http.StatusBadRequest {
+			t.Fatal(query, status)
+		}
+	}
+	chReload := llGetAsync(t, server.URL+"/ll.m3u8?_HLS_msn=2&_HLS_part=1")
+	chHint := llGetAsync(t, server.URL+"/p2.0.m4s")
+	select {
+	case resp := <-chReload:
+		t.Fatal("reload not blocked:" + resp)
+	case resp := <-chHint:
+		t.Fatal("preload hint not blocked:" + resp)
+	case <-time.After(100 * time.Millisecond):
+	}
+	feeder.feed(2200)
+	if resp := <-chHint; false == strings.HasPrefix(resp, "200") || len(resp) < 10 {
+		t.Fatal("preload hint part:" + resp)
+	}
+	select {
+	case resp := <-chReload:
+		t.Fatal("reload before part 2.1:" + resp)
+	case <-time.After(50 * time.Millisecond):
+	}
+	feeder.feed(2400)
+	if resp := <-chReload; false == strings.HasPrefix(resp, "200") || false == strings.Contains(resp, "p2.1.m4s") {
+		t.Fatal(resp)
+	}
+	if status, _ := llGet(t, server.URL+"/p9.0.m4s"); status != http.StatusNotFound {
+		t.Fatal("unknown part", status)
+	}
+
+	//a long gop does not change the target duration
+	feeder.keyMs = 3000
+	feeder.feed(6000)
+	_, playlist = llGet(t, server.URL+"/ll.m3u8")
+	if false == strings.Contains(playlist, "#EXT-X-TARGETDURATION:1\n") || false == strings.Contains(playlist, "#EXTINF:3.000,\ns3.m4s") {
+		t.Fatal(playlist)
+	}
+
+	chClosed := llGetAsync(t, server.URL+"/ll.m3u8?_HLS_msn=4")
+	time.Sleep(50 * time.Millisecond)
+	ll.close()
+	if resp := <-chClosed; false == strings.HasPrefix(resp, "404") {
+		t.Fatal(resp)
+	}
+}
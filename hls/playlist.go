@@ -0,0 +1,177 @@
+package hls
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+//拉流时解析的m3u8,只支持不加密的ts和fmp4分片
+
+//mediaSegment one segment of a media playlist
+type mediaSegment struct {
+	seq           int64
+	uri           string
+	duration      float64
+	mapURI        string //fmp4 初始化段,ts 为空
+	discontinuity bool
+}
+
+//mediaPlaylist parsed media playlist
+type mediaPlaylist struct {
+	targetDuration float64
+	segments       []*mediaSegment
+	endList        bool
+}
+
+//variantStream one EXT-X-STREAM-INF of a master playlist
+type variantStream struct {
+	bandwidth int
+	codecs    string
+	uri       string
+}
+
+//parsePlaylist 返回媒体列表或者主列表的码流,uri 按列表地址解析为绝对地址
+func parsePlaylist(data []byte, base *url.URL) (media *mediaPlaylist, variants []*variantStream, err error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 4096), len(data)+1)
+	if false == scanner.Scan() || false == strings.HasPrefix(strings.TrimSpace(scanner.Text()), "#EXTM3U") {
+		return nil, nil, errors.New("invalid m3u8")
+	}
+	media = &mediaPlaylist{}
+	var seq int64
+	var segment *mediaSegment
+	var variant *variantStream
+	mapURI := ""
+	discontinuity := false
+	resolve := func(ref string) (string, error) {
+		u, err := base.Parse(ref)
+		if err != nil {
+			return "", err
+		}
+		return u.String(), nil
+	}
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		if false == strings.HasPrefix(line, "#") {
+			uri, err := resolve(line)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch {
+			case nil != variant:
+				variant.uri = uri
+				variants = append(variants, variant)
+				variant = nil
+			case nil != segment:
+				segment.uri = uri
+				segment.seq = seq
+				segment.mapURI = mapURI
+				segment.discontinuity = discontinuity
+				media.segments = append(media.segments, segment)
+				segment = nil
+				discontinuity = false
+				seq++
+			}
+			continue
+		}
+		tag, value := line, ""
+		if idx := strings.Index(line, ":"); idx > 0 {
+			tag, value = line[:idx], line[idx+1:]
+		}
+		switch tag {
+		case "#EXT-X-STREAM-INF":
+			attrs := parseAttributes(value)
+			variant = &variantStream{codecs: attrs["CODECS"]}
+			variant.bandwidth, _ = strconv.Atoi(attrs["BANDWIDTH"])
+		case "#EXT-X-TARGETDURATION":
+			media.targetDuration, _ = strconv.ParseFloat(value, 64)
+		case "#EXT-X-MEDIA-SEQUENCE":
+			seq, _ = strconv.ParseInt(value, 10, 64)
+		case "#EXTINF":
+			segment = &mediaSegment{}
+			segment.duration, _ = strconv.ParseFloat(strings.Split(value, ",")[0], 64)
+		case "#EXT-X-MAP":
+			attrs := parseAttributes(value)
+			if _, ok := attrs["BYTERANGE"]; ok {
+				return nil, nil, errors.New("hls byte range not supported")
+			}
+			mapURI, err = resolve(attrs["URI"])
+			if err != nil {
+				return nil, nil, err
+			}
+		case "#EXT-X-KEY":
+			if method := parseAttributes(value)["METHOD"]; method != "NONE" {
+				return nil, nil, errors.New("hls encryption not supported:" + method)
+			}
+		case "#EXT-X-BYTERANGE":
+			return nil, nil, errors.New("hls byte range not supported")
+		case "#EXT-X-DISCONTINUITY":
+			discontinuity = true
+		case "#EXT-X-ENDLIST":
+			media.endList = true
+		}
+	}
+	if len(variants) > 0 {
+		return nil, variants, nil
+	}
+	if media.targetDuration <= 0 {
+		return nil, nil, errors.New("m3u8 without target duration")
+	}
+	return media, nil, nil
+}
+
+//parseAttributes KEY=VALUE,KEY="VALUE,with comma"
+func parseAttributes(value string) (attrs map[string]string) {
+	attrs = make(map[string]string)
+	for len(value) > 0 {
+		eq := strings.Index(value, "=")
+		if eq < 0 {
+			return
+		}
+		key := strings.TrimSpace(value[:eq])
+		value = value[eq+1:]
+		end := 0
+		if strings.HasPrefix(value, "\"") {
+			end = strings.Index(value[1:], "\"")
+			if end < 0 {
+				attrs[key] = value[1:]
+				return
+			}
+			attrs[key] = value[1 : end+1]
+			end += 2
+		} else {
+			end = strings.Index(value, ",")
+			if end < 0 {
+				end = len(value)
+			}
+			attrs[key] = value[:end]
+		}
+		value = strings.TrimPrefix(value[end:], ",")
+	}
+	return
+}
+
+//selectVariant 最高码率的 h264/aac 码流,没有标明编码的也可以
+func selectVariant(variants []*variantStream) (selected *variantStream) {
+	for _, variant := range variants {
+		supported := true
+		for _, codec := range strings.Split(variant.codecs, ",") {
+			codec = strings.TrimSpace(codec)
+			if len(codec) > 0 && false == strings.HasPrefix(codec, "avc1") && false == strings.HasPrefix(codec, "avc3") &&
+				false == strings.HasPrefix(codec, "mp4a") {
+				supported = false
+			}
+		}
+		if supported && (nil == selected || variant.bandwidth > selected.bandwidth) {
+			selected = variant
+		}
+	}
+	return
+}
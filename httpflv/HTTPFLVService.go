@@ -0,0 +1,174 @@
+package httpflv
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/use-go/websocket-streamserver/authorizer"
+	"github.com/use-go/websocket-streamserver/httpmux"
+	"github.com/use-go/websocket-streamserver/tlsconf"
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/utils"
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+//http://addr/flv/app/streamName.flv
+
+//HTTPFLVService serve live stream as chunked flv
+type HTTPFLVService struct {
+	mutexSinks sync.Mutex
+	sinks      map[*HTTPFLVSink]bool
+}
+
+//HTTPFLVConfig config
+type HTTPFLVConfig struct {
+	Port  int             `json:"Port"`
+	Route string          `json:"Route"`
+	TLS   *tlsconf.Config `json:"TLS"`
+}
+
+var service *HTTPFLVService
+var serviceConfig HTTPFLVConfig
+
+//Init service from config file
+func (httpflvService *HTTPFLVService) Init(msg *wssapi.Msg) (err error) {
+	defer func() {
+		if nil != err {
+			logger.LOGE(err.Error())
+		}
+	}()
+	if nil == msg || nil == msg.Param1 {
+		err = errors.New("invalid param")
+		return
+	}
+	fileName := msg.Param1.(string)
+	cfg, err := httpflvService.loadConfigFile(fileName)
+	if err != nil {
+		return
+	}
+	serviceConfig = *cfg
+	httpflvService.sinks = make(map[*HTTPFLVSink]bool)
+	service = httpflvService
+
+	strPort := ":" + strconv.Itoa(serviceConfig.Port)
+	httpmux.AddRoute(strPort, serviceConfig.Route, httpflvService.ServeHTTP)
+	err = httpmux.AddTLSRoute(serviceConfig.TLS, serviceConfig.Route, httpflvService.ServeHTTP)
+	if err != nil {
+		logger.LOGE("http flv tls disabled:" + err.Error())
+		err = nil
+	}
+
+	serviceConfig.Route = strings.TrimPrefix(serviceConfig.Route, "/")
+	serviceConfig.Route = strings.TrimSuffix(serviceConfig.Route, "/")
+	return
+}
+
+func (httpflvService *HTTPFLVService) loadConfigFile(fileName string) (cfg *HTTPFLVConfig, err error) {
+	buf, err := utils.ReadFileAll(fileName)
+	if err != nil {
+		return nil, err
+	}
+	cfg = &HTTPFLVConfig{}
+	err = json.Unmarshal(buf, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+//Start the port is served by httpmux
+func (httpflvService *HTTPFLVService) Start(msg *wssapi.Msg) (err error) {
+	return
+}
+
+//Stop end all http flv responses
+func (httpflvService *HTTPFLVService) Stop(msg *wssapi.Msg) (err error) {
+	httpflvService.mutexSinks.Lock()
+	defer httpflvService.mutexSinks.Unlock()
+	for sink := range httpflvService.sinks {
+		sink.close()
+		delete(httpflvService.sinks, sink)
+	}
+	return
+}
+
+//GetType of service
+func (httpflvService *HTTPFLVService) GetType() string {
+	return wssapi.OBJHTTPFLVServer
+}
+
+//HandleTask not implemention
+func (httpflvService *HTTPFLVService) HandleTask(task wssapi.Task) (err error) {
+	return
+}
+
+//ProcessMessage reload config,port route and tls are all bound to httpmux at init,changes are rejected
+func (httpflvService *HTTPFLVService) ProcessMessage(msg *wssapi.Msg) (err error) {
+	switch msg.Type {
+	case wssapi.MsgReloadConfig:
+		var cfg *HTTPFLVConfig
+		cfg, err = httpflvService.loadConfigFile(msg.Param1.(string))
+		if err != nil {
+			return
+		}
+		route := strings.TrimSuffix(strings.TrimPrefix(cfg.Route, "/"), "/")
+		if cfg.Port != serviceConfig.Port || route != serviceConfig.Route || false == cfg.TLS.Equal(serviceConfig.TLS) {
+			logger.LOGW("http flv config change need restart,the running config is kept")
+		}
+	}
+	return
+}
+
+//ServeHTTP one request one sink
+func (httpflvService *HTTPFLVService) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	streamName, err := httpflvService.parseURL(req.URL.Path)
+	if err != nil {
+		logger.LOGE(err.Error())
+		w.WriteHeader(404)
+		return
+	}
+	errAuth := authorizer.CheckHTTP(authorizer.ProtocolHTTPFLV, streamName, req)
+	if errAuth != nil {
+		w.WriteHeader(authorizer.StatusCode(errAuth))
+		return
+	}
+	sink := &HTTPFLVSink{}
+	err = sink.Init(&wssapi.Msg{Param1: streamName})
+	if err != nil {
+		logger.LOGE(err.Error())
+		w.WriteHeader(404)
+		return
+	}
+	httpflvService.mutexSinks.Lock()
+	httpflvService.sinks[sink] = true
+	httpflvService.mutexSinks.Unlock()
+	defer func() {
+		httpflvService.mutexSinks.Lock()
+		delete(httpflvService.sinks, sink)
+		httpflvService.mutexSinks.Unlock()
+		sink.Stop(nil)
+	}()
+	sink.serve(w, req)
+}
+
+//parseURL /flv/app/streamName.flv -> app/streamName
+func (httpflvService *HTTPFLVService) parseURL(path string) (streamName string, err error) {
+	path = strings.TrimPrefix(path, "/")
+	if false == strings.HasPrefix(path, serviceConfig.Route+"/") {
+		return "", errors.New("invalid http flv path:" + path)
+	}
+	path = strings.TrimPrefix(path, serviceConfig.Route+"/")
+	if false == strings.HasSuffix(path, ".flv") {
+		return "", errors.New("not a flv request:" + path)
+	}
+	streamName = strings.TrimSuffix(path, ".flv")
+	subs := strings.Split(streamName, "/")
+	if len(subs) < 2 || len(subs[0]) == 0 || len(subs[len(subs)-1]) == 0 {
+		return "", errors.New("invalid http flv stream name:" + streamName)
+	}
+	return
+}
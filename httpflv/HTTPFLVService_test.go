@@ -0,0 +1,149 @@
+package httpflv
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/use-go/websocket-streamserver/events/eStreamerEvent"
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+//sourceBus answer add sink like a live source:the cached headers and the last keyframe,
+//then the live tags,the source keeps playing
+type sourceBus struct {
+	tags []*flv.FlvTag
+}
+
+func (bus *sourceBus) Init(msg *wssapi.Msg) error           { return nil }
+func (bus *sourceBus) Start(msg *wssapi.Msg) error          { return nil }
+func (bus *sourceBus) Stop(msg *wssapi.Msg) error           { return nil }
+func (bus *sourceBus) GetType() string                      { return "sourceBus" }
+func (bus *sourceBus) ProcessMessage(msg *wssapi.Msg) error { return nil }
+
+func (bus *sourceBus) HandleTask(task wssapi.Task) error {
+	eve, ok := task.(*eStreamerEvent.EveAddSink)
+	if false == ok {
+		return nil
+	}
+	sink := eve.Sinker
+	if eve.StreamName != "live/hks" {
+		sink.ProcessMessage(&wssapi.Msg{Type: wssapi.MsgGetSourceFailed})
+		return nil
+	}
+	if keyFrameSinker, ok := sink.(interface{ NeedLastKeyFrame() bool }); false == ok || false == keyFrameSinker.NeedLastKeyFrame() {
+		sink.ProcessMessage(&wssapi.Msg{Type: wssapi.MsgGetSourceFailed})
+		return nil
+	}
+	sink.ProcessMessage(&wssapi.Msg{Type: wssapi.MsgGetSourceNotify})
+	sink.ProcessMessage(&wssapi.Msg{Type: wssapi.MsgPlayStart})
+	for _, tag := range bus.tags {
+		sink.ProcessMessage(&wssapi.Msg{Type: wssapi.MsgFlvTag, Param1: tag})
+	}
+	return nil
+}
+
+//readTags tags of a flv body
+func readTags(t *testing.T, data []byte) (tags []*flv.FlvTag) {
+	if len(data) < 13 || false == bytes.Equal(data[:3], []byte("FLV")) {
+		t.Fatalf("flv header %v", data)
+	}
+	data = data[13:]
+	for len(data) >= 15 {
+		size := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+		tag := &flv.FlvTag{TagType: data[0],
+			Timestamp: uint32(data[7])<<24 | uint32(data[4])<<16 | uint32(data[5])<<8 | uint32(data[6])}
+		tag.Data = data[11 : 11+size]
+		tags = append(tags, tag)
+		data = data[11+size+4:]
+	}
+	return
+}
+
+var bus = &sourceBus{tags: []*flv.FlvTag{
+	{TagType: flv.FlvTagScriptData, Timestamp: 0, Data: []byte{2, 0, 10}},
+	{TagType: flv.FlvTagAudio, Timestamp: 0, Data: []byte{0xaf, 0, 0x12, 0x10}},
+	{TagType: flv.FlvTagVideo, Timestamp: 0, Data: []byte{0x17, 0, 0, 0, 0, 1, 0x42}},
+	//the last keyframe cached by the source
+	{TagType: flv.FlvTagVideo, Timestamp: 5000, Data: []byte{0x17, 1, 0, 0, 0, 0xaa}},
+	{TagType: flv.FlvTagAudio, Timestamp: 5010, Data: []byte{0xaf, 1, 0xbb}},
+	{TagType: flv.FlvTagVideo, Timestamp: 5040, Data: []byte{0x27, 1, 0, 0, 0, 0xcc}}}}
+
+var setBus sync.Once
+
+func TestServeHeadersAndLastKeyFrameFirst(t *testing.T) {
+	serviceConfig.Route = "flv"
+	service := &HTTPFLVService{sinks: make(map[*HTTPFLVSink]bool)}
+	//the sink removes itself from the bus in a goroutine,the bus is set once and kept
+	setBus.Do(func() { wssapi.SetHandler(bus) })
+
+	server := httptest.NewServer(service)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/flv/live/hks.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the response never ends,read what the tags take
+	size := 13
+	for _, tag := range bus.tags {
+		size += 15 + len(tag.Data)
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(resp.Body, data)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "video/x-flv" {
+		t.Fatalf("status %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	tags := readTags(t, data)
+	want := []struct {
+		tagType   uint8
+		timestamp uint32
+		first     byte
+	}{
+		{flv.FlvTagScriptData, 0, 2},
+		{flv.FlvTagAudio, 0, 0xaf},
+		{flv.FlvTagVideo, 0, 0x17},
+		{flv.FlvTagVideo, 0, 0x17},
+		{flv.FlvTagAudio, 10, 0xaf},
+		{flv.FlvTagVideo, 40, 0x27}}
+	if len(tags) != len(want) {
+		t.Fatalf("tags %d", len(tags))
+	}
+	for i, tag := range tags {
+		if tag.TagType != want[i].tagType || tag.Timestamp != want[i].timestamp || tag.Data[0] != want[i].first {
+			t.Fatalf("tag %d:%d %d %x", i, tag.TagType, tag.Timestamp, tag.Data)
+		}
+	}
+	if false == flv.IsVideoSequenceHeader(tags[2]) || false == flv.IsKeyFrame(tags[3]) || flv.IsVideoSequenceHeader(tags[3]) {
+		t.Fatal("video header should be followed by the last keyframe")
+	}
+
+	resp, err = http.Get(server.URL + "/flv/live/none.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("missing source %d", resp.StatusCode)
+	}
+}
+
+func TestSkipUntilKeyFrame(t *testing.T) {
+	sink := &HTTPFLVSink{}
+	if nil != sink.tagData(&flv.FlvTag{TagType: flv.FlvTagVideo, Timestamp: 100, Data: []byte{0x27, 1, 0, 0, 0}}) {
+		t.Fatal("inter frame before keyframe sent")
+	}
+	if data := sink.tagData(&flv.FlvTag{TagType: flv.FlvTagVideo, Timestamp: 200, Data: []byte{0x17, 1, 0, 0, 0}}); nil == data {
+		t.Fatal("keyframe not sent")
+	}
+	if data := sink.tagData(&flv.FlvTag{TagType: flv.FlvTagVideo, Timestamp: 240, Data: []byte{0x27, 1, 0, 0, 0}}); nil == data || data[6] != 40 {
+		t.Fatalf("inter frame after keyframe %v", data)
+	}
+}
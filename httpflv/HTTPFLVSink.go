@@ -0,0 +1,238 @@
+package httpflv
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/events/eStreamerEvent"
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/metrics"
+	"github.com/use-go/websocket-streamserver/utils"
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+const (
+	tagCacheSize   = 1024
+	waitSourceTime = time.Minute
+)
+
+//HTTPFLVSink one http client
+type HTTPFLVSink struct {
+	streamName  string
+	clientID    string
+	sinkAdded   bool
+	chSource    chan bool
+	chTags      chan *flv.FlvTag
+	chQuit      chan bool
+	mutexQuit   sync.Mutex
+	quit        bool
+	beginTime   uint32
+	beginSet    bool
+	keyFrameGot bool
+	stats       *metrics.SinkStats
+}
+
+//Init add self to streamer as sink
+func (sink *HTTPFLVSink) Init(msg *wssapi.Msg) (err error) {
+	var ok bool
+	sink.streamName, ok = msg.Param1.(string)
+	if false == ok {
+		return errors.New("invalid param init http flv sink")
+	}
+	sink.clientID = utils.GenerateGUID()
+	sink.chSource = make(chan bool, 1)
+	sink.chTags = make(chan *flv.FlvTag, tagCacheSize)
+	sink.chQuit = make(chan bool)
+
+	taskAddSink := &eStreamerEvent.EveAddSink{
+		StreamName: sink.streamName,
+		SinkId:     sink.clientID,
+		Sinker:     sink}
+	sink.stats = metrics.AddSink(metrics.ProtocolHTTPFLV, sink.streamName, sink.clientID)
+	err = wssapi.HandleTask(taskAddSink)
+	if err != nil {
+		metrics.DelSink(sink.stats)
+		return
+	}
+	sink.sinkAdded = true
+	return
+}
+
+//Start nothing to do
+func (sink *HTTPFLVSink) Start(msg *wssapi.Msg) (err error) {
+	return
+}
+
+//Stop remove from streamer
+func (sink *HTTPFLVSink) Stop(msg *wssapi.Msg) (err error) {
+	sink.close()
+	metrics.DelSink(sink.stats)
+	if sink.sinkAdded {
+		taskDelSink := &eStreamerEvent.EveDelSink{}
+		taskDelSink.StreamName = sink.streamName
+		taskDelSink.SinkId = sink.clientID
+		go wssapi.HandleTask(taskDelSink)
+		sink.sinkAdded = false
+		logger.LOGT("del http flv sinker:" + sink.clientID)
+	}
+	return
+}
+
+//GetType of sink
+func (sink *HTTPFLVSink) GetType() string {
+	return "HTTPFLVSink"
+}
+
+//HandleTask not implemention
+func (sink *HTTPFLVSink) HandleTask(task wssapi.Task) (err error) {
+	return
+}
+
+//ProcessMessage called by source,must not block
+func (sink *HTTPFLVSink) ProcessMessage(msg *wssapi.Msg) (err error) {
+	switch msg.Type {
+	case wssapi.MsgGetSourceNotify:
+		sink.notifySource(true)
+	case wssapi.MsgGetSourceFailed:
+		sink.notifySource(false)
+	case wssapi.MsgPlayStart:
+	case wssapi.MsgPlayStop:
+		logger.LOGT("http flv source stopped:" + sink.streamName)
+		sink.close()
+	case wssapi.MsgFlvTag:
+		tag, ok := msg.Param1.(*flv.FlvTag)
+		if false == ok {
+			return errors.New("invalid flv tag")
+		}
+		select {
+		case <-sink.chQuit:
+			return errors.New("http flv client closed")
+		case sink.chTags <- tag:
+		default:
+			//客户端太慢,放弃,缓存中的tag也不会再发送
+			sink.stats.AddDropped(len(sink.chTags))
+			return errors.New("http flv client too slow:" + sink.clientID)
+		}
+	default:
+		logger.LOGW(msg.Type + " not processed")
+	}
+	return
+}
+
+//NeedLastKeyFrame http flv 需要立即出画面
+func (sink *HTTPFLVSink) NeedLastKeyFrame() bool {
+	return true
+}
+
+func (sink *HTTPFLVSink) notifySource(ok bool) {
+	select {
+	case sink.chSource <- ok:
+	default:
+	}
+}
+
+func (sink *HTTPFLVSink) close() {
+	sink.mutexQuit.Lock()
+	defer sink.mutexQuit.Unlock()
+	if false == sink.quit {
+		sink.quit = true
+		close(sink.chQuit)
+	}
+}
+
+func (sink *HTTPFLVSink) serve(w http.ResponseWriter, req *http.Request) {
+	select {
+	case ok := <-sink.chSource:
+		if false == ok {
+			logger.LOGE("http flv source not found:" + sink.streamName)
+			w.WriteHeader(404)
+			return
+		}
+	case <-time.After(waitSourceTime):
+		logger.LOGE("http flv wait source timeout:" + sink.streamName)
+		w.WriteHeader(404)
+		return
+	case <-sink.chQuit:
+		w.WriteHeader(404)
+		return
+	case <-req.Context().Done():
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "video/x-flv")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(200)
+	n, err := w.Write(flv.FlvFileHeader(true, true))
+	if err != nil {
+		return
+	}
+	sink.stats.AddBytes(n)
+	logger.LOGT("http flv play start:" + sink.streamName + " " + req.RemoteAddr)
+	for {
+		select {
+		case tag := <-sink.chTags:
+			data := sink.tagData(tag)
+			if nil == data {
+				continue
+			}
+			n, err = w.Write(data)
+			if err != nil {
+				logger.LOGE("http flv write failed:" + err.Error())
+				return
+			}
+			sink.stats.AddBytes(n)
+			if nil != flusher {
+				flusher.Flush()
+			}
+		case <-sink.chQuit:
+			return
+		case <-req.Context().Done():
+			logger.LOGT("http flv client closed:" + req.RemoteAddr)
+			return
+		}
+	}
+}
+
+//tagData 从第一个关键帧开始发送,时间戳从0开始
+func (sink *HTTPFLVSink) tagData(tag *flv.FlvTag) []byte {
+	out := &flv.FlvTag{TagType: tag.TagType, Timestamp: tag.Timestamp, Data: tag.Data}
+	isHeader := false
+	switch tag.TagType {
+	case flv.FlvTagVideo:
+		if len(tag.Data) < 2 {
+			return nil
+		}
+		isHeader = flv.IsVideoSequenceHeader(tag)
+		if false == isHeader && false == sink.keyFrameGot {
+			if false == flv.IsKeyFrame(tag) {
+				return nil
+			}
+			sink.keyFrameGot = true
+		}
+	case flv.FlvTagAudio:
+		if len(tag.Data) < 2 {
+			return nil
+		}
+		isHeader = flv.IsAudioSequenceHeader(tag)
+	case flv.FlvTagScriptData:
+		isHeader = true
+	}
+	if isHeader {
+		out.Timestamp = 0
+		return out.ToBytes()
+	}
+	if false == sink.beginSet {
+		sink.beginSet = true
+		sink.beginTime = tag.Timestamp
+	}
+	if out.Timestamp >= sink.beginTime {
+		out.Timestamp -= sink.beginTime
+	} else {
+		out.Timestamp = 0
+	}
+	return out.ToBytes()
+}
@@ -4,17 +4,29 @@ package httpmux
  mapping of  the addres and route of httpmux
 */
 import (
+	"context"
 	"errors"
 	"net/http"
+	"time"
 
 	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/tlsconf"
 )
 
 //one kind service one catalog Mutex
 var portsServe map[string]*http.ServeMux
 
+//tls port shared by services,certificates of all these services are selected by SNI
+type tlsServe struct {
+	mux   *http.ServeMux
+	store *tlsconf.Store
+}
+
+var tlsPortsServe map[string]*tlsServe
+
 func init() {
 	portsServe = make(map[string]*http.ServeMux)
+	tlsPortsServe = make(map[string]*tlsServe)
 }
 
 // AddRoute To handle different data route for spec path.
@@ -27,6 +39,78 @@ func AddRoute(port, route string, handler func(w http.ResponseWriter, req *http.
 	mux.HandleFunc(route, handler)
 }
 
+// AddTLSRoute serve the route on the tls port of cfg too,nothing to do if tls not enabled
+func AddTLSRoute(cfg *tlsconf.Config, route string, handler func(w http.ResponseWriter, req *http.Request)) (err error) {
+	if false == cfg.Enabled() {
+		return
+	}
+	port := cfg.Addr()
+	serve, exist := tlsPortsServe[port]
+	if false == exist {
+		store, err := tlsconf.NewStore(cfg)
+		if err != nil {
+			return err
+		}
+		serve = &tlsServe{mux: http.NewServeMux(), store: store}
+		tlsPortsServe[port] = serve
+	} else {
+		err = serve.store.Add(cfg)
+		if err != nil {
+			return
+		}
+	}
+	serve.mux.HandleFunc(route, handler)
+	return
+}
+
+//servers listening since Start,shut down by Stop
+var servers []*http.Server
+
+//shutdownTimeout requests in flight are waited for at most this long
+const shutdownTimeout = 5 * time.Second
+
+// Start listen on every port added by AddRoute and AddTLSRoute,the ports are shared
+// by the http based services so none of them owns the listeners,call it after all services init
+func Start() {
+	for port, mux := range portsServe {
+		server := &http.Server{Addr: port, Handler: mux}
+		go func(server *http.Server) {
+			for {
+				err := server.ListenAndServe()
+				if err == http.ErrServerClosed {
+					return
+				}
+				logger.LOGE("http serve " + server.Addr + " failed:" + err.Error())
+				time.Sleep(time.Second)
+			}
+		}(server)
+		servers = append(servers, server)
+	}
+	for port, serve := range tlsPortsServe {
+		server := &http.Server{Addr: port, Handler: serve.mux, TLSConfig: serve.store.TLSConfig()}
+		go func(server *http.Server) {
+			err := server.ListenAndServeTLS("", "")
+			if err != nil && err != http.ErrServerClosed {
+				logger.LOGE("https serve " + server.Addr + " failed:" + err.Error())
+			}
+		}(server)
+		servers = append(servers, server)
+	}
+}
+
+// Stop shut down the listeners of Start,hijacked connections such as websocket are left to their services
+func Stop() {
+	for _, server := range servers {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		err := server.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			logger.LOGW("http server " + server.Addr + " shutdown:" + err.Error())
+		}
+	}
+	servers = nil
+}
+
 // GetPortServe retrive the *http.ServeMux for the spec port
 func GetPortServe(port string) (serveMux *http.ServeMux, err error) {
 
@@ -42,19 +126,3 @@ func GetPortServe(port string) (serveMux *http.ServeMux, err error) {
 
 	return nil, errors.New("serveMux Not Found")
 }
-
-// // Start differnt http Service binded to ports
-// func Start() {
-// 	//for dash.js test
-// 	//portsServe[":8080"].Handle("/dash_js/", http.StripPrefix("/dash_js/", http.FileServer(http.Dir("../test-websocket/"))))
-// 	//for websocket-media-stream.ts test
-// 	//portsServe[":8080"].Handle("/player/", http.StripPrefix("/player/", http.FileServer(http.Dir("../test-websocket/"))))
-// 	for k, v := range portsServe {
-// 		go func(addr string, handler http.Handler) {
-// 			err := http.ListenAndServe(addr, handler)
-// 			if err != nil {
-// 				logger.LOGE(err.Error())
-// 			}
-// 		}(k, v)
-// 	}
-// }
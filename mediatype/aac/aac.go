@@ -1,6 +1,9 @@
 package aac
 
-import "bytes"
+import (
+	"bytes"
+	"errors"
+)
 
 const (
 	AAC_Main      = 1
@@ -96,6 +99,28 @@ func GenerateADTHeader(asc AudioSpecificConfig, length int) (data []byte) {
 	return
 }
 
+//ParseADTSHeader ADT头转为2字节的asc,frameSize包含头
+func ParseADTSHeader(data []byte) (asc []byte, sampleRate, headerSize, frameSize int, err error) {
+	if len(data) < 7 || data[0] != 0xff || data[1]&0xf0 != 0xf0 {
+		return nil, 0, 0, 0, errors.New("invalid adts header")
+	}
+	objectType := int(data[2]>>6) + 1
+	freqIdx := int(data[2]>>2) & 0xf
+	channels := int(data[2]&1)<<2 | int(data[3]>>6)
+	headerSize = 7
+	if data[1]&1 == 0 {
+		//crc
+		headerSize = 9
+	}
+	frameSize = int(data[3]&3)<<11 | int(data[4])<<3 | int(data[5]>>5)
+	if freqIdx > 12 || frameSize < headerSize {
+		return nil, 0, 0, 0, errors.New("invalid adts header")
+	}
+	sampleRate = getSampleRatesByIdx(freqIdx)
+	asc = []byte{byte(objectType<<3 | freqIdx>>1), byte((freqIdx&1)<<7 | channels<<3)}
+	return
+}
+
 //create aad file,from flv aac
 type AACCreater struct {
 	writer *bytes.Buffer
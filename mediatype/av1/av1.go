@@ -0,0 +1,149 @@
+package av1
+
+import (
+	"errors"
+
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+//OBU type
+const (
+	OBUSequenceHeader       = 1
+	OBUTemporalDelimiter    = 2
+	OBUFrameHeader          = 3
+	OBUTileGroup            = 4
+	OBUMetadata             = 5
+	OBUFrame                = 6
+	OBURedundantFrameHeader = 7
+	OBUTileList             = 8
+	OBUPadding              = 15
+)
+
+const (
+	av1cHeaderSize = 4
+	parsePadding   = 8
+)
+
+//OBU a low overhead bitstream format obu,Data includes the header
+type OBU struct {
+	Type    int
+	Data    []byte
+	Payload []byte
+}
+
+func readLEB128(data []byte) (value, size int, err error) {
+	for i := 0; i < 8; i++ {
+		if i >= len(data) {
+			return 0, 0, errors.New("leb128 truncated")
+		}
+		value |= int(data[i]&0x7f) << uint(i*7)
+		if data[i]&0x80 == 0 {
+			return value, i + 1, nil
+		}
+	}
+	return 0, 0, errors.New("leb128 too long")
+}
+
+//SplitOBUs split a temporal unit,every obu must have obu_has_size_field set
+func SplitOBUs(data []byte) (obus []*OBU, err error) {
+	for len(data) > 0 {
+		header := data[0]
+		headerSize := 1
+		if header&0x4 != 0 {
+			//obu_extension_flag
+			headerSize++
+		}
+		if header&0x2 == 0 || len(data) < headerSize {
+			return nil, errors.New("obu without size field")
+		}
+		payloadSize, lebSize, err := readLEB128(data[headerSize:])
+		if err != nil {
+			return nil, err
+		}
+		total := headerSize + lebSize + payloadSize
+		if total > len(data) {
+			return nil, errors.New("obu truncated")
+		}
+		obus = append(obus, &OBU{Type: int(header>>3) & 0xf,
+			Data:    data[:total],
+			Payload: data[headerSize+lebSize : total]})
+		data = data[total:]
+	}
+	return
+}
+
+//GetSequenceHeaderFromAV1C sequence header obu in configOBUs of AV1CodecConfigurationRecord
+func GetSequenceHeaderFromAV1C(av1c []byte) (seqHeader *OBU, err error) {
+	if len(av1c) < av1cHeaderSize || av1c[0]&0x7f != 1 {
+		return nil, errors.New("invalid av1C")
+	}
+	obus, err := SplitOBUs(av1c[av1cHeaderSize:])
+	if err != nil {
+		return
+	}
+	for _, obu := range obus {
+		if obu.Type == OBUSequenceHeader {
+			return obu, nil
+		}
+	}
+	return nil, errors.New("av1C without sequence header")
+}
+
+//ParseSequenceHeader get max frame size from sequence header obu payload
+func ParseSequenceHeader(payload []byte) (width, height int) {
+	tmp := make([]byte, len(payload)+parsePadding)
+	copy(tmp, payload)
+	bit := &wssapi.BitReader{}
+	bit.Init(tmp)
+	bit.ReadBits(3) //seq_profile
+	bit.ReadBit()   //still_picture
+	reducedStillPictureHeader := bit.ReadBit()
+	if reducedStillPictureHeader != 0 {
+		bit.ReadBits(5) //seq_level_idx[0]
+	} else {
+		decoderModelInfoPresent := 0
+		bufferDelayLength := 0
+		if bit.ReadBit() != 0 {
+			//timing_info
+			bit.ReadBits(32) //num_units_in_display_tick
+			bit.ReadBits(32) //time_scale
+			if bit.ReadBit() != 0 {
+				//equal_picture_interval,num_ticks_per_picture_minus_1 uvlc
+				leadingZeros := 0
+				for bit.ReadBit() == 0 && leadingZeros < 32 {
+					leadingZeros++
+				}
+				bit.ReadBits(leadingZeros)
+			}
+			decoderModelInfoPresent = bit.ReadBit()
+			if decoderModelInfoPresent != 0 {
+				bufferDelayLength = bit.ReadBits(5) + 1
+				bit.ReadBits(32) //num_units_in_decoding_tick
+				bit.ReadBits(5)  //buffer_removal_time_length_minus_1
+				bit.ReadBits(5)  //frame_presentation_time_length_minus_1
+			}
+		}
+		initialDisplayDelayPresent := bit.ReadBit()
+		operatingPointsCnt := bit.ReadBits(5) + 1
+		for i := 0; i < operatingPointsCnt; i++ {
+			bit.ReadBits(12) //operating_point_idc
+			seqLevelIdx := bit.ReadBits(5)
+			if seqLevelIdx > 7 {
+				bit.ReadBit() //seq_tier
+			}
+			if decoderModelInfoPresent != 0 && bit.ReadBit() != 0 {
+				bit.ReadBits(bufferDelayLength) //decoder_buffer_delay
+				bit.ReadBits(bufferDelayLength) //encoder_buffer_delay
+				bit.ReadBit()                   //low_delay_mode_flag
+			}
+			if initialDisplayDelayPresent != 0 && bit.ReadBit() != 0 {
+				bit.ReadBits(4) //initial_display_delay_minus_1
+			}
+		}
+	}
+	widthBits := bit.ReadBits(4) + 1
+	heightBits := bit.ReadBits(4) + 1
+	width = bit.ReadBits(widthBits) + 1
+	height = bit.ReadBits(heightBits) + 1
+	return
+}
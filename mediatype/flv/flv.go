@@ -1,5 +1,10 @@
 package flv
 
+import (
+	"errors"
+	"fmt"
+)
+
 //Flv data Type
 const (
 	FlvTagAudio      = 8
@@ -18,7 +23,7 @@ const (
 	SoundFormatNellymoser              = 6
 	SoundFormatG711ALawPCM             = 7
 	SoundFormatG711muLawPCM            = 8
-	SoundFormatreserved                = 9
+	SoundFormatExHeader                = 9 //enhanced rtmp,fourcc follows
 	SoundFormatAAC                     = 10
 	SoundFormatSpeex                   = 11
 	SoundFormatMp38KHz                = 14
@@ -69,6 +74,7 @@ const (
 	CodecIDOn2Vp6AlphaChannel = 5
 	CodecIDScreenVideoV2      = 6
 	CodecIDAVC                = 7
+	CodecIDHEVC               = 12 //not in spec,pushed by some encoders with avc layout
 )
 
 //AVC Type
@@ -77,6 +83,27 @@ const (
 	AVCNALU   = 1
 )
 
+//Enhanced RTMP packet type,AVC packet types 0-2 have the same meaning
+const (
+	PacketTypeSequenceStart        = 0
+	PacketTypeCodedFrames          = 1
+	PacketTypeSequenceEnd          = 2
+	PacketTypeCodedFramesX         = 3 //composition time is zero
+	PacketTypeMetadata             = 4
+	PacketTypeMPEG2TSSequenceStart = 5
+)
+
+//Enhanced RTMP FourCC
+const (
+	FourCCAVC  = "avc1"
+	FourCCHEVC = "hvc1"
+	FourCCAV1  = "av01"
+	FourCCVP9  = "vp09"
+	FourCCAAC  = "mp4a"
+	FourCCMP3  = ".mp3"
+	FourCCOpus = "Opus"
+)
+
 type FlvTag struct {
 	TagType   uint8
 	Timestamp uint32
@@ -84,20 +111,154 @@ type FlvTag struct {
 	Data      []byte
 }
 
+//AudioTag parsed audio tag header,Data is the sequence header or the frame
 type AudioTag struct {
+	SoundFormat int
+	FourCC      string //empty for legacy codecs other than aac and mp3
+	PacketType  int
+	Data        []byte
 }
 
+//VideoTag parsed video tag header,Data is the decoder configuration record or the frame
 type VideoTag struct {
+	FrameType       int
+	CodecID         int //0 for enhanced rtmp
+	FourCC          string
+	PacketType      int
+	CompositionTime int32
+	Data            []byte
 }
 
+//GetAudioTag parse legacy and enhanced rtmp audio tag
 func GetAudioTag(flvTag *FlvTag) (result *AudioTag, err error) {
+	if flvTag.TagType != FlvTagAudio || len(flvTag.Data) < 1 {
+		return nil, errors.New("invalid audio tag")
+	}
+	data := flvTag.Data
+	result = &AudioTag{SoundFormat: int(data[0] >> 4), PacketType: PacketTypeCodedFrames}
+	switch result.SoundFormat {
+	case SoundFormatExHeader:
+		result.PacketType = int(data[0] & 0xf)
+		if result.PacketType > PacketTypeSequenceEnd {
+			//multichannel config and multitrack
+			return nil, fmt.Errorf("audio packet type %d not support", result.PacketType)
+		}
+		if len(data) < 5 {
+			return nil, errors.New("invalid audio tag")
+		}
+		result.FourCC = string(data[1:5])
+		result.Data = data[5:]
+	case SoundFormatAAC:
+		if len(data) < 2 {
+			return nil, errors.New("invalid aac tag")
+		}
+		result.FourCC = FourCCAAC
+		result.PacketType = int(data[1])
+		result.Data = data[2:]
+	case SoundFormatMP3, SoundFormatMp38KHz:
+		result.FourCC = FourCCMP3
+		result.Data = data[1:]
+	default:
+		result.Data = data[1:]
+	}
 	return
 }
 
+//GetVideoTag parse legacy and enhanced rtmp video tag
 func GetVideoTag(flvTag *FlvTag) (result *VideoTag, err error) {
+	if flvTag.TagType != FlvTagVideo || len(flvTag.Data) < 1 {
+		return nil, errors.New("invalid video tag")
+	}
+	data := flvTag.Data
+	result = &VideoTag{}
+	if data[0]&0x80 != 0 {
+		result.FrameType = int(data[0]>>4) & 0x7
+		result.PacketType = int(data[0] & 0xf)
+		if result.FrameType == FrameTypevideoInfoCmdFrame && result.PacketType != PacketTypeMetadata {
+			//video command,no codec data
+			return
+		}
+		if result.PacketType > PacketTypeMPEG2TSSequenceStart {
+			//multitrack and modex
+			return nil, fmt.Errorf("video packet type %d not support", result.PacketType)
+		}
+		if len(data) < 5 {
+			return nil, errors.New("invalid video tag")
+		}
+		result.FourCC = string(data[1:5])
+		cur := 5
+		if result.PacketType == PacketTypeCodedFrames && (result.FourCC == FourCCAVC || result.FourCC == FourCCHEVC) {
+			if len(data) < 8 {
+				return nil, errors.New("invalid video tag")
+			}
+			result.CompositionTime = decodeSI24(data[5:8])
+			cur = 8
+		}
+		result.Data = data[cur:]
+		return
+	}
+	result.FrameType = int(data[0] >> 4)
+	result.CodecID = int(data[0] & 0xf)
+	switch result.CodecID {
+	case CodecIDAVC, CodecIDHEVC:
+		if len(data) < 5 {
+			return nil, errors.New("invalid video tag")
+		}
+		result.FourCC = FourCCAVC
+		if result.CodecID == CodecIDHEVC {
+			result.FourCC = FourCCHEVC
+		}
+		result.PacketType = int(data[1])
+		result.CompositionTime = decodeSI24(data[2:5])
+		result.Data = data[5:]
+	default:
+		result.PacketType = PacketTypeCodedFrames
+		result.Data = data[1:]
+	}
 	return
 }
 
+func decodeSI24(data []byte) int32 {
+	value := int32(data[0])<<16 | int32(data[1])<<8 | int32(data[2])
+	if value&0x800000 != 0 {
+		value -= 0x1000000
+	}
+	return value
+}
+
+//IsVideoSequenceHeader tag carries decoder configuration,avcC hvcC or av1C
+func IsVideoSequenceHeader(tag *FlvTag) bool {
+	if tag.TagType != FlvTagVideo {
+		return false
+	}
+	video, err := GetVideoTag(tag)
+	return err == nil && len(video.FourCC) > 0 && video.PacketType == PacketTypeSequenceStart
+}
+
+//IsAudioSequenceHeader aac audio specific config or enhanced audio sequence start
+func IsAudioSequenceHeader(tag *FlvTag) bool {
+	if tag.TagType != FlvTagAudio {
+		return false
+	}
+	audio, err := GetAudioTag(tag)
+	if err != nil || audio.PacketType != PacketTypeSequenceStart {
+		return false
+	}
+	return audio.SoundFormat == SoundFormatAAC || audio.SoundFormat == SoundFormatExHeader
+}
+
+//IsKeyFrame coded key frame,sequence headers are not key frames
+func IsKeyFrame(tag *FlvTag) bool {
+	if tag.TagType != FlvTagVideo {
+		return false
+	}
+	video, err := GetVideoTag(tag)
+	if err != nil || video.FrameType != FrameTypeKeyframe {
+		return false
+	}
+	return video.PacketType == PacketTypeCodedFrames || video.PacketType == PacketTypeCodedFramesX
+}
+
 //Copy Tag Type
 func (flvTag *FlvTag) Copy() (dst *FlvTag) {
 	dst = &FlvTag{}
@@ -1,13 +1,16 @@
 package flv
 
 import (
+	"errors"
+	"io"
 	"os"
 
 	"github.com/use-go/websocket-streamserver/logger"
 )
 
 type FlvFileReader struct {
-	fp *os.File
+	fp     *os.File
+	offset int64
 }
 
 func (flvfileReader *FlvFileReader) Init(name string) error {
@@ -18,13 +21,20 @@ func (flvfileReader *FlvFileReader) Init(name string) error {
 		return err
 	}
 	tmp := make([]byte, 13)
-	_, err = flvfileReader.fp.Read(tmp)
-	return err
+	_, err = io.ReadFull(flvfileReader.fp, tmp)
+	if err != nil {
+		return err
+	}
+	if tmp[0] != 'F' || tmp[1] != 'L' || tmp[2] != 'V' {
+		return errors.New("not a flv file:" + name)
+	}
+	flvfileReader.offset = 13
+	return nil
 }
 
 func (flvfileReader *FlvFileReader) GetNextTag() (tag *FlvTag, err error) {
 	buf := make([]byte, 11)
-	_, err = flvfileReader.fp.Read(buf)
+	_, err = io.ReadFull(flvfileReader.fp, buf)
 	if err != nil {
 		return
 	}
@@ -34,12 +44,31 @@ func (flvfileReader *FlvFileReader) GetNextTag() (tag *FlvTag, err error) {
 	tag.Timestamp = uint32(int(int(buf[7])<<24) | (int(buf[4]) << 16) | (int(buf[5]) << 8) | (int(buf[6])))
 
 	tag.Data = make([]byte, dataSize)
-	_, err = flvfileReader.fp.Read(tag.Data)
+	_, err = io.ReadFull(flvfileReader.fp, tag.Data)
 	if err != nil {
 		return
 	}
 	buf = make([]byte, 4)
-	flvfileReader.fp.Read(buf)
+	_, err = io.ReadFull(flvfileReader.fp, buf)
+	if err != nil {
+		return
+	}
+	flvfileReader.offset += int64(11 + dataSize + 4)
+	return
+}
+
+//Offset of next tag,can be used by SeekTag
+func (flvfileReader *FlvFileReader) Offset() int64 {
+	return flvfileReader.offset
+}
+
+//SeekTag to a tag offset got by Offset
+func (flvfileReader *FlvFileReader) SeekTag(offset int64) (err error) {
+	_, err = flvfileReader.fp.Seek(offset, io.SeekStart)
+	if err != nil {
+		return
+	}
+	flvfileReader.offset = offset
 	return
 }
 
@@ -0,0 +1,37 @@
+package flv
+
+//FlvFileHeader flv文件头,后面跟着第一个previous tag size(0)
+func FlvFileHeader(hasAudio, hasVideo bool) (header []byte) {
+	header = []byte{'F', 'L', 'V', 1, 0, 0, 0, 0, 9, 0, 0, 0, 0}
+	if hasAudio {
+		header[4] |= 0x04
+	}
+	if hasVideo {
+		header[4] |= 0x01
+	}
+	return
+}
+
+//ToBytes tag header + data + previous tag size
+func (flvTag *FlvTag) ToBytes() (data []byte) {
+	dataSize := len(flvTag.Data)
+	data = make([]byte, 11+dataSize+4)
+	data[0] = flvTag.TagType
+	data[1] = byte(dataSize >> 16)
+	data[2] = byte(dataSize >> 8)
+	data[3] = byte(dataSize)
+	data[4] = byte(flvTag.Timestamp >> 16)
+	data[5] = byte(flvTag.Timestamp >> 8)
+	data[6] = byte(flvTag.Timestamp)
+	data[7] = byte(flvTag.Timestamp >> 24)
+	data[8] = byte(flvTag.StreamID >> 16)
+	data[9] = byte(flvTag.StreamID >> 8)
+	data[10] = byte(flvTag.StreamID)
+	copy(data[11:], flvTag.Data)
+	tagSize := 11 + dataSize
+	data[11+dataSize] = byte(tagSize >> 24)
+	data[12+dataSize] = byte(tagSize >> 16)
+	data[13+dataSize] = byte(tagSize >> 8)
+	data[14+dataSize] = byte(tagSize)
+	return
+}
@@ -0,0 +1,66 @@
+package flv
+
+import (
+	"testing"
+)
+
+func TestGetVideoTag(t *testing.T) {
+	//legacy avc keyframe,composition time -1
+	legacy := &FlvTag{TagType: FlvTagVideo, Data: []byte{0x17, 1, 0xff, 0xff, 0xff, 0, 0, 0, 1, 0x65}}
+	video, err := GetVideoTag(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video.FourCC != FourCCAVC || video.CompositionTime != -1 || len(video.Data) != 5 {
+		t.Fatal(video)
+	}
+	if false == IsKeyFrame(legacy) || IsVideoSequenceHeader(legacy) {
+		t.Fatal("legacy keyframe")
+	}
+	//enhanced hevc sequence start
+	header := &FlvTag{TagType: FlvTagVideo, Data: []byte{0x90, 'h', 'v', 'c', '1', 1, 2, 3}}
+	video, err = GetVideoTag(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video.FourCC != FourCCHEVC || video.FrameType != FrameTypeKeyframe || len(video.Data) != 3 {
+		t.Fatal(video)
+	}
+	if false == IsVideoSequenceHeader(header) || IsKeyFrame(header) {
+		t.Fatal("enhanced sequence header")
+	}
+	//enhanced av1 coded frames has no composition time
+	frame := &FlvTag{TagType: FlvTagVideo, Data: []byte{0x91, 'a', 'v', '0', '1', 0x12, 0}}
+	video, err = GetVideoTag(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video.FourCC != FourCCAV1 || video.CompositionTime != 0 || len(video.Data) != 2 {
+		t.Fatal(video)
+	}
+	if false == IsKeyFrame(frame) {
+		t.Fatal("enhanced keyframe")
+	}
+	//multitrack
+	if _, err = GetVideoTag(&FlvTag{TagType: FlvTagVideo, Data: []byte{0x96, 'h', 'v', 'c', '1'}}); err == nil {
+		t.Fatal("multitrack should not be supported")
+	}
+}
+
+func TestGetAudioTag(t *testing.T) {
+	opus := &FlvTag{TagType: FlvTagAudio, Data: []byte{0x90, 'O', 'p', 'u', 's', 'O', 'p', 'u', 's'}}
+	audio, err := GetAudioTag(opus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if audio.FourCC != FourCCOpus || audio.PacketType != PacketTypeSequenceStart || len(audio.Data) != 4 {
+		t.Fatal(audio)
+	}
+	if false == IsAudioSequenceHeader(opus) {
+		t.Fatal("opus sequence header")
+	}
+	mp3 := &FlvTag{TagType: FlvTagAudio, Data: []byte{0x2f, 0xff, 0xfb}}
+	if IsAudioSequenceHeader(mp3) {
+		t.Fatal("mp3 has no sequence header")
+	}
+}
@@ -178,3 +178,42 @@ func GetSpsPpsFromAVC(avc []byte) (sps, pps []byte) {
 	return
 
 }
+
+//AVCDecoderConfigurationRecord one sps one pps,nil if sps too short
+func AVCDecoderConfigurationRecord(sps, pps []byte) (record []byte) {
+	if len(sps) < 4 || len(pps) == 0 {
+		return nil
+	}
+	record = make([]byte, 0, 11+len(sps)+len(pps))
+	record = append(record, 1, sps[1], sps[2], sps[3], 0xff, 0xe1)
+	record = append(record, byte(len(sps)>>8), byte(len(sps)))
+	record = append(record, sps...)
+	record = append(record, 1, byte(len(pps)>>8), byte(len(pps)))
+	record = append(record, pps...)
+	return
+}
+
+//SplitAnnexB nals between 00 00 01 or 00 00 00 01 start codes
+func SplitAnnexB(data []byte) (nals [][]byte) {
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			end := i
+			if end > start && data[end-1] == 0 {
+				end--
+			}
+			if end > start {
+				nals = append(nals, data[start:end])
+			}
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(data) {
+		nals = append(nals, data[start:])
+	}
+	return
+}
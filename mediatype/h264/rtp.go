@@ -0,0 +1,188 @@
+package h264
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+//rfc 6184 aggregation and fragmentation nal types
+const (
+	NalType_stapA = 24
+	NalType_fuA   = 28
+)
+
+//RTPStapA sps pps in one STAP-A payload,nri is the max of the nals
+func RTPStapA(nals ...[]byte) (payload []byte) {
+	nri := byte(0)
+	size := 1
+	for _, nal := range nals {
+		if len(nal) > 0 && nal[0]&0x60 > nri {
+			nri = nal[0] & 0x60
+		}
+		size += 2 + len(nal)
+	}
+	payload = make([]byte, 0, size)
+	payload = append(payload, nri|NalType_stapA)
+	for _, nal := range nals {
+		payload = append(payload, byte(len(nal)>>8), byte(len(nal)))
+		payload = append(payload, nal...)
+	}
+	return
+}
+
+//RTPPayloads single nal unit packet if nal not larger than maxSize,
+//else FU-A packets,nal header is carried by fu indicator and fu header
+func RTPPayloads(nal []byte, maxSize int) (payloads [][]byte) {
+	if len(nal) == 0 {
+		return
+	}
+	if len(nal) <= maxSize {
+		return [][]byte{nal}
+	}
+	fuSize := maxSize - 2 //fu indicator,fu header
+	if fuSize <= 0 {
+		return
+	}
+	indicator := (nal[0] & 0xe0) | NalType_fuA
+	nalType := nal[0] & 0x1f
+	for cur := 1; cur < len(nal); cur += fuSize {
+		header := nalType
+		if cur == 1 {
+			header |= 0x80
+		}
+		end := cur + fuSize
+		if end >= len(nal) {
+			end = len(nal)
+			header |= 0x40
+		}
+		payload := make([]byte, 0, 2+end-cur)
+		payload = append(payload, indicator, header)
+		payload = append(payload, nal[cur:end]...)
+		payloads = append(payloads, payload)
+	}
+	return
+}
+
+//RTPFrame nals of one access unit,sps pps and aud are kept by the depacketizer
+type RTPFrame struct {
+	Timestamp uint32 //rtp time
+	Nals      [][]byte
+	KeyFrame  bool
+}
+
+//AVCC nals with 4 bytes size prefix
+func (frame *RTPFrame) AVCC() []byte {
+	size := 0
+	for _, nal := range frame.Nals {
+		size += 4 + len(nal)
+	}
+	data := make([]byte, 0, size)
+	for _, nal := range frame.Nals {
+		data = append(data, byte(len(nal)>>24), byte(len(nal)>>16), byte(len(nal)>>8), byte(len(nal)))
+		data = append(data, nal...)
+	}
+	return data
+}
+
+//RTPDepacketizer single nal unit,STAP-A and FU-A payloads to frames,
+//a frame ends at the marker bit or when the timestamp changes
+type RTPDepacketizer struct {
+	SPS []byte
+	PPS []byte
+	//ParamsChanged sps or pps changed,the caller resets it after sending a new sequence header
+	ParamsChanged bool
+	nals          [][]byte
+	fuBuf         []byte
+	frameTime     uint32
+}
+
+//AddPayload lost means packets before this one were lost,the unfinished frame is dropped
+func (depacketizer *RTPDepacketizer) AddPayload(payload []byte, timestamp uint32, marker, lost bool) (frames []*RTPFrame) {
+	if lost {
+		depacketizer.nals = nil
+		depacketizer.fuBuf = nil
+	}
+	if len(payload) == 0 {
+		return
+	}
+	//时间戳变化，说明上一帧已结束
+	if len(depacketizer.nals) > 0 && timestamp != depacketizer.frameTime {
+		frames = depacketizer.flush(frames)
+	}
+	depacketizer.frameTime = timestamp
+	nalType := payload[0] & 0x1f
+	switch {
+	case nalType >= 1 && nalType <= 23:
+		depacketizer.addNal(payload)
+	case nalType == NalType_stapA:
+		for cur := 1; cur+2 <= len(payload); {
+			size := int(binary.BigEndian.Uint16(payload[cur:]))
+			cur += 2
+			if size == 0 || cur+size > len(payload) {
+				break
+			}
+			depacketizer.addNal(payload[cur : cur+size])
+			cur += size
+		}
+	case nalType == NalType_fuA:
+		if len(payload) < 2 {
+			return
+		}
+		fuHeader := payload[1]
+		if fuHeader&0x80 != 0 {
+			depacketizer.fuBuf = []byte{(payload[0] & 0xe0) | (fuHeader & 0x1f)}
+		} else if nil == depacketizer.fuBuf {
+			//丢失了开始分片
+			return
+		}
+		depacketizer.fuBuf = append(depacketizer.fuBuf, payload[2:]...)
+		if fuHeader&0x40 != 0 {
+			depacketizer.addNal(depacketizer.fuBuf)
+			depacketizer.fuBuf = nil
+		}
+	default:
+		//STAP-B,MTAP,FU-B not used by rtsp and webrtc
+		return
+	}
+	if marker {
+		frames = depacketizer.flush(frames)
+	}
+	return
+}
+
+func (depacketizer *RTPDepacketizer) addNal(nal []byte) {
+	if len(nal) == 0 {
+		return
+	}
+	switch nal[0] & 0x1f {
+	case NalType_sps:
+		if false == bytes.Equal(nal, depacketizer.SPS) {
+			depacketizer.SPS = append([]byte{}, nal...)
+			depacketizer.ParamsChanged = true
+		}
+		return
+	case NalType_pps:
+		if false == bytes.Equal(nal, depacketizer.PPS) {
+			depacketizer.PPS = append([]byte{}, nal...)
+			depacketizer.ParamsChanged = true
+		}
+		return
+	case NalType_aud:
+		return
+	}
+	depacketizer.nals = append(depacketizer.nals, append([]byte{}, nal...))
+}
+
+func (depacketizer *RTPDepacketizer) flush(frames []*RTPFrame) []*RTPFrame {
+	if len(depacketizer.nals) == 0 {
+		return frames
+	}
+	frame := &RTPFrame{Timestamp: depacketizer.frameTime, Nals: depacketizer.nals}
+	depacketizer.nals = nil
+	for _, nal := range frame.Nals {
+		if nal[0]&0x1f == NalType_idr {
+			frame.KeyFrame = true
+		}
+	}
+	return append(frames, frame)
+}
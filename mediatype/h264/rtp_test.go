@@ -0,0 +1,43 @@
+package h264
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRTPDepacketizer(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0xe0, 0x1f, 0xda}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	idr := bytes.Repeat([]byte{0x65}, 3000)
+	slice := []byte{0x41, 1, 2, 3}
+	depacketizer := &RTPDepacketizer{}
+	if len(depacketizer.AddPayload(RTPStapA(sps, pps), 0, false, false)) != 0 {
+		t.Fatal("frame from sps pps")
+	}
+	if false == depacketizer.ParamsChanged || false == bytes.Equal(depacketizer.SPS, sps) || false == bytes.Equal(depacketizer.PPS, pps) {
+		t.Fatal("sps pps not kept")
+	}
+	var frames []*RTPFrame
+	payloads := RTPPayloads(idr, 1000)
+	for i, payload := range payloads {
+		frames = append(frames, depacketizer.AddPayload(payload, 0, i == len(payloads)-1, false)...)
+	}
+	//no marker,the frame ends when the timestamp changes
+	frames = append(frames, depacketizer.AddPayload(slice, 3000, false, false)...)
+	frames = append(frames, depacketizer.AddPayload([]byte{0x09, 0xf0}, 6000, true, false)...)
+	if len(frames) != 2 || false == frames[0].KeyFrame || frames[1].KeyFrame || frames[1].Timestamp != 3000 {
+		t.Fatalf("frames %+v", frames)
+	}
+	avcc := frames[0].AVCC()
+	if len(avcc) != 4+len(idr) || avcc[2] != byte(len(idr)>>8) || false == bytes.Equal(avcc[4:], idr) {
+		t.Fatal("keyframe not reassembled")
+	}
+
+	//fragment lost,the frame is dropped
+	frames = depacketizer.AddPayload(payloads[0], 9000, false, false)
+	frames = append(frames, depacketizer.AddPayload(payloads[2], 9000, false, true)...)
+	frames = append(frames, depacketizer.AddPayload(payloads[3], 9000, true, false)...)
+	if len(frames) != 0 {
+		t.Fatalf("broken frame %+v", frames)
+	}
+}
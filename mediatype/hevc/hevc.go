@@ -0,0 +1,160 @@
+package hevc
+
+import (
+	"errors"
+
+	"github.com/use-go/websocket-streamserver/mediatype/h264"
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+//NAL unit type,H.265 table 7-1
+const (
+	NalTypeTrailN    = 0
+	NalTypeTrailR    = 1
+	NalTypeBlaWLP    = 16
+	NalTypeBlaWRADL  = 17
+	NalTypeBlaNLP    = 18
+	NalTypeIdrWRADL  = 19
+	NalTypeIdrNLP    = 20
+	NalTypeCraNut    = 21
+	NalTypeIrapVCL23 = 23
+	NalTypeVPS       = 32
+	NalTypeSPS       = 33
+	NalTypePPS       = 34
+	NalTypeAUD       = 35
+	NalTypeEOS       = 36
+	NalTypeEOB       = 37
+	NalTypeFD        = 38
+	NalTypeSEIPrefix = 39
+	NalTypeSEISuffix = 40
+	NalTypeRTPAP     = 48 //rfc 7798 aggregation packet
+	NalTypeRTPFU     = 49 //rfc 7798 fragmentation unit
+	NalTypeRTPPACI   = 50
+)
+
+const (
+	nalHeaderSize        = 2
+	hvccHeaderSize       = 23
+	spsParsePadding      = 8
+	maxSubLayersInSPS    = 8
+	profileTierLevelBits = 88 //general profile space to general_inbld_flag
+)
+
+//NalType type of nal with two bytes header
+func NalType(nal []byte) int {
+	if len(nal) < 1 {
+		return -1
+	}
+	return int(nal[0]>>1) & 0x3f
+}
+
+//IsIRAP BLA,IDR and CRA pictures are random access points
+func IsIRAP(nalType int) bool {
+	return nalType >= NalTypeBlaWLP && nalType <= NalTypeIrapVCL23
+}
+
+//GetVpsSpsPpsFromHVCC parse HEVCDecoderConfigurationRecord,all parameter sets are returned
+func GetVpsSpsPpsFromHVCC(hvcc []byte) (vps, sps, pps [][]byte, err error) {
+	if len(hvcc) < hvccHeaderSize {
+		return nil, nil, nil, errors.New("hvcC too short")
+	}
+	numOfArrays := int(hvcc[22])
+	cur := hvccHeaderSize
+	for i := 0; i < numOfArrays; i++ {
+		if cur+3 > len(hvcc) {
+			return nil, nil, nil, errors.New("hvcC array truncated")
+		}
+		nalType := int(hvcc[cur] & 0x3f)
+		numNalus := (int(hvcc[cur+1]) << 8) | int(hvcc[cur+2])
+		cur += 3
+		for j := 0; j < numNalus; j++ {
+			if cur+2 > len(hvcc) {
+				return nil, nil, nil, errors.New("hvcC nal truncated")
+			}
+			nalSize := (int(hvcc[cur]) << 8) | int(hvcc[cur+1])
+			cur += 2
+			if cur+nalSize > len(hvcc) {
+				return nil, nil, nil, errors.New("hvcC nal truncated")
+			}
+			nal := make([]byte, nalSize)
+			copy(nal, hvcc[cur:cur+nalSize])
+			cur += nalSize
+			switch nalType {
+			case NalTypeVPS:
+				vps = append(vps, nal)
+			case NalTypeSPS:
+				sps = append(sps, nal)
+			case NalTypePPS:
+				pps = append(pps, nal)
+			}
+		}
+	}
+	if len(sps) == 0 {
+		return nil, nil, nil, errors.New("hvcC without sps")
+	}
+	return
+}
+
+//ParseSPS get the cropped picture size
+func ParseSPS(sps []byte) (width, height int) {
+	if len(sps) <= nalHeaderSize {
+		return
+	}
+	tmpSps := make([]byte, len(sps)-nalHeaderSize, len(sps)-nalHeaderSize+spsParsePadding)
+	copy(tmpSps, sps[nalHeaderSize:])
+	realSPS := h264.EmulationPrevention(tmpSps)
+	//bit reader do not check the end of buffer
+	realSPS = append(realSPS, make([]byte, spsParsePadding)...)
+
+	bit := &wssapi.BitReader{}
+	bit.Init(realSPS)
+	bit.ReadBits(4) //sps_video_parameter_set_id
+	maxSubLayersMinus1 := bit.ReadBits(3)
+	bit.ReadBit() //sps_temporal_id_nesting_flag
+	//profile_tier_level
+	bit.ReadBits(profileTierLevelBits)
+	bit.ReadBits(8) //general_level_idc
+	subLayerProfilePresent := make([]int, maxSubLayersMinus1)
+	subLayerLevelPresent := make([]int, maxSubLayersMinus1)
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		subLayerProfilePresent[i] = bit.ReadBit()
+		subLayerLevelPresent[i] = bit.ReadBit()
+	}
+	if maxSubLayersMinus1 > 0 {
+		for i := maxSubLayersMinus1; i < maxSubLayersInSPS; i++ {
+			bit.ReadBits(2) //reserved_zero_2bits
+		}
+	}
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		if subLayerProfilePresent[i] != 0 {
+			bit.ReadBits(profileTierLevelBits)
+		}
+		if subLayerLevelPresent[i] != 0 {
+			bit.ReadBits(8)
+		}
+	}
+	bit.ReadExponentialGolombCode() //sps_seq_parameter_set_id
+	chromaFormatIdc := bit.ReadExponentialGolombCode()
+	if chromaFormatIdc == 3 {
+		bit.ReadBit() //separate_colour_plane_flag
+	}
+	width = bit.ReadExponentialGolombCode()
+	height = bit.ReadExponentialGolombCode()
+	if bit.ReadBit() != 0 {
+		//conformance_window
+		left := bit.ReadExponentialGolombCode()
+		right := bit.ReadExponentialGolombCode()
+		top := bit.ReadExponentialGolombCode()
+		bottom := bit.ReadExponentialGolombCode()
+		subWidthC, subHeightC := 1, 1
+		if chromaFormatIdc == 1 || chromaFormatIdc == 2 {
+			subWidthC = 2
+		}
+		if chromaFormatIdc == 1 {
+			subHeightC = 2
+		}
+		width -= subWidthC * (left + right)
+		height -= subHeightC * (top + bottom)
+	}
+	return
+}
@@ -0,0 +1,53 @@
+package hevc
+
+//rfc 7798 fu header is one byte after the two bytes payload header
+const fuHeaderSize = 1
+
+//RTPAggregation parameter sets in one aggregation packet,layer id 0,tid 1
+func RTPAggregation(nals ...[]byte) (payload []byte) {
+	size := nalHeaderSize
+	for _, nal := range nals {
+		size += 2 + len(nal)
+	}
+	payload = make([]byte, 0, size)
+	payload = append(payload, NalTypeRTPAP<<1, 1)
+	for _, nal := range nals {
+		payload = append(payload, byte(len(nal)>>8), byte(len(nal)))
+		payload = append(payload, nal...)
+	}
+	return
+}
+
+//RTPPayloads single nal unit packet if nal not larger than maxSize,
+//else fragmentation units,type,layer id and tid of the nal header are kept
+func RTPPayloads(nal []byte, maxSize int) (payloads [][]byte) {
+	if len(nal) <= nalHeaderSize {
+		return
+	}
+	if len(nal) <= maxSize {
+		return [][]byte{nal}
+	}
+	fuSize := maxSize - nalHeaderSize - fuHeaderSize
+	if fuSize <= 0 {
+		return
+	}
+	payloadHeader := []byte{(nal[0] & 0x81) | (NalTypeRTPFU << 1), nal[1]}
+	nalType := byte(NalType(nal))
+	for cur := nalHeaderSize; cur < len(nal); cur += fuSize {
+		fuHeader := nalType
+		if cur == nalHeaderSize {
+			fuHeader |= 0x80
+		}
+		end := cur + fuSize
+		if end >= len(nal) {
+			end = len(nal)
+			fuHeader |= 0x40
+		}
+		payload := make([]byte, 0, nalHeaderSize+fuHeaderSize+end-cur)
+		payload = append(payload, payloadHeader...)
+		payload = append(payload, fuHeader)
+		payload = append(payload, nal[cur:end]...)
+		payloads = append(payloads, payload)
+	}
+	return
+}
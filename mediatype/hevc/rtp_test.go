@@ -0,0 +1,37 @@
+package hevc
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRTPPayloads(t *testing.T) {
+	vps := []byte{NalTypeVPS << 1, 1, 0xc}
+	sps := []byte{NalTypeSPS << 1, 1, 1, 1}
+	ap := RTPAggregation(vps, sps)
+	if NalType(ap) != NalTypeRTPAP || ap[1] != 1 || false == bytes.Equal(ap[2:], []byte{0, 3, 0x40, 1, 0xc, 0, 4, 0x42, 1, 1, 1}) {
+		t.Fatal("aggregation packet", ap)
+	}
+
+	idr := append([]byte{NalTypeIdrWRADL << 1, 1}, bytes.Repeat([]byte{0xab}, 2500)...)
+	if payloads := RTPPayloads(idr, len(idr)); len(payloads) != 1 || false == bytes.Equal(payloads[0], idr) {
+		t.Fatal("single nal unit packet")
+	}
+	payloads := RTPPayloads(idr, 1000)
+	if len(payloads) != 3 {
+		t.Fatal("fragments", len(payloads))
+	}
+	nal := []byte{idr[0], idr[1]}
+	for i, payload := range payloads {
+		if len(payload) > 1000 || NalType(payload) != NalTypeRTPFU || payload[1] != 1 || int(payload[2]&0x3f) != NalTypeIdrWRADL {
+			t.Fatal("fragment header", i, payload[:3])
+		}
+		if (payload[2]&0x80 != 0) != (i == 0) || (payload[2]&0x40 != 0) != (i == len(payloads)-1) {
+			t.Fatal("start end bits", i, payload[2])
+		}
+		nal = append(nal, payload[3:]...)
+	}
+	if false == bytes.Equal(nal, idr) {
+		t.Fatal("fragments not reassembled")
+	}
+}
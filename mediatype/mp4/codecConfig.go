@@ -0,0 +1,99 @@
+package mp4
+
+import (
+	"encoding/binary"
+
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/mediatype/av1"
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/mediatype/h264"
+	"github.com/use-go/websocket-streamserver/mediatype/hevc"
+)
+
+const (
+	opusSampleRate     = 48000
+	opusFrameSize      = 960 //20ms
+	opusHeadMinSize    = 19
+	opusDefaultChannel = 2
+)
+
+//videoConfigBoxName decoder configuration box in the sample entry
+func videoConfigBoxName(fourCC string) string {
+	switch fourCC {
+	case flv.FourCCHEVC:
+		return "hvcC"
+	case flv.FourCCAV1:
+		return "av1C"
+	}
+	return "avcC"
+}
+
+//parseVideoSize width height and fps from avcC hvcC or av1C,fps only in h264 vui
+func parseVideoSize(video *flv.VideoTag) (width, height, fps int) {
+	switch video.FourCC {
+	case flv.FourCCAVC:
+		if len(video.Data) > 8 {
+			//ParseSPS modify the data
+			tmp := make([]byte, len(video.Data)-8)
+			copy(tmp, video.Data[8:])
+			width, height, fps = h264.ParseSPS(tmp)
+		}
+	case flv.FourCCHEVC:
+		_, sps, _, err := hevc.GetVpsSpsPpsFromHVCC(video.Data)
+		if err != nil {
+			logger.LOGE(err.Error())
+			return
+		}
+		width, height = hevc.ParseSPS(sps[0])
+	case flv.FourCCAV1:
+		seqHeader, err := av1.GetSequenceHeaderFromAV1C(video.Data)
+		if err != nil {
+			logger.LOGE(err.Error())
+			return
+		}
+		width, height = av1.ParseSequenceHeader(seqHeader.Payload)
+	}
+	return
+}
+
+//av1Sample temporal delimiters are not stored in mp4 samples
+func av1Sample(data []byte) []byte {
+	obus, err := av1.SplitOBUs(data)
+	if err != nil {
+		logger.LOGW(err.Error())
+		return data
+	}
+	sample := make([]byte, 0, len(data))
+	for _, obu := range obus {
+		if obu.Type == av1.OBUTemporalDelimiter {
+			continue
+		}
+		sample = append(sample, obu.Data...)
+	}
+	return sample
+}
+
+//opusSpecificBox convert little endian OpusHead to big endian dOps payload
+func opusSpecificBox(opusHead []byte) (dOps []byte, channels int) {
+	if len(opusHead) < opusHeadMinSize || string(opusHead[:8]) != "OpusHead" {
+		logger.LOGW("invalid OpusHead,use stereo")
+		dOps = make([]byte, 11)
+		dOps[1] = opusDefaultChannel
+		binary.BigEndian.PutUint32(dOps[4:], opusSampleRate)
+		return dOps, opusDefaultChannel
+	}
+	channels = int(opusHead[9])
+	mappingFamily := opusHead[18]
+	dOps = make([]byte, 11)
+	dOps[0] = 0 //version
+	dOps[1] = opusHead[9]
+	binary.BigEndian.PutUint16(dOps[2:], binary.LittleEndian.Uint16(opusHead[10:]))
+	binary.BigEndian.PutUint32(dOps[4:], binary.LittleEndian.Uint32(opusHead[12:]))
+	binary.BigEndian.PutUint16(dOps[8:], binary.LittleEndian.Uint16(opusHead[16:]))
+	dOps[10] = mappingFamily
+	if mappingFamily != 0 && len(opusHead) >= opusHeadMinSize+2+channels {
+		//stream count,coupled count,channel mapping
+		dOps = append(dOps, opusHead[opusHeadMinSize:opusHeadMinSize+2+channels]...)
+	}
+	return
+}
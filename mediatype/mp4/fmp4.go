@@ -10,7 +10,6 @@ import (
 	"github.com/use-go/websocket-streamserver/mediatype/aac"
 	"github.com/use-go/websocket-streamserver/mediatype/amf"
 	"github.com/use-go/websocket-streamserver/mediatype/flv"
-	"github.com/use-go/websocket-streamserver/mediatype/h264"
 	"github.com/use-go/websocket-streamserver/mediatype/mp3"
 	"github.com/use-go/websocket-streamserver/utils"
 )
@@ -32,6 +31,7 @@ const (
 	Nellymoser              = 6
 	G711ALawLogarithmicPCM  = 7
 	G711MuLawLogarithmicPCM = 8
+	ExHeader                = 9 //enhanced rtmp,only opus now
 	AAC                     = 10
 	Speex                   = 11
 	Mp38                    = 14
@@ -62,6 +62,7 @@ type FMP4Creater struct {
 	audioInited   bool
 	audioLastTime uint32
 	audioCodecID  int
+	videoFourCC   string
 
 	width               int
 	height              int
@@ -70,9 +71,13 @@ type FMP4Creater struct {
 	audioSampleRate     uint32
 	audioSampleDuration uint32
 	ascData             []byte
+	dOpsData            []byte
+	audioChannels       int
 	audioType           int
 	firstNoZeroTime     uint32
 	keyframeGeted       bool
+	//KeepTimestamp 不把时间戳归零,多个码率需要相同的时间轴
+	KeepTimestamp bool
 }
 
 //FMP4Flags struct
@@ -87,7 +92,7 @@ type FMP4Flags struct {
 //AddFlvTag for Data Package
 func (fmp4Creater *FMP4Creater) AddFlvTag(tag *flv.FlvTag) (slice *FMP4Slice) {
 
-	if 0 == fmp4Creater.firstNoZeroTime && tag.Timestamp != 0 {
+	if false == fmp4Creater.KeepTimestamp && 0 == fmp4Creater.firstNoZeroTime && tag.Timestamp != 0 {
 		fmp4Creater.firstNoZeroTime = tag.Timestamp
 	}
 	tmpTag := tag.Copy()
@@ -108,6 +113,17 @@ func (fmp4Creater *FMP4Creater) AddFlvTag(tag *flv.FlvTag) (slice *FMP4Slice) {
 }
 
 func (fmp4Creater *FMP4Creater) handleAudioTag(tag *flv.FlvTag) (slice *FMP4Slice) {
+	if int(tag.Data[0]>>4) == ExHeader {
+		audio, err := flv.GetAudioTag(tag)
+		if err != nil || audio.FourCC != flv.FourCCOpus {
+			logger.LOGW("enhanced audio not support now,only opus")
+			return
+		}
+		if (fmp4Creater.audioInited == false) != (audio.PacketType == flv.PacketTypeSequenceStart) {
+			//wait OpusHead,or ignore the repeated one
+			return
+		}
+	}
 	if fmp4Creater.audioInited == false {
 		fmp4Creater.audioInited = true
 		return fmp4Creater.createAudioInitSeg(tag)
@@ -117,25 +133,29 @@ func (fmp4Creater *FMP4Creater) handleAudioTag(tag *flv.FlvTag) (slice *FMP4Slic
 }
 
 func (fmp4Creater *FMP4Creater) handleVideoTag(tag *flv.FlvTag) (slice *FMP4Slice) {
-	if tag.Data[0] != 0x17 && tag.Data[0] != 0x27 {
+	video, err := flv.GetVideoTag(tag)
+	if err != nil || (video.FourCC != flv.FourCCAVC && video.FourCC != flv.FourCCHEVC && video.FourCC != flv.FourCCAV1) {
 		logger.LOGW(fmt.Sprintf("%d not support now", int(tag.Data[0])))
 		return
 	}
 	if fmp4Creater.videoInited == false {
-		pktType := tag.Data[1]
-		if pktType != 0 {
-			logger.LOGE("AVC pkt not find")
+		if video.PacketType != flv.PacketTypeSequenceStart {
+			logger.LOGE("video sequence header not find")
 			return
 		}
 		fmp4Creater.videoInited = true
-		return fmp4Creater.createVideoInitSeg(tag)
+		fmp4Creater.videoFourCC = video.FourCC
+		return fmp4Creater.createVideoInitSeg(video)
+	}
+	if video.PacketType != flv.PacketTypeCodedFrames && video.PacketType != flv.PacketTypeCodedFramesX {
+		return
 	}
 	if fmp4Creater.keyframeGeted {
-		return fmp4Creater.createVideoSeg(tag)
+		return fmp4Creater.createVideoSeg(tag, video)
 	}
-	if tag.Data[0] == 0x17 && tag.Data[1] == 0x1 {
+	if video.FrameType == flv.FrameTypeKeyframe {
 		fmp4Creater.keyframeGeted = true
-		return fmp4Creater.createVideoSeg(tag)
+		return fmp4Creater.createVideoSeg(tag, video)
 	}
 
 	return
@@ -216,7 +236,13 @@ func (fmp4Creater *FMP4Creater) createAudioInitSeg(tag *flv.FlvTag) (slice *FMP4
 			}
 			fmp4Creater.audioCodecID = CodecIDAAC
 		}
-
+	case ExHeader:
+		//opus always use 48k clock
+		audio, _ := flv.GetAudioTag(tag)
+		fmp4Creater.dOpsData, fmp4Creater.audioChannels = opusSpecificBox(audio.Data)
+		fmp4Creater.audioSampleSize = opusFrameSize
+		fmp4Creater.audioSampleRate = opusSampleRate
+		fmp4Creater.audioSampleDuration = fmp4Creater.audioSampleSize * 1000 / fmp4Creater.audioSampleRate
 	default:
 		logger.LOGE("unknown audio type")
 	}
@@ -360,7 +386,11 @@ func (fmp4Creater *FMP4Creater) createAudioInitSeg(tag *flv.FlvTag) (slice *FMP4
 	moovBox.Pop()
 	//stbl
 	moovBox.Push([]byte("stbl"))
-	fmp4Creater.stsdA(moovBox, tag) //stsd
+	if fmp4Creater.audioType == ExHeader {
+		fmp4Creater.stsdOpus(moovBox) //stsd
+	} else {
+		fmp4Creater.stsdA(moovBox, tag) //stsd
+	}
 	//stts
 	moovBox.Push([]byte("stts"))
 	moovBox.Push4Bytes(0) //version
@@ -439,6 +469,10 @@ func (fmp4Creater *FMP4Creater) createAudioInitSeg(tag *flv.FlvTag) (slice *FMP4
 func (fmp4Creater *FMP4Creater) createAudioSeg(tag *flv.FlvTag) (slice *FMP4Slice) {
 	slice = &FMP4Slice{}
 	slice.Type = flv.FlvTagAudio
+	if fmp4Creater.KeepTimestamp && 0 == fmp4Creater.audioIdx {
+		//tfdt 和时长按上一帧计算,第一帧从自己的时间戳开始
+		fmp4Creater.audioLastTime = tag.Timestamp
+	}
 	slice.Idx = fmp4Creater.audioIdx
 	fmp4Creater.audioIdx++
 	segEncoder := amf.AMF0Encoder{}
@@ -474,6 +508,8 @@ func (fmp4Creater *FMP4Creater) createAudioSeg(tag *flv.FlvTag) (slice *FMP4Slic
 		dataPrefixLength = 2
 	} else if fmp4Creater.audioType == MP3 {
 		dataPrefixLength = 1
+	} else if fmp4Creater.audioType == ExHeader {
+		dataPrefixLength = 5
 	} else {
 		logger.LOGE("wth")
 	}
@@ -551,7 +587,7 @@ func (fmp4Creater *FMP4Creater) createAudioSeg(tag *flv.FlvTag) (slice *FMP4Slic
 	return
 }
 
-func (fmp4Creater *FMP4Creater) createVideoInitSeg(tag *flv.FlvTag) (slice *FMP4Slice) {
+func (fmp4Creater *FMP4Creater) createVideoInitSeg(video *flv.VideoTag) (slice *FMP4Slice) {
 	slice = &FMP4Slice{}
 	slice.Type = flv.FlvTagVideo
 	slice.Idx = -1
@@ -563,7 +599,7 @@ func (fmp4Creater *FMP4Creater) createVideoInitSeg(tag *flv.FlvTag) (slice *FMP4
 	ftyp.PushBytes([]byte("isom"))
 	ftyp.Push4Bytes(1)
 	ftyp.PushBytes([]byte("isom"))
-	ftyp.PushBytes([]byte("avc1"))
+	ftyp.PushBytes([]byte(video.FourCC))
 	ftyp.Pop()
 	err := segEncoder.AppendByteArray(ftyp.Flush())
 	if err != nil {
@@ -631,9 +667,11 @@ func (fmp4Creater *FMP4Creater) createVideoInitSeg(tag *flv.FlvTag) (slice *FMP4
 	moovBox.Push4Bytes(0x0)
 	moovBox.Push4Bytes(0x40000000) //matrix
 	//parse sps ,get w h fps
-	tmpTagData := make([]byte, len(tag.Data))
-	copy(tmpTagData, tag.Data)
-	fmp4Creater.width, fmp4Creater.height, fmp4Creater.fps = h264.ParseSPS(tmpTagData[13:])
+	fmp4Creater.width, fmp4Creater.height, fmp4Creater.fps = parseVideoSize(video)
+	if fmp4Creater.fps <= 0 {
+		//sps 里没有vui信息
+		fmp4Creater.fps = 25
+	}
 	moovBox.Push4Bytes(uint32(fmp4Creater.width << 16))  //width
 	moovBox.Push4Bytes(uint32(fmp4Creater.height << 16)) //height
 	//!tkhd
@@ -691,7 +729,7 @@ func (fmp4Creater *FMP4Creater) createVideoInitSeg(tag *flv.FlvTag) (slice *FMP4
 	moovBox.Pop()
 	//stbl
 	moovBox.Push([]byte("stbl"))
-	fmp4Creater.stsdV(moovBox, tag) //stsd
+	fmp4Creater.stsdV(moovBox, video) //stsd
 	//stts
 	moovBox.Push([]byte("stts"))
 	moovBox.Push4Bytes(0) //version
@@ -767,9 +805,12 @@ func (fmp4Creater *FMP4Creater) createVideoInitSeg(tag *flv.FlvTag) (slice *FMP4
 	return
 }
 
-func (fmp4Creater *FMP4Creater) createVideoSeg(tag *flv.FlvTag) (slice *FMP4Slice) {
+func (fmp4Creater *FMP4Creater) createVideoSeg(tag *flv.FlvTag, video *flv.VideoTag) (slice *FMP4Slice) {
 	slice = &FMP4Slice{}
 	slice.Type = flv.FlvTagVideo
+	if fmp4Creater.KeepTimestamp && 0 == fmp4Creater.videoIdx {
+		fmp4Creater.videoLastTime = tag.Timestamp
+	}
 	slice.Idx = fmp4Creater.videoIdx
 	fmp4Creater.videoIdx++
 	segEncoder := amf.AMF0Encoder{}
@@ -779,11 +820,11 @@ func (fmp4Creater *FMP4Creater) createVideoSeg(tag *flv.FlvTag) (slice *FMP4Slic
 	flags.IsLeading = 0
 	flags.SampleHasRedundancy = 0
 
-	if tag.Data[0] == 0x17 {
+	if video.FrameType == flv.FrameTypeKeyframe {
 		flags.SampleDependsOn = 2
 		flags.SampleIsDependedOn = 1
 		flags.IsAsync = 0
-	} else if tag.Data[0] == 0x27 {
+	} else if video.FrameType == flv.FrameTypeInterFrame {
 		flags.SampleDependsOn = 1
 		flags.SampleIsDependedOn = 0
 		flags.IsAsync = 1
@@ -791,6 +832,10 @@ func (fmp4Creater *FMP4Creater) createVideoSeg(tag *flv.FlvTag) (slice *FMP4Slic
 		logger.LOGE("invalid video")
 		return
 	}
+	sample := video.Data
+	if fmp4Creater.videoFourCC == flv.FourCCAV1 {
+		sample = av1Sample(sample)
+	}
 
 	videBox := &Box{}
 	//moof
@@ -829,10 +874,10 @@ func (fmp4Creater *FMP4Creater) createVideoSeg(tag *flv.FlvTag) (slice *FMP4Slic
 		//log.Println(tag.Timestamp - fmp4Creater.videoLastTime)
 		//log.Println(fmp4Creater.videoLastTime)
 	}
-	composition := (uint32(tag.Data[2]) << 16) | (uint32(tag.Data[3]) << 8) | (uint32(tag.Data[4]) << 0)
+	composition := uint32(video.CompositionTime)
 	//log.Println(fmt.Sprintf("timestame:%d  composition:%d duration:%d", tag.Timestamp, composition, tag.Timestamp-fmp4Creater.videoLastTime))
 	fmp4Creater.videoLastTime = tag.Timestamp
-	videBox.Push4Bytes(uint32(len(tag.Data) - (5))) //sample size,mdat data size
+	videBox.Push4Bytes(uint32(len(sample))) //sample size,mdat data size
 	videBox.PushByte(uint8((flags.IsLeading << 2) | flags.SampleDependsOn))
 	videBox.PushByte(uint8((flags.SampleIsDependedOn << 6) | (flags.SampleHasRedundancy << 4) | flags.IsAsync))
 	videBox.Push2Bytes(0)
@@ -856,7 +901,7 @@ func (fmp4Creater *FMP4Creater) createVideoSeg(tag *flv.FlvTag) (slice *FMP4Slic
 	}
 
 	//mdat
-	err = segEncoder.EncodeInt32(int32(len(tag.Data) - (5) + 8))
+	err = segEncoder.EncodeInt32(int32(len(sample) + 8))
 	if err != nil {
 		logger.LOGE(err.Error())
 		return
@@ -866,7 +911,7 @@ func (fmp4Creater *FMP4Creater) createVideoSeg(tag *flv.FlvTag) (slice *FMP4Slic
 		logger.LOGE(err.Error())
 		return
 	}
-	err = segEncoder.AppendByteArray(tag.Data[5:])
+	err = segEncoder.AppendByteArray(sample)
 	//!mdat
 	slice.Data, err = segEncoder.GetData()
 	if err != nil {
@@ -886,13 +931,13 @@ func (fmp4Creater *FMP4Creater) createVideoSeg(tag *flv.FlvTag) (slice *FMP4Slic
 	return
 }
 
-func (fmp4Creater *FMP4Creater) stsdV(box *Box, tag *flv.FlvTag) {
+func (fmp4Creater *FMP4Creater) stsdV(box *Box, video *flv.VideoTag) {
 	//stsd
 	box.Push([]byte("stsd"))
 	box.Push4Bytes(0)
 	box.Push4Bytes(1)
-	//avc1
-	box.Push([]byte("avc1"))
+	//avc1 hvc1 av01
+	box.Push([]byte(video.FourCC))
 	box.Push4Bytes(0)
 	box.Push2Bytes(0)
 	box.Push2Bytes(1)
@@ -913,9 +958,9 @@ func (fmp4Creater *FMP4Creater) stsdV(box *Box, tag *flv.FlvTag) {
 	box.PushBytes(spaceEnd)
 	box.Push2Bytes(0x18)
 	box.Push2Bytes(0xffff)
-	//avcC
-	box.Push([]byte("avcC"))
-	box.PushBytes(tag.Data[5:])
+	//avcC hvcC av1C
+	box.Push([]byte(videoConfigBoxName(video.FourCC)))
+	box.PushBytes(video.Data)
 	//!avcC
 	box.Pop()
 	//!avc1
@@ -999,6 +1044,34 @@ func (fmp4Creater *FMP4Creater) stsdA(box *Box, tag *flv.FlvTag) {
 	return
 }
 
+func (fmp4Creater *FMP4Creater) stsdOpus(box *Box) {
+	//stsd
+	box.Push([]byte("stsd"))
+	box.Push4Bytes(0)
+	box.Push4Bytes(1)
+	//Opus
+	box.Push([]byte("Opus"))
+	box.Push4Bytes(0)                                 //reserved
+	box.Push2Bytes(0)                                 //reserved
+	box.Push2Bytes(1)                                 //data reference index
+	box.Push8Bytes(0)                                 //reserved int32[2]
+	box.Push2Bytes(uint16(fmp4Creater.audioChannels)) //channel count
+	box.Push2Bytes(16)                                //sample size
+	box.Push2Bytes(0)                                 //pre defined
+	box.Push2Bytes(0)                                 //reserved
+	box.Push4Bytes(fmp4Creater.audioSampleRate << 16) //samplerate
+	//dOps
+	box.Push([]byte("dOps"))
+	box.PushBytes(fmp4Creater.dOpsData)
+	//!dOps
+	box.Pop()
+	//!Opus
+	box.Pop()
+	//!stsd
+	box.Pop()
+	return
+}
+
 func (fmp4Creater *FMP4Creater) aacForHTTP(tag *flv.FlvTag, useragent string) (cfg []byte) {
 	asc := aac.GenerateAudioSpecificConfig(tag.Data[2:])
 
@@ -0,0 +1,493 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/mediatype/h264"
+)
+
+const (
+	aacFlvSoundFlag     = flv.SoundFormatAAC<<4 | 0xf
+	sampleNonSyncFlag   = 0x10000
+	tfhdBaseDataOffset  = 0x01
+	tfhdSampleDescIndex = 0x02
+	tfhdDefaultDuration = 0x08
+	tfhdDefaultSize     = 0x10
+	tfhdDefaultFlags    = 0x20
+	trunDataOffset      = 0x01
+	trunFirstFlags      = 0x04
+	trunDuration        = 0x100
+	trunSize            = 0x200
+	trunFlags           = 0x400
+	trunCTS             = 0x800
+)
+
+//fmp4Track one track of the init segment,only avc and aac
+type fmp4Track struct {
+	video           bool
+	timescale       uint32
+	header          []byte //flv sequence header data
+	defaultDuration uint32
+	defaultSize     uint32
+	defaultFlags    uint32
+	hasFlags        bool
+	lastDTS         int64
+}
+
+//FMP4Parser 把fmp4初始化段和媒体段解析为flv tag,只支持h264和aac,
+//时间戳为相对第一个样本的毫秒
+type FMP4Parser struct {
+	tracks      map[uint32]*fmp4Track
+	init        []byte
+	headersSent bool
+	baseSet     bool
+	baseTime    int64
+}
+
+//ParseInit 初始化段变化时重新发送音视频头
+func (parser *FMP4Parser) ParseInit(data []byte) (err error) {
+	if bytes.Equal(data, parser.init) {
+		return
+	}
+	boxes, err := readBoxes(data)
+	if err != nil {
+		return
+	}
+	moov := findBox(boxes, "moov")
+	if nil == moov {
+		return errors.New("fmp4 init segment without moov")
+	}
+	children, err := readBoxes(moov.payload())
+	if err != nil {
+		return
+	}
+	tracks := make(map[uint32]*fmp4Track)
+	for _, box := range children {
+		if box.name != "trak" {
+			continue
+		}
+		id, track, err := parseTrak(box.payload())
+		if err != nil {
+			return err
+		}
+		if nil != track {
+			tracks[id] = track
+		}
+	}
+	if len(tracks) == 0 {
+		return errors.New("fmp4 init segment without avc or aac track")
+	}
+	if mvex := findBox(children, "mvex"); nil != mvex {
+		trexs, err := readBoxes(mvex.payload())
+		if err != nil {
+			return err
+		}
+		for _, trex := range trexs {
+			payload := trex.payload()
+			if trex.name != "trex" || len(payload) < 24 {
+				continue
+			}
+			track, ok := tracks[binary.BigEndian.Uint32(payload[4:])]
+			if false == ok {
+				continue
+			}
+			track.defaultDuration = binary.BigEndian.Uint32(payload[12:])
+			track.defaultSize = binary.BigEndian.Uint32(payload[16:])
+			track.defaultFlags = binary.BigEndian.Uint32(payload[20:])
+			track.hasFlags = true
+		}
+	}
+	parser.tracks = tracks
+	parser.init = append([]byte{}, data...)
+	parser.headersSent = false
+	return
+}
+
+//parseTrak nil track for codecs not supported
+func parseTrak(data []byte) (id uint32, track *fmp4Track, err error) {
+	boxes, err := readBoxes(data)
+	if err != nil {
+		return
+	}
+	tkhd := findBox(boxes, "tkhd")
+	mdia := findBox(boxes, "mdia")
+	if nil == tkhd || nil == mdia {
+		return 0, nil, errors.New("fmp4 trak without tkhd or mdia")
+	}
+	payload := tkhd.payload()
+	offset := 12
+	if len(payload) > 0 && payload[0] == 1 {
+		offset = 20
+	}
+	if len(payload) < offset+4 {
+		return 0, nil, errors.New("fmp4 tkhd truncated")
+	}
+	id = binary.BigEndian.Uint32(payload[offset:])
+	mdiaBoxes, err := readBoxes(mdia.payload())
+	if err != nil {
+		return
+	}
+	mdhd := findBox(mdiaBoxes, "mdhd")
+	minf := findBox(mdiaBoxes, "minf")
+	if nil == mdhd || nil == minf {
+		return 0, nil, errors.New("fmp4 mdia without mdhd or minf")
+	}
+	payload = mdhd.payload()
+	offset = 12
+	if len(payload) > 0 && payload[0] == 1 {
+		offset = 20
+	}
+	if len(payload) < offset+4 {
+		return 0, nil, errors.New("fmp4 mdhd truncated")
+	}
+	track = &fmp4Track{timescale: binary.BigEndian.Uint32(payload[offset:])}
+	if 0 == track.timescale {
+		return 0, nil, errors.New("fmp4 timescale zero")
+	}
+	stsd := findPath(minf.payload(), "stbl", "stsd")
+	if nil == stsd || len(stsd.payload()) < 8 {
+		return 0, nil, errors.New("fmp4 trak without stsd")
+	}
+	entries, err := readBoxes(stsd.payload()[8:])
+	if err != nil || len(entries) == 0 {
+		return 0, nil, errors.New("fmp4 invalid stsd")
+	}
+	entry := entries[0]
+	switch entry.name {
+	case "avc1", "avc3":
+		avcC := findPath(entry.payload()[min(78, len(entry.payload())):], "avcC")
+		if nil == avcC {
+			return 0, nil, errors.New("fmp4 avc without avcC")
+		}
+		track.video = true
+		track.header = append([]byte{0x17, 0, 0, 0, 0}, avcC.payload()...)
+	case "mp4a":
+		esds := findPath(entry.payload()[min(28, len(entry.payload())):], "esds")
+		if nil == esds {
+			return 0, nil, errors.New("fmp4 mp4a without esds")
+		}
+		asc := parseESDS(esds.payload())
+		if len(asc) < 2 {
+			return 0, nil, errors.New("fmp4 aac without decoder specific info")
+		}
+		track.header = append([]byte{aacFlvSoundFlag, flv.AACSequenceHeader}, asc...)
+	default:
+		return 0, nil, nil
+	}
+	return
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+//findPath 按名字逐层查找子box
+func findPath(data []byte, names ...string) (box *rawBox) {
+	for _, name := range names {
+		boxes, err := readBoxes(data)
+		if err != nil {
+			return nil
+		}
+		box = findBox(boxes, name)
+		if nil == box {
+			return nil
+		}
+		data = box.payload()
+	}
+	return
+}
+
+//descriptor 返回tag,内容和剩余数据,长度为1到4字节的可变长度
+func descriptor(data []byte) (tag byte, payload, left []byte) {
+	if len(data) < 2 {
+		return
+	}
+	tag = data[0]
+	size, cur := 0, 1
+	for ; cur < len(data) && cur <= 4; cur++ {
+		size = size<<7 | int(data[cur]&0x7f)
+		if data[cur]&0x80 == 0 {
+			cur++
+			break
+		}
+	}
+	if cur+size > len(data) {
+		return 0, nil, nil
+	}
+	return tag, data[cur : cur+size], data[cur+size:]
+}
+
+//parseESDS audio specific config in the decoder specific info
+func parseESDS(data []byte) []byte {
+	if len(data) < 4 {
+		return nil
+	}
+	tag, es, _ := descriptor(data[4:])
+	if tag != MP4ESDescrTag || len(es) < 3 {
+		return nil
+	}
+	flags := es[2]
+	es = es[3:]
+	if flags&0x80 != 0 {
+		es = es[min(2, len(es)):]
+	}
+	if flags&0x40 != 0 && len(es) > 0 {
+		es = es[min(1+int(es[0]), len(es)):]
+	}
+	if flags&0x20 != 0 {
+		es = es[min(2, len(es)):]
+	}
+	tag, config, _ := descriptor(es)
+	if tag != MP4DecConfigDescrTag || len(config) < 13 {
+		return nil
+	}
+	tag, asc, _ := descriptor(config[13:])
+	if tag != MP4DecSpecificDescrTag {
+		return nil
+	}
+	return asc
+}
+
+//Parse 媒体段,moof后面跟着它的mdat,数据偏移相对moof开始
+func (parser *FMP4Parser) Parse(data []byte) (tags []*flv.FlvTag, err error) {
+	if len(parser.tracks) == 0 {
+		return nil, errors.New("fmp4 init segment not parsed")
+	}
+	boxes, err := readBoxes(data)
+	if err != nil {
+		return
+	}
+	offset := 0
+	for _, box := range boxes {
+		if box.name == "moof" {
+			tags, err = parser.parseMoof(box, data, offset, tags)
+			if err != nil {
+				return
+			}
+		}
+		offset += len(box.data)
+	}
+	//多个轨道按时间交织
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].Timestamp < tags[j].Timestamp
+	})
+	if len(tags) > 0 && false == parser.headersSent {
+		parser.headersSent = true
+		headers := make([]*flv.FlvTag, 0, len(parser.tracks)+len(tags))
+		for _, track := range parser.tracks {
+			if track.video {
+				headers = append(headers, &flv.FlvTag{TagType: flv.FlvTagVideo, Timestamp: tags[0].Timestamp, Data: track.header})
+			}
+		}
+		for _, track := range parser.tracks {
+			if false == track.video {
+				headers = append(headers, &flv.FlvTag{TagType: flv.FlvTagAudio, Timestamp: tags[0].Timestamp, Data: track.header})
+			}
+		}
+		tags = append(headers, tags...)
+	}
+	return
+}
+
+func (parser *FMP4Parser) parseMoof(moof *rawBox, data []byte, moofOffset int, tags []*flv.FlvTag) ([]*flv.FlvTag, error) {
+	children, err := readBoxes(moof.payload())
+	if err != nil {
+		return tags, err
+	}
+	for _, traf := range children {
+		if traf.name != "traf" {
+			continue
+		}
+		tags, err = parser.parseTraf(traf.payload(), data, moofOffset, tags)
+		if err != nil {
+			return tags, err
+		}
+	}
+	return tags, nil
+}
+
+func (parser *FMP4Parser) parseTraf(traf, data []byte, moofOffset int, tags []*flv.FlvTag) ([]*flv.FlvTag, error) {
+	boxes, err := readBoxes(traf)
+	if err != nil {
+		return tags, err
+	}
+	tfhd := findBox(boxes, "tfhd")
+	if nil == tfhd || len(tfhd.payload()) < 8 {
+		return tags, errors.New("fmp4 traf without tfhd")
+	}
+	payload := tfhd.payload()
+	flags := binary.BigEndian.Uint32(payload) & 0xffffff
+	track, ok := parser.tracks[binary.BigEndian.Uint32(payload[4:])]
+	if false == ok {
+		return tags, nil
+	}
+	duration, size, sampleFlags, hasFlags := track.defaultDuration, track.defaultSize, track.defaultFlags, track.hasFlags
+	base := int64(moofOffset)
+	fields := payload[8:]
+	readField := func(flag uint32, n int) (value uint64, ok bool) {
+		if flags&flag == 0 || len(fields) < n {
+			return
+		}
+		if n == 8 {
+			value = binary.BigEndian.Uint64(fields)
+		} else {
+			value = uint64(binary.BigEndian.Uint32(fields))
+		}
+		fields = fields[n:]
+		return value, true
+	}
+	if value, ok := readField(tfhdBaseDataOffset, 8); ok {
+		base = int64(value)
+	}
+	readField(tfhdSampleDescIndex, 4)
+	if value, ok := readField(tfhdDefaultDuration, 4); ok {
+		duration = uint32(value)
+	}
+	if value, ok := readField(tfhdDefaultSize, 4); ok {
+		size = uint32(value)
+	}
+	if value, ok := readField(tfhdDefaultFlags, 4); ok {
+		sampleFlags = uint32(value)
+		hasFlags = true
+	}
+	dts := track.lastDTS
+	if tfdt := findBox(boxes, "tfdt"); nil != tfdt && len(tfdt.payload()) >= 8 {
+		payload := tfdt.payload()
+		if payload[0] == 1 && len(payload) >= 12 {
+			dts = int64(binary.BigEndian.Uint64(payload[4:]))
+		} else {
+			dts = int64(binary.BigEndian.Uint32(payload[4:]))
+		}
+	}
+	cur := base
+	for _, trun := range boxes {
+		if trun.name != "trun" {
+			continue
+		}
+		payload := trun.payload()
+		if len(payload) < 8 {
+			return tags, errors.New("fmp4 trun truncated")
+		}
+		version := payload[0]
+		flags := binary.BigEndian.Uint32(payload) & 0xffffff
+		count := int(binary.BigEndian.Uint32(payload[4:]))
+		payload = payload[8:]
+		if flags&trunDataOffset != 0 {
+			if len(payload) < 4 {
+				return tags, errors.New("fmp4 trun truncated")
+			}
+			cur = base + int64(int32(binary.BigEndian.Uint32(payload)))
+			payload = payload[4:]
+		}
+		firstFlags, hasFirstFlags := uint32(0), false
+		if flags&trunFirstFlags != 0 {
+			if len(payload) < 4 {
+				return tags, errors.New("fmp4 trun truncated")
+			}
+			firstFlags, hasFirstFlags = binary.BigEndian.Uint32(payload), true
+			payload = payload[4:]
+		}
+		for i := 0; i < count; i++ {
+			sampleDuration, sampleSize, flagsOfSample, flagsKnown := duration, size, sampleFlags, hasFlags
+			cts := int64(0)
+			next := func() uint32 {
+				if len(payload) < 4 {
+					return 0
+				}
+				value := binary.BigEndian.Uint32(payload)
+				payload = payload[4:]
+				return value
+			}
+			if flags&trunDuration != 0 {
+				sampleDuration = next()
+			}
+			if flags&trunSize != 0 {
+				sampleSize = next()
+			}
+			if flags&trunFlags != 0 {
+				flagsOfSample, flagsKnown = next(), true
+			} else if i == 0 && hasFirstFlags {
+				flagsOfSample, flagsKnown = firstFlags, true
+			}
+			if flags&trunCTS != 0 {
+				value := next()
+				if version == 0 {
+					cts = int64(value)
+				} else {
+					cts = int64(int32(value))
+				}
+			}
+			if cur < 0 || cur+int64(sampleSize) > int64(len(data)) {
+				return tags, errors.New("fmp4 sample out of range")
+			}
+			sample := data[cur : cur+int64(sampleSize)]
+			cur += int64(sampleSize)
+			tags = append(tags, parser.sampleTag(track, sample, dts, cts, flagsOfSample, flagsKnown))
+			dts += int64(sampleDuration)
+		}
+	}
+	track.lastDTS = dts
+	return tags, nil
+}
+
+func (parser *FMP4Parser) sampleTag(track *fmp4Track, sample []byte, dts, cts int64, flags uint32, flagsKnown bool) (tag *flv.FlvTag) {
+	ms := dts * 1000 / int64(track.timescale)
+	if false == parser.baseSet {
+		parser.baseSet = true
+		parser.baseTime = ms
+	}
+	ms -= parser.baseTime
+	if ms < 0 {
+		ms = 0
+	}
+	tag = &flv.FlvTag{Timestamp: uint32(ms)}
+	if false == track.video {
+		tag.TagType = flv.FlvTagAudio
+		tag.Data = append([]byte{aacFlvSoundFlag, flv.AACRaw}, sample...)
+		return
+	}
+	keyFrame := false
+	if flagsKnown {
+		keyFrame = flags&sampleNonSyncFlag == 0
+	} else {
+		keyFrame = avccHasIDR(sample)
+	}
+	ctsMs := cts * 1000 / int64(track.timescale)
+	if ctsMs < 0 {
+		ctsMs = 0
+	}
+	tag.TagType = flv.FlvTagVideo
+	tag.Data = make([]byte, 5, 5+len(sample))
+	tag.Data[0] = 0x27
+	if keyFrame {
+		tag.Data[0] = 0x17
+	}
+	tag.Data[1] = flv.AVCNALU
+	tag.Data[2] = byte(ctsMs >> 16)
+	tag.Data[3] = byte(ctsMs >> 8)
+	tag.Data[4] = byte(ctsMs)
+	tag.Data = append(tag.Data, sample...)
+	return
+}
+
+//avccHasIDR 4字节长度前缀的nal
+func avccHasIDR(sample []byte) bool {
+	for len(sample) > 4 {
+		size := int(binary.BigEndian.Uint32(sample))
+		if size <= 0 || 4+size > len(sample) {
+			return false
+		}
+		if sample[4]&0x1f == h264.NalType_idr {
+			return true
+		}
+		sample = sample[4+size:]
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package mp4
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/mediatype/h264"
+)
+
+func TestFMP4ParserRoundTrip(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xec, 0x04, 0x40, 0x00, 0x00, 0x03, 0x00, 0x40, 0x00, 0x00, 0x0c, 0x23, 0xc6, 0x0c, 0x92}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	avcFrame := func(frameType byte, cts int, nal []byte) []byte {
+		data := []byte{frameType, 1, byte(cts >> 16), byte(cts >> 8), byte(cts)}
+		data = append(data, byte(len(nal)>>24), byte(len(nal)>>16), byte(len(nal)>>8), byte(len(nal)))
+		return append(data, nal...)
+	}
+	videoHeader := &flv.FlvTag{TagType: flv.FlvTagVideo, Data: append([]byte{0x17, 0, 0, 0, 0}, h264.AVCDecoderConfigurationRecord(sps, pps)...)}
+	audioHeader := &flv.FlvTag{TagType: flv.FlvTagAudio, Data: []byte{aacFlvSoundFlag, 0, 0x12, 0x10}}
+	in := []*flv.FlvTag{
+		{TagType: flv.FlvTagVideo, Timestamp: 1000, Data: avcFrame(0x17, 0, append([]byte{0x65, 0x88}, bytes.Repeat([]byte{0x11}, 500)...))},
+		{TagType: flv.FlvTagAudio, Timestamp: 1000, Data: append([]byte{aacFlvSoundFlag, 1}, bytes.Repeat([]byte{0x33}, 100)...)},
+		{TagType: flv.FlvTagVideo, Timestamp: 1040, Data: avcFrame(0x27, 40, []byte{0x41, 0x9a, 0x22})},
+	}
+	videoCreater := &FMP4Creater{}
+	audioCreater := &FMP4Creater{}
+	videoInit := videoCreater.AddFlvTag(videoHeader)
+	audioInit := audioCreater.AddFlvTag(audioHeader)
+	init, err := MergeInitSegments(videoInit.Data, audioInit.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var segment []byte
+	for _, tag := range in {
+		creater := videoCreater
+		if tag.TagType == flv.FlvTagAudio {
+			creater = audioCreater
+		}
+		segment = append(segment, creater.AddFlvTag(tag).Data...)
+	}
+
+	parser := &FMP4Parser{}
+	if err = parser.ParseInit(init); err != nil {
+		t.Fatal(err)
+	}
+	out, err := parser.Parse(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 5 {
+		t.Fatal("tags", len(out))
+	}
+	if false == bytes.Equal(out[0].Data, videoHeader.Data) {
+		t.Fatal("video header")
+	}
+	if false == flv.IsAudioSequenceHeader(out[1]) {
+		t.Fatal("audio header")
+	}
+	//creater 每个轨道的时间戳从第一个非零时间开始
+	for i, tag := range in {
+		if false == bytes.Equal(out[i+2].Data, tag.Data) || out[i+2].Timestamp != tag.Timestamp-1000 {
+			t.Fatal("sample", i, out[i+2].Timestamp)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+//rawBox a box read from an existing buffer,data includes the header
+type rawBox struct {
+	name string
+	data []byte
+}
+
+func (box *rawBox) payload() []byte {
+	return box.data[8:]
+}
+
+//readBoxes split buffer to sibling boxes,large size boxes are not supported
+func readBoxes(data []byte) (boxes []*rawBox, err error) {
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, errors.New("mp4 box header truncated")
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			return nil, errors.New("invalid mp4 box size")
+		}
+		boxes = append(boxes, &rawBox{name: string(data[4:8]), data: data[:size]})
+		data = data[size:]
+	}
+	return
+}
+
+func findBox(boxes []*rawBox, name string) *rawBox {
+	for _, box := range boxes {
+		if box.name == name {
+			return box
+		}
+	}
+	return nil
+}
+
+func writeBox(name string, children ...[]byte) []byte {
+	size := 8
+	for _, child := range children {
+		size += len(child)
+	}
+	out := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(out, uint32(size))
+	copy(out[4:], name)
+	for _, child := range children {
+		out = append(out, child...)
+	}
+	return out
+}
+
+//MergeInitSegments 把FMP4Creater分别生成的视频和音频初始化段合并为一个双轨的初始化段,
+//ftyp and mvhd come from video,audio trak and trex are appended
+func MergeInitSegments(video, audio []byte) (data []byte, err error) {
+	if len(video) == 0 {
+		return audio, nil
+	}
+	if len(audio) == 0 {
+		return video, nil
+	}
+	videoBoxes, err := readBoxes(video)
+	if err != nil {
+		return
+	}
+	audioBoxes, err := readBoxes(audio)
+	if err != nil {
+		return
+	}
+	ftyp := findBox(videoBoxes, "ftyp")
+	videoMoov := findBox(videoBoxes, "moov")
+	audioMoov := findBox(audioBoxes, "moov")
+	if ftyp == nil || videoMoov == nil || audioMoov == nil {
+		return nil, errors.New("init segment without ftyp or moov")
+	}
+	videoChildren, err := readBoxes(videoMoov.payload())
+	if err != nil {
+		return
+	}
+	audioChildren, err := readBoxes(audioMoov.payload())
+	if err != nil {
+		return
+	}
+
+	moovChildren := make([][]byte, 0, len(videoChildren)+2)
+	mvexChildren := make([][]byte, 0, 2)
+	for _, box := range videoChildren {
+		if box.name == "mvex" {
+			children, err := readBoxes(box.payload())
+			if err != nil {
+				return nil, err
+			}
+			for _, child := range children {
+				mvexChildren = append(mvexChildren, child.data)
+			}
+			continue
+		}
+		moovChildren = append(moovChildren, box.data)
+	}
+	for _, box := range audioChildren {
+		switch box.name {
+		case "trak":
+			moovChildren = append(moovChildren, box.data)
+		case "mvex":
+			children, err := readBoxes(box.payload())
+			if err != nil {
+				return nil, err
+			}
+			for _, child := range children {
+				mvexChildren = append(mvexChildren, child.data)
+			}
+		}
+	}
+	moovChildren = append(moovChildren, writeBox("mvex", mvexChildren...))
+
+	data = append(data, ftyp.data...)
+	data = append(data, writeBox("moov", moovChildren...)...)
+	return
+}
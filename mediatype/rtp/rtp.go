@@ -0,0 +1,52 @@
+//Package rtp rfc 3550 fixed header,payload formats are in the codec packages
+package rtp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+//HeaderSize fixed header without csrc
+const HeaderSize = 12
+
+//Packet parsed fixed header,csrc,header extension and padding are skipped
+type Packet struct {
+	Marker      bool
+	PayloadType byte
+	Seq         uint16
+	Timestamp   uint32
+	SSRC        uint32
+	Payload     []byte //shares memory with the parsed data
+}
+
+//Parse one rtp packet
+func Parse(data []byte) (pkt *Packet, err error) {
+	if len(data) < HeaderSize {
+		return nil, errors.New("rtp packet too short")
+	}
+	if data[0]>>6 != 2 {
+		return nil, errors.New("rtp version not 2")
+	}
+	pkt = &Packet{Marker: data[1]&0x80 != 0,
+		PayloadType: data[1] & 0x7f,
+		Seq:         binary.BigEndian.Uint16(data[2:]),
+		Timestamp:   binary.BigEndian.Uint32(data[4:]),
+		SSRC:        binary.BigEndian.Uint32(data[8:])}
+	cur := HeaderSize + int(data[0]&0xf)*4
+	if data[0]&0x10 != 0 {
+		//header extension,abs-send-time etc. not used
+		if len(data) < cur+4 {
+			return nil, errors.New("rtp extension invalid")
+		}
+		cur += 4 + int(binary.BigEndian.Uint16(data[cur+2:]))*4
+	}
+	end := len(data)
+	if data[0]&0x20 != 0 {
+		end -= int(data[end-1])
+	}
+	if cur > end {
+		return nil, errors.New("rtp payload invalid")
+	}
+	pkt.Payload = data[cur:end]
+	return
+}
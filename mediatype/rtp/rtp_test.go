@@ -0,0 +1,28 @@
+package rtp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	header := []byte{0x80, 0xe0, 0xff, 0xfe, 0, 0, 0x23, 0x28, 0, 0, 0, 1}
+	pkt, err := Parse(append(header, 1, 2, 3))
+	if err != nil || false == pkt.Marker || pkt.PayloadType != 96 || pkt.Seq != 0xfffe ||
+		pkt.Timestamp != 9000 || pkt.SSRC != 1 || false == bytes.Equal(pkt.Payload, []byte{1, 2, 3}) {
+		t.Fatalf("%+v %v", pkt, err)
+	}
+	//one csrc,extension with one word,two bytes padding
+	data := []byte{0xb1, 0x60, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 2,
+		0xbe, 0xde, 0, 1, 9, 9, 9, 9, 4, 5, 0, 2}
+	pkt, err = Parse(data)
+	if err != nil || pkt.Marker || false == bytes.Equal(pkt.Payload, []byte{4, 5}) {
+		t.Fatalf("%+v %v", pkt, err)
+	}
+	for _, bad := range [][]byte{header[:11], {0x40, 0x60, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1},
+		{0x90, 0x60, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0xbe}, {0xa0, 0x60, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 1, 9}} {
+		if _, err = Parse(bad); err == nil {
+			t.Fatal("parsed", bad)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/use-go/websocket-streamserver/mediatype/aac"
 	"github.com/use-go/websocket-streamserver/mediatype/flv"
 	"github.com/use-go/websocket-streamserver/mediatype/h264"
+	"github.com/use-go/websocket-streamserver/mediatype/hevc"
 	"github.com/use-go/websocket-streamserver/mediatype/mp3"
 )
 
@@ -53,6 +54,8 @@ type TsCreater struct {
 	//asc                      aac.AudioSpecificConfig
 	asc                      *aac.MP4AACAudioSpecificConfig
 	videoHeader              []byte
+	videoFourCC              string
+	vps                      []byte
 	sps                      []byte
 	pps                      []byte
 	sei                      []byte
@@ -107,7 +110,7 @@ func (tsCreater *TsCreater) AddTag(tag *flv.FlvTag) {
 	if true == tsCreater.avHeaderAdded(tag) {
 		if 0xffffffff == tsCreater.beginTime {
 			tsCreater.beginTime = tag.Timestamp
-			if tsCreater.audioHeader == nil || TS_VIDEO_ONLY {
+			if tsCreater.audioHeader == nil || TS_VIDEO_ONLY || 0 == tsCreater.audioTypeId {
 				tsCreater.encodeAudio = false
 			} else {
 				tsCreater.encodeAudio = true
@@ -118,7 +121,7 @@ func (tsCreater *TsCreater) AddTag(tag *flv.FlvTag) {
 		if flv.FlvTagAudio == tag.TagType {
 			addDts = false
 			addPCR = false
-			if TS_VIDEO_ONLY {
+			if TS_VIDEO_ONLY || false == tsCreater.encodeAudio {
 				return
 			}
 		} else {
@@ -138,6 +141,9 @@ func (tsCreater *TsCreater) AddTag(tag *flv.FlvTag) {
 				return
 			}
 		} else if flv.FlvTagVideo == tag.TagType {
+			if 0 == tsCreater.videoTypeId {
+				return
+			}
 			dataPayload = tsCreater.videoPayload(tag)
 			if nil == dataPayload {
 				logger.LOGE(dataPayload)
@@ -559,8 +565,7 @@ func (tsCreater *TsCreater) avHeaderAdded(tag *flv.FlvTag) (headerGeted bool) {
 		}
 		tsCreater.videoHeader = make([]byte, len(tag.Data))
 		copy(tsCreater.videoHeader, tag.Data)
-		tsCreater.videoTypeId = 0x1b
-		tsCreater.parseAVC(tsCreater.videoHeader)
+		tsCreater.parseVideoHeader(tsCreater.videoHeader)
 		return false
 	}
 	return false
@@ -589,16 +594,53 @@ func (tsCreater *TsCreater) parseAudioType(data []byte) {
 			tsCreater.audioTypeId = 0x04
 		}
 	default:
+		//opus in ts is not supported
 		logger.LOGE("ts audio type not supported", audioCodec)
 		return
 	}
 
 }
 
-func (tsCreater *TsCreater) parseAVC(data []byte) {
-	if data[0] == 0x17 && data[1] == 0 {
-		//avc
-		tsCreater.sps, tsCreater.pps = h264.GetSpsPpsFromAVC(data[5:])
+//parseVideoHeader avc and hevc only,av1 in ts is not supported
+func (tsCreater *TsCreater) parseVideoHeader(data []byte) {
+	video, err := flv.GetVideoTag(&flv.FlvTag{TagType: flv.FlvTagVideo, Data: data})
+	if err != nil {
+		logger.LOGE(err.Error())
+		return
+	}
+	switch video.FourCC {
+	case flv.FourCCAVC:
+		tsCreater.videoTypeId = 0x1b
+	case flv.FourCCHEVC:
+		tsCreater.videoTypeId = 0x24
+	default:
+		logger.LOGE("ts video type not supported", video.FourCC, video.CodecID)
+		return
+	}
+	tsCreater.videoFourCC = video.FourCC
+	if video.PacketType == flv.PacketTypeSequenceStart {
+		tsCreater.parseVideoConfig(video)
+	}
+}
+
+func (tsCreater *TsCreater) parseVideoConfig(video *flv.VideoTag) {
+	if video.FourCC == flv.FourCCAVC {
+		tsCreater.sps, tsCreater.pps = h264.GetSpsPpsFromAVC(video.Data)
+		return
+	}
+	vps, sps, pps, err := hevc.GetVpsSpsPpsFromHVCC(video.Data)
+	if err != nil {
+		logger.LOGE(err.Error())
+		return
+	}
+	tsCreater.vps = nil
+	tsCreater.pps = nil
+	if len(vps) > 0 {
+		tsCreater.vps = vps[0]
+	}
+	tsCreater.sps = sps[0]
+	if len(pps) > 0 {
+		tsCreater.pps = pps[0]
 	}
 }
 
@@ -790,50 +832,62 @@ func (tsCreater *TsCreater) getTsCount(dataSize int, addPCR, addDts bool) (tsCou
 }
 
 func (tsCreater *TsCreater) videoPayload(tag *flv.FlvTag) (payload []byte) {
-	if tag.Data[0] == 0x17 && tag.Data[1] == 0 {
-		tsCreater.parseAVC(tag.Data)
+	video, err := flv.GetVideoTag(tag)
+	if err != nil || video.FourCC != tsCreater.videoFourCC {
+		logger.LOGE("invalid video tag for ts")
 		return nil
 	}
-	nalCur := 5
+	if video.PacketType == flv.PacketTypeSequenceStart {
+		tsCreater.parseVideoConfig(video)
+		return nil
+	}
+	if video.PacketType != flv.PacketTypeCodedFrames && video.PacketType != flv.PacketTypeCodedFramesX {
+		return nil
+	}
+	if video.FourCC == flv.FourCCHEVC {
+		return tsCreater.hevcPayload(video)
+	}
+	data := video.Data
+	nalCur := 0
 	getKeyframe := false
 	nalList := list.New()
 	totalNalSize := 0
-	for nalCur < len(tag.Data) {
+	for nalCur < len(data) {
 		nalSize := 0
-		nalSizeSlice := tag.Data[nalCur : nalCur+4]
+		nalSizeSlice := data[nalCur : nalCur+4]
 		nalSize = (int(nalSizeSlice[0]) << 24) | (int(nalSizeSlice[1]) << 16) |
 			(int(nalSizeSlice[2]) << 8) | (int(nalSizeSlice[3]) << 0)
 		nalCur += 4
-		nalType := tag.Data[nalCur] & 0x1f
+		nalType := data[nalCur] & 0x1f
 
 		switch nalType {
 		case h264.NalType_sei:
 			tsCreater.sei = make([]byte, nalSize)
-			copy(tsCreater.sei, tag.Data[nalCur:nalCur+nalSize])
+			copy(tsCreater.sei, data[nalCur:nalCur+nalSize])
 		case h264.NalType_sps:
 			tsCreater.sps = make([]byte, nalSize)
-			copy(tsCreater.sps, tag.Data[nalCur:nalCur+nalSize])
+			copy(tsCreater.sps, data[nalCur:nalCur+nalSize])
 		case h264.NalType_pps:
 			tsCreater.pps = make([]byte, nalSize)
-			copy(tsCreater.pps, tag.Data[nalCur:nalCur+nalSize])
+			copy(tsCreater.pps, data[nalCur:nalCur+nalSize])
 		case h264.NalType_idr:
 			getKeyframe = true
 			tsCreater.keyframeWrited = true
 			totalNalSize += nalSize + 3
 			tmp := make([]byte, nalSize)
-			copy(tmp, tag.Data[nalCur:nalCur+nalSize])
+			copy(tmp, data[nalCur:nalCur+nalSize])
 			nalList.PushBack(tmp)
 		case h264.NalType_aud:
 			if /*0!=totalNalSize&&*/ nalSize != 2 {
 				totalNalSize += nalSize + 3
 				tmp := make([]byte, nalSize)
-				copy(tmp, tag.Data[nalCur:nalCur+nalSize])
+				copy(tmp, data[nalCur:nalCur+nalSize])
 				nalList.PushBack(tmp)
 			}
 		default:
 			totalNalSize += nalSize + 3
 			tmp := make([]byte, nalSize)
-			copy(tmp, tag.Data[nalCur:nalCur+nalSize])
+			copy(tmp, data[nalCur:nalCur+nalSize])
 			nalList.PushBack(tmp)
 		}
 		nalCur += nalSize
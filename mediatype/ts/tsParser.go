@@ -0,0 +1,366 @@
+package ts
+
+import (
+	"bytes"
+	"strconv"
+
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/mediatype/aac"
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/mediatype/h264"
+)
+
+const (
+	streamTypeAAC   = 0x0f
+	streamTypeH264  = 0x1b
+	tsSyncByte      = 0x47
+	ptsMask         = 1<<33 - 1
+	ptsHzPerMs      = 90
+	ptsJumpMax      = 10 * 1000 * ptsHzPerMs
+	aacFlvSoundFlag = flv.SoundFormatAAC<<4 | 0xf
+	aacFrameSamples = 1024
+)
+
+//pesBuffer 一个PID上正在组装的PES
+type pesBuffer struct {
+	streamType int
+	cc         int //上一个包的continuity counter,-1为未知
+	data       []byte
+	size       int //PES_packet_length不为0时的总长度
+	lost       bool
+}
+
+//TsParser 把TS流解复用为flv tag,只支持h264和adts aac,
+//不完整的PES直接丢弃,视频丢包后等待下一个关键帧
+type TsParser struct {
+	cache        []byte
+	pmtPID       int
+	pes          map[int]*pesBuffer
+	warnedPIDs   map[int]bool
+	baseSet      bool
+	baseTime     int64
+	lastTime     int64
+	sps          []byte
+	pps          []byte
+	avcSent      bool
+	asc          []byte
+	keyFrameWait bool
+}
+
+//Parse 输入任意长度的TS数据,不足188字节的部分留到下次
+func (tsParser *TsParser) Parse(data []byte) (tags []*flv.FlvTag) {
+	if nil == tsParser.pes {
+		tsParser.pes = make(map[int]*pesBuffer)
+		tsParser.warnedPIDs = make(map[int]bool)
+		tsParser.keyFrameWait = true
+	}
+	if len(tsParser.cache) > 0 {
+		data = append(tsParser.cache, data...)
+		tsParser.cache = nil
+	}
+	for len(data) >= TS_length {
+		if data[0] != tsSyncByte {
+			//同步丢失,找下一个同步字节
+			idx := bytes.IndexByte(data, tsSyncByte)
+			if idx < 0 {
+				data = nil
+				break
+			}
+			data = data[idx:]
+			continue
+		}
+		tags = tsParser.parsePacket(data[:TS_length], tags)
+		data = data[TS_length:]
+	}
+	if len(data) > 0 {
+		tsParser.cache = append([]byte{}, data...)
+	}
+	return
+}
+
+func (tsParser *TsParser) parsePacket(pkt []byte, tags []*flv.FlvTag) []*flv.FlvTag {
+	if pkt[1]&0x80 != 0 {
+		//transport_error_indicator
+		return tags
+	}
+	unitStart := pkt[1]&0x40 != 0
+	pid := int(pkt[1]&0x1f)<<8 | int(pkt[2])
+	adaptation := pkt[3] >> 4 & 3
+	cc := int(pkt[3] & 0xf)
+	cur := 4
+	if adaptation&2 != 0 {
+		cur += 1 + int(pkt[4])
+	}
+	if adaptation&1 == 0 || cur >= TS_length {
+		return tags
+	}
+	payload := pkt[cur:]
+	switch {
+	case pid == 0:
+		if unitStart {
+			tsParser.parsePAT(payload)
+		}
+	case pid == tsParser.pmtPID && tsParser.pmtPID > 0:
+		if unitStart {
+			tsParser.parsePMT(payload)
+		}
+	default:
+		pes, ok := tsParser.pes[pid]
+		if ok {
+			tags = tsParser.addPayload(pes, unitStart, cc, payload, tags)
+		}
+	}
+	return tags
+}
+
+//psiSection 跳过pointer field,返回完整的section,不支持跨包的section
+func psiSection(payload []byte) []byte {
+	pointer := int(payload[0])
+	if 1+pointer+3 > len(payload) {
+		return nil
+	}
+	section := payload[1+pointer:]
+	size := 3 + (int(section[1]&0xf)<<8 | int(section[2]))
+	if size > len(section) || size < 12 {
+		return nil
+	}
+	//不含crc
+	return section[:size-4]
+}
+
+func (tsParser *TsParser) parsePAT(payload []byte) {
+	section := psiSection(payload)
+	if nil == section || section[0] != 0 {
+		return
+	}
+	for cur := 8; cur+4 <= len(section); cur += 4 {
+		program := int(section[cur])<<8 | int(section[cur+1])
+		if program != 0 {
+			//只取第一个节目
+			tsParser.pmtPID = int(section[cur+2]&0x1f)<<8 | int(section[cur+3])
+			return
+		}
+	}
+}
+
+func (tsParser *TsParser) parsePMT(payload []byte) {
+	section := psiSection(payload)
+	if nil == section || section[0] != 2 {
+		return
+	}
+	cur := 12 + (int(section[10]&0xf)<<8 | int(section[11]))
+	videoFound, audioFound := false, false
+	for cur+5 <= len(section) {
+		streamType := int(section[cur])
+		pid := int(section[cur+1]&0x1f)<<8 | int(section[cur+2])
+		cur += 5 + (int(section[cur+3]&0xf)<<8 | int(section[cur+4]))
+		if _, ok := tsParser.pes[pid]; ok {
+			if streamType == streamTypeH264 {
+				videoFound = true
+			} else {
+				audioFound = true
+			}
+			continue
+		}
+		switch {
+		case streamType == streamTypeH264 && false == videoFound:
+			videoFound = true
+		case streamType == streamTypeAAC && false == audioFound:
+			audioFound = true
+		default:
+			if false == tsParser.warnedPIDs[pid] {
+				tsParser.warnedPIDs[pid] = true
+				logger.LOGW("ts stream type " + strconv.Itoa(streamType) + " not supported,pid " + strconv.Itoa(pid))
+			}
+			continue
+		}
+		tsParser.pes[pid] = &pesBuffer{streamType: streamType, cc: -1}
+	}
+}
+
+func (tsParser *TsParser) addPayload(pes *pesBuffer, unitStart bool, cc int, payload []byte, tags []*flv.FlvTag) []*flv.FlvTag {
+	if pes.cc >= 0 {
+		if cc == pes.cc && false == unitStart {
+			//重复包
+			return tags
+		}
+		if cc != (pes.cc+1)&0xf {
+			pes.lost = true
+		}
+	}
+	pes.cc = cc
+	if unitStart {
+		tags = tsParser.flushPES(pes, tags)
+		pes.data = append([]byte{}, payload...)
+		pes.size = 0
+		if len(payload) >= 6 {
+			if size := int(payload[4])<<8 | int(payload[5]); size > 0 {
+				pes.size = 6 + size
+			}
+		}
+	} else {
+		if nil == pes.data {
+			//等待PES开始
+			return tags
+		}
+		pes.data = append(pes.data, payload...)
+	}
+	if pes.size > 0 && len(pes.data) >= pes.size {
+		tags = tsParser.flushPES(pes, tags)
+	}
+	return tags
+}
+
+func (tsParser *TsParser) flushPES(pes *pesBuffer, tags []*flv.FlvTag) []*flv.FlvTag {
+	data := pes.data
+	lost := pes.lost
+	pes.data = nil
+	pes.lost = false
+	if len(data) == 0 {
+		return tags
+	}
+	if lost || len(data) < 9 || data[0] != 0 || data[1] != 0 || data[2] != 1 {
+		if pes.streamType == streamTypeH264 {
+			tsParser.keyFrameWait = true
+		}
+		return tags
+	}
+	if pes.size > 0 {
+		data = data[:pes.size]
+	}
+	flags := data[7]
+	headerSize := 9 + int(data[8])
+	if flags&0x80 == 0 || headerSize > len(data) || len(data) < 14 {
+		//没有pts
+		return tags
+	}
+	pts := readPTS(data[9:])
+	dts := pts
+	if flags&0xc0 == 0xc0 && len(data) >= 19 {
+		dts = readPTS(data[14:])
+	}
+	switch pes.streamType {
+	case streamTypeH264:
+		return tsParser.addH264(data[headerSize:], pts, dts, tags)
+	case streamTypeAAC:
+		return tsParser.addAAC(data[headerSize:], pts, tags)
+	}
+	return tags
+}
+
+func readPTS(data []byte) int64 {
+	return int64(data[0]>>1&7)<<30 | int64(data[1])<<22 | int64(data[2]>>1)<<15 |
+		int64(data[3])<<7 | int64(data[4]>>1)
+}
+
+//timestamp 33位时间戳展开后转为相对第一个时间戳的毫秒,
+//编码器重启等造成的跳变按连续处理
+func (tsParser *TsParser) timestamp(pts int64) uint32 {
+	if false == tsParser.baseSet {
+		tsParser.baseSet = true
+		tsParser.baseTime = pts
+		tsParser.lastTime = pts
+	}
+	diff := (pts - tsParser.lastTime) & ptsMask
+	if diff >= 1<<32 {
+		diff -= 1 << 33
+	}
+	if diff > ptsJumpMax || diff < -ptsJumpMax {
+		logger.LOGW("ts timestamp jump " + strconv.FormatInt(diff/ptsHzPerMs, 10) + " ms")
+		tsParser.baseTime += diff
+	}
+	tsParser.lastTime += diff
+	ms := (tsParser.lastTime - tsParser.baseTime) / ptsHzPerMs
+	if ms < 0 {
+		return 0
+	}
+	return uint32(ms)
+}
+
+func (tsParser *TsParser) addH264(payload []byte, pts, dts int64, tags []*flv.FlvTag) []*flv.FlvTag {
+	var nals [][]byte
+	keyFrame := false
+	for _, nal := range h264.SplitAnnexB(payload) {
+		switch nal[0] & 0x1f {
+		case h264.NalType_sps:
+			if false == bytes.Equal(nal, tsParser.sps) {
+				tsParser.sps = append([]byte{}, nal...)
+				tsParser.avcSent = false
+			}
+		case h264.NalType_pps:
+			if false == bytes.Equal(nal, tsParser.pps) {
+				tsParser.pps = append([]byte{}, nal...)
+				tsParser.avcSent = false
+			}
+		case h264.NalType_aud:
+		case h264.NalType_idr:
+			keyFrame = true
+			nals = append(nals, nal)
+		default:
+			nals = append(nals, nal)
+		}
+	}
+	timestamp := tsParser.timestamp(dts)
+	if false == tsParser.avcSent {
+		record := h264.AVCDecoderConfigurationRecord(tsParser.sps, tsParser.pps)
+		if nil == record {
+			return tags
+		}
+		header := &flv.FlvTag{TagType: flv.FlvTagVideo, Timestamp: timestamp}
+		header.Data = append([]byte{0x17, 0, 0, 0, 0}, record...)
+		tags = append(tags, header)
+		tsParser.avcSent = true
+	}
+	if len(nals) == 0 {
+		return tags
+	}
+	if tsParser.keyFrameWait {
+		if false == keyFrame {
+			return tags
+		}
+		tsParser.keyFrameWait = false
+	}
+	size := 5
+	for _, nal := range nals {
+		size += 4 + len(nal)
+	}
+	cts := ((pts - dts) & ptsMask) / ptsHzPerMs
+	if cts >= 1<<24 {
+		cts = 0
+	}
+	tag := &flv.FlvTag{TagType: flv.FlvTagVideo, Timestamp: timestamp}
+	tag.Data = make([]byte, 0, size)
+	if keyFrame {
+		tag.Data = append(tag.Data, 0x17)
+	} else {
+		tag.Data = append(tag.Data, 0x27)
+	}
+	tag.Data = append(tag.Data, flv.AVCNALU, byte(cts>>16), byte(cts>>8), byte(cts))
+	for _, nal := range nals {
+		tag.Data = append(tag.Data, byte(len(nal)>>24), byte(len(nal)>>16), byte(len(nal)>>8), byte(len(nal)))
+		tag.Data = append(tag.Data, nal...)
+	}
+	return append(tags, tag)
+}
+
+//addAAC 一个PES可能有多个adts帧,时间戳按采样数递增
+func (tsParser *TsParser) addAAC(payload []byte, pts int64, tags []*flv.FlvTag) []*flv.FlvTag {
+	for frames := 0; len(payload) > 0; frames++ {
+		asc, sampleRate, headerSize, frameSize, err := aac.ParseADTSHeader(payload)
+		if err != nil || frameSize > len(payload) {
+			return tags
+		}
+		timestamp := tsParser.timestamp(pts + int64(frames*aacFrameSamples*ptsHzPerMs*1000/sampleRate))
+		if false == bytes.Equal(asc, tsParser.asc) {
+			tsParser.asc = asc
+			header := &flv.FlvTag{TagType: flv.FlvTagAudio, Timestamp: timestamp}
+			header.Data = append([]byte{aacFlvSoundFlag, flv.AACSequenceHeader}, asc...)
+			tags = append(tags, header)
+		}
+		tag := &flv.FlvTag{TagType: flv.FlvTagAudio, Timestamp: timestamp}
+		tag.Data = append([]byte{aacFlvSoundFlag, flv.AACRaw}, payload[headerSize:frameSize]...)
+		tags = append(tags, tag)
+		payload = payload[frameSize:]
+	}
+	return tags
+}
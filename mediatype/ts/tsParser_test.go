@@ -0,0 +1,85 @@
+package ts
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/mediatype/h264"
+)
+
+func TestTsParserRoundTrip(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xec, 0x04, 0x40, 0x00, 0x00, 0x03, 0x00, 0x40, 0x00, 0x00, 0x0c, 0x23, 0xc6, 0x0c, 0x92}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	idr := append([]byte{0x65, 0x88}, bytes.Repeat([]byte{0x11}, 3000)...)
+	slice := append([]byte{0x41, 0x9a}, bytes.Repeat([]byte{0x22}, 500)...)
+	aacFrame := bytes.Repeat([]byte{0x33}, 300)
+	avcFrame := func(frameType byte, cts int, nal []byte) []byte {
+		data := []byte{frameType, 1, byte(cts >> 16), byte(cts >> 8), byte(cts)}
+		data = append(data, byte(len(nal)>>24), byte(len(nal)>>16), byte(len(nal)>>8), byte(len(nal)))
+		return append(data, nal...)
+	}
+	in := []*flv.FlvTag{
+		{TagType: flv.FlvTagAudio, Data: []byte{aacFlvSoundFlag, 0, 0x12, 0x10}},
+		{TagType: flv.FlvTagVideo, Data: append([]byte{0x17, 0, 0, 0, 0}, h264.AVCDecoderConfigurationRecord(sps, pps)...)},
+		{TagType: flv.FlvTagVideo, Timestamp: 1000, Data: avcFrame(0x17, 0, idr)},
+		{TagType: flv.FlvTagAudio, Timestamp: 1000, Data: append([]byte{aacFlvSoundFlag, 1}, aacFrame...)},
+		{TagType: flv.FlvTagVideo, Timestamp: 1040, Data: avcFrame(0x27, 40, slice)},
+		{TagType: flv.FlvTagVideo, Timestamp: 1080, Data: avcFrame(0x27, 0, slice)},
+	}
+	creater := &TsCreater{}
+	for _, tag := range in {
+		creater.AddTag(tag)
+	}
+	var data []byte
+	for e := creater.FlushTsList().Front(); e != nil; e = e.Next() {
+		data = append(data, e.Value.([]byte)...)
+	}
+
+	parser := &TsParser{}
+	var out []*flv.FlvTag
+	//srt payload is not always 188 aligned when it comes from other muxers
+	for len(data) > 0 {
+		size := 1000
+		if size > len(data) {
+			size = len(data)
+		}
+		out = append(out, parser.Parse(data[:size])...)
+		data = data[size:]
+	}
+	//the last video frame ends with the next pes
+	if len(out) != 5 {
+		t.Fatal("tags", len(out))
+	}
+	var videoHeader, audioHeader, keyFrame, audio, inter *flv.FlvTag
+	for _, tag := range out {
+		switch {
+		case flv.IsVideoSequenceHeader(tag):
+			videoHeader = tag
+		case flv.IsAudioSequenceHeader(tag):
+			audioHeader = tag
+		case flv.IsKeyFrame(tag):
+			keyFrame = tag
+		case tag.TagType == flv.FlvTagAudio:
+			audio = tag
+		default:
+			inter = tag
+		}
+	}
+	if nil == videoHeader || false == bytes.Equal(videoHeader.Data, in[1].Data) {
+		t.Fatal("video header")
+	}
+	if nil == audioHeader || false == bytes.Equal(audioHeader.Data, in[0].Data) {
+		t.Fatal("audio header")
+	}
+	//timestamps start from the first pes,audio or video
+	if nil == keyFrame || keyFrame.Timestamp > 1 || false == bytes.Equal(keyFrame.Data, in[2].Data) {
+		t.Fatal("keyframe")
+	}
+	if nil == audio || false == bytes.Equal(audio.Data, in[3].Data) {
+		t.Fatal("audio frame")
+	}
+	if nil == inter || inter.Timestamp-keyFrame.Timestamp != 40 || false == bytes.Equal(inter.Data, in[4].Data) {
+		t.Fatal("inter frame")
+	}
+}
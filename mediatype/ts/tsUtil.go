@@ -1,12 +1,18 @@
 package ts
 
 import (
+	"encoding/binary"
+
 	"github.com/use-go/websocket-streamserver/logger"
 	"github.com/use-go/websocket-streamserver/mediatype/aac"
 	"github.com/use-go/websocket-streamserver/mediatype/amf"
 	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/mediatype/hevc"
 )
 
+//hevc access unit delimiter,pic_type 2
+var hevcAUD = []byte{0x00, 0x00, 0x01, 0x46, 0x01, 0x50}
+
 func (tsCreater *TsCreater) audioPayload(tag *flv.FlvTag) (payload []byte, size int) {
 	if tsCreater.audioTypeId == 0xf {
 		//adth:=aac.GenerateADTHeader(tsCreater.asc,len(tag.Data)-2)
@@ -36,6 +42,14 @@ func (tsCreater *TsCreater) calPcrPtsDts(tag *flv.FlvTag) (pcr, pcrExt, pts, dts
 		logger.LOGF("wtf")
 	}
 	compositionTime, _ := amf.AMF0DecodeInt24(tag.Data[2:])
+	if tag.TagType == flv.FlvTagVideo {
+		//enhanced rtmp has no composition time for CodedFramesX
+		compositionTime = 0
+		video, err := flv.GetVideoTag(tag)
+		if err == nil && video.CompositionTime > 0 {
+			compositionTime = uint32(video.CompositionTime)
+		}
+	}
 	u64 := uint64(compositionTime)
 	dts = timeMS*90 + 90
 	pts = dts + u64*90
@@ -51,3 +65,61 @@ func (tsCreater *TsCreater) calAudioTime(tag *flv.FlvTag) {
 	//logger.LOGD(tsCreater.audioPts)
 	tsCreater.audioPts = tmp
 }
+
+//hevcPayload annex b with aud,vps sps pps are written before irap pictures
+func (tsCreater *TsCreater) hevcPayload(video *flv.VideoTag) (payload []byte) {
+	getKeyframe := false
+	nalList := make([][]byte, 0, 4)
+	data := video.Data
+	for cur := 0; cur+4 <= len(data); {
+		nalSize := int(binary.BigEndian.Uint32(data[cur:]))
+		cur += 4
+		if nalSize <= 0 || cur+nalSize > len(data) {
+			logger.LOGE("invalid hevc nal size")
+			return nil
+		}
+		nal := data[cur : cur+nalSize]
+		cur += nalSize
+		nalType := hevc.NalType(nal)
+		switch {
+		case nalType == hevc.NalTypeVPS:
+			tsCreater.vps = append([]byte{}, nal...)
+		case nalType == hevc.NalTypeSPS:
+			tsCreater.sps = append([]byte{}, nal...)
+		case nalType == hevc.NalTypePPS:
+			tsCreater.pps = append([]byte{}, nal...)
+		case nalType == hevc.NalTypeAUD:
+			//aud is always written
+		default:
+			if hevc.IsIRAP(nalType) {
+				getKeyframe = true
+			}
+			nalList = append(nalList, nal)
+		}
+	}
+	if getKeyframe {
+		tsCreater.keyframeWrited = true
+	} else if false == tsCreater.keyframeWrited {
+		logger.LOGE("no keyframe")
+		return nil
+	}
+	if len(nalList) == 0 {
+		logger.LOGE("no frame")
+		return nil
+	}
+	startCode := []byte{0x00, 0x00, 0x01}
+	payload = append(payload, hevcAUD...)
+	if getKeyframe {
+		for _, ps := range [][]byte{tsCreater.vps, tsCreater.sps, tsCreater.pps} {
+			if len(ps) > 0 {
+				payload = append(payload, startCode...)
+				payload = append(payload, ps...)
+			}
+		}
+	}
+	for _, nal := range nalList {
+		payload = append(payload, startCode...)
+		payload = append(payload, nal...)
+	}
+	return
+}
@@ -0,0 +1,158 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/session"
+)
+
+//ServeHTTP write all metrics in text exposition format
+func ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(Export())
+}
+
+//Export metrics as text exposition format
+func Export() []byte {
+	buf := &bytes.Buffer{}
+	exportStreams(buf)
+	exportDropped(buf)
+	exportSinks(buf)
+	return buf.Bytes()
+}
+
+func exportStreams(buf *bytes.Buffer) {
+	mutexStreams.RLock()
+	list := make([]*StreamStats, 0, len(streams))
+	for _, v := range streams {
+		list = append(list, v)
+	}
+	mutexStreams.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+
+	type streamValue struct {
+		name      string
+		bitrate   float64
+		fps       float64
+		keyFrame  uint32
+		bytesIn   uint64
+		uptimeSec float64
+	}
+	values := make([]streamValue, 0, len(list))
+	now := time.Now()
+	for _, v := range list {
+		v.mutex.Lock()
+		values = append(values, streamValue{name: v.name,
+			bitrate:   v.bitrate,
+			fps:       v.fps,
+			keyFrame:  v.keyFrameInterval,
+			bytesIn:   v.bytesIn,
+			uptimeSec: now.Sub(v.startTime).Seconds()})
+		v.mutex.Unlock()
+	}
+
+	writeHeader(buf, "wss_stream_ingest_bitrate_bps", "gauge", "Ingest bitrate of a live stream in bits per second.")
+	for _, v := range values {
+		fmt.Fprintf(buf, "wss_stream_ingest_bitrate_bps{stream=\"%s\"} %g\n", escapeLabel(v.name), v.bitrate)
+	}
+	writeHeader(buf, "wss_stream_ingest_fps", "gauge", "Ingest video frames per second of a live stream.")
+	for _, v := range values {
+		fmt.Fprintf(buf, "wss_stream_ingest_fps{stream=\"%s\"} %g\n", escapeLabel(v.name), v.fps)
+	}
+	writeHeader(buf, "wss_stream_keyframe_interval_ms", "gauge", "Interval between the last two video keyframes in milliseconds.")
+	for _, v := range values {
+		fmt.Fprintf(buf, "wss_stream_keyframe_interval_ms{stream=\"%s\"} %d\n", escapeLabel(v.name), v.keyFrame)
+	}
+	writeHeader(buf, "wss_stream_ingest_bytes_total", "counter", "Media bytes received from the producer of a live stream.")
+	for _, v := range values {
+		fmt.Fprintf(buf, "wss_stream_ingest_bytes_total{stream=\"%s\"} %d\n", escapeLabel(v.name), v.bytesIn)
+	}
+	writeHeader(buf, "wss_stream_uptime_seconds", "gauge", "Seconds since the live stream got its producer.")
+	for _, v := range values {
+		fmt.Fprintf(buf, "wss_stream_uptime_seconds{stream=\"%s\"} %g\n", escapeLabel(v.name), v.uptimeSec)
+	}
+}
+
+func exportDropped(buf *bytes.Buffer) {
+	mutexDropped.RLock()
+	names := make([]string, 0, len(dropped))
+	values := make(map[string]uint64, len(dropped))
+	for k, v := range dropped {
+		names = append(names, k)
+		values[k] = v
+	}
+	stopped := droppedStopped
+	mutexDropped.RUnlock()
+	sort.Strings(names)
+	writeHeader(buf, "wss_stream_dropped_tags_total", "counter", "Flv tags of a stream dropped for slow or closed clients.")
+	for _, name := range names {
+		fmt.Fprintf(buf, "wss_stream_dropped_tags_total{stream=\"%s\"} %d\n", escapeLabel(name), values[name])
+	}
+	writeHeader(buf, "wss_stopped_streams_dropped_tags_total", "counter", "Flv tags dropped for streams no longer live.")
+	fmt.Fprintf(buf, "wss_stopped_streams_dropped_tags_total %d\n", stopped)
+}
+
+func exportSinks(buf *bytes.Buffer) {
+	counts := make(map[string]int)
+	sent := make(map[sinkKey]uint64)
+	stopped := make(map[string]uint64)
+	mutexSinks.RLock()
+	for k, v := range sentClosed {
+		sent[k] = v
+	}
+	for k, v := range sentStopped {
+		stopped[k] = v
+	}
+	for v := range sinks {
+		if false == httpPlayers[v.protocol] {
+			counts[v.protocol]++
+		}
+		sent[sinkKey{protocol: v.protocol, stream: v.stream}] += v.Bytes()
+	}
+	mutexSinks.RUnlock()
+	for protocol, count := range session.HTTPPlayers() {
+		if httpPlayers[protocol] {
+			counts[protocol] += count
+		}
+	}
+	keys := make([]sinkKey, 0, len(sent))
+	for k := range sent {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].protocol != keys[j].protocol {
+			return keys[i].protocol < keys[j].protocol
+		}
+		return keys[i].stream < keys[j].stream
+	})
+
+	writeHeader(buf, "wss_sinks", "gauge", "Clients playing live streams by protocol.")
+	for _, protocol := range protocols {
+		fmt.Fprintf(buf, "wss_sinks{protocol=\"%s\"} %d\n", protocol, counts[protocol])
+	}
+	writeHeader(buf, "wss_sink_bytes_sent_total", "counter", "Bytes sent to clients by protocol and stream.")
+	for _, k := range keys {
+		fmt.Fprintf(buf, "wss_sink_bytes_sent_total{protocol=\"%s\",stream=\"%s\"} %d\n",
+			k.protocol, escapeLabel(k.stream), sent[k])
+	}
+	writeHeader(buf, "wss_stopped_streams_bytes_sent_total", "counter", "Bytes sent to clients of streams no longer live by protocol.")
+	for _, protocol := range protocols {
+		fmt.Fprintf(buf, "wss_stopped_streams_bytes_sent_total{protocol=\"%s\"} %d\n", protocol, stopped[protocol])
+	}
+}
+
+func writeHeader(buf *bytes.Buffer, name, metricType, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", name, metricType)
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelReplacer.Replace(value)
+}
@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/use-go/websocket-streamserver/session"
+)
+
+func TestExportSinks(t *testing.T) {
+	stream := StreamStarted("live/exp")
+	defer StreamStopped(stream)
+	//one hls source serves two players
+	source := AddSink(ProtocolHLS, "live/exp", "source")
+	source.AddBytes(100)
+	for _, addr := range []string{"10.0.0.1:1000", "10.0.0.2:1000"} {
+		req := httptest.NewRequest("GET", "/hls/live/exp/index.m3u8", nil)
+		req.RemoteAddr = addr
+		if _, err := session.Touch(ProtocolHLS, "live/exp", req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := AddSink(ProtocolRTMP, "live/exp", "a")
+	second := AddSink(ProtocolRTMP, "live/exp", "b")
+	first.AddBytes(10)
+	second.AddBytes(20)
+	//bytes of a client gone stay in the counter
+	DelSink(first)
+	DelSink(first)
+	text := string(Export())
+	for _, line := range []string{
+		"wss_sinks{protocol=\"hls\"} 2\n",
+		"wss_sinks{protocol=\"rtmp\"} 1\n",
+		"wss_sink_bytes_sent_total{protocol=\"hls\",stream=\"live/exp\"} 100\n",
+		"wss_sink_bytes_sent_total{protocol=\"rtmp\",stream=\"live/exp\"} 30\n"} {
+		if false == strings.Contains(text, line) {
+			t.Fatalf("%q not in %s", line, text)
+		}
+	}
+	if strings.Contains(text, "sink=") {
+		t.Fatal("bytes sent labelled by sink")
+	}
+	DelSink(second)
+	DelSink(source)
+}
+
+func TestStoppedStreamFolded(t *testing.T) {
+	stoppedBytes := func() uint64 {
+		mutexSinks.RLock()
+		defer mutexSinks.RUnlock()
+		return sentStopped[ProtocolRTMP]
+	}
+	stoppedDropped := func() uint64 {
+		mutexDropped.RLock()
+		defer mutexDropped.RUnlock()
+		return droppedStopped
+	}
+	bytesBefore, droppedBefore := stoppedBytes(), stoppedDropped()
+
+	stream := StreamStarted("live/fold")
+	gone := AddSink(ProtocolRTMP, "live/fold", "gone")
+	gone.AddBytes(10)
+	gone.AddDropped(3)
+	DelSink(gone)
+	waiting := AddSink(ProtocolRTMP, "live/fold", "waiting")
+	waiting.AddBytes(5)
+	text := string(Export())
+	for _, line := range []string{
+		"wss_sink_bytes_sent_total{protocol=\"rtmp\",stream=\"live/fold\"} 15\n",
+		"wss_stream_dropped_tags_total{stream=\"live/fold\"} 3\n"} {
+		if false == strings.Contains(text, line) {
+			t.Fatalf("%q not in %s", line, text)
+		}
+	}
+
+	StreamStopped(stream)
+	//the client still waiting for a new publisher keeps its own bytes until it is gone
+	waiting.AddDropped(2)
+	text = string(Export())
+	if false == strings.Contains(text, "wss_sink_bytes_sent_total{protocol=\"rtmp\",stream=\"live/fold\"} 5\n") ||
+		strings.Contains(text, "dropped_tags_total{stream=\"live/fold\"}") {
+		t.Fatalf("stopped stream still exported:%s", text)
+	}
+	DelSink(waiting)
+	mutexSinks.RLock()
+	for k := range sentClosed {
+		if k.stream == "live/fold" {
+			t.Error("bytes of the stopped stream kept")
+		}
+	}
+	mutexSinks.RUnlock()
+	if got := stoppedBytes() - bytesBefore; got != 15 {
+		t.Errorf("stopped bytes %d,want 15", got)
+	}
+	if got := stoppedDropped() - droppedBefore; got != 5 {
+		t.Errorf("stopped dropped %d,want 5", got)
+	}
+}
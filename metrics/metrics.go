@@ -0,0 +1,250 @@
+//Package metrics collect stream and sink statistics in memory
+//and export them in prometheus text exposition format
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+)
+
+//sink protocols used as label
+const (
+	ProtocolRTMP      = "rtmp"
+	ProtocolRTSP      = "rtsp"
+	ProtocolWebSocket = "websocket"
+	ProtocolHLS       = "hls"
+	ProtocolDASH      = "dash"
+	ProtocolHTTPFLV   = "httpflv"
+	ProtocolWebRTC    = "webrtc"
+	ProtocolSRT       = "srt"
+)
+
+//rateWindow bitrate and fps are averaged in this window
+const rateWindow = 5 * time.Second
+
+var protocols = []string{ProtocolRTMP, ProtocolRTSP, ProtocolWebSocket, ProtocolHLS, ProtocolDASH, ProtocolHTTPFLV, ProtocolWebRTC, ProtocolSRT}
+
+//httpPlayers sinks of these protocols are one per stream,players are counted from the http sessions
+var httpPlayers = map[string]bool{ProtocolHLS: true, ProtocolDASH: true}
+
+//StreamStats ingest statistics of one source
+type StreamStats struct {
+	mutex            sync.Mutex
+	name             string
+	startTime        time.Time
+	bytesIn          uint64
+	lastKeyTimestamp uint32
+	keyGot           bool
+	keyFrameInterval uint32
+	windowStart      time.Time
+	windowBytes      uint64
+	windowFrames     uint64
+	bitrate          float64
+	fps              float64
+}
+
+//sinkKey bytes sent are exported by protocol and stream
+type sinkKey struct {
+	protocol string
+	stream   string
+}
+
+//SinkStats bytes sent to one client
+type SinkStats struct {
+	protocol string
+	stream   string
+	id       string
+	bytes    uint64
+}
+
+//lock order is mutexStreams,mutexSinks,mutexDropped
+//counters by stream are kept while the stream is live,then folded into the stopped totals
+//so the number of series does not grow with every stream name ever seen
+var (
+	mutexStreams   sync.RWMutex
+	streams        = make(map[string]*StreamStats)
+	mutexDropped   sync.RWMutex
+	dropped        = make(map[string]uint64)
+	droppedStopped uint64
+	mutexSinks     sync.RWMutex
+	sinks          = make(map[*SinkStats]bool)
+	sentClosed     = make(map[sinkKey]uint64) //bytes sent to clients gone
+	sentStopped    = make(map[string]uint64)  //by protocol
+)
+
+//StreamStarted called when a source get its producer
+func StreamStarted(name string) (stats *StreamStats) {
+	stats = &StreamStats{name: name, startTime: time.Now()}
+	stats.windowStart = stats.startTime
+	mutexStreams.Lock()
+	defer mutexStreams.Unlock()
+	streams[name] = stats
+	return
+}
+
+//StreamStopped called when the producer of a source gone
+func StreamStopped(stats *StreamStats) {
+	if nil == stats {
+		return
+	}
+	mutexStreams.Lock()
+	defer mutexStreams.Unlock()
+	if cur, exist := streams[stats.name]; exist && cur == stats {
+		delete(streams, stats.name)
+		foldStream(stats.name)
+	}
+}
+
+//foldStream move the counters of a stopped stream to the totals,mutexStreams held
+func foldStream(name string) {
+	mutexSinks.Lock()
+	for k, v := range sentClosed {
+		if k.stream == name {
+			sentStopped[k.protocol] += v
+			delete(sentClosed, k)
+		}
+	}
+	mutexSinks.Unlock()
+	mutexDropped.Lock()
+	droppedStopped += dropped[name]
+	delete(dropped, name)
+	mutexDropped.Unlock()
+}
+
+//live whether the stream has a producer,mutexStreams held
+func live(name string) bool {
+	_, exist := streams[name]
+	return exist
+}
+
+//AddTag count one ingest tag
+func (stats *StreamStats) AddTag(tag *flv.FlvTag) {
+	if nil == stats || nil == tag {
+		return
+	}
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	size := uint64(len(tag.Data))
+	stats.bytesIn += size
+	stats.windowBytes += size
+	if tag.TagType == flv.FlvTagVideo && len(tag.Data) > 1 && false == flv.IsVideoSequenceHeader(tag) {
+		stats.windowFrames++
+		if flv.IsKeyFrame(tag) {
+			if stats.keyGot && tag.Timestamp > stats.lastKeyTimestamp {
+				stats.keyFrameInterval = tag.Timestamp - stats.lastKeyTimestamp
+			}
+			stats.keyGot = true
+			stats.lastKeyTimestamp = tag.Timestamp
+		}
+	}
+	now := time.Now()
+	elapsed := now.Sub(stats.windowStart)
+	if elapsed >= rateWindow {
+		stats.bitrate = float64(stats.windowBytes*8) / elapsed.Seconds()
+		stats.fps = float64(stats.windowFrames) / elapsed.Seconds()
+		stats.windowStart = now
+		stats.windowBytes = 0
+		stats.windowFrames = 0
+	}
+}
+
+//AddDropped tags of a stream not sent to some client
+func AddDropped(stream string, count int) {
+	if count <= 0 {
+		return
+	}
+	mutexStreams.RLock()
+	defer mutexStreams.RUnlock()
+	mutexDropped.Lock()
+	defer mutexDropped.Unlock()
+	if live(stream) {
+		dropped[stream] += uint64(count)
+	} else {
+		droppedStopped += uint64(count)
+	}
+}
+
+//AddSink register a client,nil returned stats can be used safely
+func AddSink(protocol, stream, id string) (stats *SinkStats) {
+	stats = &SinkStats{protocol: protocol, stream: stream, id: id}
+	mutexSinks.Lock()
+	defer mutexSinks.Unlock()
+	sinks[stats] = true
+	return
+}
+
+//DelSink unregister a client
+func DelSink(stats *SinkStats) {
+	if nil == stats {
+		return
+	}
+	mutexStreams.RLock()
+	defer mutexStreams.RUnlock()
+	mutexSinks.Lock()
+	defer mutexSinks.Unlock()
+	if false == sinks[stats] {
+		return
+	}
+	delete(sinks, stats)
+	if live(stats.stream) {
+		sentClosed[sinkKey{protocol: stats.protocol, stream: stats.stream}] += stats.Bytes()
+	} else {
+		sentStopped[stats.protocol] += stats.Bytes()
+	}
+}
+
+//AddBytes sent to client
+func (stats *SinkStats) AddBytes(size int) {
+	if nil == stats || size <= 0 {
+		return
+	}
+	atomic.AddUint64(&stats.bytes, uint64(size))
+}
+
+//Bytes sent to client
+func (stats *SinkStats) Bytes() uint64 {
+	if nil == stats {
+		return 0
+	}
+	return atomic.LoadUint64(&stats.bytes)
+}
+
+//AddDropped tags of the stream this client playing
+func (stats *SinkStats) AddDropped(count int) {
+	if nil == stats {
+		return
+	}
+	AddDropped(stats.stream, count)
+}
+
+//SinkInfo snapshot of one client
+type SinkInfo struct {
+	Protocol string `json:"protocol"`
+	Stream   string `json:"stream"`
+	ID       string `json:"id"`
+	Bytes    uint64 `json:"bytes"`
+}
+
+//Sinks clients playing stream,all clients if stream is empty
+func Sinks(stream string) (list []SinkInfo) {
+	mutexSinks.RLock()
+	defer mutexSinks.RUnlock()
+	list = make([]SinkInfo, 0)
+	for v := range sinks {
+		if len(stream) > 0 && v.stream != stream {
+			continue
+		}
+		list = append(list, SinkInfo{Protocol: v.protocol, Stream: v.stream, ID: v.id, Bytes: v.Bytes()})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Protocol != list[j].Protocol {
+			return list[i].Protocol < list[j].Protocol
+		}
+		return list[i].ID < list[j].ID
+	})
+	return
+}
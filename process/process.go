@@ -14,13 +14,22 @@ import (
 	"time"
 
 	"github.com/use-go/websocket-streamserver/rtspsrv"
+	"github.com/use-go/websocket-streamserver/authorizer"
 	"github.com/use-go/websocket-streamserver/backend"
 	"github.com/use-go/websocket-streamserver/dash"
 	"github.com/use-go/websocket-streamserver/hls"
+	"github.com/use-go/websocket-streamserver/httpflv"
+	"github.com/use-go/websocket-streamserver/httpmux"
 	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/recorder"
 	"github.com/use-go/websocket-streamserver/rtmp"
+	"github.com/use-go/websocket-streamserver/srt"
+	"github.com/use-go/websocket-streamserver/udpts"
 	"github.com/use-go/websocket-streamserver/streamer"
 	"github.com/use-go/websocket-streamserver/utils"
+	"github.com/use-go/websocket-streamserver/vod"
+	"github.com/use-go/websocket-streamserver/webhook"
+	"github.com/use-go/websocket-streamserver/webrtc"
 	"github.com/use-go/websocket-streamserver/websocket"
 	"github.com/use-go/websocket-streamserver/wssapi"
 )
@@ -41,12 +50,22 @@ type contextConfiguration struct {
 	HLSConfigName           string `json:"HLS"`
 	DASHConfigName          string `json:"DASH,omitempty"`
 	RTSPConfigName          string `json:"RTSP,omitempty"`
+	HTTPFLVConfigName       string `json:"HTTPFLV,omitempty"`
+	WebRTCConfigName        string `json:"WebRTC,omitempty"`
+	SRTConfigName           string `json:"SRT,omitempty"`
+	UDPTSConfigName         string `json:"UDPTS,omitempty"`
+	RecorderConfigName      string `json:"Recorder,omitempty"`
+	VODConfigName           string `json:"VOD,omitempty"`
+	AuthConfigName          string `json:"Auth,omitempty"`
+	WebhookConfigName       string `json:"Webhook,omitempty"`
 }
 
 //context : context holding all the Service that will be launched in Process
 type context struct {
 	servicesRWMutex sync.RWMutex //service sync operation
 	services        map[string]wssapi.MsgHandler
+	serviceOrder    []string          //init order,stop in reverse
+	serviceConfigs  map[string]string //service type -> config file for reload
 }
 
 var processContext *context
@@ -64,9 +83,21 @@ func Run() {
 	processContext.Start(nil)
 }
 
+// Shutdown stop all services,sources closed and clients notified
+func Shutdown() {
+	processContext.Stop(nil)
+}
+
+// Reload the config file of each service without dropping streams
+func Reload() {
+	processContext.reload()
+}
+
 // Init the service Configuration from json file such as hls/dash/rtsp
 func (processCtx *context) Init(msg *wssapi.Msg) (err error) {
 	processCtx.services = make(map[string]wssapi.MsgHandler)
+	processCtx.serviceOrder = make([]string, 0)
+	processCtx.serviceConfigs = make(map[string]string)
 	err = processCtx.loadConfig()
 	if err != nil {
 		logger.LOGE("process load config failed")
@@ -78,6 +109,17 @@ func (processCtx *context) Init(msg *wssapi.Msg) (err error) {
 //Create the needed Service Instance And Save it to HttpMux
 func (processCtx *context) createAllService(msg *wssapi.Msg) (err error) {
 
+	//authorizer must be ready before any client accepted,never run without the configured auth
+	err = authorizer.Init(processConfig.AuthConfigName)
+	if err != nil {
+		logger.LOGF("init authorizer failed:" + err.Error())
+	}
+	//webhook is not necessary,run without it if config invalid
+	err = webhook.Init(processConfig.WebhookConfigName)
+	if err != nil {
+		logger.LOGE("init webhook failed:" + err.Error())
+	}
+
 	//Cretate Streamer Service
 	if true {
 		livingSvr := &streamer.StreamerService{}
@@ -89,9 +131,7 @@ func (processCtx *context) createAllService(msg *wssapi.Msg) (err error) {
 		if err != nil {
 			logger.LOGE(err.Error())
 		} else {
-			processCtx.servicesRWMutex.Lock()
-			processCtx.services[livingSvr.GetType()] = livingSvr
-			processCtx.servicesRWMutex.Unlock()
+			processCtx.addService(livingSvr, processConfig.StreamManagerConfigName)
 		}
 	}
 
@@ -104,9 +144,7 @@ func (processCtx *context) createAllService(msg *wssapi.Msg) (err error) {
 		if err != nil {
 			logger.LOGE(err.Error())
 		} else {
-			processCtx.servicesRWMutex.Lock()
-			processCtx.services[rtmpSvr.GetType()] = rtmpSvr
-			processCtx.servicesRWMutex.Unlock()
+			processCtx.addService(rtmpSvr, processConfig.RTMPConfigName)
 		}
 	}
 
@@ -119,9 +157,7 @@ func (processCtx *context) createAllService(msg *wssapi.Msg) (err error) {
 		if err != nil {
 			logger.LOGE(err.Error())
 		} else {
-			processCtx.servicesRWMutex.Lock()
-			processCtx.services[webSocketSvr.GetType()] = webSocketSvr
-			processCtx.servicesRWMutex.Unlock()
+			processCtx.addService(webSocketSvr, processConfig.WebSocketConfigName)
 		}
 	}
 
@@ -134,9 +170,7 @@ func (processCtx *context) createAllService(msg *wssapi.Msg) (err error) {
 		if err != nil {
 			logger.LOGE(err.Error())
 		} else {
-			processCtx.servicesRWMutex.Lock()
-			processCtx.services[backendSvr.GetType()] = backendSvr
-			processCtx.servicesRWMutex.Unlock()
+			processCtx.addService(backendSvr, processConfig.BackendConfigName)
 		}
 	}
 
@@ -149,9 +183,7 @@ func (processCtx *context) createAllService(msg *wssapi.Msg) (err error) {
 		if err != nil {
 			logger.LOGE(err.Error())
 		} else {
-			processCtx.servicesRWMutex.Lock()
-			processCtx.services[rtspSvr.GetType()] = rtspSvr
-			processCtx.servicesRWMutex.Unlock()
+			processCtx.addService(rtspSvr, processConfig.RTSPConfigName)
 		}
 	}
 	//create HLS Service
@@ -162,9 +194,7 @@ func (processCtx *context) createAllService(msg *wssapi.Msg) (err error) {
 		if err != nil {
 			logger.LOGE(err.Error())
 		} else {
-			processCtx.servicesRWMutex.Lock()
-			processCtx.services[hls.GetType()] = hls
-			processCtx.servicesRWMutex.Unlock()
+			processCtx.addService(hls, processConfig.HLSConfigName)
 		}
 	}
 	//create DASH Service
@@ -175,15 +205,91 @@ func (processCtx *context) createAllService(msg *wssapi.Msg) (err error) {
 		if err != nil {
 			logger.LOGE(err.Error())
 		} else {
-			processCtx.servicesRWMutex.Lock()
-			processCtx.services[dash.GetType()] = dash
-			processCtx.servicesRWMutex.Unlock()
+			processCtx.addService(dash, processConfig.DASHConfigName)
+		}
+	}
+	//create HTTP-FLV Service
+	if len(processConfig.HTTPFLVConfigName) > 0 {
+		httpflvSvr := &httpflv.HTTPFLVService{}
+		msg := &wssapi.Msg{Param1: processConfig.HTTPFLVConfigName}
+		err = httpflvSvr.Init(msg)
+		if err != nil {
+			logger.LOGE(err.Error())
+		} else {
+			processCtx.addService(httpflvSvr, processConfig.HTTPFLVConfigName)
+		}
+	}
+	//create WebRTC WHEP Service
+	if len(processConfig.WebRTCConfigName) > 0 {
+		webrtcSvr := &webrtc.WebRTCService{}
+		msg := &wssapi.Msg{Param1: processConfig.WebRTCConfigName}
+		err = webrtcSvr.Init(msg)
+		if err != nil {
+			logger.LOGE(err.Error())
+		} else {
+			processCtx.addService(webrtcSvr, processConfig.WebRTCConfigName)
+		}
+	}
+	//create SRT Service
+	if len(processConfig.SRTConfigName) > 0 {
+		srtSvr := &srt.SRTService{}
+		msg := &wssapi.Msg{Param1: processConfig.SRTConfigName}
+		err = srtSvr.Init(msg)
+		if err != nil {
+			logger.LOGE(err.Error())
+		} else {
+			processCtx.addService(srtSvr, processConfig.SRTConfigName)
+		}
+	}
+
+	//create UDP TS Service
+	if len(processConfig.UDPTSConfigName) > 0 {
+		udpSvr := &udpts.UDPTSService{}
+		msg := &wssapi.Msg{Param1: processConfig.UDPTSConfigName}
+		err = udpSvr.Init(msg)
+		if err != nil {
+			logger.LOGE(err.Error())
+		} else {
+			processCtx.addService(udpSvr, processConfig.UDPTSConfigName)
+		}
+	}
+	//create Recorder Service
+	if len(processConfig.RecorderConfigName) > 0 {
+		recorderSvr := &recorder.RecorderService{}
+		msg := &wssapi.Msg{Param1: processConfig.RecorderConfigName}
+		err = recorderSvr.Init(msg)
+		if err != nil {
+			logger.LOGE(err.Error())
+		} else {
+			processCtx.addService(recorderSvr, processConfig.RecorderConfigName)
+		}
+	}
+	//create VOD Service
+	if len(processConfig.VODConfigName) > 0 {
+		vodSvr := &vod.VODService{}
+		msg := &wssapi.Msg{Param1: processConfig.VODConfigName}
+		err = vodSvr.Init(msg)
+		if err != nil {
+			logger.LOGE(err.Error())
+		} else {
+			processCtx.addService(vodSvr, processConfig.VODConfigName)
 		}
 	}
 
 	return
 }
 
+//addService keep the init order for start and stop
+func (processCtx *context) addService(svr wssapi.MsgHandler, configName string) {
+	processCtx.servicesRWMutex.Lock()
+	defer processCtx.servicesRWMutex.Unlock()
+	if _, exist := processCtx.services[svr.GetType()]; false == exist {
+		processCtx.serviceOrder = append(processCtx.serviceOrder, svr.GetType())
+	}
+	processCtx.services[svr.GetType()] = svr
+	processCtx.serviceConfigs[svr.GetType()] = configName
+}
+
 //Load Main configuration file config.json to init Services ，next
 func (processCtx *context) loadConfig() (err error) {
 	configName := ""
@@ -258,7 +364,6 @@ func (processCtx *context) Start(msg *wssapi.Msg) (err error) {
 	//if false {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	//}
-	//httpmux.Start() //remove Logic Design to Start All Service Once
 	processCtx.servicesRWMutex.RLock()
 	defer processCtx.servicesRWMutex.RUnlock()
 
@@ -267,25 +372,80 @@ func (processCtx *context) Start(msg *wssapi.Msg) (err error) {
 		return errors.New("no service avaiable")
 	}
 
-	for k, v := range processCtx.services {
+	for _, k := range processCtx.serviceOrder {
 		//v.SetParent(processCtx)
-		err = v.Start(nil)
+		err = processCtx.services[k].Start(nil)
 		if err != nil {
 			logger.LOGE("start " + k + " failed:" + err.Error())
 			continue
 		}
 		logger.LOGI("start " + k + " successed ")
 	}
+	//routes of all http based services are added at init,the shared ports listen now
+	httpmux.Start()
 
 	return
 }
 
-//Stop all the launched services
+//Stop all the launched services in reverse init order,
+//protocol services first,streamer closes the sources last
 func (processCtx *context) Stop(msg *wssapi.Msg) (err error) {
+	//服务停止时还会通过HandleTask互相调用,不能一直持有锁
 	processCtx.servicesRWMutex.RLock()
-	defer processCtx.servicesRWMutex.RUnlock()
-	for _, v := range processCtx.services {
-		err = v.Stop(nil)
+	order := make([]string, len(processCtx.serviceOrder))
+	copy(order, processCtx.serviceOrder)
+	processCtx.servicesRWMutex.RUnlock()
+	//no new http requests while the services stop
+	httpmux.Stop()
+	for i := len(order) - 1; i >= 0; i-- {
+		processCtx.servicesRWMutex.RLock()
+		svr, exist := processCtx.services[order[i]]
+		processCtx.servicesRWMutex.RUnlock()
+		if false == exist {
+			continue
+		}
+		logger.LOGI("stop " + order[i])
+		errStop := svr.Stop(nil)
+		if errStop != nil {
+			logger.LOGE("stop " + order[i] + " failed:" + errStop.Error())
+			err = errStop
+		}
+	}
+	//events of stopped services are sent before exit
+	webhook.Stop()
+	return
+}
+
+//reload send each service its config file again,running streams are kept
+func (processCtx *context) reload() (err error) {
+	//keep the old authorizer if the new config invalid
+	err = authorizer.Init(processConfig.AuthConfigName)
+	if err != nil {
+		logger.LOGE("reload authorizer failed:" + err.Error())
+	}
+	if errHook := webhook.Init(processConfig.WebhookConfigName); errHook != nil {
+		logger.LOGE("reload webhook failed:" + errHook.Error())
+		err = errHook
+	}
+	processCtx.servicesRWMutex.RLock()
+	order := make([]string, len(processCtx.serviceOrder))
+	copy(order, processCtx.serviceOrder)
+	processCtx.servicesRWMutex.RUnlock()
+	for _, k := range order {
+		processCtx.servicesRWMutex.RLock()
+		svr, exist := processCtx.services[k]
+		configName := processCtx.serviceConfigs[k]
+		processCtx.servicesRWMutex.RUnlock()
+		if false == exist || len(configName) == 0 {
+			continue
+		}
+		errReload := svr.ProcessMessage(&wssapi.Msg{Type: wssapi.MsgReloadConfig, Param1: configName})
+		if errReload != nil {
+			logger.LOGE("reload " + k + " failed:" + errReload.Error())
+			err = errReload
+			continue
+		}
+		logger.LOGI("reload " + k + " from " + configName)
 	}
 	return
 }
@@ -0,0 +1,303 @@
+package recorder
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/events/eLiveListCtrl"
+	"github.com/use-go/websocket-streamserver/events/eRecordEvent"
+	"github.com/use-go/websocket-streamserver/events/eStreamerEvent"
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/utils"
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+//record format
+const (
+	FormatFLV  = "flv"
+	FormatFMP4 = "fmp4"
+)
+
+const checkLiveInterval = 2 * time.Second
+
+//RecorderService record live streams to disk
+type RecorderService struct {
+	mutexRecords sync.RWMutex
+	records      map[string]*streamRecorder
+	//后台手动开启/关闭,优先于配置规则
+	manual  map[string]string
+	running bool
+}
+
+//RecordRule stream is path.Match pattern of app/streamName,first matched rule used
+type RecordRule struct {
+	Stream string `json:"stream"`
+	Enable bool   `json:"enable"`
+	Format string `json:"format,omitempty"`
+}
+
+//RecorderConfig config
+type RecorderConfig struct {
+	Dir            string       `json:"Dir"`
+	Format         string       `json:"Format"`
+	FileTemplate   string       `json:"FileTemplate"`
+	MaxDurationSec int          `json:"MaxDurationSec"`
+	MaxSizeMB      int          `json:"MaxSizeMB"`
+	Rules          []RecordRule `json:"Rules"`
+}
+
+var service *RecorderService
+
+//serviceConfig *RecorderConfig,rules are read by every stream start,a reload swaps it
+var serviceConfig atomic.Value
+
+//config current config,do not modify it
+func config() *RecorderConfig {
+	cfg, _ := serviceConfig.Load().(*RecorderConfig)
+	if nil == cfg {
+		return &RecorderConfig{}
+	}
+	return cfg
+}
+
+//Init recorder from config file
+func (recorderService *RecorderService) Init(msg *wssapi.Msg) (err error) {
+	defer func() {
+		if nil != err {
+			logger.LOGE(err.Error())
+		}
+	}()
+	if nil == msg || nil == msg.Param1 {
+		err = errors.New("invalid param")
+		return
+	}
+	fileName := msg.Param1.(string)
+	cfg, err := recorderService.loadConfigFile(fileName)
+	if err != nil {
+		return
+	}
+	serviceConfig.Store(cfg)
+	recorderService.records = make(map[string]*streamRecorder)
+	recorderService.manual = make(map[string]string)
+	service = recorderService
+	return
+}
+
+//loadConfigFile read a new config,it is not used until stored
+func (recorderService *RecorderService) loadConfigFile(fileName string) (cfg *RecorderConfig, err error) {
+	buf, err := utils.ReadFileAll(fileName)
+	if err != nil {
+		return
+	}
+	cfg = &RecorderConfig{}
+	err = json.Unmarshal(buf, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Dir) == 0 {
+		cfg.Dir = "record"
+	}
+	if len(cfg.FileTemplate) == 0 {
+		cfg.FileTemplate = "{app}/{stream}/{date}_{time}"
+	}
+	cfg.Format = strings.ToLower(cfg.Format)
+	if cfg.Format != FormatFMP4 {
+		cfg.Format = FormatFLV
+	}
+	return
+}
+
+//Start check live list in background
+func (recorderService *RecorderService) Start(msg *wssapi.Msg) (err error) {
+	recorderService.running = true
+	go recorderService.threadCheckLives()
+	return
+}
+
+//Stop all recorders
+func (recorderService *RecorderService) Stop(msg *wssapi.Msg) (err error) {
+	recorderService.running = false
+	recorderService.mutexRecords.Lock()
+	defer recorderService.mutexRecords.Unlock()
+	for k, v := range recorderService.records {
+		v.Stop(nil)
+		delete(recorderService.records, k)
+	}
+	return
+}
+
+//GetType of service
+func (recorderService *RecorderService) GetType() string {
+	return wssapi.OBJRecorderServer
+}
+
+//HandleTask start/stop/list record
+func (recorderService *RecorderService) HandleTask(task wssapi.Task) (err error) {
+	if task.Receiver() != recorderService.GetType() {
+		return errors.New("not my task")
+	}
+	switch task.Type() {
+	case eRecordEvent.StartRecord:
+		taskStart, ok := task.(*eRecordEvent.EveStartRecord)
+		if false == ok {
+			return errors.New("invalid param to start record")
+		}
+		format := strings.ToLower(taskStart.Format)
+		if format != FormatFLV && format != FormatFMP4 {
+			format = recorderService.ruleFormat(taskStart.StreamName)
+		}
+		recorderService.mutexRecords.Lock()
+		recorderService.manual[taskStart.StreamName] = format
+		recorderService.mutexRecords.Unlock()
+		return recorderService.tryStartRecord(taskStart.StreamName)
+	case eRecordEvent.StopRecord:
+		taskStop, ok := task.(*eRecordEvent.EveStopRecord)
+		if false == ok {
+			return errors.New("invalid param to stop record")
+		}
+		recorderService.mutexRecords.Lock()
+		defer recorderService.mutexRecords.Unlock()
+		recorderService.manual[taskStop.StreamName] = ""
+		rec, exist := recorderService.records[taskStop.StreamName]
+		if exist {
+			rec.Stop(nil)
+			delete(recorderService.records, taskStop.StreamName)
+		}
+		return
+	case eRecordEvent.GetRecordList:
+		taskList, ok := task.(*eRecordEvent.EveGetRecordList)
+		if false == ok {
+			return errors.New("invalid param to get record list")
+		}
+		taskList.Records = list.New()
+		recorderService.mutexRecords.RLock()
+		defer recorderService.mutexRecords.RUnlock()
+		for _, v := range recorderService.records {
+			taskList.Records.PushBack(v.info())
+		}
+		return
+	default:
+		return fmt.Errorf("task %s not prossed", task.Type())
+	}
+}
+
+//ProcessMessage reload config,new rules used by next check
+func (recorderService *RecorderService) ProcessMessage(msg *wssapi.Msg) (err error) {
+	switch msg.Type {
+	case wssapi.MsgReloadConfig:
+		var cfg *RecorderConfig
+		cfg, err = recorderService.loadConfigFile(msg.Param1.(string))
+		if err == nil {
+			serviceConfig.Store(cfg)
+		}
+	}
+	return
+}
+
+//recordFormat 返回空表示不录制
+func (recorderService *RecorderService) recordFormat(streamName string) string {
+	recorderService.mutexRecords.RLock()
+	format, exist := recorderService.manual[streamName]
+	recorderService.mutexRecords.RUnlock()
+	if exist {
+		return format
+	}
+	for _, rule := range config().Rules {
+		matched, err := path.Match(rule.Stream, streamName)
+		if err != nil {
+			logger.LOGW("bad record rule:" + rule.Stream)
+			continue
+		}
+		if matched {
+			if false == rule.Enable {
+				return ""
+			}
+			return recorderService.ruleFormat(streamName)
+		}
+	}
+	return ""
+}
+
+//ruleFormat 规则里的格式,没有则用全局格式
+func (recorderService *RecorderService) ruleFormat(streamName string) string {
+	for _, rule := range config().Rules {
+		if matched, _ := path.Match(rule.Stream, streamName); matched {
+			format := strings.ToLower(rule.Format)
+			if format == FormatFLV || format == FormatFMP4 {
+				return format
+			}
+			break
+		}
+	}
+	return config().Format
+}
+
+func (recorderService *RecorderService) threadCheckLives() {
+	for recorderService.running {
+		eve := &eLiveListCtrl.EveGetLiveList{}
+		err := wssapi.HandleTask(eve)
+		if err == nil && eve.Lives != nil {
+			for e := eve.Lives.Front(); e != nil; e = e.Next() {
+				info := e.Value.(*eLiveListCtrl.LiveInfo)
+				if len(recorderService.recordFormat(info.StreamName)) > 0 {
+					recorderService.tryStartRecord(info.StreamName)
+				}
+			}
+		}
+		recorderService.clearStopped()
+		time.Sleep(checkLiveInterval)
+	}
+}
+
+//tryStartRecord 只录制有推流者的源,避免触发回源
+func (recorderService *RecorderService) tryStartRecord(streamName string) (err error) {
+	format := recorderService.recordFormat(streamName)
+	if len(format) == 0 {
+		return
+	}
+	recorderService.mutexRecords.RLock()
+	rec, exist := recorderService.records[streamName]
+	recorderService.mutexRecords.RUnlock()
+	if exist && false == rec.isStopped() {
+		return
+	}
+	taskGet := &eStreamerEvent.EveGetSource{StreamName: streamName}
+	wssapi.HandleTask(taskGet)
+	if false == utils.InterfaceValid(taskGet.SrcObj) || false == taskGet.HasProducer {
+		return
+	}
+
+	rec = &streamRecorder{}
+	err = rec.Init(&wssapi.Msg{Param1: streamName, Param2: format})
+	if err != nil {
+		logger.LOGE("start record " + streamName + " failed:" + err.Error())
+		return
+	}
+	recorderService.mutexRecords.Lock()
+	defer recorderService.mutexRecords.Unlock()
+	old, exist := recorderService.records[streamName]
+	if exist && false == old.isStopped() {
+		rec.Stop(nil)
+		return
+	}
+	recorderService.records[streamName] = rec
+	logger.LOGT("start record:" + streamName + " " + format)
+	return
+}
+
+func (recorderService *RecorderService) clearStopped() {
+	recorderService.mutexRecords.Lock()
+	defer recorderService.mutexRecords.Unlock()
+	for k, v := range recorderService.records {
+		if v.isStopped() {
+			delete(recorderService.records, k)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package recorder
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/mediatype/mp4"
+)
+
+func createRecordFile(fileName string) (fp *os.File, err error) {
+	err = os.MkdirAll(filepath.Dir(fileName), os.ModePerm)
+	if err != nil {
+		return
+	}
+	return os.Create(fileName)
+}
+
+//flvRecordWriter flv file
+type flvRecordWriter struct {
+	fp       *os.File
+	fileSize int64
+}
+
+func newFLVRecordWriter(fileName string, hasAudio, hasVideo bool) (writer *flvRecordWriter, err error) {
+	fp, err := createRecordFile(fileName)
+	if err != nil {
+		return
+	}
+	writer = &flvRecordWriter{fp: fp}
+	err = writer.write(flv.FlvFileHeader(hasAudio, hasVideo))
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	return
+}
+
+func (writer *flvRecordWriter) write(data []byte) (err error) {
+	n, err := writer.fp.Write(data)
+	writer.fileSize += int64(n)
+	return
+}
+
+func (writer *flvRecordWriter) writeTag(tag *flv.FlvTag) error {
+	return writer.write(tag.ToBytes())
+}
+
+func (writer *flvRecordWriter) size() int64 {
+	return writer.fileSize
+}
+
+func (writer *flvRecordWriter) close() error {
+	return writer.fp.Close()
+}
+
+//fmp4RecordWriter FMP4Creater 的音视频是独立的track,两个初始化段合并后和所有分片写入同一个文件
+type fmp4RecordWriter struct {
+	fp        *os.File
+	creater   *mp4.FMP4Creater
+	hasAudio  bool
+	hasVideo  bool
+	videoInit []byte
+	audioInit []byte
+	inited    bool
+	fileSize  int64
+}
+
+func newFMP4RecordWriter(fileName string, hasAudio, hasVideo bool) (writer *fmp4RecordWriter, err error) {
+	fp, err := createRecordFile(fileName)
+	if err != nil {
+		return
+	}
+	writer = &fmp4RecordWriter{fp: fp, hasAudio: hasAudio, hasVideo: hasVideo}
+	writer.creater = &mp4.FMP4Creater{}
+	return
+}
+
+func (writer *fmp4RecordWriter) write(data []byte) (err error) {
+	n, err := writer.fp.Write(data)
+	writer.fileSize += int64(n)
+	return
+}
+
+func (writer *fmp4RecordWriter) writeTag(tag *flv.FlvTag) (err error) {
+	if tag.TagType == flv.FlvTagScriptData {
+		return
+	}
+	slice := writer.creater.AddFlvTag(tag)
+	if nil == slice || len(slice.Data) == 0 {
+		return
+	}
+	if slice.Idx == -1 {
+		if writer.inited {
+			//文件中途不再写初始化段,音视频头变化时会切新文件
+			return
+		}
+		switch slice.Type {
+		case flv.FlvTagVideo:
+			writer.videoInit = slice.Data
+		case flv.FlvTagAudio:
+			writer.audioInit = slice.Data
+		}
+		if (writer.hasVideo && nil == writer.videoInit) || (writer.hasAudio && nil == writer.audioInit) {
+			return
+		}
+		var initData []byte
+		initData, err = mp4.MergeInitSegments(writer.videoInit, writer.audioInit)
+		if err != nil {
+			return
+		}
+		writer.inited = true
+		return writer.write(initData)
+	}
+	if false == writer.inited {
+		//init segment 还没有生成
+		return
+	}
+	return writer.write(slice.Data)
+}
+
+func (writer *fmp4RecordWriter) size() int64 {
+	return writer.fileSize
+}
+
+func (writer *fmp4RecordWriter) close() error {
+	return writer.fp.Close()
+}
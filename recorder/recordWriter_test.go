@@ -0,0 +1,165 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/mediatype/h264"
+	"github.com/use-go/websocket-streamserver/mediatype/mp4"
+)
+
+type testBox struct {
+	name    string
+	payload []byte
+}
+
+func splitBoxes(t *testing.T, data []byte) (boxes []testBox) {
+	for len(data) > 0 {
+		if len(data) < 8 {
+			t.Fatalf("box truncated %d", len(data))
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			t.Fatalf("box size %d", size)
+		}
+		boxes = append(boxes, testBox{name: string(data[4:8]), payload: data[8:size]})
+		data = data[size:]
+	}
+	return
+}
+
+func childBoxes(t *testing.T, boxes []testBox, name string) (children [][]testBox) {
+	for _, box := range boxes {
+		if box.name == name {
+			children = append(children, splitBoxes(t, box.payload))
+		}
+	}
+	return
+}
+
+//trackIDs of tkhd in moov,tfhd in moof or trex in mvex,the id follows version and flags
+//except for tkhd where times come first
+func trackIDs(t *testing.T, boxes []testBox, name string) (ids []uint32) {
+	for _, box := range boxes {
+		if box.name != name {
+			continue
+		}
+		offset := 4
+		if name == "tkhd" {
+			offset = 12
+			if box.payload[0] == 1 {
+				offset = 20
+			}
+		}
+		ids = append(ids, binary.BigEndian.Uint32(box.payload[offset:]))
+	}
+	return
+}
+
+func TestFMP4RecordWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "live", "hks.mp4")
+	writer, err := newFMP4RecordWriter(fileName, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sps := []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xec, 0x04, 0x40, 0x00, 0x00, 0x03, 0x00, 0x40, 0x00, 0x00, 0x0c, 0x23, 0xc6, 0x0c, 0x92}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	avcFrame := func(frameType byte, nal []byte) []byte {
+		data := []byte{frameType, 1, 0, 0, 0, byte(len(nal) >> 24), byte(len(nal) >> 16), byte(len(nal) >> 8), byte(len(nal))}
+		return append(data, nal...)
+	}
+	videoHeader := &flv.FlvTag{TagType: flv.FlvTagVideo, Data: append([]byte{0x17, 0, 0, 0, 0}, h264.AVCDecoderConfigurationRecord(sps, pps)...)}
+	audioHeader := &flv.FlvTag{TagType: flv.FlvTagAudio, Data: []byte{0xaf, 0, 0x12, 0x10}}
+	frames := []*flv.FlvTag{
+		{TagType: flv.FlvTagVideo, Timestamp: 1000, Data: avcFrame(0x17, append([]byte{0x65, 0x88}, bytes.Repeat([]byte{0x11}, 500)...))},
+		{TagType: flv.FlvTagAudio, Timestamp: 1000, Data: append([]byte{0xaf, 1}, bytes.Repeat([]byte{0x33}, 100)...)},
+		{TagType: flv.FlvTagVideo, Timestamp: 1040, Data: avcFrame(0x27, []byte{0x41, 0x9a, 0x22})},
+	}
+	tags := []*flv.FlvTag{{TagType: flv.FlvTagScriptData, Data: []byte{2, 0, 10}}, videoHeader}
+	//a frame before the audio header has no init segment to follow
+	tags = append(tags, frames[0], audioHeader)
+	tags = append(tags, frames...)
+	//headers repeated mid file are not written again
+	tags = append(tags, videoHeader)
+	for _, tag := range tags {
+		if err = writer.writeTag(tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = writer.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != writer.size() {
+		t.Fatalf("size %d,file %d", writer.size(), len(data))
+	}
+	boxes := splitBoxes(t, data)
+	if len(boxes) < 3 || boxes[0].name != "ftyp" || boxes[1].name != "moov" {
+		t.Fatalf("file should start with one init segment %v", boxes[0].name)
+	}
+	initSize := 0
+	for i, box := range boxes {
+		if i > 1 && (box.name == "ftyp" || box.name == "moov") {
+			t.Fatalf("init segment written again at box %d", i)
+		}
+		if i < 2 {
+			initSize += 8 + len(box.payload)
+		}
+	}
+
+	moov := splitBoxes(t, boxes[1].payload)
+	var trakIDs []uint32
+	for _, trak := range childBoxes(t, moov, "trak") {
+		trakIDs = append(trakIDs, trackIDs(t, trak, "tkhd")...)
+	}
+	mvex := childBoxes(t, moov, "mvex")
+	if len(trakIDs) != 2 || trakIDs[0] == trakIDs[1] || len(mvex) != 1 {
+		t.Fatalf("tracks %v", trakIDs)
+	}
+	if trexIDs := trackIDs(t, mvex[0], "trex"); len(trexIDs) != 2 || trexIDs[0] != trakIDs[0] || trexIDs[1] != trakIDs[1] {
+		t.Fatalf("trex %v,tracks %v", trexIDs, trakIDs)
+	}
+	fragmentIDs := make(map[uint32]int)
+	for _, moof := range childBoxes(t, boxes, "moof") {
+		for _, traf := range childBoxes(t, moof, "traf") {
+			for _, id := range trackIDs(t, traf, "tfhd") {
+				fragmentIDs[id]++
+			}
+		}
+	}
+	if len(fragmentIDs) != 2 || fragmentIDs[trakIDs[0]] != 2 || fragmentIDs[trakIDs[1]] != 1 {
+		t.Fatalf("fragments by track %v,tracks %v", fragmentIDs, trakIDs)
+	}
+
+	parser := &mp4.FMP4Parser{}
+	if err = parser.ParseInit(data[:initSize]); err != nil {
+		t.Fatal(err)
+	}
+	out, err := parser.Parse(data[initSize:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 2+len(frames) || false == bytes.Equal(out[0].Data, videoHeader.Data) || false == flv.IsAudioSequenceHeader(out[1]) {
+		t.Fatalf("tags %d", len(out))
+	}
+	for i, tag := range frames {
+		if out[i+2].TagType != tag.TagType || false == bytes.Equal(out[i+2].Data, tag.Data) {
+			t.Fatalf("frame %d %x", i, out[i+2].Data)
+		}
+	}
+}
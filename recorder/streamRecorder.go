@@ -0,0 +1,315 @@
+package recorder
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/events/eRecordEvent"
+	"github.com/use-go/websocket-streamserver/events/eStreamerEvent"
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/utils"
+	"github.com/use-go/websocket-streamserver/webhook"
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+const tagCacheSize = 4096
+
+//streamRecorder sink of one stream,write tags in its own goroutine
+type streamRecorder struct {
+	streamName    string
+	format        string
+	clientID      string
+	sinkAdded     bool
+	chTags        chan *flv.FlvTag
+	chQuit        chan bool
+	mutexQuit     sync.Mutex
+	quit          bool
+	mutexWriter   sync.RWMutex
+	writer        recordWriter
+	fileName      string
+	fileBegin     uint32
+	headerChanged bool
+	metadata      *flv.FlvTag
+	audioHeader   *flv.FlvTag
+	videoHeader   *flv.FlvTag
+}
+
+//recordWriter one record file
+type recordWriter interface {
+	writeTag(tag *flv.FlvTag) error
+	size() int64
+	close() error
+}
+
+//Init add sink to source
+func (rec *streamRecorder) Init(msg *wssapi.Msg) (err error) {
+	rec.streamName = msg.Param1.(string)
+	rec.format = msg.Param2.(string)
+	rec.clientID = utils.GenerateGUID()
+	rec.chTags = make(chan *flv.FlvTag, tagCacheSize)
+	rec.chQuit = make(chan bool)
+	go rec.threadWrite()
+
+	taskAddSink := &eStreamerEvent.EveAddSink{
+		StreamName: rec.streamName,
+		SinkId:     rec.clientID,
+		Sinker:     rec}
+	err = wssapi.HandleTask(taskAddSink)
+	if err != nil || false == taskAddSink.Added {
+		rec.close()
+		if nil == err {
+			err = errors.New("add record sink failed")
+		}
+		return
+	}
+	rec.sinkAdded = true
+	return
+}
+
+//Start nothing to do
+func (rec *streamRecorder) Start(msg *wssapi.Msg) (err error) {
+	return
+}
+
+//Stop del sink and close file
+func (rec *streamRecorder) Stop(msg *wssapi.Msg) (err error) {
+	rec.close()
+	if rec.sinkAdded {
+		taskDelSink := &eStreamerEvent.EveDelSink{}
+		taskDelSink.StreamName = rec.streamName
+		taskDelSink.SinkId = rec.clientID
+		go wssapi.HandleTask(taskDelSink)
+		rec.sinkAdded = false
+	}
+	return
+}
+
+//GetType of recorder
+func (rec *streamRecorder) GetType() string {
+	return "streamRecorder"
+}
+
+//HandleTask not implemention
+func (rec *streamRecorder) HandleTask(task wssapi.Task) (err error) {
+	return
+}
+
+//ProcessMessage called by source,must not block
+func (rec *streamRecorder) ProcessMessage(msg *wssapi.Msg) (err error) {
+	switch msg.Type {
+	case wssapi.MsgGetSourceNotify, wssapi.MsgPlayStart:
+	case wssapi.MsgGetSourceFailed, wssapi.MsgPlayStop:
+		logger.LOGT("record source stopped:" + rec.streamName)
+		rec.close()
+	case wssapi.MsgFlvTag:
+		tag, ok := msg.Param1.(*flv.FlvTag)
+		if false == ok {
+			return errors.New("invalid flv tag")
+		}
+		select {
+		case <-rec.chQuit:
+			return errors.New("recorder closed")
+		case rec.chTags <- tag:
+		default:
+			return errors.New("disk too slow to record:" + rec.streamName)
+		}
+	default:
+		logger.LOGW(msg.Type + " not processed")
+	}
+	return
+}
+
+func (rec *streamRecorder) close() {
+	rec.mutexQuit.Lock()
+	defer rec.mutexQuit.Unlock()
+	if false == rec.quit {
+		rec.quit = true
+		close(rec.chQuit)
+	}
+}
+
+func (rec *streamRecorder) isStopped() bool {
+	rec.mutexQuit.Lock()
+	defer rec.mutexQuit.Unlock()
+	return rec.quit
+}
+
+func (rec *streamRecorder) info() *eRecordEvent.RecordInfo {
+	info := &eRecordEvent.RecordInfo{StreamName: rec.streamName, Format: rec.format}
+	rec.mutexWriter.RLock()
+	defer rec.mutexWriter.RUnlock()
+	info.FileName = rec.fileName
+	if nil != rec.writer {
+		info.Size = rec.writer.size()
+	}
+	return info
+}
+
+func (rec *streamRecorder) threadWrite() {
+	defer func() {
+		rec.closeFile()
+		logger.LOGT("stop record:" + rec.streamName)
+	}()
+	for {
+		select {
+		case tag := <-rec.chTags:
+			err := rec.writeTag(tag)
+			if err != nil {
+				logger.LOGE("record " + rec.streamName + " failed:" + err.Error())
+				rec.close()
+				return
+			}
+		case <-rec.chQuit:
+			return
+		}
+	}
+}
+
+func (rec *streamRecorder) writeTag(tag *flv.FlvTag) (err error) {
+	isHeader := false
+	switch tag.TagType {
+	case flv.FlvTagScriptData:
+		isHeader = true
+		rec.metadata = tag.Copy()
+		rec.metadata.Timestamp = 0
+	case flv.FlvTagAudio:
+		if flv.IsAudioSequenceHeader(tag) {
+			isHeader = true
+			rec.audioHeader = tag.Copy()
+			rec.audioHeader.Timestamp = 0
+		}
+	case flv.FlvTagVideo:
+		if flv.IsVideoSequenceHeader(tag) {
+			isHeader = true
+			rec.videoHeader = tag.Copy()
+			rec.videoHeader.Timestamp = 0
+		}
+	}
+	if isHeader {
+		//音视频头在新文件开头写入,中途变化则在下个关键帧切文件
+		rec.headerChanged = nil != rec.writer
+		return
+	}
+	if rec.needNewFile(tag) {
+		err = rec.createFile(tag.Timestamp)
+		if err != nil {
+			return
+		}
+	}
+	if nil == rec.writer {
+		//等待第一个关键帧
+		return
+	}
+	out := &flv.FlvTag{TagType: tag.TagType, StreamID: tag.StreamID, Data: tag.Data}
+	if tag.Timestamp > rec.fileBegin {
+		out.Timestamp = tag.Timestamp - rec.fileBegin
+	}
+	return rec.writer.writeTag(out)
+}
+
+//needNewFile 视频流只在关键帧处切文件
+func (rec *streamRecorder) needNewFile(tag *flv.FlvTag) bool {
+	if nil != rec.videoHeader {
+		if false == flv.IsKeyFrame(tag) {
+			return false
+		}
+	} else if tag.TagType != flv.FlvTagAudio {
+		return false
+	}
+	if nil == rec.writer || rec.headerChanged {
+		return true
+	}
+	if config().MaxDurationSec > 0 && tag.Timestamp >= rec.fileBegin &&
+		tag.Timestamp-rec.fileBegin >= uint32(config().MaxDurationSec*1000) {
+		return true
+	}
+	if config().MaxSizeMB > 0 && rec.writer.size() >= int64(config().MaxSizeMB)*1024*1024 {
+		return true
+	}
+	return false
+}
+
+func (rec *streamRecorder) createFile(timestamp uint32) (err error) {
+	rec.closeFile()
+	baseName := filepath.Join(config().Dir, recordFileName(config().FileTemplate, rec.streamName, time.Now()))
+	ext := ".flv"
+	if rec.format == FormatFMP4 {
+		ext = ".mp4"
+	}
+	//同一秒内切文件时不覆盖
+	fileName := baseName
+	for i := 1; ; i++ {
+		if _, errStat := os.Stat(fileName + ext); os.IsNotExist(errStat) {
+			break
+		}
+		fileName = baseName + "_" + strconv.Itoa(i)
+	}
+	fileName += ext
+	var writer recordWriter
+	if rec.format == FormatFMP4 {
+		writer, err = newFMP4RecordWriter(fileName, nil != rec.audioHeader, nil != rec.videoHeader)
+	} else {
+		writer, err = newFLVRecordWriter(fileName, nil != rec.audioHeader, nil != rec.videoHeader)
+	}
+	if err != nil {
+		return
+	}
+	for _, header := range []*flv.FlvTag{rec.metadata, rec.audioHeader, rec.videoHeader} {
+		if nil == header {
+			continue
+		}
+		err = writer.writeTag(header)
+		if err != nil {
+			writer.close()
+			return
+		}
+	}
+	rec.mutexWriter.Lock()
+	rec.writer = writer
+	rec.fileName = fileName
+	rec.fileBegin = timestamp
+	rec.mutexWriter.Unlock()
+	rec.headerChanged = false
+	logger.LOGT("record new file:" + fileName)
+	return
+}
+
+func (rec *streamRecorder) closeFile() {
+	rec.mutexWriter.Lock()
+	defer rec.mutexWriter.Unlock()
+	if nil != rec.writer {
+		size := rec.writer.size()
+		err := rec.writer.close()
+		if err != nil {
+			logger.LOGE(err.Error())
+		}
+		rec.writer = nil
+		webhook.Notify(&webhook.Event{Event: webhook.EventRecordDone,
+			StreamName: rec.streamName,
+			File:       rec.fileName,
+			FileSize:   size})
+	}
+}
+
+//recordFileName 模板支持 {app} {stream} {date} {time} {unix}
+func recordFileName(template, streamName string, now time.Time) string {
+	app := ""
+	stream := streamName
+	if idx := strings.LastIndex(streamName, "/"); idx >= 0 {
+		app = streamName[:idx]
+		stream = streamName[idx+1:]
+	}
+	replacer := strings.NewReplacer(
+		"{app}", app,
+		"{stream}", stream,
+		"{date}", now.Format("20060102"),
+		"{time}", now.Format("150405"),
+		"{unix}", strconv.FormatInt(now.Unix(), 10))
+	return replacer.Replace(template)
+}
@@ -1011,6 +1011,32 @@ func (rtmp *RTMP) SendPlay() (err error) {
 	return
 }
 
+//SendPublish publish Link.Path as live on StreamID
+func (rtmp *RTMP) SendPublish() (err error) {
+	pkt := &RTMPPacket{}
+	pkt.ChunkStreamID = RTMP_channel_AV
+	pkt.Fmt = 0
+	pkt.MessageTypeID = RTMP_PACKET_TYPE_INVOKE
+	pkt.MessageStreamID = rtmp.StreamID
+	encoder := &AMF0Encoder{}
+	encoder.Init()
+	encoder.EncodeString("publish")
+	rtmp.NumInvokes++
+	encoder.EncodeNumber(float64(rtmp.NumInvokes))
+	encoder.AppendByte(TAMF0Null)
+	encoder.EncodeString(rtmp.Link.Path)
+	encoder.EncodeString("live")
+	pkt.Body, err = encoder.GetData()
+
+	if err != nil {
+		return
+	}
+	pkt.MessageLength = uint32(len(pkt.Body))
+	err = rtmp.SendPacket(pkt, true)
+
+	return
+}
+
 func (rtmp *RTMP) SendCheckBWResult(transactionID float64) (err error) {
 	pkt := &RTMPPacket{}
 	pkt.ChunkStreamID = RTMP_channel_Invoke
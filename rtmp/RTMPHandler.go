@@ -7,9 +7,13 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/use-go/websocket-streamserver/authorizer"
 	"github.com/use-go/websocket-streamserver/events/eStreamerEvent"
+	"github.com/use-go/websocket-streamserver/events/eVODEvent"
 	"github.com/use-go/websocket-streamserver/logger"
 	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/metrics"
+	"github.com/use-go/websocket-streamserver/session"
 	"github.com/use-go/websocket-streamserver/wssapi"
 	"github.com/use-go/websocket-streamserver/utils"
 )
@@ -20,15 +24,18 @@ type RTMPHandler struct {
 	rtmpInstance *RTMP
 	source       wssapi.MsgHandler
 	sinke        wssapi.MsgHandler
+	mutexAdded   sync.Mutex //srcAdded,sinkAdded and player stats,never held while calling the streamer
 	srcAdded     bool
 	sinkAdded    bool
 	streamName   string
 	clientID     string
 	playInfo     RTMPPlayInfo
 	app          string
+	token        string //token in connect url,used if stream name has no token
 	player       rtmpPlayer
 	publisher    rtmpPublisher
 	srcID        int64
+	session      *session.Session
 }
 type RTMPPlayInfo struct {
 	playReset      bool
@@ -60,27 +67,51 @@ func (rtmpHandler *RTMPHandler) Start(msg *wssapi.Msg) (err error) {
 }
 
 func (rtmpHandler *RTMPHandler) Stop(msg *wssapi.Msg) (err error) {
-	if rtmpHandler.srcAdded {
+	//publisher gets the unpublish status before the source is removed
+	rtmpHandler.publisher.Stop(msg)
+	//service stop and the read goroutine may both get here,the flags are taken by the first one
+	rtmpHandler.mutexAdded.Lock()
+	srcAdded := rtmpHandler.srcAdded
+	sinkAdded := rtmpHandler.sinkAdded
+	rtmpHandler.srcAdded = false
+	rtmpHandler.sinkAdded = false
+	rtmpHandler.mutexAdded.Unlock()
+	if srcAdded {
 		taskDelSrc := &eStreamerEvent.EveDelSource{}
 		taskDelSrc.StreamName = rtmpHandler.streamName
 		taskDelSrc.ID = rtmpHandler.srcID
 		wssapi.HandleTask(taskDelSrc)
 		logger.LOGT("del source:" + rtmpHandler.streamName)
-		rtmpHandler.srcAdded = false
 	}
-	if rtmpHandler.sinkAdded {
+	if sinkAdded {
 		taskDelSink := &eStreamerEvent.EveDelSink{}
 		taskDelSink.StreamName = rtmpHandler.streamName
 		taskDelSink.SinkId = rtmpHandler.clientID
 		wssapi.HandleTask(taskDelSink)
-		rtmpHandler.sinkAdded = false
 		logger.LOGT("del sinker:" + rtmpHandler.clientID)
 	}
 	rtmpHandler.player.Stop(msg)
-	rtmpHandler.publisher.Stop(msg)
+	rtmpHandler.mutexAdded.Lock()
+	stats := rtmpHandler.player.stats
+	rtmpHandler.player.stats = nil
+	rtmpHandler.mutexAdded.Unlock()
+	metrics.DelSink(stats)
 	return
 }
 
+//setAdded change srcAdded or sinkAdded under mutexAdded
+func (rtmpHandler *RTMPHandler) setAdded(flag *bool, added bool) {
+	rtmpHandler.mutexAdded.Lock()
+	*flag = added
+	rtmpHandler.mutexAdded.Unlock()
+}
+
+func (rtmpHandler *RTMPHandler) isAdded(flag *bool) bool {
+	rtmpHandler.mutexAdded.Lock()
+	defer rtmpHandler.mutexAdded.Unlock()
+	return *flag
+}
+
 func (rtmpHandler *RTMPHandler) GetType() string {
 	return rtmpTypeHandler
 }
@@ -100,13 +131,13 @@ func (rtmpHandler *RTMPHandler) ProcessMessage(msg *wssapi.Msg) (err error) {
 	}
 	switch msg.Type {
 	case wssapi.MsgGetSourceNotify:
-		rtmpHandler.sinkAdded = true
+		rtmpHandler.setAdded(&rtmpHandler.sinkAdded, true)
 	case wssapi.MsgGetSourceFailed:
 		//发送404
 		rtmpHandler.rtmpInstance.CmdStatus("error", "NetStream.Play.StreamNotFound",
 			"paly failed", rtmpHandler.streamName, 0, RTMP_channel_Invoke)
 	case wssapi.MsgSourceClosedForce:
-		rtmpHandler.srcAdded = false
+		rtmpHandler.setAdded(&rtmpHandler.srcAdded, false)
 	case wssapi.MsgFlvTag:
 		tag := msg.Param1.(*flv.FlvTag)
 		err = rtmpHandler.player.appendFlvTag(tag)
@@ -128,7 +159,7 @@ func (rtmpHandler *RTMPHandler) ProcessMessage(msg *wssapi.Msg) (err error) {
 		}
 		if false == rtmpHandler.publisher.startPublish() {
 			logger.LOGE("start publish falied")
-			if true == rtmpHandler.srcAdded {
+			if rtmpHandler.isAdded(&rtmpHandler.srcAdded) {
 				taskDelSrc := &eStreamerEvent.EveDelSource{}
 				taskDelSrc.StreamName = rtmpHandler.streamName
 				taskDelSrc.ID = rtmpHandler.srcID
@@ -197,9 +228,15 @@ func (rtmpHandler *RTMPHandler) HandleRTMPPacket(packet *RTMPPacket) (err error)
 
 func (rtmpHandler *RTMPHandler) sendFlvToSrc(pkt *RTMPPacket) (err error) {
 	if rtmpHandler.publisher.isPublishing() && utils.InterfaceValid(rtmpHandler.source) {
+		tag := pkt.ToFLVTag()
+		if false == isSupportedTag(tag) {
+			//不断开推流,丢弃多轨和视频命令等增强型rtmp包
+			logger.LOGW(fmt.Sprintf("drop unsupported flv tag,type %d", tag.TagType))
+			return
+		}
 		msg := &wssapi.Msg{}
 		msg.Type = wssapi.MsgFlvTag
-		msg.Param1 = pkt.ToFLVTag()
+		msg.Param1 = tag
 		err = rtmpHandler.source.ProcessMessage(msg)
 		if err != nil {
 			logger.LOGE(err.Error())
@@ -212,6 +249,22 @@ func (rtmpHandler *RTMPHandler) sendFlvToSrc(pkt *RTMPPacket) (err error) {
 	return
 }
 
+//isSupportedTag legacy and enhanced rtmp single track audio and video
+func isSupportedTag(tag *flv.FlvTag) bool {
+	switch tag.TagType {
+	case flv.FlvTagAudio:
+		_, err := flv.GetAudioTag(tag)
+		return err == nil
+	case flv.FlvTagVideo:
+		video, err := flv.GetVideoTag(tag)
+		if err != nil {
+			return false
+		}
+		return video.FrameType != flv.FrameTypevideoInfoCmdFrame || len(video.Data) > 0
+	}
+	return true
+}
+
 func (rtmpHandler *RTMPHandler) handleInvoke(packet *RTMPPacket) (err error) {
 	var amfobj *AMF0Object
 	if RTMP_PACKET_TYPE_FLEX_MESSAGE == packet.MessageTypeID {
@@ -236,13 +289,17 @@ func (rtmpHandler *RTMPHandler) handleInvoke(packet *RTMPPacket) (err error) {
 		cmdObj := amfobj.AMF0GetPropByIndex(2)
 		if cmdObj != nil {
 			rtmpHandler.app = cmdObj.Value.ObjValue.AMF0GetPropByName("app").Value.StrValue
+			rtmpHandler.app, rtmpHandler.token = authorizer.SplitToken(rtmpHandler.app)
 			if strings.HasSuffix(rtmpHandler.app, "/") {
 				rtmpHandler.app = strings.TrimSuffix(rtmpHandler.app, "/")
 			}
+			if flashVer := cmdObj.Value.ObjValue.AMF0GetPropByName("flashVer"); flashVer != nil {
+				rtmpHandler.session.SetAgent(flashVer.Value.StrValue)
+			}
 		}
-		if rtmpHandler.app != serviceConfig.LivePath {
+		if rtmpHandler.app != config().LivePath {
 			logger.LOGE(rtmpHandler.app)
-			logger.LOGE(serviceConfig.LivePath)
+			logger.LOGE(config().LivePath)
 			logger.LOGW("path wrong")
 		}
 		err = rtmpHandler.rtmpInstance.AcknowledgementBW()
@@ -298,8 +355,16 @@ func (rtmpHandler *RTMPHandler) handleInvoke(packet *RTMPPacket) (err error) {
 				fmt.Sprintf("can not publish (%s).", "publish"), idx)
 			return
 		}
+		//auth before add to source
+		streamName, errAuth := rtmpHandler.authorize(authorizer.ActionPublish, amfobj.AMF0GetPropByIndex(3).Value.StrValue)
+		if errAuth != nil {
+			idx := amfobj.AMF0GetPropByIndex(1).Value.NumValue
+			err = rtmpHandler.rtmpInstance.CmdError("error", "NetStream.Publish.Denied",
+				fmt.Sprintf("publish %s unauthorized:%s", streamName, errAuth.Error()), idx)
+			return
+		}
 		//add to source
-		rtmpHandler.streamName = rtmpHandler.app + "/" + amfobj.AMF0GetPropByIndex(3).Value.StrValue
+		rtmpHandler.streamName = streamName
 		taskAddSrc := &eStreamerEvent.EveAddSource{}
 		taskAddSrc.Producer = rtmpHandler
 		taskAddSrc.StreamName = rtmpHandler.streamName
@@ -321,7 +386,8 @@ func (rtmpHandler *RTMPHandler) handleInvoke(packet *RTMPPacket) (err error) {
 			rtmpHandler.streamName = ""
 			return errors.New("bad name")
 		}
-		rtmpHandler.srcAdded = true
+		rtmpHandler.setAdded(&rtmpHandler.srcAdded, true)
+		rtmpHandler.session.SetStream(rtmpHandler.streamName, true)
 		rtmpHandler.rtmpInstance.Link.Path = amfobj.AMF0GetPropByIndex(2).Value.StrValue
 		if false == rtmpHandler.publisher.startPublish() {
 			logger.LOGE("start publish failed:" + rtmpHandler.streamName)
@@ -340,7 +406,13 @@ func (rtmpHandler *RTMPHandler) handleInvoke(packet *RTMPPacket) (err error) {
 		defer rtmpHandler.mutexStatus.Unlock()
 	//do nothing now
 	case "play":
-		rtmpHandler.streamName = rtmpHandler.app + "/" + amfobj.AMF0GetPropByIndex(3).Value.StrValue
+		streamName, errAuth := rtmpHandler.authorize(authorizer.ActionPlay, amfobj.AMF0GetPropByIndex(3).Value.StrValue)
+		if errAuth != nil {
+			err = rtmpHandler.rtmpInstance.CmdStatus("error", "NetStream.Play.Failed",
+				fmt.Sprintf("play %s unauthorized:%s", streamName, errAuth.Error()), streamName, 0, RTMP_channel_Invoke)
+			return
+		}
+		rtmpHandler.streamName = streamName
 		rtmpHandler.rtmpInstance.Link.Path = rtmpHandler.streamName
 		startTime := -2
 		duration := -1
@@ -396,14 +468,62 @@ func (rtmpHandler *RTMPHandler) handleInvoke(packet *RTMPPacket) (err error) {
 		taskAddSink.StreamName = rtmpHandler.streamName
 		taskAddSink.SinkId = rtmpHandler.clientID
 		taskAddSink.Sinker = rtmpHandler
+		//startTime 单位秒,只对点播有效
+		if rtmpHandler.playInfo.startTime > 0 {
+			taskAddSink.StartMs = int64(rtmpHandler.playInfo.startTime * 1000)
+		}
+		stats := metrics.AddSink(metrics.ProtocolRTMP, rtmpHandler.streamName, rtmpHandler.clientID)
+		rtmpHandler.mutexAdded.Lock()
+		rtmpHandler.player.stats = stats
+		rtmpHandler.mutexAdded.Unlock()
 		err = wssapi.HandleTask(taskAddSink)
 		if err != nil {
+			rtmpHandler.mutexAdded.Lock()
+			rtmpHandler.player.stats = nil
+			rtmpHandler.mutexAdded.Unlock()
+			metrics.DelSink(stats)
 			//404
 			err = rtmpHandler.rtmpInstance.CmdStatus("error", "NetStream.Play.StreamNotFound",
 				"paly failed", rtmpHandler.streamName, 0, RTMP_channel_Invoke)
 			return nil
 		}
-		rtmpHandler.sinkAdded = taskAddSink.Added
+		rtmpHandler.setAdded(&rtmpHandler.sinkAdded, taskAddSink.Added)
+		rtmpHandler.session.SetStream(rtmpHandler.streamName, false)
+	case "pause":
+		if amfobj.Props.Len() < 5 {
+			return
+		}
+		if amfobj.AMF0GetPropByIndex(3).Value.BoolValue {
+			_, err = rtmpHandler.vodControl(eVODEvent.VODPause, 0)
+			if err == nil {
+				err = rtmpHandler.rtmpInstance.CmdStatus("status", "NetStream.Pause.Notify",
+					fmt.Sprintf("Paused %s", rtmpHandler.streamName), rtmpHandler.streamName, 0, RTMP_channel_Invoke)
+			}
+		} else {
+			_, err = rtmpHandler.vodControl(eVODEvent.VODResume, 0)
+			if err == nil {
+				err = rtmpHandler.rtmpInstance.CmdStatus("status", "NetStream.Unpause.Notify",
+					fmt.Sprintf("Unpaused %s", rtmpHandler.streamName), rtmpHandler.streamName, 0, RTMP_channel_Invoke)
+			}
+		}
+		if err != nil {
+			//直播不支持暂停
+			logger.LOGW("pause " + rtmpHandler.streamName + " failed:" + err.Error())
+			return nil
+		}
+	case "seek":
+		if amfobj.Props.Len() < 4 {
+			return
+		}
+		position, errSeek := rtmpHandler.vodControl(eVODEvent.VODSeek, int64(amfobj.AMF0GetPropByIndex(3).Value.NumValue))
+		if errSeek != nil {
+			logger.LOGW("seek " + rtmpHandler.streamName + " failed:" + errSeek.Error())
+			err = rtmpHandler.rtmpInstance.CmdStatus("error", "NetStream.Seek.Failed",
+				"seek failed", rtmpHandler.streamName, 0, RTMP_channel_Invoke)
+			return
+		}
+		err = rtmpHandler.rtmpInstance.CmdStatus("status", "NetStream.Seek.Notify",
+			fmt.Sprintf("Seeking %d (stream ID: 1).", position), rtmpHandler.streamName, 0, RTMP_channel_Invoke)
 	case "_error":
 		amfobj.Dump()
 	case "closeStream":
@@ -414,6 +534,25 @@ func (rtmpHandler *RTMPHandler) handleInvoke(packet *RTMPPacket) (err error) {
 	return
 }
 
+//vodControl 只有点播流支持暂停和seek
+func (rtmpHandler *RTMPHandler) vodControl(action string, positionMs int64) (position int64, err error) {
+	if false == rtmpHandler.isAdded(&rtmpHandler.sinkAdded) {
+		err = errors.New("not playing")
+		return
+	}
+	taskCtrl := &eVODEvent.EveVODControl{}
+	taskCtrl.StreamName = rtmpHandler.streamName
+	taskCtrl.SinkId = rtmpHandler.clientID
+	taskCtrl.Action = action
+	taskCtrl.PositionMs = positionMs
+	err = wssapi.HandleTask(taskCtrl)
+	if err != nil {
+		return
+	}
+	position = taskCtrl.PositionMs
+	return
+}
+
 func (rtmpHandler *RTMPHandler) handle_result(amfobj *AMF0Object) {
 	transactionID := int32(amfobj.AMF0GetPropByIndex(1).Value.NumValue)
 	resultMethod := rtmpHandler.rtmpInstance.methodCache[transactionID]
@@ -447,3 +586,18 @@ func (rtmpHandler *RTMPHandler) isPlaying() bool {
 func (rtmpHandler *RTMPHandler) SetParent(parent wssapi.MsgHandler) {
 	rtmpHandler.parent = parent
 }
+
+//authorize name may carry ?token=,or the token in connect url is used
+func (rtmpHandler *RTMPHandler) authorize(action, name string) (streamName string, err error) {
+	name, token := authorizer.SplitToken(name)
+	if len(token) == 0 {
+		token = rtmpHandler.token
+	}
+	streamName = rtmpHandler.app + "/" + name
+	err = authorizer.Check(&authorizer.Request{Action: action,
+		Protocol:   authorizer.ProtocolRTMP,
+		StreamName: streamName,
+		Token:      token,
+		RemoteAddr: rtmpHandler.rtmpInstance.Conn.RemoteAddr().String()})
+	return
+}
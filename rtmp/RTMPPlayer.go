@@ -9,6 +9,7 @@ import (
 
 	"github.com/use-go/websocket-streamserver/logger"
 	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/metrics"
 	"github.com/use-go/websocket-streamserver/wssapi"
 )
 
@@ -22,7 +23,7 @@ type rtmpPlayer struct {
 	parent         wssapi.MsgHandler
 	playStatus     int
 	mutexStatus    sync.RWMutex
-	playing        bool //true for thread send playing data
+	chStop         chan bool //closed to stop the thread sending playing data
 	waitPlaying    *sync.WaitGroup
 	mutexCache     sync.RWMutex
 	cache          *list.List
@@ -35,6 +36,7 @@ type rtmpPlayer struct {
 	duration       float32
 	reset          bool
 	rtmp           *RTMP
+	stats          *metrics.SinkStats
 }
 
 func (rtmpplayer *rtmpPlayer) Init(msg *wssapi.Msg) (err error) {
@@ -72,8 +74,10 @@ func (rtmpplayer *rtmpPlayer) startPlay() {
 	defer rtmpplayer.mutexStatus.Unlock()
 	switch rtmpplayer.playStatus {
 	case play_idle:
-		go rtmpplayer.threadPlay()
+		rtmpplayer.chStop = make(chan bool)
 		rtmpplayer.playStatus = play_playing
+		rtmpplayer.waitPlaying.Add(1)
+		go rtmpplayer.threadPlay(rtmpplayer.chStop)
 	case play_paused:
 		logger.LOGE("pause not processed")
 		return
@@ -95,7 +99,7 @@ func (rtmpplayer *rtmpPlayer) stopPlay() {
 	case play_playing:
 		//stop play thread
 		//reset
-		rtmpplayer.playing = false
+		close(rtmpplayer.chStop)
 		rtmpplayer.waitPlaying.Wait()
 		rtmpplayer.playStatus = play_idle
 		rtmpplayer.resetCache()
@@ -108,6 +112,8 @@ func (rtmpplayer *rtmpPlayer) pause() {
 }
 
 func (rtmpplayer *rtmpPlayer) IsPlaying() bool {
+	rtmpplayer.mutexStatus.RLock()
+	defer rtmpplayer.mutexStatus.RUnlock()
 	return rtmpplayer.playStatus == play_playing
 }
 
@@ -128,7 +134,7 @@ func (rtmpplayer *rtmpPlayer) appendFlvTag(tag *flv.FlvTag) (err error) {
 		if rtmpplayer.videoHeader == nil {
 			rtmpplayer.videoHeader = tag
 		} else {
-			if (tag.Data[0] >> 4) == 1 {
+			if flv.IsKeyFrame(tag) {
 				rtmpplayer.keyFrameWrited = true
 			} else {
 				return
@@ -162,24 +168,36 @@ func (rtmpplayer *rtmpPlayer) resetCache() {
 	rtmpplayer.cache = list.New()
 }
 
-func (rtmpplayer *rtmpPlayer) threadPlay() {
-	rtmpplayer.playing = true
-	rtmpplayer.waitPlaying.Add(1)
+func (rtmpplayer *rtmpPlayer) threadPlay(chStop chan bool) {
+	//stopPlay waits until the play end status is sent,holding mutexStatus,
+	//so the status is only reset here when the thread ends by itself
 	defer func() {
-		rtmpplayer.waitPlaying.Done()
 		rtmpplayer.sendPlayEnds()
-		rtmpplayer.playStatus = play_idle
+		rtmpplayer.waitPlaying.Done()
+		rtmpplayer.mutexStatus.Lock()
+		select {
+		case <-chStop:
+		default:
+			rtmpplayer.playStatus = play_idle
+		}
+		rtmpplayer.mutexStatus.Unlock()
 	}()
 	rtmpplayer.sendPlayStarts()
 
-	for rtmpplayer.playing == true {
+	for {
+		select {
+		case <-chStop:
+			return
+		default:
+		}
 		rtmpplayer.mutexCache.Lock()
 		if rtmpplayer.cache == nil || rtmpplayer.cache.Len() == 0 {
 			rtmpplayer.mutexCache.Unlock()
 			time.Sleep(10 * time.Millisecond)
 			continue
 		}
-		if rtmpplayer.cache.Len() > serviceConfig.CacheCount {
+		if rtmpplayer.cache.Len() > config().CacheCount {
+			rtmpplayer.stats.AddDropped(rtmpplayer.cache.Len())
 			rtmpplayer.mutexCache.Unlock()
 			//bw not enough
 			rtmpplayer.rtmp.CmdStatus("warning", "NetStream.Play.InsufficientBW",
@@ -197,6 +215,7 @@ func (rtmpplayer *rtmpPlayer) threadPlay() {
 			logger.LOGE("send rtmp packet failed in play")
 			return
 		}
+		rtmpplayer.stats.AddBytes(len(tag.Data))
 	}
 }
 
@@ -0,0 +1,112 @@
+package rtmp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+//readStatus codes of onStatus sent to the client,closed when the connection is closed
+func readStatus(conn net.Conn) chan string {
+	codes := make(chan string, 16)
+	go func() {
+		defer close(codes)
+		rtmp := &RTMP{}
+		rtmp.Init(conn)
+		for {
+			packet, err := rtmp.ReadPacket()
+			if err != nil {
+				return
+			}
+			if packet.MessageTypeID != RTMP_PACKET_TYPE_INVOKE {
+				continue
+			}
+			amfobj, err := AMF0DecodeObj(packet.Body)
+			if err != nil {
+				continue
+			}
+			if code, _ := invokeStatus(amfobj); len(code) > 0 {
+				codes <- code
+			}
+		}
+	}()
+	return codes
+}
+
+func hasStatus(codes chan string, code string) bool {
+	found := false
+	for c := range codes {
+		found = found || c == code
+	}
+	return found
+}
+
+func TestStopSendsStatus(t *testing.T) {
+	server, client := net.Pipe()
+	codes := readStatus(client)
+	rtmp := &RTMP{}
+	rtmp.Init(server)
+	rtmp.Link.Path = "live/stop"
+	player := &rtmpPlayer{}
+	player.Init(&wssapi.Msg{Param1: rtmp})
+	player.startPlay()
+	//connection is closed right after stop,like the service does
+	player.Stop(nil)
+	server.Close()
+	if false == hasStatus(codes, "NetStream.Play.UnpublishNotify") {
+		t.Fatal("player closed before the unpublish notify")
+	}
+
+	server, client = net.Pipe()
+	codes = readStatus(client)
+	rtmp = &RTMP{}
+	rtmp.Init(server)
+	publisher := &rtmpPublisher{}
+	publisher.Init(&wssapi.Msg{Param1: rtmp})
+	go publisher.startPublish()
+	if code := <-codes; code != "NetStream.Publish.Start" {
+		t.Fatal(code)
+	}
+	publisher.Stop(nil)
+	server.Close()
+	if false == hasStatus(codes, "NetStream.Unpublish.Success") {
+		t.Fatal("publisher closed without status")
+	}
+}
+
+func TestPlayEndsByItself(t *testing.T) {
+	old := config()
+	serviceConfig.Store(&RTMPConfig{TimeoutSec: 5, CacheCount: 2})
+	defer serviceConfig.Store(old)
+	server, client := net.Pipe()
+	codes := readStatus(client)
+	rtmp := &RTMP{}
+	rtmp.Init(server)
+	rtmp.Link.Path = "live/slow"
+	player := &rtmpPlayer{}
+	player.Init(&wssapi.Msg{Param1: rtmp})
+	//more than CacheCount queued,the thread gives up at once
+	player.mutexCache.Lock()
+	for i := 0; i < 3; i++ {
+		player.cache.PushBack(&flv.FlvTag{TagType: flv.FlvTagAudio, Data: []byte{0xaf, 0x01}})
+	}
+	player.mutexCache.Unlock()
+	player.startPlay()
+	deadline := time.Now().Add(time.Second)
+	for player.IsPlaying() {
+		if time.Now().After(deadline) {
+			t.Fatal("status not reset after the thread ended")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	//nothing left to stop,stopping twice like the service and the connection do
+	player.Stop(nil)
+	player.Stop(nil)
+	server.Close()
+	if false == hasStatus(codes, "NetStream.Play.InsufficientBW") {
+		t.Fatal("no insufficient bw status")
+	}
+}
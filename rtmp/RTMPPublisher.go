@@ -79,7 +79,7 @@ func (rtmppublisher *rtmpPublisher) stopPublish() bool {
 		logger.LOGE(err.Error())
 		return false
 	}
-	err = rtmppublisher.rtmp.CmdStatus("status", "NetStream.Unpublish.Succes",
+	err = rtmppublisher.rtmp.CmdStatus("status", "NetStream.Unpublish.Success",
 		fmt.Sprintf("unpublish %s", rtmppublisher.rtmp.Link.Path), "", 0, RTMP_channel_Invoke)
 	if err != nil {
 		logger.LOGE(err.Error())
@@ -2,9 +2,9 @@ package rtmp
 
 import (
 	"container/list"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"math/rand"
 	"net"
 	"strconv"
 	"sync"
@@ -89,7 +89,14 @@ func (rtmppuller *RTMPPuller) Start(msg *wssapi.Msg) (err error) {
 	//connect
 	addr := rtmppuller.pullParams.Address + ":" + strconv.Itoa(rtmppuller.pullParams.Port)
 
-	conn, err := net.Dial("tcp", addr)
+	var conn net.Conn
+	if rtmppuller.pullParams.Protocol == "rtmps" {
+		conn, err = tls.Dial("tcp", addr, &tls.Config{
+			ServerName:         rtmppuller.pullParams.Address,
+			InsecureSkipVerify: rtmppuller.pullParams.SkipVerify})
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
 	logger.LOGT(addr)
 	if err != nil {
 		logger.LOGE("connect failed:" + err.Error())
@@ -141,59 +148,7 @@ func (rtmppuller *RTMPPuller) Stop(msg *wssapi.Msg) (err error) {
 }
 
 func (rtmppuller *RTMPPuller) handleShake() (err error) {
-	randomSize := 1528
-	//send c0
-	conn := rtmppuller.rtmp.Conn
-	c0 := make([]byte, 1)
-	c0[0] = 3
-	_, err = utils.TCPWriteTimeDuration(conn, c0, time.Duration(serviceConfig.TimeoutSec)*time.Second)
-	if err != nil {
-		logger.LOGE("send c0 failed")
-		return
-	}
-	//send c1
-	c1 := make([]byte, randomSize+4+4)
-	for idx := 8; idx < len(c1); idx++ {
-		c1[idx] = byte(rand.Intn(255))
-	}
-	_, err = utils.TCPWriteTimeDuration(conn, c1, time.Duration(serviceConfig.TimeoutSec)*time.Second)
-	if err != nil {
-		logger.LOGE("send c1 failed")
-		return
-	}
-	//read s0
-	s0, err := utils.TCPReadTimeDuration(conn, 1, time.Duration(serviceConfig.TimeoutSec)*time.Second)
-	if err != nil {
-		logger.LOGE("read s0 failed")
-		return
-	}
-	logger.LOGT(s0)
-	//read s1
-	s1, err := utils.TCPReadTimeDuration(conn, randomSize+8, time.Duration(serviceConfig.TimeoutSec)*time.Second)
-	if err != nil {
-		logger.LOGE("read s1 failed")
-		return
-	}
-	//send c2
-	_, err = utils.TCPWriteTimeDuration(conn, s1, time.Duration(serviceConfig.TimeoutSec)*time.Second)
-	if err != nil {
-		logger.LOGE("send c2 failed")
-		return
-	}
-	//read s2
-	s2, err := utils.TCPReadTimeDuration(conn, randomSize+8, time.Duration(serviceConfig.TimeoutSec)*time.Second)
-	if err != nil {
-		logger.LOGE("read s2 failed")
-		return
-	}
-	for idx := 0; idx < len(s2); idx++ {
-		if c1[idx] != s2[idx] {
-			logger.LOGE("invalid s2")
-			return errors.New("invalid s2")
-		}
-	}
-	logger.LOGT("handleshake ok")
-	return
+	return clientHandshake(rtmppuller.rtmp.Conn)
 }
 
 func (rtmppuller *RTMPPuller) GetType() string {
@@ -381,7 +336,7 @@ func (rtmppuller *RTMPPuller) processAggregation(pkt *RTMPPacket) (err error) {
 }
 
 func (rtmppuller *RTMPPuller) readRTMPPkt() (packet *RTMPPacket, err error) {
-	err = rtmppuller.rtmp.Conn.SetReadDeadline(time.Now().Add(time.Duration(serviceConfig.TimeoutSec) * time.Second))
+	err = rtmppuller.rtmp.Conn.SetReadDeadline(time.Now().Add(time.Duration(config().TimeoutSec) * time.Second))
 	if err != nil {
 		logger.LOGE(err.Error())
 		return
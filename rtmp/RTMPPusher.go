@@ -0,0 +1,707 @@
+package rtmp
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/events/eRTMPEvent"
+	"github.com/use-go/websocket-streamserver/events/eStreamerEvent"
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/metrics"
+	"github.com/use-go/websocket-streamserver/utils"
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+const (
+	pushRetryMin  = time.Second
+	pushRetryMax  = time.Minute
+	pushChunkSize = 4096
+)
+
+var (
+	errPushStopped       = errors.New("push target removed")
+	errPushSourceStopped = errors.New("local stream stopped")
+)
+
+var (
+	mutexPushers sync.Mutex
+	pushers      = make(map[string]*rtmpPusher)
+)
+
+//rtmpPusher publish a local stream to another rtmp server,
+//it stays a sink of the source while the publisher comes and goes and reconnects by itself
+type rtmpPusher struct {
+	target   eRTMPEvent.PushTarget
+	static   bool //from RTMPConfig.Push
+	created  time.Time
+	protocol string
+	addr     string
+	port     int
+	app      string
+	path     string
+	stop     chan struct{}
+	wake     chan struct{}
+	tags     chan *flv.FlvTag
+	stats    *metrics.SinkStats
+
+	mutex       sync.Mutex
+	conn        net.Conn
+	state       string
+	since       time.Time
+	retries     int
+	lastErr     string
+	attached    bool
+	live        bool
+	publishing  bool
+	waitKey     bool
+	metadata    *flv.FlvTag
+	audioHeader *flv.FlvTag
+	videoHeader *flv.FlvTag
+	//reader answers pings while tags are sent
+	mutexSend sync.Mutex
+}
+
+//addPushTarget start pushing target,a new ID is set if empty
+func addPushTarget(target *eRTMPEvent.PushTarget, static bool) (err error) {
+	target.StreamName = strings.Trim(target.StreamName, "/")
+	if len(target.StreamName) == 0 {
+		return errors.New("need stream name")
+	}
+	if len(target.ID) == 0 {
+		target.ID = utils.GenerateGUID()
+	}
+	pusher := &rtmpPusher{target: *target, static: static}
+	err = pusher.parseURL()
+	if err != nil {
+		return
+	}
+	mutexPushers.Lock()
+	defer mutexPushers.Unlock()
+	if _, exist := pushers[target.ID]; exist {
+		return errors.New("push target exist:" + target.ID)
+	}
+	pusher.init()
+	pushers[target.ID] = pusher
+	logger.LOGI("push " + target.StreamName + " to " + pusher.protocol + "://" + pusher.addr + "/" + pusher.app)
+	go pusher.run()
+	return
+}
+
+//delPushTarget stop pushing,any stream if streamName is empty
+func delPushTarget(streamName, id string) (err error) {
+	mutexPushers.Lock()
+	pusher, exist := pushers[id]
+	if exist && (len(streamName) == 0 || pusher.target.StreamName == strings.Trim(streamName, "/")) {
+		delete(pushers, id)
+	} else {
+		exist = false
+	}
+	mutexPushers.Unlock()
+	if false == exist {
+		return errors.New("push target not found:" + id)
+	}
+	pusher.shutdown()
+	return
+}
+
+//listPushTargets targets of streamName in adding order,all targets if empty
+func listPushTargets(streamName string) (list []eRTMPEvent.PushStatus) {
+	streamName = strings.Trim(streamName, "/")
+	mutexPushers.Lock()
+	all := make([]*rtmpPusher, 0, len(pushers))
+	for _, v := range pushers {
+		if len(streamName) == 0 || v.target.StreamName == streamName {
+			all = append(all, v)
+		}
+	}
+	mutexPushers.Unlock()
+	sort.Slice(all, func(i, j int) bool {
+		if false == all[i].created.Equal(all[j].created) {
+			return all[i].created.Before(all[j].created)
+		}
+		return all[i].target.ID < all[j].target.ID
+	})
+	list = make([]eRTMPEvent.PushStatus, 0, len(all))
+	for _, v := range all {
+		list = append(list, v.status())
+	}
+	return
+}
+
+//syncPushTargets make targets from config same as targets,targets added by api are kept
+func syncPushTargets(targets []eRTMPEvent.PushTarget) {
+	key := func(target *eRTMPEvent.PushTarget) string {
+		return strings.Trim(target.StreamName, "/") + "|" + target.URL
+	}
+	wanted := make(map[string]bool)
+	for i := range targets {
+		wanted[key(&targets[i])] = true
+	}
+	running := make(map[string]bool)
+	mutexPushers.Lock()
+	removed := make([]string, 0)
+	for id, v := range pushers {
+		if false == v.static {
+			continue
+		}
+		if wanted[key(&v.target)] {
+			running[key(&v.target)] = true
+		} else {
+			removed = append(removed, id)
+		}
+	}
+	mutexPushers.Unlock()
+	for _, id := range removed {
+		delPushTarget("", id)
+	}
+	for _, v := range targets {
+		if running[key(&v)] {
+			continue
+		}
+		if err := addPushTarget(&v, true); err != nil {
+			logger.LOGE("add push target failed:" + err.Error())
+		}
+	}
+}
+
+//stopPushTargets stop all targets when service stop
+func stopPushTargets() {
+	mutexPushers.Lock()
+	all := pushers
+	pushers = make(map[string]*rtmpPusher)
+	mutexPushers.Unlock()
+	for _, v := range all {
+		v.shutdown()
+	}
+}
+
+//parseURL rtmp[s]://host[:port]/app[/instance]/stream[?query],the query is part of the stream
+func (pusher *rtmpPusher) parseURL() (err error) {
+	u, err := url.Parse(pusher.target.URL)
+	if err != nil {
+		return errors.New("invalid url:" + pusher.target.URL)
+	}
+	pusher.protocol = strings.ToLower(u.Scheme)
+	pusher.port = 1935
+	if pusher.protocol == "rtmps" {
+		pusher.port = 443
+	} else if pusher.protocol != "rtmp" {
+		return errors.New("only rtmp and rtmps can be pushed to")
+	}
+	if len(u.Port()) > 0 {
+		if pusher.port, err = strconv.Atoi(u.Port()); err != nil {
+			return errors.New("invalid port:" + u.Port())
+		}
+	}
+	subs := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(u.Hostname()) == 0 || len(subs) < 2 || len(subs[len(subs)-1]) == 0 {
+		return errors.New("url should be rtmp://host:port/app/stream")
+	}
+	pusher.addr = u.Hostname()
+	pusher.app = strings.Join(subs[:len(subs)-1], "/")
+	pusher.path = subs[len(subs)-1]
+	if len(u.RawQuery) > 0 {
+		pusher.path += "?" + u.RawQuery
+	}
+	return
+}
+
+func (pusher *rtmpPusher) init() {
+	pusher.created = time.Now()
+	pusher.stop = make(chan struct{})
+	pusher.wake = make(chan struct{}, 1)
+	cacheCount := config().CacheCount
+	if cacheCount <= 0 {
+		cacheCount = rtmpCacheDefault
+	}
+	pusher.tags = make(chan *flv.FlvTag, cacheCount)
+	pusher.stats = metrics.AddSink(metrics.ProtocolRTMP, pusher.target.StreamName, pusher.sinkID())
+	pusher.state = eRTMPEvent.PushWaiting
+	pusher.since = pusher.created
+}
+
+func (pusher *rtmpPusher) sinkID() string {
+	return "push-" + pusher.target.ID
+}
+
+func (pusher *rtmpPusher) shutdown() {
+	close(pusher.stop)
+	pusher.mutex.Lock()
+	defer pusher.mutex.Unlock()
+	if nil != pusher.conn {
+		pusher.conn.Close()
+	}
+}
+
+func (pusher *rtmpPusher) status() eRTMPEvent.PushStatus {
+	pusher.mutex.Lock()
+	defer pusher.mutex.Unlock()
+	return eRTMPEvent.PushStatus{
+		PushTarget: pusher.target,
+		State:      pusher.state,
+		Since:      pusher.since,
+		Retries:    pusher.retries,
+		LastError:  pusher.lastErr,
+		BytesOut:   pusher.stats.Bytes()}
+}
+
+func (pusher *rtmpPusher) setState(state string) {
+	pusher.mutex.Lock()
+	defer pusher.mutex.Unlock()
+	if pusher.state != state {
+		pusher.state = state
+		pusher.since = time.Now()
+	}
+}
+
+func (pusher *rtmpPusher) isLive() bool {
+	pusher.mutex.Lock()
+	defer pusher.mutex.Unlock()
+	return pusher.live
+}
+
+func (pusher *rtmpPusher) notify() {
+	select {
+	case pusher.wake <- struct{}{}:
+	default:
+	}
+}
+
+//sleep true if stopped
+func (pusher *rtmpPusher) sleep(duration time.Duration) bool {
+	select {
+	case <-pusher.stop:
+		return true
+	case <-pusher.wake:
+	case <-time.After(duration):
+	}
+	return false
+}
+
+func (pusher *rtmpPusher) run() {
+	defer func() {
+		pusher.detach()
+		metrics.DelSink(pusher.stats)
+		pusher.setState(eRTMPEvent.PushStopped)
+		logger.LOGI("stop push " + pusher.target.StreamName + " " + pusher.target.ID)
+	}()
+	retry := pushRetryMin
+	for {
+		if false == pusher.attach() || false == pusher.isLive() {
+			pusher.setState(eRTMPEvent.PushWaiting)
+			if pusher.sleep(time.Second) {
+				return
+			}
+			continue
+		}
+		started, err := pusher.publish()
+		select {
+		case <-pusher.stop:
+			return
+		default:
+		}
+		if err == errPushSourceStopped {
+			continue
+		}
+		if started {
+			retry = pushRetryMin
+		}
+		logger.LOGW(fmt.Sprintf("push %s to %s failed,retry in %v:%s", pusher.target.StreamName, pusher.addr, retry, err.Error()))
+		pusher.mutex.Lock()
+		pusher.retries++
+		pusher.lastErr = err.Error()
+		pusher.mutex.Unlock()
+		pusher.setState(eRTMPEvent.PushRetrying)
+		if pusher.sleep(retry) {
+			return
+		}
+		retry *= 2
+		if retry > pushRetryMax {
+			retry = pushRetryMax
+		}
+	}
+}
+
+//attach add the pusher as a sink when the stream is live,never pull a stream to push it
+func (pusher *rtmpPusher) attach() bool {
+	pusher.mutex.Lock()
+	attached := pusher.attached
+	pusher.mutex.Unlock()
+	if attached {
+		return true
+	}
+	taskGet := &eStreamerEvent.EveGetSource{StreamName: pusher.target.StreamName}
+	if err := wssapi.HandleTask(taskGet); err != nil || false == taskGet.HasProducer {
+		return false
+	}
+	taskAdd := &eStreamerEvent.EveAddSink{
+		StreamName: pusher.target.StreamName,
+		SinkId:     pusher.sinkID(),
+		Sinker:     pusher}
+	if err := wssapi.HandleTask(taskAdd); err != nil || false == taskAdd.Added {
+		return false
+	}
+	pusher.mutex.Lock()
+	defer pusher.mutex.Unlock()
+	pusher.attached = true
+	return true
+}
+
+func (pusher *rtmpPusher) detach() {
+	pusher.mutex.Lock()
+	attached := pusher.attached
+	pusher.attached = false
+	pusher.live = false
+	pusher.mutex.Unlock()
+	if attached {
+		taskDel := &eStreamerEvent.EveDelSink{StreamName: pusher.target.StreamName, SinkId: pusher.sinkID()}
+		if err := wssapi.HandleTask(taskDel); err != nil {
+			logger.LOGE(err.Error())
+		}
+	}
+}
+
+func (pusher *rtmpPusher) dial() (conn net.Conn, err error) {
+	addr := net.JoinHostPort(pusher.addr, strconv.Itoa(pusher.port))
+	dialer := &net.Dialer{Timeout: time.Duration(config().TimeoutSec) * time.Second}
+	if pusher.protocol == "rtmps" {
+		return tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{
+			ServerName:         pusher.addr,
+			InsecureSkipVerify: pusher.target.SkipVerify})
+	}
+	return dialer.Dial("tcp", addr)
+}
+
+//publish one connection,started if the server accepted the stream
+func (pusher *rtmpPusher) publish() (started bool, err error) {
+	pusher.setState(eRTMPEvent.PushConnecting)
+	conn, err := pusher.dial()
+	if err != nil {
+		return
+	}
+	pusher.mutex.Lock()
+	pusher.conn = conn
+	pusher.mutex.Unlock()
+	defer func() {
+		pusher.mutex.Lock()
+		pusher.conn = nil
+		pusher.publishing = false
+		pusher.mutex.Unlock()
+		conn.Close()
+	}()
+	select {
+	case <-pusher.stop:
+		return false, errPushStopped
+	default:
+	}
+	err = clientHandshake(conn)
+	if err != nil {
+		return
+	}
+	rtmp := &RTMP{}
+	rtmp.Init(conn)
+	rtmp.Link.Protocol = pusher.protocol
+	rtmp.Link.App = pusher.app
+	rtmp.Link.Path = pusher.path
+	rtmp.Link.TcUrl = pusher.protocol + "://" + pusher.addr + ":" + strconv.Itoa(pusher.port) + "/" + pusher.app
+	rtmp.BytesIn = 3073
+	//nil once NetStream.Publish.Start,then the error closing the connection
+	result := make(chan error, 2)
+	go pusher.threadRead(rtmp, result)
+	pusher.mutexSend.Lock()
+	err = rtmp.Connect(true)
+	pusher.mutexSend.Unlock()
+	if err != nil {
+		return
+	}
+	select {
+	case err = <-result:
+		if err != nil {
+			return
+		}
+	case <-pusher.stop:
+		return false, errPushStopped
+	case <-time.After(time.Duration(config().TimeoutSec) * time.Second):
+		return false, errors.New("publish timeout")
+	}
+	started = true
+
+	pusher.mutex.Lock()
+	headers := []*flv.FlvTag{pusher.metadata, pusher.audioHeader, pusher.videoHeader}
+	pusher.waitKey = pusher.videoHeader != nil
+	for len(pusher.tags) > 0 {
+		<-pusher.tags
+	}
+	pusher.publishing = true
+	pusher.mutex.Unlock()
+	pusher.setState(eRTMPEvent.PushPublishing)
+	logger.LOGI("push " + pusher.target.StreamName + " to " + rtmp.Link.TcUrl + " started")
+	for _, tag := range headers {
+		if nil == tag {
+			continue
+		}
+		if err = pusher.send(rtmp, tag, 0); err != nil {
+			return
+		}
+	}
+	//timestamps start from zero on every connection
+	first := true
+	beginTime := uint32(0)
+	for {
+		select {
+		case tag := <-pusher.tags:
+			if first {
+				first = false
+				beginTime = tag.Timestamp
+			}
+			timestamp := uint32(0)
+			if tag.Timestamp > beginTime {
+				timestamp = tag.Timestamp - beginTime
+			}
+			err = pusher.send(rtmp, tag, timestamp)
+		case err = <-result:
+			if nil == err {
+				err = errors.New("connection closed")
+			}
+		case <-pusher.wake:
+			if false == pusher.isLive() {
+				err = errPushSourceStopped
+			}
+		case <-pusher.stop:
+			err = errPushStopped
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (pusher *rtmpPusher) send(rtmp *RTMP, tag *flv.FlvTag, timestamp uint32) (err error) {
+	pkt := FlvTagToRTMPPacket(tag)
+	pkt.TimeStamp = timestamp
+	pkt.MessageStreamID = rtmp.StreamID
+	pusher.mutexSend.Lock()
+	defer pusher.mutexSend.Unlock()
+	err = rtmp.Conn.SetWriteDeadline(time.Now().Add(time.Duration(config().TimeoutSec) * time.Second))
+	if err != nil {
+		return
+	}
+	err = rtmp.SendPacket(pkt, false)
+	if err == nil {
+		pusher.stats.AddBytes(len(tag.Data))
+	}
+	return
+}
+
+func (pusher *rtmpPusher) threadRead(rtmp *RTMP, result chan error) {
+	var err error
+	defer func() {
+		result <- err
+	}()
+	for {
+		var packet *RTMPPacket
+		packet, err = rtmp.ReadPacket()
+		if err != nil {
+			return
+		}
+		switch packet.MessageTypeID {
+		case RTMP_PACKET_TYPE_CHUNK_SIZE:
+			rtmp.RecvChunkSize, err = AMF0DecodeInt32(packet.Body)
+		case RTMP_PACKET_TYPE_CONTROL:
+			pusher.mutexSend.Lock()
+			err = rtmp.HandleControl(packet)
+			pusher.mutexSend.Unlock()
+		case RTMP_PACKET_TYPE_SERVER_BW:
+			rtmp.AcknowledgementWindowSize, err = AMF0DecodeInt32(packet.Body)
+		case RTMP_PACKET_TYPE_CLIENT_BW:
+			rtmp.SelfBW, err = AMF0DecodeInt32(packet.Body)
+		case RTMP_PACKET_TYPE_INVOKE, RTMP_PACKET_TYPE_FLEX_MESSAGE:
+			pusher.mutexSend.Lock()
+			err = pusher.handleInvoke(rtmp, packet, result)
+			pusher.mutexSend.Unlock()
+		case RTMP_PACKET_TYPE_BYTES_READ_REPORT:
+		default:
+			logger.LOGT(fmt.Sprintf("rtmp packet type %d not processed in push", packet.MessageTypeID))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (pusher *rtmpPusher) handleInvoke(rtmp *RTMP, pkt *RTMPPacket, result chan error) (err error) {
+	var amfobj *AMF0Object
+	if RTMP_PACKET_TYPE_FLEX_MESSAGE == pkt.MessageTypeID {
+		amfobj, err = AMF0DecodeObj(pkt.Body[1:])
+	} else {
+		amfobj, err = AMF0DecodeObj(pkt.Body)
+	}
+	if err != nil || amfobj.Props.Len() < 2 {
+		return errors.New("invalid invoke from server")
+	}
+	method := amfobj.AMF0GetPropByIndex(0).Value.StrValue
+	idx := int32(amfobj.AMF0GetPropByIndex(1).Value.NumValue)
+	switch method {
+	case "_result", "_error":
+		rtmp.mutexMethod.Lock()
+		methodRet, ok := rtmp.methodCache[idx]
+		delete(rtmp.methodCache, idx)
+		rtmp.mutexMethod.Unlock()
+		if false == ok {
+			return
+		}
+		if method == "_error" {
+			//some servers refuse releaseStream and FCPublish,publish still works
+			if methodRet == "connect" || methodRet == "createStream" {
+				_, desc := invokeStatus(amfobj)
+				return errors.New(methodRet + " refused:" + desc)
+			}
+			return
+		}
+		switch methodRet {
+		case "connect":
+			if err = rtmp.SetChunkSize(pushChunkSize); err != nil {
+				return
+			}
+			if err = rtmp.SendReleaseStream(); err != nil {
+				return
+			}
+			if err = rtmp.SendFCPublish(); err != nil {
+				return
+			}
+			err = rtmp.CreateStream()
+		case "createStream":
+			prop := amfobj.AMF0GetPropByIndex(3)
+			if nil == prop {
+				return errors.New("createStream without stream id")
+			}
+			rtmp.StreamID = uint32(prop.Value.NumValue)
+			err = rtmp.SendPublish()
+		}
+	case "onStatus":
+		code, desc := invokeStatus(amfobj)
+		switch code {
+		case "NetStream.Publish.Start":
+			result <- nil
+		case "NetStream.Publish.BadName", "NetStream.Publish.Denied", "NetStream.Publish.Rejected",
+			"NetStream.Failed", "NetConnection.Connect.Rejected", "NetConnection.Connect.InvalidApp":
+			return errors.New(code + " " + desc)
+		default:
+			logger.LOGT(code)
+		}
+	default:
+		logger.LOGT(method + " not processed in push")
+	}
+	return
+}
+
+//invokeStatus code and description of the info object of onStatus or _error
+func invokeStatus(amfobj *AMF0Object) (code, desc string) {
+	prop := amfobj.AMF0GetPropByIndex(3)
+	if nil == prop {
+		return
+	}
+	for e := prop.Value.ObjValue.Props.Front(); e != nil; e = e.Next() {
+		v := e.Value.(*AMF0Property)
+		switch v.Name {
+		case "code":
+			code = v.Value.StrValue
+		case "description":
+			desc = v.Value.StrValue
+		}
+	}
+	return
+}
+
+func (pusher *rtmpPusher) Init(msg *wssapi.Msg) (err error) {
+	return
+}
+
+func (pusher *rtmpPusher) Start(msg *wssapi.Msg) (err error) {
+	return
+}
+
+func (pusher *rtmpPusher) Stop(msg *wssapi.Msg) (err error) {
+	return
+}
+
+func (pusher *rtmpPusher) GetType() string {
+	return rtmpTypePusher
+}
+
+func (pusher *rtmpPusher) HandleTask(task wssapi.Task) (err error) {
+	return
+}
+
+//ProcessMessage never fails,the source would drop the sink
+func (pusher *rtmpPusher) ProcessMessage(msg *wssapi.Msg) (err error) {
+	switch msg.Type {
+	case wssapi.MsgPlayStart:
+		pusher.mutex.Lock()
+		pusher.attached = true
+		pusher.live = true
+		pusher.mutex.Unlock()
+		pusher.notify()
+	case wssapi.MsgPlayStop:
+		pusher.mutex.Lock()
+		pusher.live = false
+		pusher.publishing = false
+		pusher.metadata = nil
+		pusher.audioHeader = nil
+		pusher.videoHeader = nil
+		pusher.mutex.Unlock()
+		pusher.notify()
+	case wssapi.MsgFlvTag:
+		pusher.appendFlvTag(msg.Param1.(*flv.FlvTag))
+	}
+	return
+}
+
+//appendFlvTag keep headers for reconnecting,skip to the next key frame if the server is slow
+func (pusher *rtmpPusher) appendFlvTag(tag *flv.FlvTag) {
+	pusher.mutex.Lock()
+	defer pusher.mutex.Unlock()
+	header := false
+	switch tag.TagType {
+	case flv.FlvTagAudio:
+		if pusher.audioHeader == nil || flv.IsAudioSequenceHeader(tag) {
+			pusher.audioHeader = tag.Copy()
+			pusher.audioHeader.Timestamp = 0
+			header = true
+		}
+	case flv.FlvTagVideo:
+		if pusher.videoHeader == nil || flv.IsVideoSequenceHeader(tag) {
+			pusher.videoHeader = tag.Copy()
+			pusher.videoHeader.Timestamp = 0
+			header = true
+		}
+	case flv.FlvTagScriptData:
+		pusher.metadata = tag.Copy()
+		pusher.metadata.Timestamp = 0
+		header = true
+	}
+	if false == pusher.publishing {
+		return
+	}
+	if pusher.waitKey && false == header {
+		if tag.TagType != flv.FlvTagVideo || false == flv.IsKeyFrame(tag) {
+			return
+		}
+		pusher.waitKey = false
+	}
+	select {
+	case pusher.tags <- tag.Copy():
+	default:
+		pusher.stats.AddDropped(1)
+		pusher.waitKey = pusher.videoHeader != nil
+	}
+}
@@ -0,0 +1,182 @@
+package rtmp
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/events/eRTMPEvent"
+	"github.com/use-go/websocket-streamserver/events/eStreamerEvent"
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+//pushBus a live source taking the pusher as sink
+type pushBus struct {
+	mutex   sync.Mutex
+	sinker  wssapi.MsgHandler
+	deleted bool
+}
+
+func (bus *pushBus) Init(msg *wssapi.Msg) error           { return nil }
+func (bus *pushBus) Start(msg *wssapi.Msg) error          { return nil }
+func (bus *pushBus) Stop(msg *wssapi.Msg) error           { return nil }
+func (bus *pushBus) GetType() string                      { return wssapi.OBJProcess }
+func (bus *pushBus) ProcessMessage(msg *wssapi.Msg) error { return nil }
+
+func (bus *pushBus) HandleTask(task wssapi.Task) error {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	switch eve := task.(type) {
+	case *eStreamerEvent.EveGetSource:
+		eve.HasProducer = true
+	case *eStreamerEvent.EveAddSink:
+		bus.sinker = eve.Sinker
+		eve.Added = true
+		eve.Sinker.ProcessMessage(&wssapi.Msg{Type: wssapi.MsgPlayStart})
+		eve.Sinker.ProcessMessage(&wssapi.Msg{Type: wssapi.MsgFlvTag, Param1: &flv.FlvTag{
+			TagType: flv.FlvTagVideo, Data: []byte{0x17, 0, 0, 0, 0, 1, 0x64, 0, 0x1f}}})
+	case *eStreamerEvent.EveDelSink:
+		bus.deleted = true
+	}
+	return nil
+}
+
+func (bus *pushBus) sink(tag *flv.FlvTag) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	bus.sinker.ProcessMessage(&wssapi.Msg{Type: wssapi.MsgFlvTag, Param1: tag})
+}
+
+//servePublish accept one publisher,video packets are sent to videos
+func servePublish(t *testing.T, conn net.Conn, videos chan *RTMPPacket) {
+	defer conn.Close()
+	if err := rtmpHandleshake(conn); err != nil {
+		t.Error(err)
+		return
+	}
+	rtmp := &RTMP{}
+	rtmp.Init(conn)
+	for {
+		packet, err := rtmp.ReadPacket()
+		if err != nil {
+			return
+		}
+		switch packet.MessageTypeID {
+		case RTMP_PACKET_TYPE_CHUNK_SIZE:
+			rtmp.RecvChunkSize, _ = AMF0DecodeInt32(packet.Body)
+		case RTMP_PACKET_TYPE_VIDEO:
+			videos <- packet
+		case RTMP_PACKET_TYPE_INVOKE:
+			amfobj, _ := AMF0DecodeObj(packet.Body)
+			idx := amfobj.AMF0GetPropByIndex(1).Value.NumValue
+			switch amfobj.AMF0GetPropByIndex(0).Value.StrValue {
+			case "connect":
+				rtmp.ConnectResult(amfobj)
+			case "releaseStream":
+				rtmp.CmdError("error", "NetStream.Failed", "not supported", idx)
+			case "createStream":
+				rtmp.CmdNumberResult(idx, 1.0)
+			case "publish":
+				if amfobj.AMF0GetPropByIndex(3).Value.StrValue != "key?token=1" {
+					t.Errorf("publish %s", amfobj.AMF0GetPropByIndex(3).Value.StrValue)
+				}
+				rtmp.CmdStatus("status", "NetStream.Publish.Start", "publishing", "", 0, RTMP_channel_Invoke)
+			}
+		}
+	}
+}
+
+func waitPushState(t *testing.T, id, state string) eRTMPEvent.PushStatus {
+	for i := 0; i < 100; i++ {
+		list := listPushTargets("live/event")
+		if len(list) == 1 && list[0].ID == id && list[0].State == state {
+			return list[0]
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("push target not %s:%+v", state, listPushTargets(""))
+	return eRTMPEvent.PushStatus{}
+}
+
+func TestPushTarget(t *testing.T) {
+	serviceConfig.Store(&RTMPConfig{TimeoutSec: 5, CacheCount: rtmpCacheDefault})
+	bus := &pushBus{}
+	wssapi.SetHandler(bus)
+	defer wssapi.SetHandler(nil)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	videos := make(chan *RTMPPacket, 16)
+	conns := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+			go servePublish(t, conn, videos)
+		}
+	}()
+
+	for _, bad := range []string{"http://127.0.0.1/live/key", "rtmp://127.0.0.1/key", "rtmp:///live/key"} {
+		if err = addPushTarget(&eRTMPEvent.PushTarget{StreamName: "live/event", URL: bad}, false); err == nil {
+			t.Fatal("bad url added:" + bad)
+		}
+	}
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	target := &eRTMPEvent.PushTarget{StreamName: "/live/event", URL: "rtmp://127.0.0.1:" + port + "/live/key?token=1"}
+	if err = addPushTarget(target, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(target.ID) == 0 || nil == addPushTarget(target, false) {
+		t.Fatal("push target id not unique")
+	}
+	keyFrame := &flv.FlvTag{TagType: flv.FlvTagVideo, Timestamp: 1000, Data: []byte{0x17, 1, 0, 0, 0, 0xaa}}
+	for round := 0; round < 2; round++ {
+		waitPushState(t, target.ID, eRTMPEvent.PushPublishing)
+		bus.sink(keyFrame)
+		header := <-videos
+		if header.Body[1] != 0 || header.TimeStamp != 0 {
+			t.Fatalf("round %d sequence header not sent first %v", round, header.Body)
+		}
+		frame := <-videos
+		if frame.Body[1] != 1 || frame.TimeStamp != 0 {
+			t.Fatalf("round %d key frame %v at %d", round, frame.Body, frame.TimeStamp)
+		}
+		//server gone,the target reconnects and sends the header again
+		if round == 0 {
+			(<-conns).Close()
+			waitPushState(t, target.ID, eRTMPEvent.PushRetrying)
+		}
+	}
+	status := waitPushState(t, target.ID, eRTMPEvent.PushPublishing)
+	if status.Retries != 1 || len(status.LastError) == 0 || status.BytesOut == 0 {
+		t.Fatalf("status %+v", status)
+	}
+
+	if nil == delPushTarget("live/other", target.ID) {
+		t.Fatal("target of another stream removed")
+	}
+	if err = delPushTarget("live/event", target.ID); err != nil {
+		t.Fatal(err)
+	}
+	if len(listPushTargets("")) != 0 {
+		t.Fatal("removed target listed")
+	}
+	for i := 0; i < 100; i++ {
+		bus.mutex.Lock()
+		deleted := bus.deleted
+		bus.mutex.Unlock()
+		if deleted {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("removed target still a sink")
+}
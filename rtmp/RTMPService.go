@@ -7,10 +7,15 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/use-go/websocket-streamserver/events/eRTMPEvent"
 	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/metrics"
+	"github.com/use-go/websocket-streamserver/session"
+	"github.com/use-go/websocket-streamserver/tlsconf"
 	"github.com/use-go/websocket-streamserver/wssapi"
 	"github.com/use-go/websocket-streamserver/utils"
 )
@@ -18,14 +23,20 @@ import (
 const (
 	rtmpTypeHandler  = "rtmpHandler"
 	rtmpTypePuller   = "rtmpPuller"
+	rtmpTypePusher   = "rtmpPusher"
 	livePathDefault  = "live"
 	timeoutDefault   = 3000
 	rtmpCacheDefault = 1000
 )
 
 type RTMPService struct {
-	listener *net.TCPListener
-	parent   wssapi.MsgHandler
+	listener    *net.TCPListener
+	tlsListener net.Listener
+	tlsStore    *tlsconf.Store
+	parent      wssapi.MsgHandler
+	stopping    bool
+	mutexConns  sync.Mutex
+	conns       map[*RTMPHandler]net.Conn
 }
 
 func init() {
@@ -37,10 +48,25 @@ type RTMPConfig struct {
 	TimeoutSec int    `json:"TimeoutSec"`
 	LivePath   string `json:"LivePath"`
 	CacheCount int    `json:"CacheCount"`
+	//TLS rtmps listener,beside the plain one
+	TLS *tlsconf.Config `json:"TLS"`
+	//Push local streams published to other servers,more can be added by the admin api
+	Push []eRTMPEvent.PushTarget `json:"Push"`
 }
 
 var service *RTMPService
-var serviceConfig RTMPConfig
+
+//serviceConfig *RTMPConfig,replaced as a whole on reload so handlers read it without lock
+var serviceConfig atomic.Value
+
+//config current config,do not modify it
+func config() *RTMPConfig {
+	cfg, _ := serviceConfig.Load().(*RTMPConfig)
+	if nil == cfg {
+		return &RTMPConfig{}
+	}
+	return cfg
+}
 
 func (rtmpService *RTMPService) Init(msg *wssapi.Msg) (err error) {
 	if nil == msg || nil == msg.Param1 {
@@ -48,18 +74,20 @@ func (rtmpService *RTMPService) Init(msg *wssapi.Msg) (err error) {
 		return errors.New("init rtmp service failed")
 	}
 	fileName := msg.Param1.(string)
-	err = rtmpService.loadConfigFile(fileName)
+	cfg, err := rtmpService.loadConfigFile(fileName)
 	if err != nil {
 		logger.LOGE(err.Error())
 		return errors.New("init rtmp service failed")
 	}
+	serviceConfig.Store(cfg)
+	rtmpService.conns = make(map[*RTMPHandler]net.Conn)
 	service = rtmpService
 	return
 }
 
 func (rtmpService *RTMPService) Start(msg *wssapi.Msg) (err error) {
 	logger.LOGT("start rtmp service")
-	strPort := ":" + strconv.Itoa(serviceConfig.Port)
+	strPort := ":" + strconv.Itoa(config().Port)
 	tcpAddr, err := net.ResolveTCPAddr("tcp4", strPort)
 	if nil != err {
 		logger.LOGE(err.Error())
@@ -70,12 +98,40 @@ func (rtmpService *RTMPService) Start(msg *wssapi.Msg) (err error) {
 		logger.LOGE(err.Error())
 		return
 	}
-	go rtmpService.rtmpLoop()
+	go rtmpService.rtmpLoop(rtmpService.listener)
+	if config().TLS.Enabled() {
+		rtmpService.tlsListener, rtmpService.tlsStore, err = tlsconf.Listen(config().TLS)
+		if err != nil {
+			logger.LOGE("start rtmps failed:" + err.Error())
+			err = nil
+			return
+		}
+		logger.LOGI("rtmps://address:" + strconv.Itoa(config().TLS.Port) + "/" + config().LivePath + "/streamName")
+		go rtmpService.rtmpLoop(rtmpService.tlsListener)
+	}
+	syncPushTargets(config().Push)
 	return
 }
 
+//Stop close listener,players get stream end and publishers the unpublish status before the connection is closed
 func (rtmpService *RTMPService) Stop(msg *wssapi.Msg) (err error) {
-	rtmpService.listener.Close()
+	rtmpService.stopping = true
+	stopPushTargets()
+	if nil != rtmpService.listener {
+		rtmpService.listener.Close()
+	}
+	if nil != rtmpService.tlsListener {
+		rtmpService.tlsListener.Close()
+	}
+	rtmpService.mutexConns.Lock()
+	conns := rtmpService.conns
+	rtmpService.conns = make(map[*RTMPHandler]net.Conn)
+	rtmpService.mutexConns.Unlock()
+	for handler, conn := range conns {
+		//handler.Stop returns after the status is written
+		handler.Stop(nil)
+		conn.Close()
+	}
 	return
 }
 
@@ -95,7 +151,7 @@ func (rtmpService *RTMPService) HandleTask(task wssapi.Task) (err error) {
 		}
 		taskPull.Protocol = strings.ToLower(taskPull.Protocol)
 		switch taskPull.Protocol {
-		case "rtmp":
+		case "rtmp", "rtmps":
 			PullRTMPLive(taskPull)
 		default:
 			logger.LOGE(fmt.Sprintf("fmt %s not support now", taskPull.Protocol))
@@ -103,48 +159,92 @@ func (rtmpService *RTMPService) HandleTask(task wssapi.Task) (err error) {
 			return errors.New("fmt not support")
 		}
 		return
+	case eRTMPEvent.AddPushTarget:
+		taskAdd, ok := task.(*eRTMPEvent.EveAddPushTarget)
+		if false == ok {
+			return errors.New("invalid param to add push target")
+		}
+		return addPushTarget(&taskAdd.Target, false)
+	case eRTMPEvent.DelPushTarget:
+		taskDel, ok := task.(*eRTMPEvent.EveDelPushTarget)
+		if false == ok {
+			return errors.New("invalid param to del push target")
+		}
+		return delPushTarget(taskDel.StreamName, taskDel.ID)
+	case eRTMPEvent.GetPushTargets:
+		taskGet, ok := task.(*eRTMPEvent.EveGetPushTargets)
+		if false == ok {
+			return errors.New("invalid param to get push targets")
+		}
+		taskGet.Targets = listPushTargets(taskGet.StreamName)
+		return
 	default:
 		return fmt.Errorf("task %s not prossed", task.Type())
 	}
 }
 
 func (rtmpService *RTMPService) ProcessMessage(msg *wssapi.Msg) (err error) {
+	switch msg.Type {
+	case wssapi.MsgReloadConfig:
+		var cfg *RTMPConfig
+		cfg, err = rtmpService.loadConfigFile(msg.Param1.(string))
+		if err != nil {
+			return
+		}
+		if cfg.Port != config().Port {
+			logger.LOGW("rtmp port change need restart")
+			cfg.Port = config().Port
+		}
+		//certificates can change,listener keeps the port
+		if rtmpService.tlsStore != nil && cfg.TLS != nil {
+			err = rtmpService.tlsStore.Update(cfg.TLS)
+			if err != nil {
+				return
+			}
+		}
+		serviceConfig.Store(cfg)
+		syncPushTargets(cfg.Push)
+	}
 	return
 }
 
-func (rtmpService *RTMPService) loadConfigFile(fileName string) (err error) {
+func (rtmpService *RTMPService) loadConfigFile(fileName string) (cfg *RTMPConfig, err error) {
 	data, err := utils.ReadFileAll(fileName)
 	if err != nil {
 		return
 	}
-	err = json.Unmarshal(data, &serviceConfig)
+	cfg = &RTMPConfig{}
+	err = json.Unmarshal(data, cfg)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	if serviceConfig.TimeoutSec == 0 {
-		serviceConfig.TimeoutSec = timeoutDefault
+	if cfg.TimeoutSec == 0 {
+		cfg.TimeoutSec = timeoutDefault
 	}
 
-	if len(serviceConfig.LivePath) == 0 {
-		serviceConfig.LivePath = livePathDefault
+	if len(cfg.LivePath) == 0 {
+		cfg.LivePath = livePathDefault
 	}
-	if serviceConfig.CacheCount == 0 {
-		serviceConfig.CacheCount = rtmpCacheDefault
+	if cfg.CacheCount == 0 {
+		cfg.CacheCount = rtmpCacheDefault
 	}
 	strPort := ""
-	if serviceConfig.Port != 1935 {
-		strPort = strconv.Itoa(serviceConfig.Port)
+	if cfg.Port != 1935 {
+		strPort = strconv.Itoa(cfg.Port)
 	}
-	logger.LOGI("rtmp://address:" + strPort + "/" + serviceConfig.LivePath + "/streamName")
-	logger.LOGI("rtmp timeout: " + strconv.Itoa(serviceConfig.TimeoutSec) + " s")
+	logger.LOGI("rtmp://address:" + strPort + "/" + cfg.LivePath + "/streamName")
+	logger.LOGI("rtmp timeout: " + strconv.Itoa(cfg.TimeoutSec) + " s")
 	return
 }
 
-func (rtmpService *RTMPService) rtmpLoop() {
+func (rtmpService *RTMPService) rtmpLoop(listener net.Listener) {
 	for {
-		conn, err := rtmpService.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
+			if rtmpService.stopping {
+				return
+			}
 			logger.LOGW(err.Error())
 			continue
 		}
@@ -156,6 +256,13 @@ func (rtmpService *RTMPService) handleConnect(conn net.Conn) {
 	var err error
 	defer conn.Close()
 	defer logger.LOGT("close connect>>>")
+	sess, err := session.Open(metrics.ProtocolRTMP, conn.RemoteAddr().String(), func() { conn.Close() })
+	if err != nil {
+		logger.LOGW("refuse rtmp client " + conn.RemoteAddr().String() + ":" + err.Error())
+		return
+	}
+	defer sess.Close()
+	conn = sess.Conn(conn)
 	err = rtmpHandleshake(conn)
 	if err != nil {
 		logger.LOGE("rtmp handle shake failed")
@@ -168,13 +275,21 @@ func (rtmpService *RTMPService) handleConnect(conn net.Conn) {
 	msgInit := &wssapi.Msg{}
 	msgInit.Param1 = rtmp
 
-	handler := &RTMPHandler{}
+	handler := &RTMPHandler{session: sess}
 	err = handler.Init(msgInit)
 	if err != nil {
 		logger.LOGE("rtmp handler init failed")
 		return
 	}
 	logger.LOGT("new connect:" + conn.RemoteAddr().String())
+	rtmpService.mutexConns.Lock()
+	rtmpService.conns[handler] = conn
+	rtmpService.mutexConns.Unlock()
+	defer func() {
+		rtmpService.mutexConns.Lock()
+		delete(rtmpService.conns, handler)
+		rtmpService.mutexConns.Unlock()
+	}()
 	for {
 		var packet *RTMPPacket
 		packet, err = rtmpService.readPacket(rtmp, handler.isPlaying())
@@ -191,7 +306,7 @@ func (rtmpService *RTMPService) handleConnect(conn net.Conn) {
 
 func (rtmpService *RTMPService) readPacket(rtmp *RTMP, playing bool) (packet *RTMPPacket, err error) {
 	if false == playing {
-		err = rtmp.Conn.SetReadDeadline(time.Now().Add(time.Duration(serviceConfig.TimeoutSec) * time.Second))
+		err = rtmp.Conn.SetReadDeadline(time.Now().Add(time.Duration(config().TimeoutSec) * time.Second))
 		if err != nil {
 			logger.LOGE(err.Error())
 			return
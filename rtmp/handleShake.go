@@ -46,7 +46,7 @@ var GENUINE_FP_KEY = []byte{
 
 func rtmpHandleshake(conn net.Conn) (err error) {
 
-	err = conn.SetReadDeadline(time.Now().Add(time.Duration(serviceConfig.TimeoutSec) * time.Second))
+	err = conn.SetReadDeadline(time.Now().Add(time.Duration(config().TimeoutSec) * time.Second))
 	if err != nil {
 		logger.LOGE(err.Error())
 		return
@@ -296,3 +296,59 @@ func getDHOffset(buf []byte, scheme int) int {
 	}
 	return -1
 }
+
+//clientHandshake simple handshake of pullers and pushers
+func clientHandshake(conn net.Conn) (err error) {
+	randomSize := 1528
+	//send c0
+	c0 := make([]byte, 1)
+	c0[0] = 3
+	_, err = utils.TCPWriteTimeDuration(conn, c0, time.Duration(config().TimeoutSec)*time.Second)
+	if err != nil {
+		logger.LOGE("send c0 failed")
+		return
+	}
+	//send c1
+	c1 := make([]byte, randomSize+4+4)
+	for idx := 8; idx < len(c1); idx++ {
+		c1[idx] = byte(rand.Intn(255))
+	}
+	_, err = utils.TCPWriteTimeDuration(conn, c1, time.Duration(config().TimeoutSec)*time.Second)
+	if err != nil {
+		logger.LOGE("send c1 failed")
+		return
+	}
+	//read s0
+	s0, err := utils.TCPReadTimeDuration(conn, 1, time.Duration(config().TimeoutSec)*time.Second)
+	if err != nil {
+		logger.LOGE("read s0 failed")
+		return
+	}
+	logger.LOGT(s0)
+	//read s1
+	s1, err := utils.TCPReadTimeDuration(conn, randomSize+8, time.Duration(config().TimeoutSec)*time.Second)
+	if err != nil {
+		logger.LOGE("read s1 failed")
+		return
+	}
+	//send c2
+	_, err = utils.TCPWriteTimeDuration(conn, s1, time.Duration(config().TimeoutSec)*time.Second)
+	if err != nil {
+		logger.LOGE("send c2 failed")
+		return
+	}
+	//read s2
+	s2, err := utils.TCPReadTimeDuration(conn, randomSize+8, time.Duration(config().TimeoutSec)*time.Second)
+	if err != nil {
+		logger.LOGE("read s2 failed")
+		return
+	}
+	for idx := 0; idx < len(s2); idx++ {
+		if c1[idx] != s2[idx] {
+			logger.LOGE("invalid s2")
+			return errors.New("invalid s2")
+		}
+	}
+	logger.LOGT("handleshake ok")
+	return
+}
@@ -20,32 +20,52 @@
 // +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 
 
+
 package rtspcli
 
 import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
 	"io"
 	"net"
 	"net/textproto"
 	"net/url"
-	"fmt"
+	"strconv"
 	"strings"
+	"time"
+
 	"github.com/nareix/joy4/av"
-	"github.com/nareix/joy4/av/pubsub"
+	"github.com/nareix/joy4/codec"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+
+	"github.com/use-go/websocket-streamserver/rtspsrv/sdp"
+	"github.com/use-go/websocket-streamserver/utils"
+)
+
+//client timeouts
+const (
+	DefaultTimeout    = 10 * time.Second
+	KeepAliveInterval = 25 * time.Second
 )
 
 //SocketChannel info for RTSP Connetction
 type SocketChannel struct {
 	DebugConn     bool
+	Timeout       time.Duration
 	url           *url.URL
 	conn          net.Conn
-	rconn         io.Reader
+	brconn        *bufio.Reader
 	requestURI    string
 	cseq          uint
 	streams       []*Stream
 	session       string
-	authorization string
-	body          io.Reader
-	pktque        *pubsub.QueueCursor
+	authRealm     string
+	authNonce     string
+	authDigest    bool
+	lastKeepAlive time.Time
+	pkts          []av.Packet
 }
 
 //Request of RTSP
@@ -67,34 +87,71 @@ type Response struct {
 	Body          []byte
 }
 
-
-
 //Forward Data
 func (cli *SocketChannel) Forward(message string) (str string, err error) {
-	
+
 	//send message
- 	cnt,err :=	write(cli.conn ,message)
-	if cnt <1 || err !=nil {	
-		return "write socket failed",err
+	cnt, err := write(cli.conn, message)
+	if cnt < 1 || err != nil {
+		return "write socket failed", err
 	}
 	//wait to receive
-   return read(cli.conn)
+	return read(cli.conn)
 }
 
-
 func (cli *SocketChannel) writeLine(line string) (err error) {
 	if cli.DebugConn {
 		fmt.Print("> ", line)
 	}
-	write(cli.conn, line)
-	//_, err = fmt.Fprint(cli.conn, line)
+	_, err = write(cli.conn, line)
 	return
 }
 
+//authorization 根据401返回的信息生成认证头
+func (cli *SocketChannel) authorization(method, uri string) string {
+	if nil == cli.url.User || cli.authRealm == "" {
+		return ""
+	}
+	username := cli.url.User.Username()
+	password, _ := cli.url.User.Password()
+	if false == cli.authDigest {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	}
+	ha1 := utils.GetMD5Hash(username + ":" + cli.authRealm + ":" + password)
+	ha2 := utils.GetMD5Hash(method + ":" + uri)
+	response := utils.GetMD5Hash(ha1 + ":" + cli.authNonce + ":" + ha2)
+	return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`,
+		username, cli.authRealm, cli.authNonce, uri, response)
+}
+
+func (cli *SocketChannel) parseAuthenticate(header string) {
+	cli.authDigest = strings.HasPrefix(header, "Digest")
+	for _, field := range strings.Split(header, ",") {
+		keyval := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(keyval) != 2 {
+			continue
+		}
+		key := keyval[0]
+		if idx := strings.LastIndex(key, " "); idx >= 0 {
+			key = key[idx+1:]
+		}
+		val := strings.Trim(keyval[1], `"`)
+		switch key {
+		case "realm":
+			cli.authRealm = val
+		case "nonce":
+			cli.authNonce = val
+		}
+	}
+}
+
 // WriteRequest Message to RTSP
 func (cli *SocketChannel) WriteRequest(req Request) (err error) {
 	cli.cseq++
 	req.Header = append(req.Header, fmt.Sprintf("CSeq: %d", cli.cseq))
+	if auth := cli.authorization(req.Method, req.URI); auth != "" {
+		req.Header = append(req.Header, "Authorization: "+auth)
+	}
 	if err = cli.writeLine(fmt.Sprintf("%s %s RTSP/1.0\r\n", req.Method, req.URI)); err != nil {
 		return
 	}
@@ -110,12 +167,70 @@ func (cli *SocketChannel) WriteRequest(req Request) (err error) {
 	return
 }
 
-//ReadResponse handle rtsp response
+//ReadResponse handle rtsp response,interleaved data before it will be cached
 func (cli *SocketChannel) ReadResponse() (res Response, err error) {
-
+	for {
+		var first []byte
+		cli.conn.SetReadDeadline(time.Now().Add(cli.timeout()))
+		if first, err = cli.brconn.Peek(1); err != nil {
+			return
+		}
+		if first[0] != '$' {
+			break
+		}
+		if err = cli.readBlock(); err != nil {
+			return
+		}
+	}
+	tp := textproto.NewReader(cli.brconn)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return
+	}
+	if cli.DebugConn {
+		fmt.Println("<", line)
+	}
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) < 2 {
+		err = fmt.Errorf("rtsp: invalid response line:%s", line)
+		return
+	}
+	if proto, _, _, e := parseRTSPVersion(fields[0]); e != nil || proto != "RTSP" {
+		err = fmt.Errorf("rtsp: invalid response line:%s", line)
+		return
+	}
+	if res.StatusCode, err = strconv.Atoi(fields[1]); err != nil {
+		return
+	}
+	if res.Header, err = tp.ReadMIMEHeader(); err != nil {
+		return
+	}
+	if length := res.Header.Get("Content-Length"); length != "" {
+		if res.ContentLength, err = strconv.Atoi(strings.TrimSpace(length)); err != nil {
+			return
+		}
+		res.Body = make([]byte, res.ContentLength)
+		if _, err = io.ReadFull(cli.brconn, res.Body); err != nil {
+			return
+		}
+	}
+	if session := res.Header.Get("Session"); session != "" && cli.session == "" {
+		cli.session = strings.TrimSpace(strings.Split(session, ";")[0])
+	}
+	if res.StatusCode == 401 {
+		cli.parseAuthenticate(res.Header.Get("WWW-Authenticate"))
+	}
+	cli.conn.SetReadDeadline(time.Time{})
 	return
 }
 
+func (cli *SocketChannel) timeout() time.Duration {
+	if cli.Timeout > 0 {
+		return cli.Timeout
+	}
+	return DefaultTimeout
+}
+
 //Options RTSP
 func (cli *SocketChannel) Options() (err error) {
 	if err = cli.WriteRequest(Request{
@@ -138,10 +253,8 @@ func (cli *SocketChannel) Describe() (streams []av.CodecData, err error) {
 	for i := 0; i < 2; i++ {
 		req := Request{
 			Method: "DESCRIBE",
-			URI: cli.requestURI,
-		}
-		if cli.authorization != "" {
-			req.Header = append(req.Header, "Authorization: "+cli.authorization)
+			URI:    cli.requestURI,
+			Header: []string{"Accept: application/sdp"},
 		}
 		if err = cli.WriteRequest(req); err != nil {
 			return
@@ -149,14 +262,17 @@ func (cli *SocketChannel) Describe() (streams []av.CodecData, err error) {
 		if res, err = cli.ReadResponse(); err != nil {
 			return
 		}
-		if res.StatusCode == 200 {
+		if res.StatusCode != 401 || cli.authRealm == "" || nil == cli.url.User {
 			break
 		}
 	}
-	if res.ContentLength == 0 {
+	if res.StatusCode != 200 || res.ContentLength == 0 {
 		err = fmt.Errorf("rtsp: Describe failed, StatusCode=%d", res.StatusCode)
 		return
 	}
+	if base := res.Header.Get("Content-Base"); base != "" {
+		cli.requestURI = strings.TrimSuffix(base, "/")
+	}
 
 	body := string(res.Body)
 
@@ -168,32 +284,25 @@ func (cli *SocketChannel) Describe() (streams []av.CodecData, err error) {
 	for _, info := range sdp.Decode(body) {
 		stream := &Stream{Sdp: info}
 
-		if false {
-			fmt.Println("sdp:", info.TimeScale)
-		}
-
 		if info.PayloadType >= 96 && info.PayloadType <= 127 {
 			switch info.Type {
 			case av.H264:
-				var sps, pps []byte
 				for _, nalu := range info.SpropParameterSets {
 					if len(nalu) > 0 {
-						switch nalu[0]&0x1f {
+						switch nalu[0] & 0x1f {
 						case 7:
-							sps = nalu
+							stream.depacketizer.SPS = nalu
 						case 8:
-							pps = nalu
+							stream.depacketizer.PPS = nalu
 						}
 					}
 				}
-				if len(sps) > 0 && len(pps) > 0 {
-					if stream.CodecData, err = h264parser.NewCodecDataFromSPSAndPPS(sps, pps); err != nil {
+				//sdp 中没有sps pps时，从码流中获取
+				if len(stream.depacketizer.SPS) > 0 && len(stream.depacketizer.PPS) > 0 {
+					if stream.CodecData, err = h264parser.NewCodecDataFromSPSAndPPS(stream.depacketizer.SPS, stream.depacketizer.PPS); err != nil {
 						err = fmt.Errorf("rtsp: h264 sps/pps invalid: %s", err)
 						return
 					}
-				} else {
-					err = fmt.Errorf("rtsp: h264 sdp sprop-parameter-sets invalid: missing sps or pps")
-					return
 				}
 
 			case av.AAC:
@@ -205,29 +314,43 @@ func (cli *SocketChannel) Describe() (streams []av.CodecData, err error) {
 					err = fmt.Errorf("rtsp: aac sdp config invalid: %s", err)
 					return
 				}
+			default:
+				//不支持的媒体仍然setup，数据直接丢弃
+				stream.unsupported = true
 			}
 		} else {
 			switch info.PayloadType {
 			case 0:
 				stream.CodecData = codec.NewPCMMulawCodecData()
-
+			case 8:
+				stream.CodecData = codec.NewPCMAlawCodecData()
 			default:
-				err = fmt.Errorf("rtsp: PayloadType=%d unsupported", info.PayloadType)
-				return
+				stream.unsupported = true
 			}
 		}
 
 		cli.streams = append(cli.streams, stream)
 	}
+	if len(cli.streams) == 0 {
+		err = fmt.Errorf("rtsp: no media in sdp")
+		return
+	}
 
+	streams = cli.Streams()
+
+	return
+}
+
+//RemoteAddr of the rtsp server
+func (cli *SocketChannel) RemoteAddr() net.Addr {
+	return cli.conn.RemoteAddr()
+}
+
+//Streams codec data of every stream,nil if not known yet
+func (cli *SocketChannel) Streams() (streams []av.CodecData) {
 	for _, stream := range cli.streams {
-		streams = append(streams, stream)
+		streams = append(streams, stream.CodecData)
 	}
-//	cli.pktque = &pktqueue.Queue{
-//		Poll: cli.poll,
-//	}
-//	cli.pktque.Alloc(streams)
-
 	return
 }
 
@@ -239,7 +362,7 @@ func (cli *SocketChannel) Setup(streams []int) (err error) {
 		if strings.HasPrefix(control, "rtsp://") {
 			uri = control
 		} else {
-			uri = cli.requestURI+"/"+control
+			uri = cli.requestURI + "/" + control
 		}
 		req := Request{Method: "SETUP", URI: uri}
 		req.Header = append(req.Header, fmt.Sprintf("Transport: RTP/AVP/TCP;unicast;interleaved=%d-%d", si*2, si*2+1))
@@ -249,7 +372,12 @@ func (cli *SocketChannel) Setup(streams []int) (err error) {
 		if err = cli.WriteRequest(req); err != nil {
 			return
 		}
-		if _, err = cli.ReadResponse(); err != nil {
+		var res Response
+		if res, err = cli.ReadResponse(); err != nil {
+			return
+		}
+		if res.StatusCode != 200 {
+			err = fmt.Errorf("rtsp: Setup %s failed, StatusCode=%d", uri, res.StatusCode)
 			return
 		}
 	}
@@ -266,10 +394,87 @@ func (cli *SocketChannel) Play() (err error) {
 	if err = cli.WriteRequest(req); err != nil {
 		return
 	}
+	res, err := cli.ReadResponse()
+	if err != nil {
+		return
+	}
+	if res.StatusCode != 200 {
+		err = fmt.Errorf("rtsp: Play failed, StatusCode=%d", res.StatusCode)
+		return
+	}
+	cli.lastKeepAlive = time.Now()
+	return
+}
+
+//Teardown and close the connection
+func (cli *SocketChannel) Teardown() (err error) {
+	req := Request{
+		Method: "TEARDOWN",
+		URI:    cli.requestURI,
+	}
+	if cli.session != "" {
+		req.Header = append(req.Header, "Session: "+cli.session)
+	}
+	err = cli.WriteRequest(req)
+	cli.conn.Close()
 	return
 }
 
-//ReadPacket handle RTP Packet
+//keepAlive 服务端通常以收到命令为心跳，回复在readBlock里丢弃
+func (cli *SocketChannel) keepAlive() (err error) {
+	if time.Since(cli.lastKeepAlive) < KeepAliveInterval {
+		return
+	}
+	cli.lastKeepAlive = time.Now()
+	req := Request{
+		Method: "OPTIONS",
+		URI:    cli.requestURI,
+	}
+	if cli.session != "" {
+		req.Header = append(req.Header, "Session: "+cli.session)
+	}
+	return cli.WriteRequest(req)
+}
+
+//readBlock read one interleaved block or one rtsp response
+func (cli *SocketChannel) readBlock() (err error) {
+	cli.conn.SetReadDeadline(time.Now().Add(cli.timeout()))
+	defer cli.conn.SetReadDeadline(time.Time{})
+	first, err := cli.brconn.Peek(1)
+	if err != nil {
+		return
+	}
+	if first[0] != '$' {
+		var res Response
+		res, err = cli.ReadResponse()
+		if err == nil && res.StatusCode != 200 {
+			err = fmt.Errorf("rtsp: StatusCode=%d while playing", res.StatusCode)
+		}
+		return
+	}
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(cli.brconn, header); err != nil {
+		return
+	}
+	length := int(header[2])<<8 | int(header[3])
+	data := make([]byte, length)
+	if _, err = io.ReadFull(cli.brconn, data); err != nil {
+		return
+	}
+	return cli.parseBlock(int(header[1]), data)
+}
+
+//ReadPacket handle RTP Packet,for h264 data is AVCC format
 func (cli *SocketChannel) ReadPacket() (pkt av.Packet, err error) {
-	return cli.pktque.ReadPacket()
+	for len(cli.pkts) == 0 {
+		if err = cli.keepAlive(); err != nil {
+			return
+		}
+		if err = cli.readBlock(); err != nil {
+			return
+		}
+	}
+	pkt = cli.pkts[0]
+	cli.pkts = cli.pkts[1:]
+	return
 }
@@ -10,6 +10,7 @@
 package rtspcli
 
 import (
+	"bufio"
 	"errors"
 	"net"
 	"net/url"
@@ -28,7 +29,7 @@ func write(socket net.Conn, message string) (cnt int, err error) {
 	if e != nil {
 		err = errors.New("socket write failed")
 	}
-	return count, nil
+	return count, err
 }
 
 //Read Data
@@ -61,20 +62,25 @@ func Connect(uri string) (cli *SocketChannel, err error) {
 
 	cli = &SocketChannel{
 		conn:       conn,
-		rconn:      conn,
+		brconn:     bufio.NewReaderSize(conn, 65536),
 		url:        targetURL,
 		requestURI: u2.String(),
 	}
 	return
 }
 
-//Open Stream
+//Open Stream,describe setup all streams over tcp and play
 func Open(hostURL string) (cli *SocketChannel, err error) {
 
 	_cli, err := Connect(hostURL)
 	if err != nil {
 		return nil, errors.New("Connect host error: " + hostURL)
 	}
+	defer func() {
+		if err != nil {
+			_cli.conn.Close()
+		}
+	}()
 
 	//send option
 	err = _cli.Options()
@@ -82,7 +88,7 @@ func Open(hostURL string) (cli *SocketChannel, err error) {
 		return nil, errors.New("Options error: " + hostURL)
 	}
 
-	streams, err := cli.Describe()
+	streams, err := _cli.Describe()
 	if err != nil {
 		return
 	}
@@ -1,27 +1,32 @@
 package rtspcli
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"time"
 
 	"github.com/nareix/joy4/av"
-	"github.com/nareix/joy4/format/rtsp/sdp"
+	"github.com/nareix/joy4/codec/h264parser"
+
+	"github.com/use-go/websocket-streamserver/mediatype/h264"
+	"github.com/use-go/websocket-streamserver/mediatype/rtp"
+	"github.com/use-go/websocket-streamserver/rtspsrv/sdp"
 )
 
 //Stream info
 type Stream struct {
 	av.CodecData
-	Sdp sdp.Media
+	Sdp         sdp.SDPInfo
+	unsupported bool
 
 	// h264
-	fuBuffer []byte
-	sps      []byte
-	pps      []byte
+	depacketizer h264.RTPDepacketizer
 
-	gotpkt    bool
-	pkt       av.Packet
-	timestamp uint32
+	baseTime    uint32
+	baseTimeSet bool
+	pkts        []av.Packet
 }
 
 //IsAudio Check Audio
@@ -34,150 +39,100 @@ func (strem Stream) IsVideo() bool {
 	return strem.Sdp.AVType == "video"
 }
 
-func (strem *Stream) handleH264Payload(naluType byte, timestamp uint32, packet []byte) (err error) {
-	/*
-		Table 7-1 – NAL unit type codes
-		1   ￼Coded slice of a non-IDR picture
-		5    Coded slice of an IDR picture
-		6    Supplemental enhancement information (SEI)
-		7    Sequence parameter set
-		8    Picture parameter set
-	*/
-	switch naluType {
-	case 7, 8:
-		// sps/pps
-
-	default:
-		if naluType == 5 {
-			strem.pkt.IsKeyFrame = true
+//updateCodecData sps pps 变化时重建CodecData,sdp 中没有sps pps时从码流中获取
+func (strem *Stream) updateCodecData() {
+	strem.depacketizer.ParamsChanged = false
+	sps, pps := strem.depacketizer.SPS, strem.depacketizer.PPS
+	if len(sps) == 0 || len(pps) == 0 {
+		return
+	}
+	old, ok := strem.CodecData.(h264parser.CodecData)
+	if false == ok || false == bytes.Equal(old.SPS(), sps) || false == bytes.Equal(old.PPS(), pps) {
+		if codecData, e := h264parser.NewCodecDataFromSPSAndPPS(sps, pps); e == nil {
+			strem.CodecData = codecData
 		}
-		strem.gotpkt = true
-		strem.pkt.Data = packet
-		strem.timestamp = timestamp
 	}
+}
 
-	return
+func (strem *Stream) addPkt(pkt av.Packet, timestamp uint32) {
+	if false == strem.baseTimeSet {
+		strem.baseTimeSet = true
+		strem.baseTime = timestamp
+	}
+	timeScale := strem.Sdp.TimeScale
+	if timeScale <= 0 {
+		timeScale = 90000
+	}
+	pkt.Time = time.Duration(uint64(timestamp-strem.baseTime) * uint64(time.Second) / uint64(timeScale))
+	strem.pkts = append(strem.pkts, pkt)
 }
 
-func (strem *Stream) handlePacket(timestamp uint32, packet []byte) (err error) {
-	switch strem.Type() {
+func (strem *Stream) handlePacket(timestamp uint32, marker bool, packet []byte) (err error) {
+	if strem.unsupported {
+		return
+	}
+	switch strem.Sdp.Type {
 	case av.H264:
-		/*
-			+---------------+
-			|0|1|2|3|4|5|6|7|
-			+-+-+-+-+-+-+-+-+
-			|F|NRI|  Type   |
-			+---------------+
-		*/
-		naluType := packet[0] & 0x1f
-
-		/*
-			NAL Unit  Packet    Packet Type Name               Section
-			Type      Type
-			-------------------------------------------------------------
-			0        reserved                                     -
-			1-23     NAL unit  Single NAL unit packet             5.6
-			24       STAP-A    Single-time aggregation packet     5.7.1
-			25       STAP-B    Single-time aggregation packet     5.7.1
-			26       MTAP16    Multi-time aggregation packet      5.7.2
-			27       MTAP24    Multi-time aggregation packet      5.7.2
-			28       FU-A      Fragmentation unit                 5.8
-			29       FU-B      Fragmentation unit                 5.8
-			30-31    reserved                                     -
-		*/
-
-		switch {
-		case naluType >= 1 && naluType <= 23:
-			if err = strem.handleH264Payload(naluType, timestamp, packet); err != nil {
-				return
-			}
-
-		case naluType == 28: // FU-A
-			/*
-				0                   1                   2                   3
-				0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
-				+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-				| FU indicator  |   FU header   |                               |
-				+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+                               |
-				|                                                               |
-				|                         FU payload                            |
-				|                                                               |
-				|                               +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-				|                               :...OPTIONAL RTP padding        |
-				+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-				Figure 14.  RTP payload format for FU-A
-				The FU indicator octet has the following format:
-				+---------------+
-				|0|1|2|3|4|5|6|7|
-				+-+-+-+-+-+-+-+-+
-				|F|NRI|  Type   |
-				+---------------+
-				The FU header has the following format:
-				+---------------+
-				|0|1|2|3|4|5|6|7|
-				+-+-+-+-+-+-+-+-+
-				|S|E|R|  Type   |
-				+---------------+
-				S: 1 bit
-				When set to one, the Start bit indicates the start of a fragmented
-				NAL unit.  When the following FU payload is not the start of a
-				fragmented NAL unit payload, the Start bit is set to zero.
-				E: 1 bit
-				When set to one, the End bit indicates the end of a fragmented NAL
-				unit, i.e., the last byte of the payload is also the last byte of
-				the fragmented NAL unit.  When the following FU payload is not the
-				last fragment of a fragmented NAL unit, the End bit is set to
-				zero.
-				R: 1 bit
-				The Reserved bit MUST be equal to 0 and MUST be ignored by the
-				receiver.
-				Type: 5 bits
-				The NAL unit payload type as defined in table 7-1 of [1].
-			*/
-			fuIndicator := packet[0]
-			fuHeader := packet[1]
-			isStart := fuHeader&0x80 != 0
-			isEnd := fuHeader&0x40 != 0
-			naluType := fuHeader & 0x1f
-			if isStart {
-				strem.fuBuffer = []byte{fuIndicator&0xe0 | fuHeader&0x1f}
-			}
-			strem.fuBuffer = append(strem.fuBuffer, packet[2:]...)
-			if isEnd {
-				if err = strem.handleH264Payload(naluType, timestamp, strem.fuBuffer); err != nil {
-					return
-				}
-			}
-
-		case naluType == 24:
-			err = fmt.Errorf("rtsp: unsupported H264 STAP-A")
-			return
-
-		default:
-			err = fmt.Errorf("rtsp: unsupported H264 naluType=%d", naluType)
-			return
+		frames := strem.depacketizer.AddPayload(packet, timestamp, marker, false)
+		if strem.depacketizer.ParamsChanged {
+			strem.updateCodecData()
+		}
+		for _, frame := range frames {
+			strem.addPkt(av.Packet{IsKeyFrame: frame.KeyFrame, Data: frame.AVCC()}, frame.Timestamp)
 		}
 
 	case av.AAC:
-		strem.gotpkt = true
-		strem.pkt.Data = packet[4:]
-		strem.timestamp = timestamp
+		strem.handleAACPayload(timestamp, packet)
 
 	default:
-		strem.gotpkt = true
-		strem.pkt.Data = packet
-		strem.timestamp = timestamp
+		strem.addPkt(av.Packet{Data: append([]byte{}, packet...)}, timestamp)
 	}
 	return
 }
 
-func (strem *SocketChannel) parseBlock(blockNo int, packet []byte) (streamIndex int, err error) {
+//handleAACPayload mpeg4-generic,AU-headers-length + AU-headers + AUs
+func (strem *Stream) handleAACPayload(timestamp uint32, packet []byte) {
+	if len(packet) < 2 {
+		return
+	}
+	sizeLength := strem.Sdp.SizeLength
+	indexLength := strem.Sdp.IndexLength
+	if sizeLength == 0 {
+		sizeLength = 13
+		indexLength = 3
+	}
+	headersBits := int(binary.BigEndian.Uint16(packet))
+	headersLength := (headersBits + 7) / 8
+	if 2+headersLength > len(packet) {
+		return
+	}
+	cur := 2 + headersLength
+	for i := 0; (i+1)*(sizeLength+indexLength) <= headersBits; i++ {
+		size := 0
+		offset := i * (sizeLength + indexLength)
+		for bit := 0; bit < sizeLength; bit++ {
+			idx := 2 + (offset+bit)/8
+			size = (size << 1) | int((packet[idx]>>uint(7-(offset+bit)%8))&1)
+		}
+		if size == 0 || cur+size > len(packet) {
+			return
+		}
+		//1024 samples per frame
+		strem.addPkt(av.Packet{Data: append([]byte{}, packet[cur:cur+size]...)}, timestamp+uint32(i*1024))
+		cur += size
+	}
+}
+
+func (strem *SocketChannel) parseBlock(blockNo int, packet []byte) (err error) {
 	if blockNo%2 != 0 {
 		// rtcp block
 		return
 	}
 
-	streamIndex = blockNo / 2
+	streamIndex := blockNo / 2
+	if streamIndex >= len(strem.streams) {
+		return
+	}
 	stream := strem.streams[streamIndex]
 
 	/*
@@ -195,19 +150,11 @@ func (strem *SocketChannel) parseBlock(blockNo int, packet []byte) (streamIndex
 		+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 	*/
 
-	if len(packet) < 8 {
-		err = fmt.Errorf("rtp packet too short")
-		return
-	}
-	payloadOffset := 12 + int(packet[0]&0xf)*4
-	if payloadOffset+2 > len(packet) {
-		err = fmt.Errorf("rtp packet too short")
+	pkt, err := rtp.Parse(packet)
+	if err != nil {
 		return
 	}
 
-	timestamp := binary.BigEndian.Uint32(packet[4:8])
-	payload := packet[payloadOffset:]
-
 	/*
 		PT 	Encoding Name 	Audio/Video (A/V) 	Clock Rate (Hz) 	Channels 	Reference
 		0	PCMU	A	8000	1	[RFC3551]
@@ -259,9 +206,14 @@ func (strem *SocketChannel) parseBlock(blockNo int, packet []byte) (streamIndex
 		}
 	}
 
-	if err = stream.handlePacket(timestamp, payload); err != nil {
+	if err = stream.handlePacket(pkt.Timestamp, pkt.Marker, pkt.Payload); err != nil {
 		return
 	}
+	for _, pkt := range stream.pkts {
+		pkt.Idx = int8(streamIndex)
+		strem.pkts = append(strem.pkts, pkt)
+	}
+	stream.pkts = nil
 
 	return
 }
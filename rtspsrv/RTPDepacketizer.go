@@ -0,0 +1,199 @@
+// Copyright 2017-2018 The use-go websocket-streamserver Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rtspsrv
+
+import (
+	"errors"
+
+	"github.com/nareix/joy4/av"
+
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/mediatype/h264"
+	"github.com/use-go/websocket-streamserver/mediatype/rtp"
+	"github.com/use-go/websocket-streamserver/rtspsrv/sdp"
+)
+
+//rtpDepacketizer 把推流端的RTP包还原成flv tag
+type rtpDepacketizer struct {
+	codec     av.CodecType
+	clockRate uint32
+	//时间戳以第一个包为0
+	baseTimeSet bool
+	baseTime    uint32
+	headerSent   bool
+	lastSeq      uint16
+	lastSeqValid bool
+	h264         h264.RTPDepacketizer
+	//aac
+	config     []byte
+	sizeLength int
+	indexLen   int
+}
+
+func newRTPDepacketizer(info *sdp.SDPInfo) (depacketizer *rtpDepacketizer, err error) {
+	depacketizer = &rtpDepacketizer{codec: info.Type}
+	depacketizer.clockRate = uint32(info.TimeScale)
+	switch info.Type {
+	case av.H264:
+		if depacketizer.clockRate == 0 {
+			depacketizer.clockRate = RTPH264Freq
+		}
+		for _, nal := range info.SpropParameterSets {
+			if len(nal) == 0 {
+				continue
+			}
+			switch nal[0] & 0x1f {
+			case h264.NalType_sps:
+				depacketizer.h264.SPS = nal
+			case h264.NalType_pps:
+				depacketizer.h264.PPS = nal
+			}
+		}
+	case av.AAC:
+		if len(info.Config) < 2 {
+			return nil, errors.New("aac config not found in sdp")
+		}
+		if depacketizer.clockRate == 0 {
+			return nil, errors.New("aac clock rate not found in sdp")
+		}
+		depacketizer.config = info.Config
+		depacketizer.sizeLength = info.SizeLength
+		depacketizer.indexLen = info.IndexLength
+		if depacketizer.sizeLength == 0 {
+			depacketizer.sizeLength = 13
+		}
+		if depacketizer.indexLen == 0 {
+			depacketizer.indexLen = 3
+		}
+	default:
+		return nil, errors.New("codec not support now:" + info.Type.String())
+	}
+	return
+}
+
+//rtpTime2ms RTP时间转为flv的毫秒时间
+func (depacketizer *rtpDepacketizer) rtpTime2ms(rtpTime uint32) uint32 {
+	if false == depacketizer.baseTimeSet {
+		depacketizer.baseTimeSet = true
+		depacketizer.baseTime = rtpTime
+	}
+	delta := uint64(rtpTime - depacketizer.baseTime)
+	return uint32(delta * 1000 / uint64(depacketizer.clockRate))
+}
+
+//headerTag 生成音视频头,h264在没有sps pps前返回nil
+func (depacketizer *rtpDepacketizer) headerTag() (tag *flv.FlvTag) {
+	switch depacketizer.codec {
+	case av.H264:
+		record := h264.AVCDecoderConfigurationRecord(depacketizer.h264.SPS, depacketizer.h264.PPS)
+		if nil == record {
+			return nil
+		}
+		tag = &flv.FlvTag{TagType: flv.FlvTagVideo, Data: append([]byte{0x17, 0, 0, 0, 0}, record...)}
+	case av.AAC:
+		tag = &flv.FlvTag{TagType: flv.FlvTagAudio}
+		tag.Data = make([]byte, 2+len(depacketizer.config))
+		tag.Data[0] = aacFlvSoundFlag
+		tag.Data[1] = 0
+		copy(tag.Data[2:], depacketizer.config)
+	}
+	return
+}
+
+//aac 44k 16bit stereo
+const aacFlvSoundFlag = (flv.SoundFormatAAC << 4) | 0xf
+
+//addPacket 输入一个RTP包，返回完整的flv tag
+func (depacketizer *rtpDepacketizer) addPacket(pkt *rtp.Packet) (tags []*flv.FlvTag) {
+	lost := false
+	if depacketizer.lastSeqValid && pkt.Seq != depacketizer.lastSeq+1 {
+		lost = true
+	}
+	depacketizer.lastSeq = pkt.Seq
+	depacketizer.lastSeqValid = true
+	switch depacketizer.codec {
+	case av.H264:
+		for _, frame := range depacketizer.h264.AddPayload(pkt.Payload, pkt.Timestamp, pkt.Marker, lost) {
+			tags = depacketizer.flushH264(frame, tags)
+		}
+	case av.AAC:
+		return depacketizer.addAAC(pkt)
+	}
+	return
+}
+
+func (depacketizer *rtpDepacketizer) flushH264(frame *h264.RTPFrame, tags []*flv.FlvTag) []*flv.FlvTag {
+	timestamp := depacketizer.rtpTime2ms(frame.Timestamp)
+	if depacketizer.h264.ParamsChanged || false == depacketizer.headerSent {
+		header := depacketizer.headerTag()
+		if nil == header {
+			return tags
+		}
+		header.Timestamp = timestamp
+		tags = append(tags, header)
+		depacketizer.headerSent = true
+		depacketizer.h264.ParamsChanged = false
+	}
+	data := []byte{0x27, 1, 0, 0, 0}
+	if frame.KeyFrame {
+		data[0] = 0x17
+	}
+	tags = append(tags, &flv.FlvTag{TagType: flv.FlvTagVideo, Timestamp: timestamp, Data: append(data, frame.AVCC()...)})
+	return tags
+}
+
+//addAAC mpeg4-generic AAC-hbr,每个AU一个tag
+func (depacketizer *rtpDepacketizer) addAAC(pkt *rtp.Packet) (tags []*flv.FlvTag) {
+	payload := pkt.Payload
+	if len(payload) < 2 {
+		return
+	}
+	if false == depacketizer.headerSent {
+		header := depacketizer.headerTag()
+		header.Timestamp = depacketizer.rtpTime2ms(pkt.Timestamp)
+		tags = append(tags, header)
+		depacketizer.headerSent = true
+	}
+	headersBits := int(payload[0])<<8 | int(payload[1])
+	headersLength := (headersBits + 7) / 8
+	if 2+headersLength > len(payload) {
+		return
+	}
+	auHeaderBits := depacketizer.sizeLength + depacketizer.indexLen
+	if auHeaderBits == 0 {
+		return
+	}
+	auHeaders := payload[2 : 2+headersLength]
+	cur := 2 + headersLength
+	auCount := headersBits / auHeaderBits
+	for i := 0; i < auCount; i++ {
+		size := readBits(auHeaders, i*auHeaderBits, depacketizer.sizeLength)
+		if size <= 0 || cur+size > len(payload) {
+			break
+		}
+		//1024 samples per AAC frame
+		timestamp := depacketizer.rtpTime2ms(pkt.Timestamp + uint32(i*1024))
+		tag := &flv.FlvTag{TagType: flv.FlvTagAudio, Timestamp: timestamp}
+		tag.Data = make([]byte, 2+size)
+		tag.Data[0] = aacFlvSoundFlag
+		tag.Data[1] = 1
+		copy(tag.Data[2:], payload[cur:cur+size])
+		cur += size
+		tags = append(tags, tag)
+	}
+	return
+}
+
+func readBits(data []byte, offset, count int) (val int) {
+	for i := 0; i < count; i++ {
+		idx := (offset + i) / 8
+		if idx >= len(data) {
+			return
+		}
+		bit := (data[idx] >> uint(7-(offset+i)%8)) & 1
+		val = (val << 1) | int(bit)
+	}
+	return
+}
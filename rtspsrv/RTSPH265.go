@@ -0,0 +1,102 @@
+package rtspsrv
+
+import (
+	"container/list"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/mediatype/hevc"
+)
+
+func genH265sdp(hvcc []byte) (sdp string) {
+	vps, sps, pps, err := hevc.GetVpsSpsPpsFromHVCC(hvcc)
+	if err != nil || len(vps) == 0 || len(pps) == 0 {
+		logger.LOGE("invalid hvcC,no vps sps or pps")
+		return
+	}
+	fmtpLine := fmt.Sprintf("a=fmtp:%d sprop-vps=%s;sprop-sps=%s;sprop-pps=%s\r\n", PayloadH264,
+		base64.StdEncoding.EncodeToString(vps[0]),
+		base64.StdEncoding.EncodeToString(sps[0]),
+		base64.StdEncoding.EncodeToString(pps[0]))
+	sdp = fmt.Sprintf("m=video 0 RTP/AVP %d\r\nc=IN IP4 0.0.0.0\r\nb=AS:%d\r\na=rtpmap:%d H265/%d\r\na=range:npt=0-\r\n%sa=control:%s\r\n",
+		PayloadH264, 500, PayloadH264, RTPH264Freq, fmtpLine, CtrlTrackVideo)
+	return
+}
+
+//generateVideoRTPPackets choose the packetizer by the codec of video header
+func (rtspHandler *RTSPHandler) generateVideoRTPPackets(tag *flv.FlvTag, beginTime uint32, track *trackInfo) (rtpPkts *list.List) {
+	video, err := flv.GetVideoTag(rtspHandler.videoHeader)
+	if err == nil && video.FourCC == flv.FourCCHEVC {
+		return rtspHandler.generateH265RTPPackets(tag, beginTime, track)
+	}
+	return rtspHandler.generateH264RTPPackets(tag, beginTime, track)
+}
+
+//rfc 7798,single nal unit and fragmentation unit,parameter sets before irap in an aggregation packet
+func (rtspHandler *RTSPHandler) generateH265RTPPackets(tag *flv.FlvTag, beginTime uint32, track *trackInfo) (rtpPkts *list.List) {
+	video, err := flv.GetVideoTag(tag)
+	if err != nil || (video.PacketType != flv.PacketTypeCodedFrames && video.PacketType != flv.PacketTypeCodedFramesX) {
+		return
+	}
+	payloadSize := RTPMTU - 12 //rtp header
+	if track.transPort == "tcp" {
+		payloadSize -= 4
+	}
+	timestamp := tag.Timestamp - beginTime
+	if tag.Timestamp < beginTime {
+		timestamp = 0
+	}
+	//rtptime/timestamp=rate/1000  rtptime=rate*timestamp/1000
+	tmp64 := int64(track.clockRate / 1000)
+	timestamp = uint32((tmp64 * int64(timestamp)) & 0xffffffff)
+
+	rtpPkts = list.New()
+	pushPacket := func(payload []byte) {
+		track.seq++
+		if track.seq > 0xffff {
+			track.seq = 0
+		}
+		pkt := createRTPHeader(PayloadH264, uint32(track.seq), timestamp, track.ssrc)
+		rtpPkts.PushBack(append(pkt, payload...))
+	}
+	data := video.Data
+	for cur := 0; cur+4 <= len(data); {
+		nalSize := int(binary.BigEndian.Uint32(data[cur:]))
+		cur += 4
+		if nalSize <= 2 || cur+nalSize > len(data) {
+			logger.LOGE("invalid hevc nal size")
+			return
+		}
+		nal := data[cur : cur+nalSize]
+		cur += nalSize
+		nalType := hevc.NalType(nal)
+		switch {
+		case nalType == hevc.NalTypeVPS || nalType == hevc.NalTypeSPS || nalType == hevc.NalTypePPS:
+			//sent with irap from hvcC
+			continue
+		case nalType == hevc.NalTypeAUD:
+			continue
+		case hevc.IsIRAP(nalType):
+			vps, sps, pps, err := hevc.GetVpsSpsPpsFromHVCC(rtspHandler.videoHeaderConfig())
+			if err == nil {
+				pushPacket(hevc.RTPAggregation(append(append(vps, sps...), pps...)...))
+			}
+		}
+		for _, payload := range hevc.RTPPayloads(nal, payloadSize) {
+			pushPacket(payload)
+		}
+	}
+	return
+}
+
+//videoHeaderConfig decoder configuration record of the video header
+func (rtspHandler *RTSPHandler) videoHeaderConfig() []byte {
+	video, err := flv.GetVideoTag(rtspHandler.videoHeader)
+	if err != nil {
+		return nil
+	}
+	return video.Data
+}
@@ -6,15 +6,20 @@ package rtspsrv
 
 import (
 	"container/list"
+	"encoding/binary"
 	"errors"
 	"net"
 
 	"github.com/use-go/websocket-streamserver/logger"
 
 	"github.com/use-go/websocket-streamserver/events/eStreamerEvent"
+	"github.com/use-go/websocket-streamserver/events/eVODEvent"
 	"github.com/use-go/websocket-streamserver/mediatype/amf"
 	"github.com/use-go/websocket-streamserver/mediatype/flv"
 	"github.com/use-go/websocket-streamserver/mediatype/h264"
+	"github.com/use-go/websocket-streamserver/metrics"
+	"github.com/use-go/websocket-streamserver/rtspsrv/sdp"
+	"github.com/use-go/websocket-streamserver/session"
 	//	"strconv"
 	"strings"
 	"sync"
@@ -43,6 +48,18 @@ type RTSPHandler struct {
 	tracks      map[string]*trackInfo
 	mutexTracks sync.RWMutex
 	tcpTimeout  bool //just for vlc(live555) no heart beat
+	stats       *metrics.SinkStats
+	sess        *session.Session
+
+	//推流
+	announced    bool
+	medias       map[string]*sdp.SDPInfo
+	isPublishing bool
+	waitPublish  *sync.WaitGroup
+	source       wssapi.MsgHandler
+	srcID        int64
+	srcAdded     bool
+	mutexSource  sync.Mutex
 }
 
 type trackInfo struct {
@@ -67,6 +84,7 @@ type trackInfo struct {
 	RTCPCliConn  *net.UDPConn //
 	RTPSvrConn   *net.UDPConn //接收客户端的数据
 	RTCPSvrConn  *net.UDPConn //
+	depacketizer *rtpDepacketizer
 }
 
 func (trackinfo *trackInfo) reset() {
@@ -107,6 +125,7 @@ func (rtspHandler *RTSPHandler) Init(msg *wssapi.Msg) (err error) {
 	rtspHandler.sinkAdded = false
 	rtspHandler.tracks = make(map[string]*trackInfo)
 	rtspHandler.waitPlaying = new(sync.WaitGroup)
+	rtspHandler.waitPublish = new(sync.WaitGroup)
 	rtspHandler.tcpTimeout = true
 	return
 }
@@ -120,6 +139,7 @@ func (rtspHandler *RTSPHandler) Start(msg *wssapi.Msg) (err error) {
 func (rtspHandler *RTSPHandler) Stop(msg *wssapi.Msg) (err error) {
 	rtspHandler.isPlaying = false
 	rtspHandler.waitPlaying.Wait()
+	rtspHandler.stopPublish()
 	rtspHandler.delSink()
 	return
 }
@@ -145,6 +165,16 @@ func (rtspHandler *RTSPHandler) ProcessMessage(msg *wssapi.Msg) (err error) {
 	case wssapi.MsgPlayStop:
 		//如果在play,停止
 		rtspHandler.sinkRunning = false
+	case wssapi.MsgSourceClosedForce:
+		//推流被踢掉,断开连接,读循环退出后由 Stop 清理
+		logger.LOGT("rtsp source closed force:" + rtspHandler.streamName)
+		rtspHandler.mutexSource.Lock()
+		rtspHandler.srcAdded = false
+		rtspHandler.source = nil
+		rtspHandler.mutexSource.Unlock()
+		if rtspHandler.conn != nil {
+			rtspHandler.conn.Close()
+		}
 	default:
 		logger.LOGE("msg not processed")
 	}
@@ -162,10 +192,22 @@ func (rtspHandler *RTSPHandler) appendFlvTag(msg *wssapi.Msg) (err error) {
 		rtspHandler.videoHeader = tag.Copy()
 		return
 	}
+	//点播seek后会重发音视频头
+	if flv.IsAudioSequenceHeader(tag) {
+		rtspHandler.audioHeader = tag.Copy()
+		return
+	}
+	if flv.IsVideoSequenceHeader(tag) {
+		rtspHandler.videoHeader = tag.Copy()
+		return
+	}
 
 	if tag.TagType == flv.FlvTagVideo {
 		rtspHandler.mutexVideo.Lock()
 		if rtspHandler.videoCache == nil || rtspHandler.videoCache.Len() > 0xff {
+			if rtspHandler.videoCache != nil {
+				rtspHandler.stats.AddDropped(rtspHandler.videoCache.Len())
+			}
 			rtspHandler.videoCache = list.New()
 		}
 		rtspHandler.videoCache.PushBack(tag.Copy())
@@ -175,6 +217,9 @@ func (rtspHandler *RTSPHandler) appendFlvTag(msg *wssapi.Msg) (err error) {
 	if flv.FlvTagAudio == tag.TagType {
 		rtspHandler.mutexAudio.Lock()
 		if rtspHandler.audioCache == nil || rtspHandler.audioCache.Len() > 0xff {
+			if rtspHandler.audioCache != nil {
+				rtspHandler.stats.AddDropped(rtspHandler.audioCache.Len())
+			}
 			rtspHandler.audioCache = list.New()
 		}
 		rtspHandler.audioCache.PushBack(tag.Copy())
@@ -196,9 +241,16 @@ func (rtspHandler *RTSPHandler) handlePacket(data []byte) (err error) {
 	return rtspHandler.handleRTSP(data)
 }
 
+//handleRTPRTCP channel:1 length:2 data
 func (rtspHandler *RTSPHandler) handleRTPRTCP(data []byte) (err error) {
-	logger.LOGT("RTP RTCP not processed")
-	return
+	if len(data) < 3 {
+		return errors.New("interleaved data invalid")
+	}
+	if false == rtspHandler.isPublishing {
+		//播放端的RTCP 暂不处理
+		return
+	}
+	return rtspHandler.recordInterleaved(int(data[0]), data[3:])
 }
 
 func (rtspHandler *RTSPHandler) handleRTSP(data []byte) (err error) {
@@ -219,6 +271,9 @@ func (rtspHandler *RTSPHandler) handleRTSP(data []byte) (err error) {
 		}
 		cmd = strs[0]
 	}
+	if userAgent := getHeaderByName(lines, HDRUSERAGENT+":", true); len(userAgent) > 0 {
+		rtspHandler.sess.SetAgent(strings.TrimSpace(strings.TrimPrefix(userAgent, HDRUSERAGENT+":")))
+	}
 	//处理每个方法
 	switch cmd {
 	case RTSPMethodOptions:
@@ -231,6 +286,12 @@ func (rtspHandler *RTSPHandler) handleRTSP(data []byte) (err error) {
 		return rtspHandler.servePlay(lines)
 	case RTSPMethodPause:
 		return rtspHandler.servePause(lines)
+	case RTSPMethodAnnounce:
+		return rtspHandler.serveAnnounce(lines, data)
+	case RTSPMethodRecord:
+		return rtspHandler.serveRecord(lines)
+	case RTSPMethodTeardown:
+		return rtspHandler.serveTeardown(lines)
 	default:
 		logger.LOGE("method " + cmd + " not support now")
 		return rtspHandler.sendErrorReply(lines, 551)
@@ -240,7 +301,7 @@ func (rtspHandler *RTSPHandler) handleRTSP(data []byte) (err error) {
 func (rtspHandler *RTSPHandler) send(data []byte) (err error) {
 	rtspHandler.mutexConn.Lock()
 	defer rtspHandler.mutexConn.Unlock()
-	_, err = utils.TCPWriteTimeOut(rtspHandler.conn, data, serviceConfig.TimeoutSec)
+	_, err = utils.TCPWriteTimeOut(rtspHandler.conn, data, config().TimeoutSec)
 	return
 }
 
@@ -253,12 +314,16 @@ func (rtspHandler *RTSPHandler) addSink() bool {
 	taskAddSink.StreamName = rtspHandler.streamName
 	taskAddSink.SinkId = rtspHandler.session
 	taskAddSink.Sinker = rtspHandler
+	rtspHandler.stats = metrics.AddSink(metrics.ProtocolRTSP, rtspHandler.streamName, rtspHandler.session)
 	err := wssapi.HandleTask(taskAddSink)
 	if err != nil {
 		logger.LOGE(err.Error())
+		metrics.DelSink(rtspHandler.stats)
+		rtspHandler.stats = nil
 		return false
 	}
 	rtspHandler.sinkAdded = true
+	rtspHandler.sess.SetStream(rtspHandler.streamName, false)
 	return true
 }
 
@@ -271,6 +336,26 @@ func (rtspHandler *RTSPHandler) delSink() {
 	taskDelSink.SinkId = rtspHandler.session
 	wssapi.HandleTask(taskDelSink)
 	rtspHandler.sinkAdded = false
+	metrics.DelSink(rtspHandler.stats)
+}
+
+//vodControl 只有点播流支持暂停和seek
+func (rtspHandler *RTSPHandler) vodControl(action string, positionMs int64) (position int64, err error) {
+	if false == rtspHandler.sinkAdded {
+		err = errors.New("sink not added")
+		return
+	}
+	taskCtrl := &eVODEvent.EveVODControl{}
+	taskCtrl.StreamName = rtspHandler.streamName
+	taskCtrl.SinkId = rtspHandler.session
+	taskCtrl.Action = action
+	taskCtrl.PositionMs = positionMs
+	err = wssapi.HandleTask(taskCtrl)
+	if err != nil {
+		return
+	}
+	position = taskCtrl.PositionMs
+	return
 }
 
 func (rtspHandler *RTSPHandler) threadPlay() {
@@ -546,7 +631,7 @@ func (rtspHandler *RTSPHandler) threadTCP(ch chan int, track *trackInfo) {
 
 func (rtspHandler *RTSPHandler) sendFlvH264(track *trackInfo, tag *flv.FlvTag, beginSend uint32) (err error) {
 	if "udp" == track.transPort {
-		pkts := rtspHandler.generateH264RTPPackets(tag, beginSend, track)
+		pkts := rtspHandler.generateVideoRTPPackets(tag, beginSend, track)
 		if nil == pkts {
 			return
 		}
@@ -557,13 +642,14 @@ func (rtspHandler *RTSPHandler) sendFlvH264(track *trackInfo, tag *flv.FlvTag, b
 			_, err = track.RTPCliConn.Write(v.Value.([]byte))
 			track.pktSend++
 			track.byteSend += int64(len(v.Value.([]byte)))
+			rtspHandler.stats.AddBytes(len(v.Value.([]byte)))
 			if err != nil {
 				logger.LOGE(err.Error())
 				return
 			}
 		}
 	} else {
-		pkts := rtspHandler.generateH264RTPPackets(tag, beginSend, track)
+		pkts := rtspHandler.generateVideoRTPPackets(tag, beginSend, track)
 		if nil == pkts {
 			return
 		}
@@ -578,12 +664,14 @@ func (rtspHandler *RTSPHandler) sendFlvH264(track *trackInfo, tag *flv.FlvTag, b
 				tcpHeader[2] = byte(dataSize >> 8)
 				tcpHeader[3] = byte(dataSize & 0xff)
 				track.byteSend += 4
+				rtspHandler.stats.AddBytes(4)
 				rtspHandler.send(tcpHeader)
 			}
 
 			err = rtspHandler.send(pktData)
 			track.pktSend++
 			track.byteSend += int64(dataSize)
+			rtspHandler.stats.AddBytes(dataSize)
 			if err != nil {
 				logger.LOGE(err.Error())
 				return
@@ -600,6 +688,8 @@ func (rtspHandler *RTSPHandler) sendFlvAudio(track *trackInfo, tag *flv.FlvTag,
 		pkts = rtspHandler.generateAACRTPPackets(tag, beginSend, track)
 	case flv.SoundFormatMP3:
 		pkts = rtspHandler.generateMP3RTPPackets(tag, beginSend, track)
+	case flv.SoundFormatExHeader:
+		pkts = rtspHandler.generateOpusRTPPackets(tag, beginSend, track)
 	default:
 		logger.LOGW("audio type not support now")
 		return
@@ -615,6 +705,7 @@ func (rtspHandler *RTSPHandler) sendFlvAudio(track *trackInfo, tag *flv.FlvTag,
 			_, err = track.RTPCliConn.Write(v.Value.([]byte))
 			track.pktSend++
 			track.byteSend += int64(len(v.Value.([]byte)))
+			rtspHandler.stats.AddBytes(len(v.Value.([]byte)))
 			if err != nil {
 				logger.LOGE(err.Error())
 				return
@@ -629,12 +720,14 @@ func (rtspHandler *RTSPHandler) sendFlvAudio(track *trackInfo, tag *flv.FlvTag,
 				tcpHeader[2] = byte(dataSize >> 8)
 				tcpHeader[3] = byte(dataSize & 0xff)
 				track.byteSend += 4
+				rtspHandler.stats.AddBytes(4)
 				rtspHandler.send(tcpHeader)
 			}
 
 			err = rtspHandler.send(pktData)
 			track.pktSend++
 			track.byteSend += int64(dataSize)
+			rtspHandler.stats.AddBytes(dataSize)
 			if err != nil {
 				logger.LOGE(err.Error())
 				return
@@ -658,168 +751,62 @@ func (rtspHandler *RTSPHandler) sendRTCP(track *trackInfo, rtpTime uint32) {
 
 //packetization-mode 1
 func (rtspHandler *RTSPHandler) generateH264RTPPackets(tag *flv.FlvTag, beginTime uint32, track *trackInfo) (rtpPkts *list.List) {
-	payLoadSize := RTPMTU
+	payLoadSize := RTPMTU - 12 //rtp header
 	if track.transPort == "tcp" {
 		payLoadSize -= 4
 	}
 	//忽略AVC
-
-	if tag.Data[0] == 0x17 && tag.Data[1] == 0x0 {
+	if flv.IsVideoSequenceHeader(tag) {
 		return
 	}
-	//frame类型：1  avc type:1 compositionTime:3 nalsize:4
-	//可能有多个nal
-	cur := 5
+	video, err := flv.GetVideoTag(tag)
+	if err != nil {
+		return
+	}
+	//计算RTP时间
+	timestamp := tag.Timestamp - beginTime
+	if tag.Timestamp < beginTime {
+		timestamp = 0
+	}
+	//rtptime/timestamp=rate/1000  rtptime=rate*timestamp/1000
+	tmp64 := int64(track.clockRate / 1000)
+	timestamp = uint32((tmp64 * int64(timestamp)) & 0xffffffff)
+
 	rtpPkts = list.New()
-	for cur < len(tag.Data) {
-		nalSize, _ := amf.AMF0DecodeInt32(tag.Data[cur:])
+	pushPacket := func(payload []byte) {
+		track.seq++
+		if track.seq > 0xffff {
+			track.seq = 0
+		}
+		pkt := createRTPHeader(PayloadH264, uint32(track.seq), timestamp, track.ssrc)
+		rtpPkts.PushBack(append(pkt, payload...))
+	}
+	//nalsize:4,可能有多个nal
+	data := video.Data
+	for cur := 0; cur+4 <= len(data); {
+		nalSize := int(binary.BigEndian.Uint32(data[cur:]))
 		cur += 4
-		nalData := tag.Data[cur : cur+int(nalSize)]
-		cur += int(nalSize)
-		nalType := nalData[0] & 0xf
+		if nalSize <= 0 || cur+nalSize > len(data) {
+			logger.LOGE("invalid h264 nal size")
+			return
+		}
+		nalData := data[cur : cur+nalSize]
+		cur += nalSize
+		nalType := nalData[0] & 0x1f
 		//忽略sps pps
 		if nalType == h264.NalType_sps || nalType == h264.NalType_pps {
 			continue
 		}
-
-		//计算RTP时间
-		timestamp := tag.Timestamp - beginTime
-		if tag.Timestamp < beginTime {
-			timestamp = 0
-		}
-		//rtptime/timestamp=rate/1000  rtptime=rate*timestamp/1000
-		tmp64 := int64(track.clockRate / 1000)
-		timestamp = uint32((tmp64 * int64(timestamp)) & 0xffffffff)
 		//关键帧前面加sps pps
-		if nalType == h264.NalType_idr {
-			sps, pps := h264.GetSpsPpsFromAVC(rtspHandler.videoHeader.Data[5:])
-
-			stapA := &amf.AMF0Encoder{}
-			stapA.Init()
-			{
-				//header
-				track.seq++
-				if track.seq > 0xffff {
-					track.seq = 0
-				}
-				headerData := createRTPHeader(PayloadH264, uint32(track.seq), timestamp, track.ssrc)
-				stapA.AppendByteArray(headerData)
-				//start bit
-				Nri := ((sps[0] & 0x60) >> 5)
-				Type := byte(NalTypeStapA)
-				stapA.AppendByte(((Nri << 5) | Type))
-				//sps size
-				stapA.EncodeInt16(int16(len(sps)))
-				//sps
-				stapA.AppendByteArray(sps)
-				//pps size
-				stapA.EncodeInt16(int16(len(pps)))
-				//pps
-				stapA.AppendByteArray(pps)
-				pktData, _ := stapA.GetData()
-				rtpPkts.PushBack(pktData)
-			}
+		if avc := rtspHandler.videoHeaderConfig(); nalType == h264.NalType_idr && len(avc) > 8 {
+			sps, pps := h264.GetSpsPpsFromAVC(avc)
+			pushPacket(h264.RTPStapA(sps, pps))
 		}
-		//帧数据
-		{
-			payLoadSize -= 13 //12 rtp header,1 f nri type
-			//单一包
-			if nalSize < uint32(payLoadSize) {
-				single := &amf.AMF0Encoder{}
-				single.Init()
-				track.seq++
-				if track.seq > 0xffff {
-					track.seq = 0
-				}
-				headerData := createRTPHeader(PayloadH264, uint32(track.seq), timestamp, track.ssrc)
-				single.AppendByteArray(headerData)
-				single.AppendByteArray(nalData)
-				pktData, _ := single.GetData()
-				rtpPkts.PushBack(pktData)
-			} else {
-				//分片包,使用FU_A包
-				payLoadSize-- //FU header
-				var FuS, FuE, FuR, FuType, Nri, Type byte
-				Nri = ((nalData[0] & 0x60) >> 5)
-				Type = NalTypeFuA
-				FuType = nalType
-				count := int(nalSize) / payLoadSize
-				if count*payLoadSize < int(nalSize) {
-					count++
-				}
-				//first frame
-				curFrame := 0
-				curNalData := 1 //nal 的第一个字节的帧类型信息放到fh_header 里面
-				{
-					FuS = 1
-					FuE = 0
-					FuR = 0
-					fua := amf.AMF0Encoder{}
-					fua.Init()
-					track.seq++
-					if track.seq > 0xffff {
-						track.seq = 0
-					}
-					headerData := createRTPHeader(PayloadH264, uint32(track.seq), timestamp, track.ssrc)
-					fua.AppendByteArray(headerData)
-					fua.AppendByte((Nri << 5) | Type)
-					fua.AppendByte((FuS << 7) | (FuE << 6) | (FuR << 5) | FuType)
-					fua.AppendByteArray(nalData[curNalData : payLoadSize+curNalData])
-					curNalData += payLoadSize
-					pktData, _ := fua.GetData()
-					rtpPkts.PushBack(pktData)
-					curFrame++
-				}
-
-				//mid frame
-				{
-					FuS = 0
-					FuE = 0
-					FuR = 0
-					for curFrame+1 < count {
-						track.seq++
-						if track.seq > 0xffff {
-							track.seq = 0
-						}
-						fua := amf.AMF0Encoder{}
-						fua.Init()
-						headerData := createRTPHeader(PayloadH264, uint32(track.seq), timestamp, track.ssrc)
-						fua.AppendByteArray(headerData)
-						fua.AppendByte((Nri << 5) | Type)
-						fua.AppendByte((FuS << 7) | (FuE << 6) | (FuR << 5) | FuType)
-						fua.AppendByteArray(nalData[curNalData : payLoadSize+curNalData])
-						curNalData += payLoadSize
-						pktData, _ := fua.GetData()
-						rtpPkts.PushBack(pktData)
-						curFrame++
-					}
-				}
-				//last frame
-				lastFrameSize := int(nalSize) - curNalData
-				if lastFrameSize > 0 {
-					FuS = 0
-					FuE = 1
-					FuR = 0
-					track.seq++
-					if track.seq > 0xffff {
-						track.seq = 0
-					}
-					fua := amf.AMF0Encoder{}
-					fua.Init()
-					headerData := createRTPHeader(PayloadH264, uint32(track.seq), timestamp, track.ssrc)
-					fua.AppendByteArray(headerData)
-					fua.AppendByte((Nri << 5) | Type)
-					fua.AppendByte((FuS << 7) | (FuE << 6) | (FuR << 5) | FuType)
-					fua.AppendByteArray(nalData[curNalData:])
-					curNalData += payLoadSize
-					pktData, _ := fua.GetData()
-					rtpPkts.PushBack(pktData)
-					curFrame++
-				}
-			}
+		//单一包或FU_A分片包
+		for _, payload := range h264.RTPPayloads(nalData, payLoadSize) {
+			pushPacket(payload)
 		}
 	}
-
 	return
 }
 
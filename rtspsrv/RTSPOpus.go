@@ -0,0 +1,44 @@
+package rtspsrv
+
+import (
+	"container/list"
+	"strconv"
+
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+)
+
+//rfc 7587,the clock rate is always 48000 and two channels in rtpmap
+const RTPOpusFreq = 48000
+
+func genOpussdp() (sdp string) {
+	sdp += "m=audio 0 RTP/AVP " + strconv.Itoa(PayloadH264) + RTSPEndLine
+	sdp += "a=rtpmap:" + strconv.Itoa(PayloadH264) + " opus/48000/2" + RTSPEndLine
+	sdp += "a=fmtp:" + strconv.Itoa(PayloadH264) + " sprop-stereo=1" + RTSPEndLine
+	sdp += "a=control:" + CtrlTrackAudio + RTSPEndLine
+	logger.LOGD(sdp)
+	return
+}
+
+//generateOpusRTPPackets one opus packet in one rtp packet
+func (rtspHandler *RTSPHandler) generateOpusRTPPackets(tag *flv.FlvTag, beginTime uint32, track *trackInfo) (rtpPkts *list.List) {
+	audio, err := flv.GetAudioTag(tag)
+	if err != nil || audio.PacketType != flv.PacketTypeCodedFrames || len(audio.Data) == 0 {
+		return
+	}
+	timestamp := tag.Timestamp - beginTime
+	if tag.Timestamp < beginTime {
+		timestamp = 0
+	}
+	//rtptime/timestamp=rate/1000  rtptime=rate*timestamp/1000
+	tmp64 := int64(RTPOpusFreq / 1000)
+	timestamp = uint32((tmp64 * int64(timestamp)) & 0xffffffff)
+	track.seq++
+	if track.seq > 0xffff {
+		track.seq = 0
+	}
+	pkt := createRTPHeader(PayloadH264, uint32(track.seq), timestamp, track.ssrc)
+	rtpPkts = list.New()
+	rtpPkts.PushBack(append(pkt, audio.Data...))
+	return
+}
@@ -0,0 +1,277 @@
+// Copyright 2017-2018 The use-go websocket-streamserver Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rtspsrv
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/authorizer"
+	"github.com/use-go/websocket-streamserver/events/eStreamerEvent"
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/mediatype/rtp"
+	"github.com/use-go/websocket-streamserver/rtspsrv/sdp"
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+//serveAnnounce 推流端发来sdp
+func (rtspHandler *RTSPHandler) serveAnnounce(lines []string, data []byte) (err error) {
+	cseq := getCSeq(lines)
+	if rtspHandler.isPlaying || rtspHandler.isPublishing || rtspHandler.sinkAdded {
+		return rtspHandler.sendErrorReply(lines, 455)
+	}
+	strSpaces := strings.Split(removeSpace(lines[0]), " ")
+	if len(strSpaces) < 2 {
+		return rtspHandler.sendErrorReply(lines, 400)
+	}
+	_, streamName, token, err := rtspHandler.parseURL(strSpaces[1])
+	if err != nil || len(streamName) == 0 {
+		return rtspHandler.sendErrorReply(lines, 400)
+	}
+	rtspHandler.streamName = streamName
+	errAuth := rtspHandler.authorize(authorizer.ActionPublish, token)
+	if errAuth != nil {
+		rtspHandler.streamName = ""
+		return rtspHandler.sendErrorReply(lines, authorizer.StatusCode(errAuth))
+	}
+	contentType := getHeaderByName(lines, HDRCONTENTTYPE, false)
+	if false == strings.Contains(contentType, "application/sdp") {
+		logger.LOGE("announce without sdp:" + contentType)
+		return rtspHandler.sendErrorReply(lines, 415)
+	}
+	parts := strings.SplitN(string(data), RTSPEndLine+RTSPEndLine, 2)
+	if len(parts) != 2 {
+		return rtspHandler.sendErrorReply(lines, 400)
+	}
+	medias := make(map[string]*sdp.SDPInfo)
+	infos := sdp.Decode(parts[1])
+	for i := range infos {
+		if _, err := newRTPDepacketizer(&infos[i]); err != nil {
+			logger.LOGW("announce ignore media " + infos[i].AVType + ":" + err.Error())
+			continue
+		}
+		medias[controlName(infos[i].Control)] = &infos[i]
+	}
+	if len(medias) == 0 {
+		logger.LOGE("announce no supported media")
+		return rtspHandler.sendErrorReply(lines, 415)
+	}
+	rtspHandler.streamName = streamName
+	rtspHandler.announced = true
+	rtspHandler.medias = medias
+
+	strOut := RTSPVer + " " + strconv.Itoa(200) + " " + getRTSPStatusByCode(200) + RTSPEndLine
+	strOut += HDRCSEQ + ": " + strconv.Itoa(cseq) + RTSPEndLine
+	strOut += "Server: " + RTSPServerName + RTSPEndLine
+	strOut += "Session: " + rtspHandler.session + RTSPEndLine
+	strOut += RTSPEndLine
+	return rtspHandler.send([]byte(strOut))
+}
+
+//controlName a=control 可能是绝对地址，也可能是相对地址，取最后一段
+func controlName(control string) string {
+	subs := strings.Split(strings.TrimSuffix(control, "/"), "/")
+	return subs[len(subs)-1]
+}
+
+func (rtspHandler *RTSPHandler) serveRecord(lines []string) (err error) {
+	cseq := getCSeq(lines)
+	errCode := 0
+	defer func() {
+		if err != nil {
+			logger.LOGE(err.Error())
+		}
+		if errCode != 0 {
+			rtspHandler.sendErrorReply(lines, errCode)
+		}
+	}()
+	cliSession := rtspHandler.getSession(lines)
+	if cliSession != rtspHandler.session {
+		err = errors.New("session wrong")
+		errCode = 454
+		return
+	}
+	if false == rtspHandler.announced || rtspHandler.isPublishing || len(rtspHandler.tracks) == 0 {
+		err = errors.New("record on bad status")
+		errCode = 455
+		return
+	}
+	//add to source
+	taskAddSrc := &eStreamerEvent.EveAddSource{}
+	taskAddSrc.Producer = rtspHandler
+	taskAddSrc.StreamName = rtspHandler.streamName
+	taskAddSrc.RemoteIp = rtspHandler.conn.RemoteAddr()
+	err = wssapi.HandleTask(taskAddSrc)
+	if err != nil || nil == taskAddSrc.SrcObj {
+		err = errors.New("add source failed:" + rtspHandler.streamName)
+		errCode = 403
+		return
+	}
+	rtspHandler.sess.SetStream(rtspHandler.streamName, true)
+	rtspHandler.mutexSource.Lock()
+	rtspHandler.source = taskAddSrc.SrcObj
+	rtspHandler.srcID = taskAddSrc.ID
+	rtspHandler.srcAdded = true
+	rtspHandler.mutexSource.Unlock()
+	rtspHandler.isPublishing = true
+
+	rtspHandler.mutexTracks.RLock()
+	for _, v := range rtspHandler.tracks {
+		if "udp" == v.transPort {
+			//udp 推流时控制连接上可能没有心跳，超时由接收线程判断
+			rtspHandler.tcpTimeout = false
+			rtspHandler.waitPublish.Add(1)
+			go rtspHandler.threadRecordUDP(v)
+		}
+	}
+	rtspHandler.mutexTracks.RUnlock()
+
+	strOut := RTSPVer + " " + strconv.Itoa(200) + " " + getRTSPStatusByCode(200) + RTSPEndLine
+	strOut += HDRCSEQ + ": " + strconv.Itoa(cseq) + RTSPEndLine
+	strOut += "Server: " + RTSPServerName + RTSPEndLine
+	strOut += "Session: " + rtspHandler.session + RTSPEndLine
+	strOut += RTSPEndLine
+	err = rtspHandler.send([]byte(strOut))
+	logger.LOGT("rtsp publish start:" + rtspHandler.streamName)
+	return
+}
+
+func (rtspHandler *RTSPHandler) serveTeardown(lines []string) (err error) {
+	cseq := getCSeq(lines)
+	rtspHandler.stopPlayThread()
+	rtspHandler.stopPublish()
+	rtspHandler.delSink()
+	strOut := RTSPVer + " " + strconv.Itoa(200) + " " + getRTSPStatusByCode(200) + RTSPEndLine
+	strOut += HDRCSEQ + ": " + strconv.Itoa(cseq) + RTSPEndLine
+	strOut += "Session: " + rtspHandler.session + RTSPEndLine
+	strOut += RTSPEndLine
+	return rtspHandler.send([]byte(strOut))
+}
+
+func (rtspHandler *RTSPHandler) stopPublish() {
+	if false == rtspHandler.isPublishing && false == rtspHandler.srcAdded {
+		return
+	}
+	rtspHandler.isPublishing = false
+	//关闭udp连接以结束接收线程
+	rtspHandler.mutexTracks.RLock()
+	for _, v := range rtspHandler.tracks {
+		if nil != v.RTPSvrConn {
+			v.RTPSvrConn.Close()
+		}
+		if nil != v.RTCPSvrConn {
+			v.RTCPSvrConn.Close()
+		}
+	}
+	rtspHandler.mutexTracks.RUnlock()
+	rtspHandler.waitPublish.Wait()
+
+	//删除源时streamer会回调ProcessMessage,不能持有锁
+	rtspHandler.mutexSource.Lock()
+	srcAdded := rtspHandler.srcAdded
+	srcID := rtspHandler.srcID
+	rtspHandler.srcAdded = false
+	rtspHandler.source = nil
+	rtspHandler.mutexSource.Unlock()
+	if srcAdded {
+		taskDelSrc := &eStreamerEvent.EveDelSource{}
+		taskDelSrc.StreamName = rtspHandler.streamName
+		taskDelSrc.ID = srcID
+		wssapi.HandleTask(taskDelSrc)
+		logger.LOGT("del source:" + rtspHandler.streamName)
+	}
+}
+
+func (rtspHandler *RTSPHandler) threadRecordUDP(track *trackInfo) {
+	defer rtspHandler.waitPublish.Done()
+	go rtspHandler.threadRecordRTCP(track)
+	data := make([]byte, RTPDefaultMTU2)
+	for rtspHandler.isPublishing {
+		track.RTPSvrConn.SetReadDeadline(time.Now().Add(time.Duration(config().TimeoutSec) * time.Second))
+		size, _, err := track.RTPSvrConn.ReadFromUDP(data)
+		if err != nil {
+			if rtspHandler.isPublishing {
+				logger.LOGE("rtsp record " + track.trackID + " failed:" + err.Error())
+				//推流端已断开
+				rtspHandler.conn.Close()
+			}
+			return
+		}
+		rtspHandler.recordRTP(track, data[:size])
+	}
+}
+
+//threadRecordRTCP 推流端的SR暂不处理，只是保持端口可读
+func (rtspHandler *RTSPHandler) threadRecordRTCP(track *trackInfo) {
+	conn := track.RTCPSvrConn
+	if nil == conn {
+		return
+	}
+	data := make([]byte, RTPDefaultMTU2)
+	for rtspHandler.isPublishing {
+		size, _, err := conn.ReadFromUDP(data)
+		if err != nil {
+			return
+		}
+		parseRTCP(data[:size])
+	}
+}
+
+func (rtspHandler *RTSPHandler) recordInterleaved(channel int, data []byte) (err error) {
+	rtspHandler.mutexTracks.RLock()
+	defer rtspHandler.mutexTracks.RUnlock()
+	for _, v := range rtspHandler.tracks {
+		if "tcp" != v.transPort {
+			continue
+		}
+		if v.RTPChannel == channel {
+			rtspHandler.recordRTP(v, data)
+			return
+		}
+		if v.RTCPChannel == channel {
+			parseRTCP(data)
+			return
+		}
+	}
+	return
+}
+
+func (rtspHandler *RTSPHandler) recordRTP(track *trackInfo, data []byte) {
+	if nil == track.depacketizer {
+		return
+	}
+	pkt, err := rtp.Parse(data)
+	if err != nil {
+		logger.LOGW(err.Error())
+		return
+	}
+	tags := track.depacketizer.addPacket(pkt)
+	if len(tags) == 0 {
+		return
+	}
+	rtspHandler.mutexSource.Lock()
+	defer rtspHandler.mutexSource.Unlock()
+	if nil == rtspHandler.source || false == rtspHandler.srcAdded {
+		return
+	}
+	for _, tag := range tags {
+		msg := &wssapi.Msg{Type: wssapi.MsgFlvTag, Param1: tag}
+		err = rtspHandler.source.ProcessMessage(msg)
+		if err != nil {
+			logger.LOGE(err.Error())
+			return
+		}
+	}
+}
+
+//getAnnouncedMedia 根据setup的地址找到sdp里对应的媒体
+func (rtspHandler *RTSPHandler) getAnnouncedMedia(trackName string) *sdp.SDPInfo {
+	if info, ok := rtspHandler.medias[trackName]; ok {
+		return info
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package rtspsrv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/use-go/websocket-streamserver/events/eStreamerEvent"
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/mediatype/h264"
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+//publishBus the streamer for the publisher,tags go to src
+type publishBus struct {
+	mutex   sync.Mutex
+	tags    []*flv.FlvTag
+	deleted bool
+}
+
+func (bus *publishBus) Init(msg *wssapi.Msg) error  { return nil }
+func (bus *publishBus) Start(msg *wssapi.Msg) error { return nil }
+func (bus *publishBus) Stop(msg *wssapi.Msg) error  { return nil }
+func (bus *publishBus) GetType() string             { return "publishBus" }
+
+func (bus *publishBus) HandleTask(task wssapi.Task) error {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	switch eve := task.(type) {
+	case *eStreamerEvent.EveAddSource:
+		eve.SrcObj = bus
+		eve.ID = 1
+	case *eStreamerEvent.EveDelSource:
+		bus.deleted = eve.StreamName == "live/cam" && eve.ID == 1
+	}
+	return nil
+}
+
+func (bus *publishBus) ProcessMessage(msg *wssapi.Msg) error {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	if msg.Type == wssapi.MsgFlvTag {
+		bus.tags = append(bus.tags, msg.Param1.(*flv.FlvTag))
+	}
+	return nil
+}
+
+//ffmpeg -f rtsp -rtsp_transport tcp
+const announcedSDP = "v=0\r\n" +
+	"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+	"s=No Name\r\n" +
+	"c=IN IP4 127.0.0.1\r\n" +
+	"t=0 0\r\n" +
+	"a=tool:libavformat 58.29.100\r\n" +
+	"m=video 0 RTP/AVP 96\r\n" +
+	"a=rtpmap:96 H264/90000\r\n" +
+	"a=fmtp:96 packetization-mode=1; sprop-parameter-sets=Z0LgH9o=,aM48gA==; profile-level-id=42E01F\r\n" +
+	"a=control:streamid=0\r\n" +
+	"m=audio 0 RTP/AVP 97\r\n" +
+	"b=AS:128\r\n" +
+	"a=rtpmap:97 MPEG4-GENERIC/44100/2\r\n" +
+	"a=fmtp:97 profile-level-id=1;mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3; config=1210\r\n" +
+	"a=control:streamid=1\r\n"
+
+//interleaved $ channel length,then the rtp packet
+func interleaved(channel byte, seq uint16, timestamp uint32, marker bool, payload []byte) []byte {
+	data := make([]byte, 4+12, 4+12+len(payload))
+	data[0] = '$'
+	data[1] = channel
+	binary.BigEndian.PutUint16(data[2:], uint16(12+len(payload)))
+	data[4] = 0x80
+	data[5] = 96
+	if marker {
+		data[5] |= 0x80
+	}
+	binary.BigEndian.PutUint16(data[6:], seq)
+	binary.BigEndian.PutUint32(data[8:], timestamp)
+	binary.BigEndian.PutUint32(data[12:], 0x1234)
+	return append(data, payload...)
+}
+
+func TestAnnounceRecord(t *testing.T) {
+	defer serviceConfig.Store(config())
+	serviceConfig.Store(&RTSPConfig{TimeoutSec: 1000})
+	bus := &publishBus{}
+	wssapi.SetHandler(bus)
+	defer wssapi.SetHandler(nil)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	handler := &RTSPHandler{conn: server}
+	handler.Init(nil)
+	replies := make(chan string, 8)
+	go func() {
+		reader := bufio.NewReader(client)
+		status := ""
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				close(replies)
+				return
+			}
+			line = strings.TrimSpace(line)
+			if len(line) == 0 {
+				replies <- status
+				status = ""
+			} else if len(status) == 0 {
+				status = line
+			}
+		}
+	}()
+	request := func(req string) string {
+		if err := handler.handlePacket([]byte(req)); err != nil {
+			t.Fatal(err)
+		}
+		return <-replies
+	}
+
+	url := "rtsp://127.0.0.1:554/live/cam"
+	if status := request("ANNOUNCE " + url + " RTSP/1.0\r\nCSeq: 2\r\nContent-Type: application/sdp\r\nContent-Length: " +
+		strconv.Itoa(len(announcedSDP)) + "\r\n\r\n" + announcedSDP); false == strings.HasSuffix(status, "200 OK") {
+		t.Fatalf("announce %s", status)
+	}
+	if len(handler.medias) != 2 || handler.medias["streamid=0"] == nil || handler.medias["streamid=1"] == nil {
+		t.Fatalf("announced medias %v", handler.medias)
+	}
+	session := "\r\nSession: " + handler.session
+	if status := request("SETUP " + url + "/streamid=9 RTSP/1.0\r\nCSeq: 3\r\nTransport: RTP/AVP/TCP;unicast;interleaved=4-5;mode=record" + session + "\r\n\r\n"); false == strings.Contains(status, "404") {
+		t.Fatalf("setup unknown track %s", status)
+	}
+	for i, channels := range []string{"0-1", "2-3"} {
+		if status := request("SETUP " + url + "/streamid=" + strconv.Itoa(i) + " RTSP/1.0\r\nCSeq: 4\r\nTransport: RTP/AVP/TCP;unicast;interleaved=" +
+			channels + ";mode=record" + session + "\r\n\r\n"); false == strings.HasSuffix(status, "200 OK") {
+			t.Fatalf("setup %d %s", i, status)
+		}
+	}
+	if handler.tracks["streamid=1"].clockRate != 44100 {
+		t.Fatalf("aac clock rate %d", handler.tracks["streamid=1"].clockRate)
+	}
+	if status := request("RECORD " + url + " RTSP/1.0\r\nCSeq: 6" + session + "\r\n\r\n"); false == strings.HasSuffix(status, "200 OK") {
+		t.Fatalf("record %s", status)
+	}
+
+	sps := []byte{0x67, 0x42, 0xe0, 0x1f, 0xda}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	idr := bytes.Repeat([]byte{0x65}, 3000)
+	seq := uint16(100)
+	send := func(data []byte) {
+		if err := handler.handlePacket(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(interleaved(0, seq, 90000, false, h264.RTPStapA(sps, pps)))
+	payloads := h264.RTPPayloads(idr, 1000)
+	for i, payload := range payloads {
+		seq++
+		send(interleaved(0, seq, 90000, i == len(payloads)-1, payload))
+	}
+	seq++
+	send(interleaved(0, seq, 93000, true, []byte{0x41, 1, 2, 3}))
+	//two AUs of 4 and 5 bytes,13 bits size and 3 bits index each
+	send(interleaved(2, 7, 1000, true, []byte{0x00, 0x20, 0x00, 0x20, 0x00, 0x28, 1, 2, 3, 4, 5, 6, 7, 8, 9}))
+	//rtcp of the publisher is only parsed
+	send(interleaved(1, 0, 0, false, nil))
+
+	bus.mutex.Lock()
+	tags := bus.tags
+	bus.mutex.Unlock()
+	if len(tags) != 6 {
+		t.Fatalf("tags %d", len(tags))
+	}
+	if false == flv.IsVideoSequenceHeader(tags[0]) || tags[0].Timestamp != 0 {
+		t.Fatalf("avc header %v", tags[0].Data)
+	}
+	if tags[1].Data[0] != 0x17 || tags[1].Timestamp != 0 || len(tags[1].Data) != 5+4+len(idr) {
+		t.Fatalf("keyframe %x %d %d", tags[1].Data[0], tags[1].Timestamp, len(tags[1].Data))
+	}
+	if tags[2].Data[0] != 0x27 || tags[2].Timestamp != 33 {
+		t.Fatalf("inter frame %x %d", tags[2].Data[0], tags[2].Timestamp)
+	}
+	if false == flv.IsAudioSequenceHeader(tags[3]) || false == bytes.Equal(tags[3].Data[2:], []byte{0x12, 0x10}) {
+		t.Fatalf("aac header %v", tags[3].Data)
+	}
+	if false == bytes.Equal(tags[4].Data[2:], []byte{1, 2, 3, 4}) || tags[4].Timestamp != 0 {
+		t.Fatalf("first au %v %d", tags[4].Data, tags[4].Timestamp)
+	}
+	if false == bytes.Equal(tags[5].Data[2:], []byte{5, 6, 7, 8, 9}) || tags[5].Timestamp != 23 {
+		t.Fatalf("second au %v %d", tags[5].Data, tags[5].Timestamp)
+	}
+
+	if status := request("TEARDOWN " + url + " RTSP/1.0\r\nCSeq: 7" + session + "\r\n\r\n"); false == strings.HasSuffix(status, "200 OK") {
+		t.Fatalf("teardown %s", status)
+	}
+	if false == bus.deleted || handler.isPublishing {
+		t.Fatal("source not deleted on teardown")
+	}
+}
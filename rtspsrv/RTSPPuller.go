@@ -0,0 +1,252 @@
+// Copyright 2017-2018 The use-go websocket-streamserver Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rtspsrv
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+
+	"github.com/use-go/websocket-streamserver/events/eLiveListCtrl"
+	"github.com/use-go/websocket-streamserver/events/eRTSPEvent"
+	"github.com/use-go/websocket-streamserver/events/eStreamerEvent"
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/rtspcli"
+	"github.com/use-go/websocket-streamserver/utils"
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+//RTSPPuller pull stream from rtsp upstream and feed a source
+type RTSPPuller struct {
+	cli        *rtspcli.SocketChannel
+	src        wssapi.MsgHandler
+	srcID      int64
+	pullParams *eRTSPEvent.EvePullRTSPStream
+	reading    bool
+	chValid    bool
+	headers    [][]byte
+}
+
+//PullRTSPLive From camera or rtsp server
+func PullRTSPLive(task *eRTSPEvent.EvePullRTSPStream) {
+	rtsppuller := &RTSPPuller{}
+	msg := &wssapi.Msg{}
+	msg.Param1 = task
+	rtsppuller.Init(msg)
+	rtsppuller.Start(nil)
+}
+
+//Init Action
+func (rtsppuller *RTSPPuller) Init(msg *wssapi.Msg) (err error) {
+	rtsppuller.pullParams = msg.Param1.(*eRTSPEvent.EvePullRTSPStream).Copy()
+	rtsppuller.chValid = true
+	return
+}
+
+//Start Action
+func (rtsppuller *RTSPPuller) Start(msg *wssapi.Msg) (err error) {
+	go rtsppuller.threadRead()
+	return
+}
+
+//Stop Action
+func (rtsppuller *RTSPPuller) Stop(msg *wssapi.Msg) (err error) {
+	rtsppuller.reading = false
+	return
+}
+
+func (rtsppuller *RTSPPuller) GetType() string {
+	return "RTSPPuller"
+}
+
+func (rtsppuller *RTSPPuller) HandleTask(task wssapi.Task) (err error) {
+	return
+}
+
+func (rtsppuller *RTSPPuller) ProcessMessage(msg *wssapi.Msg) (err error) {
+	switch msg.Type {
+	case wssapi.MsgSourceClosedForce:
+		logger.LOGT("rtsp puller data sink closed")
+		rtsppuller.src = nil
+		rtsppuller.reading = false
+	default:
+		logger.LOGE(msg.Type + " not processed")
+	}
+	return
+}
+
+func (rtsppuller *RTSPPuller) closeCh() {
+	if rtsppuller.chValid {
+		rtsppuller.chValid = false
+		close(rtsppuller.pullParams.Src)
+	}
+}
+
+func (rtsppuller *RTSPPuller) threadRead() {
+	defer func() {
+		rtsppuller.reading = false
+		if nil != rtsppuller.cli {
+			rtsppuller.cli.Teardown()
+			rtsppuller.cli = nil
+		}
+		rtsppuller.delSource()
+		rtsppuller.closeCh()
+		logger.LOGT("stop rtsp pull:" + rtsppuller.pullParams.SourceName)
+	}()
+	url := rtsppuller.pullParams.URL()
+	logger.LOGT("rtsp pull:" + url)
+	cli, err := rtspcli.Open(url)
+	if err != nil {
+		logger.LOGE("rtsp pull " + url + " failed:" + err.Error())
+		return
+	}
+	rtsppuller.cli = cli
+	rtsppuller.cli.Timeout = time.Duration(config().TimeoutSec) * time.Second
+	if false == rtsppuller.createSource() {
+		return
+	}
+	rtsppuller.headers = make([][]byte, len(cli.Streams()))
+	rtsppuller.reading = true
+	go rtsppuller.checkPlayerCounts()
+	for rtsppuller.reading {
+		pkt, err := cli.ReadPacket()
+		if err != nil {
+			logger.LOGE("rtsp pull read failed:" + err.Error())
+			return
+		}
+		if err = rtsppuller.sendPacket(&pkt); err != nil {
+			logger.LOGE(err.Error())
+			return
+		}
+	}
+}
+
+func (rtsppuller *RTSPPuller) createSource() bool {
+	taskGet := &eStreamerEvent.EveGetSource{}
+	taskGet.StreamName = rtsppuller.pullParams.SourceName
+	wssapi.HandleTask(taskGet)
+	if utils.InterfaceValid(taskGet.SrcObj) && taskGet.HasProducer {
+		//已经被其他人抢先了
+		logger.LOGD("some other pulled rtsp stream:" + taskGet.StreamName)
+		rtsppuller.notifySrc(taskGet.SrcObj)
+		return false
+	}
+	taskAdd := &eStreamerEvent.EveAddSource{}
+	taskAdd.Producer = rtsppuller
+	taskAdd.StreamName = rtsppuller.pullParams.SourceName
+	taskAdd.RemoteIp = rtsppuller.cli.RemoteAddr()
+	err := wssapi.HandleTask(taskAdd)
+	if err != nil || utils.InterfaceIsNil(taskAdd.SrcObj) {
+		logger.LOGE("rtsp pull add source failed:" + rtsppuller.pullParams.SourceName)
+		return false
+	}
+	rtsppuller.src = taskAdd.SrcObj
+	rtsppuller.srcID = taskAdd.ID
+	rtsppuller.notifySrc(rtsppuller.src)
+	logger.LOGT("add rtsp src ok..")
+	return true
+}
+
+//notifySrc 等待方可能已经超时，不能一直阻塞
+func (rtsppuller *RTSPPuller) notifySrc(src wssapi.MsgHandler) {
+	if false == rtsppuller.chValid {
+		return
+	}
+	select {
+	case rtsppuller.pullParams.Src <- src:
+	case <-time.After(time.Duration(config().TimeoutSec) * time.Second):
+		logger.LOGW("nobody wait for rtsp pull result:" + rtsppuller.pullParams.SourceName)
+	}
+	rtsppuller.closeCh()
+}
+
+func (rtsppuller *RTSPPuller) delSource() {
+	if utils.InterfaceValid(rtsppuller.src) {
+		taskDelSrc := &eStreamerEvent.EveDelSource{}
+		taskDelSrc.StreamName = rtsppuller.pullParams.SourceName
+		taskDelSrc.ID = rtsppuller.srcID
+		err := wssapi.HandleTask(taskDelSrc)
+		if err != nil {
+			logger.LOGE(err.Error())
+		}
+		rtsppuller.src = nil
+	}
+}
+
+func (rtsppuller *RTSPPuller) checkPlayerCounts() {
+	for rtsppuller.reading && utils.InterfaceValid(rtsppuller.src) {
+		time.Sleep(time.Duration(2) * time.Minute)
+		eve := &eLiveListCtrl.EveGetLivePlayerCount{LiveName: rtsppuller.pullParams.SourceName}
+
+		err := wssapi.HandleTask(eve)
+		if err != nil {
+			logger.LOGD(err.Error())
+			continue
+		}
+		if 1 > eve.Count {
+			logger.LOGI("no player for rtsp puller ,close itself")
+			rtsppuller.reading = false
+			return
+		}
+	}
+}
+
+//sendPacket av.Packet 转为flv tag,音视频头在变化时重新发送
+func (rtsppuller *RTSPPuller) sendPacket(pkt *av.Packet) (err error) {
+	streams := rtsppuller.cli.Streams()
+	idx := int(pkt.Idx)
+	if idx >= len(streams) || nil == streams[idx] {
+		return
+	}
+	timestamp := uint32(pkt.Time / time.Millisecond)
+	var header, tag *flv.FlvTag
+	switch codecData := streams[idx].(type) {
+	case h264parser.CodecData:
+		record := codecData.AVCDecoderConfRecordBytes()
+		if false == bytes.Equal(record, rtsppuller.headers[idx]) {
+			rtsppuller.headers[idx] = record
+			header = &flv.FlvTag{TagType: flv.FlvTagVideo, Timestamp: timestamp}
+			header.Data = append([]byte{0x17, 0, 0, 0, 0}, record...)
+		}
+		tag = &flv.FlvTag{TagType: flv.FlvTagVideo, Timestamp: timestamp}
+		cts := uint32(pkt.CompositionTime / time.Millisecond)
+		tag.Data = make([]byte, 5+len(pkt.Data))
+		tag.Data[0] = 0x27
+		if pkt.IsKeyFrame {
+			tag.Data[0] = 0x17
+		}
+		tag.Data[1] = 1
+		tag.Data[2] = byte(cts >> 16)
+		tag.Data[3] = byte(cts >> 8)
+		tag.Data[4] = byte(cts)
+		copy(tag.Data[5:], pkt.Data)
+	case aacparser.CodecData:
+		config := codecData.MPEG4AudioConfigBytes()
+		if false == bytes.Equal(config, rtsppuller.headers[idx]) {
+			rtsppuller.headers[idx] = config
+			header = &flv.FlvTag{TagType: flv.FlvTagAudio, Timestamp: timestamp}
+			header.Data = append([]byte{aacFlvSoundFlag, 0}, config...)
+		}
+		tag = &flv.FlvTag{TagType: flv.FlvTagAudio, Timestamp: timestamp}
+		tag.Data = append([]byte{aacFlvSoundFlag, 1}, pkt.Data...)
+	default:
+		//flv 不支持的编码直接丢弃
+		return
+	}
+	if nil == rtsppuller.src {
+		return
+	}
+	if nil != header {
+		err = rtsppuller.src.ProcessMessage(&wssapi.Msg{Type: wssapi.MsgFlvTag, Param1: header})
+		if err != nil {
+			return
+		}
+	}
+	return rtsppuller.src.ProcessMessage(&wssapi.Msg{Type: wssapi.MsgFlvTag, Param1: tag})
+}
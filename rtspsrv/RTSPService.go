@@ -6,24 +6,51 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/use-go/websocket-streamserver/events/eRTSPEvent"
 
 	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/metrics"
+	"github.com/use-go/websocket-streamserver/session"
+	"github.com/use-go/websocket-streamserver/tlsconf"
 	"github.com/use-go/websocket-streamserver/utils"
 	"github.com/use-go/websocket-streamserver/wssapi"
 )
 
 //RTSPService Service
 type RTSPService struct {
+	listener    *net.TCPListener
+	tlsListener net.Listener
+	tlsStore    *tlsconf.Store
+	stopping    bool
+	mutexConns  sync.Mutex
+	conns       map[*RTSPHandler]net.Conn
 }
 
 //RTSPConfig for configuration from file
+//TLS rtsps listener,rtp over udp is not encrypted,clients should use interleaved transport
 type RTSPConfig struct {
-	Port       int `json:"port"`
-	TimeoutSec int `json:"timeoutSec"`
+	Port       int             `json:"port"`
+	TimeoutSec int             `json:"timeoutSec"`
+	TLS        *tlsconf.Config `json:"tls"`
 }
 
 var service *RTSPService
-var serviceConfig RTSPConfig
+
+//serviceConfig *RTSPConfig,a reload stores a new one
+var serviceConfig atomic.Value
+
+//config current config,do not modify it
+func config() *RTSPConfig {
+	cfg, _ := serviceConfig.Load().(*RTSPConfig)
+	if nil == cfg {
+		return &RTSPConfig{}
+	}
+	return cfg
+}
 
 //Init Service configuration for RTSPService
 func (rtspService *RTSPService) Init(msg *wssapi.Msg) (err error) {
@@ -36,29 +63,33 @@ func (rtspService *RTSPService) Init(msg *wssapi.Msg) (err error) {
 		logger.LOGE("bad param init rtsp server")
 		return errors.New("invalid param init rtsp server")
 	}
-	err = rtspService.loadConfigFile(fileName)
+	cfg, err := rtspService.loadConfigFile(fileName)
 	if err != nil {
 		logger.LOGE("load rtsp config failed:" + err.Error())
 		return
 	}
+	serviceConfig.Store(cfg)
+	rtspService.conns = make(map[*RTSPHandler]net.Conn)
 	return
 }
 
-func (rtspService *RTSPService) loadConfigFile(fileName string) (err error) {
+//loadConfigFile read a new config,it is not used until stored
+func (rtspService *RTSPService) loadConfigFile(fileName string) (cfg *RTSPConfig, err error) {
 	data, err := utils.ReadFileAll(fileName)
 	if err != nil {
 		return
 	}
-	err = json.Unmarshal(data, &serviceConfig)
+	cfg = &RTSPConfig{}
+	err = json.Unmarshal(data, cfg)
 	if err != nil {
-		return
+		return nil, err
 	}
-	if serviceConfig.TimeoutSec <= 0 {
-		serviceConfig.TimeoutSec = 60
+	if cfg.TimeoutSec <= 0 {
+		cfg.TimeoutSec = 60
 	}
 
-	if serviceConfig.Port == 0 {
-		serviceConfig.Port = 554
+	if cfg.Port == 0 {
+		cfg.Port = 554
 	}
 	return
 }
@@ -66,7 +97,7 @@ func (rtspService *RTSPService) loadConfigFile(fileName string) (err error) {
 //Start RTSPService
 func (rtspService *RTSPService) Start(msg *wssapi.Msg) (err error) {
 	logger.LOGT("start RTSP server")
-	strPort := ":" + strconv.Itoa(serviceConfig.Port)
+	strPort := ":" + strconv.Itoa(config().Port)
 	tcp, err := net.ResolveTCPAddr("tcp4", strPort)
 	if err != nil {
 		logger.LOGE(err.Error())
@@ -77,14 +108,27 @@ func (rtspService *RTSPService) Start(msg *wssapi.Msg) (err error) {
 		logger.LOGE(err.Error())
 		return
 	}
+	rtspService.listener = listener
 	go rtspService.rtspLoop(listener)
+	if config().TLS.Enabled() {
+		rtspService.tlsListener, rtspService.tlsStore, err = tlsconf.Listen(config().TLS)
+		if err != nil {
+			logger.LOGE("start rtsps failed:" + err.Error())
+			err = nil
+			return
+		}
+		go rtspService.rtspLoop(rtspService.tlsListener)
+	}
 	return
 }
 
-func (rtspService *RTSPService) rtspLoop(listener *net.TCPListener) {
+func (rtspService *RTSPService) rtspLoop(listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if rtspService.stopping {
+				return
+			}
 			logger.LOGE(err.Error())
 			continue
 		}
@@ -97,9 +141,25 @@ func (rtspService *RTSPService) handleConn(conn net.Conn) {
 	defer func() {
 		conn.Close()
 	}()
+	sess, err := session.Open(metrics.ProtocolRTSP, conn.RemoteAddr().String(), func() { conn.Close() })
+	if err != nil {
+		logger.LOGW("refuse rtsp client " + conn.RemoteAddr().String() + ":" + err.Error())
+		return
+	}
+	defer sess.Close()
+	conn = sess.Conn(conn)
 	handler := &RTSPHandler{}
 	handler.conn = conn
+	handler.sess = sess
 	handler.Init(nil)
+	rtspService.mutexConns.Lock()
+	rtspService.conns[handler] = conn
+	rtspService.mutexConns.Unlock()
+	defer func() {
+		rtspService.mutexConns.Lock()
+		delete(rtspService.conns, handler)
+		rtspService.mutexConns.Unlock()
+	}()
 	for {
 		data, err := ReadPacket(conn, handler.tcpTimeout)
 		if err != nil {
@@ -116,8 +176,23 @@ func (rtspService *RTSPService) handleConn(conn net.Conn) {
 	}
 }
 
-//Stop RTSPService not implemention
+//Stop close listener and all rtsp connections
 func (rtspService *RTSPService) Stop(msg *wssapi.Msg) (err error) {
+	rtspService.stopping = true
+	if nil != rtspService.listener {
+		rtspService.listener.Close()
+	}
+	if nil != rtspService.tlsListener {
+		rtspService.tlsListener.Close()
+	}
+	rtspService.mutexConns.Lock()
+	conns := rtspService.conns
+	rtspService.conns = make(map[*RTSPHandler]net.Conn)
+	rtspService.mutexConns.Unlock()
+	for handler, conn := range conns {
+		handler.Stop(nil)
+		conn.Close()
+	}
 	return
 }
 
@@ -126,12 +201,50 @@ func (rtspService *RTSPService) GetType() string {
 	return wssapi.OBJRTSPServer
 }
 
-//HandleTask  not implemention
+//HandleTask pull rtsp stream from upstream
 func (rtspService *RTSPService) HandleTask(task wssapi.Task) (err error) {
-	return
+	if task.Receiver() != rtspService.GetType() {
+		return errors.New("not my task")
+	}
+	switch task.Type() {
+	case eRTSPEvent.PullRTSPStream:
+		taskPull, ok := task.(*eRTSPEvent.EvePullRTSPStream)
+		if false == ok {
+			return errors.New("invalid param to pull rtsp stream")
+		}
+		taskPull.Protocol = strings.ToLower(taskPull.Protocol)
+		if taskPull.Protocol != "rtsp" {
+			logger.LOGE(fmt.Sprintf("fmt %s not support now", taskPull.Protocol))
+			close(taskPull.Src)
+			return errors.New("fmt not support")
+		}
+		PullRTSPLive(taskPull)
+		return
+	default:
+		return fmt.Errorf("task %s not prossed", task.Type())
+	}
 }
 
-//ProcessMessage  not implemention
+//ProcessMessage reload config,port can not change at runtime
 func (rtspService *RTSPService) ProcessMessage(msg *wssapi.Msg) (err error) {
+	switch msg.Type {
+	case wssapi.MsgReloadConfig:
+		var cfg *RTSPConfig
+		cfg, err = rtspService.loadConfigFile(msg.Param1.(string))
+		if err != nil {
+			return
+		}
+		if cfg.Port != config().Port {
+			logger.LOGW("rtsp port change need restart")
+			cfg.Port = config().Port
+		}
+		if rtspService.tlsStore != nil && cfg.TLS != nil {
+			err = rtspService.tlsStore.Update(cfg.TLS)
+			if err != nil {
+				return
+			}
+		}
+		serviceConfig.Store(cfg)
+	}
 	return
 }
@@ -37,8 +37,8 @@ func init() {
 //ReadPacket vlc no heart beat
 func ReadPacket(conn net.Conn, timeout bool) (data []byte, err error) {
 	if timeout {
-		logger.LOGT(serviceConfig.TimeoutSec)
-		err = conn.SetReadDeadline(time.Now().Add(time.Duration(serviceConfig.TimeoutSec) * time.Second))
+		logger.LOGT(config().TimeoutSec)
+		err = conn.SetReadDeadline(time.Now().Add(time.Duration(config().TimeoutSec) * time.Second))
 		if err != nil {
 			logger.LOGE(err.Error())
 			return
@@ -53,7 +53,6 @@ func ReadPacket(conn net.Conn, timeout bool) (data []byte, err error) {
 	}
 	if '$' == firstByte[0] {
 		threeBytes, err := utils.TCPRead(conn, 3)
-		_, err = conn.Read(threeBytes)
 		if err != nil {
 			logger.LOGE(err.Error())
 			return nil, err
@@ -96,36 +95,25 @@ func isFullRTSPPacket(data []byte) bool {
 	if nil == data || len(data) < 4 {
 		return false
 	}
-	el := make([]byte, 4)
-	el[0] = '\r'
-	el[1] = '\n'
-	el[2] = '\r'
-	el[3] = '\n'
-	if bytes.HasSuffix(data, el) {
-		strData := string(data)
-		strData = strings.ToLower(strData)
-		if strings.Contains(strData, "content-length:") {
-			splits := strings.Split(strData, "content-length:")
-			if len(splits) != 2 {
-				logger.LOGW("unknown fmt rtsp data:" + strData)
-				return true
-			}
-			contentLength, err := strconv.Atoi(splits[1])
+	headerEnd := bytes.Index(data, []byte(RTSPEndLine+RTSPEndLine))
+	if headerEnd < 0 {
+		return false
+	}
+	//announce 等命令带有sdp
+	contentLength := 0
+	for _, line := range strings.Split(string(data[:headerEnd]), RTSPEndLine) {
+		line = strings.ToLower(line)
+		if strings.HasPrefix(line, "content-length:") {
+			var err error
+			contentLength, err = strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "content-length:")))
 			if err != nil {
-				logger.LOGE(err.Error())
-				return false
-			}
-			if contentLength == 0 {
+				logger.LOGW("unknown fmt rtsp data:" + line)
 				return true
 			}
-			return strings.Count(strData, "\r\n\r\n") > 1
-
+			break
 		}
-		return true
-
 	}
-
-	return false
+	return len(data) >= headerEnd+4+contentLength
 }
 
 func getHeaderByName(heads []string, name string, caseinsensitive bool) (val string) {
@@ -175,8 +163,18 @@ func removeSpace(data string) string {
 
 func generateSDP(videoHeader, audioHeader *flv.FlvTag) (sdp string, ok bool) {
 	if videoHeader != nil {
-		//读取视频类型，目前仅支持h264
-		sdp += genH264sdp(videoHeader.Data)
+		//读取视频类型，支持h264和h265
+		video, err := flv.GetVideoTag(videoHeader)
+		if err == nil {
+			switch video.FourCC {
+			case flv.FourCCAVC:
+				sdp += genH264sdp(video.Data)
+			case flv.FourCCHEVC:
+				sdp += genH265sdp(video.Data)
+			default:
+				logger.LOGW("video not support now")
+			}
+		}
 		if len(sdp) > 0 {
 			ok = true
 		}
@@ -196,6 +194,14 @@ func generateSDP(videoHeader, audioHeader *flv.FlvTag) (sdp string, ok bool) {
 			if len(sdp) > 0 {
 				ok = true
 			}
+		case flv.SoundFormatExHeader:
+			audio, err := flv.GetAudioTag(audioHeader)
+			if err == nil && audio.FourCC == flv.FourCCOpus {
+				sdp += genOpussdp()
+				ok = true
+			} else {
+				logger.LOGW("audio not support now")
+			}
 		default:
 			logger.LOGW("audio not support now")
 		}
@@ -205,9 +211,10 @@ func generateSDP(videoHeader, audioHeader *flv.FlvTag) (sdp string, ok bool) {
 	return
 }
 
+//genH264sdp data is AVCDecoderConfigurationRecord
 func genH264sdp(data []byte) (sdp string) {
 	var sps, pps []byte
-	cur := 10
+	cur := 5
 	numOfSequenceParameterSets := int(data[cur] & 0x1f)
 	cur++
 	for i := 0; i < numOfSequenceParameterSets; i++ {
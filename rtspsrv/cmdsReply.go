@@ -25,8 +25,12 @@ import (
 	"strings"
 	"time"
 
+	"github.com/use-go/websocket-streamserver/authorizer"
+	"github.com/use-go/websocket-streamserver/events/eVODEvent"
 	"github.com/use-go/websocket-streamserver/logger"
 	"github.com/use-go/websocket-streamserver/mediatype/aac"
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/rtspsrv/sdp"
 )
 
 func (rtspHandler *RTSPHandler) sendErrorReply(lines []string, code int) (err error) {
@@ -50,7 +54,7 @@ func (rtspHandler *RTSPHandler) serveOptions(lines []string) (err error) {
 	if hasSession {
 		str += "Session: " + rtspHandler.session + RTSPEndLine
 	}
-	str += "Public: OPTIONS, DESCRIBE, GET_PARAMETER, PAUSE, PLAY, SETUP, SET_PARAMETER, TEARDOWN " + RTSPEndLine 
+	str += "Public: OPTIONS, DESCRIBE, ANNOUNCE, GET_PARAMETER, PAUSE, PLAY, RECORD, SETUP, SET_PARAMETER, TEARDOWN " + RTSPEndLine 
 	str += "Server: GStreamer RTSP server " + RTSPEndLine
 	//Date: Mon, 15 Jan 2018 09:20:38 GMT
 	str += "Date: "+  time.Now().Format("Mon, 02 Jan 2006 15:04:05 GMT")  + RTSPEndLine + RTSPEndLine
@@ -73,11 +77,16 @@ func (rtspHandler *RTSPHandler) serveDescribe(lines []string) (err error) {
 		return rtspHandler.sendErrorReply(lines, 455)
 	}
 
-	_, rtspHandler.streamName, err = rtspHandler.parseURL(strSpaces[1])
+	token := ""
+	_, rtspHandler.streamName, token, err = rtspHandler.parseURL(strSpaces[1])
 	if err != nil {
 		logger.LOGE(err.Error())
 		return rtspHandler.sendErrorReply(lines, 455)
 	}
+	errAuth := rtspHandler.authorize(authorizer.ActionPlay, token)
+	if errAuth != nil {
+		return rtspHandler.sendErrorReply(lines, authorizer.StatusCode(errAuth))
+	}
 
 	//添加槽
 	if false == rtspHandler.addSink() {
@@ -144,7 +153,7 @@ func (rtspHandler *RTSPHandler) serveDescribe(lines []string) (err error) {
 	return
 }
 
-func (rtspHandler *RTSPHandler) parseURL(url string) (port int, streamName string, err error) {
+func (rtspHandler *RTSPHandler) parseURL(url string) (port int, streamName, token string, err error) {
 	if false == strings.HasPrefix(url, "rtsp://") {
 		err = errors.New("bad rtsp url:" + url)
 		logger.LOGE(err.Error())
@@ -159,6 +168,7 @@ func (rtspHandler *RTSPHandler) parseURL(url string) (port int, streamName strin
 	}
 	streamName = strings.TrimPrefix(sub, subs[0])
 	streamName = strings.TrimPrefix(streamName, "/")
+	streamName, token = authorizer.SplitToken(streamName)
 	if false == strings.Contains(subs[0], ":") {
 		port = 554
 	} else {
@@ -173,6 +183,15 @@ func (rtspHandler *RTSPHandler) parseURL(url string) (port int, streamName strin
 	return
 }
 
+//authorize the stream parsed from url
+func (rtspHandler *RTSPHandler) authorize(action, token string) error {
+	return authorizer.Check(&authorizer.Request{Action: action,
+		Protocol:   authorizer.ProtocolRTSP,
+		StreamName: rtspHandler.streamName,
+		Token:      token,
+		RemoteAddr: rtspHandler.conn.RemoteAddr().String()})
+}
+
 func (rtspHandler *RTSPHandler) getSession(lines []string) (cliSession string) {
 	tmp := getHeaderByName(lines, "Session:", true)
 	if len(tmp) > 0 {
@@ -210,7 +229,15 @@ func (rtspHandler *RTSPHandler) serveSetup(lines []string) (err error) {
 		subs = strings.Split(subs[1], "/")
 		trackName = subs[len(subs)-1]
 	}
-	if strings.Compare(trackName, CtrlTrackAudio) != 0 && strings.Compare(trackName, CtrlTrackVideo) != 0 {
+	var mediaInfo *sdp.SDPInfo
+	if rtspHandler.announced {
+		//推流，track由sdp决定
+		mediaInfo = rtspHandler.getAnnouncedMedia(trackName)
+		if nil == mediaInfo {
+			logger.LOGE("announced track :" + trackName + " not found")
+			return rtspHandler.sendErrorReply(lines, 404)
+		}
+	} else if strings.Compare(trackName, CtrlTrackAudio) != 0 && strings.Compare(trackName, CtrlTrackVideo) != 0 {
 		logger.LOGE("track :" + trackName + " not found")
 		return rtspHandler.sendErrorReply(lines, 404)
 	}
@@ -233,7 +260,9 @@ func (rtspHandler *RTSPHandler) serveSetup(lines []string) (err error) {
 
 		//video 90000
 		if strings.Compare(trackName, CtrlTrackAudio) == 0 {
-			if rtspHandler.audioHeader != nil {
+			if rtspHandler.audioHeader != nil && int(rtspHandler.audioHeader.Data[0]>>4) == flv.SoundFormatExHeader {
+				track.clockRate = RTPOpusFreq
+			} else if rtspHandler.audioHeader != nil {
 				asc := aac.GenerateAudioSpecificConfig(rtspHandler.audioHeader.Data[2:])
 				track.clockRate = uint32(asc.SamplingFrequency)
 			}
@@ -242,6 +271,14 @@ func (rtspHandler *RTSPHandler) serveSetup(lines []string) (err error) {
 		if strings.Compare(trackName, CtrlTrackVideo) == 0 {
 			track.clockRate = RTPH264Freq
 		}
+		if nil != mediaInfo {
+			track.depacketizer, err = newRTPDepacketizer(mediaInfo)
+			if err != nil {
+				logger.LOGE(err.Error())
+				return rtspHandler.sendErrorReply(lines, 415)
+			}
+			track.clockRate = track.depacketizer.clockRate
+		}
 		strTransport := getHeaderByName(lines, HDRTRANSPORT, true)
 		if len(strTransport) == 0 {
 			logger.LOGE("setup failed,no transport")
@@ -254,7 +291,7 @@ func (rtspHandler *RTSPHandler) serveSetup(lines []string) (err error) {
 		subs := strings.Split(strTransport, ";")
 
 		logger.LOGT(subs)
-		if len(subs) != 3 {
+		if len(subs) < 3 {
 			logger.LOGT(len(subs))
 			logger.LOGE("setup failed,parse transport failed")
 			return rtspHandler.sendErrorReply(lines, 400)
@@ -267,11 +304,16 @@ func (rtspHandler *RTSPHandler) serveSetup(lines []string) (err error) {
 		}
 		if subs[0] == RTSPRTPAVP || subs[0] == RTSPRTPAVPUDP {
 			track.transPort = "udp"
-			if false == strings.HasPrefix(subs[2], "client_port=") {
+			cliports := ""
+			for _, v := range subs[2:] {
+				if strings.HasPrefix(v, "client_port=") {
+					cliports = strings.TrimPrefix(v, "client_port=")
+				}
+			}
+			if len(cliports) == 0 {
 				logger.LOGE("udp not found client port")
 				return rtspHandler.sendErrorReply(lines, 461)
 			}
-			cliports := strings.TrimPrefix(subs[2], "client_port=")
 			ports := strings.Split(cliports, "-")
 			if len(ports) != 2 {
 				logger.LOGE("udp not found client port")
@@ -308,7 +350,7 @@ func (rtspHandler *RTSPHandler) serveSetup(lines []string) (err error) {
 				return rtspHandler.sendErrorReply(lines, 461)
 			}
 
-			strsubs = strings.Split(strsubs[1], "-")
+			strsubs = strings.Split(strings.Split(strsubs[1], ";")[0], "-")
 			if len(strsubs) != 2 {
 				logger.LOGE("not found tcp interleaved")
 				return rtspHandler.sendErrorReply(lines, 461)
@@ -339,19 +381,21 @@ func (rtspHandler *RTSPHandler) serveSetup(lines []string) (err error) {
 	strOut := RTSPVer + " " + strconv.Itoa(200) + " " + getRTSPStatusByCode(200) + RTSPEndLine
 	strOut += HDRCSEQ + ": " + strconv.Itoa(cseq) + RTSPEndLine
 	strOut += "Server: " + RTSPServerName + RTSPEndLine
-	strOut += "Session: " + rtspHandler.session + ";timeout=" + strconv.Itoa(serviceConfig.TimeoutSec) + RTSPEndLine
+	strOut += "Session: " + rtspHandler.session + ";timeout=" + strconv.Itoa(config().TimeoutSec) + RTSPEndLine
 	if track.transPort == "udp" {
 		strOut += "Transport: RTP/AVP;unicast;"
 		strOut += "client_port=" + strconv.Itoa(track.RTPCliPort) + "-" + strconv.Itoa(track.RTCPCliPort) + ";"
 		strOut += "server_port=" + strconv.Itoa(track.RTPSvrPort) + "-" + strconv.Itoa(track.RTCPSvrPort)
-		strOut += RTSPEndLine
 	} else {
 		//tcp
 		strOut += "Transport: RTP/AVP/TCP;unicast;"
 		strOut += "interleaved=" + strconv.Itoa(track.RTPChannel) + "-" + strconv.Itoa(track.RTCPChannel)
-		strOut += RTSPEndLine
+	}
+	if rtspHandler.announced {
+		strOut += ";mode=record"
 	}
 	strOut += RTSPEndLine
+	strOut += RTSPEndLine
 
 	return rtspHandler.send([]byte(strOut))
 }
@@ -387,13 +431,27 @@ func (rtspHandler *RTSPHandler) servePlay(lines []string) (err error) {
 		errCode = 454
 		return
 	}
-	//begin time:use default zero
+	//begin time:点播按Range seek,直播忽略
+	npt := "0.0"
+	startSec := 0.0
+	rangeLine := getHeaderByName(lines, "Range:", false)
+	if len(rangeLine) > 0 {
+		fmt.Sscanf(removeSpace(rangeLine), "range: npt=%f-", &startSec)
+	}
+	if startSec > 0 {
+		position, errSeek := rtspHandler.vodControl(eVODEvent.VODSeek, int64(startSec*1000))
+		if errSeek == nil {
+			npt = strconv.FormatFloat(float64(position)/1000, 'f', 3, 64)
+		}
+	} else {
+		rtspHandler.vodControl(eVODEvent.VODResume, 0)
+	}
 	//start play
 
 	strOut := RTSPVer + " " + strconv.Itoa(200) + " " + getRTSPStatusByCode(200) + RTSPEndLine
 	strOut += HDRCSEQ + ": " + strconv.Itoa(cseq) + RTSPEndLine
 	strOut += "Session: " + rtspHandler.session + RTSPEndLine
-	strOut += "Range: npt=0.0-" + RTSPEndLine
+	strOut += "Range: npt=" + npt + "-" + RTSPEndLine
 	strOut += "RTP-Info: "
 	addCmma := false
 	line0 := removeSpace(lines[0])
@@ -447,7 +505,8 @@ func (rtspHandler *RTSPHandler) servePause(lines []string) (err error) {
 		errCode = 455
 		return
 	}
-	//停止播放
+	//停止播放,点播同时停止读文件
+	rtspHandler.vodControl(eVODEvent.VODPause, 0)
 	rtspHandler.stopPlayThread()
 
 	strOut := RTSPVer + " " + strconv.Itoa(200) + " " + getRTSPStatusByCode(200) + RTSPEndLine
@@ -12,7 +12,7 @@ import (
 
 type SDPInfo struct {
 	AVType             string
-	Type               int
+	Type               av.CodecType
 	TimeScale          int
 	Control            string
 	Rtpmap             int
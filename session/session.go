@@ -0,0 +1,416 @@
+//Package session registry of client connections of all protocols,
+//sessions can be listed and kicked by the admin api and client ips banned for a while
+package session
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/utils"
+)
+
+//HTTPIdleTimeout hls and dash players have no connection,
+//a player not requesting for this long is gone
+const HTTPIdleTimeout = 30 * time.Second
+
+//evictPeriod idle http players are removed by a ticker
+const evictPeriod = 5 * time.Second
+
+//errors of open,touch and kick
+var (
+	ErrBanned   = errors.New("client ip banned")
+	ErrKicked   = errors.New("session kicked")
+	ErrNotFound = errors.New("session not found")
+)
+
+//Session one rtmp,rtsp or websocket connection,or one http player
+type Session struct {
+	id       string
+	protocol string
+	addr     string
+	start    time.Time
+	bytesIn  uint64
+	bytesOut uint64
+	closer   func()
+
+	mutex     sync.Mutex
+	stream    string
+	publisher bool
+	agent     string
+	//http players
+	key    string
+	active time.Time
+	kicked bool
+}
+
+//Info snapshot of one session
+type Info struct {
+	ID         string    `json:"id"`
+	Protocol   string    `json:"protocol"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Stream     string    `json:"stream,omitempty"`
+	Publisher  bool      `json:"publisher"`
+	Agent      string    `json:"agent,omitempty"`
+	Start      time.Time `json:"start"`
+	BytesIn    uint64    `json:"bytesIn"`
+	BytesOut   uint64    `json:"bytesOut"`
+}
+
+//BanInfo ip refused until
+type BanInfo struct {
+	IP    string    `json:"ip"`
+	Until time.Time `json:"until"`
+}
+
+var (
+	mutexSessions sync.Mutex
+	sessions      = make(map[string]*Session)
+	httpSessions  = make(map[string]*Session)
+	mutexBans     sync.Mutex
+	bans          = make(map[string]time.Time)
+	evictOnce     sync.Once
+)
+
+//Open register a connection,closer disconnects it when kicked
+func Open(protocol, remoteAddr string, closer func()) (session *Session, err error) {
+	if Banned(remoteAddr) {
+		return nil, ErrBanned
+	}
+	session = newSession(protocol, remoteAddr, closer)
+	mutexSessions.Lock()
+	defer mutexSessions.Unlock()
+	sessions[session.id] = session
+	return
+}
+
+//Touch find or create the session of a http player by ip,user agent and stream,
+//a kicked player stays refused until it is idle
+func Touch(protocol, stream string, req *http.Request) (session *Session, err error) {
+	if Banned(req.RemoteAddr) {
+		return nil, ErrBanned
+	}
+	key := protocol + "|" + host(req.RemoteAddr) + "|" + req.UserAgent() + "|" + stream
+	now := time.Now()
+	evictOnce.Do(func() { go threadEvict() })
+	mutexSessions.Lock()
+	defer mutexSessions.Unlock()
+	session = httpSessions[key]
+	if nil != session && session.idle(now) {
+		//not evicted by the ticker yet
+		delete(sessions, session.id)
+		session = nil
+	}
+	if nil == session {
+		session = newSession(protocol, req.RemoteAddr, nil)
+		session.key = key
+		session.stream = stream
+		session.agent = req.UserAgent()
+		httpSessions[key] = session
+		sessions[session.id] = session
+	}
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.active = now
+	if session.kicked {
+		return nil, ErrKicked
+	}
+	return
+}
+
+//threadEvict remove idle http players
+func threadEvict() {
+	ticker := time.NewTicker(evictPeriod)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		evictIdle(now)
+	}
+}
+
+func evictIdle(now time.Time) {
+	mutexSessions.Lock()
+	defer mutexSessions.Unlock()
+	for key, session := range httpSessions {
+		if session.idle(now) {
+			delete(httpSessions, key)
+			delete(sessions, session.id)
+		}
+	}
+}
+
+func (session *Session) idle(now time.Time) bool {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return now.Sub(session.active) > HTTPIdleTimeout
+}
+
+func newSession(protocol, remoteAddr string, closer func()) *Session {
+	return &Session{
+		id:       utils.GenerateGUID(),
+		protocol: protocol,
+		addr:     remoteAddr,
+		start:    time.Now(),
+		closer:   closer}
+}
+
+//Close unregister the connection
+func (session *Session) Close() {
+	if nil == session {
+		return
+	}
+	mutexSessions.Lock()
+	defer mutexSessions.Unlock()
+	delete(sessions, session.id)
+}
+
+//ID of the session
+func (session *Session) ID() string {
+	if nil == session {
+		return ""
+	}
+	return session.id
+}
+
+//SetStream the stream played or published
+func (session *Session) SetStream(stream string, publisher bool) {
+	if nil == session {
+		return
+	}
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.stream = stream
+	session.publisher = publisher
+}
+
+//SetAgent user agent or flash version of the client
+func (session *Session) SetAgent(agent string) {
+	if nil == session {
+		return
+	}
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.agent = agent
+}
+
+//AddIn bytes received from the client
+func (session *Session) AddIn(size int) {
+	if nil == session || size <= 0 {
+		return
+	}
+	atomic.AddUint64(&session.bytesIn, uint64(size))
+}
+
+//AddOut bytes sent to the client
+func (session *Session) AddOut(size int) {
+	if nil == session || size <= 0 {
+		return
+	}
+	atomic.AddUint64(&session.bytesOut, uint64(size))
+}
+
+//Info snapshot of the session
+func (session *Session) Info() (info Info) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return Info{
+		ID:         session.id,
+		Protocol:   session.protocol,
+		RemoteAddr: session.addr,
+		Stream:     session.stream,
+		Publisher:  session.publisher,
+		Agent:      session.agent,
+		Start:      session.start,
+		BytesIn:    atomic.LoadUint64(&session.bytesIn),
+		BytesOut:   atomic.LoadUint64(&session.bytesOut)}
+}
+
+//Conn count bytes of conn in the session
+func (session *Session) Conn(conn net.Conn) net.Conn {
+	if nil == session {
+		return conn
+	}
+	return &countConn{Conn: conn, session: session}
+}
+
+//ResponseWriter count bytes sent by w in the session
+func (session *Session) ResponseWriter(w http.ResponseWriter) http.ResponseWriter {
+	if nil == session {
+		return w
+	}
+	return &countWriter{ResponseWriter: w, session: session}
+}
+
+//List sessions of stream sorted by start time,all sessions if stream is empty
+func List(stream string) (list []Info) {
+	mutexSessions.Lock()
+	all := make([]*Session, 0, len(sessions))
+	for _, v := range sessions {
+		all = append(all, v)
+	}
+	mutexSessions.Unlock()
+	list = make([]Info, 0, len(all))
+	for _, v := range all {
+		info := v.Info()
+		if len(stream) > 0 && info.Stream != stream {
+			continue
+		}
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if false == list[i].Start.Equal(list[j].Start) {
+			return list[i].Start.Before(list[j].Start)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return
+}
+
+//HTTPPlayers count of hls and dash players by protocol,kicked and idle players are not counted
+func HTTPPlayers() (counts map[string]int) {
+	now := time.Now()
+	counts = make(map[string]int)
+	mutexSessions.Lock()
+	defer mutexSessions.Unlock()
+	for _, session := range httpSessions {
+		if _, exist := sessions[session.id]; exist && false == session.idle(now) {
+			counts[session.protocol]++
+		}
+	}
+	return
+}
+
+//Kick disconnect the session,ban its ip for ban if ban > 0
+func Kick(id string, ban time.Duration) (info Info, err error) {
+	mutexSessions.Lock()
+	session, exist := sessions[id]
+	if exist {
+		delete(sessions, id)
+	}
+	mutexSessions.Unlock()
+	if false == exist {
+		return info, ErrNotFound
+	}
+	session.mutex.Lock()
+	session.kicked = true
+	session.mutex.Unlock()
+	if ban > 0 {
+		Ban(host(session.addr), ban)
+	}
+	if session.closer != nil {
+		session.closer()
+	}
+	return session.Info(), nil
+}
+
+//Ban refuse new sessions from ip for duration
+func Ban(ip string, duration time.Duration) {
+	mutexBans.Lock()
+	defer mutexBans.Unlock()
+	bans[ip] = time.Now().Add(duration)
+}
+
+//Unban false if ip not banned
+func Unban(ip string) bool {
+	mutexBans.Lock()
+	defer mutexBans.Unlock()
+	_, exist := bans[ip]
+	delete(bans, ip)
+	return exist
+}
+
+//Bans ips banned now
+func Bans() (list []BanInfo) {
+	now := time.Now()
+	mutexBans.Lock()
+	defer mutexBans.Unlock()
+	list = make([]BanInfo, 0, len(bans))
+	for ip, until := range bans {
+		if until.Before(now) {
+			delete(bans, ip)
+			continue
+		}
+		list = append(list, BanInfo{IP: ip, Until: until})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].IP < list[j].IP })
+	return
+}
+
+//Banned whether the ip of remoteAddr is banned
+func Banned(remoteAddr string) bool {
+	ip := host(remoteAddr)
+	mutexBans.Lock()
+	defer mutexBans.Unlock()
+	until, exist := bans[ip]
+	if false == exist {
+		return false
+	}
+	if until.Before(time.Now()) {
+		delete(bans, ip)
+		return false
+	}
+	return true
+}
+
+func host(remoteAddr string) string {
+	if ip, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return ip
+	}
+	return remoteAddr
+}
+
+type countConn struct {
+	net.Conn
+	session *Session
+}
+
+func (conn *countConn) Read(b []byte) (n int, err error) {
+	n, err = conn.Conn.Read(b)
+	conn.session.AddIn(n)
+	return
+}
+
+func (conn *countConn) Write(b []byte) (n int, err error) {
+	n, err = conn.Conn.Write(b)
+	conn.session.AddOut(n)
+	return
+}
+
+type countWriter struct {
+	http.ResponseWriter
+	session *Session
+}
+
+func (w *countWriter) Write(b []byte) (n int, err error) {
+	n, err = w.ResponseWriter.Write(b)
+	w.session.AddOut(n)
+	return
+}
+
+//Flush pass through,http-flv and chunked players flush every tag
+func (w *countWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//Hijack pass through,bytes written to the hijacked conn are counted too
+func (w *countWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if false == ok {
+		return nil, nil, errors.New("response writer can not be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return conn, rw, err
+	}
+	conn = w.session.Conn(conn)
+	if rw.Writer.Buffered() == 0 {
+		rw.Writer.Reset(conn)
+	}
+	return conn, rw, nil
+}
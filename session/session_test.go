@@ -0,0 +1,139 @@
+package session
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestKickAndBan(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	session, err := Open("rtmp", "192.168.1.2:5000", func() { server.Close() })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	conn := session.Conn(server)
+	go client.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err = conn.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	session.SetStream("live/hks", true)
+	session.SetAgent("FMLE/3.0")
+	list := List("live/hks")
+	if len(list) != 1 || list[0].BytesIn != 5 || false == list[0].Publisher || list[0].Agent != "FMLE/3.0" {
+		t.Fatalf("list %+v", list)
+	}
+
+	if _, err = Kick(session.ID(), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Read(buf); err == nil {
+		t.Fatal("kicked conn not closed")
+	}
+	if len(List("")) != 0 {
+		t.Fatal("kicked session listed")
+	}
+	if _, err = Open("rtmp", "192.168.1.2:5001", nil); err != ErrBanned {
+		t.Fatalf("banned ip opened:%v", err)
+	}
+	Unban("192.168.1.2")
+	again, err := Open("rtmp", "192.168.1.2:5001", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again.Close()
+}
+
+func TestHTTPSession(t *testing.T) {
+	req := httptest.NewRequest("GET", "/hls/live/hks/index.m3u8", nil)
+	req.RemoteAddr = "192.168.1.3:6000"
+	req.Header.Set("User-Agent", "player")
+	first, err := Touch("hls", "live/hks", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//another request of the same player
+	req.RemoteAddr = "192.168.1.3:6001"
+	w := httptest.NewRecorder()
+	second, err := Touch("hls", "live/hks", req)
+	if err != nil || second != first {
+		t.Fatalf("same player got another session %v", err)
+	}
+	second.ResponseWriter(w).Write(make([]byte, 188))
+	if list := List("live/hks"); len(list) != 1 || list[0].BytesOut != 188 || list[0].Agent != "player" {
+		t.Fatalf("list %+v", list)
+	}
+
+	if _, err = Kick(first.ID(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Touch("hls", "live/hks", req); err != ErrKicked {
+		t.Fatalf("kicked player served:%v", err)
+	}
+	first.active = time.Now().Add(-HTTPIdleTimeout - time.Second)
+	third, err := Touch("hls", "live/hks", req)
+	if err != nil {
+		t.Fatalf("idle kicked player refused:%v", err)
+	}
+
+	//players gone are evicted by the ticker
+	evictIdle(time.Now().Add(HTTPIdleTimeout + time.Second))
+	if list := List("live/hks"); len(list) != 0 {
+		t.Fatalf("idle player listed %+v", list)
+	}
+	if fourth, _ := Touch("hls", "live/hks", req); fourth == third {
+		t.Fatal("evicted session reused")
+	}
+	evictIdle(time.Now().Add(HTTPIdleTimeout + time.Second))
+}
+
+func TestResponseWriterPassThrough(t *testing.T) {
+	req := httptest.NewRequest("GET", "/flv/live/pass.flv", nil)
+	req.RemoteAddr = "192.168.1.4:6000"
+	player, err := Touch("flv", "live/pass", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer player.Close()
+	recorder := httptest.NewRecorder()
+	w := player.ResponseWriter(recorder)
+	flusher, ok := w.(http.Flusher)
+	if false == ok {
+		t.Fatal("flusher hidden")
+	}
+	flusher.Flush()
+	if false == recorder.Flushed {
+		t.Fatal("flush not passed through")
+	}
+	if _, _, err = w.(http.Hijacker).Hijack(); err == nil {
+		t.Fatal("recorder hijacked")
+	}
+
+	served := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, rw, err := player.ResponseWriter(w).(http.Hijacker).Hijack()
+		if err == nil {
+			defer conn.Close()
+			rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+			err = rw.Flush()
+		}
+		served <- err
+	}))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if err = <-served; err != nil {
+		t.Fatal(err)
+	}
+	if out := player.Info().BytesOut; out != 40 {
+		t.Fatalf("hijacked bytes %d", out)
+	}
+}
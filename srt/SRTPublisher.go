@@ -0,0 +1,152 @@
+package srt
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	gosrt "github.com/datarhei/gosrt"
+
+	"github.com/use-go/websocket-streamserver/events/eStreamerEvent"
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/mediatype/ts"
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+//srtReadSize bigger than the max srt payload
+const srtReadSize = 1500
+
+//SRTPublisher mpeg-ts from a srt caller,demuxed to flv tags of a source
+type SRTPublisher struct {
+	streamName  string
+	parser      ts.TsParser
+	mutexSource sync.Mutex
+	source      wssapi.MsgHandler
+	srcID       int64
+	srcAdded    bool
+	mutexConn   sync.Mutex
+	conn        gosrt.Conn
+	quit        bool
+}
+
+//Init add self to streamer as source,Param1 stream name,Param2 remote address
+func (publisher *SRTPublisher) Init(msg *wssapi.Msg) (err error) {
+	var ok bool
+	publisher.streamName, ok = msg.Param1.(string)
+	if false == ok {
+		return errors.New("invalid param init srt publisher")
+	}
+	taskAddSrc := &eStreamerEvent.EveAddSource{}
+	taskAddSrc.Producer = publisher
+	taskAddSrc.StreamName = publisher.streamName
+	taskAddSrc.RemoteIp, _ = msg.Param2.(net.Addr)
+	err = wssapi.HandleTask(taskAddSrc)
+	if err != nil || nil == taskAddSrc.SrcObj {
+		return errors.New("add source failed:" + publisher.streamName)
+	}
+	publisher.mutexSource.Lock()
+	publisher.source = taskAddSrc.SrcObj
+	publisher.srcID = taskAddSrc.ID
+	publisher.srcAdded = true
+	publisher.mutexSource.Unlock()
+	return
+}
+
+//Start nothing to do
+func (publisher *SRTPublisher) Start(msg *wssapi.Msg) (err error) {
+	return
+}
+
+//Stop close the connection and remove source from streamer
+func (publisher *SRTPublisher) Stop(msg *wssapi.Msg) (err error) {
+	publisher.close()
+	//删除源时streamer会回调ProcessMessage,不能持有锁
+	publisher.mutexSource.Lock()
+	srcAdded := publisher.srcAdded
+	publisher.srcAdded = false
+	publisher.source = nil
+	publisher.mutexSource.Unlock()
+	if srcAdded {
+		taskDelSrc := &eStreamerEvent.EveDelSource{}
+		taskDelSrc.StreamName = publisher.streamName
+		taskDelSrc.ID = publisher.srcID
+		wssapi.HandleTask(taskDelSrc)
+		logger.LOGT("del source:" + publisher.streamName)
+	}
+	return
+}
+
+//GetType of publisher
+func (publisher *SRTPublisher) GetType() string {
+	return "SRTPublisher"
+}
+
+//HandleTask not implemention
+func (publisher *SRTPublisher) HandleTask(task wssapi.Task) (err error) {
+	return
+}
+
+//ProcessMessage source closed by streamer
+func (publisher *SRTPublisher) ProcessMessage(msg *wssapi.Msg) (err error) {
+	switch msg.Type {
+	case wssapi.MsgSourceClosedForce:
+		logger.LOGT("srt source closed force:" + publisher.streamName)
+		publisher.mutexSource.Lock()
+		publisher.srcAdded = false
+		publisher.source = nil
+		publisher.mutexSource.Unlock()
+		publisher.close()
+	}
+	return
+}
+
+//setConn closed at once if the publisher closed before accepted
+func (publisher *SRTPublisher) setConn(conn gosrt.Conn) {
+	publisher.mutexConn.Lock()
+	defer publisher.mutexConn.Unlock()
+	publisher.conn = conn
+	if publisher.quit {
+		conn.Close()
+	}
+}
+
+func (publisher *SRTPublisher) close() {
+	publisher.mutexConn.Lock()
+	defer publisher.mutexConn.Unlock()
+	if false == publisher.quit {
+		publisher.quit = true
+		if nil != publisher.conn {
+			publisher.conn.Close()
+		}
+	}
+}
+
+//run read until the caller gone,lost packets are recovered by srt in the latency window,
+//packets too late are dropped by srt and the broken pes by the ts parser
+func (publisher *SRTPublisher) run() {
+	buf := make([]byte, srtReadSize)
+	for {
+		n, err := publisher.conn.Read(buf)
+		if err != nil {
+			logger.LOGT("srt publisher read end:" + err.Error())
+			return
+		}
+		tags := publisher.parser.Parse(buf[:n])
+		publisher.mutexSource.Lock()
+		for _, tag := range tags {
+			if nil == publisher.source {
+				break
+			}
+			err = publisher.source.ProcessMessage(&wssapi.Msg{Type: wssapi.MsgFlvTag, Param1: tag})
+			if err != nil {
+				logger.LOGE(err.Error())
+				break
+			}
+		}
+		closed := nil == publisher.source
+		publisher.mutexSource.Unlock()
+		if closed {
+			return
+		}
+	}
+}
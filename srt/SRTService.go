@@ -0,0 +1,353 @@
+package srt
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gosrt "github.com/datarhei/gosrt"
+
+	"github.com/use-go/websocket-streamserver/authorizer"
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/utils"
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+//srt caller 推流和播放,streamid 使用 access control 格式
+//#!::r=live/foo,m=publish  推流
+//#!::r=live/foo,m=request  播放,m可省略
+//不带 #!:: 的 streamid 整个作为播放的流名
+
+const (
+	latencyDefault = 120
+	timeoutDefault = 5
+	modeRequest    = "request"
+	modePublish    = "publish"
+)
+
+//srtSession publisher or sink on one srt connection
+type srtSession interface {
+	close()
+}
+
+//SRTService srt listener for mpeg-ts contribution and playback
+type SRTService struct {
+	listener      gosrt.Listener
+	stopping      bool
+	mutexSessions sync.Mutex
+	sessions      map[srtSession]bool
+}
+
+//SRTConfig config
+type SRTConfig struct {
+	Port int `json:"Port"`
+	//tsbpd latency,lost packets are retransmitted in this window,the bigger one of both sides is used
+	LatencyMs  int `json:"LatencyMs"`
+	TimeoutSec int `json:"TimeoutSec"` //peer idle timeout
+	//encryption,optional,encrypted callers rejected if empty
+	Passphrase string `json:"Passphrase,omitempty"`
+	PBKeyLen   int    `json:"PBKeyLen,omitempty"` //16 24 32
+}
+
+var service *SRTService
+
+//serviceConfig *SRTConfig,passphrase is checked per caller,a reload swaps the whole config
+var serviceConfig atomic.Value
+
+//config current config,do not modify it
+func config() *SRTConfig {
+	cfg, _ := serviceConfig.Load().(*SRTConfig)
+	if nil == cfg {
+		return &SRTConfig{}
+	}
+	return cfg
+}
+
+//Init service from config file
+func (srtService *SRTService) Init(msg *wssapi.Msg) (err error) {
+	if nil == msg || nil == msg.Param1 {
+		logger.LOGE("invalid param init srt server")
+		return errors.New("init srt service failed")
+	}
+	fileName := msg.Param1.(string)
+	cfg, err := srtService.loadConfigFile(fileName)
+	if err != nil {
+		logger.LOGE(err.Error())
+		return errors.New("init srt service failed")
+	}
+	serviceConfig.Store(cfg)
+	srtService.sessions = make(map[srtSession]bool)
+	service = srtService
+	return
+}
+
+//loadConfigFile read a new config,it is not used until stored
+func (srtService *SRTService) loadConfigFile(fileName string) (cfg *SRTConfig, err error) {
+	data, err := utils.ReadFileAll(fileName)
+	if err != nil {
+		return
+	}
+	cfg = &SRTConfig{}
+	err = json.Unmarshal(data, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.LatencyMs <= 0 {
+		cfg.LatencyMs = latencyDefault
+	}
+	if cfg.TimeoutSec <= 0 {
+		cfg.TimeoutSec = timeoutDefault
+	}
+	if len(cfg.Passphrase) > 0 && (len(cfg.Passphrase) < gosrt.MIN_PASSPHRASE_SIZE ||
+		len(cfg.Passphrase) > gosrt.MAX_PASSPHRASE_SIZE) {
+		return nil, errors.New("srt passphrase must be 10 to 80 characters")
+	}
+	logger.LOGI("srt://address:" + strconv.Itoa(cfg.Port) + "?streamid=#!::r=live/streamName,m=publish")
+	logger.LOGI("srt latency: " + strconv.Itoa(cfg.LatencyMs) + " ms")
+	return
+}
+
+//Start listen udp port
+func (srtService *SRTService) Start(msg *wssapi.Msg) (err error) {
+	logger.LOGT("start srt service")
+	cfg := config()
+	srtConfig := gosrt.DefaultConfig()
+	srtConfig.ReceiverLatency = time.Duration(cfg.LatencyMs) * time.Millisecond
+	srtConfig.PeerLatency = srtConfig.ReceiverLatency
+	srtConfig.PeerIdleTimeout = time.Duration(cfg.TimeoutSec) * time.Second
+	if cfg.PBKeyLen > 0 {
+		srtConfig.PBKeylen = cfg.PBKeyLen
+	}
+	srtService.listener, err = gosrt.Listen("srt", ":"+strconv.Itoa(cfg.Port), srtConfig)
+	if err != nil {
+		logger.LOGE(err.Error())
+		return
+	}
+	go srtService.srtLoop(srtService.listener)
+	return
+}
+
+//Stop close listener and all sessions
+func (srtService *SRTService) Stop(msg *wssapi.Msg) (err error) {
+	srtService.mutexSessions.Lock()
+	srtService.stopping = true
+	sessions := srtService.sessions
+	srtService.sessions = make(map[srtSession]bool)
+	srtService.mutexSessions.Unlock()
+	for session := range sessions {
+		session.close()
+	}
+	if nil != srtService.listener {
+		srtService.listener.Close()
+	}
+	return
+}
+
+//GetType of service
+func (srtService *SRTService) GetType() string {
+	return wssapi.OBJSRTServer
+}
+
+//HandleTask not implemention
+func (srtService *SRTService) HandleTask(task wssapi.Task) (err error) {
+	return
+}
+
+//ProcessMessage reload config,port and latency need restart,passphrase used by new callers
+func (srtService *SRTService) ProcessMessage(msg *wssapi.Msg) (err error) {
+	switch msg.Type {
+	case wssapi.MsgReloadConfig:
+		var cfg *SRTConfig
+		cfg, err = srtService.loadConfigFile(msg.Param1.(string))
+		if err != nil {
+			logger.LOGE(err.Error())
+			return
+		}
+		old := config()
+		if cfg.Port != old.Port || cfg.LatencyMs != old.LatencyMs {
+			logger.LOGW("srt port or latency change need restart")
+			cfg.Port = old.Port
+			cfg.LatencyMs = old.LatencyMs
+		}
+		serviceConfig.Store(cfg)
+	}
+	return
+}
+
+func (srtService *SRTService) srtLoop(listener gosrt.Listener) {
+	for {
+		req, err := listener.Accept2()
+		if err != nil {
+			if srtService.stopping || err == gosrt.ErrListenerClosed {
+				return
+			}
+			logger.LOGW(err.Error())
+			continue
+		}
+		go srtService.handleRequest(req)
+	}
+}
+
+//handleRequest decide by streamid,rejected callers get the access control reject code
+func (srtService *SRTService) handleRequest(req gosrt.ConnRequest) {
+	remoteAddr := req.RemoteAddr()
+	streamName, mode, token, err := parseStreamID(req.StreamId())
+	if err != nil {
+		logger.LOGE(err.Error() + " from " + remoteAddr.String())
+		req.Reject(gosrt.REJX_BAD_REQUEST)
+		return
+	}
+	passphrase := config().Passphrase
+	if req.IsEncrypted() {
+		if len(passphrase) == 0 {
+			req.Reject(gosrt.REJ_UNSECURE)
+			return
+		}
+		err = req.SetPassphrase(passphrase)
+		if err != nil {
+			logger.LOGE("srt passphrase mismatch from " + remoteAddr.String())
+			req.Reject(gosrt.REJ_BADSECRET)
+			return
+		}
+	} else if len(passphrase) > 0 {
+		req.Reject(gosrt.REJ_UNSECURE)
+		return
+	}
+	action := authorizer.ActionPlay
+	if mode == modePublish {
+		action = authorizer.ActionPublish
+	}
+	errAuth := authorizer.Check(&authorizer.Request{Action: action,
+		Protocol:   authorizer.ProtocolSRT,
+		StreamName: streamName,
+		Token:      token,
+		RemoteAddr: remoteAddr.String()})
+	if errAuth != nil {
+		if errAuth == authorizer.ErrTokenMissing {
+			req.Reject(gosrt.REJX_UNAUTHORIZED)
+		} else {
+			req.Reject(gosrt.REJX_FORBIDDEN)
+		}
+		return
+	}
+	if mode == modePublish {
+		srtService.servePublish(req, streamName)
+	} else {
+		srtService.servePlay(req, streamName)
+	}
+}
+
+func (srtService *SRTService) servePublish(req gosrt.ConnRequest, streamName string) {
+	publisher := &SRTPublisher{}
+	err := publisher.Init(&wssapi.Msg{Param1: streamName, Param2: req.RemoteAddr()})
+	if err != nil {
+		logger.LOGE(err.Error())
+		req.Reject(gosrt.REJX_CONFLICT)
+		return
+	}
+	conn, err := req.Accept()
+	if err != nil {
+		logger.LOGE("srt accept failed:" + err.Error())
+		publisher.Stop(nil)
+		return
+	}
+	publisher.setConn(conn)
+	if false == srtService.addSession(publisher) {
+		publisher.Stop(nil)
+		return
+	}
+	logger.LOGT("srt publish start:" + streamName + " " + conn.RemoteAddr().String())
+	publisher.run()
+	srtService.delSession(publisher)
+	publisher.Stop(nil)
+	logger.LOGT("srt publish stop:" + streamName)
+}
+
+func (srtService *SRTService) servePlay(req gosrt.ConnRequest, streamName string) {
+	sink := &SRTSink{}
+	err := sink.Init(&wssapi.Msg{Param1: streamName})
+	if err != nil {
+		logger.LOGE(err.Error())
+		req.Reject(gosrt.REJX_NOTFOUND)
+		return
+	}
+	if false == sink.waitSource() {
+		sink.Stop(nil)
+		req.Reject(gosrt.REJX_NOTFOUND)
+		return
+	}
+	conn, err := req.Accept()
+	if err != nil {
+		logger.LOGE("srt accept failed:" + err.Error())
+		sink.Stop(nil)
+		return
+	}
+	sink.setConn(conn)
+	if false == srtService.addSession(sink) {
+		sink.Stop(nil)
+		return
+	}
+	logger.LOGT("srt play start:" + streamName + " " + conn.RemoteAddr().String())
+	sink.run()
+	srtService.delSession(sink)
+	sink.Stop(nil)
+	logger.LOGT("srt play stop:" + streamName)
+}
+
+//addSession false if the service is stopping
+func (srtService *SRTService) addSession(session srtSession) bool {
+	srtService.mutexSessions.Lock()
+	defer srtService.mutexSessions.Unlock()
+	if srtService.stopping {
+		return false
+	}
+	srtService.sessions[session] = true
+	return true
+}
+
+func (srtService *SRTService) delSession(session srtSession) {
+	srtService.mutexSessions.Lock()
+	defer srtService.mutexSessions.Unlock()
+	delete(srtService.sessions, session)
+}
+
+//parseStreamID access control syntax,keys r m and token,other keys ignored,
+//a token in r as live/foo?token=xxx is also accepted
+func parseStreamID(streamID string) (streamName, mode, token string, err error) {
+	mode = modeRequest
+	if strings.HasPrefix(streamID, "#!::") {
+		for _, kv := range strings.Split(streamID[4:], ",") {
+			pair := strings.SplitN(kv, "=", 2)
+			if len(pair) != 2 {
+				continue
+			}
+			switch pair[0] {
+			case "r":
+				streamName = pair[1]
+			case "m":
+				mode = pair[1]
+			case authorizer.TokenParam:
+				token = pair[1]
+			}
+		}
+	} else {
+		streamName = streamID
+	}
+	if mode != modeRequest && mode != modePublish {
+		return "", "", "", errors.New("srt mode not supported:" + mode)
+	}
+	name, tokenInName := authorizer.SplitToken(streamName)
+	if len(token) == 0 {
+		token = tokenInName
+	}
+	streamName = strings.Trim(name, "/")
+	subs := strings.Split(streamName, "/")
+	if len(subs) < 2 || len(subs[0]) == 0 || len(subs[len(subs)-1]) == 0 {
+		return "", "", "", errors.New("invalid srt stream name:" + streamID)
+	}
+	return
+}
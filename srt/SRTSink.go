@@ -0,0 +1,257 @@
+package srt
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	gosrt "github.com/datarhei/gosrt"
+
+	"github.com/use-go/websocket-streamserver/events/eStreamerEvent"
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/mediatype/ts"
+	"github.com/use-go/websocket-streamserver/metrics"
+	"github.com/use-go/websocket-streamserver/utils"
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+const (
+	tagCacheSize = 1024
+	//srt caller 握手默认3秒超时,等待时间要短于它
+	waitSourceTime = 2 * time.Second
+	//pat pmt 在关键帧前和至少每隔这个时间发送一次
+	psiInterval = 500 * time.Millisecond
+)
+
+//SRTSink one srt player,flv tags muxed to mpeg-ts
+type SRTSink struct {
+	streamName     string
+	clientID       string
+	sinkAdded      bool
+	chSource       chan bool
+	chTags         chan *flv.FlvTag
+	chQuit         chan bool
+	mutexConn      sync.Mutex
+	conn           gosrt.Conn
+	quit           bool
+	tsCreater      *ts.TsCreater
+	videoHeaderGot bool
+	audioHeaderGot bool
+	keyFrameGot    bool
+	lastPSI        time.Time
+	stats          *metrics.SinkStats
+}
+
+//Init add self to streamer as sink
+func (sink *SRTSink) Init(msg *wssapi.Msg) (err error) {
+	var ok bool
+	sink.streamName, ok = msg.Param1.(string)
+	if false == ok {
+		return errors.New("invalid param init srt sink")
+	}
+	sink.clientID = utils.GenerateGUID()
+	sink.chSource = make(chan bool, 1)
+	sink.chTags = make(chan *flv.FlvTag, tagCacheSize)
+	sink.chQuit = make(chan bool)
+	sink.tsCreater = &ts.TsCreater{}
+
+	taskAddSink := &eStreamerEvent.EveAddSink{
+		StreamName: sink.streamName,
+		SinkId:     sink.clientID,
+		Sinker:     sink}
+	sink.stats = metrics.AddSink(metrics.ProtocolSRT, sink.streamName, sink.clientID)
+	err = wssapi.HandleTask(taskAddSink)
+	if err != nil {
+		metrics.DelSink(sink.stats)
+		return
+	}
+	sink.sinkAdded = true
+	return
+}
+
+//Start nothing to do
+func (sink *SRTSink) Start(msg *wssapi.Msg) (err error) {
+	return
+}
+
+//Stop remove from streamer
+func (sink *SRTSink) Stop(msg *wssapi.Msg) (err error) {
+	sink.close()
+	metrics.DelSink(sink.stats)
+	if sink.sinkAdded {
+		taskDelSink := &eStreamerEvent.EveDelSink{}
+		taskDelSink.StreamName = sink.streamName
+		taskDelSink.SinkId = sink.clientID
+		go wssapi.HandleTask(taskDelSink)
+		sink.sinkAdded = false
+		logger.LOGT("del srt sinker:" + sink.clientID)
+	}
+	return
+}
+
+//GetType of sink
+func (sink *SRTSink) GetType() string {
+	return "SRTSink"
+}
+
+//HandleTask not implemention
+func (sink *SRTSink) HandleTask(task wssapi.Task) (err error) {
+	return
+}
+
+//ProcessMessage called by source,must not block
+func (sink *SRTSink) ProcessMessage(msg *wssapi.Msg) (err error) {
+	switch msg.Type {
+	case wssapi.MsgGetSourceNotify:
+		sink.notifySource(true)
+	case wssapi.MsgGetSourceFailed:
+		sink.notifySource(false)
+	case wssapi.MsgPlayStart:
+	case wssapi.MsgPlayStop:
+		logger.LOGT("srt source stopped:" + sink.streamName)
+		sink.close()
+	case wssapi.MsgFlvTag:
+		tag, ok := msg.Param1.(*flv.FlvTag)
+		if false == ok {
+			return errors.New("invalid flv tag")
+		}
+		select {
+		case <-sink.chQuit:
+			return errors.New("srt client closed")
+		case sink.chTags <- tag:
+		default:
+			//客户端太慢,放弃,缓存中的tag也不会再发送
+			sink.stats.AddDropped(len(sink.chTags))
+			return errors.New("srt client too slow:" + sink.clientID)
+		}
+	default:
+		logger.LOGW(msg.Type + " not processed")
+	}
+	return
+}
+
+//NeedLastKeyFrame srt 播放需要立即出画面
+func (sink *SRTSink) NeedLastKeyFrame() bool {
+	return true
+}
+
+func (sink *SRTSink) notifySource(ok bool) {
+	select {
+	case sink.chSource <- ok:
+	default:
+	}
+}
+
+//setConn closed at once if the sink closed before accepted
+func (sink *SRTSink) setConn(conn gosrt.Conn) {
+	sink.mutexConn.Lock()
+	defer sink.mutexConn.Unlock()
+	sink.conn = conn
+	if sink.quit {
+		conn.Close()
+	}
+}
+
+func (sink *SRTSink) close() {
+	sink.mutexConn.Lock()
+	defer sink.mutexConn.Unlock()
+	if false == sink.quit {
+		sink.quit = true
+		close(sink.chQuit)
+		if nil != sink.conn {
+			sink.conn.Close()
+		}
+	}
+}
+
+//waitSource true if the stream exists
+func (sink *SRTSink) waitSource() bool {
+	select {
+	case ok := <-sink.chSource:
+		if false == ok {
+			logger.LOGE("srt source not found:" + sink.streamName)
+		}
+		return ok
+	case <-time.After(waitSourceTime):
+		logger.LOGE("srt wait source timeout:" + sink.streamName)
+	case <-sink.chQuit:
+	}
+	return false
+}
+
+//run send tags until client gone or source stopped
+func (sink *SRTSink) run() {
+	for {
+		select {
+		case tag := <-sink.chTags:
+			err := sink.sendTag(tag)
+			if err != nil {
+				logger.LOGE("srt send failed:" + err.Error())
+				return
+			}
+		case <-sink.chQuit:
+			return
+		}
+	}
+}
+
+//sendTag ts creater takes the first audio and video tag as headers,
+//frames start from a keyframe
+func (sink *SRTSink) sendTag(tag *flv.FlvTag) (err error) {
+	switch tag.TagType {
+	case flv.FlvTagVideo:
+		if flv.IsVideoSequenceHeader(tag) {
+			if sink.videoHeaderGot {
+				return
+			}
+			sink.videoHeaderGot = true
+		} else if false == sink.videoHeaderGot {
+			return
+		} else if false == sink.keyFrameGot {
+			if false == flv.IsKeyFrame(tag) {
+				return
+			}
+			sink.keyFrameGot = true
+		}
+	case flv.FlvTagAudio:
+		if flv.IsAudioSequenceHeader(tag) {
+			if sink.audioHeaderGot {
+				return
+			}
+			sink.audioHeaderGot = true
+		} else if false == sink.audioHeaderGot || (sink.videoHeaderGot && false == sink.keyFrameGot) {
+			return
+		}
+	default:
+		return
+	}
+	sink.tsCreater.AddTag(tag)
+	if flv.IsVideoSequenceHeader(tag) || flv.IsAudioSequenceHeader(tag) {
+		//pmt 在第一帧时按两个头生成
+		return
+	}
+	tsList := sink.tsCreater.FlushTsList()
+	sendPSI := flv.IsKeyFrame(tag) || time.Since(sink.lastPSI) >= psiInterval
+	if sendPSI {
+		sink.lastPSI = time.Now()
+	}
+	buf := make([]byte, 0, ts.TS_length*tsList.Len())
+	for e := tsList.Front(); e != nil; e = e.Next() {
+		pkt := e.Value.([]byte)
+		pid := int(pkt[1]&0x1f)<<8 | int(pkt[2])
+		if false == sendPSI && (pid == 0 || pid == ts.PMT_ID) {
+			continue
+		}
+		buf = append(buf, pkt...)
+	}
+	if len(buf) == 0 {
+		return
+	}
+	_, err = sink.conn.Write(buf)
+	if err != nil {
+		return
+	}
+	sink.stats.AddBytes(len(buf))
+	return
+}
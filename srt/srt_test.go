@@ -0,0 +1,32 @@
+package srt
+
+import "testing"
+
+func TestParseStreamID(t *testing.T) {
+	cases := []struct {
+		streamID string
+		name     string
+		mode     string
+		token    string
+		fail     bool
+	}{
+		{"#!::r=live/foo,m=publish", "live/foo", modePublish, "", false},
+		{"#!::r=live/foo,token=abc", "live/foo", modeRequest, "abc", false},
+		{"live/foo", "live/foo", modeRequest, "", false},
+		{"live/foo?token=xyz", "live/foo", modeRequest, "xyz", false},
+		{"#!::r=live/foo,m=bidirectional", "", "", "", true},
+		{"foo", "", "", "", true},
+	}
+	for _, c := range cases {
+		name, mode, token, err := parseStreamID(c.streamID)
+		if c.fail {
+			if err == nil {
+				t.Fatal("should fail:", c.streamID)
+			}
+			continue
+		}
+		if err != nil || name != c.name || mode != c.mode || token != c.token {
+			t.Fatal(c.streamID, name, mode, token, err)
+		}
+	}
+}
@@ -8,6 +8,10 @@ package main
 life circle of app
 */
 import (
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/use-go/websocket-streamserver/logger"
 	"github.com/use-go/websocket-streamserver/process"
 )
@@ -23,9 +27,22 @@ func initLogger() {
 	logger.OutputInCmd(true)
 }
 
+//runServer SIGHUP reload configs,SIGINT/SIGTERM stop all services then exit
 func runServer() {
 	process.Run()
 
-	ch := make(chan int)
-	<-ch
+	chSignal := make(chan os.Signal, 1)
+	signal.Notify(chSignal, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range chSignal {
+		switch sig {
+		case syscall.SIGHUP:
+			logger.LOGI("reload config")
+			process.Reload()
+		default:
+			logger.LOGI("shutdown by signal:" + sig.String())
+			process.Shutdown()
+			logger.LOGI("all services stopped")
+			return
+		}
+	}
 }
@@ -7,6 +7,11 @@ import (
 	"github.com/use-go/websocket-streamserver/wssapi"
 )
 
+//lastKeyFrameSinker 需要立即出画面的sinker(如http-flv)实现此接口,加入时会收到缓存的关键帧
+type lastKeyFrameSinker interface {
+	NeedLastKeyFrame() bool
+}
+
 type streamSink struct {
 	id     string
 	sinker wssapi.MsgHandler
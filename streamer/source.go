@@ -8,6 +8,7 @@ import (
 
 	"github.com/use-go/websocket-streamserver/logger"
 	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/metrics"
 	"github.com/use-go/websocket-streamserver/wssapi"
 	"github.com/use-go/websocket-streamserver/utils"
 )
@@ -26,6 +27,7 @@ type streamSource struct {
 	createID     int64
 	mutexID      sync.RWMutex
 	dataProducer wssapi.MsgHandler
+	stats        *metrics.StreamStats //replaced by SetProducer under mutexSink
 }
 
 func (source *streamSource) Init(msg *wssapi.Msg) (err error) {
@@ -57,18 +59,24 @@ func (source *streamSource) ProcessMessage(msg *wssapi.Msg) (err error) {
 			return errors.New("src may closed or invalid")
 		}
 		tag := msg.Param1.(*flv.FlvTag)
+		//AddSink reads the headers with the write lock
+		source.mutexSink.RLock()
+		defer source.mutexSink.RUnlock()
+		source.stats.AddTag(tag)
 		switch tag.TagType {
 		case flv.FlvTagAudio:
-			if source.audioHeader == nil {
+			//mp3 has no sequence header,the first frame is kept as header
+			if source.audioHeader == nil || flv.IsAudioSequenceHeader(tag) {
 				source.audioHeader = tag.Copy()
 				source.audioHeader.Timestamp = 0
 			}
 		case flv.FlvTagVideo:
-			if source.videoHeader == nil {
+			//avcC hvcC av1C,new sequence header replaces the old one
+			if source.videoHeader == nil || flv.IsVideoSequenceHeader(tag) {
 				source.videoHeader = tag.Copy()
 				source.videoHeader.Timestamp = 0
 			}
-			if (tag.Data[0] >> 4) == 1 {
+			if flv.IsKeyFrame(tag) {
 				source.lastKeyFrame = tag.Copy()
 			}
 
@@ -77,14 +85,13 @@ func (source *streamSource) ProcessMessage(msg *wssapi.Msg) (err error) {
 				source.metadata = tag.Copy()
 			}
 		}
-		source.mutexSink.RLock()
-		defer source.mutexSink.RUnlock()
 		for k, v := range source.sinks {
 			err = v.ProcessMessage(msg)
 			if err != nil {
 				logger.LOGE("send msg to sink failed,delete it:" + k)
 				delete(source.sinks, k)
 				v.Stop(nil)
+				metrics.AddDropped(source.streamName, 1)
 				err = nil //这不是源的锅
 			}
 		}
@@ -105,6 +112,11 @@ func (source *streamSource) SetProducer(status bool) (remove bool) {
 	}
 	source.bProducer = status
 	if source.bProducer == false {
+		source.mutexSink.Lock()
+		stats := source.stats
+		source.stats = nil
+		source.mutexSink.Unlock()
+		metrics.StreamStopped(stats)
 		//通知生产者
 		logger.LOGD(source.dataProducer)
 		if utils.InterfaceValid(source.dataProducer) {
@@ -126,6 +138,10 @@ func (source *streamSource) SetProducer(status bool) (remove bool) {
 		}
 		return
 	}
+	stats := metrics.StreamStarted(source.streamName)
+	source.mutexSink.Lock()
+	source.stats = stats
+	source.mutexSink.Unlock()
 	//notify sinks start
 	source.mutexSink.RLock()
 	defer source.mutexSink.RUnlock()
@@ -174,13 +190,32 @@ func (source *streamSource) AddSink(id string, sinker wssapi.MsgHandler) (err er
 		if source.lastKeyFrame != nil {
 			msg.Param1 = source.lastKeyFrame
 			msg.Type = wssapi.MsgFlvTag
-			logger.LOGD("not send last keyframe")
-			//			sink.ProcessMessage(msg)
+			if keyFrameSinker, ok := sinker.(lastKeyFrameSinker); ok && keyFrameSinker.NeedLastKeyFrame() {
+				sink.ProcessMessage(msg)
+			} else {
+				logger.LOGD("not send last keyframe")
+			}
 		}
 	}
 	return
 }
 
+//close 服务停止时通知生产者和所有播放者
+func (source *streamSource) close() {
+	if source.bProducer {
+		source.SetProducer(false)
+	} else {
+		source.mutexSink.RLock()
+		for _, v := range source.sinks {
+			v.Stop(nil)
+		}
+		source.mutexSink.RUnlock()
+	}
+	source.mutexSink.Lock()
+	source.sinks = make(map[string]*streamSink)
+	source.mutexSink.Unlock()
+}
+
 func (source *streamSource) clearCache() {
 	logger.LOGT("clear cache")
 	source.metadata = nil
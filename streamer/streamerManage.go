@@ -9,11 +9,15 @@ import (
 	"strings"
 	"time"
 
+	"github.com/use-go/websocket-streamserver/events/eHLSEvent"
 	"github.com/use-go/websocket-streamserver/events/eLiveListCtrl"
 	"github.com/use-go/websocket-streamserver/events/eRTMPEvent"
+	"github.com/use-go/websocket-streamserver/events/eRTSPEvent"
+	"github.com/use-go/websocket-streamserver/events/eStreamerEvent"
 	"github.com/use-go/websocket-streamserver/logger"
 	"github.com/use-go/websocket-streamserver/wssapi"
 	"github.com/use-go/websocket-streamserver/utils"
+	"github.com/use-go/websocket-streamserver/webhook"
 )
 
 func enableBlackList(enable bool) (err error) {
@@ -38,7 +42,7 @@ func addBlackList(blackList *list.List) (err error) {
 		}
 		service.blacks[name] = name
 		if service.blackOn {
-			service.delSource(name, 0xffffffff)
+			service.delSource(name, eStreamerEvent.DelSourceForce)
 		}
 	}
 	if len(errs) > 0 {
@@ -108,7 +112,7 @@ func delWhiteList(whiteList *list.List) (err error) {
 		}
 		delete(service.whites, name)
 		if service.whiteOn {
-			service.delSource(name, 0xffffffff)
+			service.delSource(name, eStreamerEvent.DelSourceForce)
 		}
 	}
 	if len(errs) > 0 {
@@ -281,7 +285,7 @@ func (streamer *StreamerService) pullStreamExec(app, streamName string, addr *eL
 	chRet := make(chan wssapi.MsgHandler) //这个ch由任务执行者来关闭
 	protocol := strings.ToLower(addr.Protocol)
 	switch protocol {
-	case "rtmp":
+	case "rtmp", "rtmps":
 		task := &eRTMPEvent.EvePullRTMPStream{}
 		task.App = addr.App
 		if strings.Contains(app, "/") {
@@ -296,6 +300,49 @@ func (streamer *StreamerService) pullStreamExec(app, streamName string, addr *eL
 		task.Port = addr.Port
 		task.Protocol = addr.Protocol
 		task.StreamName = streamName
+		task.SkipVerify = addr.TLSSkipVerify
+		task.Src = chRet
+		task.SourceName = app + "/" + streamName
+		err := wssapi.HandleTask(task)
+		if err != nil {
+			logger.LOGE(err.Error())
+			return
+		}
+	case "rtsp":
+		task := &eRTSPEvent.EvePullRTSPStream{}
+		task.App = addr.App
+		task.Instance = addr.Instance
+		if strings.Contains(app, "/") {
+			tmp := strings.Split(app, "/")
+			task.Instance = strings.TrimPrefix(app, tmp[0])
+			task.Instance = strings.TrimPrefix(task.Instance, "/")
+		}
+		task.Address = addr.Addr
+		task.Port = addr.Port
+		task.Protocol = protocol
+		task.StreamName = streamName
+		task.Src = chRet
+		task.SourceName = app + "/" + streamName
+		err := wssapi.HandleTask(task)
+		if err != nil {
+			logger.LOGE(err.Error())
+			return
+		}
+	case "hls":
+		task := &eHLSEvent.EvePullHLSStream{}
+		task.App = addr.App
+		task.Instance = addr.Instance
+		if strings.Contains(app, "/") {
+			tmp := strings.Split(app, "/")
+			task.Instance = strings.TrimPrefix(app, tmp[0])
+			task.Instance = strings.TrimPrefix(task.Instance, "/")
+		}
+		task.Address = addr.Addr
+		task.Port = addr.Port
+		task.HTTPS = addr.HTTPS
+		task.Playlist = addr.Playlist
+		task.SkipVerify = addr.TLSSkipVerify
+		task.StreamName = streamName
 		task.Src = chRet
 		task.SourceName = app + "/" + streamName
 		err := wssapi.HandleTask(task)
@@ -317,7 +364,7 @@ func (streamer *StreamerService) pullStreamExec(app, streamName string, addr *eL
 			logger.LOGD("pull up stream false")
 		}
 		return
-	case <-time.After(time.Duration(serviceConfig.UpstreamTimeoutSec) * time.Second):
+	case <-time.After(time.Duration(config().UpstreamTimeoutSec) * time.Second):
 		logger.LOGD("pull up stream timeout")
 		return
 	}
@@ -328,6 +375,10 @@ func (streamer *StreamerService) pullStream(app, streamName, sinkID string, sink
 	addr := streamer.getUpAddrAuto()
 	if nil == addr {
 		logger.LOGE("upstream not found")
+		webhook.Notify(&webhook.Event{Event: webhook.EventUpstreamFailed,
+			StreamName: app + "/" + streamName,
+			ClientID:   sinkID,
+			Reason:     "upstream not found"})
 		return
 	}
 	src, ok := streamer.pullStreamExec(app, streamName, addr)
@@ -339,7 +390,9 @@ func (streamer *StreamerService) pullStream(app, streamName, sinkID string, sink
 				msg := &wssapi.Msg{}
 				msg.Type = wssapi.MsgGetSourceNotify
 				sinker.ProcessMessage(msg)
-				source.AddSink(sinkID, sinker)
+				if nil == source.AddSink(sinkID, sinker) {
+					webhook.Notify(&webhook.Event{Event: webhook.EventPlay, StreamName: app + "/" + streamName, ClientID: sinkID})
+				}
 			} else {
 				logger.LOGE("add sink failed", source, ok)
 				msg := &wssapi.Msg{Type: wssapi.MsgGetSourceFailed}
@@ -348,6 +401,10 @@ func (streamer *StreamerService) pullStream(app, streamName, sinkID string, sink
 		} else {
 			logger.LOGE("bad add", ok, src)
 			logger.LOGD(reflect.TypeOf(src))
+			webhook.Notify(&webhook.Event{Event: webhook.EventUpstreamFailed,
+				StreamName: app + "/" + streamName,
+				ClientID:   sinkID,
+				Reason:     "all upstreams failed"})
 			msg := &wssapi.Msg{Type: wssapi.MsgGetSourceFailed}
 			sinker.ProcessMessage(msg)
 		}
@@ -8,12 +8,15 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/use-go/websocket-streamserver/events/eLiveListCtrl"
 	"github.com/use-go/websocket-streamserver/events/eStreamerEvent"
+	"github.com/use-go/websocket-streamserver/events/eVODEvent"
 	"github.com/use-go/websocket-streamserver/logger"
 	"github.com/use-go/websocket-streamserver/wssapi"
 	"github.com/use-go/websocket-streamserver/utils"
+	"github.com/use-go/websocket-streamserver/webhook"
 )
 
 const (
@@ -45,7 +48,18 @@ type StreamerConfig struct {
 }
 
 var service *StreamerService
-var serviceConfig StreamerConfig
+
+//serviceConfig *StreamerConfig,the pull timeout is read while a reload may be storing a new one
+var serviceConfig atomic.Value
+
+//config current config,do not modify it
+func config() *StreamerConfig {
+	cfg, _ := serviceConfig.Load().(*StreamerConfig)
+	if nil == cfg {
+		return &StreamerConfig{}
+	}
+	return cfg
+}
 
 //Init Streamer
 func (streamer *StreamerService) Init(msg *wssapi.Msg) (err error) {
@@ -58,28 +72,34 @@ func (streamer *StreamerService) Init(msg *wssapi.Msg) (err error) {
 	streamer.whiteOn = false
 	if msg != nil {
 		fileName := msg.Param1.(string)
-		err = streamer.loadConfigFile(fileName)
+		var cfg *StreamerConfig
+		cfg, err = streamer.loadConfigFile(fileName)
+		if err == nil {
+			serviceConfig.Store(cfg)
+		}
 	}
 	if err != nil {
 		streamer.badIni()
 	}
 	// init the upstreamer
-	for _, v := range serviceConfig.Upstreams {
+	for _, v := range config().Upstreams {
 		streamer.InitUpstream(v)
 	}
 	return
 }
 
-func (streamer *StreamerService) loadConfigFile(fileName string) (err error) {
+//loadConfigFile read a new config,it is not used until stored
+func (streamer *StreamerService) loadConfigFile(fileName string) (cfg *StreamerConfig, err error) {
 	data, err := utils.ReadFileAll(fileName)
 	if err != nil {
 		logger.LOGE(err.Error())
 		return
 	}
-	err = json.Unmarshal(data, &serviceConfig)
+	cfg = &StreamerConfig{}
+	err = json.Unmarshal(data, cfg)
 	if err != nil {
 		logger.LOGE(err.Error())
-		return
+		return nil, err
 	}
 	return
 }
@@ -89,8 +109,17 @@ func (streamer *StreamerService) Start(msg *wssapi.Msg) (err error) {
 	return
 }
 
-//Stop func
+//Stop close all sources,producers get MsgSourceClosedForce and sinks get MsgPlayStop
 func (streamer *StreamerService) Stop(msg *wssapi.Msg) (err error) {
+	//通知时生产者和播放者可能回调删除,先换掉map再通知
+	streamer.mutexSources.Lock()
+	sources := streamer.sources
+	streamer.sources = make(map[string]*streamSource)
+	streamer.mutexSources.Unlock()
+	for path, src := range sources {
+		logger.LOGT("close source:" + path)
+		src.close()
+	}
 	return
 }
 
@@ -222,6 +251,27 @@ func (streamer *StreamerService) HandleTask(task wssapi.Task) (err error) {
 
 //ProcessMessage of streamer
 func (streamer *StreamerService) ProcessMessage(msg *wssapi.Msg) (err error) {
+	switch msg.Type {
+	case wssapi.MsgReloadConfig:
+		err = streamer.reloadConfig(msg.Param1.(string))
+	}
+	return
+}
+
+//reloadConfig only upstreams changed,existing sources are kept
+func (streamer *StreamerService) reloadConfig(fileName string) (err error) {
+	cfg, err := streamer.loadConfigFile(fileName)
+	if err != nil {
+		return
+	}
+	serviceConfig.Store(cfg)
+	streamer.mutexUpStream.Lock()
+	streamer.upApps = list.New()
+	streamer.upAppIdx = 0
+	streamer.mutexUpStream.Unlock()
+	for _, v := range cfg.Upstreams {
+		streamer.InitUpstream(v)
+	}
 	return
 }
 
@@ -251,6 +301,7 @@ func (streamer *StreamerService) addsource(path string, producer wssapi.MsgHandl
 		oldSrc.dataProducer = producer
 		oldSrc.addr = addr
 		oldSrc.mutexID.Unlock()
+		notifyPublish(path, addr)
 		return
 	}
 	if oldSrc.HasProducer() {
@@ -265,6 +316,7 @@ func (streamer *StreamerService) addsource(path string, producer wssapi.MsgHandl
 	id = oldSrc.createID
 	oldSrc.dataProducer = producer
 	oldSrc.mutexID.Unlock()
+	notifyPublish(path, addr)
 	return
 
 }
@@ -284,6 +336,7 @@ func (streamer *StreamerService) delSource(path string, id int64) (err error) {
 		return errors.New(path + "is old id:" + strconv.Itoa(int(id)) + " can not delete")
 	}
 	/*remove := */ oldSrc.SetProducer(false)
+	webhook.Notify(&webhook.Event{Event: webhook.EventUnpublish, StreamName: path})
 	//if remove == true {
 	if 0 == len(oldSrc.sinks) {
 		delete(streamer.sources, path)
@@ -297,36 +350,40 @@ func (streamer *StreamerService) delSource(path string, id int64) (err error) {
 //del sink:not stop sink,stop by sink itself
 //将add sink 改成异步
 func (streamer *StreamerService) addSink(sinkInfo *eStreamerEvent.EveAddSink) (err error) {
-	streamer.mutexSources.Lock()
-	defer streamer.mutexSources.Unlock()
 	path := sinkInfo.StreamName
 	sinkID := sinkInfo.SinkId
 	sinker := sinkInfo.Sinker
 	sinkInfo.Added = false
+	streamer.mutexSources.Lock()
 	src, exist := streamer.sources[path]
-	hasProducer := false
-	if nil != src {
-		hasProducer = src.bProducer
-	}
-	if false == exist || false == hasProducer {
-		tmpStrings := strings.Split(path, "/")
-		if len(tmpStrings) < 2 {
-			return errors.New("add sink bad path:" + path)
-		}
-		app := strings.TrimSuffix(path, tmpStrings[len(tmpStrings)-1])
-		app = strings.TrimSuffix(app, "/")
-		streamName := tmpStrings[len(tmpStrings)-1]
-		logger.LOGT("create upstream:" + path)
-		go streamer.pullStream(app, streamName, sinkID, sinkInfo.Sinker)
-	} else {
+	if exist && src.bProducer {
 		err = src.AddSink(sinkID, sinker)
+		streamer.mutexSources.Unlock()
 		if err == nil {
 			sinkInfo.Added = true
+			webhook.Notify(&webhook.Event{Event: webhook.EventPlay, StreamName: path, ClientID: sinkID})
 			msg := &wssapi.Msg{}
 			msg.Type = wssapi.MsgGetSourceNotify
 			sinker.ProcessMessage(msg)
 		}
+		return
+	}
+	streamer.mutexSources.Unlock()
+	//点播文件每个sink独立播放,不经过源;打开文件建索引较慢,不能持有源的锁
+	if nil == streamer.addVODSink(sinkInfo) {
+		sinkInfo.Added = true
+		webhook.Notify(&webhook.Event{Event: webhook.EventPlay, StreamName: path, ClientID: sinkID})
+		return
 	}
+	tmpStrings := strings.Split(path, "/")
+	if len(tmpStrings) < 2 {
+		return errors.New("add sink bad path:" + path)
+	}
+	app := strings.TrimSuffix(path, tmpStrings[len(tmpStrings)-1])
+	app = strings.TrimSuffix(app, "/")
+	streamName := tmpStrings[len(tmpStrings)-1]
+	logger.LOGT("create upstream:" + path)
+	go streamer.pullStream(app, streamName, sinkID, sinkInfo.Sinker)
 	return
 }
 
@@ -336,9 +393,14 @@ func (streamer *StreamerService) delSink(path, sinkID string) (err error) {
 	defer streamer.mutexSources.Unlock()
 	src, exist := streamer.sources[path]
 	if false == exist {
+		if nil == streamer.delVODSink(path, sinkID) {
+			webhook.Notify(&webhook.Event{Event: webhook.EventStop, StreamName: path, ClientID: sinkID})
+			return
+		}
 		return errors.New("source not found in del sink")
 	}
 	logger.LOGD("delete sinker:" + path + " " + sinkID)
+	webhook.Notify(&webhook.Event{Event: webhook.EventStop, StreamName: path, ClientID: sinkID})
 	src.mutexSink.Lock()
 	defer src.mutexSink.Unlock()
 	delete(src.sinks, sinkID)
@@ -348,3 +410,26 @@ func (streamer *StreamerService) delSink(path, sinkID string) (err error) {
 
 	return
 }
+
+func notifyPublish(path string, addr net.Addr) {
+	evt := &webhook.Event{Event: webhook.EventPublish, StreamName: path}
+	if nil != addr {
+		evt.RemoteAddr = addr.String()
+	}
+	webhook.Notify(evt)
+}
+
+//addVODSink 点播服务未启用或者文件不存在时返回错误
+func (streamer *StreamerService) addVODSink(sinkInfo *eStreamerEvent.EveAddSink) (err error) {
+	taskAddVOD := &eVODEvent.EveAddVODSink{
+		StreamName: sinkInfo.StreamName,
+		SinkId:     sinkInfo.SinkId,
+		Sinker:     sinkInfo.Sinker,
+		StartMs:    sinkInfo.StartMs}
+	return wssapi.HandleTask(taskAddVOD)
+}
+
+func (streamer *StreamerService) delVODSink(path, sinkID string) (err error) {
+	taskDelVOD := &eVODEvent.EveDelVODSink{StreamName: path, SinkId: sinkID}
+	return wssapi.HandleTask(taskDelVOD)
+}
@@ -0,0 +1,227 @@
+//Package tlsconf loads certificates for the tls listeners of every service,
+//certificates are selected by SNI and reloaded when the files change
+package tlsconf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/logger"
+)
+
+//reloadCheckInterval cert files are checked at most once during this interval
+const reloadCheckInterval = 5 * time.Second
+
+//CertConfig a certificate and its private key,pem files
+type CertConfig struct {
+	Cert string `json:"Cert"`
+	Key  string `json:"Key"`
+}
+
+//Config tls listener of a service,Port 0 disables tls,
+//the first certificate is used when SNI matches none of them
+type Config struct {
+	Port  int          `json:"Port"`
+	Certs []CertConfig `json:"Certs"`
+}
+
+//Enabled whether the tls listener should be started
+func (cfg *Config) Enabled() bool {
+	return cfg != nil && cfg.Port > 0 && len(cfg.Certs) > 0
+}
+
+//Addr listen address of the tls listener
+func (cfg *Config) Addr() string {
+	return ":" + strconv.Itoa(cfg.Port)
+}
+
+//Equal same port and certificate files,a nil config equals a disabled one
+func (cfg *Config) Equal(other *Config) bool {
+	if false == cfg.Enabled() || false == other.Enabled() {
+		return cfg.Enabled() == other.Enabled()
+	}
+	if cfg.Port != other.Port || len(cfg.Certs) != len(other.Certs) {
+		return false
+	}
+	for i := range cfg.Certs {
+		if cfg.Certs[i] != other.Certs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type certEntry struct {
+	files   CertConfig
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+//Store certificates of one or more services sharing a listener
+type Store struct {
+	mutex     sync.RWMutex
+	entries   []*certEntry
+	lastCheck time.Time
+}
+
+//NewStore load all certificates of cfg
+func NewStore(cfg *Config) (store *Store, err error) {
+	store = &Store{}
+	err = store.Update(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+//Update replace certificates with cfg,the old ones are kept on error
+func (store *Store) Update(cfg *Config) (err error) {
+	if cfg == nil || len(cfg.Certs) == 0 {
+		return errors.New("no tls certificate configured")
+	}
+	entries := make([]*certEntry, 0, len(cfg.Certs))
+	for _, files := range cfg.Certs {
+		entry, err := loadEntry(files)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+	}
+	store.mutex.Lock()
+	store.entries = entries
+	store.lastCheck = time.Now()
+	store.mutex.Unlock()
+	return
+}
+
+//Add append certificates of another service sharing the listener
+func (store *Store) Add(cfg *Config) (err error) {
+	if cfg == nil {
+		return
+	}
+	for _, files := range cfg.Certs {
+		entry, err := loadEntry(files)
+		if err != nil {
+			return err
+		}
+		store.mutex.Lock()
+		store.entries = append(store.entries, entry)
+		store.mutex.Unlock()
+	}
+	return
+}
+
+//modTime the newer one of cert and key file
+func modTime(files CertConfig) (latest time.Time, err error) {
+	for _, name := range []string{files.Cert, files.Key} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return
+}
+
+func loadEntry(files CertConfig) (entry *certEntry, err error) {
+	latest, err := modTime(files)
+	if err != nil {
+		return
+	}
+	cert, err := tls.LoadX509KeyPair(files.Cert, files.Key)
+	if err != nil {
+		return
+	}
+	if cert.Leaf == nil && len(cert.Certificate) > 0 {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return
+		}
+	}
+	entry = &certEntry{files: files, cert: &cert, modTime: latest}
+	return
+}
+
+//reloadChanged reload the certificates whose cert or key file is newer than the loaded one,
+//handshakes only take the read lock until a check is due
+func (store *Store) reloadChanged() {
+	store.mutex.RLock()
+	due := time.Since(store.lastCheck) >= reloadCheckInterval
+	store.mutex.RUnlock()
+	if false == due {
+		return
+	}
+	store.mutex.Lock()
+	if time.Since(store.lastCheck) < reloadCheckInterval {
+		//checked by another handshake
+		store.mutex.Unlock()
+		return
+	}
+	store.lastCheck = time.Now()
+	entries := make([]*certEntry, len(store.entries))
+	copy(entries, store.entries)
+	store.mutex.Unlock()
+
+	for i, entry := range entries {
+		latest, err := modTime(entry.files)
+		if err != nil || false == latest.After(entry.modTime) {
+			continue
+		}
+		newEntry, err := loadEntry(entry.files)
+		if err != nil {
+			//files may be half written,try again next time
+			logger.LOGW("reload certificate " + entry.files.Cert + " failed:" + err.Error())
+			continue
+		}
+		store.mutex.Lock()
+		//entries may be replaced by Update meanwhile
+		if i < len(store.entries) && store.entries[i] == entry {
+			store.entries[i] = newEntry
+		}
+		store.mutex.Unlock()
+		logger.LOGI("certificate reloaded:" + entry.files.Cert)
+	}
+}
+
+//GetCertificate select the certificate by SNI,for tls.Config
+func (store *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	store.reloadChanged()
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if len(store.entries) == 0 {
+		return nil, errors.New("no tls certificate")
+	}
+	if len(hello.ServerName) > 0 {
+		for _, entry := range store.entries {
+			if entry.cert.Leaf != nil && entry.cert.Leaf.VerifyHostname(hello.ServerName) == nil {
+				return entry.cert, nil
+			}
+		}
+	}
+	return store.entries[0].cert, nil
+}
+
+//TLSConfig server side config using this store
+func (store *Store) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: store.GetCertificate,
+		MinVersion:     tls.VersionTLS12}
+}
+
+//Listen start a tls listener for cfg,the store is returned for reloading on config change
+func Listen(cfg *Config) (listener net.Listener, store *Store, err error) {
+	store, err = NewStore(cfg)
+	if err != nil {
+		return
+	}
+	listener, err = tls.Listen("tcp", cfg.Addr(), store.TLSConfig())
+	return
+}
@@ -0,0 +1,152 @@
+package tlsconf
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//writeCert self signed certificate for host,written to dir/name.crt and dir/name.key
+func writeCert(t *testing.T, dir, name, host string) CertConfig {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := CertConfig{Cert: filepath.Join(dir, name+".crt"), Key: filepath.Join(dir, name+".key")}
+	if err = ioutil.WriteFile(files.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(files.Key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func serverName(t *testing.T, store *Store, sni string) string {
+	cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: sni})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestGetCertificate(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore(&Config{Port: 443, Certs: []CertConfig{
+		writeCert(t, dir, "a", "a.example.com"),
+		writeCert(t, dir, "b", "b.example.com")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		sni  string
+		want string
+	}{
+		{"a.example.com", "a.example.com"},
+		{"b.example.com", "b.example.com"},
+		//the first certificate when SNI matches none or is missing
+		{"c.example.com", "a.example.com"},
+		{"", "a.example.com"},
+	} {
+		if got := serverName(t, store, test.sni); got != test.want {
+			t.Errorf("sni %q got %s,want %s", test.sni, got, test.want)
+		}
+	}
+
+	if _, err = NewStore(&Config{Port: 443}); err == nil {
+		t.Error("store without certificate")
+	}
+	if _, err = NewStore(&Config{Port: 443, Certs: []CertConfig{{Cert: filepath.Join(dir, "none.crt"), Key: filepath.Join(dir, "none.key")}}}); err == nil {
+		t.Error("store with missing files")
+	}
+}
+
+func TestReloadChanged(t *testing.T) {
+	dir := t.TempDir()
+	files := writeCert(t, dir, "a", "a.example.com")
+	store, err := NewStore(&Config{Port: 443, Certs: []CertConfig{files}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//renewed with another host,mtime moved forward as the file system may be coarse
+	writeCert(t, dir, "a", "renewed.example.com")
+	future := time.Now().Add(time.Minute)
+	for _, name := range []string{files.Cert, files.Key} {
+		if err = os.Chtimes(name, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//not checked again within the interval
+	if got := serverName(t, store, ""); got != "a.example.com" {
+		t.Fatalf("reloaded before the check interval:%s", got)
+	}
+	store.mutex.Lock()
+	store.lastCheck = time.Now().Add(-reloadCheckInterval)
+	store.mutex.Unlock()
+	if got := serverName(t, store, ""); got != "renewed.example.com" {
+		t.Fatalf("not reloaded:%s", got)
+	}
+
+	//broken files keep the loaded certificate
+	if err = ioutil.WriteFile(files.Cert, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	future = future.Add(time.Minute)
+	os.Chtimes(files.Cert, future, future)
+	store.mutex.Lock()
+	store.lastCheck = time.Now().Add(-reloadCheckInterval)
+	store.mutex.Unlock()
+	if got := serverName(t, store, ""); got != "renewed.example.com" {
+		t.Fatalf("broken file replaced certificate:%s", got)
+	}
+}
+
+func TestConfigEqual(t *testing.T) {
+	a := CertConfig{Cert: "a.crt", Key: "a.key"}
+	b := CertConfig{Cert: "b.crt", Key: "b.key"}
+	tests := []struct {
+		name  string
+		x, y  *Config
+		equal bool
+	}{
+		{"both nil", nil, nil, true},
+		{"nil and disabled", nil, &Config{Port: 0, Certs: []CertConfig{a}}, true},
+		{"nil and enabled", nil, &Config{Port: 443, Certs: []CertConfig{a}}, false},
+		{"same", &Config{Port: 443, Certs: []CertConfig{a, b}}, &Config{Port: 443, Certs: []CertConfig{a, b}}, true},
+		{"port", &Config{Port: 443, Certs: []CertConfig{a}}, &Config{Port: 8443, Certs: []CertConfig{a}}, false},
+		{"cert added", &Config{Port: 443, Certs: []CertConfig{a}}, &Config{Port: 443, Certs: []CertConfig{a, b}}, false},
+		{"order", &Config{Port: 443, Certs: []CertConfig{a, b}}, &Config{Port: 443, Certs: []CertConfig{b, a}}, false},
+	}
+	for _, test := range tests {
+		if got := test.x.Equal(test.y); got != test.equal {
+			t.Errorf("%s:got %v", test.name, got)
+		}
+		if got := test.y.Equal(test.x); got != test.equal {
+			t.Errorf("%s reversed:got %v", test.name, got)
+		}
+	}
+}
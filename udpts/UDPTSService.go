@@ -0,0 +1,183 @@
+package udpts
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/utils"
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+//udp 单播和组播的 mpeg-ts 输入,每个输入对应一个流名,
+//ffmpeg -f mpegts udp://239.1.1.1:5000 或广播编码器推送,也支持 rtp 封装的 ts
+
+const (
+	timeoutDefault = 5
+)
+
+//UDPTSService all configured udp ts inputs
+type UDPTSService struct {
+	mutexInputs sync.Mutex
+	inputs      map[string]*udpInput
+}
+
+//UDPTSConfig config
+type UDPTSConfig struct {
+	//没有数据超过这个时间认为推流结束,源被删除,数据恢复后重新创建
+	TimeoutSec int          `json:"TimeoutSec"`
+	Inputs     []UDPTSInput `json:"Inputs"`
+}
+
+//UDPTSInput one udp input
+type UDPTSInput struct {
+	StreamName string `json:"StreamName"` //app/name
+	//:5000 单播,239.1.1.1:5000 组播
+	Address string `json:"Address"`
+	//组播加入的网卡名,空为系统默认
+	Interface string `json:"Interface,omitempty"`
+	//只接受这个地址发来的数据,空为不限制
+	SourceIP string `json:"SourceIP,omitempty"`
+}
+
+//serviceConfig *UDPTSConfig,inputs and timeout,replaced as a whole when reloaded
+var serviceConfig atomic.Value
+
+//config current config,do not modify it
+func config() *UDPTSConfig {
+	cfg, _ := serviceConfig.Load().(*UDPTSConfig)
+	if nil == cfg {
+		return &UDPTSConfig{}
+	}
+	return cfg
+}
+
+//Init service from config file
+func (udpService *UDPTSService) Init(msg *wssapi.Msg) (err error) {
+	if nil == msg || nil == msg.Param1 {
+		logger.LOGE("invalid param init udp ts server")
+		return errors.New("init udp ts service failed")
+	}
+	fileName := msg.Param1.(string)
+	cfg, err := udpService.loadConfigFile(fileName)
+	if err != nil {
+		logger.LOGE(err.Error())
+		return errors.New("init udp ts service failed")
+	}
+	serviceConfig.Store(cfg)
+	udpService.inputs = make(map[string]*udpInput)
+	return
+}
+
+//loadConfigFile read a new config,it is not used until stored
+func (udpService *UDPTSService) loadConfigFile(fileName string) (cfg *UDPTSConfig, err error) {
+	data, err := utils.ReadFileAll(fileName)
+	if err != nil {
+		return
+	}
+	cfg = &UDPTSConfig{}
+	err = json.Unmarshal(data, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.TimeoutSec <= 0 {
+		cfg.TimeoutSec = timeoutDefault
+	}
+	names := make(map[string]bool)
+	for i := range cfg.Inputs {
+		input := &cfg.Inputs[i]
+		input.StreamName = strings.Trim(input.StreamName, "/")
+		if false == strings.Contains(input.StreamName, "/") {
+			return nil, errors.New("invalid udp ts stream name:" + input.StreamName)
+		}
+		if names[input.StreamName] {
+			return nil, errors.New("udp ts stream name repeated:" + input.StreamName)
+		}
+		names[input.StreamName] = true
+	}
+	return
+}
+
+//Start open all inputs
+func (udpService *UDPTSService) Start(msg *wssapi.Msg) (err error) {
+	logger.LOGT("start udp ts service")
+	udpService.mutexInputs.Lock()
+	defer udpService.mutexInputs.Unlock()
+	for _, input := range config().Inputs {
+		udpService.startInput(input)
+	}
+	return
+}
+
+//Stop close all inputs
+func (udpService *UDPTSService) Stop(msg *wssapi.Msg) (err error) {
+	udpService.mutexInputs.Lock()
+	defer udpService.mutexInputs.Unlock()
+	for name, input := range udpService.inputs {
+		input.close()
+		delete(udpService.inputs, name)
+	}
+	return
+}
+
+//GetType of service
+func (udpService *UDPTSService) GetType() string {
+	return wssapi.OBJUDPTSServer
+}
+
+//HandleTask not implemention
+func (udpService *UDPTSService) HandleTask(task wssapi.Task) (err error) {
+	return
+}
+
+//ProcessMessage reload config,changed inputs are reopened
+func (udpService *UDPTSService) ProcessMessage(msg *wssapi.Msg) (err error) {
+	switch msg.Type {
+	case wssapi.MsgReloadConfig:
+		var cfg *UDPTSConfig
+		cfg, err = udpService.loadConfigFile(msg.Param1.(string))
+		if err != nil {
+			logger.LOGE(err.Error())
+			return
+		}
+		serviceConfig.Store(cfg)
+		udpService.mutexInputs.Lock()
+		defer udpService.mutexInputs.Unlock()
+		configs := make(map[string]UDPTSInput)
+		for _, input := range cfg.Inputs {
+			configs[input.StreamName] = input
+		}
+		for name, input := range udpService.inputs {
+			if config, ok := configs[name]; ok && config == input.config && input.timeout == timeout() {
+				delete(configs, name)
+				continue
+			}
+			input.close()
+			delete(udpService.inputs, name)
+		}
+		for _, config := range configs {
+			udpService.startInput(config)
+		}
+	}
+	return
+}
+
+//startInput 打开失败只记录,不影响其他输入
+func (udpService *UDPTSService) startInput(config UDPTSInput) {
+	input, err := openInput(config, timeout())
+	if err != nil {
+		logger.LOGE("udp ts input " + config.StreamName + " " + config.Address + " failed:" + err.Error())
+		return
+	}
+	udpService.inputs[config.StreamName] = input
+	logger.LOGI("udp ts input " + config.Address + " to " + config.StreamName)
+	go input.run()
+}
+
+func timeout() time.Duration {
+	return time.Duration(config().TimeoutSec) * time.Second
+}
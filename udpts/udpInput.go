@@ -0,0 +1,258 @@
+package udpts
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/events/eStreamerEvent"
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/mediatype/ts"
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+const (
+	//7个ts包一个udp包,留出rtp头和jumbo帧的余量
+	udpReadSize = 9000
+	//高码率组播需要较大的接收缓冲
+	udpReadBuffer = 4 << 20
+	readTimeout   = time.Second
+	rtpHeaderSize = 12
+	rtpVersion    = 2
+)
+
+//udpInput one udp socket feeding one source
+type udpInput struct {
+	config      UDPTSInput
+	timeout     time.Duration
+	sourceIP    net.IP
+	conn        *net.UDPConn
+	mutexSource sync.Mutex
+	source      wssapi.MsgHandler
+	srcID       int64
+	parser      *ts.TsParser
+	lastData    time.Time
+	retryTime   time.Time
+	mutexQuit   sync.Mutex
+	quit        bool
+}
+
+//openInput 组播地址加入组播,其他地址按单播监听
+func openInput(config UDPTSInput, timeout time.Duration) (input *udpInput, err error) {
+	addr, err := net.ResolveUDPAddr("udp", config.Address)
+	if err != nil {
+		return
+	}
+	input = &udpInput{config: config, timeout: timeout}
+	if len(config.SourceIP) > 0 {
+		input.sourceIP = net.ParseIP(config.SourceIP)
+		if nil == input.sourceIP {
+			return nil, errors.New("invalid source ip:" + config.SourceIP)
+		}
+	}
+	if addr.IP.IsMulticast() {
+		var ifi *net.Interface
+		if len(config.Interface) > 0 {
+			ifi, err = net.InterfaceByName(config.Interface)
+			if err != nil {
+				return nil, err
+			}
+		}
+		input.conn, err = net.ListenMulticastUDP("udp", ifi, addr)
+	} else {
+		input.conn, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = input.conn.SetReadBuffer(udpReadBuffer)
+	if err != nil {
+		logger.LOGW("udp ts set read buffer failed:" + err.Error())
+		err = nil
+	}
+	return
+}
+
+//Init nothing to do,source added when data comes
+func (input *udpInput) Init(msg *wssapi.Msg) (err error) {
+	return
+}
+
+//Start nothing to do
+func (input *udpInput) Start(msg *wssapi.Msg) (err error) {
+	return
+}
+
+//Stop close the socket
+func (input *udpInput) Stop(msg *wssapi.Msg) (err error) {
+	input.close()
+	return
+}
+
+//GetType of input
+func (input *udpInput) GetType() string {
+	return "UDPTSInput"
+}
+
+//HandleTask not implemention
+func (input *udpInput) HandleTask(task wssapi.Task) (err error) {
+	return
+}
+
+//ProcessMessage streamer stopping,close the input
+func (input *udpInput) ProcessMessage(msg *wssapi.Msg) (err error) {
+	switch msg.Type {
+	case wssapi.MsgSourceClosedForce:
+		logger.LOGT("udp ts source closed force:" + input.config.StreamName)
+		input.mutexSource.Lock()
+		input.source = nil
+		input.mutexSource.Unlock()
+		input.close()
+	}
+	return
+}
+
+func (input *udpInput) close() {
+	input.mutexQuit.Lock()
+	defer input.mutexQuit.Unlock()
+	if false == input.quit {
+		input.quit = true
+		input.conn.Close()
+	}
+}
+
+func (input *udpInput) closed() bool {
+	input.mutexQuit.Lock()
+	defer input.mutexQuit.Unlock()
+	return input.quit
+}
+
+//run read until closed,source removed when no data for a while
+func (input *udpInput) run() {
+	defer input.delSource()
+	buf := make([]byte, udpReadSize)
+	for {
+		input.conn.SetReadDeadline(time.Now().Add(readTimeout))
+		n, addr, err := input.conn.ReadFromUDP(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				if nil != input.parser && time.Since(input.lastData) > input.timeout {
+					logger.LOGT("udp ts input timeout:" + input.config.StreamName)
+					input.delSource()
+				}
+				continue
+			}
+			if false == input.closed() {
+				logger.LOGE("udp ts read failed:" + err.Error())
+			}
+			return
+		}
+		if nil != input.sourceIP && false == input.sourceIP.Equal(addr.IP) {
+			continue
+		}
+		payload := stripRTP(buf[:n])
+		if len(payload) == 0 {
+			continue
+		}
+		input.lastData = time.Now()
+		if nil == input.parser {
+			if time.Now().Before(input.retryTime) {
+				continue
+			}
+			if false == input.addSource(addr) {
+				//流名被其他推流占用,过一段时间再试
+				input.retryTime = time.Now().Add(input.timeout)
+				continue
+			}
+		}
+		input.sendTags(input.parser.Parse(payload))
+	}
+}
+
+//addSource 每次推流开始使用新的ts解析器
+func (input *udpInput) addSource(addr *net.UDPAddr) bool {
+	taskAddSrc := &eStreamerEvent.EveAddSource{}
+	taskAddSrc.Producer = input
+	taskAddSrc.StreamName = input.config.StreamName
+	taskAddSrc.RemoteIp = addr
+	err := wssapi.HandleTask(taskAddSrc)
+	if err != nil || nil == taskAddSrc.SrcObj {
+		logger.LOGE("udp ts add source failed:" + input.config.StreamName)
+		return false
+	}
+	input.mutexSource.Lock()
+	input.source = taskAddSrc.SrcObj
+	input.srcID = taskAddSrc.ID
+	input.mutexSource.Unlock()
+	input.parser = &ts.TsParser{}
+	logger.LOGT("udp ts publish start:" + input.config.StreamName + " from " + addr.String())
+	return true
+}
+
+func (input *udpInput) delSource() {
+	input.parser = nil
+	//删除源时streamer会回调ProcessMessage,不能持有锁
+	input.mutexSource.Lock()
+	source := input.source
+	input.source = nil
+	input.mutexSource.Unlock()
+	if nil == source {
+		return
+	}
+	taskDelSrc := &eStreamerEvent.EveDelSource{}
+	taskDelSrc.StreamName = input.config.StreamName
+	taskDelSrc.ID = input.srcID
+	err := wssapi.HandleTask(taskDelSrc)
+	if err != nil {
+		logger.LOGE(err.Error())
+	}
+	logger.LOGT("udp ts publish stop:" + input.config.StreamName)
+}
+
+func (input *udpInput) sendTags(tags []*flv.FlvTag) {
+	input.mutexSource.Lock()
+	defer input.mutexSource.Unlock()
+	for _, tag := range tags {
+		if nil == input.source {
+			return
+		}
+		err := input.source.ProcessMessage(&wssapi.Msg{Type: wssapi.MsgFlvTag, Param1: tag})
+		if err != nil {
+			logger.LOGE(err.Error())
+			return
+		}
+	}
+}
+
+//stripRTP 编码器用rtp封装ts时去掉rtp头,裸ts直接返回
+func stripRTP(data []byte) []byte {
+	if len(data) == 0 || data[0] == 0x47 {
+		return data
+	}
+	if len(data) < rtpHeaderSize || int(data[0]>>6) != rtpVersion {
+		return nil
+	}
+	size := rtpHeaderSize + 4*int(data[0]&0xf)
+	if data[0]&0x10 != 0 {
+		//header extension
+		if size+4 > len(data) {
+			return nil
+		}
+		size += 4 + 4*(int(data[size+2])<<8|int(data[size+3]))
+	}
+	if size > len(data) {
+		return nil
+	}
+	payload := data[size:]
+	if data[0]&0x20 != 0 && len(payload) > 0 {
+		//padding
+		padding := int(payload[len(payload)-1])
+		if padding > len(payload) {
+			return nil
+		}
+		payload = payload[:len(payload)-padding]
+	}
+	return payload
+}
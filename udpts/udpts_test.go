@@ -0,0 +1,29 @@
+package udpts
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStripRTP(t *testing.T) {
+	ts := bytes.Repeat([]byte{0x47, 1, 2, 3}, 47)
+	rtp := append([]byte{0x80, 33, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1}, ts...)
+	//csrc 1个,extension 1个字,padding 4字节
+	rtpExt := append([]byte{0xb1, 33, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 2, 0xbe, 0xde, 0, 1, 9, 9, 9, 9}, ts...)
+	rtpExt = append(rtpExt, 0, 0, 0, 4)
+	cases := []struct {
+		data []byte
+		out  []byte
+	}{
+		{ts, ts},
+		{rtp, ts},
+		{rtpExt, ts},
+		{[]byte{0x80, 33, 0}, nil},
+		{[]byte{0x12, 0x34}, nil},
+	}
+	for i, c := range cases {
+		if out := stripRTP(c.data); false == bytes.Equal(out, c.out) {
+			t.Fatal(i, len(out))
+		}
+	}
+}
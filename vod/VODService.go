@@ -0,0 +1,278 @@
+package vod
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/use-go/websocket-streamserver/events/eVODEvent"
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/utils"
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+//VODService play flv files in Dir
+type VODService struct {
+	mutexSessions sync.RWMutex
+	sessions      map[string]*vodSession
+	mutexIndexes  sync.Mutex
+	indexes       map[string]*fileIndex
+}
+
+//VODConfig config
+type VODConfig struct {
+	Dir string `json:"Dir"`
+	App string `json:"App"`
+}
+
+var service *VODService
+
+//serviceConfig *VODConfig,dir and app are looked up per play,a reload swaps it
+var serviceConfig atomic.Value
+
+//config current config,do not modify it
+func config() *VODConfig {
+	cfg, _ := serviceConfig.Load().(*VODConfig)
+	if nil == cfg {
+		return &VODConfig{}
+	}
+	return cfg
+}
+
+//Init service from config file
+func (vodService *VODService) Init(msg *wssapi.Msg) (err error) {
+	defer func() {
+		if nil != err {
+			logger.LOGE(err.Error())
+		}
+	}()
+	if nil == msg || nil == msg.Param1 {
+		err = errors.New("invalid param")
+		return
+	}
+	fileName := msg.Param1.(string)
+	cfg, err := vodService.loadConfigFile(fileName)
+	if err != nil {
+		return
+	}
+	serviceConfig.Store(cfg)
+	vodService.sessions = make(map[string]*vodSession)
+	vodService.indexes = make(map[string]*fileIndex)
+	service = vodService
+	return
+}
+
+//loadConfigFile read a new config,it is not used until stored
+func (vodService *VODService) loadConfigFile(fileName string) (cfg *VODConfig, err error) {
+	buf, err := utils.ReadFileAll(fileName)
+	if err != nil {
+		return
+	}
+	cfg = &VODConfig{}
+	err = json.Unmarshal(buf, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Dir) == 0 {
+		cfg.Dir = "record"
+	}
+	if len(cfg.App) == 0 {
+		cfg.App = "vod"
+	}
+	cfg.App = strings.Trim(cfg.App, "/")
+	return
+}
+
+//Start nothing to do
+func (vodService *VODService) Start(msg *wssapi.Msg) (err error) {
+	return
+}
+
+//Stop all sessions
+func (vodService *VODService) Stop(msg *wssapi.Msg) (err error) {
+	vodService.mutexSessions.Lock()
+	defer vodService.mutexSessions.Unlock()
+	for k, v := range vodService.sessions {
+		v.Stop(nil)
+		delete(vodService.sessions, k)
+	}
+	return
+}
+
+//GetType of service
+func (vodService *VODService) GetType() string {
+	return wssapi.OBJVODServer
+}
+
+//HandleTask add/del sink and control
+func (vodService *VODService) HandleTask(task wssapi.Task) (err error) {
+	if task.Receiver() != vodService.GetType() {
+		return errors.New("not my task")
+	}
+	switch task.Type() {
+	case eVODEvent.AddVODSink:
+		taskAdd, ok := task.(*eVODEvent.EveAddVODSink)
+		if false == ok {
+			return errors.New("invalid param to add vod sink")
+		}
+		return vodService.addSession(taskAdd)
+	case eVODEvent.DelVODSink:
+		taskDel, ok := task.(*eVODEvent.EveDelVODSink)
+		if false == ok {
+			return errors.New("invalid param to del vod sink")
+		}
+		vodService.mutexSessions.Lock()
+		session, exist := vodService.sessions[taskDel.SinkId]
+		if exist && session.streamName == taskDel.StreamName {
+			delete(vodService.sessions, taskDel.SinkId)
+		}
+		vodService.mutexSessions.Unlock()
+		if false == exist {
+			return errors.New("vod sink not found:" + taskDel.SinkId)
+		}
+		session.Stop(nil)
+		return
+	case eVODEvent.VODControl:
+		taskCtrl, ok := task.(*eVODEvent.EveVODControl)
+		if false == ok {
+			return errors.New("invalid param to control vod")
+		}
+		vodService.mutexSessions.RLock()
+		session, exist := vodService.sessions[taskCtrl.SinkId]
+		vodService.mutexSessions.RUnlock()
+		if false == exist || session.streamName != taskCtrl.StreamName {
+			return errors.New("not a vod sink:" + taskCtrl.StreamName)
+		}
+		return session.control(taskCtrl)
+	case eVODEvent.GetVODList:
+		taskList, ok := task.(*eVODEvent.EveGetVODList)
+		if false == ok {
+			return errors.New("invalid param to get vod list")
+		}
+		taskList.Files, err = vodService.listFiles()
+		return
+	default:
+		return fmt.Errorf("task %s not prossed", task.Type())
+	}
+}
+
+//ProcessMessage reload config,playing sessions are kept
+func (vodService *VODService) ProcessMessage(msg *wssapi.Msg) (err error) {
+	switch msg.Type {
+	case wssapi.MsgReloadConfig:
+		var cfg *VODConfig
+		cfg, err = vodService.loadConfigFile(msg.Param1.(string))
+		if err == nil {
+			serviceConfig.Store(cfg)
+		}
+	}
+	return
+}
+
+//fileName app/sub/name -> Dir/sub/name.flv,不在点播app下或者文件不存在返回空
+func (vodService *VODService) fileName(streamName string) string {
+	if false == strings.HasPrefix(streamName, config().App+"/") {
+		return ""
+	}
+	name := strings.TrimPrefix(streamName, config().App+"/")
+	if false == strings.HasSuffix(name, ".flv") {
+		name += ".flv"
+	}
+	//不允许跳出点播目录
+	name = filepath.Join("/", filepath.FromSlash(name))
+	fileName := filepath.Join(config().Dir, name)
+	info, err := os.Stat(fileName)
+	if err != nil || info.IsDir() {
+		return ""
+	}
+	return fileName
+}
+
+func (vodService *VODService) addSession(taskAdd *eVODEvent.EveAddVODSink) (err error) {
+	fileName := vodService.fileName(taskAdd.StreamName)
+	if len(fileName) == 0 {
+		return errors.New("vod file not found:" + taskAdd.StreamName)
+	}
+	index, err := vodService.getIndex(fileName)
+	if err != nil {
+		return
+	}
+	session := &vodSession{}
+	msg := &wssapi.Msg{Param1: taskAdd, Param2: index}
+	err = session.Init(msg)
+	if err != nil {
+		return
+	}
+	vodService.mutexSessions.Lock()
+	old, exist := vodService.sessions[taskAdd.SinkId]
+	vodService.sessions[taskAdd.SinkId] = session
+	vodService.mutexSessions.Unlock()
+	if exist {
+		old.Stop(nil)
+	}
+	taskAdd.Sinker.ProcessMessage(&wssapi.Msg{Type: wssapi.MsgGetSourceNotify})
+	logger.LOGT("vod play:" + fileName)
+	return session.Start(nil)
+}
+
+//delSession return false if the session removed already
+func (vodService *VODService) delSession(sinkID string, session *vodSession) (removed bool) {
+	vodService.mutexSessions.Lock()
+	defer vodService.mutexSessions.Unlock()
+	if cur, exist := vodService.sessions[sinkID]; exist && cur == session {
+		delete(vodService.sessions, sinkID)
+		removed = true
+	}
+	return
+}
+
+//getIndex 文件没有变化时复用关键帧索引
+func (vodService *VODService) getIndex(fileName string) (index *fileIndex, err error) {
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return
+	}
+	vodService.mutexIndexes.Lock()
+	defer vodService.mutexIndexes.Unlock()
+	index, exist := vodService.indexes[fileName]
+	if exist && index.size == info.Size() && index.modTime.Equal(info.ModTime()) {
+		return
+	}
+	index, err = createFileIndex(fileName)
+	if err != nil {
+		return
+	}
+	index.size = info.Size()
+	index.modTime = info.ModTime()
+	vodService.indexes[fileName] = index
+	return
+}
+
+func (vodService *VODService) listFiles() (files *list.List, err error) {
+	files = list.New()
+	root := filepath.Clean(config().Dir)
+	err = filepath.Walk(root, func(fileName string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() || false == strings.HasSuffix(info.Name(), ".flv") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, fileName)
+		if err != nil {
+			return nil
+		}
+		vodInfo := &eVODEvent.VODInfo{}
+		vodInfo.StreamName = config().App + "/" + strings.TrimSuffix(filepath.ToSlash(rel), ".flv")
+		vodInfo.Size = info.Size()
+		files.PushBack(vodInfo)
+		return nil
+	})
+	return
+}
@@ -0,0 +1,111 @@
+package vod
+
+import (
+	"io"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+)
+
+//audio only 文件每秒一个索引点
+const audioIndexInterval = 1000
+
+type indexPoint struct {
+	timestamp uint32
+	offset    int64
+}
+
+//fileIndex 关键帧位置和音视频头
+type fileIndex struct {
+	fileName    string
+	size        int64
+	modTime     time.Time
+	duration    uint32
+	metadata    *flv.FlvTag
+	audioHeader *flv.FlvTag
+	videoHeader *flv.FlvTag
+	points      []indexPoint
+}
+
+func createFileIndex(fileName string) (index *fileIndex, err error) {
+	reader := &flv.FlvFileReader{}
+	defer reader.Close()
+	err = reader.Init(fileName)
+	if err != nil {
+		return
+	}
+	index = &fileIndex{fileName: fileName}
+	audioPoints := make([]indexPoint, 0)
+	for {
+		offset := reader.Offset()
+		tag, errRead := reader.GetNextTag()
+		if errRead != nil {
+			if errRead != io.EOF && errRead != io.ErrUnexpectedEOF {
+				err = errRead
+				return
+			}
+			//录制中的文件可能不完整
+			break
+		}
+		if tag.Timestamp > index.duration {
+			index.duration = tag.Timestamp
+		}
+		switch tag.TagType {
+		case flv.FlvTagScriptData:
+			if nil == index.metadata {
+				index.metadata = tag
+			}
+		case flv.FlvTagAudio:
+			if len(tag.Data) < 2 {
+				continue
+			}
+			if flv.IsAudioSequenceHeader(tag) {
+				if nil == index.audioHeader {
+					index.audioHeader = tag
+				}
+				continue
+			}
+			if len(audioPoints) == 0 || tag.Timestamp-audioPoints[len(audioPoints)-1].timestamp >= audioIndexInterval {
+				audioPoints = append(audioPoints, indexPoint{timestamp: tag.Timestamp, offset: offset})
+			}
+		case flv.FlvTagVideo:
+			if len(tag.Data) < 2 {
+				continue
+			}
+			if flv.IsVideoSequenceHeader(tag) {
+				if nil == index.videoHeader {
+					index.videoHeader = tag
+				}
+				continue
+			}
+			if flv.IsKeyFrame(tag) {
+				index.points = append(index.points, indexPoint{timestamp: tag.Timestamp, offset: offset})
+			}
+		}
+	}
+	if nil == index.videoHeader {
+		index.points = audioPoints
+	}
+	return
+}
+
+//nearest 离目标时间最近的关键帧
+func (index *fileIndex) nearest(timestamp uint32) (point indexPoint, ok bool) {
+	if len(index.points) == 0 {
+		return
+	}
+	point = index.points[0]
+	for _, v := range index.points {
+		if absDiff(v.timestamp, timestamp) < absDiff(point.timestamp, timestamp) {
+			point = v
+		}
+	}
+	return point, true
+}
+
+func absDiff(a, b uint32) uint32 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
@@ -0,0 +1,251 @@
+package vod
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/events/eVODEvent"
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/webhook"
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+type vodCtrl struct {
+	action     string
+	positionMs int64
+	chRet      chan int64
+}
+
+//vodSession one sink play one file with real-time pacing
+type vodSession struct {
+	streamName string
+	sinkID     string
+	sinker     wssapi.MsgHandler
+	index      *fileIndex
+	reader     *flv.FlvFileReader
+	startMs    int64
+	paused     bool
+	baseSet    bool
+	baseTime   uint32
+	baseWall   time.Time
+	chCtrl     chan *vodCtrl
+	chQuit     chan bool
+	chDone     chan bool //closed when threadPlay exits
+	mutexQuit  sync.Mutex
+	quit       bool
+}
+
+//Init open file
+func (session *vodSession) Init(msg *wssapi.Msg) (err error) {
+	taskAdd := msg.Param1.(*eVODEvent.EveAddVODSink)
+	session.index = msg.Param2.(*fileIndex)
+	session.streamName = taskAdd.StreamName
+	session.sinkID = taskAdd.SinkId
+	session.sinker = taskAdd.Sinker
+	session.startMs = taskAdd.StartMs
+	session.reader = &flv.FlvFileReader{}
+	err = session.reader.Init(session.index.fileName)
+	if err != nil {
+		session.reader.Close()
+		return
+	}
+	session.chCtrl = make(chan *vodCtrl)
+	session.chQuit = make(chan bool)
+	session.chDone = make(chan bool)
+	return
+}
+
+//Start play thread
+func (session *vodSession) Start(msg *wssapi.Msg) (err error) {
+	go session.threadPlay()
+	return
+}
+
+//Stop play thread
+func (session *vodSession) Stop(msg *wssapi.Msg) (err error) {
+	session.mutexQuit.Lock()
+	defer session.mutexQuit.Unlock()
+	if false == session.quit {
+		session.quit = true
+		close(session.chQuit)
+	}
+	return
+}
+
+//GetType of session
+func (session *vodSession) GetType() string {
+	return "vodSession"
+}
+
+//HandleTask not implemention
+func (session *vodSession) HandleTask(task wssapi.Task) (err error) {
+	return
+}
+
+//ProcessMessage not implemention
+func (session *vodSession) ProcessMessage(msg *wssapi.Msg) (err error) {
+	return
+}
+
+//control 由播放线程处理,seek 返回实际的关键帧时间
+func (session *vodSession) control(taskCtrl *eVODEvent.EveVODControl) (err error) {
+	switch taskCtrl.Action {
+	case eVODEvent.VODPause, eVODEvent.VODResume, eVODEvent.VODSeek:
+	default:
+		return errors.New("unknown vod action:" + taskCtrl.Action)
+	}
+	ctrl := &vodCtrl{action: taskCtrl.Action, positionMs: taskCtrl.PositionMs, chRet: make(chan int64, 1)}
+	select {
+	case session.chCtrl <- ctrl:
+	case <-session.chQuit:
+		return errors.New("vod session closed")
+	case <-session.chDone:
+		return errors.New("vod session closed")
+	}
+	position, ok := <-ctrl.chRet
+	if false == ok || position < 0 {
+		return errors.New("vod " + taskCtrl.Action + " failed")
+	}
+	taskCtrl.PositionMs = position
+	return
+}
+
+func (session *vodSession) threadPlay() {
+	defer func() {
+		//control 不再等待播放线程
+		close(session.chDone)
+		session.reader.Close()
+		//sink 主动删除时不再通知
+		select {
+		case <-session.chQuit:
+		default:
+			session.sinker.ProcessMessage(&wssapi.Msg{Type: wssapi.MsgPlayStop})
+		}
+		//sink 删除时由streamer通知,这里只通知自己结束的
+		if service.delSession(session.sinkID, session) {
+			webhook.Notify(&webhook.Event{Event: webhook.EventStop, StreamName: session.streamName, ClientID: session.sinkID})
+		}
+		logger.LOGT("vod play end:" + session.streamName)
+	}()
+	session.sinker.ProcessMessage(&wssapi.Msg{Type: wssapi.MsgPlayStart})
+	if session.startMs > 0 {
+		if _, err := session.seek(session.startMs, false); err != nil {
+			logger.LOGE(err.Error())
+			return
+		}
+	}
+	var pending *flv.FlvTag
+	for {
+		if session.paused {
+			select {
+			case ctrl := <-session.chCtrl:
+				if session.handleCtrl(ctrl) {
+					pending = nil
+				}
+			case <-session.chQuit:
+				return
+			}
+			continue
+		}
+		if nil == pending {
+			tag, err := session.reader.GetNextTag()
+			if err != nil {
+				//文件结束
+				return
+			}
+			pending = tag
+		}
+		wait := session.waitTime(pending)
+		if wait > 0 {
+			select {
+			case ctrl := <-session.chCtrl:
+				if session.handleCtrl(ctrl) {
+					pending = nil
+				}
+				continue
+			case <-session.chQuit:
+				return
+			case <-time.After(wait):
+			}
+		}
+		err := session.sinker.ProcessMessage(&wssapi.Msg{Type: wssapi.MsgFlvTag, Param1: pending})
+		if err != nil {
+			logger.LOGE("vod send failed:" + err.Error())
+			return
+		}
+		pending = nil
+	}
+}
+
+//waitTime 按文件时间戳实时发送
+func (session *vodSession) waitTime(tag *flv.FlvTag) time.Duration {
+	if tag.TagType == flv.FlvTagScriptData {
+		return 0
+	}
+	if false == session.baseSet {
+		session.baseSet = true
+		session.baseTime = tag.Timestamp
+		session.baseWall = time.Now()
+		return 0
+	}
+	if tag.Timestamp <= session.baseTime {
+		return 0
+	}
+	due := time.Duration(tag.Timestamp-session.baseTime) * time.Millisecond
+	return due - time.Since(session.baseWall)
+}
+
+//handleCtrl 返回true表示读位置变化
+func (session *vodSession) handleCtrl(ctrl *vodCtrl) (seeked bool) {
+	defer close(ctrl.chRet)
+	switch ctrl.action {
+	case eVODEvent.VODPause:
+		session.paused = true
+		ctrl.chRet <- 0
+	case eVODEvent.VODResume:
+		session.paused = false
+		//重新计时
+		session.baseSet = false
+		ctrl.chRet <- 0
+	case eVODEvent.VODSeek:
+		position, err := session.seek(ctrl.positionMs, true)
+		if err != nil {
+			logger.LOGE(err.Error())
+			ctrl.chRet <- -1
+			return
+		}
+		ctrl.chRet <- position
+		return true
+	}
+	return
+}
+
+//seek 跳到最近的关键帧,播放器重新开始并先收到音视频头
+func (session *vodSession) seek(positionMs int64, restart bool) (position int64, err error) {
+	if positionMs < 0 {
+		positionMs = 0
+	}
+	point, ok := session.index.nearest(uint32(positionMs))
+	if false == ok {
+		return -1, errors.New("no keyframe to seek in " + session.streamName)
+	}
+	err = session.reader.SeekTag(point.offset)
+	if err != nil {
+		return -1, err
+	}
+	logger.LOGT("vod seek " + session.streamName + " to " + strconv.Itoa(int(point.timestamp)))
+	if restart {
+		session.sinker.ProcessMessage(&wssapi.Msg{Type: wssapi.MsgPlayStop})
+		session.sinker.ProcessMessage(&wssapi.Msg{Type: wssapi.MsgPlayStart})
+	}
+	for _, header := range []*flv.FlvTag{session.index.metadata, session.index.audioHeader, session.index.videoHeader} {
+		if nil != header {
+			session.sinker.ProcessMessage(&wssapi.Msg{Type: wssapi.MsgFlvTag, Param1: header})
+		}
+	}
+	session.baseSet = false
+	return int64(point.timestamp), nil
+}
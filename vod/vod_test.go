@@ -0,0 +1,173 @@
+package vod
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/events/eVODEvent"
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+// vodSink timestamps of media tags,-1 for play stop
+type vodSink struct {
+	events chan int64
+}
+
+func (sink *vodSink) Init(msg *wssapi.Msg) error        { return nil }
+func (sink *vodSink) Start(msg *wssapi.Msg) error       { return nil }
+func (sink *vodSink) Stop(msg *wssapi.Msg) error        { return nil }
+func (sink *vodSink) GetType() string                   { return "vodSink" }
+func (sink *vodSink) HandleTask(task wssapi.Task) error { return nil }
+
+func (sink *vodSink) ProcessMessage(msg *wssapi.Msg) error {
+	switch msg.Type {
+	case wssapi.MsgPlayStop:
+		sink.events <- -1
+	case wssapi.MsgFlvTag:
+		tag := msg.Param1.(*flv.FlvTag)
+		if false == flv.IsVideoSequenceHeader(tag) {
+			sink.events <- int64(tag.Timestamp)
+		}
+	}
+	return nil
+}
+
+// next media tag or play stop
+func (sink *vodSink) next(t *testing.T) int64 {
+	select {
+	case ts := <-sink.events:
+		return ts
+	case <-time.After(3 * time.Second):
+		t.Fatal("vod sink got nothing")
+	}
+	return 0
+}
+
+// writeVODFile 2 seconds of 25 fps video,keyframe every 400ms
+func writeVODFile(t *testing.T) string {
+	data := flv.FlvFileHeader(false, true)
+	data = append(data, (&flv.FlvTag{TagType: flv.FlvTagVideo, Data: []byte{0x17, 0, 0, 0, 0, 1, 0x42, 0, 0x1f}}).ToBytes()...)
+	for ts := uint32(0); ts <= 2000; ts += 40 {
+		frameType := byte(0x27)
+		if ts%400 == 0 {
+			frameType = 0x17
+		}
+		data = append(data, (&flv.FlvTag{TagType: flv.FlvTagVideo, Timestamp: ts, Data: []byte{frameType, 1, 0, 0, 0, 0xaa}}).ToBytes()...)
+	}
+	fileName := filepath.Join(t.TempDir(), "a.flv")
+	if err := ioutil.WriteFile(fileName, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestFileIndexNearest(t *testing.T) {
+	index, err := createFileIndex(writeVODFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.duration != 2000 || nil == index.videoHeader || len(index.points) != 6 {
+		t.Fatalf("index %d %d", index.duration, len(index.points))
+	}
+	for _, test := range []struct {
+		position uint32
+		want     uint32
+	}{
+		{0, 0},
+		{190, 0},
+		{210, 400},
+		{1750, 1600},
+		{9999, 2000},
+	} {
+		point, ok := index.nearest(test.position)
+		if false == ok || point.timestamp != test.want {
+			t.Errorf("nearest %d got %d", test.position, point.timestamp)
+		}
+	}
+	if _, ok := (&fileIndex{}).nearest(0); ok {
+		t.Error("keyframe in empty index")
+	}
+}
+
+func TestSessionControl(t *testing.T) {
+	service = &VODService{sessions: make(map[string]*vodSession), indexes: make(map[string]*fileIndex)}
+	index, err := service.getIndex(writeVODFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &vodSink{events: make(chan int64, 1024)}
+	taskAdd := &eVODEvent.EveAddVODSink{StreamName: "vod/a", SinkId: "s1", Sinker: sink}
+	session := &vodSession{}
+	if err = session.Init(&wssapi.Msg{Param1: taskAdd, Param2: index}); err != nil {
+		t.Fatal(err)
+	}
+	service.sessions["s1"] = session
+	session.Start(nil)
+	control := func(action string, positionMs int64) (int64, error) {
+		taskCtrl := &eVODEvent.EveVODControl{StreamName: "vod/a", SinkId: "s1", Action: action, PositionMs: positionMs}
+		err := session.control(taskCtrl)
+		return taskCtrl.PositionMs, err
+	}
+
+	if ts := sink.next(t); ts != 0 {
+		t.Fatalf("first tag at %d", ts)
+	}
+	if _, err = control("rewind", 0); err == nil {
+		t.Fatal("unknown action accepted")
+	}
+	if _, err = control(eVODEvent.VODPause, 0); err != nil {
+		t.Fatal(err)
+	}
+	for len(sink.events) > 0 {
+		<-sink.events
+	}
+	time.Sleep(200 * time.Millisecond)
+	if len(sink.events) != 0 {
+		t.Fatal("tags sent while paused")
+	}
+	//seek to the nearest keyframe,the player restarts
+	position, err := control(eVODEvent.VODSeek, 1500)
+	if err != nil || position != 1600 {
+		t.Fatalf("seek to %d %v", position, err)
+	}
+	if ts := sink.next(t); ts != -1 {
+		t.Fatalf("no restart after seek:%d", ts)
+	}
+	if _, err = control(eVODEvent.VODResume, 0); err != nil {
+		t.Fatal(err)
+	}
+	if ts := sink.next(t); ts != 1600 {
+		t.Fatalf("resumed at %d", ts)
+	}
+	//end of file stops the player and the play thread
+	for ts := sink.next(t); ts != -1; ts = sink.next(t) {
+	}
+	chErr := make(chan error, 1)
+	go func() {
+		_, err := control(eVODEvent.VODPause, 0)
+		chErr <- err
+	}()
+	select {
+	case err = <-chErr:
+		if err == nil {
+			t.Fatal("control after the play thread exited")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("control blocked after the play thread exited")
+	}
+	for i := 0; ; i++ {
+		service.mutexSessions.RLock()
+		count := len(service.sessions)
+		service.mutexSessions.RUnlock()
+		if count == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("session not removed at end of file")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,251 @@
+//Package webhook post stream lifecycle events as json to our own services,
+//every url has its own queue and goroutine so the caller never blocks
+//and a slow or failing hook does not delay the others
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/utils"
+)
+
+//events
+const (
+	EventPublish        = "on_publish"
+	EventUnpublish      = "on_unpublish"
+	EventPlay           = "on_play"
+	EventStop           = "on_stop"
+	EventRecordDone     = "on_record_done"
+	EventUpstreamFailed = "on_upstream_failed"
+)
+
+const (
+	defaultQueueSize     = 1024
+	defaultRetries       = 3
+	defaultRetryInterval = time.Second
+	defaultTimeout       = 3 * time.Second
+	//flushTimeout wait pending events when stop
+	flushTimeout = 5 * time.Second
+)
+
+//Event body posted to the hooks
+type Event struct {
+	Event      string `json:"event"`
+	StreamName string `json:"stream"`
+	ClientID   string `json:"client_id,omitempty"`
+	RemoteAddr string `json:"addr,omitempty"`
+	File       string `json:"file,omitempty"`
+	FileSize   int64  `json:"file_size,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	Time       int64  `json:"time"`
+}
+
+//Config of webhook,empty Events means all events
+type Config struct {
+	URLs            []string `json:"URLs"`
+	Events          []string `json:"Events"`
+	QueueSize       int      `json:"QueueSize"`
+	Retries         int      `json:"Retries"`
+	RetryIntervalMs int      `json:"RetryIntervalMs"`
+	TimeoutSec      int      `json:"TimeoutSec"`
+}
+
+//dispatcher one config,replaced on reload
+type dispatcher struct {
+	events        map[string]bool
+	retries       int
+	retryInterval time.Duration
+	client        *http.Client
+	targets       []*target
+}
+
+//target one url,events are posted in order with retries
+type target struct {
+	url      string
+	chEvents chan *Event
+	chDone   chan bool
+}
+
+var (
+	mutexDispatcher sync.RWMutex
+	current         *dispatcher
+)
+
+//Init load config file and start sending,empty file name disable webhook
+func Init(fileName string) (err error) {
+	var disp *dispatcher
+	if len(fileName) > 0 {
+		cfg := &Config{}
+		var buf []byte
+		buf, err = utils.ReadFileAll(fileName)
+		if err != nil {
+			return
+		}
+		err = json.Unmarshal(buf, cfg)
+		if err != nil {
+			return
+		}
+		disp, err = newDispatcher(cfg)
+		if err != nil {
+			return
+		}
+	}
+	mutexDispatcher.Lock()
+	old := current
+	current = disp
+	if nil != old {
+		old.close()
+	}
+	mutexDispatcher.Unlock()
+	if nil != disp {
+		disp.start()
+	}
+	if nil != old {
+		old.wait()
+	}
+	return
+}
+
+//Stop send pending events and stop
+func Stop() {
+	mutexDispatcher.Lock()
+	old := current
+	current = nil
+	if nil != old {
+		old.close()
+	}
+	mutexDispatcher.Unlock()
+	if nil != old {
+		old.wait()
+	}
+}
+
+//Notify queue the event to every url,dropped for the urls whose queue is full
+func Notify(evt *Event) {
+	mutexDispatcher.RLock()
+	defer mutexDispatcher.RUnlock()
+	if nil == current || false == current.events[evt.Event] {
+		return
+	}
+	if 0 == evt.Time {
+		evt.Time = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+	for _, target := range current.targets {
+		select {
+		case target.chEvents <- evt:
+		default:
+			logger.LOGW("webhook queue of " + target.url + " full,drop " + evt.Event + " " + evt.StreamName)
+		}
+	}
+}
+
+func newDispatcher(cfg *Config) (disp *dispatcher, err error) {
+	if len(cfg.URLs) == 0 {
+		return nil, errors.New("webhook has no url")
+	}
+	disp = &dispatcher{events: make(map[string]bool),
+		retries:       defaultRetries,
+		retryInterval: defaultRetryInterval,
+		client:        &http.Client{Timeout: defaultTimeout}}
+	events := cfg.Events
+	if len(events) == 0 {
+		events = []string{EventPublish, EventUnpublish, EventPlay, EventStop, EventRecordDone, EventUpstreamFailed}
+	}
+	for _, v := range events {
+		disp.events[v] = true
+	}
+	if cfg.Retries > 0 {
+		disp.retries = cfg.Retries
+	}
+	if cfg.RetryIntervalMs > 0 {
+		disp.retryInterval = time.Duration(cfg.RetryIntervalMs) * time.Millisecond
+	}
+	if cfg.TimeoutSec > 0 {
+		disp.client.Timeout = time.Duration(cfg.TimeoutSec) * time.Second
+	}
+	queueSize := defaultQueueSize
+	if cfg.QueueSize > 0 {
+		queueSize = cfg.QueueSize
+	}
+	for _, url := range cfg.URLs {
+		disp.targets = append(disp.targets, &target{url: url,
+			chEvents: make(chan *Event, queueSize),
+			chDone:   make(chan bool)})
+	}
+	return
+}
+
+func (disp *dispatcher) start() {
+	for _, target := range disp.targets {
+		go disp.threadSend(target)
+	}
+}
+
+//close no more events,the queued ones are still sent
+func (disp *dispatcher) close() {
+	for _, target := range disp.targets {
+		close(target.chEvents)
+	}
+}
+
+func (disp *dispatcher) threadSend(target *target) {
+	defer close(target.chDone)
+	for evt := range target.chEvents {
+		body, err := json.Marshal(evt)
+		if err != nil {
+			logger.LOGE(err.Error())
+			continue
+		}
+		disp.post(target.url, body, evt)
+	}
+}
+
+//post retry with growing interval,give up after retries
+func (disp *dispatcher) post(url string, body []byte, evt *Event) {
+	var err error
+	for i := 0; i <= disp.retries; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(i) * disp.retryInterval)
+		}
+		err = disp.postOnce(url, body)
+		if err == nil {
+			return
+		}
+	}
+	logger.LOGE("webhook " + evt.Event + " " + evt.StreamName + " to " + url + " failed:" + err.Error())
+}
+
+func (disp *dispatcher) postOnce(url string, body []byte) (err error) {
+	resp, err := disp.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("status " + strconv.Itoa(resp.StatusCode))
+	}
+	return
+}
+
+//wait all urls,flushTimeout in total
+func (disp *dispatcher) wait() {
+	timeout := time.After(flushTimeout)
+	for _, target := range disp.targets {
+		select {
+		case <-target.chDone:
+		case <-timeout:
+			logger.LOGW("webhook stop with events not sent")
+			return
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+//hookServer fail the first failures posts,received events are kept
+type hookServer struct {
+	mutex    sync.Mutex
+	failures int
+	posts    int
+	events   []*Event
+}
+
+func (hook *hookServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	hook.mutex.Lock()
+	defer hook.mutex.Unlock()
+	hook.posts++
+	if hook.posts <= hook.failures {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	evt := &Event{}
+	json.NewDecoder(req.Body).Decode(evt)
+	hook.events = append(hook.events, evt)
+}
+
+func TestQueueOverflow(t *testing.T) {
+	disp, err := newDispatcher(&Config{URLs: []string{"http://127.0.0.1:1"}, Events: []string{EventPublish}, QueueSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//no sending goroutine,the queue is filled
+	mutexDispatcher.Lock()
+	current = disp
+	mutexDispatcher.Unlock()
+	defer func() {
+		mutexDispatcher.Lock()
+		current = nil
+		mutexDispatcher.Unlock()
+	}()
+	for _, test := range []struct {
+		event  string
+		queued int
+	}{
+		{EventPublish, 1},
+		{EventPlay, 1}, //not configured
+		{EventPublish, 2},
+		{EventPublish, 2}, //dropped
+	} {
+		Notify(&Event{Event: test.event, StreamName: "live/queue"})
+		if len(disp.targets[0].chEvents) != test.queued {
+			t.Fatalf("%s:queued %d,want %d", test.event, len(disp.targets[0].chEvents), test.queued)
+		}
+	}
+	if evt := <-disp.targets[0].chEvents; evt.Time == 0 {
+		t.Error("event time not set")
+	}
+	if _, err = newDispatcher(&Config{}); err == nil {
+		t.Error("dispatcher without url")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		failures int
+		retries  int
+		posts    int
+		received int
+	}{
+		{"first ok", 0, 2, 1, 1},
+		{"ok on retry", 2, 2, 3, 1},
+		{"give up", 5, 2, 3, 0},
+	} {
+		hook := &hookServer{failures: test.failures}
+		server := httptest.NewServer(hook)
+		disp, err := newDispatcher(&Config{URLs: []string{server.URL}, Retries: test.retries, RetryIntervalMs: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		disp.post(server.URL, []byte(`{"event":"on_play"}`), &Event{Event: EventPlay})
+		server.Close()
+		if hook.posts != test.posts || len(hook.events) != test.received {
+			t.Errorf("%s:posts %d received %d", test.name, hook.posts, len(hook.events))
+		}
+	}
+}
+
+func TestInitAndStop(t *testing.T) {
+	hook := &hookServer{}
+	server := httptest.NewServer(hook)
+	defer server.Close()
+	cfg, _ := json.Marshal(&Config{URLs: []string{server.URL}, Events: []string{EventRecordDone}})
+	fileName := filepath.Join(t.TempDir(), "webhook.json")
+	if err := ioutil.WriteFile(fileName, cfg, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Init(fileName); err != nil {
+		t.Fatal(err)
+	}
+	Notify(&Event{Event: EventPublish, StreamName: "live/init"})
+	Notify(&Event{Event: EventRecordDone, StreamName: "live/init", File: "a.mp4", FileSize: 10})
+	//pending events are sent before stop returns
+	Stop()
+	Notify(&Event{Event: EventRecordDone, StreamName: "live/init"})
+	hook.mutex.Lock()
+	defer hook.mutex.Unlock()
+	if len(hook.events) != 1 || hook.events[0].File != "a.mp4" || hook.events[0].FileSize != 10 {
+		t.Fatalf("events %+v", hook.events)
+	}
+}
+
+func TestSlowHookNotBlocking(t *testing.T) {
+	release := make(chan bool)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	received := make(chan *Event, 4)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		evt := &Event{}
+		json.NewDecoder(req.Body).Decode(evt)
+		received <- evt
+	}))
+	defer fast.Close()
+	disp, err := newDispatcher(&Config{URLs: []string{slow.URL, fast.URL}, TimeoutSec: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutexDispatcher.Lock()
+	current = disp
+	mutexDispatcher.Unlock()
+	disp.start()
+	Notify(&Event{Event: EventPublish, StreamName: "live/a"})
+	Notify(&Event{Event: EventUnpublish, StreamName: "live/a"})
+	//the slow hook is still holding the first event
+	for _, want := range []string{EventPublish, EventUnpublish} {
+		select {
+		case evt := <-received:
+			if evt.Event != want {
+				t.Fatalf("got %s,want %s", evt.Event, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s not sent while another hook is slow", want)
+		}
+	}
+	close(release)
+	Stop()
+}
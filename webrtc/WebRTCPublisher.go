@@ -0,0 +1,252 @@
+package webrtc
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/events/eStreamerEvent"
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/mediatype/rtp"
+	"github.com/use-go/websocket-streamserver/utils"
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+const (
+	feedbackPeriod          = time.Second
+	pliMinInterval          = 500 * time.Millisecond
+	defaultKeyFrameInterval = 2 * time.Second
+)
+
+//rtpTrack one received media of the publisher
+type rtpTrack struct {
+	video        bool
+	localSSRC    uint32 //rtcp sender
+	remoteSSRC   uint32
+	jitter       *jitterBuffer
+	depacketizer *rtpDepacketizer
+}
+
+//WebRTCPublisher one whip session,srtp to flv tags of a source
+type WebRTCPublisher struct {
+	streamName       string
+	clientID         string
+	remoteAddr       net.Addr
+	peer             *webrtcPeer
+	answer           *sdpAnswer
+	keyFrameInterval time.Duration
+	mutexSource      sync.Mutex
+	source           wssapi.MsgHandler
+	srcID            int64
+	srcAdded         bool
+	mutexTracks      sync.Mutex
+	tracks           map[int]*rtpTrack //by payload type
+	lastPLI          time.Time
+	lastKeyRequest   time.Time
+	chQuit           chan bool
+	mutexQuit        sync.Mutex
+	quit             bool
+}
+
+//Init add self to streamer as source,Param1 stream name,Param2 remote address
+func (publisher *WebRTCPublisher) Init(msg *wssapi.Msg) (err error) {
+	var ok bool
+	publisher.streamName, ok = msg.Param1.(string)
+	if false == ok {
+		return errors.New("invalid param init webrtc publisher")
+	}
+	publisher.remoteAddr, _ = msg.Param2.(net.Addr)
+	publisher.clientID = utils.GenerateGUID()
+	publisher.chQuit = make(chan bool)
+	publisher.tracks = make(map[int]*rtpTrack)
+
+	taskAddSrc := &eStreamerEvent.EveAddSource{}
+	taskAddSrc.Producer = publisher
+	taskAddSrc.StreamName = publisher.streamName
+	taskAddSrc.RemoteIp = publisher.remoteAddr
+	err = wssapi.HandleTask(taskAddSrc)
+	if err != nil || nil == taskAddSrc.SrcObj {
+		return errors.New("add source failed:" + publisher.streamName)
+	}
+	publisher.mutexSource.Lock()
+	publisher.source = taskAddSrc.SrcObj
+	publisher.srcID = taskAddSrc.ID
+	publisher.srcAdded = true
+	publisher.mutexSource.Unlock()
+	return
+}
+
+//Start nothing to do
+func (publisher *WebRTCPublisher) Start(msg *wssapi.Msg) (err error) {
+	return
+}
+
+//Stop remove source from streamer
+func (publisher *WebRTCPublisher) Stop(msg *wssapi.Msg) (err error) {
+	publisher.close()
+	//删除源时streamer会回调ProcessMessage,不能持有锁
+	publisher.mutexSource.Lock()
+	srcAdded := publisher.srcAdded
+	publisher.srcAdded = false
+	publisher.source = nil
+	publisher.mutexSource.Unlock()
+	if srcAdded {
+		taskDelSrc := &eStreamerEvent.EveDelSource{}
+		taskDelSrc.StreamName = publisher.streamName
+		taskDelSrc.ID = publisher.srcID
+		wssapi.HandleTask(taskDelSrc)
+		logger.LOGT("del source:" + publisher.streamName)
+	}
+	return
+}
+
+//GetType of publisher
+func (publisher *WebRTCPublisher) GetType() string {
+	return "WebRTCPublisher"
+}
+
+//HandleTask not implemention
+func (publisher *WebRTCPublisher) HandleTask(task wssapi.Task) (err error) {
+	return
+}
+
+//ProcessMessage source closed by streamer
+func (publisher *WebRTCPublisher) ProcessMessage(msg *wssapi.Msg) (err error) {
+	switch msg.Type {
+	case wssapi.MsgSourceClosedForce:
+		logger.LOGT("whip source closed force:" + publisher.streamName)
+		publisher.mutexSource.Lock()
+		publisher.srcAdded = false
+		publisher.source = nil
+		publisher.mutexSource.Unlock()
+		publisher.close()
+	}
+	return
+}
+
+func (publisher *WebRTCPublisher) close() {
+	publisher.mutexQuit.Lock()
+	defer publisher.mutexQuit.Unlock()
+	if false == publisher.quit {
+		publisher.quit = true
+		close(publisher.chQuit)
+	}
+}
+
+//addTracks depacketizers for the negotiated payload types
+func (publisher *WebRTCPublisher) addTracks(startTime time.Time) {
+	if publisher.answer.videoPT >= 0 {
+		publisher.tracks[publisher.answer.videoPT] = &rtpTrack{video: true,
+			localSSRC:    publisher.answer.videoSSRC,
+			jitter:       newJitterBuffer(),
+			depacketizer: newH264Depacketizer(startTime)}
+	}
+	if publisher.answer.audioPT >= 0 {
+		publisher.tracks[publisher.answer.audioPT] = &rtpTrack{
+			localSSRC:    publisher.answer.audioSSRC,
+			jitter:       newJitterBuffer(),
+			depacketizer: newOpusDepacketizer(startTime, 2)}
+	}
+}
+
+//onRTP called by udp reader with decrypted rtp
+func (publisher *WebRTCPublisher) onRTP(data []byte) {
+	parsed, err := rtp.Parse(data)
+	if err != nil {
+		logger.LOGW(err.Error())
+		return
+	}
+	pkt := &rtpPacket{Packet: parsed, arrival: time.Now()}
+	publisher.mutexTracks.Lock()
+	defer publisher.mutexTracks.Unlock()
+	track, ok := publisher.tracks[int(pkt.PayloadType)]
+	if false == ok {
+		return
+	}
+	track.remoteSSRC = pkt.SSRC
+	for _, v := range track.jitter.push(pkt) {
+		tags, needKeyFrame := track.depacketizer.addPacket(v)
+		if needKeyFrame {
+			publisher.requestKeyFrame(track)
+		}
+		publisher.mutexSource.Lock()
+		for _, tag := range tags {
+			if nil == publisher.source || false == publisher.srcAdded {
+				break
+			}
+			err = publisher.source.ProcessMessage(&wssapi.Msg{Type: wssapi.MsgFlvTag, Param1: tag})
+			if err != nil {
+				logger.LOGE(err.Error())
+				break
+			}
+		}
+		publisher.mutexSource.Unlock()
+	}
+}
+
+//requestKeyFrame receiver report and pli in one compound rtcp,called with tracks locked
+func (publisher *WebRTCPublisher) requestKeyFrame(track *rtpTrack) {
+	if track.remoteSSRC == 0 || time.Since(publisher.lastPLI) < pliMinInterval {
+		return
+	}
+	publisher.lastPLI = time.Now()
+	pkt := track.jitter.receiverReport(track.localSSRC, track.remoteSSRC)
+	pkt = append(pkt, pictureLossIndication(track.localSSRC, track.remoteSSRC)...)
+	err := publisher.peer.writeRTCP(pkt)
+	if err != nil {
+		logger.LOGW("whip pli failed:" + err.Error())
+	}
+}
+
+//feedback receiver reports let the publisher estimate bandwidth,
+//periodic pli keeps the gop short for hls and late players
+func (publisher *WebRTCPublisher) feedback() {
+	publisher.mutexTracks.Lock()
+	defer publisher.mutexTracks.Unlock()
+	for _, track := range publisher.tracks {
+		if track.remoteSSRC == 0 {
+			continue
+		}
+		if track.video && time.Since(publisher.lastKeyRequest) >= publisher.keyFrameInterval {
+			publisher.lastKeyRequest = time.Now()
+			publisher.lastPLI = time.Time{}
+			publisher.requestKeyFrame(track)
+			continue
+		}
+		err := publisher.peer.writeRTCP(track.jitter.receiverReport(track.localSSRC, track.remoteSSRC))
+		if err != nil {
+			logger.LOGW("whip receiver report failed:" + err.Error())
+		}
+	}
+}
+
+//run until publisher gone or source closed
+func (publisher *WebRTCPublisher) run() {
+	select {
+	case <-publisher.peer.chConnected:
+	case <-publisher.peer.chQuit:
+		return
+	case <-publisher.chQuit:
+		return
+	}
+	logger.LOGT("whip publish start:" + publisher.streamName + " " + publisher.peer.RemoteAddr().String())
+	publisher.lastKeyRequest = time.Now()
+	ticker := time.NewTicker(feedbackPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if publisher.peer.consentExpired(consentTimeout) {
+				logger.LOGT("whip consent expired:" + publisher.clientID)
+				return
+			}
+			publisher.feedback()
+		case <-publisher.peer.chQuit:
+			logger.LOGT("whip publisher closed:" + publisher.clientID)
+			return
+		case <-publisher.chQuit:
+			return
+		}
+	}
+}
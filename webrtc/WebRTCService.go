@@ -0,0 +1,529 @@
+package webrtc
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/authorizer"
+	"github.com/use-go/websocket-streamserver/httpmux"
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/tlsconf"
+	"github.com/use-go/websocket-streamserver/utils"
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+//whep,draft-ietf-wish-whep
+//POST   http://addr/whep/app/streamName           offer in,answer out
+//DELETE http://addr/whep/app/streamName/sessionID end the session
+//whip,rfc 9725,same as whep on WHIPRoute,the stream is published
+
+const (
+	maxOfferSize  = 64 * 1024
+	udpBufferSize = 1600
+)
+
+//webrtcSession whep sink or whip publisher
+type webrtcSession interface {
+	close()
+}
+
+//WebRTCService whep and whip endpoint,ice lite on one udp port for all sessions
+type WebRTCService struct {
+	conn          *net.UDPConn
+	cert          tls.Certificate
+	fingerprint   string
+	candidates    []string
+	mutexSessions sync.RWMutex
+	sessions      map[string]webrtcSession
+	peers         map[string]*webrtcPeer //by local ice ufrag
+	peersAddr     map[string]*webrtcPeer //by remote address
+}
+
+//WebRTCConfig config
+type WebRTCConfig struct {
+	Port    int             `json:"Port"`
+	Route   string          `json:"Route"`
+	TLS     *tlsconf.Config `json:"TLS"`
+	UDPPort int             `json:"UDPPort"`
+	HostIPs []string        `json:"HostIPs"` //host candidates,all interface addresses if empty
+	//whip ingest,disabled if empty
+	WHIPRoute           string `json:"WHIPRoute,omitempty"`
+	KeyFrameIntervalSec int    `json:"KeyFrameIntervalSec,omitempty"` //pli period for whip publishers
+}
+
+var service *WebRTCService
+
+//serviceConfig *WebRTCConfig,routes are matched per request,a reload swaps it
+var serviceConfig atomic.Value
+
+//config current config,do not modify it
+func config() *WebRTCConfig {
+	cfg, _ := serviceConfig.Load().(*WebRTCConfig)
+	if nil == cfg {
+		return &WebRTCConfig{}
+	}
+	return cfg
+}
+
+//Init service from config file
+func (webrtcService *WebRTCService) Init(msg *wssapi.Msg) (err error) {
+	defer func() {
+		if nil != err {
+			logger.LOGE(err.Error())
+		}
+	}()
+	if nil == msg || nil == msg.Param1 {
+		err = errors.New("invalid param")
+		return
+	}
+	fileName := msg.Param1.(string)
+	cfg, err := webrtcService.loadConfigFile(fileName)
+	if err != nil {
+		return
+	}
+	err = webrtcService.listen(cfg.UDPPort, cfg.HostIPs)
+	if err != nil {
+		return
+	}
+	service = webrtcService
+
+	strPort := ":" + strconv.Itoa(cfg.Port)
+	httpmux.AddRoute(strPort, cfg.Route, webrtcService.ServeHTTP)
+	err = httpmux.AddTLSRoute(cfg.TLS, cfg.Route, webrtcService.ServeHTTP)
+	if err != nil {
+		logger.LOGE("webrtc tls disabled:" + err.Error())
+		err = nil
+	}
+	if len(cfg.WHIPRoute) > 0 {
+		httpmux.AddRoute(strPort, cfg.WHIPRoute, webrtcService.ServeWHIP)
+		err = httpmux.AddTLSRoute(cfg.TLS, cfg.WHIPRoute, webrtcService.ServeWHIP)
+		if err != nil {
+			logger.LOGE("whip tls disabled:" + err.Error())
+			err = nil
+		}
+	}
+
+	cfg.Route = strings.Trim(cfg.Route, "/")
+	cfg.WHIPRoute = strings.Trim(cfg.WHIPRoute, "/")
+	serviceConfig.Store(cfg)
+	return
+}
+
+//loadConfigFile read a new config,it is not used until stored
+func (webrtcService *WebRTCService) loadConfigFile(fileName string) (cfg *WebRTCConfig, err error) {
+	buf, err := utils.ReadFileAll(fileName)
+	if err != nil {
+		return nil, err
+	}
+	cfg = &WebRTCConfig{}
+	err = json.Unmarshal(buf, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+//listen udp port shared by all peers,dtls certificate for all sessions
+func (webrtcService *WebRTCService) listen(port int, hostIPs []string) (err error) {
+	webrtcService.sessions = make(map[string]webrtcSession)
+	webrtcService.peers = make(map[string]*webrtcPeer)
+	webrtcService.peersAddr = make(map[string]*webrtcPeer)
+	webrtcService.cert, err = generateCertificate()
+	if err != nil {
+		return
+	}
+	webrtcService.fingerprint = certFingerprint(webrtcService.cert.Certificate[0])
+	webrtcService.conn, err = net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return
+	}
+	port = webrtcService.conn.LocalAddr().(*net.UDPAddr).Port
+	if len(hostIPs) == 0 {
+		hostIPs = interfaceIPs()
+	}
+	for i, ip := range hostIPs {
+		webrtcService.candidates = append(webrtcService.candidates, hostCandidate(i+1, ip, port))
+	}
+	logger.LOGI("webrtc ice udp port " + strconv.Itoa(port) + " host " + strings.Join(hostIPs, ","))
+	go webrtcService.serveUDP(webrtcService.conn)
+	return
+}
+
+//interfaceIPs ipv4 addresses of up interfaces,loopback if nothing else
+func interfaceIPs() (ips []string) {
+	addrs, err := net.InterfaceAddrs()
+	if err == nil {
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if ok && false == ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+				ips = append(ips, ipNet.IP.String())
+			}
+		}
+	}
+	if len(ips) == 0 {
+		ips = []string{"127.0.0.1"}
+	}
+	return
+}
+
+//Start the http port is served by httpmux
+func (webrtcService *WebRTCService) Start(msg *wssapi.Msg) (err error) {
+	return
+}
+
+//Stop end all sessions and close udp port
+func (webrtcService *WebRTCService) Stop(msg *wssapi.Msg) (err error) {
+	webrtcService.mutexSessions.RLock()
+	for _, session := range webrtcService.sessions {
+		session.close()
+	}
+	webrtcService.mutexSessions.RUnlock()
+	if webrtcService.conn != nil {
+		webrtcService.conn.Close()
+	}
+	return
+}
+
+//GetType of service
+func (webrtcService *WebRTCService) GetType() string {
+	return wssapi.OBJWebRTCServer
+}
+
+//HandleTask not implemention
+func (webrtcService *WebRTCService) HandleTask(task wssapi.Task) (err error) {
+	return
+}
+
+//ProcessMessage reload config,only the pli period can change,used by new whip publishers
+func (webrtcService *WebRTCService) ProcessMessage(msg *wssapi.Msg) (err error) {
+	switch msg.Type {
+	case wssapi.MsgReloadConfig:
+		var cfg *WebRTCConfig
+		cfg, err = webrtcService.loadConfigFile(msg.Param1.(string))
+		if err != nil {
+			return
+		}
+		old := config()
+		if cfg.Port != old.Port || strings.Trim(cfg.Route, "/") != old.Route ||
+			strings.Trim(cfg.WHIPRoute, "/") != old.WHIPRoute || false == cfg.TLS.Equal(old.TLS) ||
+			cfg.UDPPort != old.UDPPort || false == reflect.DeepEqual(cfg.HostIPs, old.HostIPs) {
+			logger.LOGW("webrtc ports,routes,tls and host ips change need restart")
+		}
+		next := *old
+		next.KeyFrameIntervalSec = cfg.KeyFrameIntervalSec
+		serviceConfig.Store(&next)
+	}
+	return
+}
+
+//ServeHTTP whep resource,trickle ice by PATCH not supported as all candidates in answer
+func (webrtcService *WebRTCService) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	webrtcService.serveResource(w, req, webrtcService.servePlay)
+}
+
+//ServeWHIP whip resource,the same methods as whep
+func (webrtcService *WebRTCService) ServeWHIP(w http.ResponseWriter, req *http.Request) {
+	webrtcService.serveResource(w, req, webrtcService.servePublish)
+}
+
+func (webrtcService *WebRTCService) serveResource(w http.ResponseWriter, req *http.Request,
+	servePost func(w http.ResponseWriter, req *http.Request)) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	switch req.Method {
+	case http.MethodOptions:
+		w.Header().Set("Access-Control-Allow-Methods", "POST, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.WriteHeader(204)
+	case http.MethodPost:
+		servePost(w, req)
+	case http.MethodDelete:
+		webrtcService.serveDelete(w, req)
+	default:
+		w.Header().Set("Allow", "POST, DELETE, OPTIONS")
+		w.WriteHeader(405)
+	}
+}
+
+//servePlay one offer one sink
+func (webrtcService *WebRTCService) servePlay(w http.ResponseWriter, req *http.Request) {
+	streamName, err := parseURL(config().Route, req.URL.Path)
+	if err != nil {
+		logger.LOGE(err.Error())
+		w.WriteHeader(404)
+		return
+	}
+	errAuth := authorizer.CheckHTTP(authorizer.ProtocolWebRTC, streamName, req)
+	if errAuth != nil {
+		w.WriteHeader(authorizer.StatusCode(errAuth))
+		return
+	}
+	offer, ok := readOffer(w, req)
+	if false == ok {
+		return
+	}
+	sink := &WebRTCSink{}
+	err = sink.Init(&wssapi.Msg{Param1: streamName})
+	if err != nil {
+		logger.LOGE(err.Error())
+		w.WriteHeader(404)
+		return
+	}
+	if false == sink.waitSource() {
+		sink.Stop(nil)
+		w.WriteHeader(404)
+		return
+	}
+	answer := &sdpAnswer{iceUfrag: sink.clientID[:8],
+		icePwd:      sink.clientID[8:],
+		fingerprint: webrtcService.fingerprint,
+		candidates:  webrtcService.candidates,
+		videoSSRC:   randomSSRC(),
+		audioSSRC:   randomSSRC()}
+	answerSDP, err := buildAnswer(offer, answer)
+	if err != nil {
+		logger.LOGE("whep offer not acceptable:" + err.Error())
+		sink.Stop(nil)
+		w.WriteHeader(406)
+		return
+	}
+	sink.answer = answer
+	sink.peer = newPeer(webrtcService.conn, answer.iceUfrag, answer.icePwd, offer.iceUfrag, offer.fingerprint)
+	webrtcService.addSession(sink.clientID, sink, sink.peer)
+	sink.peer.start(webrtcService.cert)
+	go func() {
+		sink.run()
+		webrtcService.delSession(sink.clientID, sink.peer)
+		sink.Stop(nil)
+		logger.LOGT("whep session closed:" + sink.clientID)
+	}()
+
+	writeAnswer(w, req, sink.clientID, answerSDP)
+	logger.LOGT("whep session created:" + sink.clientID + " " + req.RemoteAddr)
+}
+
+//servePublish one offer one source,h264 and opus received
+func (webrtcService *WebRTCService) servePublish(w http.ResponseWriter, req *http.Request) {
+	streamName, err := parseURL(config().WHIPRoute, req.URL.Path)
+	if err != nil {
+		logger.LOGE(err.Error())
+		w.WriteHeader(404)
+		return
+	}
+	errAuth := authorizer.CheckHTTPPublish(authorizer.ProtocolWebRTC, streamName, req)
+	if errAuth != nil {
+		w.WriteHeader(authorizer.StatusCode(errAuth))
+		return
+	}
+	offer, ok := readOffer(w, req)
+	if false == ok {
+		return
+	}
+	publisher := &WebRTCPublisher{}
+	remoteAddr, _ := net.ResolveTCPAddr("tcp", req.RemoteAddr)
+	err = publisher.Init(&wssapi.Msg{Param1: streamName, Param2: remoteAddr})
+	if err != nil {
+		logger.LOGE(err.Error())
+		w.WriteHeader(403)
+		return
+	}
+	answer := &sdpAnswer{iceUfrag: publisher.clientID[:8],
+		icePwd:      publisher.clientID[8:],
+		fingerprint: webrtcService.fingerprint,
+		candidates:  webrtcService.candidates,
+		videoSSRC:   randomSSRC(),
+		audioSSRC:   randomSSRC(),
+		recvOnly:    true}
+	answerSDP, err := buildAnswer(offer, answer)
+	if err != nil {
+		logger.LOGE("whip offer not acceptable:" + err.Error())
+		publisher.Stop(nil)
+		w.WriteHeader(406)
+		return
+	}
+	publisher.answer = answer
+	publisher.keyFrameInterval = defaultKeyFrameInterval
+	if keyFrameIntervalSec := config().KeyFrameIntervalSec; keyFrameIntervalSec > 0 {
+		publisher.keyFrameInterval = time.Duration(keyFrameIntervalSec) * time.Second
+	}
+	publisher.addTracks(time.Now())
+	publisher.peer = newPeer(webrtcService.conn, answer.iceUfrag, answer.icePwd, offer.iceUfrag, offer.fingerprint)
+	publisher.peer.onRTP = publisher.onRTP
+	webrtcService.addSession(publisher.clientID, publisher, publisher.peer)
+	publisher.peer.start(webrtcService.cert)
+	go func() {
+		publisher.run()
+		webrtcService.delSession(publisher.clientID, publisher.peer)
+		publisher.Stop(nil)
+		logger.LOGT("whip session closed:" + publisher.clientID)
+	}()
+
+	writeAnswer(w, req, publisher.clientID, answerSDP)
+	logger.LOGT("whip session created:" + publisher.clientID + " " + req.RemoteAddr)
+}
+
+//readOffer the sdp body,error status written if not ok
+func readOffer(w http.ResponseWriter, req *http.Request) (offer *sdpOffer, ok bool) {
+	if false == strings.HasPrefix(req.Header.Get("Content-Type"), "application/sdp") {
+		w.WriteHeader(415)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxOfferSize))
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	offer, err = parseOffer(string(body))
+	if err != nil {
+		logger.LOGE("invalid webrtc offer:" + err.Error())
+		w.WriteHeader(400)
+		return
+	}
+	return offer, true
+}
+
+//writeAnswer 201 with the session resource
+func writeAnswer(w http.ResponseWriter, req *http.Request, sessionID, answerSDP string) {
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", strings.TrimSuffix(req.URL.Path, "/")+"/"+sessionID)
+	w.Header().Set("Access-Control-Expose-Headers", "Location")
+	w.WriteHeader(201)
+	w.Write([]byte(answerSDP))
+}
+
+//serveDelete the last path element is session id
+func (webrtcService *WebRTCService) serveDelete(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimSuffix(req.URL.Path, "/")
+	sessionID := path[strings.LastIndex(path, "/")+1:]
+	webrtcService.mutexSessions.RLock()
+	session, ok := webrtcService.sessions[sessionID]
+	webrtcService.mutexSessions.RUnlock()
+	if false == ok {
+		w.WriteHeader(404)
+		return
+	}
+	session.close()
+	w.WriteHeader(200)
+}
+
+//parseURL /whep/app/streamName -> app/streamName
+func parseURL(route, path string) (streamName string, err error) {
+	path = strings.TrimPrefix(path, "/")
+	if false == strings.HasPrefix(path, route+"/") {
+		return "", errors.New("invalid webrtc path:" + path)
+	}
+	streamName = strings.TrimSuffix(strings.TrimPrefix(path, route+"/"), "/")
+	subs := strings.Split(streamName, "/")
+	if len(subs) < 2 || len(subs[0]) == 0 || len(subs[len(subs)-1]) == 0 {
+		return "", errors.New("invalid webrtc stream name:" + streamName)
+	}
+	return
+}
+
+func (webrtcService *WebRTCService) addSession(id string, session webrtcSession, peer *webrtcPeer) {
+	peer.onClose = webrtcService.delPeer
+	webrtcService.mutexSessions.Lock()
+	defer webrtcService.mutexSessions.Unlock()
+	webrtcService.sessions[id] = session
+	webrtcService.peers[peer.localUfrag] = peer
+}
+
+func (webrtcService *WebRTCService) delSession(id string, peer *webrtcPeer) {
+	webrtcService.mutexSessions.Lock()
+	delete(webrtcService.sessions, id)
+	webrtcService.mutexSessions.Unlock()
+	peer.close()
+}
+
+func (webrtcService *WebRTCService) delPeer(peer *webrtcPeer) {
+	webrtcService.mutexSessions.Lock()
+	defer webrtcService.mutexSessions.Unlock()
+	delete(webrtcService.peers, peer.localUfrag)
+	for addr, v := range webrtcService.peersAddr {
+		if v == peer {
+			delete(webrtcService.peersAddr, addr)
+		}
+	}
+}
+
+//serveUDP demux by the first byte,rfc 7983
+func (webrtcService *WebRTCService) serveUDP(conn *net.UDPConn) {
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			logger.LOGT("webrtc udp closed:" + err.Error())
+			return
+		}
+		if n == 0 {
+			continue
+		}
+		data := buf[:n]
+		switch {
+		case isSTUN(data):
+			webrtcService.handleSTUN(data, addr)
+		case data[0] >= 20 && data[0] <= 63:
+			webrtcService.mutexSessions.RLock()
+			peer := webrtcService.peersAddr[addr.String()]
+			webrtcService.mutexSessions.RUnlock()
+			if peer != nil {
+				peer.pushDTLS(append([]byte{}, data...))
+			}
+		case data[0] >= 128 && data[0] <= 191:
+			webrtcService.mutexSessions.RLock()
+			peer := webrtcService.peersAddr[addr.String()]
+			webrtcService.mutexSessions.RUnlock()
+			if peer != nil {
+				peer.handleRTP(data)
+			}
+		}
+	}
+}
+
+//handleSTUN username of binding request is local ufrag:remote ufrag
+func (webrtcService *WebRTCService) handleSTUN(data []byte, addr *net.UDPAddr) {
+	msg, err := parseSTUN(data)
+	if err != nil {
+		logger.LOGW(err.Error())
+		return
+	}
+	localUfrag := strings.SplitN(msg.username(), ":", 2)[0]
+	webrtcService.mutexSessions.RLock()
+	peer := webrtcService.peers[localUfrag]
+	webrtcService.mutexSessions.RUnlock()
+	if nil == peer {
+		return
+	}
+	if false == peer.handleSTUN(msg, addr) {
+		return
+	}
+	webrtcService.mutexSessions.Lock()
+	defer webrtcService.mutexSessions.Unlock()
+	if webrtcService.peers[localUfrag] != peer {
+		//closed while answering
+		return
+	}
+	for k, v := range webrtcService.peersAddr {
+		if v == peer {
+			delete(webrtcService.peersAddr, k)
+		}
+	}
+	webrtcService.peersAddr[addr.String()] = peer
+}
+
+func randomSSRC() uint32 {
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	return binary.BigEndian.Uint32(buf)
+}
@@ -0,0 +1,320 @@
+package webrtc
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/events/eStreamerEvent"
+	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/mediatype/h264"
+	"github.com/use-go/websocket-streamserver/metrics"
+	"github.com/use-go/websocket-streamserver/utils"
+	"github.com/use-go/websocket-streamserver/wssapi"
+)
+
+const (
+	tagCacheSize       = 1024
+	waitSourceTime     = 10 * time.Second
+	consentTimeout     = 30 * time.Second
+	consentCheckPeriod = 5 * time.Second
+	rtpHeaderSize      = 12
+	srtpAuthTagSize    = 10
+	rtpPacketSize      = 1200 //below common path mtu
+	rtpVideoFreq       = 90000
+	rtpOpusFreq        = 48000
+)
+
+//WebRTCSink one whep session,flv tags to srtp
+type WebRTCSink struct {
+	streamName  string
+	clientID    string
+	sinkAdded   bool
+	peer        *webrtcPeer
+	answer      *sdpAnswer
+	chSource    chan bool
+	chTags      chan *flv.FlvTag
+	chQuit      chan bool
+	mutexQuit   sync.Mutex
+	quit        bool
+	videoHeader *flv.FlvTag
+	videoSeq    uint16
+	audioSeq    uint16
+	beginTime   uint32
+	beginSet    bool
+	keyFrameGot bool
+	codecWarned bool
+	stats       *metrics.SinkStats
+}
+
+//Init add self to streamer as sink
+func (sink *WebRTCSink) Init(msg *wssapi.Msg) (err error) {
+	var ok bool
+	sink.streamName, ok = msg.Param1.(string)
+	if false == ok {
+		return errors.New("invalid param init webrtc sink")
+	}
+	sink.clientID = utils.GenerateGUID()
+	sink.chSource = make(chan bool, 1)
+	sink.chTags = make(chan *flv.FlvTag, tagCacheSize)
+	sink.chQuit = make(chan bool)
+
+	taskAddSink := &eStreamerEvent.EveAddSink{
+		StreamName: sink.streamName,
+		SinkId:     sink.clientID,
+		Sinker:     sink}
+	sink.stats = metrics.AddSink(metrics.ProtocolWebRTC, sink.streamName, sink.clientID)
+	err = wssapi.HandleTask(taskAddSink)
+	if err != nil {
+		metrics.DelSink(sink.stats)
+		return
+	}
+	sink.sinkAdded = true
+	return
+}
+
+//Start nothing to do
+func (sink *WebRTCSink) Start(msg *wssapi.Msg) (err error) {
+	return
+}
+
+//Stop remove from streamer
+func (sink *WebRTCSink) Stop(msg *wssapi.Msg) (err error) {
+	sink.close()
+	metrics.DelSink(sink.stats)
+	if sink.sinkAdded {
+		taskDelSink := &eStreamerEvent.EveDelSink{}
+		taskDelSink.StreamName = sink.streamName
+		taskDelSink.SinkId = sink.clientID
+		go wssapi.HandleTask(taskDelSink)
+		sink.sinkAdded = false
+		logger.LOGT("del webrtc sinker:" + sink.clientID)
+	}
+	return
+}
+
+//GetType of sink
+func (sink *WebRTCSink) GetType() string {
+	return "WebRTCSink"
+}
+
+//HandleTask not implemention
+func (sink *WebRTCSink) HandleTask(task wssapi.Task) (err error) {
+	return
+}
+
+//ProcessMessage called by source,must not block
+func (sink *WebRTCSink) ProcessMessage(msg *wssapi.Msg) (err error) {
+	switch msg.Type {
+	case wssapi.MsgGetSourceNotify:
+		sink.notifySource(true)
+	case wssapi.MsgGetSourceFailed:
+		sink.notifySource(false)
+	case wssapi.MsgPlayStart:
+	case wssapi.MsgPlayStop:
+		logger.LOGT("webrtc source stopped:" + sink.streamName)
+		sink.close()
+	case wssapi.MsgFlvTag:
+		tag, ok := msg.Param1.(*flv.FlvTag)
+		if false == ok {
+			return errors.New("invalid flv tag")
+		}
+		select {
+		case <-sink.chQuit:
+			return errors.New("webrtc client closed")
+		case sink.chTags <- tag:
+		default:
+			//客户端太慢,放弃,缓存中的tag也不会再发送
+			sink.stats.AddDropped(len(sink.chTags))
+			return errors.New("webrtc client too slow:" + sink.clientID)
+		}
+	default:
+		logger.LOGW(msg.Type + " not processed")
+	}
+	return
+}
+
+//NeedLastKeyFrame webrtc 需要立即出画面
+func (sink *WebRTCSink) NeedLastKeyFrame() bool {
+	return true
+}
+
+func (sink *WebRTCSink) notifySource(ok bool) {
+	select {
+	case sink.chSource <- ok:
+	default:
+	}
+}
+
+func (sink *WebRTCSink) close() {
+	sink.mutexQuit.Lock()
+	defer sink.mutexQuit.Unlock()
+	if false == sink.quit {
+		sink.quit = true
+		close(sink.chQuit)
+	}
+}
+
+//waitSource true if the stream exists
+func (sink *WebRTCSink) waitSource() bool {
+	select {
+	case ok := <-sink.chSource:
+		if false == ok {
+			logger.LOGE("webrtc source not found:" + sink.streamName)
+		}
+		return ok
+	case <-time.After(waitSourceTime):
+		logger.LOGE("webrtc wait source timeout:" + sink.streamName)
+	case <-sink.chQuit:
+	}
+	return false
+}
+
+//run send tags after dtls connected,until client gone or source stopped
+func (sink *WebRTCSink) run() {
+	select {
+	case <-sink.peer.chConnected:
+	case <-sink.peer.chQuit:
+		return
+	case <-sink.chQuit:
+		return
+	}
+	logger.LOGT("webrtc play start:" + sink.streamName + " " + sink.peer.RemoteAddr().String())
+	ticker := time.NewTicker(consentCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case tag := <-sink.chTags:
+			err := sink.sendTag(tag)
+			if err != nil {
+				logger.LOGE("webrtc send failed:" + err.Error())
+				return
+			}
+		case <-ticker.C:
+			if sink.peer.consentExpired(consentTimeout) {
+				logger.LOGT("webrtc consent expired:" + sink.clientID)
+				return
+			}
+		case <-sink.peer.chQuit:
+			logger.LOGT("webrtc client closed:" + sink.clientID)
+			return
+		case <-sink.chQuit:
+			return
+		}
+	}
+}
+
+//sendTag 从第一个关键帧开始发送,时间戳从0开始
+func (sink *WebRTCSink) sendTag(tag *flv.FlvTag) (err error) {
+	switch tag.TagType {
+	case flv.FlvTagVideo:
+		if flv.IsVideoSequenceHeader(tag) {
+			sink.videoHeader = tag
+			return
+		}
+		if sink.answer.videoPT < 0 || nil == sink.videoHeader {
+			return
+		}
+		if false == sink.keyFrameGot {
+			if false == flv.IsKeyFrame(tag) {
+				return
+			}
+			sink.keyFrameGot = true
+		}
+		video, err := flv.GetVideoTag(tag)
+		if err != nil {
+			return nil
+		}
+		if video.FourCC != flv.FourCCAVC {
+			if false == sink.codecWarned {
+				sink.codecWarned = true
+				logger.LOGW("webrtc only h264 video supported:" + video.FourCC)
+			}
+			return nil
+		}
+		return sink.sendH264(tag, video)
+	case flv.FlvTagAudio:
+		//audio waits for the first keyframe if the stream has video
+		if sink.answer.audioPT < 0 || (false == sink.keyFrameGot && sink.videoHeader != nil) {
+			return
+		}
+		audio, err := flv.GetAudioTag(tag)
+		if err != nil || audio.FourCC != flv.FourCCOpus || audio.PacketType != flv.PacketTypeCodedFrames {
+			return nil
+		}
+		timestamp := uint32(int64(sink.relativeTime(tag.Timestamp)) * rtpOpusFreq / 1000)
+		sink.audioSeq++
+		return sink.sendRTP(sink.answer.audioPT, sink.audioSeq, timestamp, sink.answer.audioSSRC, false, audio.Data)
+	}
+	return
+}
+
+//sendH264 sps pps before idr in STAP-A,marker on the last packet of the frame
+func (sink *WebRTCSink) sendH264(tag *flv.FlvTag, video *flv.VideoTag) (err error) {
+	ms := int64(sink.relativeTime(tag.Timestamp)) + int64(video.CompositionTime)
+	if ms < 0 {
+		ms = 0
+	}
+	timestamp := uint32(ms * rtpVideoFreq / 1000)
+	payloads := make([][]byte, 0, 8)
+	data := video.Data
+	for cur := 0; cur+4 <= len(data); {
+		nalSize := int(binary.BigEndian.Uint32(data[cur:]))
+		cur += 4
+		if nalSize <= 0 || cur+nalSize > len(data) {
+			logger.LOGE("invalid h264 nal size")
+			return
+		}
+		nal := data[cur : cur+nalSize]
+		cur += nalSize
+		nalType := nal[0] & 0x1f
+		if nalType == h264.NalType_sps || nalType == h264.NalType_pps || nalType == h264.NalType_aud {
+			continue
+		}
+		if nalType == h264.NalType_idr && len(sink.videoHeader.Data) > 13 {
+			sps, pps := h264.GetSpsPpsFromAVC(sink.videoHeader.Data[5:])
+			payloads = append(payloads, h264.RTPStapA(sps, pps))
+		}
+		payloads = append(payloads, h264.RTPPayloads(nal, rtpPacketSize-rtpHeaderSize-srtpAuthTagSize)...)
+	}
+	for i, payload := range payloads {
+		sink.videoSeq++
+		err = sink.sendRTP(sink.answer.videoPT, sink.videoSeq, timestamp, sink.answer.videoSSRC, i == len(payloads)-1, payload)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (sink *WebRTCSink) relativeTime(timestamp uint32) uint32 {
+	if false == sink.beginSet {
+		sink.beginSet = true
+		sink.beginTime = timestamp
+	}
+	if timestamp < sink.beginTime {
+		return 0
+	}
+	return timestamp - sink.beginTime
+}
+
+func (sink *WebRTCSink) sendRTP(payloadType int, seq uint16, timestamp, ssrc uint32, marker bool, payload []byte) (err error) {
+	pkt := make([]byte, rtpHeaderSize, rtpHeaderSize+len(payload)+srtpAuthTagSize)
+	pkt[0] = 2 << 6 //version
+	pkt[1] = byte(payloadType & 0x7f)
+	if marker {
+		pkt[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(pkt[2:], seq)
+	binary.BigEndian.PutUint32(pkt[4:], timestamp)
+	binary.BigEndian.PutUint32(pkt[8:], ssrc)
+	pkt = append(pkt, payload...)
+	n, err := sink.peer.writeRTP(pkt)
+	if err != nil {
+		return
+	}
+	sink.stats.AddBytes(n)
+	return
+}
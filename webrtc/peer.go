@@ -0,0 +1,352 @@
+package webrtc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/srtp/v2"
+	"github.com/pion/transport/v2/deadline"
+	"github.com/use-go/websocket-streamserver/logger"
+)
+
+const (
+	dtlsHandshakeTimeout = 10 * time.Second
+	dtlsCacheSize        = 64
+)
+
+//webrtcPeer ice lite,dtls and srtp of one whep session,
+//all peers share the udp socket of the service
+type webrtcPeer struct {
+	localUfrag        string
+	localPwd          string
+	remoteUfrag       string
+	remoteFingerprint string
+	conn              *net.UDPConn
+	mutexAddr         sync.RWMutex
+	remoteAddr        *net.UDPAddr
+	lastSTUN          time.Time
+	chDTLS            chan []byte
+	readDeadline      *deadline.Deadline
+	dtlsConn          *dtls.Conn
+	mutexSRTP         sync.Mutex
+	srtpCtx           *srtp.Context //local keys,encrypt
+	srtpRemote        *srtp.Context //remote keys,decrypt
+	onRTP             func(pkt []byte)
+	chConnected       chan bool
+	chQuit            chan bool
+	mutexQuit         sync.Mutex
+	quit              bool
+	onClose           func(peer *webrtcPeer)
+}
+
+func newPeer(conn *net.UDPConn, localUfrag, localPwd, remoteUfrag, remoteFingerprint string) *webrtcPeer {
+	return &webrtcPeer{localUfrag: localUfrag,
+		localPwd:          localPwd,
+		remoteUfrag:       remoteUfrag,
+		remoteFingerprint: remoteFingerprint,
+		conn:              conn,
+		lastSTUN:          time.Now(),
+		chDTLS:            make(chan []byte, dtlsCacheSize),
+		readDeadline:      deadline.New(),
+		chConnected:       make(chan bool),
+		chQuit:            make(chan bool)}
+}
+
+//handleSTUN answer binding request,the latest checked address is used to send media
+func (peer *webrtcPeer) handleSTUN(msg *stunMessage, addr *net.UDPAddr) (changed bool) {
+	if msg.msgType != stunBindingRequest || msg.username() != peer.localUfrag+":"+peer.remoteUfrag {
+		return
+	}
+	if false == msg.checkIntegrity(peer.localPwd) {
+		logger.LOGW("stun integrity check failed from " + addr.String())
+		return
+	}
+	peer.mutexAddr.Lock()
+	peer.lastSTUN = time.Now()
+	if nil == peer.remoteAddr || peer.remoteAddr.String() != addr.String() {
+		peer.remoteAddr = addr
+		changed = true
+	}
+	peer.mutexAddr.Unlock()
+
+	builder := newSTUNBuilder(stunBindingSuccess, msg.transactionID)
+	builder.addXorMappedAddress(addr)
+	_, err := peer.conn.WriteToUDP(builder.bytes(peer.localPwd), addr)
+	if err != nil {
+		logger.LOGE("stun response failed:" + err.Error())
+	}
+	return
+}
+
+//consentExpired no binding request for a while,rfc 7675
+func (peer *webrtcPeer) consentExpired(timeout time.Duration) bool {
+	peer.mutexAddr.RLock()
+	defer peer.mutexAddr.RUnlock()
+	return time.Since(peer.lastSTUN) > timeout
+}
+
+//pushDTLS called by udp reader,drop if handshake not reading
+func (peer *webrtcPeer) pushDTLS(data []byte) {
+	select {
+	case peer.chDTLS <- data:
+	default:
+		logger.LOGW("dtls packet dropped:" + peer.localUfrag)
+	}
+}
+
+//start dtls server,srtp keys are exported after handshake
+func (peer *webrtcPeer) start(cert tls.Certificate) {
+	go func() {
+		err := peer.handshake(cert)
+		if err != nil {
+			logger.LOGE("webrtc dtls failed:" + err.Error())
+			peer.close()
+			return
+		}
+		close(peer.chConnected)
+		//read until close notify or peer closed,application data not used
+		buf := make([]byte, 1500)
+		for {
+			_, err = peer.dtlsConn.Read(buf)
+			if err != nil {
+				peer.close()
+				return
+			}
+		}
+	}()
+}
+
+func (peer *webrtcPeer) handshake(cert tls.Certificate) (err error) {
+	config := &dtls.Config{
+		Certificates:           []tls.Certificate{cert},
+		SRTPProtectionProfiles: []dtls.SRTPProtectionProfile{dtls.SRTP_AES128_CM_HMAC_SHA1_80},
+		ClientAuth:             dtls.RequireAnyClientCert,
+		VerifyPeerCertificate:  peer.verifyCertificate}
+	ctx, cancel := context.WithTimeout(context.Background(), dtlsHandshakeTimeout)
+	defer cancel()
+	dtlsConn, err := dtls.ServerWithContext(ctx, peer, config)
+	if err != nil {
+		return
+	}
+	peer.mutexQuit.Lock()
+	peer.dtlsConn = dtlsConn
+	quit := peer.quit
+	peer.mutexQuit.Unlock()
+	if quit {
+		dtlsConn.Close()
+		return errors.New("webrtc peer closed")
+	}
+	profile, ok := dtlsConn.SelectedSRTPProtectionProfile()
+	if false == ok || profile != dtls.SRTP_AES128_CM_HMAC_SHA1_80 {
+		return errors.New("srtp profile not negotiated")
+	}
+	state := dtlsConn.ConnectionState()
+	srtpConfig := &srtp.Config{Profile: srtp.ProtectionProfileAes128CmHmacSha1_80}
+	err = srtpConfig.ExtractSessionKeysFromDTLS(&state, false)
+	if err != nil {
+		return
+	}
+	peer.srtpCtx, err = srtp.CreateContext(srtpConfig.Keys.LocalMasterKey, srtpConfig.Keys.LocalMasterSalt, srtpConfig.Profile)
+	if err != nil {
+		return
+	}
+	peer.srtpRemote, err = srtp.CreateContext(srtpConfig.Keys.RemoteMasterKey, srtpConfig.Keys.RemoteMasterSalt, srtpConfig.Profile)
+	return
+}
+
+//verifyCertificate the certificate must match the fingerprint in offer
+func (peer *webrtcPeer) verifyCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no dtls client certificate")
+	}
+	if certFingerprint(rawCerts[0]) != peer.remoteFingerprint {
+		return errors.New("dtls fingerprint mismatch")
+	}
+	return nil
+}
+
+//writeRTP encrypt and send,dropped before dtls connected
+func (peer *webrtcPeer) writeRTP(pkt []byte) (n int, err error) {
+	select {
+	case <-peer.chConnected:
+	default:
+		return 0, errors.New("webrtc peer not connected")
+	}
+	peer.mutexSRTP.Lock()
+	encrypted, err := peer.srtpCtx.EncryptRTP(nil, pkt, nil)
+	peer.mutexSRTP.Unlock()
+	if err != nil {
+		return
+	}
+	return peer.Write(encrypted)
+}
+
+//writeRTCP encrypt and send feedback,dropped before dtls connected
+func (peer *webrtcPeer) writeRTCP(pkt []byte) (err error) {
+	select {
+	case <-peer.chConnected:
+	default:
+		return errors.New("webrtc peer not connected")
+	}
+	peer.mutexSRTP.Lock()
+	encrypted, err := peer.srtpCtx.EncryptRTCP(nil, pkt, nil)
+	peer.mutexSRTP.Unlock()
+	if err != nil {
+		return
+	}
+	_, err = peer.Write(encrypted)
+	return
+}
+
+//handleRTP called by udp reader,rtcp from the remote is not used
+func (peer *webrtcPeer) handleRTP(data []byte) {
+	select {
+	case <-peer.chConnected:
+	default:
+		return
+	}
+	if nil == peer.onRTP || isRTCP(data) {
+		return
+	}
+	pkt, err := peer.srtpRemote.DecryptRTP(nil, data, nil)
+	if err != nil {
+		logger.LOGW("srtp decrypt failed:" + err.Error())
+		return
+	}
+	peer.onRTP(pkt)
+}
+
+//isRTCP payload type 192-223 with marker bit,rfc 5761
+func isRTCP(data []byte) bool {
+	return len(data) >= 2 && data[1] >= 192 && data[1] <= 223
+}
+
+func (peer *webrtcPeer) close() {
+	peer.shutdown(true)
+}
+
+func (peer *webrtcPeer) shutdown(closeDTLS bool) {
+	peer.mutexQuit.Lock()
+	if peer.quit {
+		peer.mutexQuit.Unlock()
+		return
+	}
+	peer.quit = true
+	close(peer.chQuit)
+	dtlsConn := peer.dtlsConn
+	peer.mutexQuit.Unlock()
+	if dtlsConn != nil && closeDTLS {
+		dtlsConn.Close()
+	}
+	if peer.onClose != nil {
+		peer.onClose(peer)
+	}
+}
+
+//net.Conn for dtls,packets demuxed by the service
+
+//Read one dtls record from udp reader
+func (peer *webrtcPeer) Read(b []byte) (n int, err error) {
+	select {
+	case data := <-peer.chDTLS:
+		return copy(b, data), nil
+	case <-peer.chQuit:
+		return 0, io.EOF
+	case <-peer.readDeadline.Done():
+		return 0, errors.New("webrtc peer read timeout")
+	}
+}
+
+//Write to the address of latest binding request
+func (peer *webrtcPeer) Write(b []byte) (n int, err error) {
+	addr := peer.RemoteAddr()
+	if nil == addr {
+		return 0, errors.New("webrtc peer has no remote address")
+	}
+	return peer.conn.WriteToUDP(b, addr.(*net.UDPAddr))
+}
+
+//Close called by dtls conn when closing,must not close it again
+func (peer *webrtcPeer) Close() error {
+	peer.shutdown(false)
+	return nil
+}
+
+//LocalAddr of the shared udp socket
+func (peer *webrtcPeer) LocalAddr() net.Addr {
+	return peer.conn.LocalAddr()
+}
+
+//RemoteAddr nil before ice checked
+func (peer *webrtcPeer) RemoteAddr() net.Addr {
+	peer.mutexAddr.RLock()
+	defer peer.mutexAddr.RUnlock()
+	if nil == peer.remoteAddr {
+		return nil
+	}
+	return peer.remoteAddr
+}
+
+//SetDeadline only read deadline used
+func (peer *webrtcPeer) SetDeadline(t time.Time) error {
+	return peer.SetReadDeadline(t)
+}
+
+//SetReadDeadline wake up blocked Read
+func (peer *webrtcPeer) SetReadDeadline(t time.Time) error {
+	peer.readDeadline.Set(t)
+	return nil
+}
+
+//SetWriteDeadline udp write not blocked
+func (peer *webrtcPeer) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+//generateCertificate self signed ecdsa certificate for dtls,browsers check fingerprint only
+func generateCertificate() (cert tls.Certificate, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "websocket-streamserver"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return
+	}
+	cert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return
+}
+
+//certFingerprint sha-256 upper hex with colons as in sdp
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	strs := make([]string, len(sum))
+	for i, v := range sum {
+		strs[i] = fmt.Sprintf("%02X", v)
+	}
+	return strings.Join(strs, ":")
+}
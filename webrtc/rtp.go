@@ -0,0 +1,141 @@
+package webrtc
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/mediatype/rtp"
+)
+
+const (
+	jitterBufferSize  = 256
+	jitterBufferDelay = 150 * time.Millisecond
+	rtcpRR            = 201
+	rtcpPSFB          = 206
+	rtcpFmtPLI        = 1
+)
+
+//rtpPacket rtp packet in the jitter buffer
+type rtpPacket struct {
+	*rtp.Packet
+	arrival    time.Time
+	lostBefore bool //set by jitter buffer if packets before are skipped
+}
+
+//seqBefore a is older than b with wrap around
+func seqBefore(a, b uint16) bool {
+	return a != b && b-a < 0x8000
+}
+
+//jitterBuffer reorder packets by sequence,a missing packet is skipped
+//when the buffer is full or the oldest packet waited too long
+type jitterBuffer struct {
+	packets  map[uint16]*rtpPacket
+	started  bool
+	nextSeq  uint16
+	received uint32
+	//receiver report
+	cycles       uint32
+	maxSeq       uint16
+	lastReceived uint32
+	lastExpected uint32
+	baseSeq      uint16
+}
+
+func newJitterBuffer() *jitterBuffer {
+	return &jitterBuffer{packets: make(map[uint16]*rtpPacket)}
+}
+
+//push return packets in order
+func (jb *jitterBuffer) push(pkt *rtpPacket) (out []*rtpPacket) {
+	if false == jb.started {
+		jb.started = true
+		jb.nextSeq = pkt.Seq
+		jb.baseSeq = pkt.Seq
+		jb.maxSeq = pkt.Seq
+	}
+	if seqBefore(pkt.Seq, jb.nextSeq) {
+		//late or duplicate
+		return
+	}
+	if _, ok := jb.packets[pkt.Seq]; ok {
+		return
+	}
+	jb.received++
+	if seqBefore(jb.maxSeq, pkt.Seq) {
+		if pkt.Seq < jb.maxSeq {
+			jb.cycles += 0x10000
+		}
+		jb.maxSeq = pkt.Seq
+	}
+	jb.packets[pkt.Seq] = pkt
+	out = jb.pop(out)
+	for len(jb.packets) > 0 {
+		oldest := jb.oldest()
+		if len(jb.packets) < jitterBufferSize && time.Since(oldest.arrival) < jitterBufferDelay {
+			break
+		}
+		jb.nextSeq = oldest.Seq
+		oldest.lostBefore = true
+		out = jb.pop(out)
+	}
+	return
+}
+
+func (jb *jitterBuffer) pop(out []*rtpPacket) []*rtpPacket {
+	for {
+		pkt, ok := jb.packets[jb.nextSeq]
+		if false == ok {
+			return out
+		}
+		delete(jb.packets, jb.nextSeq)
+		jb.nextSeq++
+		out = append(out, pkt)
+	}
+}
+
+func (jb *jitterBuffer) oldest() (pkt *rtpPacket) {
+	for _, v := range jb.packets {
+		if nil == pkt || seqBefore(v.Seq, pkt.Seq) {
+			pkt = v
+		}
+	}
+	return
+}
+
+//receiverReport rfc 3550 RR with one report block,jitter and lsr not calculated
+func (jb *jitterBuffer) receiverReport(senderSSRC, mediaSSRC uint32) []byte {
+	expected := jb.cycles + uint32(jb.maxSeq) - uint32(jb.baseSeq) + 1
+	lostTotal := int64(expected) - int64(jb.received)
+	expectedInterval := expected - jb.lastExpected
+	receivedInterval := jb.received - jb.lastReceived
+	jb.lastExpected = expected
+	jb.lastReceived = jb.received
+	fraction := 0
+	if expectedInterval > 0 && expectedInterval > receivedInterval {
+		fraction = int((expectedInterval - receivedInterval) << 8 / expectedInterval)
+	}
+	if lostTotal < 0 {
+		lostTotal = 0
+	}
+	pkt := make([]byte, 32)
+	pkt[0] = 0x81 //version 2,one report block
+	pkt[1] = rtcpRR
+	binary.BigEndian.PutUint16(pkt[2:], 7)
+	binary.BigEndian.PutUint32(pkt[4:], senderSSRC)
+	binary.BigEndian.PutUint32(pkt[8:], mediaSSRC)
+	binary.BigEndian.PutUint32(pkt[12:], uint32(lostTotal)&0xffffff|uint32(fraction&0xff)<<24)
+	binary.BigEndian.PutUint32(pkt[16:], jb.cycles|uint32(jb.maxSeq))
+	return pkt
+}
+
+//pictureLossIndication rfc 4585 PLI,ask the publisher for a keyframe
+func pictureLossIndication(senderSSRC, mediaSSRC uint32) []byte {
+	pkt := make([]byte, 12)
+	pkt[0] = 0x80 | rtcpFmtPLI
+	pkt[1] = rtcpPSFB
+	binary.BigEndian.PutUint16(pkt[2:], 2)
+	binary.BigEndian.PutUint32(pkt[4:], senderSSRC)
+	binary.BigEndian.PutUint32(pkt[8:], mediaSSRC)
+	return pkt
+}
@@ -0,0 +1,138 @@
+package webrtc
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/use-go/websocket-streamserver/mediatype/flv"
+	"github.com/use-go/websocket-streamserver/mediatype/h264"
+)
+
+const opusPreSkip = 312
+
+//rtpDepacketizer 把推流端的RTP包还原成flv tag,h264为avc,opus为enhanced flv
+type rtpDepacketizer struct {
+	fourCC    string
+	clockRate uint32
+	channels  int
+	//时间戳以会话开始为0,各轨道以第一个包的到达时间对齐
+	startTime   time.Time
+	baseTimeSet bool
+	baseTime    uint32
+	baseMs      uint32
+	headerSent  bool
+	//h264
+	h264         h264.RTPDepacketizer
+	waitKeyFrame bool
+}
+
+func newH264Depacketizer(startTime time.Time) *rtpDepacketizer {
+	return &rtpDepacketizer{fourCC: flv.FourCCAVC,
+		clockRate:    rtpVideoFreq,
+		startTime:    startTime,
+		waitKeyFrame: true}
+}
+
+func newOpusDepacketizer(startTime time.Time, channels int) *rtpDepacketizer {
+	if channels <= 0 {
+		channels = 2
+	}
+	return &rtpDepacketizer{fourCC: flv.FourCCOpus,
+		clockRate: rtpOpusFreq,
+		channels:  channels,
+		startTime: startTime}
+}
+
+func (depacketizer *rtpDepacketizer) rtpTime2ms(rtpTime uint32) uint32 {
+	if false == depacketizer.baseTimeSet {
+		depacketizer.baseTimeSet = true
+		depacketizer.baseTime = rtpTime
+		depacketizer.baseMs = uint32(time.Since(depacketizer.startTime) / time.Millisecond)
+	}
+	delta := uint64(rtpTime - depacketizer.baseTime)
+	return depacketizer.baseMs + uint32(delta*1000/uint64(depacketizer.clockRate))
+}
+
+//addPacket 输入排序后的RTP包,needKeyFrame为等待关键帧
+func (depacketizer *rtpDepacketizer) addPacket(pkt *rtpPacket) (tags []*flv.FlvTag, needKeyFrame bool) {
+	if depacketizer.fourCC == flv.FourCCOpus {
+		return depacketizer.addOpus(pkt), false
+	}
+	tags = depacketizer.addH264(pkt)
+	return tags, depacketizer.waitKeyFrame
+}
+
+func (depacketizer *rtpDepacketizer) addOpus(pkt *rtpPacket) (tags []*flv.FlvTag) {
+	if len(pkt.Payload) == 0 {
+		return
+	}
+	timestamp := depacketizer.rtpTime2ms(pkt.Timestamp)
+	if false == depacketizer.headerSent {
+		head := make([]byte, 19)
+		copy(head, "OpusHead")
+		head[8] = 1 //version
+		head[9] = byte(depacketizer.channels)
+		binary.LittleEndian.PutUint16(head[10:], opusPreSkip)
+		binary.LittleEndian.PutUint32(head[12:], rtpOpusFreq)
+		tags = append(tags, exAudioTag(flv.PacketTypeSequenceStart, timestamp, head))
+		depacketizer.headerSent = true
+	}
+	tags = append(tags, exAudioTag(flv.PacketTypeCodedFrames, timestamp, pkt.Payload))
+	return
+}
+
+func exAudioTag(packetType int, timestamp uint32, data []byte) *flv.FlvTag {
+	tag := &flv.FlvTag{TagType: flv.FlvTagAudio, Timestamp: timestamp}
+	tag.Data = make([]byte, 0, 5+len(data))
+	tag.Data = append(tag.Data, byte(flv.SoundFormatExHeader<<4|packetType))
+	tag.Data = append(tag.Data, flv.FourCCOpus...)
+	tag.Data = append(tag.Data, data...)
+	return tag
+}
+
+func (depacketizer *rtpDepacketizer) addH264(pkt *rtpPacket) (tags []*flv.FlvTag) {
+	if pkt.lostBefore {
+		//丢包后的帧不完整,丢弃直到下一个关键帧
+		depacketizer.waitKeyFrame = true
+	}
+	for _, frame := range depacketizer.h264.AddPayload(pkt.Payload, pkt.Timestamp, pkt.Marker, pkt.lostBefore) {
+		tags = depacketizer.flushH264(frame, tags)
+	}
+	return
+}
+
+func (depacketizer *rtpDepacketizer) flushH264(frame *h264.RTPFrame, tags []*flv.FlvTag) []*flv.FlvTag {
+	if depacketizer.waitKeyFrame {
+		if false == frame.KeyFrame {
+			return tags
+		}
+		depacketizer.waitKeyFrame = false
+	}
+	timestamp := depacketizer.rtpTime2ms(frame.Timestamp)
+	if depacketizer.h264.ParamsChanged || false == depacketizer.headerSent {
+		header := depacketizer.avcHeader()
+		if nil == header {
+			depacketizer.waitKeyFrame = true
+			return tags
+		}
+		header.Timestamp = timestamp
+		tags = append(tags, header)
+		depacketizer.headerSent = true
+		depacketizer.h264.ParamsChanged = false
+	}
+	data := []byte{0x27, 1, 0, 0, 0}
+	if frame.KeyFrame {
+		data[0] = 0x17
+	}
+	tags = append(tags, &flv.FlvTag{TagType: flv.FlvTagVideo, Timestamp: timestamp, Data: append(data, frame.AVCC()...)})
+	return tags
+}
+
+//avcHeader avc sequence header,nil before sps pps received
+func (depacketizer *rtpDepacketizer) avcHeader() (tag *flv.FlvTag) {
+	record := h264.AVCDecoderConfigurationRecord(depacketizer.h264.SPS, depacketizer.h264.PPS)
+	if nil == record {
+		return nil
+	}
+	return &flv.FlvTag{TagType: flv.FlvTagVideo, Data: append([]byte{0x17, 0, 0, 0, 0}, record...)}
+}
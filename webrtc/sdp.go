@@ -0,0 +1,257 @@
+package webrtc
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const sdpEndLine = "\r\n"
+
+//sdpMedia one m= section of the offer
+type sdpMedia struct {
+	kind     string
+	mid      string
+	proto    string
+	payloads []int
+	rtpmap   map[int]string
+	fmtp     map[int]string
+}
+
+//sdpOffer what a whep player or whip publisher offers
+type sdpOffer struct {
+	iceUfrag    string
+	icePwd      string
+	fingerprint string //sha-256 hash,hex with colons
+	setup       string
+	medias      []*sdpMedia
+}
+
+//sdpAnswer choices made for the offer
+type sdpAnswer struct {
+	iceUfrag    string
+	icePwd      string
+	fingerprint string
+	candidates  []string
+	videoPT     int
+	audioPT     int
+	videoSSRC   uint32
+	audioSSRC   uint32
+	recvOnly    bool //whip
+}
+
+//parseOffer session level ice and dtls attributes are shared by media
+func parseOffer(sdp string) (offer *sdpOffer, err error) {
+	offer = &sdpOffer{}
+	var media *sdpMedia
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) < 2 || line[1] != '=' {
+			continue
+		}
+		value := line[2:]
+		if line[0] == 'm' {
+			fields := strings.Fields(value)
+			if len(fields) < 4 {
+				return nil, errors.New("invalid m line:" + line)
+			}
+			media = &sdpMedia{kind: fields[0],
+				proto:  fields[2],
+				rtpmap: make(map[int]string),
+				fmtp:   make(map[int]string)}
+			for _, v := range fields[3:] {
+				pt, err := strconv.Atoi(v)
+				if err == nil {
+					media.payloads = append(media.payloads, pt)
+				}
+			}
+			offer.medias = append(offer.medias, media)
+			continue
+		}
+		if line[0] != 'a' {
+			continue
+		}
+		key := value
+		attrValue := ""
+		if idx := strings.Index(value, ":"); idx > 0 {
+			key = value[:idx]
+			attrValue = value[idx+1:]
+		}
+		switch key {
+		case "ice-ufrag":
+			if len(offer.iceUfrag) == 0 {
+				offer.iceUfrag = attrValue
+			}
+		case "ice-pwd":
+			if len(offer.icePwd) == 0 {
+				offer.icePwd = attrValue
+			}
+		case "fingerprint":
+			fields := strings.Fields(attrValue)
+			if len(fields) == 2 && strings.ToLower(fields[0]) == "sha-256" && len(offer.fingerprint) == 0 {
+				offer.fingerprint = strings.ToUpper(fields[1])
+			}
+		case "setup":
+			if len(offer.setup) == 0 {
+				offer.setup = attrValue
+			}
+		case "mid":
+			if media != nil {
+				media.mid = attrValue
+			}
+		case "rtpmap", "fmtp":
+			if nil == media {
+				continue
+			}
+			idx := strings.Index(attrValue, " ")
+			if idx < 0 {
+				continue
+			}
+			pt, err := strconv.Atoi(attrValue[:idx])
+			if err != nil {
+				continue
+			}
+			if key == "rtpmap" {
+				media.rtpmap[pt] = attrValue[idx+1:]
+			} else {
+				media.fmtp[pt] = attrValue[idx+1:]
+			}
+		}
+	}
+	if len(offer.iceUfrag) == 0 || len(offer.icePwd) == 0 {
+		return nil, errors.New("offer without ice credentials")
+	}
+	if len(offer.fingerprint) == 0 {
+		return nil, errors.New("offer without sha-256 fingerprint")
+	}
+	if offer.setup == "passive" {
+		return nil, errors.New("offer dtls role passive not supported")
+	}
+	return
+}
+
+//fmtpParam value of name in a=fmtp
+func fmtpParam(fmtp, name string) string {
+	for _, param := range strings.Split(fmtp, ";") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], name) {
+			return kv[1]
+		}
+	}
+	return ""
+}
+
+//selectPayload first payload in offer order with the codec,
+//h264 must be packetization-mode 1
+func (media *sdpMedia) selectPayload() int {
+	for _, pt := range media.payloads {
+		codec := strings.ToLower(media.rtpmap[pt])
+		switch media.kind {
+		case "video":
+			if strings.HasPrefix(codec, "h264/90000") && fmtpParam(media.fmtp[pt], "packetization-mode") == "1" {
+				return pt
+			}
+		case "audio":
+			if strings.HasPrefix(codec, "opus/48000") {
+				return pt
+			}
+		}
+	}
+	return -1
+}
+
+//buildAnswer ice lite,dtls passive,send only for whep and receive only for whip,
+//rejected media with port 0
+func buildAnswer(offer *sdpOffer, answer *sdpAnswer) (sdp string, err error) {
+	answer.videoPT = -1
+	answer.audioPT = -1
+	mids := make([]string, 0, len(offer.medias))
+	for _, media := range offer.medias {
+		pt := media.selectPayload()
+		if pt < 0 {
+			continue
+		}
+		if media.kind == "video" && answer.videoPT < 0 {
+			answer.videoPT = pt
+		} else if media.kind == "audio" && answer.audioPT < 0 {
+			answer.audioPT = pt
+		} else {
+			continue
+		}
+		mids = append(mids, media.mid)
+	}
+	if answer.videoPT < 0 && answer.audioPT < 0 {
+		return "", errors.New("no h264 or opus in offer")
+	}
+
+	sdp = "v=0" + sdpEndLine
+	sdp += "o=- " + strconv.FormatUint(uint64(answer.videoSSRC), 10) + " 2 IN IP4 127.0.0.1" + sdpEndLine
+	sdp += "s=-" + sdpEndLine
+	sdp += "t=0 0" + sdpEndLine
+	sdp += "a=ice-lite" + sdpEndLine
+	sdp += "a=group:BUNDLE " + strings.Join(mids, " ") + sdpEndLine
+	sdp += "a=msid-semantic: WMS wsa" + sdpEndLine
+	videoUsed := false
+	audioUsed := false
+	for _, media := range offer.medias {
+		pt := -1
+		ssrc := uint32(0)
+		if media.kind == "video" && false == videoUsed && media.selectPayload() == answer.videoPT {
+			pt, ssrc, videoUsed = answer.videoPT, answer.videoSSRC, true
+		} else if media.kind == "audio" && false == audioUsed && media.selectPayload() == answer.audioPT {
+			pt, ssrc, audioUsed = answer.audioPT, answer.audioSSRC, true
+		}
+		if pt < 0 {
+			sdp += "m=" + media.kind + " 0 " + media.proto + " " + joinPayloads(media.payloads) + sdpEndLine
+			sdp += "c=IN IP4 0.0.0.0" + sdpEndLine
+			sdp += "a=mid:" + media.mid + sdpEndLine
+			sdp += "a=inactive" + sdpEndLine
+			continue
+		}
+		strPT := strconv.Itoa(pt)
+		sdp += "m=" + media.kind + " 9 UDP/TLS/RTP/SAVPF " + strPT + sdpEndLine
+		sdp += "c=IN IP4 0.0.0.0" + sdpEndLine
+		sdp += "a=mid:" + media.mid + sdpEndLine
+		sdp += "a=ice-ufrag:" + answer.iceUfrag + sdpEndLine
+		sdp += "a=ice-pwd:" + answer.icePwd + sdpEndLine
+		sdp += "a=fingerprint:sha-256 " + answer.fingerprint + sdpEndLine
+		sdp += "a=setup:passive" + sdpEndLine
+		if answer.recvOnly {
+			sdp += "a=recvonly" + sdpEndLine
+		} else {
+			sdp += "a=sendonly" + sdpEndLine
+		}
+		sdp += "a=rtcp-mux" + sdpEndLine
+		sdp += "a=rtpmap:" + strPT + " " + media.rtpmap[pt] + sdpEndLine
+		if fmtp, ok := media.fmtp[pt]; ok {
+			sdp += "a=fmtp:" + strPT + " " + fmtp + sdpEndLine
+		}
+		if answer.recvOnly {
+			if media.kind == "video" {
+				//keyframes are requested by pli,lost packets are not retransmitted
+				sdp += "a=rtcp-fb:" + strPT + " nack pli" + sdpEndLine
+			}
+		} else {
+			sdp += "a=msid:wsa wsa-" + media.kind + sdpEndLine
+			sdp += "a=ssrc:" + strconv.FormatUint(uint64(ssrc), 10) + " cname:wsa" + sdpEndLine
+		}
+		for _, candidate := range answer.candidates {
+			sdp += "a=" + candidate + sdpEndLine
+		}
+		sdp += "a=end-of-candidates" + sdpEndLine
+	}
+	return
+}
+
+func joinPayloads(payloads []int) string {
+	strs := make([]string, len(payloads))
+	for i, pt := range payloads {
+		strs[i] = strconv.Itoa(pt)
+	}
+	return strings.Join(strs, " ")
+}
+
+//hostCandidate rfc 8839 candidate attribute,one component with rtcp-mux
+func hostCandidate(foundation int, ip string, port int) string {
+	return "candidate:" + strconv.Itoa(foundation) + " 1 udp 2130706431 " + ip + " " + strconv.Itoa(port) + " typ host"
+}
@@ -0,0 +1,181 @@
+package webrtc
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net"
+)
+
+//rfc 5389,only what ice lite needs
+const (
+	stunHeaderSize          = 20
+	stunMagicCookie         = 0x2112A442
+	stunFingerprintXor      = 0x5354554e
+	stunBindingRequest      = 0x0001
+	stunBindingSuccess      = 0x0101
+	stunAttrUsername        = 0x0006
+	stunAttrIntegrity       = 0x0008
+	stunAttrXorMappedAddr   = 0x0020
+	stunAttrUseCandidate    = 0x0025
+	stunAttrFingerprint     = 0x8028
+	stunAttrIceControlling  = 0x802a
+	stunIntegritySize       = 20
+	stunFingerprintAttrSize = 8
+)
+
+type stunAttr struct {
+	attrType uint16
+	value    []byte
+	offset   int //attr header offset in raw message
+}
+
+type stunMessage struct {
+	msgType       uint16
+	transactionID []byte
+	attrs         []*stunAttr
+	raw           []byte
+}
+
+//isSTUN first two bits zero and magic cookie
+func isSTUN(data []byte) bool {
+	return len(data) >= stunHeaderSize && data[0] < 4 &&
+		binary.BigEndian.Uint32(data[4:]) == stunMagicCookie
+}
+
+func parseSTUN(data []byte) (msg *stunMessage, err error) {
+	if false == isSTUN(data) {
+		return nil, errors.New("not a stun message")
+	}
+	size := int(binary.BigEndian.Uint16(data[2:]))
+	if stunHeaderSize+size > len(data) {
+		return nil, errors.New("stun message truncated")
+	}
+	msg = &stunMessage{
+		msgType:       binary.BigEndian.Uint16(data),
+		transactionID: data[8:stunHeaderSize],
+		raw:           data[:stunHeaderSize+size]}
+	for cur := stunHeaderSize; cur+4 <= len(msg.raw); {
+		attr := &stunAttr{attrType: binary.BigEndian.Uint16(msg.raw[cur:]), offset: cur}
+		attrSize := int(binary.BigEndian.Uint16(msg.raw[cur+2:]))
+		if cur+4+attrSize > len(msg.raw) {
+			return nil, errors.New("stun attribute truncated")
+		}
+		attr.value = msg.raw[cur+4 : cur+4+attrSize]
+		msg.attrs = append(msg.attrs, attr)
+		cur += 4 + (attrSize+3)&^3
+	}
+	return
+}
+
+func (msg *stunMessage) getAttr(attrType uint16) *stunAttr {
+	for _, attr := range msg.attrs {
+		if attr.attrType == attrType {
+			return attr
+		}
+	}
+	return nil
+}
+
+//username local ufrag:remote ufrag for binding requests received
+func (msg *stunMessage) username() string {
+	attr := msg.getAttr(stunAttrUsername)
+	if nil == attr {
+		return ""
+	}
+	return string(attr.value)
+}
+
+//checkIntegrity short term credential,key is the password of the receiver
+func (msg *stunMessage) checkIntegrity(pwd string) bool {
+	attr := msg.getAttr(stunAttrIntegrity)
+	if nil == attr || len(attr.value) != stunIntegritySize {
+		return false
+	}
+	//length in header counts up to the end of integrity attribute
+	data := make([]byte, attr.offset)
+	copy(data, msg.raw[:attr.offset])
+	binary.BigEndian.PutUint16(data[2:], uint16(attr.offset-stunHeaderSize+4+stunIntegritySize))
+	mac := hmac.New(sha1.New, []byte(pwd))
+	mac.Write(data)
+	return hmac.Equal(mac.Sum(nil), attr.value)
+}
+
+//stunBuilder append attributes then sign with integrity and fingerprint
+type stunBuilder struct {
+	data []byte
+}
+
+func newSTUNBuilder(msgType uint16, transactionID []byte) *stunBuilder {
+	builder := &stunBuilder{data: make([]byte, stunHeaderSize, 128)}
+	binary.BigEndian.PutUint16(builder.data, msgType)
+	binary.BigEndian.PutUint32(builder.data[4:], stunMagicCookie)
+	copy(builder.data[8:], transactionID)
+	return builder
+}
+
+func (builder *stunBuilder) addAttr(attrType uint16, value []byte) {
+	attr := make([]byte, 4, 4+len(value)+3)
+	binary.BigEndian.PutUint16(attr, attrType)
+	binary.BigEndian.PutUint16(attr[2:], uint16(len(value)))
+	attr = append(attr, value...)
+	for len(attr)%4 != 0 {
+		attr = append(attr, 0)
+	}
+	builder.data = append(builder.data, attr...)
+	builder.setLength(len(builder.data) - stunHeaderSize)
+}
+
+func (builder *stunBuilder) setLength(size int) {
+	binary.BigEndian.PutUint16(builder.data[2:], uint16(size))
+}
+
+//addXorMappedAddress port and address xor with magic cookie,ipv6 also with transaction id
+func (builder *stunBuilder) addXorMappedAddress(addr *net.UDPAddr) {
+	ip := addr.IP.To4()
+	family := byte(1)
+	if nil == ip {
+		ip = addr.IP.To16()
+		family = 2
+	}
+	value := make([]byte, 4+len(ip))
+	value[1] = family
+	binary.BigEndian.PutUint16(value[2:], uint16(addr.Port)^uint16(stunMagicCookie>>16))
+	key := builder.data[4:stunHeaderSize]
+	for i := range ip {
+		value[4+i] = ip[i] ^ key[i]
+	}
+	builder.addAttr(stunAttrXorMappedAddr, value)
+}
+
+//bytes message integrity with pwd if not empty,then fingerprint
+func (builder *stunBuilder) bytes(pwd string) []byte {
+	if len(pwd) > 0 {
+		builder.setLength(len(builder.data) - stunHeaderSize + 4 + stunIntegritySize)
+		mac := hmac.New(sha1.New, []byte(pwd))
+		mac.Write(builder.data)
+		builder.addAttr(stunAttrIntegrity, mac.Sum(nil))
+	}
+	builder.setLength(len(builder.data) - stunHeaderSize + stunFingerprintAttrSize)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(builder.data)^stunFingerprintXor)
+	builder.addAttr(stunAttrFingerprint, crc)
+	return builder.data
+}
+
+//xorMappedAddress decode the address of a binding response
+func (msg *stunMessage) xorMappedAddress() (addr *net.UDPAddr, err error) {
+	attr := msg.getAttr(stunAttrXorMappedAddr)
+	if nil == attr || (len(attr.value) != 8 && len(attr.value) != 20) {
+		return nil, errors.New("no xor mapped address")
+	}
+	key := msg.raw[4:stunHeaderSize]
+	ip := make(net.IP, len(attr.value)-4)
+	for i := range ip {
+		ip[i] = attr.value[4+i] ^ key[i]
+	}
+	port := binary.BigEndian.Uint16(attr.value[2:]) ^ uint16(stunMagicCookie>>16)
+	return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+}
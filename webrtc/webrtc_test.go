@@ -0,0 +1,242 @@
+package webrtc
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/srtp/v2"
+	"github.com/use-go/websocket-streamserver/mediatype/h264"
+	"github.com/use-go/websocket-streamserver/mediatype/rtp"
+)
+
+const testOffer = "v=0\r\n" +
+	"o=- 1 2 IN IP4 127.0.0.1\r\n" +
+	"s=-\r\n" +
+	"t=0 0\r\n" +
+	"a=group:BUNDLE 0 1\r\n" +
+	"a=fingerprint:sha-256 %s\r\n" +
+	"m=video 9 UDP/TLS/RTP/SAVPF 96 102\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"a=mid:0\r\n" +
+	"a=ice-ufrag:cli1\r\n" +
+	"a=ice-pwd:clientpassword0123456789\r\n" +
+	"a=setup:actpass\r\n" +
+	"a=recvonly\r\n" +
+	"a=rtpmap:96 H264/90000\r\n" +
+	"a=fmtp:96 level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42001f\r\n" +
+	"a=rtpmap:102 H264/90000\r\n" +
+	"a=fmtp:102 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f\r\n" +
+	"m=audio 9 UDP/TLS/RTP/SAVPF 111 0\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"a=mid:1\r\n" +
+	"a=recvonly\r\n" +
+	"a=rtpmap:111 opus/48000/2\r\n" +
+	"a=rtpmap:0 PCMU/8000\r\n"
+
+//rtpFilterConn player side demux,srtp not given to dtls
+type rtpFilterConn struct {
+	*net.UDPConn
+	chRTP chan []byte
+}
+
+func (conn *rtpFilterConn) Read(b []byte) (n int, err error) {
+	for {
+		n, err = conn.UDPConn.Read(b)
+		if err != nil || n == 0 || b[0] < 128 || b[0] > 191 {
+			return
+		}
+		conn.chRTP <- append([]byte{}, b[:n]...)
+	}
+}
+
+func TestWHEPLoopback(t *testing.T) {
+	svc := &WebRTCService{}
+	err := svc.listen(0, []string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Stop(nil)
+	port := svc.conn.LocalAddr().(*net.UDPAddr).Port
+
+	clientCert, err := generateCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	offerSDP := strings.Replace(testOffer, "%s", certFingerprint(clientCert.Certificate[0]), 1)
+	offer, err := parseOffer(offerSDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer := &sdpAnswer{iceUfrag: "srv00001",
+		icePwd:      "serverpassword0123456789",
+		fingerprint: svc.fingerprint,
+		candidates:  svc.candidates,
+		videoSSRC:   1234,
+		audioSSRC:   5678}
+	answerSDP, err := buildAnswer(offer, answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer.videoPT != 102 || answer.audioPT != 111 {
+		t.Fatal("payload type", answer.videoPT, answer.audioPT)
+	}
+	for _, line := range []string{"a=ice-lite", "a=setup:passive", "m=video 9 UDP/TLS/RTP/SAVPF 102",
+		"127.0.0.1 " + strconv.Itoa(port) + " typ host"} {
+		if false == strings.Contains(answerSDP, line) {
+			t.Fatal("answer without " + line + "\n" + answerSDP)
+		}
+	}
+
+	peer := newPeer(svc.conn, answer.iceUfrag, answer.icePwd, offer.iceUfrag, offer.fingerprint)
+	peer.onClose = svc.delPeer
+	svc.mutexSessions.Lock()
+	svc.peers[peer.localUfrag] = peer
+	svc.mutexSessions.Unlock()
+	peer.start(svc.cert)
+
+	udpConn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+
+	//ice connectivity check from the controlling player
+	request := newSTUNBuilder(stunBindingRequest, []byte("0123456789ab"))
+	request.addAttr(stunAttrUsername, []byte("srv00001:cli1"))
+	request.addAttr(stunAttrIceControlling, make([]byte, 8))
+	request.addAttr(stunAttrUseCandidate, nil)
+	_, err = udpConn.Write(request.bytes(answer.icePwd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := udpConn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpConn.SetReadDeadline(time.Time{})
+	response, err := parseSTUN(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.msgType != stunBindingSuccess || false == response.checkIntegrity(answer.icePwd) {
+		t.Fatal("invalid binding response")
+	}
+	mapped, err := response.xorMappedAddress()
+	if err != nil || mapped.String() != udpConn.LocalAddr().String() {
+		t.Fatal("xor mapped address", mapped, err)
+	}
+
+	//dtls client as the player,srtp keys from the handshake
+	clientConn := &rtpFilterConn{UDPConn: udpConn, chRTP: make(chan []byte, 16)}
+	dtlsConn, err := dtls.Client(clientConn, &dtls.Config{
+		Certificates:           []tls.Certificate{clientCert},
+		InsecureSkipVerify:     true,
+		SRTPProtectionProfiles: []dtls.SRTPProtectionProfile{dtls.SRTP_AES128_CM_HMAC_SHA1_80}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-peer.chConnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server dtls not connected")
+	}
+	state := dtlsConn.ConnectionState()
+	srtpConfig := &srtp.Config{Profile: srtp.ProtectionProfileAes128CmHmacSha1_80}
+	err = srtpConfig.ExtractSessionKeysFromDTLS(&state, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srtpCtx, err := srtp.CreateContext(srtpConfig.Keys.RemoteMasterKey, srtpConfig.Keys.RemoteMasterSalt, srtpConfig.Profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkt := []byte{0x80, 0x80 | 102, 0, 1, 0, 0, 0, 90, 0, 0, 0x04, 0xd2, 0x65, 1, 2, 3}
+	_, err = peer.writeRTP(append([]byte{}, pkt...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case encrypted := <-clientConn.chRTP:
+		decrypted, err := srtpCtx.DecryptRTP(nil, encrypted, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if false == bytes.Equal(decrypted, pkt) {
+			t.Fatal("srtp payload mismatch")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no srtp packet")
+	}
+
+	//close notify from player ends the peer
+	dtlsConn.Close()
+	select {
+	case <-peer.chQuit:
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer not closed")
+	}
+	//removed by onClose after quit
+	for i := 0; ; i++ {
+		svc.mutexSessions.RLock()
+		removed := len(svc.peers) == 0 && len(svc.peersAddr) == 0
+		svc.mutexSessions.RUnlock()
+		if removed {
+			break
+		}
+		if i == 100 {
+			t.Fatal("peer not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWHIPDepacketize(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0xe0, 0x1f, 0xda}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	idr := bytes.Repeat([]byte{0x65}, 3000)
+	stapA := []byte{24, 0, byte(len(sps))}
+	stapA = append(stapA, sps...)
+	stapA = append(stapA, 0, byte(len(pps)))
+	stapA = append(stapA, pps...)
+	payloads := append([][]byte{stapA}, h264.RTPPayloads(idr, 1000)...)
+
+	jb := newJitterBuffer()
+	depacketizer := newH264Depacketizer(time.Now())
+	var pkts []*rtpPacket
+	for i, payload := range payloads {
+		pkts = append(pkts, &rtpPacket{Packet: &rtp.Packet{Seq: uint16(65534 + i), Timestamp: 9000, Payload: payload,
+			Marker: i == len(payloads)-1}, arrival: time.Now()})
+	}
+	//swap two packets across the sequence wrap
+	pkts[1], pkts[2] = pkts[2], pkts[1]
+	var tags int
+	var data []byte
+	for _, pkt := range pkts {
+		for _, v := range jb.push(pkt) {
+			out, _ := depacketizer.addPacket(v)
+			for _, tag := range out {
+				tags++
+				data = tag.Data
+			}
+		}
+	}
+	if tags != 2 {
+		t.Fatal("tags", tags)
+	}
+	if data[0] != 0x17 || len(data) != 5+4+len(idr) || false == bytes.Equal(data[9:], idr) {
+		t.Fatal("keyframe not reassembled")
+	}
+	rr := jb.receiverReport(1, 2)
+	if len(rr) != 32 || rr[1] != rtcpRR || rr[12] != 0 {
+		t.Fatal("receiver report", rr)
+	}
+}
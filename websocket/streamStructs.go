@@ -131,6 +131,7 @@ type stPlay struct {
 	Len   int    `json:"len"`
 	Reset int    `json:"reset"`
 	Req   int    `json:"req"`
+	Token string `json:"token,omitempty"`
 }
 
 type stPlay2 struct {
@@ -12,6 +12,8 @@ import (
 	"github.com/use-go/websocket-streamserver/logger"
 	"github.com/use-go/websocket-streamserver/mediatype/flv"
 	"github.com/use-go/websocket-streamserver/mediatype/mp4"
+	"github.com/use-go/websocket-streamserver/metrics"
+	"github.com/use-go/websocket-streamserver/session"
 	"github.com/use-go/websocket-streamserver/wssapi"
 )
 
@@ -23,6 +25,7 @@ type websocketHandler struct {
 	parent       wssapi.MsgHandler
 	conn         *websocket.Conn
 	app          string
+	token        string //token in websocket url
 	streamName   string
 	playName     string
 	pubName      string
@@ -41,6 +44,8 @@ type websocketHandler struct {
 	sourceIdx    int
 	lastCmd      int
 	mutexWs      sync.Mutex
+	stats        *metrics.SinkStats
+	sess         *session.Session
 }
 
 type playInfo struct {
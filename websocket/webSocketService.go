@@ -1,30 +1,40 @@
 package websocket
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/gorilla/websocket"
 
+	"github.com/use-go/websocket-streamserver/authorizer"
 	"github.com/use-go/websocket-streamserver/httpmux"
 	"github.com/use-go/websocket-streamserver/logger"
+	"github.com/use-go/websocket-streamserver/metrics"
+	"github.com/use-go/websocket-streamserver/session"
+	"github.com/use-go/websocket-streamserver/tlsconf"
 	"github.com/use-go/websocket-streamserver/utils"
 	"github.com/use-go/websocket-streamserver/wssapi"
 )
 
 // WebSocketService to handle webservice business
 type WebSocketService struct {
-	parent wssapi.MsgHandler
+	parent        wssapi.MsgHandler
+	mutexHandlers sync.Mutex
+	handlers      map[*websocketHandler]*websocket.Conn
 }
 
 // WebSocketConfig to store webservice configuration information
 type WebSocketConfig struct {
-	Port  int    `json:"Port"`
-	Route string `json:"Route"`
+	Port  int             `json:"Port"`
+	Route string          `json:"Route"`
+	TLS   *tlsconf.Config `json:"TLS"`
 }
 
 var wsService *WebSocketService
@@ -40,44 +50,43 @@ func (websockService *WebSocketService) Init(msg *wssapi.Msg) (err error) {
 	}
 	fileName := msg.Param1.(string)
 	// Fill the serviceConfig from config file
-	err = websockService.loadConfigFile(fileName)
+	cfg, err := websockService.loadConfigFile(fileName)
 	if err != nil {
 		logger.LOGE(err.Error())
 		return errors.New("load websocket config failed")
 	}
+	serviceConfig = *cfg
+	websockService.handlers = make(map[*websocketHandler]*websocket.Conn)
 	wsService = websockService
 	serviceAddrWithPort = ":" + strconv.Itoa(serviceConfig.Port)
 	httpmux.AddRoute(serviceAddrWithPort, serviceConfig.Route, websockService.ServeHTTP)
+	err = httpmux.AddTLSRoute(serviceConfig.TLS, serviceConfig.Route, websockService.ServeHTTP)
+	if err != nil {
+		logger.LOGE("websocket tls disabled:" + err.Error())
+		err = nil
+	}
 
 	return
 }
 
-// Start interface implemention
+// Start interface implemention,the http and https ports are shared with the other
+// http based services and listened by httpmux once all of them are started
 func (websockService *WebSocketService) Start(msg *wssapi.Msg) (err error) {
-
-	serverMux, err := httpmux.GetPortServe(serviceAddrWithPort)
-	if err != nil {
-		logger.LOGE(err.Error())
-		return errors.New("Somthing error when retrive httpMux of websocket")
-	}
-
-	go func(addr string, handler http.Handler) {
-		for {
-			err := http.ListenAndServe(addr, handler)
-			if err != nil {
-				logger.LOGE(err.Error())
-				continue
-			}
-		}
-
-	}(serviceAddrWithPort, serverMux)
-
 	return
 }
 
-// Stop interface implemention
+// Stop interface implemention,the listeners are shut down by httpmux,
+// the upgraded connections are not tracked by the http server and closed here
 func (websockService *WebSocketService) Stop(msg *wssapi.Msg) (err error) {
-	//TODO....
+	//websocket 连接已经被接管,http server 不会关闭它们
+	websockService.mutexHandlers.Lock()
+	handlers := websockService.handlers
+	websockService.handlers = make(map[*websocketHandler]*websocket.Conn)
+	websockService.mutexHandlers.Unlock()
+	for handler, conn := range handlers {
+		handler.Stop(nil)
+		conn.Close()
+	}
 	return
 }
 
@@ -96,20 +105,33 @@ func (websockService *WebSocketService) HandleTask(task wssapi.Task) (err error)
 	return
 }
 
-// ProcessMessage interface implemention
+// ProcessMessage interface implemention,the websocket config is only read at init,
+// a reload is checked and any change rejected until restart
 func (websockService *WebSocketService) ProcessMessage(msg *wssapi.Msg) (err error) {
+	switch msg.Type {
+	case wssapi.MsgReloadConfig:
+		var cfg *WebSocketConfig
+		cfg, err = websockService.loadConfigFile(msg.Param1.(string))
+		if err != nil {
+			return
+		}
+		if cfg.Port != serviceConfig.Port || cfg.Route != serviceConfig.Route || false == cfg.TLS.Equal(serviceConfig.TLS) {
+			logger.LOGW("websocket config change need restart,the running config is kept")
+		}
+	}
 	return
 }
 
-//loadConfigFile from FS to config Current Service
-func (websockService *WebSocketService) loadConfigFile(fileName string) (err error) {
+//loadConfigFile from FS to a new config,the running one is not touched
+func (websockService *WebSocketService) loadConfigFile(fileName string) (cfg *WebSocketConfig, err error) {
 	data, err := utils.ReadFileAll(fileName)
 	if err != nil {
 		return
 	}
-	err = json.Unmarshal(data, &serviceConfig)
+	cfg = &WebSocketConfig{}
+	err = json.Unmarshal(data, cfg)
 	if err != nil {
-		return
+		return nil, err
 	}
 
 	return
@@ -131,9 +153,18 @@ func (websockService *WebSocketService) ServeHTTP(w http.ResponseWriter, req *ht
 	subProtocol := req.Header.Get("Sec-Websocket-Protocol")
 	respHeader := http.Header{"Sec-Websocket-Protocol": []string{subProtocol}}
 
-	conn, err := upgrader.Upgrade(w, req, respHeader)
+	hijacker := &sessionHijacker{ResponseWriter: w}
+	sess, err := session.Open(metrics.ProtocolWebSocket, req.RemoteAddr, hijacker.close)
 	if err != nil {
-		logger.LOGE("webSocket handshake failed with error " + err.Error() + "of remote :" + conn.RemoteAddr().String())
+		logger.LOGW("refuse websocket client " + req.RemoteAddr + ":" + err.Error())
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	hijacker.sess = sess
+	conn, err := upgrader.Upgrade(hijacker, req, respHeader)
+	if err != nil {
+		sess.Close()
+		logger.LOGE("webSocket handshake failed with error " + err.Error() + "of remote :" + req.RemoteAddr)
 		return
 	}
 	//remmber to close the websocket connetction
@@ -144,18 +175,28 @@ func (websockService *WebSocketService) ServeHTTP(w http.ResponseWriter, req *ht
 
 	//new connection came here
 	logger.LOGT(fmt.Sprintf("new websocket client connected: %s", conn.RemoteAddr().String()))
-	go websockService.handleConn(conn, req, path)
+	go websockService.handleConn(conn, req, path, sess)
 
 }
 
-func (websockService *WebSocketService) handleConn(conn *websocket.Conn, req *http.Request, path string) {
+func (websockService *WebSocketService) handleConn(conn *websocket.Conn, req *http.Request, path string, sess *session.Session) {
+	defer sess.Close()
+	sess.SetAgent(req.UserAgent())
 	handler := &websocketHandler{}
 	msg := &wssapi.Msg{}
 	msg.Param1 = conn
 	msg.Param2 = path
 	handler.Init(msg)
+	handler.token = authorizer.TokenFromQuery(req.URL.RawQuery)
+	handler.sess = sess
+	websockService.mutexHandlers.Lock()
+	websockService.handlers[handler] = conn
+	websockService.mutexHandlers.Unlock()
 	//close the handling proc
 	defer func() {
+		websockService.mutexHandlers.Lock()
+		delete(websockService.handlers, handler)
+		websockService.mutexHandlers.Unlock()
 		handler.processWSMessage(nil)
 	}()
 
@@ -195,6 +236,38 @@ func (websockService *WebSocketService) handleConn(conn *websocket.Conn, req *ht
 	}
 }
 
+//sessionHijacker count bytes of the hijacked connection in the session,
+//the session is kicked by closing it
+type sessionHijacker struct {
+	http.ResponseWriter
+	sess  *session.Session
+	mutex sync.Mutex
+	conn  net.Conn
+}
+
+func (hijacker *sessionHijacker) Hijack() (conn net.Conn, brw *bufio.ReadWriter, err error) {
+	h, ok := hijacker.ResponseWriter.(http.Hijacker)
+	if false == ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	conn, brw, err = h.Hijack()
+	if err != nil {
+		return
+	}
+	hijacker.mutex.Lock()
+	hijacker.conn = conn
+	hijacker.mutex.Unlock()
+	return hijacker.sess.Conn(conn), brw, nil
+}
+
+func (hijacker *sessionHijacker) close() {
+	hijacker.mutex.Lock()
+	defer hijacker.mutex.Unlock()
+	if hijacker.conn != nil {
+		hijacker.conn.Close()
+	}
+}
+
 // SetParent handler for websocketservice
 func (websockService *WebSocketService) SetParent(parent wssapi.MsgHandler) {
 	websockService.parent = parent
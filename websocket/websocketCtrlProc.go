@@ -7,11 +7,15 @@ package websocket
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"strconv"
 
 	"github.com/gorilla/websocket"
+	"github.com/use-go/websocket-streamserver/authorizer"
+	"github.com/use-go/websocket-streamserver/events/eVODEvent"
 	"github.com/use-go/websocket-streamserver/logger"
 	"github.com/use-go/websocket-streamserver/mediatype/amf"
+	"github.com/use-go/websocket-streamserver/metrics"
 	"github.com/use-go/websocket-streamserver/rtspcli"
 	"github.com/use-go/websocket-streamserver/utils"
 	"github.com/use-go/websocket-streamserver/wssapi"
@@ -406,10 +410,26 @@ func (websockHandler *websocketHandler) ctrlPause(data []byte) (err error) {
 
 func (websockHandler *websocketHandler) ctrlSeek(data []byte) (err error) {
 	st := &stSeek{}
+	defer func() {
+		if err != nil {
+			logger.LOGE("seek failed:" + err.Error())
+			websockHandler.sendWsStatus(websockHandler.conn, WSStatusStatus, NetStreamSeekFailed, st.Req)
+		}
+	}()
 	err = json.Unmarshal(data, st)
 	if err != nil {
 		return err
 	}
+	if st.Offset < 0 {
+		websockHandler.sendWsStatus(websockHandler.conn, WSStatusStatus, NetStreamSeekInvalidTime, st.Req)
+		return
+	}
+	switch websockHandler.lastCmd {
+	case WSCPlay, WSCPlay2, WSCPause:
+		err = websockHandler.doSeek(st)
+	default:
+		err = errors.New("invalid last cmd in seek")
+	}
 	return
 }
 
@@ -472,6 +492,7 @@ func (websockHandler *websocketHandler) doClose() (err error) {
 	if websockHandler.hasSink {
 		websockHandler.delSink(websockHandler.streamName, websockHandler.clientID)
 	}
+	metrics.DelSink(websockHandler.stats)
 	if websockHandler.isPublish {
 		websockHandler.stopPublish()
 	}
@@ -485,13 +506,29 @@ func (websockHandler *websocketHandler) doPlay(st *stPlay) (err error) {
 
 	logger.LOGT("play")
 	websockHandler.clientID = utils.GenerateGUID()
+	name, token := authorizer.SplitToken(st.Name)
 	if len(websockHandler.app) > 0 {
-		websockHandler.streamName = websockHandler.app + "/" + st.Name
+		websockHandler.streamName = websockHandler.app + "/" + name
 	} else {
-		websockHandler.streamName = st.Name
+		websockHandler.streamName = name
+	}
+	//token in play cmd,stream name,then websocket url
+	if len(st.Token) > 0 {
+		token = st.Token
+	} else if len(token) == 0 {
+		token = websockHandler.token
+	}
+	err = authorizer.Check(&authorizer.Request{Action: authorizer.ActionPlay,
+		Protocol:   authorizer.ProtocolWebSocket,
+		StreamName: websockHandler.streamName,
+		Token:      token,
+		RemoteAddr: websockHandler.conn.RemoteAddr().String()})
+	if err != nil {
+		return
 	}
 
-	err = websockHandler.addSink(websockHandler.streamName, websockHandler.clientID, websockHandler)
+	//start 为点播起始位置,单位毫秒
+	err = websockHandler.addSink(websockHandler.streamName, websockHandler.clientID, websockHandler, int64(st.Start))
 	if err != nil {
 		logger.LOGE("add sink failed: " + err.Error())
 		return
@@ -509,18 +546,36 @@ func (websockHandler *websocketHandler) doPlay2() (err error) {
 
 func (websockHandler *websocketHandler) doResume(st *stResume) (err error) {
 	logger.LOGT("resume play start")
+	//直播流没有暂停,不需要恢复
+	if _, errVOD := websockHandler.vodControl(eVODEvent.VODResume, 0); errVOD == nil {
+		err = websockHandler.sendWsStatus(websockHandler.conn, WSStatusStatus, NetStreamUnpauseNotify, st.Req)
+		if err != nil {
+			return
+		}
+	}
 	err = websockHandler.sendWsStatus(websockHandler.conn, WSStatusStatus, NetStreamPlayStart, st.Req)
 	return
 }
 
 func (websockHandler *websocketHandler) doPause(st *stPause) (err error) {
-	logger.LOGT("pause do nothing")
-
+	logger.LOGT("pause")
+	//点播暂停读文件,直播只是丢弃数据
+	websockHandler.vodControl(eVODEvent.VODPause, 0)
 	websockHandler.sendWsStatus(websockHandler.conn, WSStatusStatus, NetStreamPauseNotify, st.Req)
 	return
 }
 
-func (websockHandler *websocketHandler) doSeek() (err error) {
+func (websockHandler *websocketHandler) doSeek(st *stSeek) (err error) {
+	position, err := websockHandler.vodControl(eVODEvent.VODSeek, int64(st.Offset))
+	if err != nil {
+		return
+	}
+	logger.LOGT(fmt.Sprintf("seek to %d ms", position))
+	if WSCPause == websockHandler.lastCmd {
+		websockHandler.vodControl(eVODEvent.VODResume, 0)
+		websockHandler.lastCmd = WSCPlay
+	}
+	err = websockHandler.sendWsStatus(websockHandler.conn, WSStatusStatus, NetStreamSeekNotify, st.Req)
 	return
 }
 
@@ -10,9 +10,11 @@ import (
 
 	"github.com/gorilla/websocket"
 	"github.com/use-go/websocket-streamserver/events/eStreamerEvent"
+	"github.com/use-go/websocket-streamserver/events/eVODEvent"
 	"github.com/use-go/websocket-streamserver/logger"
 	"github.com/use-go/websocket-streamserver/mediatype/flv"
 	"github.com/use-go/websocket-streamserver/mediatype/mp4"
+	"github.com/use-go/websocket-streamserver/metrics"
 	"github.com/use-go/websocket-streamserver/wssapi"
 )
 
@@ -25,6 +27,7 @@ func (websockHandler *websocketHandler) addSource(streamName string) (id int, sr
 		return
 	}
 	websockHandler.hasSource = true
+	websockHandler.sess.SetStream(streamName, true)
 	return
 }
 
@@ -39,14 +42,19 @@ func (websockHandler *websocketHandler) delSource(streamName string, id int) (er
 	return
 }
 
-func (websockHandler *websocketHandler) addSink(streamName, clientID string, sinker wssapi.MsgHandler) (err error) {
-	taskAddsink := &eStreamerEvent.EveAddSink{StreamName: streamName, SinkId: clientID, Sinker: sinker}
+func (websockHandler *websocketHandler) addSink(streamName, clientID string, sinker wssapi.MsgHandler, startMs int64) (err error) {
+	taskAddsink := &eStreamerEvent.EveAddSink{StreamName: streamName, SinkId: clientID, Sinker: sinker, StartMs: startMs}
+	metrics.DelSink(websockHandler.stats)
+	websockHandler.stats = metrics.AddSink(metrics.ProtocolWebSocket, streamName, clientID)
 	err = wssapi.HandleTask(taskAddsink)
 	if err != nil {
+		metrics.DelSink(websockHandler.stats)
+		websockHandler.stats = nil
 		logger.LOGE(fmt.Sprintf("add sink %s %s failed :%s", streamName, clientID, err.Error()))
 		return
 	}
 	websockHandler.hasSink = taskAddsink.Added
+	websockHandler.sess.SetStream(streamName, false)
 	return
 }
 
@@ -54,6 +62,7 @@ func (websockHandler *websocketHandler) delSink(streamName, clientID string) (er
 	taskDelSink := &eStreamerEvent.EveDelSink{StreamName: streamName, SinkId: clientID}
 	err = wssapi.HandleTask(taskDelSink)
 	websockHandler.hasSink = false
+	metrics.DelSink(websockHandler.stats)
 	if err != nil {
 		logger.LOGE(fmt.Sprintf("del sink %s %s failed:\n%s", streamName, clientID, err.Error()))
 	}
@@ -61,6 +70,24 @@ func (websockHandler *websocketHandler) delSink(streamName, clientID string) (er
 	return
 }
 
+//vodControl 只有点播流支持,直播流返回错误
+func (websockHandler *websocketHandler) vodControl(action string, positionMs int64) (position int64, err error) {
+	if false == websockHandler.hasSink {
+		err = errors.New("websocket client not playing")
+		return
+	}
+	taskCtrl := &eVODEvent.EveVODControl{StreamName: websockHandler.streamName,
+		SinkId:     websockHandler.clientID,
+		Action:     action,
+		PositionMs: positionMs}
+	err = wssapi.HandleTask(taskCtrl)
+	if err != nil {
+		return
+	}
+	position = taskCtrl.PositionMs
+	return
+}
+
 func (websockHandler *websocketHandler) appendFlvTag(tag *flv.FlvTag) (err error) {
 	if false == websockHandler.isPlaying {
 		err = errors.New("websocket client not playing")
@@ -98,7 +125,7 @@ func (websockHandler *websocketHandler) appendFlvTag(tag *flv.FlvTag) (err error
 		return
 	}
 	if false == websockHandler.stPlay.keyFrameWrited && tag.TagType == flv.FlvTagVideo {
-		if false == websockHandler.stPlay.keyFrameWrited && ((tag.Data[0] >> 4) == 1) {
+		if false == websockHandler.stPlay.keyFrameWrited && flv.IsKeyFrame(tag) {
 			websockHandler.stPlay.beginTime = tag.Timestamp
 			websockHandler.stPlay.keyFrameWrited = true
 		}
@@ -129,5 +156,8 @@ func (websockHandler *websocketHandler) sendFmp4Slice(slice *mp4.FMP4Slice) (err
 	dataSend[0] = byte(slice.Type)
 	copy(dataSend[1:], slice.Data)
 	err = websockHandler.conn.WriteMessage(websocket.BinaryMessage, dataSend)
+	if err == nil {
+		websockHandler.stats.AddBytes(len(dataSend))
+	}
 	return
 }
@@ -56,6 +56,12 @@ const (
 	OBJRTSPServer      = "RTSPServer"
 	OBJHLSServer       = "HLSServer"
 	OBJDASHServer      = `DASHServer`
+	OBJHTTPFLVServer   = "HTTPFLVServer"
+	OBJRecorderServer  = "RecorderServer"
+	OBJVODServer       = "VODServer"
+	OBJWebRTCServer    = "WebRTCServer"
+	OBJSRTServer       = "SRTServer"
+	OBJUDPTSServer     = "UDPTSServer"
 )
 
 // MSG Type to handle different Event
@@ -68,4 +74,5 @@ const (
 	MsgPublishStop       = "MSG.NetStream.Publish.Stop"
 	MsgPlayStart         = "MSG.NetStream.Play.Start"
 	MsgPlayStop          = "MSG.NetStream.Play.Stop"
+	MsgReloadConfig      = "MSG.Service.Reload.Config" //Param1 config file name
 )